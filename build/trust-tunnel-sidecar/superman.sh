@@ -17,18 +17,22 @@ set -e
 
 usage() {
     echo "Usage:"
-    echo "superman.sh -u USER [-g GROUP] command"
+    echo "superman.sh -u USER [-g GROUP] [-T | -w DIR] command"
     echo "Description:"
     echo "USER: user name for the command."
     echo "GROUP: group name for the command."
+    echo "-T: run the command with the tools of the sidecar, the root of the target is at \$TARGET_ROOT."
+    echo "DIR: working directory of the command in the target."
     exit 255
 }
 
 # Parse options.
-while getopts 'u:g:' OPT; do
+while getopts 'u:g:Tw:' OPT; do
     case $OPT in
         u) user="$OPTARG";;
         g) group="$OPTARG";;
+        T) tools=1;;
+        w) wd="$OPTARG";;
         ?) usage;;
     esac
 done
@@ -51,9 +55,43 @@ then
 	fi
 fi
 
+# Enter the user namespace of the target as well if it's remapped, e.g. dockerd with userns-remap,
+# as the uid and gid are relative to it.
+userns=""
+if [ "$(readlink /proc/1/ns/user)"x != "$(readlink /proc/self/ns/user)"x ]
+then
+	userns="-U"
+fi
+
+# Run the command with the tools of the sidecar in the namespaces of the target except the mount one,
+# for targets without shells or coreutils. The uid and gid are looked up in the target's files, as its
+# commands may not exist.
+if [ "$tools"x = "1"x ]
+then
+	export TARGET_ROOT=/proc/1/root
+	uid=$(awk -F: -v name="$user" '$1 == name {print $3}' "$TARGET_ROOT/etc/passwd" 2>/dev/null)
+	gid=$(awk -F: -v name="$group" '$1 == name {print $3}' "$TARGET_ROOT/etc/group" 2>/dev/null)
+
+	# Images without the user database are run as root.
+	if [ "$user"x = "root"x ]
+	then
+		uid=${uid:-0}
+		gid=${gid:-0}
+	fi
+
+	if [ "$uid"x = ""x ] || [ "$gid"x = ""x ]
+	then
+		echo "user $user or group $group not found in the target" >&2
+		exit 255
+	fi
+
+	cd "$TARGET_ROOT"
+	exec nsenter -t 1 $userns -u -i -n -p -S "$uid" -G "$gid" "$@"
+fi
+
 # Get uid and gid from user name.
 uid=$(nsenter -t 1 -m id -u "$user")
 gid=$(nsenter -t 1 -m getent group "${group}" | cut -d: -f3)
 
-# Execute command with user's uid and gid.
-nsenter -t 1 -m -u -i -n -p -S "$uid" -G "$gid" "$@"
+# Execute command with user's uid and gid, in the working directory if it's given.
+nsenter -t 1 $userns -m -u -i -n -p -S "$uid" -G "$gid" ${wd:+"--wd=$wd"} "$@"
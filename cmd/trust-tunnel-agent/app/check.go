@@ -0,0 +1,692 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package app
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"text/template"
+	"time"
+	"trust-tunnel/pkg/common/logutil"
+	"trust-tunnel/pkg/trust-tunnel-agent/auth"
+	"trust-tunnel/pkg/trust-tunnel-agent/backend"
+	"trust-tunnel/pkg/trust-tunnel-agent/recordstore"
+	"trust-tunnel/pkg/trust-tunnel-agent/session"
+	"trust-tunnel/pkg/trust-tunnel-client/fips"
+
+	"github.com/BurntSushi/toml"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// configReport collects the problems found in the config.
+type configReport struct {
+	errors   []string
+	warnings []string
+}
+
+// errorf records an error of the option of the given key.
+func (r *configReport) errorf(key, format string, args ...interface{}) {
+	r.errors = append(r.errors, fmt.Sprintf("%s: %s", key, fmt.Sprintf(format, args...)))
+}
+
+// warnf records a warning of the option of the given key.
+func (r *configReport) warnf(key, format string, args ...interface{}) {
+	r.warnings = append(r.warnings, fmt.Sprintf("%s: %s", key, fmt.Sprintf(format, args...)))
+}
+
+// file checks the file of the given key exists if it's set, or if it's required.
+func (r *configReport) file(key, path string, required bool) {
+	if path == "" {
+		if required {
+			r.errorf(key, "is required")
+		}
+
+		return
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		r.errorf(key, "%v", err)
+	} else if info.IsDir() {
+		r.errorf(key, "%s is a directory", path)
+	}
+}
+
+// nonNegative checks the duration of the given key isn't negative.
+func (r *configReport) nonNegative(key string, d time.Duration) {
+	if d < 0 {
+		r.errorf(key, "%v is negative", d)
+	}
+}
+
+// url checks the URL of the given key is an absolute one with one of the schemes.
+func (r *configReport) url(key, rawURL string, schemes ...string) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		r.errorf(key, "%v", err)
+
+		return
+	}
+
+	for _, scheme := range schemes {
+		if u.Scheme == scheme && u.Host != "" {
+			return
+		}
+	}
+
+	r.errorf(key, "%q isn't a %v URL", rawURL, schemes)
+}
+
+// newCheckConfigCommand creates the command validating the config before rollout.
+func newCheckConfigCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:          "check-config",
+		Short:        "Validate the config of trust-tunnel-agent",
+		Long:         "Parse the config, validate the options and the files they refer to, and report the problems found",
+		SilenceUsage: true,
+		// The error is printed by main.
+		SilenceErrors: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var options Option
+			if err := loadConfig(cmd, &options); err != nil {
+				return err
+			}
+
+			report := checkConfig(&options)
+
+			// Decode the file again for the keys unknown to the agent, it's absent if no key is found.
+			md, _ := toml.DecodeFile(configPath, &Option{})
+			for _, key := range md.Undecoded() {
+				report.warnf(key.String(), "unknown option")
+			}
+
+			checkDurationKeys(report, md)
+
+			if !report.print(cmd.OutOrStdout()) {
+				return fmt.Errorf("config is invalid")
+			}
+
+			return nil
+		},
+	}
+
+	addConfigFlags(cmd)
+
+	return cmd
+}
+
+// print prints the report, and returns whether the config is valid.
+func (r *configReport) print(w io.Writer) bool {
+	for _, e := range r.errors {
+		fmt.Fprintf(w, "ERROR %s\n", e)
+	}
+
+	for _, warning := range r.warnings {
+		fmt.Fprintf(w, "WARN  %s\n", warning)
+	}
+
+	if len(r.errors) > 0 {
+		return false
+	}
+
+	fmt.Fprintf(w, "config is valid with %d warnings\n", len(r.warnings))
+
+	return true
+}
+
+// checkConfig validates the options and the files they refer to.
+func checkConfig(opt *Option) *configReport {
+	r := &configReport{}
+
+	if port, err := strconv.Atoi(opt.Port); err != nil || port <= 0 || port > 65535 {
+		r.errorf("port", "%q isn't a valid port", opt.Port)
+	}
+
+	if opt.LogConfig.Level != "" {
+		if _, err := logrus.ParseLevel(opt.LogConfig.Level); err != nil {
+			r.errorf("log_config.level", "%v", err)
+		}
+	}
+
+	if days := opt.LogConfig.ExpireDays; days < 0 || days >= 365 {
+		r.warnf("log_config.expire_days", "%d is out of (0, 365), the default is used", days)
+	}
+
+	if addr := opt.LogConfig.AuditSyslog; addr != "" {
+		if _, _, err := logutil.ParseSyslogAddr(addr); err != nil {
+			r.errorf("log_config.audit_syslog", "%v", err)
+		}
+	}
+
+	checkSessionConfig(r, opt)
+	checkContainerConfig(r, opt)
+	checkTLSConfig(r, opt)
+	checkAuthConfig(r, &opt.AuthConfig)
+	checkTenantConfig(r, &opt.TenantConfig, opt.AuthConfig.CertProxies)
+	checkNotifyConfig(r, &opt.NotifyConfig)
+	checkServiceConfig(r, opt)
+
+	return r
+}
+
+// checkSessionConfig validates the options of the sessions.
+func checkSessionConfig(r *configReport, opt *Option) {
+	c := &opt.SessionConfig
+
+	switch c.PhysTunnel {
+	case "nsenter", "sshd":
+	case "":
+		r.warnf("session_config.phys_tunnel", "isn't set, sshd is used")
+	default:
+		r.errorf("session_config.phys_tunnel", "unknown tunnel %q, nsenter or sshd is supported", c.PhysTunnel)
+	}
+
+	r.nonNegative("session_config.delay_release_session_timeout", c.DelayReleaseSessionTimeout)
+	r.nonNegative("session_config.idle_timeout", c.IdleTimeout)
+	r.nonNegative("session_config.idle_warning", c.IdleWarning)
+
+	if c.IdleWarning > 0 && (c.IdleTimeout <= 0 || c.IdleWarning >= c.IdleTimeout) {
+		r.warnf("session_config.idle_warning", "%v isn't shorter than idle_timeout %v, no warning is shown", c.IdleWarning, c.IdleTimeout)
+	}
+
+	switch c.ExecTracer {
+	case "", backend.ExecTracerProc:
+	case backend.ExecTracerEBPF:
+		if !c.ExecAudit && !opt.AuthConfig.BreakGlass.Enabled {
+			r.warnf("session_config.exec_tracer", "no command is audited without exec_audit or break-glass access")
+		}
+	default:
+		r.errorf("session_config.exec_tracer", "unknown tracer %q, proc or ebpf is supported", c.ExecTracer)
+	}
+
+	r.nonNegative("session_config.max_duration", c.MaxDuration)
+	r.nonNegative("session_config.shutdown_timeout", c.ShutdownTimeout)
+
+	for sensitivity, interval := range c.Watermark {
+		if interval <= 0 {
+			r.errorf("session_config.watermark."+sensitivity, "interval %v isn't positive", interval)
+		}
+	}
+
+	for _, pattern := range c.ForwardEnv {
+		if _, err := path.Match(pattern, ""); err != nil {
+			r.errorf("session_config.forward_env", "invalid pattern %q: %v", pattern, err)
+		}
+
+		if pattern == "*" {
+			r.warnf("session_config.forward_env", "\"*\" forwards any variable of the clients, list the custom ones, e.g. \"APP_*\"")
+		}
+	}
+
+	n := &opt.NetworkConfig
+	r.nonNegative("network_config.tcp_keepalive", n.TCPKeepAlive)
+	r.nonNegative("network_config.ping_period", n.PingPeriod)
+
+	if n.ReadBufferSize < 0 || n.WriteBufferSize < 0 {
+		r.errorf("network_config", "buffer sizes can't be negative")
+	}
+
+	if n.MaxHeaderBytes < 0 {
+		r.errorf("network_config.max_header_bytes", "%d is negative", n.MaxHeaderBytes)
+	}
+
+	if n.FrameSize < 0 || n.BulkFrameSize < 0 {
+		r.errorf("network_config", "frame sizes can't be negative")
+	} else if n.FrameSize > 0 && n.BulkFrameSize > 0 && n.BulkFrameSize < n.FrameSize {
+		r.errorf("network_config.bulk_frame_size", "%d is smaller than frame_size %d", n.BulkFrameSize, n.FrameSize)
+	}
+
+	if c.MaxCommandLength < 0 {
+		r.errorf("session_config.max_command_length", "%d is negative", c.MaxCommandLength)
+	}
+
+	if c.RecordDir != "" && !path.IsAbs(c.RecordDir) {
+		r.errorf("session_config.record_dir", "%q isn't an absolute path", c.RecordDir)
+	} else if c.RecordDir == "" && c.RecordInput {
+		r.warnf("session_config.record_input", "nothing is recorded without record_dir")
+	}
+
+	if c.RecordDir == "" && opt.AuthConfig.BreakGlass.Enabled {
+		r.errorf("session_config.record_dir", "is required for break-glass access, so that the sessions are recorded")
+	}
+
+	checkRecordUploadConfig(r, c)
+
+	if run := &opt.RunConfig; run.Enabled {
+		if run.MaxBodyBytes < 0 || run.MaxOutputBytes < 0 {
+			r.errorf("run_config", "byte limits can't be negative")
+		}
+
+		r.nonNegative("run_config.default_timeout", run.DefaultTimeout)
+		r.nonNegative("run_config.max_timeout", run.MaxTimeout)
+
+		if run.MaxTimeout > 0 && run.DefaultTimeout > run.MaxTimeout {
+			r.errorf("run_config.default_timeout", "%v exceeds max_timeout %v", run.DefaultTimeout, run.MaxTimeout)
+		}
+	}
+
+	if f := &opt.FileConfig; f.Enabled {
+		if f.MaxBytes < 0 {
+			r.errorf("file_config.max_bytes", "%d is negative", f.MaxBytes)
+		}
+
+		for _, p := range append(append([]string{}, f.AllowedPaths...), f.DeniedPaths...) {
+			if !path.IsAbs(p) {
+				r.errorf("file_config", "path %q isn't absolute", p)
+			}
+		}
+	}
+
+	if c := &opt.CopyConfig; c.Enabled {
+		if c.MaxBytes < 0 {
+			r.errorf("copy_config.max_bytes", "%d is negative", c.MaxBytes)
+		}
+
+		for _, p := range append(append([]string{}, c.AllowedPaths...), c.DeniedPaths...) {
+			if !path.IsAbs(p) {
+				r.errorf("copy_config", "path %q isn't absolute", p)
+			}
+		}
+	}
+
+	if f := &opt.ForwardConfig; f.Enabled {
+		if f.MaxStreams < 0 {
+			r.errorf("forward_config.max_streams", "%d is negative", f.MaxStreams)
+		}
+
+		for _, port := range f.AllowedPorts {
+			if port < 1 || port > 65535 {
+				r.errorf("forward_config.allowed_ports", "port %d isn't in 1..65535", port)
+			}
+		}
+
+		for _, port := range f.ReversePorts {
+			if port < 1 || port > 65535 {
+				r.errorf("forward_config.reverse_ports", "port %d isn't in 1..65535", port)
+			}
+		}
+
+		for _, pattern := range f.AllowedHosts {
+			if _, err := path.Match(pattern, ""); err != nil {
+				r.errorf("forward_config.allowed_hosts", "invalid pattern %q: %v", pattern, err)
+			}
+		}
+	}
+
+	r.nonNegative("verb_config.cache.ttl", opt.VerbConfig.Cache.TTL)
+
+	if opt.VerbConfig.Cache.MaxEntries < 0 {
+		r.errorf("verb_config.cache.max_entries", "%d is negative", opt.VerbConfig.Cache.MaxEntries)
+	}
+
+	for _, name := range opt.VerbConfig.Allowed {
+		if _, ok := session.LookupVerb(name); !ok {
+			r.errorf("verb_config.allowed", "unknown verb %q, %v are registered", name, session.VerbNames())
+		}
+	}
+
+	t := &opt.TagConfig
+	if t.MaxTags < 0 || t.MaxValueLength < 0 || t.MetricValues < 0 {
+		r.errorf("tag_config", "limits can't be negative")
+	}
+
+	for key, pattern := range t.Patterns {
+		if _, err := regexp.Compile(pattern); err != nil {
+			r.errorf("tag_config.patterns."+key, "invalid pattern: %v", err)
+		}
+	}
+
+	for _, key := range t.Required {
+		if len(t.Allowed) > 0 && !slices.Contains(t.Allowed, key) {
+			r.errorf("tag_config.required", "tag %q isn't allowed", key)
+		}
+	}
+
+	o := &opt.ObserveConfig
+	if o.Enabled && o.MaxObservers < 0 {
+		r.errorf("observe_config.max_observers", "%d is negative", o.MaxObservers)
+	}
+
+	if len(o.DualControl) > 0 && !o.Enabled {
+		r.errorf("observe_config.dual_control", "the witnesses can't observe the sessions unless enabled is set")
+	}
+
+	r.nonNegative("observe_config.witness_timeout", o.WitnessTimeout)
+}
+
+// checkContainerConfig validates the options of the container runtime and the sidecars.
+func checkContainerConfig(r *configReport, opt *Option) {
+	c := &opt.ContainerConfig
+
+	switch c.ContainerRuntime {
+	case session.Docker, session.Containerd:
+	case "":
+		r.warnf("container_config.container_runtime", "isn't set, container sessions are unavailable")
+	default:
+		r.errorf("container_config.container_runtime", "unknown runtime %q, docker or containerd is supported", c.ContainerRuntime)
+	}
+
+	r.nonNegative("container_config.health_check_period", c.HealthCheckPeriod)
+	r.nonNegative("container_config.paused_wait_timeout", c.PausedWaitTimeout)
+
+	switch c.CleanMode {
+	case "", session.CleanModeSidecar:
+		if c.ContainerRuntime != "" && opt.SidecarConfig.Limit <= 0 {
+			r.errorf("sidecar_config.limit", "%d isn't positive, no sidecar can be created", opt.SidecarConfig.Limit)
+		}
+
+		if c.ContainerRuntime != "" && opt.SidecarConfig.Image == "" {
+			r.errorf("sidecar_config.image", "is required in the sidecar clean mode")
+		}
+	case session.CleanModeNsexec:
+	default:
+		r.errorf("container_config.clean_mode", "unknown mode %q, sidecar or nsexec is supported", c.CleanMode)
+	}
+
+	s := &opt.SidecarConfig
+	r.file("sidecar_config.image_tarball", s.ImageTarball, false)
+
+	if s.PerContainerLimit < 0 {
+		r.errorf("sidecar_config.per_container_limit", "%d is negative", s.PerContainerLimit)
+	}
+
+	if v := &s.Verify; v.Enabled {
+		if len(v.PublicKeys) == 0 && len(v.KeylessIdentities) == 0 && len(v.ImageIDs) == 0 {
+			r.errorf("sidecar_config.verify", "public_keys, keyless_identities or image_ids is required")
+		}
+
+		for _, key := range v.PublicKeys {
+			r.file("sidecar_config.verify.public_keys", key, true)
+		}
+
+		if v.CosignPath != "" {
+			if _, err := exec.LookPath(v.CosignPath); err != nil {
+				r.errorf("sidecar_config.verify.cosign_path", "%v", err)
+			}
+		}
+
+		r.nonNegative("sidecar_config.verify.timeout", v.Timeout)
+	}
+}
+
+// checkTLSConfig validates the certificates of the server.
+func checkTLSConfig(r *configReport, opt *Option) {
+	t := &opt.TLSConfig
+	r.file("tls_config.tls_ca", t.TLSCA, t.TLSVerify)
+	r.file("tls_config.tls_cert", t.TLSCert, t.TLSVerify)
+	r.file("tls_config.tls_key", t.TLSKey, t.TLSVerify)
+
+	n := &opt.NTLSConfig
+	r.file("ntls_config.ntls_sign_cert_file", n.NTLSSignCertFile, n.NTLSVerify)
+	r.file("ntls_config.ntls_sign_key_file", n.NTLSSignKeyFile, n.NTLSVerify)
+	r.file("ntls_config.ntls_enc_cert_file", n.NTLSEncCertFile, n.NTLSVerify)
+	r.file("ntls_config.ntls_enc_key_file", n.NTLSEncKeyFile, n.NTLSVerify)
+	r.file("ntls_config.ntls_ca_file", n.NTLSCaFile, n.NTLSVerify)
+
+	if !t.TLSVerify && !n.NTLSVerify {
+		r.warnf("tls_config.tls_verify", "is disabled, sessions are served in plaintext")
+	}
+
+	if t.FIPS {
+		checkFIPS(r, opt)
+	}
+}
+
+// checkFIPS validates that the agent can run in the FIPS mode.
+func checkFIPS(r *configReport, opt *Option) {
+	fips.Enable()
+
+	t := &opt.TLSConfig
+	if !t.TLSVerify && !opt.ReverseConfig.Enabled {
+		r.errorf("tls_config.fips", "requires tls_verify, sessions can't be served in plaintext")
+	}
+
+	if opt.NTLSConfig.NTLSVerify {
+		r.errorf("tls_config.fips", "NTLS ciphers aren't FIPS-approved")
+	}
+
+	for _, c := range []struct{ name, cert, key string }{
+		{"tls_config.tls_cert", t.TLSCert, t.TLSKey},
+		{"monitor_config.tls_cert", opt.MonitorConfig.TLSCert, opt.MonitorConfig.TLSKey},
+		{"reverse_config.tls_cert", opt.ReverseConfig.TLSCert, opt.ReverseConfig.TLSKey},
+	} {
+		if c.cert == "" {
+			continue
+		}
+
+		// The unreadable files are reported by the checks of the sections.
+		if cert, err := tls.LoadX509KeyPair(c.cert, c.key); err == nil {
+			if err = fips.CheckCertificate(&cert); err != nil {
+				r.errorf(c.name, "%v", err)
+			}
+		}
+	}
+}
+
+// checkAuthConfig validates the options of the auth handler.
+func checkAuthConfig(r *configReport, c *auth.Config) {
+	if c.Name == "" {
+		r.warnf("auth_config.name", "isn't set, every request is allowed")
+	} else if !auth.HasAuthHandlerFactory(c.Name) {
+		r.errorf("auth_config.name", "unknown auth handler %q", c.Name)
+	}
+
+	if c.BreakGlass.Enabled {
+		if len(c.BreakGlass.Users) == 0 {
+			r.errorf("auth_config.break_glass.users", "is required for break-glass access, nobody is allowed otherwise")
+		}
+
+		if c.BreakGlass.AlertURL == "" {
+			r.errorf("auth_config.break_glass.alert_url", "is required for break-glass access")
+		} else {
+			r.url("auth_config.break_glass.alert_url", c.BreakGlass.AlertURL, "http", "https")
+		}
+	}
+
+	r.nonNegative("auth_config.cache.ttl", c.Cache.TTL)
+	r.nonNegative("auth_config.cache.negative_ttl", c.Cache.NegativeTTL)
+
+	if c.Cache.MaxEntries < 0 {
+		r.errorf("auth_config.cache.max_entries", "%d is negative", c.Cache.MaxEntries)
+	}
+}
+
+// checkTenantConfig validates the tenants and their policies.
+func checkTenantConfig(r *configReport, c *backend.TenantConfig, certProxies []string) {
+	switch c.Source {
+	case "":
+		if len(c.Tenants) > 0 {
+			r.warnf("tenant_config.source", "isn't set, the tenants are ignored")
+		}
+
+		return
+	case backend.TenantFromHeader:
+		if len(c.TrustedProxies) == 0 && len(certProxies) == 0 {
+			r.errorf("tenant_config.trusted_proxies", "no proxy is trusted to set the tenant header")
+		}
+	case backend.TenantFromCertOU:
+	default:
+		r.errorf("tenant_config.source", "unknown source %q, header or cert_ou is supported", c.Source)
+	}
+
+	names := make(map[string]bool)
+
+	for i, t := range c.Tenants {
+		key := fmt.Sprintf("tenant_config.tenants[%d]", i)
+
+		switch {
+		case t.Name == "":
+			r.errorf(key+".name", "is required")
+		case names[t.Name]:
+			r.errorf(key+".name", "duplicate tenant %s", t.Name)
+		}
+
+		names[t.Name] = true
+
+		if t.AuthHandler != "" && !auth.HasAuthHandlerFactory(t.AuthHandler) {
+			r.errorf(key+".auth_handler", "unknown auth handler %q", t.AuthHandler)
+		}
+
+		if t.MaxCpus < 0 || t.MaxMemoryMB < 0 {
+			r.errorf(key, "resource caps can't be negative")
+		}
+	}
+}
+
+// checkRecordUploadConfig validates the object storage the recordings are uploaded to.
+func checkRecordUploadConfig(r *configReport, c *backend.SessionConfig) {
+	u := &c.RecordUpload
+	if u.Driver == "" {
+		return
+	}
+
+	const key = "session_config.record_upload"
+
+	if c.RecordDir == "" {
+		r.errorf(key, "nothing is uploaded without record_dir")
+	}
+
+	if u.Driver != recordstore.DriverS3 && u.Driver != recordstore.DriverOSS {
+		r.errorf(key+".driver", "unknown driver %q, %q or %q is supported", u.Driver, recordstore.DriverS3, recordstore.DriverOSS)
+	} else if u.Driver == recordstore.DriverS3 && u.Region == "" {
+		r.errorf(key+".region", "is required by %s", u.Driver)
+	}
+
+	r.url(key+".endpoint", u.Endpoint, "https", "http")
+
+	if u.Bucket == "" || u.AccessKeyID == "" || u.SecretAccessKey == "" {
+		r.errorf(key, "bucket, access_key_id and secret_access_key are required")
+	}
+
+	if u.EncryptionKey == "" {
+		r.warnf(key+".encryption_key", "the recordings are uploaded unencrypted")
+	} else if _, err := recordstore.ParseKey(u.EncryptionKey); err != nil {
+		r.errorf(key+".encryption_key", "%v", err)
+	}
+
+	r.nonNegative(key+".retention", u.Retention)
+	r.nonNegative(key+".interval", u.Interval)
+}
+
+// checkNotifyConfig validates the webhooks notified of the session lifecycle events.
+func checkNotifyConfig(r *configReport, c *backend.NotifyConfig) {
+	for i, w := range c.Webhooks {
+		key := fmt.Sprintf("notify_config.webhooks[%d]", i)
+
+		if u, err := url.Parse(w.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			r.errorf(key+".url", "%q isn't an http or https URL", w.URL)
+		}
+
+		switch w.Type {
+		case "", backend.WebhookGeneric, backend.WebhookSlack, backend.WebhookDingTalk:
+		default:
+			r.errorf(key+".type", "unknown type %q, generic, slack or dingtalk is supported", w.Type)
+		}
+
+		for _, event := range w.Events {
+			switch event {
+			case backend.EventSessionStart, backend.EventSessionEnd, backend.EventSessionDenied:
+			default:
+				r.errorf(key+".events", "unknown event %q", event)
+			}
+		}
+
+		if _, err := template.New(key).Parse(w.Template); err != nil {
+			r.errorf(key+".template", "%v", err)
+		}
+
+		if w.RatePerMinute < 0 {
+			r.errorf(key+".rate_per_minute", "%d is negative", w.RatePerMinute)
+		}
+	}
+}
+
+// checkServiceConfig validates the options of the auxiliary services, the monitor, enrollment and reverse tunnel.
+func checkServiceConfig(r *configReport, opt *Option) {
+	if m := &opt.MonitorConfig; !m.Disabled {
+		if (m.TLSCert == "") != (m.TLSKey == "") {
+			r.errorf("monitor_config", "tls_cert and tls_key must be set together")
+		}
+
+		r.file("monitor_config.tls_cert", m.TLSCert, false)
+		r.file("monitor_config.tls_key", m.TLSKey, false)
+		r.file("monitor_config.tls_ca", m.TLSCA, false)
+
+		if m.BasicAuth != nil && (m.BasicAuth.Username == "" || m.BasicAuth.Password == "") {
+			r.errorf("monitor_config.basic_auth", "username and password are required")
+		}
+
+		if m.Pprof && !m.Authenticated() {
+			r.warnf("monitor_config.pprof", "profiles are refused without basic_auth, bearer_token or tls_ca")
+		}
+	}
+
+	if e := &opt.EnrollConfig; e.Enabled {
+		r.file("enroll_config.tls_cert", e.TLSCert, true)
+		r.file("enroll_config.tls_key", e.TLSKey, true)
+		r.file("enroll_config.ca_cert", e.CACert, true)
+		r.file("enroll_config.ca_key", e.CAKey, true)
+		r.nonNegative("enroll_config.cert_ttl", e.CertTTL)
+	}
+
+	if s := &opt.SSHConfig; s.Enabled {
+		if len(s.HostKeys) == 0 {
+			r.errorf("ssh_config.host_keys", "is required")
+		}
+
+		for _, path := range s.HostKeys {
+			r.file("ssh_config.host_keys", path, true)
+		}
+
+		r.file("ssh_config.authorized_keys", s.AuthorizedKeys, true)
+	}
+
+	if rc := &opt.ReverseConfig; rc.Enabled {
+		if rc.ControllerURL == "" {
+			r.errorf("reverse_config.controller_url", "is required")
+		} else {
+			r.url("reverse_config.controller_url", rc.ControllerURL, "wss")
+		}
+
+		if err := checkOutboundIdentity(opt); err != nil {
+			r.errorf("reverse_config.enabled", "%v", err)
+		}
+
+		r.file("reverse_config.tls_ca", rc.TLSCA, true)
+		r.file("reverse_config.tls_cert", rc.TLSCert, false)
+		r.file("reverse_config.tls_key", rc.TLSKey, false)
+		r.nonNegative("reverse_config.reconnect_interval", rc.ReconnectInterval)
+	}
+}
+
+// checkDurationKeys warns of the durations given as integers, which are taken as nanoseconds for compatibility,
+// e.g. idle_timeout = 30 is 30ns rather than 30s.
+func checkDurationKeys(r *configReport, md toml.MetaData) {
+	for _, key := range md.Keys() {
+		if t, ok := configType(reflect.TypeOf(Option{}), key); ok && t == durationType && md.Type(key...) == "Integer" {
+			r.warnf(key.String(), "is given in nanoseconds, use a duration string such as \"30s\" or \"5m\" instead")
+		}
+	}
+}
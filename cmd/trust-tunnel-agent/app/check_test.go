@@ -0,0 +1,88 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package app
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+	"trust-tunnel/pkg/trust-tunnel-agent/session"
+
+	"github.com/BurntSushi/toml"
+)
+
+func TestCheckConfig(t *testing.T) {
+	cert := filepath.Join(t.TempDir(), "cert.pem")
+	if err := os.WriteFile(cert, []byte("cert"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	var opt Option
+
+	opt.Port = "5006"
+	opt.SessionConfig.PhysTunnel = "nsenter"
+	opt.SessionConfig.IdleTimeout = -time.Minute
+	opt.ContainerConfig.ContainerRuntime = session.Docker
+	opt.SidecarConfig.Image = "trust-tunnel-sidecar:latest"
+	opt.TLSConfig = TLSConfig{TLSVerify: true, TLSCA: cert, TLSCert: cert, TLSKey: "/nonexistent/key.pem"}
+	opt.AuthConfig.Name = "unknown"
+	opt.AuthConfig.BreakGlass.Enabled = true
+	opt.ReverseConfig.Enabled = true
+	opt.ReverseConfig.ControllerURL = "https://controller"
+
+	want := []string{
+		"session_config.idle_timeout: -1m0s is negative",
+		"session_config.record_dir: is required for break-glass access, so that the sessions are recorded",
+		"sidecar_config.limit: 0 isn't positive, no sidecar can be created",
+		"tls_config.tls_key: stat /nonexistent/key.pem: no such file or directory",
+		`auth_config.name: unknown auth handler "unknown"`,
+		"auth_config.break_glass.users: is required for break-glass access, nobody is allowed otherwise",
+		"auth_config.break_glass.alert_url: is required for break-glass access",
+		`reverse_config.controller_url: "https://controller" isn't a [wss] URL`,
+		"reverse_config.tls_ca: is required",
+	}
+
+	if r := checkConfig(&opt); !reflect.DeepEqual(r.errors, want) || len(r.warnings) != 0 {
+		t.Errorf("unexpected report, errors:\n%v\nwarnings:\n%v", r.errors, r.warnings)
+	}
+}
+
+func TestCheckDurationKeys(t *testing.T) {
+	var opt Option
+
+	md, err := toml.Decode(`
+[session_config]
+idle_timeout = 30
+max_duration = "8h"
+watermark = { high = 60, low = "5m" }
+`, &opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The integers are still taken as nanoseconds.
+	if opt.SessionConfig.IdleTimeout != 30 || opt.SessionConfig.MaxDuration != 8*time.Hour {
+		t.Errorf("unexpected durations %+v", opt.SessionConfig)
+	}
+
+	r := &configReport{}
+	checkDurationKeys(r, md)
+
+	if len(r.warnings) != 2 || r.warnings[0][:len("session_config.idle_timeout")] != "session_config.idle_timeout" {
+		t.Errorf("unexpected warnings %v", r.warnings)
+	}
+}
@@ -16,11 +16,16 @@ package app
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
+	"strings"
 	"trust-tunnel/pkg/common/logutil"
 	"trust-tunnel/pkg/trust-tunnel-agent/auth"
 	"trust-tunnel/pkg/trust-tunnel-agent/backend"
+	"trust-tunnel/pkg/trust-tunnel-agent/enroll"
+	"trust-tunnel/pkg/trust-tunnel-agent/monitor"
+	"trust-tunnel/pkg/trust-tunnel-agent/reverse"
 	"trust-tunnel/pkg/trust-tunnel-agent/session"
 	"trust-tunnel/pkg/trust-tunnel-agent/sidecar"
 
@@ -40,11 +45,33 @@ type Option struct {
 	AuthConfig      auth.Config             `toml:"auth_config"`
 	ContainerConfig session.ContainerConfig `toml:"container_config"`
 	SidecarConfig   sidecar.Config          `toml:"sidecar_config"`
+	NetworkConfig   backend.NetworkConfig   `toml:"network_config"`
+	ReverseConfig   reverse.Config          `toml:"reverse_config"`
+	JumpConfig      backend.JumpConfig      `toml:"jump_config"`
+	MonitorConfig   monitor.Config          `toml:"monitor_config"`
+	EnrollConfig    enroll.Config           `toml:"enroll_config"`
+	SecurityConfig  session.SecurityConfig  `toml:"security_config"`
+	RunConfig       backend.RunConfig       `toml:"run_config"`
+	KubeExecConfig  backend.KubeExecConfig  `toml:"kube_exec_config"`
+	SSHConfig       backend.SSHConfig       `toml:"ssh_config"`
+	TenantConfig    backend.TenantConfig    `toml:"tenant_config"`
+	FileConfig      backend.FileConfig      `toml:"file_config"`
+	CopyConfig      backend.CopyConfig      `toml:"copy_config"`
+	ForwardConfig   backend.ForwardConfig   `toml:"forward_config"`
+	VerbConfig      backend.VerbConfig      `toml:"verb_config"`
+	TagConfig       backend.TagConfig       `toml:"tag_config"`
+	NotifyConfig    backend.NotifyConfig    `toml:"notify_config"`
+	ObserveConfig   backend.ObserveConfig   `toml:"observe_config"`
+
+	// unresolved is the options in JSON before resolving the secret references, which is logged instead.
+	unresolved []byte
 }
 
 var (
 	Version    string
 	configPath string
+	// configSets are the key=value pairs overriding the options, given by --set.
+	configSets []string
 )
 
 // NewCommand creates and returns a new cobra command object.
@@ -54,8 +81,8 @@ func NewCommand() *cobra.Command {
 		Short: "trust-tunnel-agent",
 		RunE: func(cmd *cobra.Command, args []string) error {
 			var options Option
-			if err := loadConfigFromToml(&options); err != nil {
-				return fmt.Errorf("failed to load config from toml: %w", err)
+			if err := loadConfig(cmd, &options); err != nil {
+				return fmt.Errorf("failed to load config: %w", err)
 			}
 			if err := runServer(&options); err != nil {
 				fmt.Fprintf(os.Stderr, "%v\n", err)
@@ -64,7 +91,7 @@ func NewCommand() *cobra.Command {
 		},
 	}
 
-	cmd.Flags().StringVarP(&configPath, "config", "c", "config.toml", "path to the config file")
+	addConfigFlags(cmd)
 
 	versionCmd := &cobra.Command{
 		Use:   "version",
@@ -75,10 +102,48 @@ func NewCommand() *cobra.Command {
 		},
 	}
 	cmd.AddCommand(versionCmd)
+	cmd.AddCommand(newStatusCommand())
+	cmd.AddCommand(newCheckConfigCommand())
+	cmd.AddCommand(newDecryptRecordingCommand())
 
 	return cmd
 }
 
+// addConfigFlags adds the flags of the config file and the overrides to the command.
+func addConfigFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVarP(&configPath, "config", "c", "config.toml", "path to the config file")
+	cmd.Flags().StringArrayVar(&configSets, "set", nil,
+		"override an option of the config file, e.g. --set session_config.idle_timeout=30m, can be repeated")
+}
+
+// loadConfig loads the configuration from the TOML file, then overrides the options by the TRUST_TUNNEL_*
+// environment variables, and finally by the --set flags. The references to secrets, "env://NAME" and
+// "file://path", are resolved at last.
+// The default config file may be absent if the options are all given by the environment variables and flags.
+func loadConfig(cmd *cobra.Command, config *Option) error {
+	if err := loadConfigFromToml(config); err != nil {
+		if !errors.Is(err, os.ErrNotExist) || cmd.Flags().Changed("config") {
+			return err
+		}
+	}
+
+	if err := applyEnvOverrides(config); err != nil {
+		return err
+	}
+
+	if err := applySetOverrides(config, configSets); err != nil {
+		return err
+	}
+
+	config.unresolved, _ = json.Marshal(config)
+
+	if err := resolveSecrets(config); err != nil {
+		return fmt.Errorf("resolve secret of %v", err)
+	}
+
+	return nil
+}
+
 // loadConfigFromToml loads the configuration from the given TOML file.
 func loadConfigFromToml(config *Option) error {
 	_, err := toml.DecodeFile(configPath, config)
@@ -93,6 +158,18 @@ func loadConfigFromToml(config *Option) error {
 func logGlobalConfig(opt *Option) {
 	logrus.Info("trust-tunnel-agent start...")
 
-	b, _ := json.Marshal(opt)
+	if names := envOverrides(); len(names) > 0 {
+		logrus.Infof("config overridden by environment: %s", strings.Join(names, ", "))
+	}
+
+	if len(configSets) > 0 {
+		logrus.Infof("config overridden by flags: %s", strings.Join(configSetKeys(), ", "))
+	}
+
+	b := opt.unresolved
+	if b == nil {
+		b, _ = json.Marshal(opt)
+	}
+
 	logrus.Infof("config: %#v", string(b))
 }
@@ -18,17 +18,19 @@
 package app
 
 import (
+	"context"
 	"net"
 	"net/http"
 	"os"
+	"trust-tunnel/pkg/common/sessionutil"
 	"trust-tunnel/pkg/trust-tunnel-agent/backend"
 	"trust-tunnel/pkg/trust-tunnel-agent/monitor"
+	"trust-tunnel/pkg/trust-tunnel-agent/reverse"
 
 	"github.com/gorilla/mux"
 	"github.com/sirupsen/logrus"
 	tongsuogo "github.com/tongsuo-project/tongsuo-go-sdk"
 	"github.com/tongsuo-project/tongsuo-go-sdk/crypto"
-	agentSession "trust-tunnel/pkg/trust-tunnel-agent/session"
 )
 
 // NTLSServer represents a server structure that implements the server interface, specifically designed for the NTLS protocol.
@@ -40,50 +42,98 @@ func NewServer() Server {
 }
 
 func (s *NTLSServer) Start(opt *Option) error {
-	addr := net.JoinHostPort(opt.Host, opt.Port)
+	addr := net.JoinHostPort(sessionutil.TrimHostBrackets(opt.Host), opt.Port)
 	server := &http.Server{
-		Addr: addr,
+		Addr:           addr,
+		MaxHeaderBytes: opt.NetworkConfig.MaxHeaderBytes,
 	}
 
-	handler, err := backend.NewHandler(backend.Config{
-		RootfsPrefix:     opt.RootfsPrefix,
-		AuthConfig:       opt.AuthConfig,
-		Endpoint:         opt.Endpoint,
-		PhysTunnel:       opt.PhysTunnel,
-		ContainerRuntime: agentSession.ContainerRuntime(opt.ContainerRuntime),
-		SidecarImage:     opt.SidecarImage,
-		ImageHubAuth:     opt.ImageHubAuth,
-		SidecarLimit:     opt.SidecarLimit,
+	handler, err := backend.NewHandler(&backend.Config{
+		ContainerConfig: opt.ContainerConfig,
+		AuthConfig:      opt.AuthConfig,
+		SessionConfig:   opt.SessionConfig,
+		SidecarConfig:   opt.SidecarConfig,
+		NetworkConfig:   opt.NetworkConfig,
+		JumpConfig:      opt.JumpConfig,
+		SecurityConfig:  opt.SecurityConfig,
+		RunConfig:       opt.RunConfig,
+		KubeExecConfig:  opt.KubeExecConfig,
+		TenantConfig:    opt.TenantConfig,
+		FileConfig:      opt.FileConfig,
+		CopyConfig:      opt.CopyConfig,
+		ForwardConfig:   opt.ForwardConfig,
+		VerbConfig:      opt.VerbConfig,
+		TagConfig:       opt.TagConfig,
+		NotifyConfig:    opt.NotifyConfig,
+		ObserveConfig:   opt.ObserveConfig,
 	})
 	if err != nil {
 		return err
 	}
 
+	// Tell the clients that the sessions are terminated for the agent is shutting down.
+	onShutdown(handler.Shutdown)
+
+	if err = startSSHServer(&opt.SSHConfig, handler); err != nil {
+		return err
+	}
+
 	r := mux.NewRouter()
 	r.HandleFunc("/exec", func(w http.ResponseWriter, r *http.Request) {
 		handler.Handle(w, r)
 	})
+	// The port forwards are refused by the handler if they're disabled, and relayed by the jump agents anyway.
+	r.HandleFunc("/forward", handler.Handle)
+	r.HandleFunc("/info", handler.Info).Methods(http.MethodGet)
+
+	if opt.RunConfig.Enabled {
+		r.HandleFunc("/run", handler.Run).Methods(http.MethodPost)
+	}
+
+	if opt.KubeExecConfig.Enabled {
+		r.HandleFunc(backend.KubeExecPath, handler.KubeExec)
+	}
 	server.Handler = monitor.WrapPrometheus(r)
 
+	// In outbound-only mode, serve the requests from the controller instead of listening. The connection to
+	// the controller is secured by the TLS of reverse_config rather than NTLS.
+	if opt.ReverseConfig.Enabled {
+		return reverse.Serve(&opt.ReverseConfig, &reverse.Agent{
+			Instance: handler.InstanceID(),
+			Addr:     sessionutil.GetMainIP(),
+		}, server.Handler)
+	}
+
+	// Listen with the configured TCP keep-alive period.
+	lc := net.ListenConfig{KeepAlive: opt.NetworkConfig.TCPKeepAlive}
+
+	ln, err := lc.Listen(context.Background(), "tcp", addr)
+	if err != nil {
+		return err
+	}
+
 	// If NTLS verification is enabled, create a new NTLS listener and serve the HTTP server.
 	if opt.NTLSConfig.NTLSVerify {
-		lis, err := newNTLSListener(addr, opt.NTLSConfig, func(sslctx *tongsuogo.Ctx) error {
+		lis, err := newNTLSListener(ln, opt.NTLSConfig, func(sslctx *tongsuogo.Ctx) error {
 			return sslctx.SetCipherList(opt.NTLSConfig.Cipher)
 		})
 		if err != nil {
+			ln.Close()
+
 			return err
 		}
 
-		return server.Serve(*lis)
+		// Audit the failed handshakes, which may be probes or misconfigured clients.
+		return server.Serve(backend.NewHandshakeAuditor("session").WrapNTLS(*lis))
 	}
 
 	logrus.Info("start ntls server")
 
-	return server.ListenAndServe()
+	return server.Serve(ln)
 }
 
-// newNTLSListener creates a new NTLS listener with the specified address and configuration.
-func newNTLSListener(addr string, ntlsConfig NTLSConfig, options ...func(sslctx *tongsuogo.Ctx) error) (*net.Listener, error) {
+// newNTLSListener creates a new NTLS listener over the TCP listener with the specified configuration.
+func newNTLSListener(inner net.Listener, ntlsConfig NTLSConfig, options ...func(sslctx *tongsuogo.Ctx) error) (*net.Listener, error) {
 	ctx, err := tongsuogo.NewCtxWithVersion(tongsuogo.NTLS)
 	if err != nil {
 		return nil, err
@@ -157,10 +207,7 @@ func newNTLSListener(addr string, ntlsConfig NTLSConfig, options ...func(sslctx
 		}
 	}
 
-	lis, err := tongsuogo.Listen("tcp", addr, ctx)
-	if err != nil {
-		return nil, err
-	}
+	lis := tongsuogo.NewListener(inner, ctx)
 
 	return &lis, nil
 }
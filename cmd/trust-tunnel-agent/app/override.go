@@ -0,0 +1,299 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package app
+
+import (
+	"encoding"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+// envPrefix is the prefix of the environment variables overriding the options.
+// The option session_config.idle_timeout is overridden by TRUST_TUNNEL_SESSION_CONFIG_IDLE_TIMEOUT, for example.
+const envPrefix = "TRUST_TUNNEL_"
+
+var (
+	textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+	durationType        = reflect.TypeOf(time.Duration(0))
+)
+
+// configKeys returns the dotted keys of all the options settable in the TOML file, e.g. "log_config.level".
+func configKeys(t reflect.Type, prefix string) []string {
+	var keys []string
+
+	for i := 0; i < t.NumField(); i++ {
+		name, ok := tomlName(t.Field(i))
+		if !ok {
+			continue
+		}
+
+		key := prefix + name
+
+		ft := t.Field(i).Type
+		if ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+
+		if isTable(ft) {
+			keys = append(keys, configKeys(ft, key+".")...)
+		} else {
+			keys = append(keys, key)
+		}
+	}
+
+	return keys
+}
+
+// tomlName returns the key of the struct field in TOML.
+func tomlName(f reflect.StructField) (string, bool) {
+	if f.PkgPath != "" {
+		return "", false
+	}
+
+	name := strings.Split(f.Tag.Get("toml"), ",")[0]
+
+	switch name {
+	case "-":
+		return "", false
+	case "":
+		return strings.ToLower(f.Name), true
+	}
+
+	return name, true
+}
+
+// isTable tells whether the options of type t are a table of options, which are overridden one by one.
+func isTable(t reflect.Type) bool {
+	return t.Kind() == reflect.Struct && !reflect.PtrTo(t).Implements(textUnmarshalerType)
+}
+
+// envName returns the environment variable overriding the option of the given key.
+func envName(key string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(key, ".", "_"))
+}
+
+// applyEnvOverrides overrides the options with the TRUST_TUNNEL_* environment variables.
+func applyEnvOverrides(config *Option) error {
+	for _, key := range configKeys(reflect.TypeOf(*config), "") {
+		value, ok := os.LookupEnv(envName(key))
+		if !ok {
+			continue
+		}
+
+		if err := setConfigValue(config, key, value); err != nil {
+			return fmt.Errorf("invalid %s: %v", envName(key), err)
+		}
+	}
+
+	return nil
+}
+
+// applySetOverrides overrides the options with the key=value pairs given by the --set flags.
+func applySetOverrides(config *Option, sets []string) error {
+	for _, set := range sets {
+		key, value, ok := strings.Cut(set, "=")
+		if !ok {
+			return fmt.Errorf("invalid --set %q, key=value is expected", set)
+		}
+
+		if err := setConfigValue(config, strings.TrimSpace(key), value); err != nil {
+			return fmt.Errorf("invalid --set %q: %v", set, err)
+		}
+	}
+
+	return nil
+}
+
+// setConfigValue sets the option of the dotted key to the value parsed from the string.
+// Strings, booleans, numbers and durations are given as is, string lists are separated by commas,
+// and the other options, e.g. maps and tables arrays, are given in TOML, such as `{ high = "1m" }`.
+func setConfigValue(config *Option, key, value string) error {
+	v := reflect.ValueOf(config).Elem()
+
+	for _, name := range strings.Split(key, ".") {
+		if v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+
+			v = v.Elem()
+		}
+
+		if !isTable(v.Type()) {
+			return fmt.Errorf("unknown option %s", key)
+		}
+
+		field, ok := fieldByTOMLName(v, name)
+		if !ok {
+			return fmt.Errorf("unknown option %s", key)
+		}
+
+		v = field
+	}
+
+	if v.Kind() == reflect.Ptr && isTable(v.Type().Elem()) || isTable(v.Type()) {
+		return fmt.Errorf("option %s is a table, set its options one by one", key)
+	}
+
+	return parseConfigValue(v, value)
+}
+
+// configType returns the type of the option of the given key, or the value type of the maps the key refers into.
+func configType(t reflect.Type, key []string) (reflect.Type, bool) {
+	for _, name := range key {
+		if t.Kind() == reflect.Ptr {
+			t = t.Elem()
+		}
+
+		switch {
+		case t.Kind() == reflect.Map:
+			t = t.Elem()
+		case isTable(t):
+			found := false
+
+			for i := 0; i < t.NumField(); i++ {
+				if n, ok := tomlName(t.Field(i)); ok && n == name {
+					t, found = t.Field(i).Type, true
+
+					break
+				}
+			}
+
+			if !found {
+				return nil, false
+			}
+		default:
+			return nil, false
+		}
+	}
+
+	return t, true
+}
+
+// fieldByTOMLName returns the field of the struct with the given TOML key.
+func fieldByTOMLName(v reflect.Value, name string) (reflect.Value, bool) {
+	for i := 0; i < v.NumField(); i++ {
+		if n, ok := tomlName(v.Type().Field(i)); ok && n == name {
+			return v.Field(i), true
+		}
+	}
+
+	return reflect.Value{}, false
+}
+
+// parseConfigValue parses the string into the option.
+func parseConfigValue(v reflect.Value, value string) error {
+	if v.Addr().Type().Implements(textUnmarshalerType) {
+		return v.Addr().Interface().(encoding.TextUnmarshaler).UnmarshalText([]byte(value))
+	}
+
+	switch {
+	case v.Type() == durationType:
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+
+		v.SetInt(int64(d))
+	case v.Kind() == reflect.String:
+		v.SetString(value)
+	case v.Kind() == reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+
+		v.SetBool(b)
+	case v.CanInt():
+		n, err := strconv.ParseInt(value, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+
+		v.SetInt(n)
+	case v.CanUint():
+		n, err := strconv.ParseUint(value, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+
+		v.SetUint(n)
+	case v.CanFloat():
+		f, err := strconv.ParseFloat(value, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+
+		v.SetFloat(f)
+	case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.String && !strings.HasPrefix(strings.TrimSpace(value), "["):
+		list := reflect.MakeSlice(v.Type(), 0, 0)
+
+		for _, s := range strings.Split(value, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				list = reflect.Append(list, reflect.ValueOf(s).Convert(v.Type().Elem()))
+			}
+		}
+
+		v.Set(list)
+	default:
+		// Decode the other options as a TOML value.
+		holder := reflect.New(reflect.StructOf([]reflect.StructField{{
+			Name: "Value",
+			Type: v.Type(),
+			Tag:  `toml:"value"`,
+		}}))
+
+		if _, err := toml.Decode("value = "+value, holder.Interface()); err != nil {
+			return err
+		}
+
+		v.Set(holder.Elem().Field(0))
+	}
+
+	return nil
+}
+
+// configSetKeys returns the keys of the options overridden by the --set flags, without the values which may be secrets.
+func configSetKeys() []string {
+	keys := make([]string, 0, len(configSets))
+	for _, set := range configSets {
+		key, _, _ := strings.Cut(set, "=")
+		keys = append(keys, strings.TrimSpace(key))
+	}
+
+	return keys
+}
+
+// envOverrides returns the TRUST_TUNNEL_* environment variables which override the options, sorted.
+func envOverrides() []string {
+	var names []string
+
+	for _, key := range configKeys(reflect.TypeOf(Option{}), "") {
+		if _, ok := os.LookupEnv(envName(key)); ok {
+			names = append(names, envName(key))
+		}
+	}
+
+	sort.Strings(names)
+
+	return names
+}
@@ -0,0 +1,67 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package app
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestConfigOverrides(t *testing.T) {
+	var opt Option
+
+	opt.SessionConfig.IdleTimeout = time.Minute
+	opt.LogConfig.Level = "info"
+
+	t.Setenv("TRUST_TUNNEL_SESSION_CONFIG_IDLE_TIMEOUT", "30m")
+	t.Setenv("TRUST_TUNNEL_LOG_CONFIG_LEVEL", "debug")
+	t.Setenv("TRUST_TUNNEL_MONITOR_CONFIG_BASIC_AUTH_USERNAME", "admin")
+	t.Setenv("TRUST_TUNNEL_AUTH_CONFIG_BREAK_GLASS_USERS", "alice, bob")
+
+	if err := applyEnvOverrides(&opt); err != nil {
+		t.Fatal(err)
+	}
+
+	// The flags take precedence over the environment variables.
+	err := applySetOverrides(&opt, []string{
+		"log_config.level=warn",
+		"sidecar_config.limit=10",
+		`session_config.watermark={ high = "1m" }`,
+		"auth_config.params={ url = \"http://auth\" }",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if opt.SessionConfig.IdleTimeout != 30*time.Minute || opt.LogConfig.Level != "warn" || opt.SidecarConfig.Limit != 10 {
+		t.Errorf("unexpected options %+v %+v %+v", opt.SessionConfig, opt.LogConfig, opt.SidecarConfig)
+	}
+
+	if opt.MonitorConfig.BasicAuth == nil || opt.MonitorConfig.BasicAuth.Username != "admin" {
+		t.Errorf("unexpected basic auth %+v", opt.MonitorConfig.BasicAuth)
+	}
+
+	if !reflect.DeepEqual(opt.AuthConfig.BreakGlass.Users, []string{"alice", "bob"}) ||
+		opt.SessionConfig.Watermark["high"] != time.Minute || opt.AuthConfig.Params["url"] != "http://auth" {
+		t.Errorf("unexpected options %+v %+v", opt.AuthConfig, opt.SessionConfig.Watermark)
+	}
+
+	for _, set := range []string{"log_config.unknown=1", "log_config=1", "sidecar_config.limit=ten", "no_value"} {
+		if err := applySetOverrides(&opt, []string{set}); err == nil {
+			t.Errorf("--set %s should be refused", set)
+		}
+	}
+}
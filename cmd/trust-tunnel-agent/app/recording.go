@@ -0,0 +1,76 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package app
+
+import (
+	"fmt"
+	"os"
+	"trust-tunnel/pkg/trust-tunnel-agent/recordstore"
+
+	"github.com/spf13/cobra"
+)
+
+// newDecryptRecordingCommand creates the command decrypting the recordings uploaded encrypted.
+func newDecryptRecordingCommand() *cobra.Command {
+	var key string
+
+	cmd := &cobra.Command{
+		Use:   "decrypt-recording FILE",
+		Short: "Decrypt a session recording uploaded encrypted",
+		Long: "Decrypt a session recording downloaded from the object storage to the standard output, with the " +
+			"encryption_key of [session_config.record_upload] in the config file or the one given by --key",
+		Args:         cobra.ExactArgs(1),
+		SilenceUsage: true,
+		// The error is printed by main.
+		SilenceErrors: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if key == "" {
+				var options Option
+				if err := loadConfig(cmd, &options); err != nil {
+					return fmt.Errorf("failed to load config: %w", err)
+				}
+
+				key = options.SessionConfig.RecordUpload.EncryptionKey
+			} else {
+				var err error
+				if key, err = resolveReference(key); err != nil {
+					return err
+				}
+			}
+
+			if key == "" {
+				return fmt.Errorf("no encryption key is configured")
+			}
+
+			master, err := recordstore.ParseKey(key)
+			if err != nil {
+				return err
+			}
+
+			f, err := os.Open(args[0])
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+
+			return recordstore.Decrypt(os.Stdout, f, master)
+		},
+	}
+
+	addConfigFlags(cmd)
+	cmd.Flags().StringVar(&key, "key", "", `encryption key, or a reference to it, e.g. "env://TRUST_TUNNEL_RECORD_KEY"`)
+
+	return cmd
+}
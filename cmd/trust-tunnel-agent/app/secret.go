@@ -0,0 +1,111 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package app
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+)
+
+// Schemes of the string options referring to secrets kept out of the config file.
+const (
+	// envScheme refers to an environment variable, e.g. "env://IMAGE_HUB_AUTH".
+	envScheme = "env://"
+	// fileScheme refers to the content of a file, e.g. "file:///run/secrets/image-hub-auth".
+	fileScheme = "file://"
+)
+
+// resolveSecrets replaces the string options referring to environment variables or files with their values,
+// including the elements of string lists and the values of string maps such as the auth params.
+func resolveSecrets(config *Option) error {
+	return resolveValue(reflect.ValueOf(config).Elem(), "")
+}
+
+// resolveValue resolves the references within the option of the given key.
+func resolveValue(v reflect.Value, key string) error {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if !v.IsNil() {
+			return resolveValue(v.Elem(), key)
+		}
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			name, ok := tomlName(v.Type().Field(i))
+			if !ok {
+				continue
+			}
+
+			if err := resolveValue(v.Field(i), strings.TrimPrefix(key+"."+name, ".")); err != nil {
+				return err
+			}
+		}
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			if err := resolveValue(v.Index(i), fmt.Sprintf("%s[%d]", key, i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		if v.Type().Elem().Kind() != reflect.String {
+			return nil
+		}
+
+		iter := v.MapRange()
+		for iter.Next() {
+			resolved, err := resolveReference(iter.Value().String())
+			if err != nil {
+				return fmt.Errorf("%s.%v: %v", key, iter.Key(), err)
+			}
+
+			v.SetMapIndex(iter.Key(), reflect.ValueOf(resolved).Convert(v.Type().Elem()))
+		}
+	case reflect.String:
+		resolved, err := resolveReference(v.String())
+		if err != nil {
+			return fmt.Errorf("%s: %v", key, err)
+		}
+
+		v.SetString(resolved)
+	}
+
+	return nil
+}
+
+// resolveReference returns the value referred to by the string, or the string itself if it's no reference.
+// The trailing line break of files is trimmed.
+func resolveReference(s string) (string, error) {
+	switch {
+	case strings.HasPrefix(s, envScheme):
+		name := strings.TrimPrefix(s, envScheme)
+
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s isn't set", name)
+		}
+
+		return value, nil
+	case strings.HasPrefix(s, fileScheme):
+		content, err := os.ReadFile(strings.TrimPrefix(s, fileScheme))
+		if err != nil {
+			return "", err
+		}
+
+		return strings.TrimRight(string(content), "\r\n"), nil
+	}
+
+	return s, nil
+}
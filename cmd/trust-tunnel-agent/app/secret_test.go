@@ -0,0 +1,53 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package app
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"trust-tunnel/pkg/trust-tunnel-agent/monitor"
+)
+
+func TestResolveSecrets(t *testing.T) {
+	secret := filepath.Join(t.TempDir(), "password")
+	if err := os.WriteFile(secret, []byte("s3cret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("HUB_AUTH", "user:token")
+
+	var opt Option
+
+	opt.SidecarConfig.ImageHubAuth = "env://HUB_AUTH"
+	opt.MonitorConfig.BasicAuth = &monitor.BasicAuth{Username: "admin", Password: "file://" + secret}
+	opt.AuthConfig.Params = map[string]string{"token": "env://HUB_AUTH", "url": "http://auth"}
+
+	if err := resolveSecrets(&opt); err != nil {
+		t.Fatal(err)
+	}
+
+	if opt.SidecarConfig.ImageHubAuth != "user:token" || opt.MonitorConfig.BasicAuth.Password != "s3cret" ||
+		opt.AuthConfig.Params["token"] != "user:token" || opt.AuthConfig.Params["url"] != "http://auth" {
+		t.Errorf("unexpected options %+v %+v %+v", opt.SidecarConfig, opt.MonitorConfig.BasicAuth, opt.AuthConfig.Params)
+	}
+
+	opt.AuthConfig.BreakGlass.Users = []string{"env://UNSET_TRUST_TUNNEL_TEST"}
+
+	err := resolveSecrets(&opt)
+	if err == nil || err.Error() != "auth_config.break_glass.users[0]: environment variable UNSET_TRUST_TUNNEL_TEST isn't set" {
+		t.Errorf("unexpected error %v", err)
+	}
+}
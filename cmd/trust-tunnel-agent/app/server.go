@@ -15,18 +15,43 @@
 package app
 
 import (
+	"fmt"
 	"net"
-	"net/http"
 	"trust-tunnel/pkg/common/logutil"
+	"trust-tunnel/pkg/trust-tunnel-agent/backend"
+	"trust-tunnel/pkg/trust-tunnel-agent/enroll"
+	"trust-tunnel/pkg/trust-tunnel-agent/monitor"
+	"trust-tunnel/pkg/trust-tunnel-agent/proctrack"
+	"trust-tunnel/pkg/trust-tunnel-client/fips"
 
-	"github.com/gorilla/mux"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sirupsen/logrus"
 )
 
+// checkOutboundIdentity refuses the outbound-only mode with the policies identifying the clients by their
+// certificates or the proxies they come through, since the requests relayed by the controller carry neither.
+func checkOutboundIdentity(opt *Option) error {
+	if !opt.ReverseConfig.Enabled {
+		return nil
+	}
+
+	if opt.AuthConfig.BindUserToCert {
+		return fmt.Errorf("bind_user_to_cert can't be enforced in outbound-only mode, the requests carry no client certificates")
+	}
+
+	if source := opt.TenantConfig.Source; source != "" {
+		return fmt.Errorf("tenants identified by %s can't be served in outbound-only mode, the requests carry no client certificates", source)
+	}
+
+	return nil
+}
+
 // runServer configures and starts the trust-tunnel-agent server.
 func runServer(opt *Option) error {
 	// Setup logging.
+	if opt.LogConfig.Level == "" {
+		opt.LogConfig.Level = "info"
+	}
+
 	level, err := logrus.ParseLevel(opt.LogConfig.Level)
 	if err != nil {
 		return err
@@ -34,14 +59,59 @@ func runServer(opt *Option) error {
 
 	logutil.SetLevel(level)
 	logutil.SetExpireDay(opt.LogConfig.ExpireDays)
+	logutil.SetSessionFiles(opt.LogConfig.SessionFiles)
+
+	if err := logutil.SetAuditSyslog(opt.LogConfig.AuditSyslog); err != nil {
+		return err
+	}
 
 	setupSignal()
 
+	// Turn the FIPS mode on before any TLS config is created.
+	if opt.TLSConfig.FIPS {
+		fips.Enable()
+	}
+
+	if mode := fips.Mode(); mode != "" {
+		logrus.Infof("FIPS mode is on (%s)", mode)
+	}
+
+	if err := checkOutboundIdentity(opt); err != nil {
+		return err
+	}
+
 	// Log global configuration.
 	logGlobalConfig(opt)
 
 	// Start monitoring server.
-	go startMonitorServer()
+	monitor.SetVersion(Version)
+
+	if err := startMonitorServer(&opt.MonitorConfig); err != nil {
+		return err
+	}
+
+	if err := startEnrollServer(&opt.EnrollConfig); err != nil {
+		return err
+	}
+
+	// Track the processes spawned within sessions, otherwise they are found by scanning /proc when cleaned.
+	if err := proctrack.Start(); err != nil {
+		if opt.SessionConfig.ExecAudit {
+			return fmt.Errorf("exec audit requires process tracking: %v", err)
+		}
+
+		if opt.AuthConfig.BreakGlass.Enabled {
+			return fmt.Errorf("break-glass access requires process tracking to audit the commands: %v", err)
+		}
+
+		logrus.Warnf("process tracking is unavailable, fall back to scanning /proc: %v", err)
+	}
+
+	if opt.SessionConfig.ExecTracer == backend.ExecTracerEBPF {
+		if err := proctrack.StartExecTracer(); err != nil {
+			return fmt.Errorf("eBPF exec tracer error: %v", err)
+		}
+	}
 
 	// Start serving requests.
 	server := NewServer()
@@ -49,14 +119,76 @@ func runServer(opt *Option) error {
 	return server.Start(opt)
 }
 
-// startMonitorServer starts the monitoring server.
-func startMonitorServer() {
-	addr := net.JoinHostPort("0.0.0.0", "19104")
-	server := &http.Server{
-		Addr: addr,
+// startMonitorServer starts the monitoring server in background unless it's disabled.
+func startMonitorServer(config *monitor.Config) error {
+	if config.Disabled {
+		logrus.Info("monitor server is disabled")
+
+		return nil
+	}
+
+	server, err := monitor.NewServer(config)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		if server.TLSConfig != nil {
+			backend.NewHandshakeAuditor("monitor").Hook(server)
+
+			err = server.ListenAndServeTLS("", "")
+		} else {
+			err = server.ListenAndServe()
+		}
+
+		logrus.Errorf("monitor server on %s exited: %v", server.Addr, err)
+	}()
+
+	return nil
+}
+
+// startSSHServer starts the SSH server bridging the standard SSH clients into the sessions of the handler in
+// background if it's enabled.
+func startSSHServer(config *backend.SSHConfig, handler *backend.Handler) error {
+	if !config.Enabled {
+		return nil
+	}
+
+	server, err := handler.NewSSHServer(config)
+	if err != nil {
+		return err
 	}
-	r := mux.NewRouter()
-	r.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) { promhttp.Handler().ServeHTTP(w, r) })
-	server.Handler = r
-	server.ListenAndServe()
+
+	ln, err := net.Listen("tcp", server.Addr())
+	if err != nil {
+		return fmt.Errorf("listen ssh on %s error: %v", server.Addr(), err)
+	}
+
+	go func() {
+		err := server.Serve(ln)
+		logrus.Errorf("ssh server on %s exited: %v", server.Addr(), err)
+	}()
+
+	return nil
+}
+
+// startEnrollServer starts the enrollment server issuing short-lived client certificates in background if it's enabled.
+func startEnrollServer(config *enroll.Config) error {
+	if !config.Enabled {
+		return nil
+	}
+
+	server, err := enroll.NewServer(config)
+	if err != nil {
+		return err
+	}
+
+	backend.NewHandshakeAuditor("enroll").Hook(server)
+
+	go func() {
+		err := server.ListenAndServeTLS("", "")
+		logrus.Errorf("enrollment server on %s exited: %v", server.Addr, err)
+	}()
+
+	return nil
 }
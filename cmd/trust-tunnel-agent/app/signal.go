@@ -17,6 +17,7 @@ package app
 import (
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
 
 	"github.com/sirupsen/logrus"
@@ -24,6 +25,29 @@ import (
 
 const channelSize = 10
 
+var (
+	shutdownHooks []func()
+	hooksLock     sync.Mutex
+)
+
+// onShutdown registers a function to run before the agent exits on signals.
+func onShutdown(f func()) {
+	hooksLock.Lock()
+	defer hooksLock.Unlock()
+
+	shutdownHooks = append(shutdownHooks, f)
+}
+
+// runShutdownHooks runs the registered shutdown functions.
+func runShutdownHooks() {
+	hooksLock.Lock()
+	defer hooksLock.Unlock()
+
+	for _, f := range shutdownHooks {
+		f()
+	}
+}
+
 // setupSignal initializes a signal channel to listen for SIGINT and SIGTERM signals
 // and handles these signals to ensure the program can exit gracefully or immediately as needed.
 func setupSignal() {
@@ -36,9 +60,11 @@ func setupSignal() {
 			switch sig {
 			case syscall.SIGINT:
 				logrus.Infof("Got SIGINT, quit with grace")
+				runShutdownHooks()
 				os.Exit(0)
 			case syscall.SIGTERM:
 				logrus.Infof("Got SIGTERM, quit immediately")
+				runShutdownHooks()
 				os.Exit(0)
 			}
 		}
@@ -0,0 +1,180 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package app
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"text/tabwriter"
+	"time"
+	"trust-tunnel/pkg/trust-tunnel-agent/monitor"
+
+	"github.com/spf13/cobra"
+)
+
+const statusTimeout = 5 * time.Second
+
+// newStatusCommand creates the command querying the status of the local agent from the monitor server.
+func newStatusCommand() *cobra.Command {
+	var (
+		output             string
+		insecureSkipVerify bool
+	)
+
+	cmd := &cobra.Command{
+		Use:   "status",
+		Short: "Display the status of the local trust-tunnel-agent",
+		Long:  "Display the sessions, sidecar usage, runtime health and version of the local trust-tunnel-agent",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if output != "table" && output != "json" {
+				return fmt.Errorf("unknown output format %q, table or json is supported", output)
+			}
+
+			var options Option
+			if err := loadConfig(cmd, &options); err != nil {
+				return fmt.Errorf("failed to load config: %w", err)
+			}
+
+			status, err := queryStatus(&options.MonitorConfig, insecureSkipVerify)
+			if err != nil {
+				return err
+			}
+
+			if output == "json" {
+				encoder := json.NewEncoder(os.Stdout)
+				encoder.SetIndent("", "  ")
+
+				return encoder.Encode(status)
+			}
+
+			return printStatus(os.Stdout, status)
+		},
+	}
+
+	addConfigFlags(cmd)
+	cmd.Flags().StringVarP(&output, "output", "o", "table", "output format, table or json")
+	cmd.Flags().BoolVar(&insecureSkipVerify, "insecure-skip-verify", false, "skip verifying the certificate of the monitor server")
+
+	return cmd
+}
+
+// queryStatus queries the status of the local agent from the monitor server configured in config.
+func queryStatus(config *monitor.Config, insecureSkipVerify bool) (*monitor.Status, error) {
+	if config.Disabled {
+		return nil, fmt.Errorf("monitor server is disabled")
+	}
+
+	url, err := statusURL(config)
+	if err != nil {
+		return nil, err
+	}
+
+	httpClient := &http.Client{Timeout: statusTimeout}
+
+	if config.TLSCert != "" {
+		tlsConfig := &tls.Config{InsecureSkipVerify: insecureSkipVerify}
+
+		if config.TLSCA != "" {
+			caCert, err := os.ReadFile(config.TLSCA)
+			if err != nil {
+				return nil, err
+			}
+
+			tlsConfig.RootCAs = x509.NewCertPool()
+			tlsConfig.RootCAs.AppendCertsFromPEM(caCert)
+		}
+
+		httpClient.Transport = &http.Transport{TLSClientConfig: tlsConfig}
+	}
+
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+config.BearerToken)
+	} else if config.BasicAuth != nil {
+		req.SetBasicAuth(config.BasicAuth.Username, config.BasicAuth.Password)
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("query agent status error: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+
+		return nil, fmt.Errorf("query agent status error: %s: %s", resp.Status, body)
+	}
+
+	var status monitor.Status
+	if err = json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return nil, fmt.Errorf("decode agent status error: %v", err)
+	}
+
+	return &status, nil
+}
+
+// statusURL returns the URL of the status endpoint, the loopback address is used if the server listens on all addresses.
+func statusURL(config *monitor.Config) (string, error) {
+	addr := config.Addr
+	if addr == "" {
+		addr = ":19104"
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", fmt.Errorf("invalid monitor server address %s: %v", addr, err)
+	}
+
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = "127.0.0.1"
+	}
+
+	scheme := "http"
+	if config.TLSCert != "" {
+		scheme = "https"
+	}
+
+	return fmt.Sprintf("%s://%s/status", scheme, net.JoinHostPort(host, port)), nil
+}
+
+// printStatus prints the status as a table.
+func printStatus(w io.Writer, status *monitor.Status) error {
+	runtime := "healthy"
+	if !status.RuntimeHealthy {
+		runtime = "unhealthy: " + status.RuntimeError
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "VERSION\t%s\n", status.Version)
+	fmt.Fprintf(tw, "INSTANCE\t%s\n", status.Instance)
+	fmt.Fprintf(tw, "UPTIME\t%s\n", time.Since(status.StartTime).Truncate(time.Second))
+	fmt.Fprintf(tw, "ACTIVE SESSIONS\t%d\n", status.ActiveSessions)
+	fmt.Fprintf(tw, "STALE SESSIONS\t%d\n", status.StaleSessions)
+	fmt.Fprintf(tw, "SIDECARS\t%d/%d\n", status.Sidecars, status.SidecarLimit)
+	fmt.Fprintf(tw, "CONTAINER RUNTIME\t%s (%s)\n", status.ContainerRuntime, runtime)
+
+	return tw.Flush()
+}
@@ -17,13 +17,18 @@
 package app
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"fmt"
 	"net"
 	"net/http"
 	"os"
+	"trust-tunnel/pkg/common/sessionutil"
 	"trust-tunnel/pkg/trust-tunnel-agent/backend"
 	"trust-tunnel/pkg/trust-tunnel-agent/monitor"
+	"trust-tunnel/pkg/trust-tunnel-agent/reverse"
+	"trust-tunnel/pkg/trust-tunnel-client/fips"
 
 	"github.com/gorilla/mux"
 )
@@ -35,9 +40,15 @@ func NewServer() Server {
 }
 
 func (s *TLSServer) Start(opt *Option) error {
-	addr := net.JoinHostPort(opt.Host, opt.Port)
+	addr := net.JoinHostPort(sessionutil.TrimHostBrackets(opt.Host), opt.Port)
 	server := &http.Server{
-		Addr: addr,
+		Addr:           addr,
+		MaxHeaderBytes: opt.NetworkConfig.MaxHeaderBytes,
+	}
+
+	// Sessions can't be served in plaintext in the FIPS mode.
+	if fips.Enabled() && !opt.TLSConfig.TLSVerify && !opt.ReverseConfig.Enabled {
+		return fmt.Errorf("tls_verify is required in the FIPS mode")
 	}
 
 	// If TLS verification is enabled, configure the TLS settings for the server.
@@ -52,6 +63,13 @@ func (s *TLSServer) Start(opt *Option) error {
 		}
 
 		server.TLSConfig = tlsConfig
+
+		// Dial the target agents with the same certificate as a jump agent.
+		opt.JumpConfig.TLSConfig = tlsConfig.Clone()
+		opt.JumpConfig.TLSConfig.ServerName = opt.JumpConfig.ServerName
+
+		// Audit the failed handshakes, which may be probes or misconfigured clients.
+		backend.NewHandshakeAuditor("session").Hook(server)
 	}
 
 	handler, err := backend.NewHandler(&backend.Config{
@@ -59,26 +77,73 @@ func (s *TLSServer) Start(opt *Option) error {
 		AuthConfig:      opt.AuthConfig,
 		SessionConfig:   opt.SessionConfig,
 		SidecarConfig:   opt.SidecarConfig,
+		NetworkConfig:   opt.NetworkConfig,
+		JumpConfig:      opt.JumpConfig,
+		SecurityConfig:  opt.SecurityConfig,
+		RunConfig:       opt.RunConfig,
+		KubeExecConfig:  opt.KubeExecConfig,
+		TenantConfig:    opt.TenantConfig,
+		FileConfig:      opt.FileConfig,
+		CopyConfig:      opt.CopyConfig,
+		ForwardConfig:   opt.ForwardConfig,
+		VerbConfig:      opt.VerbConfig,
+		TagConfig:       opt.TagConfig,
+		NotifyConfig:    opt.NotifyConfig,
+		ObserveConfig:   opt.ObserveConfig,
 	})
 	if err != nil {
 		return err
 	}
 
+	// Tell the clients that the sessions are terminated for the agent is shutting down.
+	onShutdown(handler.Shutdown)
+
+	if err = startSSHServer(&opt.SSHConfig, handler); err != nil {
+		return err
+	}
+
 	r := mux.NewRouter()
 	r.HandleFunc("/exec", func(w http.ResponseWriter, r *http.Request) {
 		handler.Handle(w, r)
 	})
+	// The port forwards are refused by the handler if they're disabled, and relayed by the jump agents anyway.
+	r.HandleFunc("/forward", handler.Handle)
+	r.HandleFunc("/info", handler.Info).Methods(http.MethodGet)
+
+	if opt.RunConfig.Enabled {
+		r.HandleFunc("/run", handler.Run).Methods(http.MethodPost)
+	}
+
+	if opt.KubeExecConfig.Enabled {
+		r.HandleFunc(backend.KubeExecPath, handler.KubeExec)
+	}
 
 	// Wrap the router with Prometheus monitoring middleware.
 	server.Handler = monitor.WrapPrometheus(r)
 
+	// In outbound-only mode, serve the requests from the controller instead of listening.
+	if opt.ReverseConfig.Enabled {
+		return reverse.Serve(&opt.ReverseConfig, &reverse.Agent{
+			Instance: handler.InstanceID(),
+			Addr:     sessionutil.GetMainIP(),
+		}, server.Handler)
+	}
+
+	// Listen with the configured TCP keep-alive period.
+	lc := net.ListenConfig{KeepAlive: opt.NetworkConfig.TCPKeepAlive}
+
+	ln, err := lc.Listen(context.Background(), "tcp", addr)
+	if err != nil {
+		return err
+	}
+
 	// If TLS is enabled, start the server in TLS mode.
 	if opt.TLSConfig.TLSVerify {
-		return server.ListenAndServeTLS("", "")
+		return server.ServeTLS(ln, "", "")
 	}
 
 	// Start the HTTP server without TLS.
-	return server.ListenAndServe()
+	return server.Serve(ln)
 }
 
 // ConfigTLS creates a TLS configuration from command line options.
@@ -97,12 +162,17 @@ func ConfigTLS(config *TLSConfig) (*tls.Config, error) {
 		return nil, err
 	}
 
+	if err = fips.CheckCertificate(&cert); err != nil {
+		return nil, err
+	}
+
 	tlsConfig := &tls.Config{
 		RootCAs:      pool,
 		ClientCAs:    pool,
 		ClientAuth:   tls.RequireAndVerifyClientCert,
 		Certificates: []tls.Certificate{cert},
 	}
+	fips.Apply(tlsConfig)
 
 	return tlsConfig, nil
 }
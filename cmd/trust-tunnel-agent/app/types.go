@@ -28,6 +28,10 @@ type TLSConfig struct {
 	// TLSKey is the path to the server's TLS private key.
 	// Paired with TLSCert, it is used to decrypt received data and sign data being sent.
 	TLSKey string `toml:"tls_key"`
+	// FIPS restricts the cipher suites, the key types and the hash algorithms of the agent's TLS to the FIPS-approved
+	// sets, and refuses to start with plaintext listeners or certificates using other algorithms. It's always on
+	// in the boringcrypto builds.
+	FIPS bool `toml:"fips"`
 }
 
 // NTLSConfig is a structure used to configure Non-Traditional Layer Security (NTLS)
@@ -15,44 +15,97 @@
 package app
 
 import (
+	"errors"
 	"fmt"
 	"os"
+	"runtime"
+	"time"
+	"trust-tunnel/pkg/trust-tunnel-client/fips"
 
 	"github.com/spf13/cobra"
+	client "trust-tunnel/pkg/trust-tunnel-client"
 )
 
 // Version of the client.
 var Version string
 
+// exitCodeTimeout is the exit code when the command is killed on timeout, the same as timeout(1).
+const exitCodeTimeout = 124
+
 type Option struct {
-	SessionID        string
-	Host             string
-	Port             int
-	Pod              string
-	ContainerName    string
-	ContainerID      string
-	IP               string
-	Type             string
-	Interactive      bool
-	Tty              bool
-	LoginName        string
-	LoginGroup       string
-	UserName         string
-	TLSVerify        bool
-	NTLSVerify       bool
-	TLSCert          string
-	TLSKey           string
-	TLSCa            string
-	NTLSCa           string
-	NTLSSignKey      string
-	NTLSSignCert     string
-	NTLSEncCert      string
-	NTLSEncKey       string
-	Cipher           string
-	Cmd              []string
-	Cpus             float64
-	MemoryMB         int
-	DisableCleanMode bool
+	SessionID             string
+	AffinityToken         string
+	Host                  string
+	Port                  int
+	Jump                  string
+	Pod                   string
+	ContainerName         string
+	ContainerID           string
+	IP                    string
+	Type                  string
+	Interactive           bool
+	Tty                   bool
+	LoginName             string
+	LoginGroup            string
+	UserName              string
+	TLSVerify             bool
+	NTLSVerify            bool
+	TLSCert               string
+	TLSKey                string
+	TLSCa                 string
+	TLSServerName         string
+	FIPS                  bool
+	CredentialProvider    string
+	CredentialParams      map[string]string
+	TLSInsecureSkipVerify bool
+	NTLSCa                string
+	NTLSSignKey           string
+	NTLSSignCert          string
+	NTLSEncCert           string
+	NTLSEncKey            string
+	Cipher                string
+	Cmd                   []string
+	Shell                 string
+	Tools                 bool
+	Cpus                  float64
+	MemoryMB              int
+	DisableCleanMode      bool
+	TCPKeepAlive          time.Duration
+	PingPeriod            time.Duration
+	ReadBufferSize        int
+	WriteBufferSize       int
+	FrameProfile          string
+	FrameSize             int
+	Quiet                 bool
+	Timestamps            bool
+	PrefixTarget          bool
+	LineBuffered          bool
+	Timeout               time.Duration
+	Input                 string
+	Width                 int
+	Height                int
+	History               bool
+	HistoryDir            string
+	PasteChunkSize        int
+	PasteDelay            time.Duration
+	PasteProgress         bool
+	Debug                 string
+	DebugPID              int
+	DebugListen           string
+	MFACode               string
+	Logs                  *client.LogsOptions
+	File                  *client.FileRequest
+	Top                   bool
+	Verb                  *client.VerbRequest
+	Tags                  map[string]string
+	ForwardEnv            bool
+	Env                   []string
+	CommandFrameThreshold int
+	Confirm               bool
+	Observe               string
+	Target                string
+	Resolver              string
+	ResolverParams        map[string]string
 }
 
 // NewCommand creates a new cobra command for the trust-tunnel-client.
@@ -61,32 +114,65 @@ func NewCommand() *cobra.Command {
 	cmd := &cobra.Command{
 		Use:   "trust-tunnel-client [OPTIONS] COMMAND [ARG...]",
 		Short: "Run a command in a remote running container or physical host",
-		Args:  cobra.MinimumNArgs(1),
+		Args: func(cmd *cobra.Command, args []string) error {
+			// The command of the debug mode is the debug server, and the observers run nothing.
+			if options.Debug != "" || options.Observe != "" {
+				return cobra.NoArgs(cmd, args)
+			}
+
+			return cobra.MinimumNArgs(1)(cmd, args)
+		},
 		RunE: func(cmd *cobra.Command, args []string) error {
-			options.Cmd = args
-			exitCode, err := runClient(options)
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "%v\n", err)
-				os.Exit(-1)
+			if options.Debug != "" {
+				if err := runDebugBridge(options); err != nil {
+					fmt.Fprintf(os.Stderr, "%v\n", err)
+					os.Exit(-1)
+				}
+
+				return nil
 			}
-			os.Exit(exitCode)
+
+			options.Cmd = args
+			runClientAndExit(options)
 
 			return nil
 		},
 	}
 
 	// Create version sub command.
+	var verbose bool
+
 	versionCmd := &cobra.Command{
 		Use:   "version",
 		Short: "Display the current version of this CLI tool",
-		Long:  "Display the current version of this CLI tool",
+		Long:  "Display the current version of this CLI tool, and the features of the build with --verbose",
 		Run: func(cmd *cobra.Command, args []string) {
 			// Print the version of trust-tunnel-client.
 			fmt.Println(Version)
+
+			if verbose {
+				mode := fips.Mode()
+				if mode == "" {
+					mode = "off"
+				}
+
+				fmt.Printf("platform: %s/%s\n", runtime.GOOS, runtime.GOARCH)
+				fmt.Printf("ntls: %t\n", client.NTLSSupported())
+				fmt.Printf("fips: %s\n", mode)
+				fmt.Printf("resize: %s\n", resizeTracking)
+			}
 		},
 	}
+	versionCmd.Flags().BoolVarP(&verbose, "verbose", "v", false, "Display the features of the build as well")
 
 	cmd.AddCommand(versionCmd)
+	cmd.AddCommand(newDecodeWatermarkCommand())
+	cmd.AddCommand(newLogsCommand())
+	cmd.AddCommand(newFileCommands()...)
+	cmd.AddCommand(newTopCommand())
+	cmd.AddCommand(newRunVerbCommand())
+	cmd.AddCommand(newCopyCommand())
+	cmd.AddCommand(newPortForwardCommand())
 
 	// Setup command flags and bind them to options.
 	setupCmdFlags(cmd, options)
@@ -94,21 +180,68 @@ func NewCommand() *cobra.Command {
 	return cmd
 }
 
+// runClientAndExit runs the session, and exits with the exit code of the command.
+func runClientAndExit(options *Option) {
+	exitCode, err := runClient(options)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+
+		if errors.Is(err, client.ErrCommandTimeout) {
+			os.Exit(exitCodeTimeout)
+		}
+
+		os.Exit(-1)
+	}
+
+	os.Exit(exitCode)
+}
+
 // setupCmdFlags sets up the command line flags.
 func setupCmdFlags(cmd *cobra.Command, options *Option) {
 	flags := cmd.Flags()
 	flags.SetInterspersed(false)
 
+	setupTargetFlags(cmd, options)
+
 	flags.StringVarP(&options.SessionID, "session-id", "s", "", "Session ID to uniquely identify the session")
+	flags.StringVarP(&options.AffinityToken, "affinity-token", "", "", "Affinity token issued by the agent, used to reattach the session behind a load balancer")
+	flags.StringVarP(&options.Type, "type", "", "phys", "Connection type: 'phys' for physical or 'container' for container")
+	flags.BoolVarP(&options.Interactive, "interactive", "i", false, "Start an interactive session with Stdin enabled")
+	flags.BoolVarP(&options.Tty, "tty", "t", false, "Allocate a TTY for the session")
+	flags.IntVarP(&options.Width, "width", "", 0, "Width of the remote terminal, defaults to the local terminal width or 80")
+	flags.IntVarP(&options.Height, "height", "", 0, "Height of the remote terminal, defaults to the local terminal height or 24")
+	flags.BoolVarP(&options.History, "history", "", false, "Record the commands typed in interactive TTY sessions to a local history file per target")
+	flags.StringVarP(&options.HistoryDir, "history-dir", "", defaultHistoryDir(), "Directory of the history files")
+	flags.IntVarP(&options.PasteChunkSize, "paste-chunk-size", "", 256, "Size of the chunks large pastes are split into in interactive TTY sessions, disabled if not positive")
+	flags.DurationVarP(&options.PasteDelay, "paste-delay", "", 10*time.Millisecond, "Delay between the chunks of large pastes")
+	flags.BoolVarP(&options.PasteProgress, "paste-progress", "", false, "Show the progress of large pastes")
+	flags.StringVarP(&options.Input, "input", "", "", "Read the input of the command from the file instead of Stdin, implies --interactive")
+	flags.StringVarP(&options.Shell, "shell", "", "", "Set to 'auto' to run the command with the shell found in the target, i.e. bash, sh or ash")
+	flags.BoolVarP(&options.Tools, "tools", "", false, "Run the command with the tools of the sidecar in the container's namespaces, for distroless containers; the container's root is at $TARGET_ROOT")
+	flags.Float64VarP(&options.Cpus, "cpus", "c", 1.0, "Amount of CPU resources for command execution (e.g., 0.5, 2.0)")
+	flags.IntVarP(&options.MemoryMB, "memory", "m", 512, "Amount of memory (MB) for command execution")
+	flags.BoolVarP(&options.DisableCleanMode, "disable-clean-mode", "d", false, "Disabling clean mode prevents the use of sidecars and nsenter")
+	flags.StringVarP(&options.Debug, "debug", "", "", "Attach dlv or gdb (gdbserver) to the process of --debug-pid in the target, and bridge it to --debug-listen for the local debugger")
+	flags.IntVarP(&options.DebugPID, "debug-pid", "", 1, "PID of the process to debug in the target")
+	flags.StringVarP(&options.DebugListen, "debug-listen", "", "127.0.0.1:2345", "Local address the debugger connects to")
+	flags.StringVarP(&options.Observe, "observe", "", "", "Attach to the live session of the ID as a read-only observer to shadow it, e.g. when troubleshooting together, requires agents of protocol version 6")
+}
+
+// setupTargetFlags sets up the flags of the agent, the target and the output shared by the sub commands
+// starting sessions.
+func setupTargetFlags(cmd *cobra.Command, options *Option) {
+	flags := cmd.Flags()
+
 	flags.StringVarP(&options.Host, "host", "o", "", "Target agent server address")
+	flags.StringVarP(&options.Target, "target", "", "", "Friendly name of the target, e.g. payments-prod-3, resolved to the agent and the target by --resolver instead of --host, --pod, --cname, --cid and --ip")
+	flags.StringVarP(&options.Resolver, "resolver", "", "file", "Resolver of --target, file for the targets bookmarked in ~/.trust-tunnel/targets.json or the file of --resolver-param path=...")
+	flags.StringToStringVarP(&options.ResolverParams, "resolver-param", "", nil, "Parameter of the resolver, e.g. path=targets.json, can be repeated")
 	flags.IntVarP(&options.Port, "port", "p", 5006, "Target agent server port")
-	flags.StringVarP(&options.Type, "type", "", "phys", "Connection type: 'phys' for physical or 'container' for container")
+	flags.StringVarP(&options.Jump, "jump", "J", "", "Address of the jump agent proxying the session to the target agent, e.g. 10.0.0.1:5006")
 	flags.StringVarP(&options.Pod, "pod", "", "", "Name of the target pod")
 	flags.StringVarP(&options.ContainerName, "cname", "", "", "Name of the target container")
 	flags.StringVarP(&options.ContainerID, "cid", "", "", "ID of the target container")
 	flags.StringVarP(&options.IP, "ip", "", "", "IP address of the target container")
-	flags.BoolVarP(&options.Interactive, "interactive", "i", false, "Start an interactive session with Stdin enabled")
-	flags.BoolVarP(&options.Tty, "tty", "t", false, "Allocate a TTY for the session")
 	flags.StringVarP(&options.LoginName, "login-name", "l", "root", "Username for logging into the target host")
 	flags.StringVarP(&options.LoginGroup, "login-group", "g", "", "User group for logging into the target host")
 	flags.StringVarP(&options.UserName, "user-name", "u", "", "User issuing the command")
@@ -117,13 +250,32 @@ func setupCmdFlags(cmd *cobra.Command, options *Option) {
 	flags.StringVarP(&options.TLSCert, "tls-cert", "", "", "Path to the TLS certificate file for authentication")
 	flags.StringVarP(&options.TLSKey, "tls-key", "", "", "Path to the TLS private key file for authentication")
 	flags.StringVarP(&options.TLSCa, "tls-ca", "", "", "Path to the TLS CA certificate file to verify the server")
+	flags.BoolVarP(&options.FIPS, "fips", "", false, "Restrict TLS to the FIPS-approved cipher suites, key types and hash algorithms, requires --tls-verify")
+	flags.StringVarP(&options.TLSServerName, "tls-server-name", "", "", "Server name to verify the server's certificate against, defaults to the host being dialed")
+	flags.BoolVarP(&options.TLSInsecureSkipVerify, "tls-insecure-skip-verify", "", false, "Enable TLS without verifying the server's certificate, only for lab use")
+	flags.StringVarP(&options.CredentialProvider, "tls-credential-provider", "", "", "Credential provider of the TLS client certificate instead of --tls-cert and --tls-key, e.g. file")
+	flags.StringToStringVarP(&options.CredentialParams, "tls-credential-param", "", nil, "Parameter of the credential provider, e.g. cert=client.pem, can be repeated")
 	flags.StringVarP(&options.NTLSCa, "ntls-ca", "", "", "Specify NTLS ca file")
 	flags.StringVarP(&options.NTLSSignKey, "ntls-sign-key", "", "", "Specify NTLS sign key file")
 	flags.StringVarP(&options.NTLSSignCert, "ntls-sign-cert", "", "", "Specify NTLS sign cert file")
 	flags.StringVarP(&options.NTLSEncCert, "ntls-enc-cert", "", "", "Specify NTLS enc cert file")
 	flags.StringVarP(&options.NTLSEncKey, "ntls-enc-key", "", "", "Specify NTLS enc key file")
 	flags.StringVarP(&options.Cipher, "cipher", "", "", "Specify NTLS cipher")
-	flags.Float64VarP(&options.Cpus, "cpus", "c", 1.0, "Amount of CPU resources for command execution (e.g., 0.5, 2.0)")
-	flags.IntVarP(&options.MemoryMB, "memory", "m", 512, "Amount of memory (MB) for command execution")
-	flags.BoolVarP(&options.DisableCleanMode, "disable-clean-mode", "d", false, "Disabling clean mode prevents the use of sidecars and nsenter")
+	flags.DurationVarP(&options.TCPKeepAlive, "tcp-keepalive", "", 0, "TCP keep-alive period of the connection to agent, 15s if zero and disabled if negative")
+	flags.DurationVarP(&options.PingPeriod, "ping-period", "", 30*time.Second, "Period of websocket pings to keep idle sessions alive, disabled if not positive")
+	flags.IntVarP(&options.ReadBufferSize, "read-buffer-size", "", 0, "Websocket read buffer size in bytes, 4096 if zero")
+	flags.IntVarP(&options.WriteBufferSize, "write-buffer-size", "", 0, "Websocket write buffer size in bytes, 4096 if zero")
+	flags.StringVarP(&options.FrameProfile, "frame-profile", "", "", "Profile of the output frame size, bulk for the larger frames suiting large outputs, e.g. cat of large files")
+	flags.IntVarP(&options.FrameSize, "frame-size", "", 0, "Output frame size in bytes asked of the agent instead of the profile, clamped by the agent's limits")
+	flags.DurationVarP(&options.Timeout, "timeout", "", 0, "Kill the command if it runs longer than the timeout and exit with 124, e.g. 30s")
+	flags.BoolVarP(&options.Quiet, "quiet", "q", false, "Suppress output other than the command's, e.g. reattach hints")
+	flags.BoolVarP(&options.Timestamps, "timestamps", "", false, "Prefix each output line with a timestamp")
+	flags.BoolVarP(&options.PrefixTarget, "prefix-target", "", false, "Prefix each output line with the target, i.e. the pod, container or host")
+	flags.BoolVarP(&options.LineBuffered, "line-buffered", "", false, "Write output by complete lines, useful when piping output into log collectors")
+	flags.IntVarP(&options.CommandFrameThreshold, "command-frame-threshold", "", client.DefaultCommandFrameThreshold, "Send the command longer than the bytes in the first frame instead of the headers, requires agents of protocol version 2, disabled if negative")
+	flags.BoolVarP(&options.ForwardEnv, "forward-env", "", true, "Forward TERM, COLORTERM, LANG, LANGUAGE and LC_* to the command, subject to the policy of the agent")
+	flags.StringArrayVarP(&options.Env, "env", "e", nil, "Environment variable of the command as KEY=VAL, or KEY for the local value, subject to the policy of the agent, can be repeated")
+	flags.StringToStringVarP(&options.Tags, "tag", "", nil, "Tag of the session carried into the audit logs and metrics, e.g. incident=INC-1234, can be repeated")
+	flags.BoolVarP(&options.Confirm, "confirm", "", false, "Confirm the command as it's resolved by the agent, e.g. with the login directory entered, before it's run, requires agents of protocol version 3")
+	flags.StringVarP(&options.MFACode, "mfa-code", "", "", "Answer to the MFA challenge of the agent, e.g. a TOTP code, prompted on the terminal if it's required and empty")
 }
@@ -0,0 +1,105 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package app
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"unicode"
+
+	client "trust-tunnel/pkg/trust-tunnel-client"
+)
+
+// confirmPrompt returns the function asking the user on the terminal to confirm the command resolved by the agent.
+func confirmPrompt() func(*client.Confirmation) (bool, error) {
+	return func(confirmation *client.Confirmation) (bool, error) {
+		// The stdin may be the input of the command, so the answer is read from the terminal.
+		tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+		if err != nil {
+			return false, fmt.Errorf("confirmation is required, but there is no terminal to prompt for it")
+		}
+		defer tty.Close()
+
+		fmt.Fprint(tty, formatConfirmation(confirmation))
+
+		answer, err := bufio.NewReader(tty).ReadString('\n')
+		if err != nil {
+			return false, err
+		}
+
+		switch strings.ToLower(strings.TrimSpace(answer)) {
+		case "y", "yes":
+			return true, nil
+		}
+
+		return false, nil
+	}
+}
+
+// formatConfirmation returns the prompt showing the command resolved by the agent.
+func formatConfirmation(confirmation *client.Confirmation) string {
+	var b strings.Builder
+
+	target := "the host"
+	if confirmation.Target != "" {
+		target = "container " + shortContainerID(confirmation.Target)
+	}
+
+	user := confirmation.User
+	if user == "" {
+		user = "the default user"
+	}
+
+	fmt.Fprintf(&b, "The agent will run on %s as %s", target, user)
+
+	if confirmation.Dir != "" {
+		fmt.Fprintf(&b, " in %s", confirmation.Dir)
+	}
+
+	b.WriteString(":\n ")
+
+	for _, arg := range confirmation.Cmd {
+		b.WriteString(" " + quoteArg(arg))
+	}
+
+	b.WriteString("\nRun it? [y/N] ")
+
+	return b.String()
+}
+
+// quoteArg quotes the argument unless it's a plain word, so that the whitespaces and the control characters hidden
+// in it are shown.
+func quoteArg(arg string) string {
+	plain := arg != "" && strings.IndexFunc(arg, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && !strings.ContainsRune("-_./=:,+@%;$~", r)
+	}) < 0
+
+	if plain {
+		return arg
+	}
+
+	return strconv.Quote(arg)
+}
+
+// shortContainerID returns the container ID as shown by docker ps.
+func shortContainerID(id string) string {
+	if len(id) > 12 {
+		return id[:12]
+	}
+
+	return id
+}
@@ -0,0 +1,42 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package app
+
+import (
+	"testing"
+
+	client "trust-tunnel/pkg/trust-tunnel-client"
+)
+
+func TestFormatConfirmation(t *testing.T) {
+	tests := []struct {
+		confirmation *client.Confirmation
+		want         string
+	}{
+		{
+			&client.Confirmation{Cmd: []string{"/bin/bash", "-c", "cd /root;rm -rf ./tmp"}, User: "root", Dir: "/root", Target: "0123456789abcdef"},
+			"The agent will run on container 0123456789ab as root in /root:\n  /bin/bash -c \"cd /root;rm -rf ./tmp\"\nRun it? [y/N] ",
+		},
+		{
+			&client.Confirmation{Cmd: []string{"/bin/sh", "-c", "cd ;ls\x1b[2K"}},
+			"The agent will run on the host as the default user:\n  /bin/sh -c \"cd ;ls\\x1b[2K\"\nRun it? [y/N] ",
+		},
+	}
+
+	for _, test := range tests {
+		if got := formatConfirmation(test.confirmation); got != test.want {
+			t.Errorf("got %q, want %q", got, test.want)
+		}
+	}
+}
@@ -16,51 +16,144 @@ package app
 
 import (
 	"fmt"
+	"io"
 	"os"
+	"trust-tunnel/pkg/trust-tunnel-client/protocol"
 
-	"github.com/gorilla/websocket"
 	"golang.org/x/term"
 	client "trust-tunnel/pkg/trust-tunnel-client"
 )
 
-const bufferSize = 1024
+const (
+	bufferSize = 1024
+
+	// bulkOutputBufferSize matches the default bulk_frame_size of the agents.
+	bulkOutputBufferSize = 64 << 10
+)
 
 // createClient creates a client based on the given Option.
 func createClient(opt *Option) (*client.Client, error) {
+	if err := resolveTarget(opt); err != nil {
+		return nil, err
+	}
+
 	targetType, err := getClientTargetType(opt.Type)
 	if err != nil {
 		return nil, err
 	}
 
+	if opt.FrameProfile != "" && opt.FrameProfile != protocol.FrameProfileDefault && opt.FrameProfile != protocol.FrameProfileBulk {
+		return nil, fmt.Errorf("invalid frame profile %q, only %q and %q are supported",
+			opt.FrameProfile, protocol.FrameProfileDefault, protocol.FrameProfileBulk)
+	}
+
+	if opt.Shell != "" && opt.Shell != client.ShellAuto {
+		return nil, fmt.Errorf("invalid shell %q, only %q is supported", opt.Shell, client.ShellAuto)
+	}
+
+	if opt.TLSInsecureSkipVerify {
+		fmt.Fprintln(os.Stderr, "WARNING: the agent's certificate is not verified, the session is exposed to man-in-the-middle attacks")
+
+		opt.TLSVerify = true
+	}
+
+	// The observers attach to the session of the ID, with the input ignored.
+	if opt.Observe != "" {
+		if opt.SessionID != "" && opt.SessionID != opt.Observe {
+			return nil, fmt.Errorf("--observe and --session-id refer to different sessions")
+		}
+
+		if opt.Input != "" || opt.Confirm {
+			return nil, fmt.Errorf("--observe can't be used with --input or --confirm")
+		}
+
+		opt.SessionID = opt.Observe
+		opt.Interactive = false
+		opt.Tty = false
+	}
+
 	cli := client.Client{
-		SessionID:        opt.SessionID,
-		AgentAddr:        opt.Host,
-		AgentPort:        opt.Port,
-		Type:             targetType,
-		PodName:          opt.Pod,
-		ContainerName:    opt.ContainerName,
-		ContainerID:      opt.ContainerID,
-		IPAddress:        opt.IP,
-		Interactive:      opt.Interactive,
-		Tty:              opt.Tty,
-		Command:          opt.Cmd,
-		LoginName:        opt.LoginName,
-		LoginGroup:       opt.LoginGroup,
-		UserName:         opt.UserName,
-		TLSVerify:        opt.TLSVerify,
-		TLSCaCert:        opt.TLSCa,
-		TLSCert:          opt.TLSCert,
-		TLSKey:           opt.TLSKey,
-		NtlsVerify:       opt.NTLSVerify,
-		NTLSCaFile:       opt.NTLSCa,
-		NTLSSignCertFile: opt.NTLSSignCert,
-		NTLSEncCertFile:  opt.NTLSEncCert,
-		NTLSEncKeyFile:   opt.NTLSEncKey,
-		NTLSSignKeyFile:  opt.NTLSSignKey,
-		Cipher:           opt.Cipher,
-		Cpus:             opt.Cpus,
-		MemoryMB:         opt.MemoryMB,
-		DisableCleanMode: opt.DisableCleanMode,
+		SessionID:             opt.SessionID,
+		AffinityToken:         opt.AffinityToken,
+		AgentAddr:             opt.Host,
+		AgentPort:             opt.Port,
+		JumpAddr:              opt.Jump,
+		Type:                  targetType,
+		PodName:               opt.Pod,
+		ContainerName:         opt.ContainerName,
+		ContainerID:           opt.ContainerID,
+		IPAddress:             opt.IP,
+		Interactive:           opt.Interactive,
+		Tty:                   opt.Tty,
+		Command:               opt.Cmd,
+		Shell:                 opt.Shell,
+		Tools:                 opt.Tools,
+		Logs:                  opt.Logs,
+		File:                  opt.File,
+		Top:                   opt.Top,
+		Verb:                  opt.Verb,
+		Observe:               opt.Observe != "",
+		Tags:                  opt.Tags,
+		LoginName:             opt.LoginName,
+		LoginGroup:            opt.LoginGroup,
+		UserName:              opt.UserName,
+		TLSVerify:             opt.TLSVerify,
+		TLSCaCert:             opt.TLSCa,
+		TLSServerName:         opt.TLSServerName,
+		FIPS:                  opt.FIPS,
+		TLSInsecureSkipVerify: opt.TLSInsecureSkipVerify,
+		TLSCert:               opt.TLSCert,
+		TLSKey:                opt.TLSKey,
+		NtlsVerify:            opt.NTLSVerify,
+		NTLSCaFile:            opt.NTLSCa,
+		NTLSSignCertFile:      opt.NTLSSignCert,
+		NTLSEncCertFile:       opt.NTLSEncCert,
+		NTLSEncKeyFile:        opt.NTLSEncKey,
+		NTLSSignKeyFile:       opt.NTLSSignKey,
+		Cipher:                opt.Cipher,
+		Cpus:                  opt.Cpus,
+		MemoryMB:              opt.MemoryMB,
+		DisableCleanMode:      opt.DisableCleanMode,
+		TCPKeepAlive:          opt.TCPKeepAlive,
+		PingPeriod:            opt.PingPeriod,
+		ReadBufferSize:        opt.ReadBufferSize,
+		WriteBufferSize:       opt.WriteBufferSize,
+		FrameProfile:          opt.FrameProfile,
+		FrameSize:             opt.FrameSize,
+		Timeout:               opt.Timeout,
+		CommandFrameThreshold: opt.CommandFrameThreshold,
+		MFAPrompt:             mfaPrompt(opt),
+	}
+
+	if opt.Confirm {
+		cli.ConfirmCommand = confirmPrompt()
+	}
+
+	if opt.ForwardEnv {
+		cli.Env = forwardedEnv(os.Environ(), opt.Tty)
+	}
+
+	// The variables given explicitly take precedence over the forwarded ones.
+	if len(opt.Env) > 0 {
+		env, err := parseEnv(opt.Env, os.LookupEnv)
+		if err != nil {
+			return nil, err
+		}
+
+		if cli.Env == nil {
+			cli.Env = make(map[string]string, len(env))
+		}
+
+		for name, value := range env {
+			cli.Env[name] = value
+		}
+	}
+
+	if opt.CredentialProvider != "" {
+		cli.Credentials, err = client.CreateCredentialProvider(opt.CredentialProvider, opt.CredentialParams)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	return &cli, nil
@@ -81,6 +174,20 @@ func getClientTargetType(targetType string) (client.TargetType, error) {
 // runClient creates a client and starts a session. It sets up signal handling and
 // launches goroutines to handle local input and remote output and error streams.
 func runClient(opt *Option) (int, error) {
+	// Read the input of the command from the file if given.
+	input := os.Stdin
+
+	if opt.Input != "" {
+		f, err := os.Open(opt.Input)
+		if err != nil {
+			return -1, fmt.Errorf("open input file error: %v", err)
+		}
+		defer f.Close()
+
+		input = f
+		opt.Interactive = true
+	}
+
 	cli, err := createClient(opt)
 	if err != nil {
 		return -1, err
@@ -91,14 +198,31 @@ func runClient(opt *Option) (int, error) {
 		return -1, err
 	}
 
-	w, h, _ := term.GetSize(int(os.Stdin.Fd()))
+	if opt.Logs != nil {
+		closeOnInterrupt(session)
+	}
+
+	// Tell the user how to reattach the session, unless it's reattached already. The hint is shown as the
+	// interactive terminal sessions start, and for the others only if they are dropped, so that the stderr of the
+	// scripts isn't cluttered.
+	reattachable := !opt.Quiet && cli.SessionID != "" && cli.AffinityToken != opt.AffinityToken && !cli.Observe
+	interactiveTty := cli.Interactive && cli.Tty
 
-	err = session.Resize(h, w)
-	if err != nil {
-		return -1, err
+	if reattachable && interactiveTty {
+		fmt.Fprintf(os.Stderr, "reattach with: --session-id %s --affinity-token %s\n", cli.SessionID, cli.AffinityToken)
 	}
 
-	setupSignal(session)
+	// Size the remote terminal, and follow the size changes of the local terminal.
+	if cli.Tty {
+		w, h := terminalSize(opt)
+
+		err = session.Resize(h, w)
+		if err != nil {
+			return -1, err
+		}
+
+		setupSignal(session, opt)
+	}
 
 	if cli.Interactive && cli.Tty {
 		fd := int(os.Stdin.Fd())
@@ -110,64 +234,161 @@ func runClient(opt *Option) (int, error) {
 		defer term.Restore(fd, oldState)
 	}
 
+	// Record the typed commands to the history file of the target.
+	var (
+		localInput io.Reader = input
+		recorder   *historyRecorder
+	)
+
+	if opt.History && cli.Interactive && cli.Tty {
+		recorder, err = openHistoryRecorder(opt.HistoryDir, opt)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "open history file error: %v\n", err)
+		} else {
+			defer recorder.Close()
+
+			localInput = io.TeeReader(input, recorder)
+		}
+	}
+
+	// Decorate the remote output as requested.
+	var prefix string
+	if opt.PrefixTarget {
+		prefix = targetName(opt)
+	}
+
+	stdout := newOutputWriter(os.Stdout, opt.Timestamps, prefix, opt.LineBuffered)
+	stderr := newOutputWriter(os.Stderr, opt.Timestamps, prefix, opt.LineBuffered)
+
+	defer flushOutput(stdout)
+	defer flushOutput(stderr)
+
 	errs := make(chan error, 1)
 
-	go processLocalInput(errs, session)
-	go processRemoteOutput(errs, session)
-	go processRemoteErr(errs, session)
+	// Pace large pastes into interactive TTY sessions.
+	var sessionInput io.Writer = session
+
+	if cli.Interactive && cli.Tty {
+		var progress io.Writer
+		if opt.PasteProgress {
+			progress = os.Stderr
+		}
+
+		sessionInput = newPasteWriter(session, opt.PasteChunkSize, opt.PasteDelay, progress)
+	}
+
+	// The input of the observers would be discarded by the agent.
+	if !cli.Observe {
+		go processLocalInput(errs, session, localInput, sessionInput)
+	}
+
+	// The recorder tells the lines typed without echo, e.g. passwords, from the output.
+	remoteOutput := stdout
+	if recorder != nil {
+		remoteOutput = io.MultiWriter(stdout, recorder.Output())
+	}
+
+	go processRemoteOutput(errs, session, remoteOutput, outputBufferSize(opt))
+	go processRemoteErr(errs, session, stderr)
 
 	err = <-errs
 
+	// Both of the output and the errors are drained once the session ends, wait for the other one to be written,
+	// which may still be in flight if the agent closes the session right after the output.
+	if err == nil {
+		err = <-errs
+	}
+
+	// Tell the user why the session is terminated if it isn't ended by the command or the user.
+	if reason := client.SessionTerminationReason(session); !opt.Quiet && reason != "" &&
+		reason != client.TerminationExited && reason != client.TerminationClientClose {
+		// The terminal may still be in raw mode, so the carriage return is needed.
+		fmt.Fprintf(os.Stderr, "session terminated: %s\r\n", reason)
+	}
+
+	if err != nil && reattachable && !interactiveTty {
+		fmt.Fprintf(os.Stderr, "session dropped, reattach with: --session-id %s --affinity-token %s\n", cli.SessionID, cli.AffinityToken)
+	}
+
 	return session.ExitCode(), err
 }
 
-// processLocalInput reads from os.Stdin and writes to a client.Session.
-func processLocalInput(errs chan error, session client.Session) {
+// targetName returns the name identifying the target in output lines.
+func targetName(opt *Option) string {
+	if opt.Type == "container" {
+		for _, name := range []string{opt.Pod, opt.ContainerName, opt.ContainerID, opt.IP} {
+			if name != "" {
+				return name
+			}
+		}
+	}
+
+	return opt.Host
+}
+
+// processLocalInput reads from input and writes to a client.Session through output, which may pace the writes.
+// The stdin of the remote command is closed once input reaches EOF, e.g. a piped script is exhausted,
+// and the session goes on until the command exits.
+func processLocalInput(errs chan error, session client.Session, input io.Reader, output io.Writer) {
 	buf := make([]byte, bufferSize)
 
 	for {
-		n, err := os.Stdin.Read(buf)
+		n, err := input.Read(buf)
+		if err == io.EOF {
+			if err = client.CloseStdin(session); err != nil {
+				errs <- fmt.Errorf("close remote stdin error: %v", err)
+			}
+
+			return
+		}
+
 		if err != nil {
 			errs <- fmt.Errorf("read from stdin error: %v", err)
 
 			return
 		}
 
-		written := 0
-		for written < n {
-			m, err := session.Write(buf[written:n])
-			if err != nil {
-				errs <- fmt.Errorf("write to remote error: %v", err)
-
-				return
-			}
+		if _, err = writeAll(output, buf[:n]); err != nil {
+			errs <- fmt.Errorf("write to remote error: %v", err)
 
-			written += m
+			return
 		}
 	}
 }
 
-// processRemoteOutput reads from a client.Session and writes the output to os.Stdout.
-func processRemoteOutput(errs chan error, session client.Session) {
-	buf := make([]byte, 1024)
+// outputBufferSize returns the size of the buffer reading the output, which keeps up with the frames asked of the agent.
+func outputBufferSize(opt *Option) int {
+	switch {
+	case opt.FrameSize > 0:
+		return opt.FrameSize
+	case opt.FrameProfile == protocol.FrameProfileBulk:
+		return bulkOutputBufferSize
+	default:
+		return bufferSize
+	}
+}
+
+// processRemoteOutput reads from a client.Session and writes the output to stdout.
+func processRemoteOutput(errs chan error, session client.Session, stdout io.Writer, size int) {
+	buf := make([]byte, size)
 
 	for {
 		n, err := session.Read(buf)
 		if err != nil {
-			if closeErr, ok := err.(*websocket.CloseError); ok && closeErr.Code == websocket.CloseNormalClosure {
-				// If the error is a normal close error, ignore it and exit the loop.
+			if err == io.EOF {
+				// The command exited, and the output is drained.
 				errs <- nil
 
 				return
 			}
-			errs <- fmt.Errorf("read from remote error: %v", err)
+			errs <- fmt.Errorf("read from remote error: %w", err)
 
 			return
 		}
 
 		written := 0
 		for written < n {
-			m, err := os.Stdout.Write(buf[written:n])
+			m, err := stdout.Write(buf[written:n])
 			if err != nil {
 				errs <- fmt.Errorf("write to Stdout error: %v", err)
 
@@ -179,27 +400,27 @@ func processRemoteOutput(errs chan error, session client.Session) {
 	}
 }
 
-// processRemoteErr reads from a client.Session and writes the error output to os.Stderr.
-func processRemoteErr(errs chan error, session client.Session) {
+// processRemoteErr reads from a client.Session and writes the error output to stderr.
+func processRemoteErr(errs chan error, session client.Session, stderr io.Writer) {
 	buf := make([]byte, 1024)
 
 	for {
 		n, err := session.ReadStderr(buf)
 		if err != nil {
-			if closeErr, ok := err.(*websocket.CloseError); ok && closeErr.Code == websocket.CloseNormalClosure {
-				// If the error is a normal close error, ignore it and exit the loop.
+			if err == io.EOF {
+				// The command exited, and the error output is drained.
 				errs <- nil
 
 				return
 			}
-			errs <- fmt.Errorf("read from remote stderr error: %v", err)
+			errs <- fmt.Errorf("read from remote stderr error: %w", err)
 
 			return
 		}
 
 		written := 0
 		for written < n {
-			m, err := os.Stderr.Write(buf[written:n])
+			m, err := stderr.Write(buf[written:n])
 			if err != nil {
 				errs <- fmt.Errorf("write to Stderr error: %v", err)
 
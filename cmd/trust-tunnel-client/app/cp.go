@@ -0,0 +1,342 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package app
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+	client "trust-tunnel/pkg/trust-tunnel-client"
+)
+
+// newCopyCommand creates the command copying the files to or from the target by the agent, like kubectl cp.
+func newCopyCommand() *cobra.Command {
+	options := &Option{}
+
+	cmd := &cobra.Command{
+		Use:   "cp SRC DEST",
+		Short: "Copy files to or from the target, the remote path is prefixed with ':'",
+		Long: `Copy files to or from the target by the agent, without running any command in the target.
+
+The remote path is absolute and prefixed with ':'. A file or a directory is copied into the directory DEST:
+  trust-tunnel-client cp -o 10.0.0.1 ./app.conf :/etc/app
+  trust-tunnel-client cp -o 10.0.0.1 --type container --cid 0123abcd :/var/log/app ./logs`,
+		Args: cobra.ExactArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := runCopy(options, args[0], args[1]); err != nil {
+				fmt.Fprintf(os.Stderr, "%v\n", err)
+				os.Exit(-1)
+			}
+		},
+	}
+
+	setupTargetFlags(cmd, options)
+
+	flags := cmd.Flags()
+	flags.StringVarP(&options.Type, "type", "", "phys", "Connection type: 'phys' for physical or 'container' for container")
+
+	return cmd
+}
+
+// parseCopyArgs returns the copy request and the local path of the arguments, one of which is the remote path.
+func parseCopyArgs(src, dest string) (*client.CopyRequest, string, error) {
+	remoteSrc, remoteDest := strings.HasPrefix(src, ":"), strings.HasPrefix(dest, ":")
+
+	switch {
+	case remoteSrc && remoteDest:
+		return nil, "", fmt.Errorf("only one of SRC and DEST can be remote")
+	case remoteSrc:
+		return &client.CopyRequest{Direction: client.CopyFromTarget, Path: src[1:]}, dest, nil
+	case remoteDest:
+		return &client.CopyRequest{Direction: client.CopyToTarget, Path: dest[1:]}, src, nil
+	default:
+		return nil, "", fmt.Errorf("one of SRC and DEST must be remote, prefixed with ':'")
+	}
+}
+
+// runCopy copies the files between the local path and the remote path of the arguments.
+func runCopy(opt *Option, src, dest string) error {
+	req, local, err := parseCopyArgs(src, dest)
+	if err != nil {
+		return err
+	}
+
+	cli, err := createClient(opt)
+	if err != nil {
+		return err
+	}
+
+	if req.Direction == client.CopyFromTarget {
+		r, w := io.Pipe()
+		done := make(chan error, 1)
+
+		go func() {
+			err := extractLocalTar(local, r)
+			// The rest of the stream is discarded, so that the copy isn't blocked.
+			r.CloseWithError(err)
+			done <- err
+		}()
+
+		err = cli.Copy(nil, req, nil, w)
+		w.CloseWithError(err)
+
+		// The error of the copy is told rather than the one of the stream it breaks.
+		if extractErr := <-done; err == nil {
+			err = extractErr
+		}
+
+		return err
+	}
+
+	if _, err = os.Lstat(local); err != nil {
+		return err
+	}
+
+	r, w := io.Pipe()
+
+	go func() {
+		w.CloseWithError(writeLocalTar(local, w))
+	}()
+
+	return cli.Copy(nil, req, r, nil)
+}
+
+// writeLocalTar writes the tar stream of the local file or directory, whose entries are named after its base name.
+// The symbolic links are written as they are, and the special files are skipped with the warnings.
+func writeLocalTar(local string, w io.Writer) error {
+	abs, err := filepath.Abs(local)
+	if err != nil {
+		return err
+	}
+
+	base := filepath.Base(abs)
+	tw := tar.NewWriter(w)
+
+	err = filepath.WalkDir(abs, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(abs, p)
+		if err != nil {
+			return err
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		return writeLocalEntry(tw, p, path.Join(base, filepath.ToSlash(rel)), info)
+	})
+	if err != nil {
+		return err
+	}
+
+	return tw.Close()
+}
+
+// writeLocalEntry writes the local file to the tar stream, named as given.
+func writeLocalEntry(tw *tar.Writer, p, name string, info fs.FileInfo) error {
+	var link string
+
+	switch {
+	case info.Mode().IsRegular(), info.IsDir():
+	case info.Mode()&fs.ModeSymlink != 0:
+		var err error
+		if link, err = os.Readlink(p); err != nil {
+			return err
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "skip %s: not a regular file, a directory or a symbolic link\n", p)
+
+		return nil
+	}
+
+	hdr, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return err
+	}
+
+	hdr.Name = name
+	if info.IsDir() {
+		hdr.Name += "/"
+	}
+
+	if err = tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+
+	if !info.Mode().IsRegular() {
+		return nil
+	}
+
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// The file may be changed while it's copied, only the size in the header is written.
+	_, err = io.CopyN(tw, f, hdr.Size)
+
+	return err
+}
+
+// extractLocalTar extracts the tar stream into the local directory. The entries escaping the directory are refused,
+// and the symbolic links are never written through, so that the files copied from the target stay in the directory.
+func extractLocalTar(dest string, r io.Reader) error {
+	info, err := os.Stat(dest)
+	if err != nil {
+		return err
+	}
+
+	if !info.IsDir() {
+		return fmt.Errorf("%s isn't a directory", dest)
+	}
+
+	tr := tar.NewReader(r)
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+
+		if err != nil {
+			return fmt.Errorf("read tar stream error: %v", err)
+		}
+
+		if err = extractLocalEntry(dest, hdr, tr); err != nil {
+			return fmt.Errorf("extract %s error: %v", hdr.Name, err)
+		}
+	}
+}
+
+// extractLocalEntry extracts the tar entry into the local directory.
+func extractLocalEntry(dest string, hdr *tar.Header, r io.Reader) error {
+	rel, err := localEntryPath(dest, hdr.Name)
+	if err != nil || rel == "" {
+		return err
+	}
+
+	target := filepath.Join(dest, rel)
+	perm := fs.FileMode(hdr.Mode).Perm()
+
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		err = os.Mkdir(target, perm)
+		if os.IsExist(err) {
+			if info, statErr := os.Lstat(target); statErr == nil && info.IsDir() {
+				return nil
+			}
+		}
+
+		return err
+	case tar.TypeSymlink:
+		if err = removeNonDir(target); err != nil {
+			return err
+		}
+
+		return os.Symlink(hdr.Linkname, target)
+	case tar.TypeReg:
+		// The link is replaced rather than written through.
+		if err = removeNonDir(target); err != nil {
+			return err
+		}
+
+		f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+		if err != nil {
+			return err
+		}
+
+		if _, err = io.CopyN(f, r, hdr.Size); err != nil {
+			f.Close()
+
+			return err
+		}
+
+		if err = f.Close(); err != nil {
+			return err
+		}
+
+		return os.Chtimes(target, hdr.ModTime, hdr.ModTime)
+	default:
+		fmt.Fprintf(os.Stderr, "skip %s: not a regular file, a directory or a symbolic link\n", hdr.Name)
+
+		return nil
+	}
+}
+
+// localEntryPath returns the local path of the tar entry relative to the directory, empty for the directory itself.
+// The entries escaping the directory, or under the symbolic links in it, are refused.
+func localEntryPath(dest, name string) (string, error) {
+	for _, elem := range strings.Split(name, "/") {
+		if elem == ".." {
+			return "", fmt.Errorf("it escapes the directory")
+		}
+	}
+
+	rel := strings.TrimPrefix(path.Clean("/"+name), "/")
+	if rel == "" {
+		return "", nil
+	}
+
+	// The parent directories are checked, since the links among them may point anywhere.
+	parent := dest
+
+	for _, elem := range strings.Split(path.Dir(rel), "/") {
+		if elem == "." {
+			break
+		}
+
+		parent = filepath.Join(parent, elem)
+
+		info, err := os.Lstat(parent)
+		if err != nil {
+			return "", err
+		}
+
+		if !info.IsDir() {
+			return "", fmt.Errorf("%s isn't a directory", parent)
+		}
+	}
+
+	return filepath.FromSlash(rel), nil
+}
+
+// removeNonDir removes the file unless it's a directory, so that it's replaced.
+func removeNonDir(p string) error {
+	info, err := os.Lstat(p)
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if info.IsDir() {
+		return fmt.Errorf("it exists and is a directory")
+	}
+
+	return os.Remove(p)
+}
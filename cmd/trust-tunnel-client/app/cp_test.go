@@ -0,0 +1,90 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package app
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	client "trust-tunnel/pkg/trust-tunnel-client"
+)
+
+func TestParseCopyArgs(t *testing.T) {
+	req, local, err := parseCopyArgs("./app.conf", ":/etc/app")
+	if err != nil || req.Direction != client.CopyToTarget || req.Path != "/etc/app" || local != "./app.conf" {
+		t.Errorf("unexpected request %+v of local %s, %v", req, local, err)
+	}
+
+	req, local, err = parseCopyArgs(":/var/log/app", "logs")
+	if err != nil || req.Direction != client.CopyFromTarget || req.Path != "/var/log/app" || local != "logs" {
+		t.Errorf("unexpected request %+v of local %s, %v", req, local, err)
+	}
+
+	for _, args := range [][2]string{{"a", "b"}, {":/a", ":/b"}} {
+		if _, _, err := parseCopyArgs(args[0], args[1]); err == nil {
+			t.Errorf("%v should be refused", args)
+		}
+	}
+}
+
+func TestLocalTarRoundTrip(t *testing.T) {
+	src, dst := t.TempDir(), t.TempDir()
+
+	if err := os.MkdirAll(filepath.Join(src, "app/conf"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(filepath.Join(src, "app/conf/app.yaml"), []byte("port: 80\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	var stream bytes.Buffer
+	if err := writeLocalTar(filepath.Join(src, "app"), &stream); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := extractLocalTar(dst, &stream); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile(filepath.Join(dst, "app/conf/app.yaml"))
+	if err != nil || string(b) != "port: 80\n" {
+		t.Errorf("unexpected content %q, %v", b, err)
+	}
+
+	// The entries can't escape the directory, nor be written through the symbolic links.
+	if err := os.Symlink(src, filepath.Join(dst, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"../escaped", "link/escaped"} {
+		var evil bytes.Buffer
+
+		tw := tar.NewWriter(&evil)
+		tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: name, Mode: 0o644, Size: 1})
+		tw.Write([]byte("x"))
+		tw.Close()
+
+		if err := extractLocalTar(dst, &evil); err == nil {
+			t.Errorf("%s should be refused", name)
+		}
+	}
+
+	if _, err := os.Lstat(filepath.Join(src, "escaped")); !os.IsNotExist(err) {
+		t.Errorf("the file shouldn't be written through the link, got %v", err)
+	}
+}
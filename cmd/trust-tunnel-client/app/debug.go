@@ -0,0 +1,220 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package app
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	client "trust-tunnel/pkg/trust-tunnel-client"
+)
+
+// Debuggers supported by the debug mode.
+const (
+	debuggerDlv = "dlv"
+	debuggerGdb = "gdb"
+)
+
+// debugCommand returns the command running the debug server attached to the process pid in the target,
+// which serves the debugger through its stdin and stdout.
+func debugCommand(debugger string, pid int) ([]string, error) {
+	switch debugger {
+	case debuggerGdb:
+		// gdbserver speaks the remote protocol over stdio.
+		return []string{"gdbserver", "--attach", "-", strconv.Itoa(pid)}, nil
+	case debuggerDlv:
+		// Delve doesn't serve stdio, so it listens on a unix socket in a directory private to the session,
+		// instead of a port of the target's network, and the connection is relayed by nc once it's listening.
+		// It exits when the debugger disconnects, and the directory is removed with the session.
+		script := fmt.Sprintf(`d=$(mktemp -d) || exit 1; `+
+			`dlv attach %d --headless --api-version=2 --listen="unix:$d/dlv.sock" >&2 & `+
+			`trap 'kill $! 2>/dev/null; rm -rf "$d"' EXIT; `+
+			`i=0; until [ -S "$d/dlv.sock" ]; do i=$((i+1)); [ $i -lt 50 ] || exit 1; sleep 0.2; done; `+
+			`nc -U "$d/dlv.sock"`, pid)
+
+		return []string{"sh", "-c", script}, nil
+	default:
+		return nil, fmt.Errorf("unsupported debugger %q, only %q and %q are supported", debugger, debuggerDlv, debuggerGdb)
+	}
+}
+
+// runDebugBridge listens for the local debugger, e.g. an IDE, and bridges each connection to a new session
+// running the debug server attached to the process in the target. The sessions are closed when the connections
+// are, or the client is interrupted, so the debug servers are cleaned by the agent.
+func runDebugBridge(opt *Option) error {
+	listener, err := net.Listen("tcp", opt.DebugListen)
+	if err != nil {
+		return fmt.Errorf("listen for the debugger error: %v", err)
+	}
+	defer listener.Close()
+
+	opt.Cmd, err = debugCommand(opt.Debug, opt.DebugPID)
+	if err != nil {
+		return err
+	}
+
+	// The debug servers talk to the debugger through raw stdio.
+	opt.Interactive = true
+	opt.Tty = false
+
+	bridges := &debugBridges{sessions: make(map[client.Session]struct{})}
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		<-sigCh
+		bridges.closeAll()
+		listener.Close()
+	}()
+
+	fmt.Fprintf(os.Stderr, "waiting for %s on %s to debug process %d\n", opt.Debug, listener.Addr(), opt.DebugPID)
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if bridges.closed() {
+				return nil
+			}
+
+			return fmt.Errorf("accept the debugger error: %v", err)
+		}
+
+		go func() {
+			if err := bridges.serve(conn, opt); err != nil {
+				fmt.Fprintf(os.Stderr, "debug session error: %v\n", err)
+			}
+		}()
+	}
+}
+
+// debugBridges are the sessions bridged to the local debugger.
+type debugBridges struct {
+	lock     sync.Mutex
+	sessions map[client.Session]struct{}
+	done     bool
+	serial   atomic.Int64
+}
+
+// serve starts a session for the connection of the debugger and bridges them until either ends.
+func (b *debugBridges) serve(conn net.Conn, opt *Option) error {
+	defer conn.Close()
+
+	cli, err := createClient(opt)
+	if err != nil {
+		return err
+	}
+
+	// Each connection is a new session, whose ID is unique even if the connections are made in the same second.
+	cli.SessionID = fmt.Sprintf("%s-%d", time.Now().Format("20060102150405"), b.serial.Add(1))
+
+	session, err := cli.Start(nil)
+	if err != nil {
+		return err
+	}
+
+	if !b.add(session) {
+		session.CloseSession()
+		session.Close()
+
+		return nil
+	}
+	defer b.remove(session)
+
+	bridge(conn, session, os.Stderr)
+
+	return nil
+}
+
+func (b *debugBridges) add(session client.Session) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.done {
+		return false
+	}
+
+	b.sessions[session] = struct{}{}
+
+	return true
+}
+
+func (b *debugBridges) remove(session client.Session) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	delete(b.sessions, session)
+}
+
+func (b *debugBridges) closed() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return b.done
+}
+
+// closeAll closes the sessions and stops accepting new ones.
+func (b *debugBridges) closeAll() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.done = true
+
+	for session := range b.sessions {
+		session.CloseSession()
+		session.Close()
+	}
+}
+
+// bridge copies the data between the connection and the session until either ends, then closes the session
+// so that the processes in it are cleaned. The error output of the session is written to stderr.
+func bridge(conn net.Conn, session client.Session, stderr io.Writer) {
+	done := make(chan struct{}, 2)
+
+	go func() {
+		io.Copy(session, conn)
+		done <- struct{}{}
+	}()
+
+	go func() {
+		io.Copy(conn, session)
+		done <- struct{}{}
+	}()
+
+	go io.Copy(stderr, stderrReader{session})
+
+	<-done
+
+	session.CloseSession()
+	session.Close()
+	conn.Close()
+}
+
+// stderrReader reads the error output of a session.
+type stderrReader struct {
+	session client.Session
+}
+
+func (r stderrReader) Read(p []byte) (int, error) {
+	return r.session.ReadStderr(p)
+}
@@ -0,0 +1,123 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package app
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	client "trust-tunnel/pkg/trust-tunnel-client"
+)
+
+// echoSession is a session whose command echoes the input in upper case until the input is closed.
+type echoSession struct {
+	client.Session
+	stdin  *io.PipeWriter
+	stdout *io.PipeReader
+	closed bool
+}
+
+func newEchoSession() *echoSession {
+	inR, inW := io.Pipe()
+	outR, outW := io.Pipe()
+
+	go func() {
+		buf := make([]byte, 64)
+
+		for {
+			n, err := inR.Read(buf)
+			if err != nil {
+				outW.Close()
+
+				return
+			}
+
+			outW.Write(bytes.ToUpper(buf[:n]))
+		}
+	}()
+
+	return &echoSession{stdin: inW, stdout: outR}
+}
+
+func (s *echoSession) Write(p []byte) (int, error) {
+	return s.stdin.Write(p)
+}
+
+func (s *echoSession) Read(p []byte) (int, error) {
+	return s.stdout.Read(p)
+}
+
+func (s *echoSession) ReadStderr(_ []byte) (int, error) {
+	return 0, io.EOF
+}
+
+func (s *echoSession) CloseSession() error {
+	s.closed = true
+
+	return s.stdin.Close()
+}
+
+func (s *echoSession) Close() error {
+	return s.stdout.Close()
+}
+
+func TestDebugCommand(t *testing.T) {
+	cmd, err := debugCommand("gdb", 7)
+	if err != nil || strings.Join(cmd, " ") != "gdbserver --attach - 7" {
+		t.Errorf("unexpected gdb command %v %v", cmd, err)
+	}
+
+	// Delve listens on a unix socket instead of a port of the target's network.
+	cmd, err = debugCommand("dlv", 7)
+	if err != nil || len(cmd) != 3 || !strings.Contains(cmd[2], `dlv attach 7 --headless --api-version=2 --listen="unix:$d/dlv.sock"`) ||
+		!strings.Contains(cmd[2], `nc -U "$d/dlv.sock"`) || strings.Contains(cmd[2], "127.0.0.1") {
+		t.Errorf("unexpected dlv command %v %v", cmd, err)
+	}
+
+	if _, err = debugCommand("lldb", 7); err == nil {
+		t.Errorf("expected error for unsupported debugger")
+	}
+}
+
+func TestBridge(t *testing.T) {
+	debugger, conn := net.Pipe()
+	session := newEchoSession()
+	done := make(chan struct{})
+
+	go func() {
+		bridge(conn, session, io.Discard)
+		close(done)
+	}()
+
+	debugger.Write([]byte("qSupported"))
+
+	buf := make([]byte, 64)
+
+	n, err := debugger.Read(buf)
+	if err != nil || string(buf[:n]) != "QSUPPORTED" {
+		t.Fatalf("unexpected bridged output %q %v", buf[:n], err)
+	}
+
+	// The session is closed once the debugger disconnects.
+	debugger.Close()
+	<-done
+
+	if !session.closed {
+		t.Errorf("session is not closed")
+	}
+}
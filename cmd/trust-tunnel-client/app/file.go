@@ -0,0 +1,63 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package app
+
+import (
+	"trust-tunnel/pkg/trust-tunnel-client/protocol"
+
+	"github.com/spf13/cobra"
+	client "trust-tunnel/pkg/trust-tunnel-client"
+)
+
+// newFileCommands creates the commands reading a file in the target by the agent, without running any command.
+func newFileCommands() []*cobra.Command {
+	cat := newFileCommand(client.FileVerbCat, "Print a file of the target")
+	tail := newFileCommand(client.FileVerbTail, "Print the last lines of a file of the target")
+	stat := newFileCommand(client.FileVerbStat, "Print the metadata and the hash of a file of the target")
+
+	return []*cobra.Command{cat, tail, stat}
+}
+
+// newFileCommand creates the command of the file verb, taking the absolute path of the file.
+func newFileCommand(verb, short string) *cobra.Command {
+	options := &Option{File: &client.FileRequest{Verb: verb}}
+
+	cmd := &cobra.Command{
+		Use:   verb + " PATH",
+		Short: short,
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			options.File.Path = args[0]
+
+			// Large files are printed in the larger frames unless asked otherwise.
+			if verb == client.FileVerbCat && options.FrameProfile == "" && options.FrameSize <= 0 {
+				options.FrameProfile = protocol.FrameProfileBulk
+			}
+
+			runClientAndExit(options)
+		},
+	}
+
+	setupTargetFlags(cmd, options)
+
+	flags := cmd.Flags()
+	flags.StringVarP(&options.Type, "type", "", "phys", "Connection type: 'phys' for physical or 'container' for container")
+
+	if verb == client.FileVerbTail {
+		flags.IntVarP(&options.File.Lines, "lines", "n", 10, "Number of the last lines to show")
+	}
+
+	return cmd
+}
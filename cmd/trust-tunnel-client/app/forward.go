@@ -0,0 +1,199 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package app
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/cobra"
+	client "trust-tunnel/pkg/trust-tunnel-client"
+)
+
+// newPortForwardCommand creates the command forwarding a local port to a port of the target by the agent, like
+// kubectl port-forward.
+func newPortForwardCommand() *cobra.Command {
+	options := &Option{}
+
+	var reverse bool
+
+	cmd := &cobra.Command{
+		Use:   "port-forward [LOCAL_ADDR:]LOCAL_PORT:[REMOTE_HOST:]REMOTE_PORT | -R REMOTE_PORT:[LOCAL_HOST:]LOCAL_PORT",
+		Short: "Forward a local port to a port on the loopback of the target, or of a host reached from it",
+		Long: `Forward the connections to a local port to a port on the loopback of the target's network namespace by the
+agent, without running any command in the target. The local address defaults to 127.0.0.1, the local port 0 picks
+a free one, and a single port is used for both:
+  trust-tunnel-client port-forward -o 10.0.0.1 8080:80
+  trust-tunnel-client port-forward -o 10.0.0.1 --type container --cid 0123abcd 0.0.0.0:5005:5005
+
+With REMOTE_HOST, the connections are forwarded to the host reached from the target instead, whose name is resolved
+as the target does, e.g. with the cluster DNS. It requires the agent to allow the host:
+  trust-tunnel-client port-forward -o 10.0.0.1 --type container --cid 0123abcd 5432:db:5432
+
+With -R, the connections to REMOTE_PORT on the loopback of the target are forwarded to LOCAL_PORT of LOCAL_HOST,
+127.0.0.1 by default, like ssh -R, e.g. for a process in the target to reach a local debugger. The spec is
+REMOTE_PORT:[LOCAL_HOST:]LOCAL_PORT then, and it requires the agent to allow the reverse forwards:
+  trust-tunnel-client port-forward -o 10.0.0.1 --type container --cid 0123abcd -R 5005:5005`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			run := runPortForward
+			if reverse {
+				run = runReverseForward
+			}
+
+			if err := run(options, args[0]); err != nil {
+				fmt.Fprintf(os.Stderr, "%v\n", err)
+				os.Exit(-1)
+			}
+		},
+	}
+
+	setupTargetFlags(cmd, options)
+
+	flags := cmd.Flags()
+	flags.StringVarP(&options.Type, "type", "", "phys", "Connection type: 'phys' for physical or 'container' for container")
+	flags.BoolVarP(&reverse, "reverse", "R", false, "Forward the connections to a port on the loopback of the target to a local port instead")
+
+	return cmd
+}
+
+// parsePortForwardSpec returns the local address to listen on, the remote host and the remote port of the spec.
+// The part before the remote port is the remote host unless it's a port, and the IPv6 hosts are bracketed.
+func parsePortForwardSpec(spec string) (string, string, int, error) {
+	local, remote := spec, spec
+	if i := strings.LastIndex(spec, ":"); i >= 0 {
+		local, remote = spec[:i], spec[i+1:]
+	}
+
+	port, err := strconv.Atoi(remote)
+	if err != nil || port < 1 || port > 65535 {
+		return "", "", 0, fmt.Errorf("invalid remote port %q", remote)
+	}
+
+	var remoteHost string
+
+	if strings.HasSuffix(local, "]") {
+		if i := strings.LastIndex(local, "["); i > 0 && local[i-1] == ':' {
+			local, remoteHost = local[:i-1], local[i+1:len(local)-1]
+			if net.ParseIP(remoteHost) == nil {
+				return "", "", 0, fmt.Errorf("invalid remote host %q", remoteHost)
+			}
+		}
+	} else if i := strings.LastIndex(local, ":"); i >= 0 {
+		if _, err := strconv.Atoi(local[i+1:]); err != nil {
+			local, remoteHost = local[:i], local[i+1:]
+			if remoteHost == "" {
+				return "", "", 0, fmt.Errorf("invalid remote host %q", remoteHost)
+			}
+		}
+	}
+
+	host, localPort := "127.0.0.1", local
+	if strings.Contains(local, ":") {
+		if host, localPort, err = net.SplitHostPort(local); err != nil {
+			return "", "", 0, fmt.Errorf("invalid local address %q: %v", local, err)
+		}
+	}
+
+	if p, err := strconv.Atoi(localPort); err != nil || p < 0 || p > 65535 {
+		return "", "", 0, fmt.Errorf("invalid local port %q", localPort)
+	}
+
+	return net.JoinHostPort(host, localPort), remoteHost, port, nil
+}
+
+// runPortForward forwards the local port of the spec to the remote port until the agent ends the session.
+func runPortForward(opt *Option, spec string) error {
+	addr, remoteHost, port, err := parsePortForwardSpec(spec)
+	if err != nil {
+		return err
+	}
+
+	cli, err := createClient(opt)
+	if err != nil {
+		return err
+	}
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+
+	if remoteHost != "" {
+		fmt.Fprintf(os.Stderr, "Forwarding from %s -> %s\n", listener.Addr(), net.JoinHostPort(remoteHost, strconv.Itoa(port)))
+	} else {
+		fmt.Fprintf(os.Stderr, "Forwarding from %s -> %d\n", listener.Addr(), port)
+	}
+
+	return cli.Forward(nil, &client.ForwardRequest{Host: remoteHost, Port: port}, listener, func(err error) {
+		fmt.Fprintf(os.Stderr, "connection refused by the agent: %v\n", err)
+	})
+}
+
+// parseReverseForwardSpec returns the remote port to listen on and the local address to dial of the spec of a
+// reverse forward.
+func parseReverseForwardSpec(spec string) (int, string, error) {
+	remote, local := spec, spec
+	if i := strings.Index(spec, ":"); i >= 0 {
+		remote, local = spec[:i], spec[i+1:]
+	}
+
+	port, err := strconv.Atoi(remote)
+	if err != nil || port < 1 || port > 65535 {
+		return 0, "", fmt.Errorf("invalid remote port %q", remote)
+	}
+
+	host, localPort := "127.0.0.1", local
+	if strings.Contains(local, ":") {
+		if host, localPort, err = net.SplitHostPort(local); err != nil || host == "" {
+			return 0, "", fmt.Errorf("invalid local address %q", local)
+		}
+	}
+
+	if p, err := strconv.Atoi(localPort); err != nil || p < 1 || p > 65535 {
+		return 0, "", fmt.Errorf("invalid local port %q", localPort)
+	}
+
+	return port, net.JoinHostPort(host, localPort), nil
+}
+
+// runReverseForward forwards the remote port of the spec to the local address until the agent ends the session.
+func runReverseForward(opt *Option, spec string) error {
+	port, addr, err := parseReverseForwardSpec(spec)
+	if err != nil {
+		return err
+	}
+
+	cli, err := createClient(opt)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "Forwarding from port %d of the target -> %s\n", port, addr)
+
+	dial := func() (net.Conn, error) {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "connection refused locally: %v\n", err)
+		}
+
+		return conn, err
+	}
+
+	return cli.ReverseForward(nil, &client.ForwardRequest{Port: port}, dial, nil)
+}
@@ -0,0 +1,67 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package app
+
+import "testing"
+
+func TestParsePortForwardSpec(t *testing.T) {
+	for spec, want := range map[string]struct {
+		addr string
+		host string
+		port int
+	}{
+		"80":                       {"127.0.0.1:80", "", 80},
+		"8080:80":                  {"127.0.0.1:8080", "", 80},
+		"0:80":                     {"127.0.0.1:0", "", 80},
+		"0.0.0.0:5005:5005":        {"0.0.0.0:5005", "", 5005},
+		"[::1]:8080:80":            {"[::1]:8080", "", 80},
+		"5432:db:5432":             {"127.0.0.1:5432", "db", 5432},
+		"0.0.0.0:5432:10.0.0.5:80": {"0.0.0.0:5432", "10.0.0.5", 80},
+		"8080:[fd00::5]:80":        {"127.0.0.1:8080", "fd00::5", 80},
+	} {
+		addr, host, port, err := parsePortForwardSpec(spec)
+		if err != nil || addr != want.addr || host != want.host || port != want.port {
+			t.Errorf("got %s, %s, %d, %v of %s", addr, host, port, err, spec)
+		}
+	}
+
+	for _, spec := range []string{"", "8080:0", "8080:65536", "x:80", "::1:8080:80", "70000:80", "8080::80", "db:80", "8080:[db]:80"} {
+		if _, _, _, err := parsePortForwardSpec(spec); err == nil {
+			t.Errorf("%q should be refused", spec)
+		}
+	}
+}
+
+func TestParseReverseForwardSpec(t *testing.T) {
+	for spec, want := range map[string]struct {
+		port int
+		addr string
+	}{
+		"5005":                 {5005, "127.0.0.1:5005"},
+		"5005:15005":           {5005, "127.0.0.1:15005"},
+		"8080:devbox.local:80": {8080, "devbox.local:80"},
+		"8080:[::1]:80":        {8080, "[::1]:80"},
+	} {
+		port, addr, err := parseReverseForwardSpec(spec)
+		if err != nil || port != want.port || addr != want.addr {
+			t.Errorf("got %d, %s, %v of %s", port, addr, err, spec)
+		}
+	}
+
+	for _, spec := range []string{"", "0:80", "5005:0", "x:80", "80:x", "80::80", "80:::1:80"} {
+		if _, _, err := parseReverseForwardSpec(spec); err == nil {
+			t.Errorf("%q should be refused", spec)
+		}
+	}
+}
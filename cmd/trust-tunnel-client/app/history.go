@@ -0,0 +1,272 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package app
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"unicode/utf8"
+)
+
+const (
+	keyCtrlC     = 0x03
+	keyBackspace = 0x08
+	keyCtrlU     = 0x15
+	keyCtrlW     = 0x17
+	keyEscape    = 0x1b
+	keyDelete    = 0x7f
+	keyBell      = 0x07
+)
+
+// unsafeFileNameChars matches the characters not allowed in history file names.
+var unsafeFileNameChars = regexp.MustCompile(`[^A-Za-z0-9._-]`)
+
+// historyRecorder reconstructs the command lines from the keystrokes of an interactive TTY session,
+// and appends them to a history file. It's a best-effort record like the shell history: line editing keys
+// are applied, while the results of completions and history recalls made by the remote shell are unknown.
+//
+// The lines typed while the remote terminal doesn't echo, e.g. at password prompts, are skipped. The terminal
+// mode isn't visible to the client, so a line is regarded as echoed if any visible character is output
+// after its first keystroke, up to the line end following its Enter key.
+type historyRecorder struct {
+	lock sync.Mutex
+	file *os.File
+	line []byte
+	// escape is the state of parsing escape sequences, e.g. arrow keys, which are skipped.
+	escape escapeState
+	// echoed indicates whether the current line is echoed.
+	echoed bool
+	// unconfirmed are the lines entered before they're echoed, e.g. pasted ones, which are written once a visible
+	// character is output before the next line end, or skipped otherwise.
+	unconfirmed []historyLine
+	// outputEscape is the state of parsing escape sequences in the output, which aren't visible.
+	outputEscape escapeState
+}
+
+// historyLine is a line entered before it's confirmed as echoed.
+type historyLine struct {
+	text   []byte
+	echoed bool
+}
+
+type escapeState int
+
+const (
+	escapeNone escapeState = iota
+	escapeStart
+	escapeSequence
+	// escapeString is an operating system command in the output, e.g. setting the window title,
+	// which ends with BEL or ST.
+	escapeString
+	escapeStringEnd
+)
+
+// defaultHistoryDir returns the default directory of history files, "~/.trust-tunnel/history".
+func defaultHistoryDir() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+
+	return filepath.Join(home, ".trust-tunnel", "history")
+}
+
+// historyFile returns the path of the history file of the target.
+func historyFile(dir string, opt *Option) string {
+	name := unsafeFileNameChars.ReplaceAllString(opt.Type+"_"+targetName(opt), "_")
+
+	return filepath.Join(dir, name)
+}
+
+// openHistoryRecorder opens the history file of the target for appending.
+func openHistoryRecorder(dir string, opt *Option) (*historyRecorder, error) {
+	if dir == "" {
+		return nil, fmt.Errorf("history directory is unknown")
+	}
+
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(historyFile(dir, opt), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, err
+	}
+
+	return &historyRecorder{file: file}, nil
+}
+
+// Write consumes the keystrokes, it never fails so that the session isn't interrupted by the recording.
+func (r *historyRecorder) Write(p []byte) (int, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for _, b := range p {
+		r.consume(b)
+	}
+
+	return len(p), nil
+}
+
+// consume applies a keystroke to the current line.
+func (r *historyRecorder) consume(b byte) {
+	switch r.escape {
+	case escapeStart:
+		r.escape = escapeNone
+		if b == '[' || b == 'O' {
+			r.escape = escapeSequence
+		}
+
+		return
+	case escapeSequence:
+		// The final byte of a control sequence is in the range 0x40-0x7e.
+		if b >= 0x40 && b <= 0x7e {
+			r.escape = escapeNone
+		}
+
+		return
+	case escapeNone:
+	}
+
+	switch {
+	case b == '\r' || b == '\n':
+		r.flush()
+	case b == keyBackspace || b == keyDelete:
+		if _, size := utf8.DecodeLastRune(r.line); size > 0 {
+			r.line = r.line[:len(r.line)-size]
+		}
+	case b == keyCtrlC || b == keyCtrlU:
+		r.line = r.line[:0]
+	case b == keyCtrlW:
+		line := bytes.TrimRight(r.line, " ")
+		r.line = line[:bytes.LastIndexByte(line, ' ')+1]
+	case b == keyEscape:
+		r.escape = escapeStart
+	case b >= 0x20:
+		r.line = append(r.line, b)
+	}
+}
+
+// flush appends the current line to the history file if it's not blank and it's echoed,
+// otherwise the line waits for its echo.
+func (r *historyRecorder) flush() {
+	line := bytes.TrimSpace(r.line)
+	r.line = r.line[:0]
+
+	echoed := r.echoed
+	r.echoed = false
+
+	if len(line) == 0 {
+		return
+	}
+
+	// The lines are written in order, so the echoed ones wait for the unconfirmed ones before them.
+	if !echoed || len(r.unconfirmed) > 0 {
+		r.unconfirmed = append(r.unconfirmed, historyLine{text: bytes.Clone(line), echoed: echoed})
+
+		return
+	}
+
+	r.file.Write(append(line, '\n'))
+}
+
+// Output returns the writer observing the output of the session, which tells the echoed lines.
+func (r *historyRecorder) Output() io.Writer {
+	return historyOutput{r: r}
+}
+
+// historyOutput observes the output of the session for the recorder.
+type historyOutput struct {
+	r *historyRecorder
+}
+
+func (o historyOutput) Write(p []byte) (int, error) {
+	o.r.lock.Lock()
+	defer o.r.lock.Unlock()
+
+	for _, b := range p {
+		o.r.observe(b)
+	}
+
+	return len(p), nil
+}
+
+// observe applies an output byte to the echo state of the lines.
+func (r *historyRecorder) observe(b byte) {
+	switch r.outputEscape {
+	case escapeStart:
+		switch b {
+		case '[':
+			r.outputEscape = escapeSequence
+		case ']':
+			r.outputEscape = escapeString
+		default:
+			r.outputEscape = escapeNone
+		}
+
+		return
+	case escapeSequence:
+		if b >= 0x40 && b <= 0x7e {
+			r.outputEscape = escapeNone
+		}
+
+		return
+	case escapeString:
+		switch b {
+		case keyBell:
+			r.outputEscape = escapeNone
+		case keyEscape:
+			r.outputEscape = escapeStringEnd
+		}
+
+		return
+	case escapeStringEnd:
+		r.outputEscape = escapeNone
+
+		return
+	case escapeNone:
+	}
+
+	switch {
+	case b == keyEscape:
+		r.outputEscape = escapeStart
+	case b == '\n' && len(r.unconfirmed) > 0:
+		// The line end after the Enter key of the first unconfirmed line.
+		if first := r.unconfirmed[0]; first.echoed {
+			r.file.Write(append(first.text, '\n'))
+		}
+
+		r.unconfirmed = r.unconfirmed[1:]
+	case b > ' ' && b != keyDelete:
+		if len(r.unconfirmed) > 0 {
+			r.unconfirmed[0].echoed = true
+		} else if len(r.line) > 0 {
+			r.echoed = true
+		}
+	}
+}
+
+// Close closes the history file, the lines never confirmed as echoed are skipped.
+func (r *historyRecorder) Close() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return r.file.Close()
+}
@@ -0,0 +1,94 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package app
+
+import (
+	"os"
+	"testing"
+)
+
+func TestHistoryRecorder(t *testing.T) {
+	dir := t.TempDir()
+	opt := &Option{Type: "container", Pod: "web/pod-1"}
+
+	r, err := openHistoryRecorder(dir, opt)
+	if err != nil {
+		t.Fatalf("open history recorder error: %v", err)
+	}
+
+	keystrokes := []string{
+		"ls -l\r",
+		"\r",
+		"echo helo\x7flo\r",
+		"rm -rf /\x03",
+		"cat foo bar\x17baz\r",
+		"\x1b[Avim\x1bOB\r",
+		"pwd",
+	}
+
+	// The remote terminal echoes the keystrokes.
+	for _, k := range keystrokes {
+		r.Write([]byte(k))
+		r.Output().Write([]byte(k + "\n"))
+	}
+
+	r.Close()
+
+	content, err := os.ReadFile(historyFile(dir, opt))
+	if err != nil {
+		t.Fatalf("read history file error: %v", err)
+	}
+
+	want := "ls -l\necho hello\ncat foo baz\nvim\n"
+	if string(content) != want {
+		t.Errorf("got history %q, want %q", content, want)
+	}
+}
+
+func TestHistoryRecorderNoEcho(t *testing.T) {
+	dir := t.TempDir()
+	opt := &Option{Type: "physical", Host: "10.0.0.1"}
+
+	r, err := openHistoryRecorder(dir, opt)
+	if err != nil {
+		t.Fatalf("open history recorder error: %v", err)
+	}
+
+	output := r.Output()
+
+	// The line typed at a password prompt isn't echoed, only the line end is output after it.
+	r.Write([]byte("sudo -i\r"))
+	output.Write([]byte("sudo -i\r\n\x1b]0;title\x07[sudo] password for alice: "))
+	r.Write([]byte("s3cret\r"))
+	output.Write([]byte("\r\n"))
+
+	// The pasted lines are echoed after they're entered.
+	r.Write([]byte("id\rwhoami\r"))
+	output.Write([]byte("\x1b[?2004lid\r\nuid=0(root)\r\nwhoami\r\nroot\r\n"))
+
+	// The line whose line end is never output is skipped.
+	r.Write([]byte("s3cret\r"))
+	r.Close()
+
+	content, err := os.ReadFile(historyFile(dir, opt))
+	if err != nil {
+		t.Fatalf("read history file error: %v", err)
+	}
+
+	want := "sudo -i\nid\nwhoami\n"
+	if string(content) != want {
+		t.Errorf("got history %q, want %q", content, want)
+	}
+}
@@ -0,0 +1,58 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package app
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/spf13/cobra"
+	client "trust-tunnel/pkg/trust-tunnel-client"
+)
+
+// newLogsCommand creates the command streaming the output of the main process of a container, like docker logs.
+func newLogsCommand() *cobra.Command {
+	options := &Option{Type: "container", Logs: &client.LogsOptions{}}
+
+	cmd := &cobra.Command{
+		Use:   "logs",
+		Short: "Stream the output of the main process of a remote container",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			runClientAndExit(options)
+		},
+	}
+
+	setupTargetFlags(cmd, options)
+
+	flags := cmd.Flags()
+	flags.BoolVarP(&options.Logs.Follow, "follow", "f", false, "Follow the output until interrupted or the container exits")
+	flags.IntVarP(&options.Logs.Tail, "tail", "", -1, "Number of the last lines to show, all lines if negative")
+
+	return cmd
+}
+
+// closeOnInterrupt closes the session once the client is interrupted, so that the agent stops following
+// the logs at once rather than keeping the session for reattachment.
+func closeOnInterrupt(session client.Session) {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		<-sigCh
+		session.CloseSession()
+	}()
+}
@@ -0,0 +1,64 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package app
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/term"
+	client "trust-tunnel/pkg/trust-tunnel-client"
+)
+
+// mfaTypeWebAuthn is the MFA type requiring a security key, which the CLI can't talk to.
+const mfaTypeWebAuthn = "webauthn"
+
+// mfaPrompt returns the function answering the MFA challenges of the agents with the code given by --mfa-code,
+// or the one typed on the terminal, e.g. a TOTP code.
+func mfaPrompt(opt *Option) func(*client.MFAChallenge) (string, error) {
+	return func(challenge *client.MFAChallenge) (string, error) {
+		if opt.MFACode != "" {
+			return opt.MFACode, nil
+		}
+
+		if challenge.Type == mfaTypeWebAuthn {
+			return "", fmt.Errorf("MFA type %s isn't supported by the CLI, use --mfa-code with an assertion", challenge.Type)
+		}
+
+		// The stdin may be the input of the command, so the code is read from the terminal.
+		tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+		if err != nil {
+			return "", fmt.Errorf("MFA code is required, but there is no terminal to prompt for it, use --mfa-code")
+		}
+		defer tty.Close()
+
+		prompt := challenge.Prompt
+		if prompt == "" {
+			prompt = fmt.Sprintf("%s code: ", strings.ToUpper(challenge.Type))
+		}
+
+		fmt.Fprint(tty, prompt)
+
+		code, err := term.ReadPassword(int(tty.Fd()))
+		fmt.Fprintln(tty)
+
+		if err != nil {
+			return "", err
+		}
+
+		return strings.TrimSpace(string(code)), nil
+	}
+}
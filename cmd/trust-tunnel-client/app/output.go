@@ -0,0 +1,151 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package app
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"time"
+)
+
+const timestampFormat = "2006-01-02T15:04:05.000Z07:00"
+
+// outputWriter decorates the remote output before writing it to the local stream.
+// Each line is prefixed with a timestamp and/or the target if enabled, and complete lines
+// are written at once if line buffering is enabled, so that log collectors never see partial lines.
+type outputWriter struct {
+	w            io.Writer
+	timestamps   bool
+	prefix       string
+	lineBuffered bool
+
+	lock sync.Mutex
+	// pending is the incomplete line held back in line buffered mode.
+	pending []byte
+	// midLine indicates whether the last written byte isn't a line end, so the next write needn't decorating.
+	midLine bool
+	// now returns the current time, it's replaceable in tests.
+	now func() time.Time
+}
+
+// newOutputWriter creates an outputWriter, w is returned as is if no decoration is needed.
+func newOutputWriter(w io.Writer, timestamps bool, prefix string, lineBuffered bool) io.Writer {
+	if !timestamps && prefix == "" && !lineBuffered {
+		return w
+	}
+
+	return &outputWriter{
+		w:            w,
+		timestamps:   timestamps,
+		prefix:       prefix,
+		lineBuffered: lineBuffered,
+		now:          time.Now,
+	}
+}
+
+// Write decorates the lines in p and writes them.
+func (o *outputWriter) Write(p []byte) (int, error) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	data := p
+	if o.lineBuffered {
+		o.pending = append(o.pending, p...)
+
+		i := bytes.LastIndexByte(o.pending, '\n')
+		if i < 0 {
+			return len(p), nil
+		}
+
+		data = o.pending[:i+1]
+		defer func() {
+			o.pending = append(o.pending[:0], o.pending[i+1:]...)
+		}()
+	}
+
+	if _, err := o.w.Write(o.decorate(data)); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+// Flush writes the incomplete line held back in line buffered mode.
+func (o *outputWriter) Flush() error {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	if len(o.pending) == 0 {
+		return nil
+	}
+
+	_, err := o.w.Write(o.decorate(o.pending))
+	o.pending = o.pending[:0]
+
+	return err
+}
+
+// decorate inserts the line header at the start of every line in data.
+func (o *outputWriter) decorate(data []byte) []byte {
+	header := o.header()
+	if header == "" {
+		return data
+	}
+
+	var buf bytes.Buffer
+
+	for len(data) > 0 {
+		if !o.midLine {
+			buf.WriteString(header)
+		}
+
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			buf.Write(data)
+			o.midLine = true
+
+			break
+		}
+
+		buf.Write(data[:i+1])
+		data = data[i+1:]
+		o.midLine = false
+	}
+
+	return buf.Bytes()
+}
+
+// header returns the decoration of a line.
+func (o *outputWriter) header() string {
+	var header string
+
+	if o.timestamps {
+		header = o.now().Format(timestampFormat) + " "
+	}
+
+	if o.prefix != "" {
+		header += "[" + o.prefix + "] "
+	}
+
+	return header
+}
+
+// flushOutput flushes w if it's an outputWriter.
+func flushOutput(w io.Writer) {
+	if o, ok := w.(*outputWriter); ok {
+		o.Flush()
+	}
+}
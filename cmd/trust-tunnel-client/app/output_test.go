@@ -0,0 +1,122 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package app
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestOutputWriter(t *testing.T) {
+	now := time.Date(2024, 1, 2, 3, 4, 5, 6000000, time.UTC)
+
+	tests := []struct {
+		name         string
+		timestamps   bool
+		prefix       string
+		lineBuffered bool
+		writes       []string
+		want         string
+		wantFlushed  string
+	}{
+		{
+			name:   "prefix split lines",
+			prefix: "host1",
+			writes: []string{"hel", "lo\nwor", "ld\n"},
+			want:   "[host1] hello\n[host1] world\n",
+		},
+		{
+			name:       "timestamps",
+			timestamps: true,
+			prefix:     "pod",
+			writes:     []string{"a\nb\n"},
+			want:       "2024-01-02T03:04:05.006Z [pod] a\n2024-01-02T03:04:05.006Z [pod] b\n",
+		},
+		{
+			name:         "line buffered",
+			lineBuffered: true,
+			writes:       []string{"par", "tial\nre", "st"},
+			want:         "partial\n",
+			wantFlushed:  "partial\nrest",
+		},
+		{
+			name:         "line buffered with prefix",
+			prefix:       "h",
+			lineBuffered: true,
+			writes:       []string{"a", "b\nc"},
+			want:         "[h] ab\n",
+			wantFlushed:  "[h] ab\n[h] c",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+
+			w := newOutputWriter(&buf, tt.timestamps, tt.prefix, tt.lineBuffered).(*outputWriter)
+			w.now = func() time.Time { return now }
+
+			for _, s := range tt.writes {
+				if n, err := w.Write([]byte(s)); err != nil || n != len(s) {
+					t.Fatalf("write %q returns %d, %v", s, n, err)
+				}
+			}
+
+			if buf.String() != tt.want {
+				t.Errorf("got %q, want %q", buf.String(), tt.want)
+			}
+
+			if tt.wantFlushed != "" {
+				w.Flush()
+
+				if buf.String() != tt.wantFlushed {
+					t.Errorf("got %q after flush, want %q", buf.String(), tt.wantFlushed)
+				}
+			}
+		})
+	}
+}
+
+// TestOutputWriterConcurrentFlush flushes the output while it's written, e.g. when the session ends, run it with -race.
+func TestOutputWriterConcurrentFlush(t *testing.T) {
+	var buf bytes.Buffer
+
+	w := newOutputWriter(&buf, false, "host1", true)
+
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+
+	go func() {
+		defer wg.Done()
+
+		for i := 0; i < 100; i++ {
+			w.Write([]byte("line\n"))
+		}
+	}()
+
+	for i := 0; i < 100; i++ {
+		flushOutput(w)
+	}
+
+	wg.Wait()
+
+	if got := strings.Count(buf.String(), "[host1] line\n"); got != 100 {
+		t.Errorf("got %d lines, want 100", got)
+	}
+}
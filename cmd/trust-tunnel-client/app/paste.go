@@ -0,0 +1,129 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package app
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"time"
+)
+
+var (
+	// pasteStart and pasteEnd are the markers of bracketed paste, they wrap the pasted text
+	// if the remote shell enables bracketed paste mode of the local terminal.
+	pasteStart = []byte("\x1b[200~")
+	pasteEnd   = []byte("\x1b[201~")
+)
+
+// pasteWriter writes pasted text to the session in small chunks at a limited rate,
+// so that large pastes don't overflow the input buffer of the remote terminal.
+// A paste is detected by the bracketed paste markers, or by reads filling the whole buffer
+// for terminals without bracketed paste.
+type pasteWriter struct {
+	w         io.Writer
+	chunkSize int
+	delay     time.Duration
+	// progress is where the paste progress is reported, nil to disable reporting.
+	progress io.Writer
+
+	inPaste bool
+	// tail is the end of the last write, kept to detect markers split across writes.
+	tail   []byte
+	pasted int
+}
+
+// newPasteWriter creates a pasteWriter, w is returned as is if chunking is disabled.
+func newPasteWriter(w io.Writer, chunkSize int, delay time.Duration, progress io.Writer) io.Writer {
+	if chunkSize <= 0 {
+		return w
+	}
+
+	return &pasteWriter{
+		w:         w,
+		chunkSize: chunkSize,
+		delay:     delay,
+		progress:  progress,
+	}
+}
+
+// Write writes p to the session, in paced chunks if p is a part of a paste.
+func (pw *pasteWriter) Write(p []byte) (int, error) {
+	window := append(pw.tail, p...)
+	start, end := bytes.LastIndex(window, pasteStart), bytes.LastIndex(window, pasteEnd)
+	paced := pw.inPaste || start >= 0 || len(p) >= bufferSize
+
+	if start > end {
+		pw.inPaste = true
+	} else if end > start {
+		pw.inPaste = false
+	}
+
+	if keep := len(pasteStart) - 1; len(window) > keep {
+		window = window[len(window)-keep:]
+	}
+
+	pw.tail = append(pw.tail[:0], window...)
+
+	if !paced {
+		return writeAll(pw.w, p)
+	}
+
+	for written := 0; written < len(p); {
+		chunk := p[written:]
+		if len(chunk) > pw.chunkSize {
+			chunk = chunk[:pw.chunkSize]
+		}
+
+		if _, err := writeAll(pw.w, chunk); err != nil {
+			return written, err
+		}
+
+		written += len(chunk)
+		pw.pasted += len(chunk)
+
+		if pw.progress != nil {
+			fmt.Fprintf(pw.progress, "\r\x1b[Kpasting: %d bytes sent", pw.pasted)
+		}
+
+		time.Sleep(pw.delay)
+	}
+
+	if !pw.inPaste {
+		if pw.progress != nil {
+			fmt.Fprint(pw.progress, "\r\x1b[K")
+		}
+
+		pw.pasted = 0
+	}
+
+	return len(p), nil
+}
+
+// writeAll writes all of p to w.
+func writeAll(w io.Writer, p []byte) (int, error) {
+	written := 0
+
+	for written < len(p) {
+		m, err := w.Write(p[written:])
+		if err != nil {
+			return written, err
+		}
+
+		written += m
+	}
+
+	return written, nil
+}
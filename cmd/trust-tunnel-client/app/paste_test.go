@@ -0,0 +1,89 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package app
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// recordWriter records the sizes of the writes.
+type recordWriter struct {
+	bytes.Buffer
+	sizes []int
+}
+
+func (w *recordWriter) Write(p []byte) (int, error) {
+	w.sizes = append(w.sizes, len(p))
+
+	return w.Buffer.Write(p)
+}
+
+func TestPasteWriter(t *testing.T) {
+	tests := []struct {
+		name      string
+		writes    []string
+		wantSizes []int
+	}{
+		{
+			name:      "typing isn't chunked",
+			writes:    []string{"ls -l\r", "exit\r"},
+			wantSizes: []int{6, 5},
+		},
+		{
+			name:      "bracketed paste",
+			writes:    []string{"\x1b[200~" + strings.Repeat("a", 10), strings.Repeat("b", 6) + "\x1b[201~", "x"},
+			wantSizes: []int{8, 8, 8, 4, 1},
+		},
+		{
+			name:      "paste end marker split across writes",
+			writes:    []string{"\x1b[200~abcd\x1b[2", "01~", "xy"},
+			wantSizes: []int{8, 5, 3, 2},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var w recordWriter
+
+			pw := newPasteWriter(&w, 8, 0, nil)
+
+			var want string
+
+			for _, s := range tt.writes {
+				if n, err := pw.Write([]byte(s)); err != nil || n != len(s) {
+					t.Fatalf("write %q returns %d, %v", s, n, err)
+				}
+
+				want += s
+			}
+
+			if w.String() != want {
+				t.Errorf("got %q, want %q", w.String(), want)
+			}
+
+			if len(w.sizes) != len(tt.wantSizes) {
+				t.Fatalf("got write sizes %v, want %v", w.sizes, tt.wantSizes)
+			}
+
+			for i := range w.sizes {
+				if w.sizes[i] != tt.wantSizes[i] {
+					t.Fatalf("got write sizes %v, want %v", w.sizes, tt.wantSizes)
+				}
+			}
+		})
+	}
+}
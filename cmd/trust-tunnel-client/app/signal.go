@@ -12,7 +12,7 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-//go:build linux || darwin
+//go:build unix
 
 package app
 
@@ -22,14 +22,16 @@ import (
 	"syscall"
 
 	"github.com/sirupsen/logrus"
-	"golang.org/x/term"
 	client "trust-tunnel/pkg/trust-tunnel-client"
 )
 
 const channelSize = 10
 
+// resizeTracking is how the size changes of the local terminal are tracked.
+const resizeTracking = "SIGWINCH"
+
 // setupSignal listens for window size change signals and adjusts the client session size accordingly.
-func setupSignal(session client.Session) {
+func setupSignal(session client.Session, opt *Option) {
 	sigCh := make(chan os.Signal, channelSize)
 	signal.Notify(sigCh, syscall.SIGWINCH)
 
@@ -38,7 +40,7 @@ func setupSignal(session client.Session) {
 			sig := <-sigCh
 
 			if sig == syscall.SIGWINCH {
-				w, h, _ := term.GetSize(int(os.Stdin.Fd()))
+				w, h := terminalSize(opt)
 
 				err := session.Resize(h, w)
 				if err != nil {
@@ -0,0 +1,51 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !unix
+
+package app
+
+import (
+	"time"
+
+	"github.com/sirupsen/logrus"
+	client "trust-tunnel/pkg/trust-tunnel-client"
+)
+
+// resizePollPeriod is the period of polling the size of the local terminal, as there's no SIGWINCH.
+const resizePollPeriod = 250 * time.Millisecond
+
+// resizeTracking is how the size changes of the local terminal are tracked.
+const resizeTracking = "polling"
+
+// setupSignal polls the size of the local terminal and adjusts the client session size accordingly, the same as
+// on SIGWINCH on Unix.
+func setupSignal(session client.Session, opt *Option) {
+	go func() {
+		width, height := terminalSize(opt)
+
+		for range time.Tick(resizePollPeriod) {
+			w, h := terminalSize(opt)
+			if w == width && h == height {
+				continue
+			}
+
+			width, height = w, h
+
+			if err := session.Resize(h, w); err != nil {
+				logrus.Errorf("failed to resize window: %v", err)
+			}
+		}
+	}()
+}
@@ -0,0 +1,89 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package app
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	client "trust-tunnel/pkg/trust-tunnel-client"
+)
+
+// defaultTargetsFile returns the file of the targets bookmarked for the file resolver.
+func defaultTargetsFile() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+
+	return filepath.Join(home, ".trust-tunnel", "targets.json")
+}
+
+// resolveTarget sets the agent and the target of the option to the ones of the named target resolved by the
+// resolver of the option. The target can't be given along with the flags it resolves.
+func resolveTarget(opt *Option) error {
+	if opt.Target == "" {
+		return nil
+	}
+
+	if opt.Host != "" || opt.Pod != "" || opt.ContainerName != "" || opt.ContainerID != "" || opt.IP != "" {
+		return fmt.Errorf("--target can't be used with --host, --pod, --cname, --cid or --ip")
+	}
+
+	params := make(map[string]string, len(opt.ResolverParams)+1)
+	for k, v := range opt.ResolverParams {
+		params[k] = v
+	}
+
+	if opt.Resolver == "file" && params["path"] == "" {
+		params["path"] = defaultTargetsFile()
+	}
+
+	resolver, err := client.CreateResolver(opt.Resolver, params)
+	if err != nil {
+		return err
+	}
+
+	target, err := resolver.Resolve(opt.Target)
+	if err != nil {
+		return fmt.Errorf("resolve target error: %w", err)
+	}
+
+	targetType, err := target.TargetType()
+	if err != nil {
+		return err
+	}
+
+	opt.Host = target.AgentAddr
+	opt.Pod = target.PodName
+	opt.ContainerName = target.ContainerName
+	opt.ContainerID = target.ContainerID
+	opt.IP = target.IPAddress
+
+	opt.Type = "phys"
+	if targetType == client.TargetContainer {
+		opt.Type = "container"
+	}
+
+	if target.AgentPort > 0 {
+		opt.Port = target.AgentPort
+	}
+
+	if target.JumpAddr != "" {
+		opt.Jump = target.JumpAddr
+	}
+
+	return nil
+}
@@ -0,0 +1,45 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package app
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResolveTarget(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "targets.json")
+	os.WriteFile(path, []byte(`{"payments-prod-3": {"agent_addr": "10.0.0.3", "type": "container", "pod_name": "payments-3"}}`), 0o600)
+
+	opt := &Option{Target: "payments-prod-3", Resolver: "file", ResolverParams: map[string]string{"path": path},
+		Port: 5006, Type: "phys"}
+	if err := resolveTarget(opt); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if opt.Host != "10.0.0.3" || opt.Port != 5006 || opt.Type != "container" || opt.Pod != "payments-3" {
+		t.Errorf("unexpected option %+v", opt)
+	}
+
+	// The flags resolved by the target can't be given along with it.
+	if err := resolveTarget(opt); err == nil {
+		t.Errorf("target with --host should be refused")
+	}
+
+	opt = &Option{Target: "unknown", Resolver: "file", ResolverParams: map[string]string{"path": path}}
+	if err := resolveTarget(opt); err == nil {
+		t.Errorf("unknown target should be refused")
+	}
+}
@@ -0,0 +1,107 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package app
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/term"
+)
+
+const (
+	defaultTermWidth  = 80
+	defaultTermHeight = 24
+)
+
+// terminalSize returns the size of the remote terminal. The overrides in options take precedence,
+// then the size of the local terminal on Stdin or Stdout, and 80x24 if neither is a terminal.
+func terminalSize(opt *Option) (width, height int) {
+	width, height = defaultTermWidth, defaultTermHeight
+
+	for _, f := range []*os.File{os.Stdin, os.Stdout} {
+		fd := int(f.Fd())
+		if !term.IsTerminal(fd) {
+			continue
+		}
+
+		if w, h, err := term.GetSize(fd); err == nil && w > 0 && h > 0 {
+			width, height = w, h
+
+			break
+		}
+	}
+
+	if opt.Width > 0 {
+		width = opt.Width
+	}
+
+	if opt.Height > 0 {
+		height = opt.Height
+	}
+
+	return width, height
+}
+
+// forwardedEnv returns the terminal type and the locale in the environment to forward to the command. TERM is only
+// forwarded with a tty, as it describes the local terminal.
+func forwardedEnv(environ []string, tty bool) map[string]string {
+	env := make(map[string]string)
+
+	for _, kv := range environ {
+		name, value, ok := strings.Cut(kv, "=")
+		if !ok || value == "" {
+			continue
+		}
+
+		switch {
+		case name == "TERM", name == "COLORTERM":
+			if !tty {
+				continue
+			}
+		case name == "LANG", name == "LANGUAGE", strings.HasPrefix(name, "LC_"):
+		default:
+			continue
+		}
+
+		env[name] = value
+	}
+
+	return env
+}
+
+// parseEnv parses the environment variables given as "KEY=VAL", or "KEY" for the value of lookup, e.g. the local
+// environment, which is skipped if it isn't set.
+func parseEnv(values []string, lookup func(string) (string, bool)) (map[string]string, error) {
+	env := make(map[string]string, len(values))
+
+	for _, v := range values {
+		name, value, ok := strings.Cut(v, "=")
+		if name == "" {
+			return nil, fmt.Errorf("invalid environment variable %q, KEY=VAL or KEY expected", v)
+		}
+
+		if !ok {
+			if value, ok = lookup(name); !ok {
+				continue
+			}
+		}
+
+		env[name] = value
+	}
+
+	return env, nil
+}
@@ -0,0 +1,76 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package app
+
+import (
+	"os"
+	"reflect"
+	"testing"
+
+	"golang.org/x/term"
+)
+
+func TestTerminalSize(t *testing.T) {
+	if term.IsTerminal(int(os.Stdin.Fd())) || term.IsTerminal(int(os.Stdout.Fd())) {
+		t.Skip("the test must run without a terminal")
+	}
+
+	if w, h := terminalSize(&Option{}); w != defaultTermWidth || h != defaultTermHeight {
+		t.Errorf("got %dx%d, want the default size", w, h)
+	}
+
+	if w, h := terminalSize(&Option{Width: 120}); w != 120 || h != defaultTermHeight {
+		t.Errorf("got %dx%d, want 120x%d", w, h, defaultTermHeight)
+	}
+}
+
+func TestForwardedEnv(t *testing.T) {
+	environ := []string{"TERM=xterm-kitty", "LANG=en_US.UTF-8", "LC_CTYPE=C.UTF-8", "HOME=/home/me", "LC_ALL=", "PATH"}
+
+	want := map[string]string{"TERM": "xterm-kitty", "LANG": "en_US.UTF-8", "LC_CTYPE": "C.UTF-8"}
+	if got := forwardedEnv(environ, true); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	delete(want, "TERM")
+
+	if got := forwardedEnv(environ, false); !reflect.DeepEqual(got, want) {
+		t.Errorf("without tty got %v, want %v", got, want)
+	}
+}
+
+func TestParseEnv(t *testing.T) {
+	lookup := func(name string) (string, bool) {
+		if name == "LANG" {
+			return "C.UTF-8", true
+		}
+
+		return "", false
+	}
+
+	env, err := parseEnv([]string{"FOO=bar", "OPTS=a=b", "EMPTY=", "LANG", "UNSET"}, lookup)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{"FOO": "bar", "OPTS": "a=b", "EMPTY": "", "LANG": "C.UTF-8"}
+	if !reflect.DeepEqual(env, want) {
+		t.Errorf("got %v, want %v", env, want)
+	}
+
+	if _, err = parseEnv([]string{"=bar"}, lookup); err == nil {
+		t.Errorf("expected error of the empty name")
+	}
+}
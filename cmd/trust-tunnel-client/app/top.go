@@ -0,0 +1,39 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package app
+
+import "github.com/spf13/cobra"
+
+// newTopCommand creates the command printing the snapshot of the target for triage, gathered by the agent
+// without running any command.
+func newTopCommand() *cobra.Command {
+	options := &Option{Top: true}
+
+	cmd := &cobra.Command{
+		Use:   "top",
+		Short: "Print the uptime, load, memory, disks and top processes of the target as JSON",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			runClientAndExit(options)
+		},
+	}
+
+	setupTargetFlags(cmd, options)
+
+	flags := cmd.Flags()
+	flags.StringVarP(&options.Type, "type", "", "phys", "Connection type: 'phys' for physical or 'container' for container")
+
+	return cmd
+}
@@ -0,0 +1,42 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package app
+
+import (
+	"github.com/spf13/cobra"
+	client "trust-tunnel/pkg/trust-tunnel-client"
+)
+
+// newRunVerbCommand creates the command running a verb registered in the agent, e.g. ps or netdiag.
+func newRunVerbCommand() *cobra.Command {
+	options := &Option{}
+
+	cmd := &cobra.Command{
+		Use:   "run-verb NAME [ARGS...]",
+		Short: "Run an operation natively by the agent instead of a command, e.g. ps, netdiag or file-read",
+		Args:  cobra.MinimumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			options.Verb = &client.VerbRequest{Name: args[0], Args: args[1:]}
+			runClientAndExit(options)
+		},
+	}
+
+	setupTargetFlags(cmd, options)
+
+	flags := cmd.Flags()
+	flags.StringVarP(&options.Type, "type", "", "phys", "Connection type: 'phys' for physical or 'container' for container")
+
+	return cmd
+}
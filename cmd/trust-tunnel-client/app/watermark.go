@@ -0,0 +1,72 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"trust-tunnel/pkg/common/watermark"
+
+	"github.com/spf13/cobra"
+)
+
+// newDecodeWatermarkCommand creates the command decoding the watermarks of sessions in leaked output.
+func newDecodeWatermarkCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "decode-watermark [FILE]",
+		Short: "Decode the watermarks of sessions in the output pasted to the file or stdin",
+		Args:  cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			input := io.Reader(os.Stdin)
+
+			if len(args) > 0 && args[0] != "-" {
+				f, err := os.Open(args[0])
+				if err != nil {
+					return err
+				}
+				defer f.Close()
+
+				input = f
+			}
+
+			return decodeWatermarks(input, cmd.OutOrStdout())
+		},
+	}
+}
+
+// decodeWatermarks writes the marks found in the input as JSON lines.
+func decodeWatermarks(input io.Reader, output io.Writer) error {
+	text, err := io.ReadAll(input)
+	if err != nil {
+		return fmt.Errorf("read input error: %v", err)
+	}
+
+	marks := watermark.Decode(text)
+	if len(marks) == 0 {
+		return fmt.Errorf("no watermark found")
+	}
+
+	encoder := json.NewEncoder(output)
+
+	for _, m := range marks {
+		if err = encoder.Encode(m); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
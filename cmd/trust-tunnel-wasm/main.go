@@ -0,0 +1,296 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build js && wasm
+
+// Command trust-tunnel-wasm is the client compiled to WebAssembly for browser-based terminals, e.g. xterm.js.
+// It registers trustTunnel.start(options, handlers) in the global scope, see README.md for the API.
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"syscall/js"
+
+	client "trust-tunnel/pkg/trust-tunnel-client"
+)
+
+const (
+	defaultAgentPort = 5006
+	bufferSize       = 32 * 1024
+)
+
+func main() {
+	start := js.FuncOf(startSession)
+	js.Global().Set("trustTunnel", js.ValueOf(map[string]any{"start": start}))
+
+	// Keep the exported functions alive.
+	select {}
+}
+
+// startSession starts a session with the options, and returns a promise of the session object.
+// The output is passed to handlers.onStdout and handlers.onStderr as Uint8Array, and handlers.onExit is called
+// with {code, error, reason} once the session ends.
+func startSession(_ js.Value, args []js.Value) any {
+	if len(args) < 2 {
+		return rejected(errors.New("options and handlers are required"))
+	}
+
+	opts, handlers := args[0], args[1]
+
+	cli, err := newClient(opts)
+	if err != nil {
+		return rejected(err)
+	}
+
+	// Dialing waits for the events of the browser, so it mustn't block the event loop.
+	return promise(func() (js.Value, error) {
+		session, err := cli.Start(nil)
+		if err != nil {
+			return js.Undefined(), err
+		}
+
+		return newSession(session, handlers), nil
+	})
+}
+
+// newClient creates a client from the options given by JavaScript.
+func newClient(opts js.Value) (*client.Client, error) {
+	cli := &client.Client{
+		AgentAddr:        str(opts, "agentAddr"),
+		AgentPort:        defaultAgentPort,
+		JumpAddr:         str(opts, "jumpAddr"),
+		TLSVerify:        boolean(opts, "tls"),
+		UserName:         str(opts, "userName"),
+		LoginName:        str(opts, "loginName"),
+		LoginGroup:       str(opts, "loginGroup"),
+		PodName:          str(opts, "podName"),
+		ContainerName:    str(opts, "containerName"),
+		ContainerID:      str(opts, "containerId"),
+		IPAddress:        str(opts, "ipAddress"),
+		Interactive:      boolean(opts, "interactive"),
+		Tty:              boolean(opts, "tty"),
+		Shell:            str(opts, "shell"),
+		Tools:            boolean(opts, "tools"),
+		DisableCleanMode: boolean(opts, "disableCleanMode"),
+		DialTransport:    client.DialBrowserWebSocket,
+	}
+
+	// The terminal type of the terminal emulator, e.g. "xterm-256color" for xterm.js.
+	if term := str(opts, "term"); term != "" {
+		cli.Env = map[string]string{"TERM": term}
+	}
+
+	if port := opts.Get("agentPort"); port.Type() == js.TypeNumber {
+		cli.AgentPort = port.Int()
+	}
+
+	if cpus := opts.Get("cpus"); cpus.Type() == js.TypeNumber {
+		cli.Cpus = cpus.Float()
+	}
+
+	if memory := opts.Get("memoryMB"); memory.Type() == js.TypeNumber {
+		cli.MemoryMB = memory.Int()
+	}
+
+	switch targetType := str(opts, "targetType"); targetType {
+	case "", "phys":
+		cli.Type = client.TargetPhys
+	case "container":
+		cli.Type = client.TargetContainer
+	default:
+		return nil, fmt.Errorf("wrong target type %q", targetType)
+	}
+
+	command := opts.Get("command")
+	if command.Type() != js.TypeObject || command.Length() == 0 {
+		return nil, errors.New("no command")
+	}
+
+	for i := 0; i < command.Length(); i++ {
+		cli.Command = append(cli.Command, command.Index(i).String())
+	}
+
+	return cli, nil
+}
+
+// newSession returns the session object for JavaScript, and passes the output to the handlers.
+func newSession(session client.Session, handlers js.Value) js.Value {
+	var funcs []js.Func
+
+	method := func(f func(args []js.Value) error) js.Func {
+		fn := js.FuncOf(func(_ js.Value, args []js.Value) any {
+			if err := f(args); err != nil {
+				return js.Global().Get("Error").New(err.Error())
+			}
+
+			return nil
+		})
+		funcs = append(funcs, fn)
+
+		return fn
+	}
+
+	obj := js.ValueOf(map[string]any{
+		// write accepts a string or an Uint8Array.
+		"write": method(func(args []js.Value) error {
+			if len(args) == 0 {
+				return nil
+			}
+
+			_, err := session.Write(bytesOf(args[0]))
+
+			return err
+		}),
+		"resize": method(func(args []js.Value) error {
+			if len(args) < 2 {
+				return errors.New("rows and cols are required")
+			}
+
+			return session.Resize(args[0].Int(), args[1].Int())
+		}),
+		"closeStdin": method(func([]js.Value) error {
+			return client.CloseStdin(session)
+		}),
+		"close": method(func([]js.Value) error {
+			return session.CloseSession()
+		}),
+	})
+
+	var (
+		wg   sync.WaitGroup
+		lock sync.Mutex
+		// sessionErr is the first error other than io.EOF of the output.
+		sessionErr error
+	)
+
+	pump := func(read func([]byte) (int, error), handler string) {
+		defer wg.Done()
+
+		buf := make([]byte, bufferSize)
+
+		for {
+			n, err := read(buf)
+			if n > 0 {
+				array := js.Global().Get("Uint8Array").New(n)
+				js.CopyBytesToJS(array, buf[:n])
+				call(handlers, handler, array)
+			}
+
+			if err != nil {
+				if err != io.EOF {
+					lock.Lock()
+					if sessionErr == nil {
+						sessionErr = err
+					}
+					lock.Unlock()
+				}
+
+				return
+			}
+		}
+	}
+
+	wg.Add(2)
+
+	go pump(session.Read, "onStdout")
+	go pump(session.ReadStderr, "onStderr")
+
+	go func() {
+		wg.Wait()
+
+		result := map[string]any{
+			"code":   session.ExitCode(),
+			"error":  nil,
+			"reason": string(client.SessionTerminationReason(session)),
+		}
+		if sessionErr != nil {
+			result["error"] = sessionErr.Error()
+		}
+
+		call(handlers, "onExit", js.ValueOf(result))
+		session.Close()
+
+		for _, fn := range funcs {
+			fn.Release()
+		}
+	}()
+
+	return obj
+}
+
+// promise runs f in a goroutine, and returns a promise settled with its result.
+func promise(f func() (js.Value, error)) js.Value {
+	executor := js.FuncOf(func(_ js.Value, args []js.Value) any {
+		resolve, reject := args[0], args[1]
+
+		go func() {
+			v, err := f()
+			if err != nil {
+				reject.Invoke(js.Global().Get("Error").New(err.Error()))
+
+				return
+			}
+
+			resolve.Invoke(v)
+		}()
+
+		return nil
+	})
+	defer executor.Release()
+
+	return js.Global().Get("Promise").New(executor)
+}
+
+// rejected returns a promise rejected with err.
+func rejected(err error) js.Value {
+	return js.Global().Get("Promise").Call("reject", js.Global().Get("Error").New(err.Error()))
+}
+
+// call calls the handler of the name if it's given.
+func call(handlers js.Value, name string, args ...any) {
+	if handler := handlers.Get(name); handler.Type() == js.TypeFunction {
+		handler.Invoke(args...)
+	}
+}
+
+// bytesOf returns the bytes of a string or an Uint8Array.
+func bytesOf(v js.Value) []byte {
+	if v.Type() == js.TypeString {
+		return []byte(v.String())
+	}
+
+	b := make([]byte, v.Get("length").Int())
+	js.CopyBytesToGo(b, v)
+
+	return b
+}
+
+// str returns the string option of the name, or empty if it isn't given.
+func str(opts js.Value, name string) string {
+	if v := opts.Get(name); v.Type() == js.TypeString {
+		return v.String()
+	}
+
+	return ""
+}
+
+// boolean returns the boolean option of the name, or false if it isn't given.
+func boolean(opts js.Value, name string) bool {
+	v := opts.Get(name)
+
+	return v.Type() == js.TypeBoolean && v.Bool()
+}
@@ -18,199 +18,84 @@
 package e2e
 
 import (
-	"context"
-	"os/exec"
+	"fmt"
+	"os"
+	"strconv"
 	"testing"
 	"time"
-	"trust-tunnel/pkg/common/sessionutil"
-
-	"github.com/docker/docker/api/types/container"
 )
 
-const (
-	host             = "localhost"
-	port             = "5006"
-	dockerAPIVersion = "1.40"
-)
+// sh returns the command running the script with sh.
+func sh(script string) []string {
+	return []string{"sh", "-c", script}
+}
 
-type Config struct {
-	Host             string
-	Port             string
-	TargetType       string
-	ContainerID      string
-	LoginName        string
-	DisableCleanMode string
-	Cmd              string
+// commonScenarios returns the scenarios run against both physical hosts and containers.
+func commonScenarios(t *testing.T) []Scenario {
+	// The session must end once the script is exhausted, "cat" exits only if the stdin of the shell is closed.
+	script := "echo first\ncat\necho last\n"
+	isTty := sh("test -t 1 && echo is-tty || echo not-tty")
+
+	return []Scenario{
+		{Name: "clean mode", Run: Run{Cmd: sh("ls -l")}},
+		{Name: "disable clean mode", Run: Run{DisableCleanMode: true, Cmd: sh("ls -l")}},
+		{Name: "exit code", Run: Run{Cmd: sh("echo bye; exit 3")}, ExitCode: 3, Output: []string{"bye"}},
+		{Name: "non-tty", Run: Run{Cmd: isTty}, Output: []string{"not-tty"}},
+		{Name: "tty", Run: Run{Tty: true, Cmd: isTty}, Output: []string{"is-tty"}},
+		{Name: "resize", Run: Run{Tty: true, Width: 100, Height: 30, Cmd: sh("stty size")}, Output: []string{"30 100"}},
+		{Name: "stdin", Run: Run{Stdin: script, Cmd: []string{"sh"}}, Output: []string{"first", "last"}},
+		{Name: "stdin with disable clean mode", Run: Run{DisableCleanMode: true, Stdin: script, Cmd: []string{"sh"}}, Output: []string{"first", "last"}},
+		{Name: "input file", Run: Run{Args: []string{"--input", writeTempFile(t, script)}, Cmd: []string{"sh"}}, Output: []string{"first", "last"}},
+	}
 }
 
 func TestExecCmdInPhy(t *testing.T) {
-	cli, err := sessionutil.CreateDockerClient("unix:///var/run/docker.sock", dockerAPIVersion)
-	if err != nil {
-		t.Fatalf("Failed to create Docker client: %v", err)
-	}
-	cid, err := startTrustTunnelAgent(cli, "./config/config.toml")
-	if err != nil {
-		t.Fatalf("Failed to run trust-tunnel-agent: %v", err)
-	}
-	defer func() {
-		if err := cli.ContainerRemove(context.Background(), cid, container.RemoveOptions{Force: true}); err != nil {
-			t.Fatalf("Failed to remove container: %v", err)
-		}
-	}()
-	time.Sleep(10 * time.Second)
-
-	tests := []struct {
-		name             string
-		host             string
-		port             string
-		targetType       string
-		loginName        string
-		disableCleanMode string
-		cmd              string
-	}{
-		{
-			name:             "Test with clean mode",
-			host:             host,
-			port:             port,
-			targetType:       "phys",
-			loginName:        "root",
-			disableCleanMode: "false",
-			cmd:              "ls -l",
-		},
-		{
-			name:             "Test with disable clean mode",
-			host:             host,
-			port:             port,
-			targetType:       "phys",
-			loginName:        "root",
-			disableCleanMode: "true",
-			cmd:              "ls -l",
-		},
-	}
+	agent := StartAgent(t, Runtimes[0].ConfigFile)
 
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			c := Config{
-				Host:             tt.host,
-				Port:             tt.port,
-				TargetType:       tt.targetType,
-				LoginName:        tt.loginName,
-				DisableCleanMode: tt.disableCleanMode,
-				Cmd:              tt.cmd,
-			}
+	RunScenarios(t, agent, Run{TargetType: "phys"}, commonScenarios(t))
+}
 
-			output, err := execCmdWithClient(c)
-			if err != nil {
-				t.Fatalf("exec cmd in host error: %v", err)
-			}
-			if output == "" {
-				t.Fatalf("Failed to run trust-tunnel-client: %v", err)
-			}
+func TestExecCmdInContainer(t *testing.T) {
+	for _, runtime := range Runtimes {
+		t.Run(runtime.Name, func(t *testing.T) {
+			agent := StartAgent(t, runtime.ConfigFile)
+			cid := agent.StartTarget(t)
+
+			RunScenarios(t, agent, Run{TargetType: "container", ContainerID: cid}, commonScenarios(t))
 		})
 	}
 }
 
-func TestExecCmdInContainer(t *testing.T) {
-	cli, err := sessionutil.CreateDockerClient("unix:///var/run/docker.sock", "1.40")
-	if err != nil {
-		t.Fatalf("Failed to create Docker client: %v", err)
-	}
-	agentContainerCid, err := startTrustTunnelAgent(cli, "./config/config.toml")
-	if err != nil {
-		t.Fatalf("Failed to run trust-tunnel-agent: %v", err)
-	}
+// TestThroughput streams the output of dd over the tunnel and reports the throughput.
+// Set E2E_MIN_THROUGHPUT_MBPS to fail the test below the throughput.
+func TestThroughput(t *testing.T) {
+	const sizeMB = 64
 
-	targetContainerCid, err := startTargetContainer(cli)
-	if err != nil {
-		t.Fatalf("failed to run target container: %v", err)
-	}
+	agent := StartAgent(t, Runtimes[0].ConfigFile)
 
-	defer func() {
-		if err := cli.ContainerRemove(context.Background(), agentContainerCid, container.RemoveOptions{Force: true}); err != nil {
-			t.Fatalf("Failed to remove container: %v", err)
-		}
-		if err := cli.ContainerRemove(context.Background(), targetContainerCid, container.RemoveOptions{Force: true}); err != nil {
-			t.Fatalf("Failed to remove container: %v", err)
-		}
-	}()
-	time.Sleep(10 * time.Second)
-
-	tests := []struct {
-		name             string
-		host             string
-		port             string
-		targetType       string
-		cid              string
-		loginName        string
-		disableCleanMode string
-		cmd              string
-	}{
-		{
-			name:             "Test with clean mode",
-			host:             host,
-			port:             port,
-			targetType:       "container",
-			cid:              targetContainerCid,
-			loginName:        "root",
-			disableCleanMode: "false",
-			cmd:              "ls -l",
-		},
-		{
-			name:             "Test with disable clean mode",
-			host:             host,
-			port:             port,
-			targetType:       "container",
-			cid:              targetContainerCid,
-			loginName:        "root",
-			disableCleanMode: "true",
-			cmd:              "ls -l",
-		},
-	}
+	for _, disableCleanMode := range []bool{false, true} {
+		t.Run(fmt.Sprintf("disable clean mode %v", disableCleanMode), func(t *testing.T) {
+			start := time.Now()
 
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			c := Config{
-				Host:             tt.host,
-				Port:             tt.port,
-				TargetType:       tt.targetType,
-				ContainerID:      tt.cid,
-				LoginName:        tt.loginName,
-				DisableCleanMode: tt.disableCleanMode,
-				Cmd:              tt.cmd,
+			result := agent.Run(Run{
+				TargetType:       "phys",
+				DisableCleanMode: disableCleanMode,
+				Cmd:              sh(fmt.Sprintf("dd if=/dev/zero bs=1M count=%d 2>/dev/null", sizeMB)),
+			})
+			if result.Err != nil || result.ExitCode != 0 {
+				t.Fatalf("run client error: %v, exit code: %d", result.Err, result.ExitCode)
 			}
 
-			output, err := execCmdWithClient(c)
-			if err != nil {
-				t.Fatalf("exec cmd in container error: %v", err)
+			if len(result.Output) != sizeMB<<20 {
+				t.Fatalf("expected %d bytes of output, got %d", sizeMB<<20, len(result.Output))
 			}
-			if output == "" {
-				t.Fatalf("Failed to run trust-tunnel-client: %v", err)
-			}
-		})
-	}
-}
-
-func execCmdWithClient(c Config) (string, error) {
-	var clientCmd *exec.Cmd
-	disableCleanModeFlag := "--disable-clean-mode" + "=" + c.DisableCleanMode
-	if c.ContainerID != "" {
-		clientCmd = exec.Command("../out/trust-tunnel-client", "--host", c.Host, "--port", c.Port, "--type", c.TargetType,
-			"--login-name", c.LoginName, "--cid", c.ContainerID, disableCleanModeFlag, "sh", "-c", c.Cmd)
-	} else {
-		clientCmd = exec.Command("../out/trust-tunnel-client", "--host", c.Host, "--port", c.Port, "--type", c.TargetType,
-			"--login-name", c.LoginName, disableCleanModeFlag, "sh", "-c", c.Cmd)
-	}
 
-	stdin, err := clientCmd.StdinPipe()
-	if err != nil {
-		return "", err
-	}
-	defer stdin.Close()
+			throughput := sizeMB / time.Since(start).Seconds()
+			t.Logf("throughput: %.1f MB/s", throughput)
 
-	clientOutput, err := clientCmd.CombinedOutput()
-	if err != nil {
-		return "", err
+			if min, err := strconv.ParseFloat(os.Getenv("E2E_MIN_THROUGHPUT_MBPS"), 64); err == nil && throughput < min {
+				t.Errorf("throughput %.1f MB/s is below %.1f MB/s", throughput, min)
+			}
+		})
 	}
-
-	return string(clientOutput), nil
 }
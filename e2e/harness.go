@@ -0,0 +1,281 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+// +build linux
+
+package e2e
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+	"trust-tunnel/pkg/common/sessionutil"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+)
+
+const (
+	host             = "localhost"
+	port             = "5006"
+	dockerAPIVersion = "1.40"
+
+	// clientBinary is the client built by "make trust-tunnel-client".
+	clientBinary = "../out/trust-tunnel-client"
+
+	// agentStartTimeout is the timeout of waiting for the agent to listen.
+	agentStartTimeout = 30 * time.Second
+
+	// runTimeout is the timeout of the commands run by the client.
+	runTimeout = "60s"
+)
+
+// Runtime is the container runtime the agent connects to, with the config file of the agent for it.
+type Runtime struct {
+	Name       string
+	ConfigFile string
+}
+
+// Runtimes are the container runtimes the container scenarios run with.
+// The containerd agent reaches the containers created by docker in the "moby" namespace.
+var Runtimes = []Runtime{
+	{Name: "docker", ConfigFile: "./config/config.toml"},
+	{Name: "containerd", ConfigFile: "./config/config-containerd.toml"},
+}
+
+// Agent is a trust-tunnel-agent running in a container on the host.
+type Agent struct {
+	cli  *client.Client
+	ID   string
+	Host string
+	Port string
+}
+
+// StartAgent starts an agent with the config file, waits for it to listen,
+// and removes it when the test and its subtests finish.
+func StartAgent(t *testing.T, configFile string) *Agent {
+	t.Helper()
+
+	cli, err := sessionutil.CreateDockerClient("unix:///var/run/docker.sock", dockerAPIVersion)
+	if err != nil {
+		t.Fatalf("Failed to create Docker client: %v", err)
+	}
+
+	cid, err := startTrustTunnelAgent(cli, configFile)
+	if err != nil {
+		t.Fatalf("Failed to run trust-tunnel-agent: %v", err)
+	}
+
+	agent := &Agent{cli: cli, ID: cid, Host: host, Port: port}
+
+	t.Cleanup(func() {
+		agent.remove(t, cid)
+		cli.Close()
+	})
+
+	if err := agent.waitListening(); err != nil {
+		t.Fatalf("trust-tunnel-agent isn't ready: %v", err)
+	}
+
+	return agent
+}
+
+// StartTarget starts a target container, and removes it when the test finishes.
+func (a *Agent) StartTarget(t *testing.T) string {
+	t.Helper()
+
+	cid, err := startTargetContainer(a.cli)
+	if err != nil {
+		t.Fatalf("failed to run target container: %v", err)
+	}
+
+	t.Cleanup(func() {
+		a.remove(t, cid)
+	})
+
+	return cid
+}
+
+// remove removes the container.
+func (a *Agent) remove(t *testing.T, cid string) {
+	if err := a.cli.ContainerRemove(context.Background(), cid, container.RemoveOptions{Force: true}); err != nil {
+		t.Errorf("Failed to remove container: %v", err)
+	}
+}
+
+// waitListening waits for the agent to accept connections.
+func (a *Agent) waitListening() error {
+	deadline := time.Now().Add(agentStartTimeout)
+
+	for {
+		conn, err := net.DialTimeout("tcp", net.JoinHostPort(a.Host, a.Port), time.Second)
+		if err == nil {
+			conn.Close()
+
+			return nil
+		}
+
+		if time.Now().After(deadline) {
+			return err
+		}
+
+		time.Sleep(500 * time.Millisecond)
+	}
+}
+
+// Run describes a command run by the client.
+type Run struct {
+	// TargetType is "phys" or "container".
+	TargetType string
+	// ContainerID is the ID of the target container.
+	ContainerID string
+	// LoginName defaults to root.
+	LoginName        string
+	DisableCleanMode bool
+	// Stdin is fed to the command, the session is interactive if it's set.
+	Stdin string
+	// Tty allocates a terminal of Width x Height for the command, the local terminal is not required.
+	Tty           bool
+	Width, Height int
+	// Args are the extra flags of the client.
+	Args []string
+	// Cmd is the command to run.
+	Cmd []string
+}
+
+// Result is the result of a run.
+type Result struct {
+	// Output is the combined output of the client.
+	Output   string
+	ExitCode int
+	Err      error
+}
+
+// Run runs the command with the client.
+func (a *Agent) Run(r Run) Result {
+	loginName := r.LoginName
+	if loginName == "" {
+		loginName = "root"
+	}
+
+	args := []string{"--host", a.Host, "--port", a.Port, "--type", r.TargetType, "--login-name", loginName,
+		"--disable-clean-mode=" + strconv.FormatBool(r.DisableCleanMode), "--timeout", runTimeout}
+
+	if r.ContainerID != "" {
+		args = append(args, "--cid", r.ContainerID)
+	}
+
+	if r.Stdin != "" {
+		args = append(args, "-i")
+	}
+
+	if r.Tty {
+		args = append(args, "-t")
+
+		if r.Width > 0 && r.Height > 0 {
+			args = append(args, "--width", strconv.Itoa(r.Width), "--height", strconv.Itoa(r.Height))
+		}
+	}
+
+	args = append(append(args, r.Args...), r.Cmd...)
+
+	cmd := exec.Command(clientBinary, args...)
+	cmd.Stdin = strings.NewReader(r.Stdin)
+
+	output, err := cmd.CombinedOutput()
+
+	result := Result{Output: string(output)}
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		result.ExitCode = exitErr.ExitCode()
+	} else {
+		result.Err = err
+	}
+
+	return result
+}
+
+// Scenario is a command run by the client with the expected result.
+type Scenario struct {
+	Name string
+	Run  Run
+	// ExitCode is the expected exit code of the client.
+	ExitCode int
+	// Output are the substrings expected in the output, the output must not be empty if none is given.
+	Output []string
+}
+
+// RunScenarios runs the scenarios as subtests against the agent.
+// The target type and container are filled from the base run if they're not set.
+func RunScenarios(t *testing.T, agent *Agent, base Run, scenarios []Scenario) {
+	for _, s := range scenarios {
+		s := s
+
+		t.Run(s.Name, func(t *testing.T) {
+			run := s.Run
+			if run.TargetType == "" {
+				run.TargetType, run.ContainerID = base.TargetType, base.ContainerID
+			}
+
+			result := agent.Run(run)
+			if result.Err != nil {
+				t.Fatalf("run client error: %v", result.Err)
+			}
+
+			if result.ExitCode != s.ExitCode {
+				t.Errorf("expected exit code %d, got %d, output: %s", s.ExitCode, result.ExitCode, result.Output)
+			}
+
+			if len(s.Output) == 0 && result.Output == "" {
+				t.Errorf("expected output")
+			}
+
+			for _, want := range s.Output {
+				if !strings.Contains(result.Output, want) {
+					t.Errorf("output %q doesn't contain %q", result.Output, want)
+				}
+			}
+		})
+	}
+}
+
+// writeTempFile writes the content to a temporary file removed when the test finishes.
+func writeTempFile(t *testing.T, content string) string {
+	t.Helper()
+
+	f, err := os.CreateTemp("", "trust-tunnel-e2e")
+	if err != nil {
+		t.Fatalf("create temp file error: %v", err)
+	}
+
+	t.Cleanup(func() {
+		os.Remove(f.Name())
+	})
+
+	defer f.Close()
+
+	if _, err := f.WriteString(content); err != nil {
+		t.Fatalf("write temp file error: %v", err)
+	}
+
+	return f.Name()
+}
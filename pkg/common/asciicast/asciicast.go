@@ -0,0 +1,239 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package asciicast records terminal sessions in the asciicast v2 format of asciinema, a header line followed by
+// a line per event of the output, the input or the resize with the seconds since the start, so that the sessions
+// can be replayed, e.g. by `asciinema play`.
+package asciicast
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Version is the version of the asciicast format.
+const Version = 2
+
+// The codes of the events.
+const (
+	EventOutput = "o"
+	EventInput  = "i"
+	EventResize = "r"
+)
+
+// The terminal size of the header if the session is recorded before its size is known.
+const (
+	DefaultWidth  = 80
+	DefaultHeight = 24
+)
+
+// Header is the first line of a recording.
+type Header struct {
+	Version   int               `json:"version"`
+	Width     int               `json:"width"`
+	Height    int               `json:"height"`
+	Timestamp int64             `json:"timestamp,omitempty"`
+	Command   string            `json:"command,omitempty"`
+	Title     string            `json:"title,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+}
+
+// Recorder writes the events of a session to a recording. The header is written along with the first event, so
+// that the terminal size requested right after the session starts is the initial size of the replay rather than
+// a resize. It's safe for concurrent use, and the failures of writing the recording don't fail the writers of the
+// session, but are returned by Close.
+type Recorder struct {
+	lock          sync.Mutex
+	w             io.WriteCloser
+	header        Header
+	headerWritten bool
+	start         time.Time
+	now           func() time.Time
+	// partial holds the incomplete UTF-8 sequence at the end of the latest data of each event code, which is
+	// completed by the next data, as the events carry strings.
+	partial map[string][]byte
+	err     error
+	closed  bool
+}
+
+// NewRecorder creates a recorder writing to w, starting now. The version and the timestamp of the header are set
+// if they're zero, and so is the size.
+func NewRecorder(w io.WriteCloser, header Header) *Recorder {
+	return newRecorder(w, header, time.Now)
+}
+
+func newRecorder(w io.WriteCloser, header Header, now func() time.Time) *Recorder {
+	start := now()
+
+	if header.Version == 0 {
+		header.Version = Version
+	}
+
+	if header.Timestamp == 0 {
+		header.Timestamp = start.Unix()
+	}
+
+	if header.Width <= 0 || header.Height <= 0 {
+		header.Width, header.Height = DefaultWidth, DefaultHeight
+	}
+
+	return &Recorder{
+		w:       w,
+		header:  header,
+		start:   start,
+		now:     now,
+		partial: make(map[string][]byte),
+	}
+}
+
+// Output returns the writer recording the output of the session.
+func (r *Recorder) Output() io.Writer {
+	return eventWriter{recorder: r, code: EventOutput}
+}
+
+// Input returns the writer recording the input of the session.
+func (r *Recorder) Input() io.Writer {
+	return eventWriter{recorder: r, code: EventInput}
+}
+
+// Resize records the terminal size of the session, which is the size of the header if nothing has been recorded.
+func (r *Recorder) Resize(width, height int) {
+	if width <= 0 || height <= 0 {
+		return
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if !r.headerWritten {
+		r.header.Width, r.header.Height = width, height
+
+		return
+	}
+
+	r.writeEvent(EventResize, fmt.Sprintf("%dx%d", width, height))
+}
+
+// Close writes the header if nothing has been recorded and closes the recording. It returns the first failure of
+// writing the recording.
+func (r *Recorder) Close() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.closed {
+		return r.err
+	}
+
+	r.closed = true
+
+	// The incomplete sequences are never completed, they're kept as the replacement characters.
+	for _, code := range []string{EventOutput, EventInput} {
+		if p := r.partial[code]; len(p) > 0 {
+			r.writeEvent(code, string(p))
+		}
+	}
+
+	r.writeHeader()
+
+	if err := r.w.Close(); err != nil && r.err == nil {
+		r.err = err
+	}
+
+	return r.err
+}
+
+// record records the data of the event, keeping the incomplete UTF-8 sequence at the end for the next data.
+func (r *Recorder) record(code string, p []byte) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.closed {
+		return
+	}
+
+	data := append(r.partial[code], p...)
+	complete := len(data) - incompleteSuffix(data)
+	r.partial[code] = append([]byte(nil), data[complete:]...)
+
+	if complete > 0 {
+		r.writeEvent(code, string(data[:complete]))
+	}
+}
+
+// writeEvent writes an event line, after the header if it hasn't been written.
+func (r *Recorder) writeEvent(code, data string) {
+	r.writeHeader()
+
+	elapsed := float64(r.now().Sub(r.start).Microseconds()) / 1e6
+
+	line, _ := json.Marshal([]interface{}{elapsed, code, data})
+	r.writeLine(line)
+}
+
+// writeHeader writes the header line unless it has been written.
+func (r *Recorder) writeHeader() {
+	if r.headerWritten {
+		return
+	}
+
+	r.headerWritten = true
+
+	line, _ := json.Marshal(r.header)
+	r.writeLine(line)
+}
+
+// writeLine writes a line to the recording, nothing is written after a failure.
+func (r *Recorder) writeLine(line []byte) {
+	if r.err != nil {
+		return
+	}
+
+	if _, err := r.w.Write(append(line, '\n')); err != nil {
+		r.err = err
+	}
+}
+
+// eventWriter records the data written as the events of the code.
+type eventWriter struct {
+	recorder *Recorder
+	code     string
+}
+
+// Write records p, it never fails.
+func (w eventWriter) Write(p []byte) (int, error) {
+	w.recorder.record(w.code, p)
+
+	return len(p), nil
+}
+
+// incompleteSuffix returns the length of the incomplete UTF-8 sequence at the end of p.
+func incompleteSuffix(p []byte) int {
+	for i := len(p) - 1; i >= 0 && i >= len(p)-utf8.UTFMax+1; i-- {
+		if !utf8.RuneStart(p[i]) {
+			continue
+		}
+
+		if utf8.FullRune(p[i:]) {
+			return 0
+		}
+
+		return len(p) - i
+	}
+
+	return 0
+}
@@ -0,0 +1,86 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package asciicast
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+)
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
+
+func TestRecorder(t *testing.T) {
+	var out bytes.Buffer
+
+	start := time.Unix(1700000000, 0)
+	now := start
+
+	r := newRecorder(nopCloser{&out}, Header{Command: "bash", Env: map[string]string{"TERM": "xterm"}}, func() time.Time {
+		return now
+	})
+
+	// The size requested before anything is recorded is the initial size.
+	r.Resize(120, 40)
+
+	now = start.Add(1500 * time.Millisecond)
+	r.Output().Write([]byte("$ \xe4\xbd"))
+	r.Input().Write([]byte("ls\r"))
+
+	now = start.Add(2 * time.Second)
+	r.Output().Write([]byte("\xa0\n"))
+	r.Resize(80, 24)
+
+	if err := r.Close(); err != nil {
+		t.Fatalf("unexpected close error: %v", err)
+	}
+
+	// The split character is recorded once it's completed.
+	expected := `{"version":2,"width":120,"height":40,"timestamp":1700000000,"command":"bash","env":{"TERM":"xterm"}}
+[1.5,"o","$ "]
+[1.5,"i","ls\r"]
+[2,"o","你\n"]
+[2,"r","80x24"]
+`
+	if out.String() != expected {
+		t.Errorf("got recording %q, want %q", out.String(), expected)
+	}
+
+	// Nothing is recorded once it's closed.
+	r.Output().Write([]byte("late"))
+
+	if out.String() != expected {
+		t.Errorf("recorded after closed: %q", out.String())
+	}
+}
+
+func TestRecorderEmpty(t *testing.T) {
+	var out bytes.Buffer
+
+	r := newRecorder(nopCloser{&out}, Header{Timestamp: 1}, time.Now)
+	r.Close()
+
+	expected := `{"version":2,"width":80,"height":24,"timestamp":1}` + "\n"
+	if out.String() != expected {
+		t.Errorf("got recording %q, want %q", out.String(), expected)
+	}
+}
@@ -0,0 +1,104 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logutil
+
+import (
+	"fmt"
+	"net/url"
+
+	"github.com/sirupsen/logrus"
+)
+
+// auditModules are the modules of the audit loggers, which are copied to the remote syslog if configured.
+var (
+	auditModules = make(map[string]bool)
+	auditHook    logrus.Hook
+)
+
+// GetAuditLogger returns the audit logger for the given module name, creating it if it doesn't exist.
+func GetAuditLogger(moduleName string) *logrus.Logger {
+	logger := GetLogger(moduleName)
+
+	locker.Lock()
+	defer locker.Unlock()
+
+	if !auditModules[moduleName] {
+		auditModules[moduleName] = true
+
+		if auditHook != nil {
+			logger.AddHook(auditHook)
+		}
+	}
+
+	return logger
+}
+
+// SetAuditSyslog copies the audit logs to the remote syslog at the address, e.g. "udp://10.0.0.1:514",
+// "tcp://syslog.example.com:601" or "unix:///dev/log". It can be set only once.
+func SetAuditSyslog(addr string) error {
+	if addr == "" {
+		return nil
+	}
+
+	network, raddr, err := ParseSyslogAddr(addr)
+	if err != nil {
+		return err
+	}
+
+	hook, err := newSyslogHook(network, raddr)
+	if err != nil {
+		return fmt.Errorf("failed to connect to syslog %s: %v", addr, err)
+	}
+
+	locker.Lock()
+	defer locker.Unlock()
+
+	if auditHook != nil {
+		return fmt.Errorf("audit syslog is already set")
+	}
+
+	auditHook = hook
+
+	for moduleName := range auditModules {
+		logMap[moduleName].AddHook(hook)
+	}
+
+	return nil
+}
+
+// ParseSyslogAddr parses the syslog address into the network and the address to dial.
+func ParseSyslogAddr(addr string) (string, string, error) {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid syslog address %q: %v", addr, err)
+	}
+
+	switch u.Scheme {
+	case "udp", "tcp":
+		if u.Host == "" || u.Port() == "" {
+			return "", "", fmt.Errorf("invalid syslog address %q: host and port are required", addr)
+		}
+
+		return u.Scheme, u.Host, nil
+	case "unix", "unixgram":
+		if u.Path == "" {
+			return "", "", fmt.Errorf("invalid syslog address %q: path is required", addr)
+		}
+
+		return u.Scheme, u.Path, nil
+	default:
+		return "", "", fmt.Errorf("invalid syslog address %q: scheme must be udp, tcp, unix or unixgram", addr)
+	}
+}
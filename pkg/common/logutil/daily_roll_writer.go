@@ -34,6 +34,10 @@ const (
 type Config struct {
 	Level      string `toml:"level"`
 	ExpireDays int    `toml:"expire_days"`
+	// SessionFiles copies the logs of each session into <log dir>/sessions/<session id>.log.
+	SessionFiles bool `toml:"session_files"`
+	// AuditSyslog copies the audit logs to the remote syslog, e.g. "udp://10.0.0.1:514".
+	AuditSyslog string `toml:"audit_syslog"`
 }
 
 var expireDay = defaultExpireDay
@@ -178,4 +182,27 @@ func cleanHistoryLogs() {
 			os.Remove(path.Join(logDir, logFile.Name()))
 		}
 	}
+
+	cleanSessionLogs(expireDate)
+}
+
+// cleanSessionLogs deletes per-session log files which haven't been written since the expiration date.
+func cleanSessionLogs(expireDate time.Time) {
+	dir := filepath.Join(logDir, sessionLogDir)
+
+	logFiles, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+
+	for _, logFile := range logFiles {
+		info, err := logFile.Info()
+		if err != nil {
+			continue
+		}
+
+		if expireDate.After(info.ModTime()) {
+			os.Remove(filepath.Join(dir, logFile.Name()))
+		}
+	}
 }
@@ -0,0 +1,348 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logutil
+
+import (
+	"unicode"
+	"unicode/utf8"
+)
+
+// Control characters interpreted by the lineEditor, following the emacs key bindings of readline.
+const (
+	keyCtrlA     = 0x01
+	keyCtrlB     = 0x02
+	keyCtrlC     = 0x03
+	keyCtrlD     = 0x04
+	keyCtrlE     = 0x05
+	keyCtrlF     = 0x06
+	keyBackspace = 0x08
+	keyTab       = 0x09
+	keyLF        = 0x0a
+	keyCtrlK     = 0x0b
+	keyCR        = 0x0d
+	keyCtrlN     = 0x0e
+	keyCtrlP     = 0x10
+	keyCtrlR     = 0x12
+	keyCtrlU     = 0x15
+	keyCtrlW     = 0x17
+	keyEscape    = 0x1b
+	keyDelete    = 0x7f
+)
+
+// escState is the state of the escape sequence being parsed.
+type escState int
+
+const (
+	escNone escState = iota
+	// escStart follows an ESC.
+	escStart
+	// escCSI follows an ESC [, collecting the parameters until the final byte.
+	escCSI
+	// escSS3 follows an ESC O, expecting a single final byte.
+	escSS3
+)
+
+// editedLine is a command line reconstructed by the lineEditor.
+type editedLine struct {
+	text string
+	// completion tells the line was edited by tab completion, which is done by the remote shell,
+	// so the completed text is missing in the line.
+	completion bool
+	// history tells the line was recalled or searched from the history of the remote shell,
+	// so the recalled text is missing in the line.
+	history bool
+}
+
+// lineEditor reconstructs the command lines typed into a terminal from the keystrokes,
+// interpreting the line editing keys and escape sequences of common shells.
+type lineEditor struct {
+	line   []rune
+	cursor int
+
+	// pending holds the bytes of an incomplete UTF-8 character.
+	pending []byte
+
+	esc       escState
+	escParams []byte
+	// paste tells the keys are inside a bracketed paste, so they're inserted literally.
+	paste bool
+
+	completion bool
+	history    bool
+
+	maxLength int
+}
+
+// newLineEditor creates a lineEditor, flushing lines longer than maxLength runes.
+func newLineEditor(maxLength int) *lineEditor {
+	return &lineEditor{maxLength: maxLength}
+}
+
+// feed interprets the given keystrokes, and returns the lines completed by them.
+func (e *lineEditor) feed(p []byte) []editedLine {
+	var lines []editedLine
+
+	if len(e.pending) > 0 {
+		p = append(e.pending, p...)
+		e.pending = nil
+	}
+
+	for len(p) > 0 {
+		r, size := utf8.DecodeRune(p)
+		if r == utf8.RuneError && size <= 1 && !utf8.FullRune(p) {
+			// Wait for the rest of the character.
+			e.pending = append([]byte{}, p...)
+
+			break
+		}
+
+		p = p[size:]
+
+		if line, ok := e.key(r); ok {
+			lines = append(lines, line)
+		}
+
+		if len(e.line) >= e.maxLength {
+			lines = append(lines, e.flush())
+		}
+	}
+
+	return lines
+}
+
+// key interprets a single key, returning the line if it's completed by the key.
+func (e *lineEditor) key(r rune) (editedLine, bool) {
+	if e.esc != escNone {
+		e.escape(r)
+
+		return editedLine{}, false
+	}
+
+	if e.paste {
+		switch r {
+		case keyEscape:
+			e.esc = escStart
+		case keyCR, keyLF:
+			// The pasted lines are executed one by one.
+			return e.enter()
+		default:
+			if unicode.IsPrint(r) || r == keyTab {
+				e.insert(r)
+			}
+		}
+
+		return editedLine{}, false
+	}
+
+	switch r {
+	case keyCR, keyLF:
+		return e.enter()
+	case keyCtrlC:
+		// The line is discarded by the shell.
+		e.reset()
+	case keyCtrlA:
+		e.cursor = 0
+	case keyCtrlE:
+		e.cursor = len(e.line)
+	case keyCtrlB:
+		e.moveLeft()
+	case keyCtrlF:
+		e.moveRight()
+	case keyBackspace, keyDelete:
+		if e.cursor > 0 {
+			e.line = append(e.line[:e.cursor-1], e.line[e.cursor:]...)
+			e.cursor--
+		}
+	case keyCtrlD:
+		e.deleteForward()
+	case keyCtrlK:
+		e.line = e.line[:e.cursor]
+	case keyCtrlU:
+		e.line = append(e.line[:0], e.line[e.cursor:]...)
+		e.cursor = 0
+	case keyCtrlW:
+		start := e.wordStart()
+		e.line = append(e.line[:start], e.line[e.cursor:]...)
+		e.cursor = start
+	case keyTab:
+		e.completion = true
+	case keyCtrlP, keyCtrlN, keyCtrlR:
+		e.history = true
+	case keyEscape:
+		e.esc = escStart
+	default:
+		if unicode.IsPrint(r) {
+			e.insert(r)
+		}
+	}
+
+	return editedLine{}, false
+}
+
+// escape interprets a key of an escape sequence.
+func (e *lineEditor) escape(r rune) {
+	switch e.esc {
+	case escStart:
+		e.esc = escNone
+
+		switch r {
+		case '[':
+			e.esc = escCSI
+			e.escParams = e.escParams[:0]
+		case 'O':
+			e.esc = escSS3
+		case 'b', 'B':
+			// Alt+B moves to the previous word.
+			e.cursor = e.wordStart()
+		case 'f', 'F':
+			// Alt+F moves to the next word.
+			e.cursor = e.wordEnd()
+		case keyDelete, keyBackspace:
+			// Alt+Backspace deletes the previous word.
+			start := e.wordStart()
+			e.line = append(e.line[:start], e.line[e.cursor:]...)
+			e.cursor = start
+		case 'd', 'D':
+			// Alt+D deletes the next word.
+			end := e.wordEnd()
+			e.line = append(e.line[:e.cursor], e.line[end:]...)
+		}
+	case escSS3:
+		e.esc = escNone
+		e.cursorKey(r, "")
+	case escCSI:
+		// Parameter and intermediate bytes are followed by a final byte in 0x40-0x7e.
+		if r < 0x40 || r > 0x7e {
+			if len(e.escParams) < 16 {
+				e.escParams = append(e.escParams, byte(r))
+			}
+
+			return
+		}
+
+		e.esc = escNone
+		e.cursorKey(r, string(e.escParams))
+	}
+}
+
+// cursorKey interprets the final byte of a CSI or SS3 sequence with the given parameters.
+func (e *lineEditor) cursorKey(final rune, params string) {
+	switch final {
+	case 'A', 'B':
+		// Up and down arrows recall the history.
+		e.history = true
+	case 'C':
+		e.moveRight()
+	case 'D':
+		e.moveLeft()
+	case 'H':
+		e.cursor = 0
+	case 'F':
+		e.cursor = len(e.line)
+	case '~':
+		switch params {
+		case "1", "7":
+			e.cursor = 0
+		case "4", "8":
+			e.cursor = len(e.line)
+		case "3":
+			e.deleteForward()
+		case "200":
+			e.paste = true
+		case "201":
+			e.paste = false
+		}
+	}
+}
+
+// enter completes the current line.
+func (e *lineEditor) enter() (editedLine, bool) {
+	if len(e.line) == 0 && !e.completion && !e.history {
+		return editedLine{}, false
+	}
+
+	return e.flush(), true
+}
+
+// flush returns the current line and starts a new one.
+func (e *lineEditor) flush() editedLine {
+	line := editedLine{text: string(e.line), completion: e.completion, history: e.history}
+	e.reset()
+
+	return line
+}
+
+// reset discards the current line.
+func (e *lineEditor) reset() {
+	e.line = e.line[:0]
+	e.cursor = 0
+	e.completion = false
+	e.history = false
+}
+
+// insert inserts the given character at the cursor.
+func (e *lineEditor) insert(r rune) {
+	e.line = append(e.line, 0)
+	copy(e.line[e.cursor+1:], e.line[e.cursor:])
+	e.line[e.cursor] = r
+	e.cursor++
+}
+
+// deleteForward deletes the character under the cursor.
+func (e *lineEditor) deleteForward() {
+	if e.cursor < len(e.line) {
+		e.line = append(e.line[:e.cursor], e.line[e.cursor+1:]...)
+	}
+}
+
+func (e *lineEditor) moveLeft() {
+	if e.cursor > 0 {
+		e.cursor--
+	}
+}
+
+func (e *lineEditor) moveRight() {
+	if e.cursor < len(e.line) {
+		e.cursor++
+	}
+}
+
+// wordStart returns the start of the word before the cursor.
+func (e *lineEditor) wordStart() int {
+	i := e.cursor
+	for i > 0 && unicode.IsSpace(e.line[i-1]) {
+		i--
+	}
+
+	for i > 0 && !unicode.IsSpace(e.line[i-1]) {
+		i--
+	}
+
+	return i
+}
+
+// wordEnd returns the end of the word after the cursor.
+func (e *lineEditor) wordEnd() int {
+	i := e.cursor
+	for i < len(e.line) && unicode.IsSpace(e.line[i]) {
+		i++
+	}
+
+	for i < len(e.line) && !unicode.IsSpace(e.line[i]) {
+		i++
+	}
+
+	return i
+}
@@ -0,0 +1,82 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logutil
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLineEditor(t *testing.T) {
+	cases := []struct {
+		name  string
+		keys  []string
+		lines []editedLine
+	}{
+		{
+			name:  "plain",
+			keys:  []string{"ls -l\r"},
+			lines: []editedLine{{text: "ls -l"}},
+		},
+		{
+			name:  "backspace",
+			keys:  []string{"lss\x7f -l\r\n"},
+			lines: []editedLine{{text: "ls -l"}},
+		},
+		{
+			name:  "arrow keys",
+			keys:  []string{"rm -rf /tmp/x", "\x1b[D\x1b[D\x1b[D\x1b[D\x1b[D\x1b[D", "\x1b", "[3~\x01sudo \x1bOF y\r"},
+			lines: []editedLine{{text: "sudo rm -rf tmp/x y"}},
+		},
+		{
+			name:  "kill and words",
+			keys:  []string{"echo foo bar\x17baz\x01\x0bcat a\x1bbb \x1bfxx\r"},
+			lines: []editedLine{{text: "cat b axx"}},
+		},
+		{
+			name:  "interrupted",
+			keys:  []string{"reboot\x03", "\r", "uptime\r"},
+			lines: []editedLine{{text: "uptime"}},
+		},
+		{
+			name:  "completion and history",
+			keys:  []string{"cat /etc/pas\t\r", "\x1b[A\r"},
+			lines: []editedLine{{text: "cat /etc/pas", completion: true}, {history: true}},
+		},
+		{
+			name:  "bracketed paste",
+			keys:  []string{"\x1b[200~echo\ta\x01\rid\x1b[201~\r"},
+			lines: []editedLine{{text: "echo\ta"}, {text: "id"}},
+		},
+		{
+			name:  "split utf-8",
+			keys:  []string{"echo \xe4\xbd", "\xa0\xe5\xa5\xbd\x7f\r"},
+			lines: []editedLine{{text: "echo 你"}},
+		},
+	}
+
+	for _, c := range cases {
+		e := newLineEditor(maxLength)
+
+		var lines []editedLine
+		for _, k := range c.keys {
+			lines = append(lines, e.feed([]byte(k))...)
+		}
+
+		if !reflect.DeepEqual(lines, c.lines) {
+			t.Errorf("%s: got lines %+v, want %+v", c.name, lines, c.lines)
+		}
+	}
+}
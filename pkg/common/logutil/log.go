@@ -30,6 +30,8 @@ type CmdLogger struct {
 	cmdCh  chan []byte
 	doneCh chan struct{}
 	l      *logrus.Entry
+	// editor reconstructs the command lines of terminal sessions from the keystrokes.
+	editor *lineEditor
 }
 
 // NewCmdLogger creates a new CmdLogger instance.
@@ -45,9 +47,24 @@ func NewCmdLogger(l *logrus.Entry) *CmdLogger {
 	return cmdL
 }
 
+// NewTTYCmdLogger creates a new CmdLogger instance for terminal sessions. Instead of logging the raw keystrokes,
+// it interprets the line editing keys and escape sequences to log the command lines as they're executed.
+func NewTTYCmdLogger(l *logrus.Entry) *CmdLogger {
+	cmdL := &CmdLogger{
+		cmdCh:  make(chan []byte, 50),
+		doneCh: make(chan struct{}),
+		l:      l,
+		editor: newLineEditor(maxLength),
+	}
+	go cmdL.log()
+
+	return cmdL
+}
+
 // Write writes the command output to the logger.
 func (cmdLogger *CmdLogger) Write(p []byte) (int, error) {
-	cmdLogger.cmdCh <- p
+	// The buffer of p may be reused by the caller once Write returns.
+	cmdLogger.cmdCh <- append([]byte{}, p...)
 
 	return len(p), nil
 }
@@ -74,6 +91,12 @@ func (cmdLogger *CmdLogger) log() {
 			}
 		}
 
+		if cmdLogger.editor != nil {
+			cmdLogger.logLines(p)
+
+			continue
+		}
+
 		for {
 			if len(p) == 0 {
 				break
@@ -109,3 +132,19 @@ func (cmdLogger *CmdLogger) log() {
 		}
 	}
 }
+
+// logLines logs the command lines completed by the given keystrokes.
+func (cmdLogger *CmdLogger) logLines(p []byte) {
+	for _, line := range cmdLogger.editor.feed(p) {
+		l := cmdLogger.l
+		if line.completion {
+			l = l.WithField("completion", true)
+		}
+
+		if line.history {
+			l = l.WithField("history", true)
+		}
+
+		l.Infof("Cmd: %s", line.text)
+	}
+}
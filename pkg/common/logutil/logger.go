@@ -96,6 +96,10 @@ func GetLogger(moduleName string) *logrus.Logger {
 	}
 
 	logger := newLogrusLogger(moduleName)
+	if sessionFileEnabled {
+		setSessionFileHook(logger, true)
+	}
+
 	logMap[moduleName] = logger
 
 	return logger
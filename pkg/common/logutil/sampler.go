@@ -0,0 +1,105 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logutil
+
+import (
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Sampler limits the entries logged by a hot path, e.g. the per-message traces of the streams,
+// so that enabling a verbose level can't overwhelm the disks.
+// Within each period, the first entries are logged, then only every thereafter-th entry.
+// The number of entries dropped since the last logged one is attached in the "dropped" field.
+type Sampler struct {
+	first      int
+	thereafter int
+	period     time.Duration
+
+	lock    sync.Mutex
+	start   time.Time
+	count   int
+	dropped int
+	now     func() time.Time
+}
+
+// NewSampler creates a Sampler logging the first entries of each period and every thereafter-th entry after them.
+// A thereafter of zero drops the rest of the entries of the period, rate limiting the entries to first per period.
+func NewSampler(first, thereafter int, period time.Duration) *Sampler {
+	return &Sampler{
+		first:      first,
+		thereafter: thereafter,
+		period:     period,
+		now:        time.Now,
+	}
+}
+
+// allow tells whether the next entry should be logged, and how many entries were dropped before it.
+func (s *Sampler) allow() (bool, int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := s.now()
+	if now.Sub(s.start) >= s.period {
+		s.start = now
+		s.count = 0
+	}
+
+	s.count++
+
+	if s.count > s.first && (s.thereafter <= 0 || (s.count-s.first)%s.thereafter != 0) {
+		s.dropped++
+
+		return false, 0
+	}
+
+	dropped := s.dropped
+	s.dropped = 0
+
+	return true, dropped
+}
+
+// Logf logs the entry at the given level if it's enabled and sampled.
+func (s *Sampler) Logf(l *logrus.Logger, level logrus.Level, format string, args ...interface{}) {
+	// Skip the sampling, and formatting the arguments, if the level isn't enabled.
+	if !l.IsLevelEnabled(level) {
+		return
+	}
+
+	ok, dropped := s.allow()
+	if !ok {
+		return
+	}
+
+	if dropped > 0 {
+		l.WithField("dropped", dropped).Logf(level, format, args...)
+
+		return
+	}
+
+	l.Logf(level, format, args...)
+}
+
+// Tracef logs the entry at the trace level if it's enabled and sampled.
+func (s *Sampler) Tracef(l *logrus.Logger, format string, args ...interface{}) {
+	s.Logf(l, logrus.TraceLevel, format, args...)
+}
+
+// Debugf logs the entry at the debug level if it's enabled and sampled.
+func (s *Sampler) Debugf(l *logrus.Logger, format string, args ...interface{}) {
+	s.Logf(l, logrus.DebugLevel, format, args...)
+}
@@ -0,0 +1,62 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logutil
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestSampler(t *testing.T) {
+	var out bytes.Buffer
+
+	l := logrus.New()
+	l.Out = &out
+	l.Level = logrus.TraceLevel
+
+	now := time.Now()
+	s := NewSampler(2, 3, time.Second)
+	s.now = func() time.Time { return now }
+
+	for i := 0; i < 8; i++ {
+		s.Tracef(l, "chunk %d", i)
+	}
+
+	// The next period starts over.
+	now = now.Add(time.Second)
+	s.Tracef(l, "chunk %d", 8)
+
+	var got []string
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		got = append(got, line[strings.Index(line, "msg="):])
+	}
+
+	want := []string{`msg="chunk 0"`, `msg="chunk 1"`, `msg="chunk 4" dropped=2`, `msg="chunk 7" dropped=2`, `msg="chunk 8"`}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got entries\n%s", strings.Join(got, "\n"))
+	}
+
+	// Disabled levels aren't counted.
+	l.Level = logrus.DebugLevel
+	s.Tracef(l, "disabled")
+
+	if s.count != 1 {
+		t.Errorf("disabled entries shouldn't be counted, got %d", s.count)
+	}
+}
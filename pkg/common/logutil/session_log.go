@@ -0,0 +1,245 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logutil
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Fields used to route log entries into per-session log files.
+const (
+	FieldSessionID     = "session_id"
+	FieldCorrelationID = "correlation_id"
+)
+
+const (
+	sessionLogDir = "sessions"
+
+	// maxPendingEntries bounds the entries kept for a request which hasn't got a session yet.
+	maxPendingEntries = 64
+	// pendingExpiry is how long entries of a request without session are kept.
+	pendingExpiry = time.Minute
+)
+
+var sessionFileNameExp = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// pendingEntries holds the entries logged by a request before its session ID is known.
+type pendingEntries struct {
+	created time.Time
+	lines   [][]byte
+}
+
+// sessionFileHook is a logrus hook copying entries with a session ID into a dedicated file per session.
+// Entries logged before the session ID is known are kept by correlation ID and flushed into the
+// session file once an entry carries both IDs.
+type sessionFileHook struct {
+	lock      sync.Mutex
+	formatter logrus.Formatter
+	files     map[string]*os.File
+	pending   map[string]*pendingEntries
+	now       func() time.Time
+}
+
+var (
+	sessionHook        *sessionFileHook
+	sessionFileEnabled bool
+)
+
+// newSessionFileHook creates a new sessionFileHook.
+func newSessionFileHook() *sessionFileHook {
+	return &sessionFileHook{
+		formatter: &logrus.TextFormatter{DisableColors: true},
+		files:     make(map[string]*os.File),
+		pending:   make(map[string]*pendingEntries),
+		now:       time.Now,
+	}
+}
+
+// Levels returns the levels the hook fires on.
+func (h *sessionFileHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+// Fire writes the entry into the file of its session.
+func (h *sessionFileHook) Fire(entry *logrus.Entry) error {
+	sessID, _ := entry.Data[FieldSessionID].(string)
+	correlationID, _ := entry.Data[FieldCorrelationID].(string)
+
+	if sessID == "" && correlationID == "" {
+		return nil
+	}
+
+	line, err := h.formatter.Format(entry)
+	if err != nil {
+		return err
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.expirePending()
+
+	if sessID == "" {
+		p, ok := h.pending[correlationID]
+		if !ok {
+			p = &pendingEntries{created: h.now()}
+			h.pending[correlationID] = p
+		}
+
+		if len(p.lines) < maxPendingEntries {
+			p.lines = append(p.lines, line)
+		}
+
+		return nil
+	}
+
+	f, err := h.file(sessID)
+	if err != nil {
+		return err
+	}
+
+	if p, ok := h.pending[correlationID]; ok && correlationID != "" {
+		for _, l := range p.lines {
+			if _, err := f.Write(l); err != nil {
+				return err
+			}
+		}
+
+		delete(h.pending, correlationID)
+	}
+
+	_, err = f.Write(line)
+
+	return err
+}
+
+// file returns the opened log file of the given session.
+func (h *sessionFileHook) file(sessID string) (*os.File, error) {
+	if f, ok := h.files[sessID]; ok {
+		return f, nil
+	}
+
+	if !sessionFileNameExp.MatchString(sessID) || sessID == "." || sessID == ".." {
+		return nil, fmt.Errorf("invalid session id %q for session log file", sessID)
+	}
+
+	dir := filepath.Join(logDir, sessionLogDir)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(filepath.Join(dir, sessID+".log"), os.O_APPEND|os.O_WRONLY|os.O_CREATE, os.FileMode(0o644))
+	if err != nil {
+		return nil, err
+	}
+
+	h.files[sessID] = f
+
+	return f, nil
+}
+
+// expirePending drops the entries of requests which never got a session.
+func (h *sessionFileHook) expirePending() {
+	deadline := h.now().Add(-pendingExpiry)
+
+	for id, p := range h.pending {
+		if p.created.Before(deadline) {
+			delete(h.pending, id)
+		}
+	}
+}
+
+// closeSession closes the log file of the given session.
+func (h *sessionFileHook) closeSession(sessID string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if f, ok := h.files[sessID]; ok {
+		f.Close()
+		delete(h.files, sessID)
+	}
+}
+
+// SetSessionFiles sets whether to copy the entries of each session into a dedicated file
+// named by the session ID under the log dir, in addition to the module logs.
+// Only entries with the session_id or correlation_id field are copied.
+func SetSessionFiles(enable bool) {
+	locker.Lock()
+	defer locker.Unlock()
+
+	if enable == sessionFileEnabled {
+		return
+	}
+
+	sessionFileEnabled = enable
+
+	if enable && sessionHook == nil {
+		sessionHook = newSessionFileHook()
+	}
+
+	for _, theLogger := range logMap {
+		setSessionFileHook(theLogger, enable)
+	}
+}
+
+// setSessionFileHook adds or removes the session file hook of the given logger.
+func setSessionFileHook(logger *logrus.Logger, enable bool) {
+	hooks := make(logrus.LevelHooks)
+
+	for level, levelHooks := range logger.Hooks {
+		for _, hook := range levelHooks {
+			if hook != sessionHook {
+				hooks[level] = append(hooks[level], hook)
+			}
+		}
+	}
+
+	if enable {
+		hooks.Add(sessionHook)
+	}
+
+	logger.ReplaceHooks(hooks)
+}
+
+// CloseSessionFile closes the dedicated log file of the given session.
+// Entries logged for the session afterwards reopen the file in append mode.
+func CloseSessionFile(sessID string) {
+	locker.Lock()
+	hook := sessionHook
+	locker.Unlock()
+
+	if hook != nil {
+		hook.closeSession(sessID)
+	}
+}
+
+// NewCorrelationID returns a random ID correlating the log entries of one request.
+func NewCorrelationID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,74 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logutil
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestSessionFileHook(t *testing.T) {
+	origDir := logDir
+	logDir = t.TempDir()
+
+	defer func() { logDir = origDir }()
+
+	now := time.Now()
+	hook := newSessionFileHook()
+	hook.now = func() time.Time { return now }
+
+	l := logrus.New()
+	l.Out = io.Discard
+	l.AddHook(hook)
+
+	req := l.WithField(FieldCorrelationID, "c1")
+	req.Info("request info")
+	l.WithField(FieldCorrelationID, "c2").Info("denied request")
+	l.Info("module only")
+
+	sess := req.WithField(FieldSessionID, "s1")
+	sess.Info("session established")
+	hook.closeSession("s1")
+	l.WithField(FieldSessionID, "s1").Info("session released")
+
+	content, err := os.ReadFile(filepath.Join(logDir, sessionLogDir, "s1.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	if len(lines) != 3 || !strings.Contains(lines[0], "request info") || !strings.Contains(lines[1], "session established") ||
+		!strings.Contains(lines[2], "session released") {
+		t.Errorf("unexpected session log:\n%s", content)
+	}
+
+	// The entries of requests without session expire.
+	now = now.Add(2 * pendingExpiry)
+	l.WithField(FieldCorrelationID, "c3").Info("another request")
+
+	if _, ok := hook.pending["c2"]; ok {
+		t.Error("pending entries of c2 should expire")
+	}
+
+	if err := hook.Fire(l.WithField(FieldSessionID, "../escape")); err == nil {
+		t.Error("session id with path separator should be refused")
+	}
+}
@@ -0,0 +1,84 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build unix
+
+package logutil
+
+import (
+	"log/syslog"
+
+	"github.com/sirupsen/logrus"
+)
+
+// syslogQueueSize bounds the entries waiting to be sent, so that an unreachable syslog doesn't block the audits.
+const syslogQueueSize = 1024
+
+// syslogHook sends the messages of the entries to the remote syslog in background.
+type syslogHook struct {
+	writer *syslog.Writer
+	queue  chan *logrus.Entry
+}
+
+// newSyslogHook connects to the syslog, the messages are tagged with "trust-tunnel-audit".
+func newSyslogHook(network, raddr string) (logrus.Hook, error) {
+	writer, err := syslog.Dial(network, raddr, syslog.LOG_INFO|syslog.LOG_AUTH, "trust-tunnel-audit")
+	if err != nil {
+		return nil, err
+	}
+
+	h := &syslogHook{
+		writer: writer,
+		queue:  make(chan *logrus.Entry, syslogQueueSize),
+	}
+	go h.send()
+
+	return h, nil
+}
+
+func (h *syslogHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+// Fire queues the entry, which is dropped if the queue is full.
+func (h *syslogHook) Fire(entry *logrus.Entry) error {
+	select {
+	case h.queue <- entry:
+	default:
+	}
+
+	return nil
+}
+
+// send sends the queued entries with their levels, the writer reconnects on failures.
+func (h *syslogHook) send() {
+	for entry := range h.queue {
+		var err error
+
+		switch entry.Level {
+		case logrus.PanicLevel, logrus.FatalLevel:
+			err = h.writer.Crit(entry.Message)
+		case logrus.ErrorLevel:
+			err = h.writer.Err(entry.Message)
+		case logrus.WarnLevel:
+			err = h.writer.Warning(entry.Message)
+		default:
+			err = h.writer.Info(entry.Message)
+		}
+
+		if err != nil {
+			logrus.Debugf("failed to send audit log to syslog: %v", err)
+		}
+	}
+}
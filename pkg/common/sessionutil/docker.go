@@ -17,8 +17,11 @@ package sessionutil
 import dockerClient "github.com/docker/docker/client"
 
 // CreateDockerClient Creates a Docker client based on the given socket endpoint and docker api version.
-func CreateDockerClient(endpoint string, apiVersion string) (*dockerClient.Client, error) {
-	cli, err := dockerClient.NewClientWithOpts(dockerClient.WithHost(endpoint), dockerClient.WithVersion(apiVersion))
+// The extra options are applied after the endpoint and the version.
+func CreateDockerClient(endpoint string, apiVersion string, opts ...dockerClient.Opt) (*dockerClient.Client, error) {
+	opts = append([]dockerClient.Opt{dockerClient.WithHost(endpoint), dockerClient.WithVersion(apiVersion)}, opts...)
+
+	cli, err := dockerClient.NewClientWithOpts(opts...)
 	if err != nil {
 		return nil, err
 	}
@@ -17,37 +17,168 @@ package sessionutil
 import (
 	"net"
 	"os"
+	"path"
+	"sort"
+	"strconv"
 	"strings"
 )
 
+// MainIPConfig specifies how to choose the main IP of the host.
+type MainIPConfig struct {
+	// AdvertiseAddress overrides the main IP if it's not empty, the port is ignored if any.
+	AdvertiseAddress string
+
+	// InterfacePriority lists the patterns (as in path.Match, e.g. "bond*") of the interface names in descending
+	// priority, the main IP is chosen from the interface with the highest priority.
+	InterfacePriority []string
+}
+
+var mainIPConfig MainIPConfig
+
+// virtualInterfaces are the name patterns of virtual interfaces created by container runtimes and CNI plugins,
+// they have the lowest priority when choosing the main IP.
+var virtualInterfaces = []string{"docker*", "br-*", "veth*", "cni*", "flannel*", "cali*", "vxlan*", "tunl*", "kube-ipvs*", "virbr*"}
+
+// interfaceAddr is an IP address and the name of the interface it belongs to.
+type interfaceAddr struct {
+	name string
+	ip   net.IP
+}
+
+// SetMainIPConfig sets the configuration used by GetMainIP.
+func SetMainIPConfig(config MainIPConfig) {
+	mainIPConfig = config
+}
+
 // GetIPAddrs gets the ip addresses of the host.
+// Loopback and link-local addresses are excluded, and IPv4 addresses come before IPv6 ones.
 func GetIPAddrs() ([]string, error) {
 	ret := make([]string, 0)
 
-	adds, err := net.InterfaceAddrs()
+	addrs, err := getInterfaceAddrs()
 	if err != nil {
 		return ret, err
 	}
 
-	for _, a := range adds {
-		if aspnet, ok := a.(*net.IPNet); ok && !aspnet.IP.IsLoopback() {
-			if aspnet.IP.To4() != nil {
-				ret = append(ret, aspnet.IP.String())
+	sortInterfaceAddrs(addrs, nil)
+
+	for _, addr := range addrs {
+		ret = append(ret, addr.ip.String())
+	}
+
+	return ret, nil
+}
+
+// getInterfaceAddrs gets the ip addresses of the interfaces which are up,
+// loopback and link-local addresses are excluded.
+func getInterfaceAddrs() ([]interfaceAddr, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+
+	var ret []interfaceAddr
+
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 {
+			continue
+		}
+
+		adds, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+
+		for _, a := range adds {
+			aspnet, ok := a.(*net.IPNet)
+			if !ok || aspnet.IP.IsLoopback() || aspnet.IP.IsLinkLocalUnicast() || !aspnet.IP.IsGlobalUnicast() {
+				continue
 			}
+
+			ret = append(ret, interfaceAddr{name: iface.Name, ip: aspnet.IP})
 		}
 	}
 
 	return ret, nil
 }
 
-// FindNonPrivateIP retrieves an IP address that is not in the 192.168 subnet from a given list of IP addresses.
+// sortInterfaceAddrs sorts the addresses by the priority of their interfaces, IPv4 addresses come first
+// for the interfaces with the same priority.
+func sortInterfaceAddrs(addrs []interfaceAddr, priority []string) {
+	sort.SliceStable(addrs, func(i, j int) bool {
+		ri, rj := interfaceRank(addrs[i].name, priority), interfaceRank(addrs[j].name, priority)
+		if ri != rj {
+			return ri < rj
+		}
+
+		return addrs[i].ip.To4() != nil && addrs[j].ip.To4() == nil
+	})
+}
+
+// interfaceRank returns the rank of the interface, the smaller the higher priority.
+func interfaceRank(name string, priority []string) int {
+	for i, pattern := range priority {
+		if ok, _ := path.Match(pattern, name); ok {
+			return i
+		}
+	}
+
+	for _, pattern := range virtualInterfaces {
+		if ok, _ := path.Match(pattern, name); ok {
+			return len(priority) + 1
+		}
+	}
+
+	return len(priority)
+}
+
+// IsPrivateIP reports whether the IP is a private address,
+// i.e. in the RFC 1918, RFC 4193 (unique local) or RFC 6598 (shared address space) ranges.
+func IsPrivateIP(ip net.IP) bool {
+	if ip.IsPrivate() {
+		return true
+	}
+
+	// 100.64.0.0/10.
+	if ip4 := ip.To4(); ip4 != nil && ip4[0] == 100 && ip4[1]&0xc0 == 64 {
+		return true
+	}
+
+	return false
+}
+
+// TrimHostBrackets removes the brackets around an IPv6 literal, e.g. "[::1]" becomes "::1",
+// so that the host can be passed to net.JoinHostPort.
+func TrimHostBrackets(host string) string {
+	if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+		return host[1 : len(host)-1]
+	}
+
+	return host
+}
+
+// SplitHostPort splits an address like "1.2.3.4:5006" or "[::1]:5006" into host and port,
+// the port is zero if the address has no port.
+func SplitHostPort(addr string) (string, int) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return TrimHostBrackets(addr), 0
+	}
+
+	port, _ := strconv.Atoi(portStr)
+
+	return host, port
+}
+
+// FindNonPrivateIP retrieves the first IP address which isn't private from the given IP addresses,
+// the first IP address is returned if all of them are private.
 func FindNonPrivateIP(ipAdds []string) string {
 	if len(ipAdds) == 0 {
 		return ""
 	}
 
 	for _, ip := range ipAdds {
-		if !strings.Contains(ip, "192.168") {
+		if parsed := net.ParseIP(ip); parsed != nil && !IsPrivateIP(parsed) {
 			return ip
 		}
 	}
@@ -55,19 +186,41 @@ func FindNonPrivateIP(ipAdds []string) string {
 	return ipAdds[0]
 }
 
+// GetMainIP gets the IP address representing the host, e.g. in audit logs.
+// The advertise address is used if it's configured, otherwise the IP address is chosen from the interface
+// with the highest priority, and non-private addresses are preferred.
 func GetMainIP() string {
-	var primaryIP string
+	if mainIPConfig.AdvertiseAddress != "" {
+		host, _ := SplitHostPort(mainIPConfig.AdvertiseAddress)
 
-	ipAdds, err := GetIPAddrs()
-	if err != nil {
+		return host
+	}
+
+	addrs, err := getInterfaceAddrs()
+	if err != nil || len(addrs) == 0 {
 		return ""
 	}
 
-	if len(ipAdds) > 0 {
-		primaryIP = FindNonPrivateIP(ipAdds)
+	return chooseMainIP(addrs, mainIPConfig.InterfacePriority)
+}
+
+// chooseMainIP chooses the main IP from the addresses of the interface with the highest priority.
+func chooseMainIP(addrs []interfaceAddr, priority []string) string {
+	sortInterfaceAddrs(addrs, priority)
+
+	topRank := interfaceRank(addrs[0].name, priority)
+
+	var ipAdds []string
+
+	for _, addr := range addrs {
+		if interfaceRank(addr.name, priority) != topRank {
+			break
+		}
+
+		ipAdds = append(ipAdds, addr.ip.String())
 	}
 
-	return primaryIP
+	return FindNonPrivateIP(ipAdds)
 }
 
 // GetHostName gets the hostname of the host.
@@ -0,0 +1,88 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sessionutil
+
+import (
+	"net"
+	"testing"
+)
+
+func TestSplitHostPort(t *testing.T) {
+	tests := []struct {
+		addr string
+		host string
+		port int
+	}{
+		{"10.0.0.1:5006", "10.0.0.1", 5006},
+		{"[2001:db8::1]:5006", "2001:db8::1", 5006},
+		{"[fe80::1%eth0]:5006", "fe80::1%eth0", 5006},
+		{"10.0.0.1", "10.0.0.1", 0},
+		{"[2001:db8::1]", "2001:db8::1", 0},
+		{"2001:db8::1", "2001:db8::1", 0},
+	}
+
+	for _, test := range tests {
+		host, port := SplitHostPort(test.addr)
+		if host != test.host || port != test.port {
+			t.Errorf("SplitHostPort(%s) = %s, %d, expected %s, %d", test.addr, host, port, test.host, test.port)
+		}
+	}
+}
+
+func TestFindNonPrivateIP(t *testing.T) {
+	tests := []struct {
+		ipAdds   []string
+		expected string
+	}{
+		{[]string{"192.168.1.2", "10.0.0.1", "47.100.192.168"}, "47.100.192.168"},
+		{[]string{"172.16.0.1", "11.192.168.1"}, "11.192.168.1"},
+		{[]string{"10.0.0.1", "172.31.0.1", "100.64.0.1", "fd00::1", "2001:db8::1"}, "2001:db8::1"},
+		{[]string{"10.0.0.1", "192.168.1.2"}, "10.0.0.1"},
+		{nil, ""},
+	}
+
+	for _, test := range tests {
+		if ip := FindNonPrivateIP(test.ipAdds); ip != test.expected {
+			t.Errorf("FindNonPrivateIP(%v) = %s, expected %s", test.ipAdds, ip, test.expected)
+		}
+	}
+}
+
+func TestChooseMainIP(t *testing.T) {
+	newAddrs := func() []interfaceAddr {
+		return []interfaceAddr{
+			{name: "docker0", ip: net.ParseIP("172.17.0.1")},
+			{name: "eth1", ip: net.ParseIP("2001:db8::1")},
+			{name: "eth0", ip: net.ParseIP("10.0.0.1")},
+			{name: "bond0", ip: net.ParseIP("11.0.0.1")},
+		}
+	}
+
+	tests := []struct {
+		priority []string
+		expected string
+	}{
+		{nil, "11.0.0.1"},
+		{[]string{"eth*"}, "2001:db8::1"},
+		{[]string{"eth0", "bond*"}, "10.0.0.1"},
+		{[]string{"docker0"}, "172.17.0.1"},
+	}
+
+	for _, test := range tests {
+		if ip := chooseMainIP(newAddrs(), test.priority); ip != test.expected {
+			t.Errorf("chooseMainIP with priority %v = %s, expected %s", test.priority, ip, test.expected)
+		}
+	}
+}
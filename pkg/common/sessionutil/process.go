@@ -16,7 +16,6 @@ package sessionutil
 
 import (
 	"bufio"
-	"bytes"
 	"fmt"
 	"io"
 	"os"
@@ -27,10 +26,7 @@ import (
 	"time"
 )
 
-const (
-	bufferSize                  = 4096
-	expectedPasswdSegmentsCount = 7
-)
+const expectedPasswdSegmentsCount = 7
 
 type Process struct {
 	PID          int
@@ -284,21 +280,3 @@ func GetLoginDirAndIDs(username string, passwdPath string, rootfsPrefix string)
 
 	return uidInt, gidInt, rootfsPrefix + loginDir, nil
 }
-
-// OneRead reads data once from the provided Reader and returns a new Reader that can read the already read data.
-// If there is no data to read or an error occurs, it returns an error.
-func OneRead(origin io.Reader) (io.Reader, error) {
-	var (
-		buf    = make([]byte, bufferSize)
-		reader io.Reader
-	)
-
-	n, err := origin.Read(buf)
-	if n > 0 {
-		reader = bytes.NewReader(buf[:n])
-
-		return reader, nil
-	}
-
-	return nil, err
-}
@@ -0,0 +1,107 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sessionutil
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// IDMapping is a range of IDs mapped from a user namespace to its parent, as in /proc/[pid]/uid_map.
+type IDMapping struct {
+	ContainerID uint32
+	HostID      uint32
+	Size        uint32
+}
+
+// IDMap is the ID mappings of a user namespace.
+type IDMap []IDMapping
+
+// ReadIDMaps reads the uid and gid mappings of the user namespace of the process.
+func ReadIDMaps(pid int) (IDMap, IDMap, error) {
+	uidMap, err := readIDMap(fmt.Sprintf("/proc/%d/uid_map", pid))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	gidMap, err := readIDMap(fmt.Sprintf("/proc/%d/gid_map", pid))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return uidMap, gidMap, nil
+}
+
+func readIDMap(path string) (IDMap, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return ParseIDMap(f)
+}
+
+// ParseIDMap parses the ID mappings in the format of /proc/[pid]/uid_map.
+func ParseIDMap(r io.Reader) (IDMap, error) {
+	var idMap IDMap
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("invalid ID mapping: %q", scanner.Text())
+		}
+
+		var ids [3]uint32
+
+		for i, field := range fields {
+			id, err := strconv.ParseUint(field, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid ID mapping: %q", scanner.Text())
+			}
+
+			ids[i] = uint32(id)
+		}
+
+		idMap = append(idMap, IDMapping{ContainerID: ids[0], HostID: ids[1], Size: ids[2]})
+	}
+
+	return idMap, scanner.Err()
+}
+
+// Remapped returns whether the IDs are remapped, i.e. the user namespace isn't the initial one.
+func (m IDMap) Remapped() bool {
+	return len(m) != 1 || m[0].ContainerID != 0 || m[0].HostID != 0 || m[0].Size != 1<<32-1
+}
+
+// ToHost translates the ID in the user namespace to the one in the parent, and returns whether it's mapped.
+func (m IDMap) ToHost(id uint32) (uint32, bool) {
+	for _, mapping := range m {
+		if id >= mapping.ContainerID && id-mapping.ContainerID < mapping.Size {
+			return mapping.HostID + id - mapping.ContainerID, true
+		}
+	}
+
+	return 0, false
+}
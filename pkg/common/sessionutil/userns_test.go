@@ -0,0 +1,54 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sessionutil
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestIDMap(t *testing.T) {
+	identity, err := ParseIDMap(strings.NewReader("         0          0 4294967295\n"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if identity.Remapped() {
+		t.Error("identity map is regarded as remapped")
+	}
+
+	// The mappings of dockerd with userns-remap.
+	remapped, err := ParseIDMap(strings.NewReader("0 100000 65536\n65536 300000 10\n"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if !remapped.Remapped() {
+		t.Error("remapped map is regarded as identity")
+	}
+
+	for id, expected := range map[uint32]int64{0: 100000, 1000: 101000, 65535: 165535, 65536: 300000, 65546: -1} {
+		hostID, ok := remapped.ToHost(id)
+		if (expected < 0 && ok) || (expected >= 0 && (!ok || int64(hostID) != expected)) {
+			t.Errorf("got host ID %d (mapped %v) for %d, want %d", hostID, ok, id, expected)
+		}
+	}
+
+	for _, invalid := range []string{"0 100000\n", "0 -1 10\n", "a b c\n"} {
+		if _, err := ParseIDMap(strings.NewReader(invalid)); err == nil {
+			t.Errorf("expected error parsing %q", invalid)
+		}
+	}
+}
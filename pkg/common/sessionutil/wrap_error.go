@@ -47,6 +47,11 @@ func WrapContainerError(errMsg string, containerID string) string {
 // errMsg: The original error message.
 // Returns: An error message prefixed with an error code.
 func WrapErrorWithCode(errMsg string) string {
+	return fmt.Sprintf("code=%s,msg=%s", ErrorCode(errMsg), errMsg)
+}
+
+// ErrorCode returns the error code of an error message based on its content, "MA_-1" if it's unknown.
+func ErrorCode(errMsg string) string {
 	var code string
 
 	switch {
@@ -62,7 +67,7 @@ func WrapErrorWithCode(errMsg string) string {
 		code = "MA_522"
 	case strings.Contains(errMsg, "container is not running"):
 		code = "MA_523"
-	case strings.Contains(errMsg, "docker daemon is unavailable"):
+	case strings.Contains(errMsg, "daemon is unavailable"):
 		code = "MA_524"
 	case strings.Contains(errMsg, "is not permitted to login on host"):
 		code = "MA_525"
@@ -78,9 +83,33 @@ func WrapErrorWithCode(errMsg string) string {
 		code = "MA_530"
 	case strings.Contains(errMsg, "SSH connect error"):
 		code = "MA_531"
+	case strings.Contains(errMsg, "sidecar image signature verification failed"):
+		code = "MA_532"
+	case strings.Contains(errMsg, "jump to target agent failed"):
+		code = "MA_533"
+	case strings.Contains(errMsg, "user namespace remapping error"):
+		code = "MA_534"
+	case strings.Contains(errMsg, "security label error"):
+		code = "MA_535"
+	case strings.Contains(errMsg, "MFA verification failed"):
+		code = "MA_536"
+	case strings.Contains(errMsg, "sidecar num of the container exceed the limit"):
+		code = "MA_537"
+	case strings.Contains(errMsg, "container is paused"):
+		code = "MA_538"
+	case strings.Contains(errMsg, "read command frame error"):
+		code = "MA_539"
+	case strings.Contains(errMsg, "command not confirmed"):
+		code = "MA_540"
+	case strings.Contains(errMsg, "containerd shim is unresponsive"):
+		code = "MA_541"
+	case strings.Contains(errMsg, "session recording error"):
+		code = "MA_542"
+	case strings.Contains(errMsg, "dual control error"):
+		code = "MA_543"
 	default:
 		code = "MA_-1"
 	}
 
-	return fmt.Sprintf("code=%s,msg=%s", code, errMsg)
+	return code
 }
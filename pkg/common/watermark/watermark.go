@@ -0,0 +1,165 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package watermark hides the user and the session ID in terminal output with zero-width characters,
+// so that leaked pastes of sensitive sessions can be traced back.
+package watermark
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"time"
+)
+
+// The zero-width characters of watermarks. A watermark is the bits of its payload between two word joiners.
+const (
+	// zero is the zero width space.
+	zero = "\u200b"
+	// one is the zero width non-joiner.
+	one = "\u200c"
+	// delimiter is the word joiner.
+	delimiter = "\u2060"
+
+	// separator separates the user and the session ID in the payload.
+	separator = 0x1f
+)
+
+// Mark is the information carried by a watermark.
+type Mark struct {
+	User      string `json:"user"`
+	SessionID string `json:"session_id"`
+}
+
+// Encode returns the watermark of the mark.
+func Encode(m Mark) []byte {
+	payload := m.User + string(rune(separator)) + m.SessionID
+
+	var b bytes.Buffer
+
+	b.WriteString(delimiter)
+
+	for i := 0; i < len(payload); i++ {
+		for bit := 7; bit >= 0; bit-- {
+			if payload[i]>>bit&1 == 1 {
+				b.WriteString(one)
+			} else {
+				b.WriteString(zero)
+			}
+		}
+	}
+
+	b.WriteString(delimiter)
+
+	return b.Bytes()
+}
+
+// Decode returns the marks of the watermarks found in the text, in order. The other characters are ignored,
+// so the watermarks can be decoded from pastes with the visible text around them.
+func Decode(text []byte) []Mark {
+	var marks []Mark
+
+	for _, part := range strings.Split(string(text), delimiter) {
+		if m, ok := decodePayload(part); ok {
+			marks = append(marks, m)
+		}
+	}
+
+	return marks
+}
+
+// decodePayload decodes the bits between two delimiters, it isn't a watermark if anything else is there.
+func decodePayload(bits string) (Mark, bool) {
+	var (
+		payload []byte
+		cur     byte
+		n       int
+	)
+
+	for len(bits) > 0 {
+		switch {
+		case strings.HasPrefix(bits, zero):
+			cur <<= 1
+			bits = bits[len(zero):]
+		case strings.HasPrefix(bits, one):
+			cur = cur<<1 | 1
+			bits = bits[len(one):]
+		default:
+			return Mark{}, false
+		}
+
+		if n++; n%8 == 0 {
+			payload = append(payload, cur)
+			cur = 0
+		}
+	}
+
+	if n == 0 || n%8 != 0 {
+		return Mark{}, false
+	}
+
+	user, sessionID, ok := strings.Cut(string(payload), string(rune(separator)))
+	if !ok {
+		return Mark{}, false
+	}
+
+	return Mark{User: user, SessionID: sessionID}, true
+}
+
+// Writer inserts the watermark into the output once per interval. It's inserted after a line feed,
+// so that neither characters nor escape sequences are split by it.
+type Writer struct {
+	w        io.Writer
+	mark     []byte
+	interval time.Duration
+	next     time.Time
+}
+
+// NewWriter returns a writer inserting the watermark of the mark into the output written to w.
+// The first line of the output is watermarked, then a line once per interval.
+func NewWriter(w io.Writer, m Mark, interval time.Duration) *Writer {
+	return &Writer{w: w, mark: Encode(m), interval: interval}
+}
+
+// Reset sets the writer the output is written to, the interval is kept.
+func (wm *Writer) Reset(w io.Writer) {
+	wm.w = w
+}
+
+// Write writes p to the underlying writer, with the watermark inserted if it's due.
+func (wm *Writer) Write(p []byte) (int, error) {
+	now := time.Now()
+
+	i := -1
+	if !now.Before(wm.next) {
+		i = bytes.IndexByte(p, '\n')
+	}
+
+	if i < 0 {
+		return wm.w.Write(p)
+	}
+
+	marked := make([]byte, 0, len(p)+len(wm.mark))
+	marked = append(marked, p[:i+1]...)
+	marked = append(marked, wm.mark...)
+	marked = append(marked, p[i+1:]...)
+
+	if _, err := wm.w.Write(marked); err != nil {
+		return 0, err
+	}
+
+	wm.next = now.Add(wm.interval)
+
+	return len(p), nil
+}
@@ -0,0 +1,54 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package watermark
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDecode(t *testing.T) {
+	m := Mark{User: "alice", SessionID: "20261017011210"}
+
+	text := append([]byte("$ cat secret\n"), Encode(m)...)
+	text = append(text, []byte("token\u200b\u2060 not a mark \u2060")...)
+	text = append(text, Encode(Mark{User: "bob"})...)
+
+	marks := Decode(text)
+	if !reflect.DeepEqual(marks, []Mark{m, {User: "bob"}}) {
+		t.Errorf("got marks %+v", marks)
+	}
+}
+
+func TestWriter(t *testing.T) {
+	var out bytes.Buffer
+
+	m := Mark{User: "alice", SessionID: "1"}
+	w := NewWriter(&out, m, time.Hour)
+
+	for _, p := range []string{"no line feed", " a\nb\n", "c\n"} {
+		if n, err := w.Write([]byte(p)); n != len(p) || err != nil {
+			t.Fatalf("unexpected write result %d %v", n, err)
+		}
+	}
+
+	// Only the first line is watermarked within the interval.
+	expected := "no line feed a\n" + string(Encode(m)) + "b\nc\n"
+	if out.String() != expected {
+		t.Errorf("got output %q, want %q", out.String(), expected)
+	}
+}
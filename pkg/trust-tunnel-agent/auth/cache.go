@@ -0,0 +1,216 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+	"trust-tunnel/pkg/trust-tunnel-agent/backend/request"
+	"trust-tunnel/pkg/trust-tunnel-agent/monitor"
+
+	client "trust-tunnel/pkg/trust-tunnel-client"
+)
+
+// defaultCacheMaxEntries is the default maximum number of cached decisions.
+const defaultCacheMaxEntries = 10000
+
+// CacheConfig specifies caching the decisions of the auth handler, keyed by the user, the target and the login.
+// Handlers deciding on other fields of the requests, e.g. the command, shouldn't enable it.
+type CacheConfig struct {
+	// TTL is how long the approvals are cached, the decisions aren't cached if it's zero.
+	TTL time.Duration `toml:"ttl"`
+	// NegativeTTL is how long the denials are cached, they aren't cached if it's zero.
+	NegativeTTL time.Duration `toml:"negative_ttl"`
+	// MaxEntries is the maximum number of cached decisions, defaults to 10000.
+	MaxEntries int `toml:"max_entries"`
+}
+
+// cacheKey identifies the decisions of the same user, target, login, verb scope and access.
+type cacheKey struct {
+	user       string
+	loginName  string
+	loginGroup string
+	targetType client.TargetType
+	ipAddress  string
+	pod        string
+	container  string
+	jumpTarget string
+	// verbScope tells the verbs apart from the shells, which are authorized separately.
+	verbScope string
+	// access tells the kinds of the requests apart, along with the paths, the ports and the sessions they access,
+	// so that e.g. the approval to observe a session isn't reused for a shell.
+	access string
+}
+
+type cacheEntry struct {
+	resp    Response
+	expires time.Time
+}
+
+// CachingHandler caches the decisions of the wrapped handler. Only approvals and denials are cached, errors and
+// the approvals requiring MFA, whose challenges mustn't be replayed, always go to the wrapped handler.
+type CachingHandler struct {
+	handler Handler
+	config  CacheConfig
+
+	lock    sync.Mutex
+	entries map[cacheKey]cacheEntry
+	// now returns the current time, it's replaced in tests.
+	now func() time.Time
+}
+
+// NewCachingHandler wraps the handler with the decision cache.
+func NewCachingHandler(handler Handler, config CacheConfig) *CachingHandler {
+	if config.MaxEntries <= 0 {
+		config.MaxEntries = defaultCacheMaxEntries
+	}
+
+	return &CachingHandler{
+		handler: handler,
+		config:  config,
+		entries: make(map[cacheKey]cacheEntry),
+		now:     time.Now,
+	}
+}
+
+// VerifyAccessPermission returns the cached decision of the request if it hasn't expired, otherwise asks the
+// wrapped handler and caches its decision.
+func (c *CachingHandler) VerifyAccessPermission(req *request.Info) Response {
+	key := newCacheKey(req)
+
+	c.lock.Lock()
+	entry, ok := c.entries[key]
+	if ok && c.now().Before(entry.expires) {
+		c.lock.Unlock()
+		monitor.MetricsAuthCache.WithLabelValues("hit").Inc()
+
+		return entry.resp
+	}
+	c.lock.Unlock()
+	monitor.MetricsAuthCache.WithLabelValues("miss").Inc()
+
+	resp := c.handler.VerifyAccessPermission(req)
+
+	var ttl time.Duration
+
+	switch {
+	case resp.Code == Success && resp.MFA == nil:
+		ttl = c.config.TTL
+	case resp.Code == Forbidden:
+		ttl = c.config.NegativeTTL
+	}
+
+	if ttl > 0 {
+		c.lock.Lock()
+		c.put(key, cacheEntry{resp: resp, expires: c.now().Add(ttl)})
+		c.lock.Unlock()
+	}
+
+	return resp
+}
+
+// VerifyMFA verifies the assertion with the wrapped handler.
+func (c *CachingHandler) VerifyMFA(req *request.Info, challenge *client.MFAChallenge, assertion string) error {
+	verifier, ok := c.handler.(MFAVerifier)
+	if !ok {
+		return fmt.Errorf("auth handler doesn't verify MFA")
+	}
+
+	return verifier.VerifyMFA(req, challenge, assertion)
+}
+
+// Invalidate drops the cached decisions of the user, or all of them if the user is empty.
+// It returns the number of the dropped decisions.
+func (c *CachingHandler) Invalidate(user string) int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	n := 0
+
+	for key := range c.entries {
+		if user == "" || key.user == user {
+			delete(c.entries, key)
+			n++
+		}
+	}
+
+	return n
+}
+
+// put caches the entry, making room by dropping the expired entries, or arbitrary ones if none has expired.
+// It must be called with the lock held.
+func (c *CachingHandler) put(key cacheKey, entry cacheEntry) {
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= c.config.MaxEntries {
+		now := c.now()
+
+		for k, e := range c.entries {
+			if !now.Before(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+
+		for k := range c.entries {
+			if len(c.entries) < c.config.MaxEntries {
+				break
+			}
+
+			delete(c.entries, k)
+		}
+	}
+
+	c.entries[key] = entry
+}
+
+func newCacheKey(req *request.Info) cacheKey {
+	return cacheKey{
+		user:       req.UserName,
+		loginName:  req.LoginName,
+		loginGroup: req.LoginGroup,
+		targetType: req.TargetType,
+		ipAddress:  req.IPAddress,
+		pod:        req.PodName,
+		container:  req.ContainerID + "/" + req.ContainerName,
+		jumpTarget: req.JumpTarget,
+		verbScope:  req.VerbScope,
+		access:     accessOf(req),
+	}
+}
+
+// accessOf returns the kind of the request with what it accesses, the commands run aren't told apart though.
+func accessOf(req *request.Info) string {
+	switch {
+	case req.Observe:
+		return "observe " + req.SessionID
+	case req.Logs != nil:
+		return "logs"
+	case req.File != nil:
+		return fmt.Sprintf("file %s %s", req.File.Verb, req.File.Path)
+	case req.Copy != nil:
+		return fmt.Sprintf("copy %s %s", req.Copy.Direction, req.Copy.Path)
+	case req.Forward != nil && req.Forward.Reverse:
+		return fmt.Sprintf("reverse %d", req.Forward.Port)
+	case req.Forward != nil:
+		return fmt.Sprintf("forward %s", net.JoinHostPort(req.Forward.Host, strconv.Itoa(req.Forward.Port)))
+	case req.Top:
+		return "top"
+	case req.Verb != nil:
+		return fmt.Sprintf("verb %s %q", req.Verb.Name, req.Verb.Args)
+	default:
+		return "exec"
+	}
+}
@@ -0,0 +1,112 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"testing"
+	"time"
+	"trust-tunnel/pkg/trust-tunnel-agent/backend/request"
+
+	client "trust-tunnel/pkg/trust-tunnel-client"
+)
+
+// countingHandler approves alice, denies the others, and requires MFA on the host "mfa".
+type countingHandler struct {
+	calls int
+}
+
+func (h *countingHandler) VerifyAccessPermission(req *request.Info) Response {
+	h.calls++
+
+	switch {
+	case req.IPAddress == "mfa":
+		return Response{Code: Success, MFA: &client.MFAChallenge{Type: "totp"}}
+	case req.UserName == "alice":
+		return Response{Code: Success}
+	default:
+		return Response{Code: Forbidden}
+	}
+}
+
+func TestCachingHandler(t *testing.T) {
+	inner := &countingHandler{}
+	cache := NewCachingHandler(inner, CacheConfig{TTL: time.Minute, NegativeTTL: time.Second})
+
+	now := time.Now()
+	cache.now = func() time.Time { return now }
+
+	verify := func(user, ip string, expectedCode Code, expectedCalls int) {
+		t.Helper()
+
+		resp := cache.VerifyAccessPermission(&request.Info{UserName: user, LoginName: "root", IPAddress: ip})
+		if resp.Code != expectedCode || inner.calls != expectedCalls {
+			t.Fatalf("%s@%s: expected code %d after %d calls, got %d after %d calls", user, ip, expectedCode, expectedCalls, resp.Code, inner.calls)
+		}
+	}
+
+	verify("alice", "ip1", Success, 1)
+	verify("alice", "ip1", Success, 1)
+	verify("alice", "ip2", Success, 2)
+	verify("bob", "ip1", Forbidden, 3)
+	verify("bob", "ip1", Forbidden, 3)
+
+	// The challenges aren't replayed.
+	verify("alice", "mfa", Success, 4)
+	verify("alice", "mfa", Success, 5)
+
+	// The denials expire earlier than the approvals.
+	now = now.Add(2 * time.Second)
+
+	verify("bob", "ip1", Forbidden, 6)
+	verify("alice", "ip1", Success, 6)
+
+	if n := cache.Invalidate("alice"); n != 2 {
+		t.Fatalf("expected 2 decisions of alice invalidated, got %d", n)
+	}
+
+	verify("alice", "ip1", Success, 7)
+	verify("bob", "ip1", Forbidden, 7)
+
+	// The verbs are cached apart from the shells of the same target.
+	cache.VerifyAccessPermission(&request.Info{UserName: "alice", LoginName: "root", IPAddress: "ip1", VerbScope: "verb:ps"})
+	if inner.calls != 8 {
+		t.Fatalf("expected the verb authorized apart from the shell, got %d calls", inner.calls)
+	}
+
+	// So are the other kinds of requests, and the paths, the ports and the sessions they access.
+	for i, req := range []*request.Info{
+		{Observe: true, SessionID: "db-fix"},
+		{Observe: true, SessionID: "other"},
+		{File: &client.FileRequest{Verb: client.FileVerbCat, Path: "/etc/resolv.conf"}},
+		{File: &client.FileRequest{Verb: client.FileVerbCat, Path: "/etc/shadow"}},
+		{Copy: &client.CopyRequest{Direction: client.CopyFromTarget, Path: "/etc/shadow"}},
+		{Copy: &client.CopyRequest{Direction: client.CopyToTarget, Path: "/etc/shadow"}},
+		{Forward: &client.ForwardRequest{Port: 5432}},
+		{Forward: &client.ForwardRequest{Port: 5432, Reverse: true}},
+		{Forward: &client.ForwardRequest{Host: "db", Port: 5432}},
+		{Logs: &client.LogsOptions{}},
+		{Top: true},
+	} {
+		req.UserName, req.LoginName, req.IPAddress = "alice", "root", "ip1"
+		cache.VerifyAccessPermission(req)
+
+		if inner.calls != 9+i {
+			t.Fatalf("expected %+v authorized apart from the others, got %d calls", req, inner.calls)
+		}
+	}
+
+	// The shell is still cached apart from them.
+	verify("alice", "ip1", Success, 19)
+}
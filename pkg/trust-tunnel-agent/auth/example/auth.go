@@ -17,25 +17,68 @@ package example
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
 	"net/http"
+	"strconv"
+	"time"
 	"trust-tunnel/pkg/trust-tunnel-agent/auth"
 	"trust-tunnel/pkg/trust-tunnel-agent/backend/request"
+	"trust-tunnel/pkg/trust-tunnel-agent/monitor"
+
+	"github.com/sirupsen/logrus"
+	client "trust-tunnel/pkg/trust-tunnel-client"
+)
+
+const (
+	defaultTimeout          = 5 * time.Second
+	defaultRetries          = 2
+	defaultBreakerThreshold = 5
+	defaultBreakerCooldown  = 30 * time.Second
+
+	// retryBackoff is the backoff before the first retry, it grows linearly with the retries.
+	retryBackoff = 200 * time.Millisecond
+
+	// FailOpen approves the requests while the auth server is unavailable, FailClosed responds Unavailable.
+	FailOpen   = "open"
+	FailClosed = "closed"
 )
 
 func init() {
 	auth.RegisterAuthHandlerFactory("example", func(config auth.HandlerConfig) auth.Handler {
 		configMaps := config.(map[string]string)
 
+		failurePolicy := configMaps["failure_policy"]
+		if failurePolicy != FailOpen {
+			if failurePolicy != "" && failurePolicy != FailClosed {
+				logrus.Warnf("invalid failure_policy %q of the example auth handler, fail closed", failurePolicy)
+			}
+
+			failurePolicy = FailClosed
+		}
+
 		return &AuthHandler{
-			AuthURL: configMaps["auth_url"],
-			Client:  &http.Client{},
+			AuthURL:       configMaps["auth_url"],
+			MFAURL:        configMaps["mfa_url"],
+			Client:        &http.Client{Timeout: durationParam(configMaps, "timeout", defaultTimeout)},
+			Retries:       intParam(configMaps, "retries", defaultRetries),
+			FailurePolicy: failurePolicy,
+			breaker: newBreaker(intParam(configMaps, "breaker_threshold", defaultBreakerThreshold),
+				durationParam(configMaps, "breaker_cooldown", defaultBreakerCooldown)),
 		}
 	})
 }
 
 type AuthHandler struct {
 	AuthURL string
-	Client  *http.Client
+	// MFAURL is the URL verifying the assertions of MFA challenges issued by the authentication server.
+	MFAURL string
+	Client *http.Client
+	// Retries is the number of retries after the authentication server fails or is unreachable.
+	Retries int
+	// FailurePolicy is FailOpen or FailClosed, deciding the requests while the authentication server is unavailable.
+	FailurePolicy string
+	// breaker short circuits the requests while the authentication server keeps failing, it's disabled if nil.
+	breaker *breaker
 }
 
 func (handler *AuthHandler) VerifyAccessPermission(req *request.Info) auth.Response {
@@ -48,16 +91,12 @@ func (handler *AuthHandler) VerifyAccessPermission(req *request.Info) auth.Respo
 	}
 
 	// Post the payload to the authentication server.
-	resp, err := http.Post(handler.AuthURL, "application/json", bytes.NewBuffer(payloadBytes))
+	resp, err := handler.post(payloadBytes)
 	if err != nil {
-		return auth.Response{
-			Code:   auth.InternalServerErr,
-			ErrMsg: err.Error(),
-		}
+		return handler.unavailable(req, err)
 	}
 	defer resp.Body.Close()
 
-	// Check the response from the authentication server.
 	if resp.StatusCode != http.StatusOK {
 		return auth.Response{
 			Code:   auth.InternalServerErr,
@@ -67,7 +106,10 @@ func (handler *AuthHandler) VerifyAccessPermission(req *request.Info) auth.Respo
 
 	// Parse the response from the authentication server.
 	var authResponse struct {
-		Code auth.Code `json:"code"`
+		Code        auth.Code            `json:"code"`
+		Reason      string               `json:"reason"`
+		Sensitivity string               `json:"sensitivity"`
+		MFA         *client.MFAChallenge `json:"mfa"`
 	}
 
 	err = json.NewDecoder(resp.Body).Decode(&authResponse)
@@ -82,11 +124,146 @@ func (handler *AuthHandler) VerifyAccessPermission(req *request.Info) auth.Respo
 		return auth.Response{
 			Code:   auth.Forbidden,
 			ErrMsg: "",
+			Reason: authResponse.Reason,
+		}
+	}
+
+	if authResponse.MFA != nil && handler.MFAURL == "" {
+		return auth.Response{
+			Code:   auth.InternalServerErr,
+			ErrMsg: "MFA is required, but mfa_url isn't configured",
 		}
 	}
 
 	return auth.Response{
-		Code:   auth.Success,
-		ErrMsg: "",
+		Code:        auth.Success,
+		ErrMsg:      "",
+		Sensitivity: authResponse.Sensitivity,
+		MFA:         authResponse.MFA,
 	}
 }
+
+// post posts the payload to the authentication server, retrying if it fails with a 5xx status or is unreachable.
+// It fails without posting while the circuit breaker is open.
+func (handler *AuthHandler) post(payload []byte) (*http.Response, error) {
+	if !handler.breaker.allow() {
+		monitor.MetricsAuthRequest.WithLabelValues("short_circuit").Inc()
+
+		return nil, fmt.Errorf("circuit breaker of the auth server is open")
+	}
+
+	var (
+		resp *http.Response
+		err  error
+	)
+
+	for attempt := 0; ; attempt++ {
+		resp, err = handler.Client.Post(handler.AuthURL, "application/json", bytes.NewReader(payload))
+		if err == nil && resp.StatusCode >= http.StatusInternalServerError {
+			resp.Body.Close()
+			err = fmt.Errorf("auth server responded with status %d", resp.StatusCode)
+		}
+
+		if err == nil || attempt >= handler.Retries {
+			break
+		}
+
+		monitor.MetricsAuthRequest.WithLabelValues("retry").Inc()
+		time.Sleep(retryBackoff * time.Duration(attempt+1))
+	}
+
+	handler.breaker.record(err == nil)
+
+	if err != nil {
+		monitor.MetricsAuthRequest.WithLabelValues("error").Inc()
+
+		return nil, err
+	}
+
+	monitor.MetricsAuthRequest.WithLabelValues("ok").Inc()
+
+	return resp, nil
+}
+
+// unavailable decides the request by the failure policy while the authentication server is unavailable.
+func (handler *AuthHandler) unavailable(req *request.Info, err error) auth.Response {
+	if handler.FailurePolicy == FailOpen {
+		logrus.Warnf("auth server is unavailable, fail open for %s: %v", req.UserName, err)
+
+		return auth.Response{
+			Code:   auth.Success,
+			ErrMsg: err.Error(),
+		}
+	}
+
+	return auth.Response{
+		Code:   auth.Unavailable,
+		ErrMsg: err.Error(),
+	}
+}
+
+// VerifyMFA posts the assertion to the MFA URL, which verifies it against the challenge issued for the request.
+func (handler *AuthHandler) VerifyMFA(req *request.Info, challenge *client.MFAChallenge, assertion string) error {
+	payloadBytes, err := json.Marshal(map[string]interface{}{
+		"request":   req,
+		"challenge": challenge,
+		"assertion": assertion,
+	})
+	if err != nil {
+		return err
+	}
+
+	resp, err := handler.Client.Post(handler.MFAURL, "application/json", bytes.NewBuffer(payloadBytes))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var mfaResponse struct {
+		Code auth.Code `json:"code"`
+	}
+
+	if resp.StatusCode != http.StatusOK || json.NewDecoder(resp.Body).Decode(&mfaResponse) != nil {
+		return fmt.Errorf("visit MFA server failed with status %d", resp.StatusCode)
+	}
+
+	if mfaResponse.Code != auth.Success {
+		return fmt.Errorf("assertion is rejected")
+	}
+
+	return nil
+}
+
+// intParam returns the integer param, or the default value if it's absent or invalid.
+func intParam(params map[string]string, name string, defaultValue int) int {
+	v, ok := params[name]
+	if !ok {
+		return defaultValue
+	}
+
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		logrus.Warnf("invalid %s %q of the example auth handler, use %d", name, v, defaultValue)
+
+		return defaultValue
+	}
+
+	return n
+}
+
+// durationParam returns the duration param, e.g. "5s", or the default value if it's absent or invalid.
+func durationParam(params map[string]string, name string, defaultValue time.Duration) time.Duration {
+	v, ok := params[name]
+	if !ok {
+		return defaultValue
+	}
+
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		logrus.Warnf("invalid %s %q of the example auth handler, use %s", name, v, defaultValue)
+
+		return defaultValue
+	}
+
+	return d
+}
@@ -20,6 +20,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 	"trust-tunnel/pkg/trust-tunnel-agent/auth"
 	"trust-tunnel/pkg/trust-tunnel-agent/backend/request"
 	client "trust-tunnel/pkg/trust-tunnel-client"
@@ -108,3 +109,58 @@ func TestVerifyAccessPermission(t *testing.T) {
 		})
 	}
 }
+
+func TestUnavailable(t *testing.T) {
+	var calls, failures int
+
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls <= failures {
+			w.WriteHeader(http.StatusServiceUnavailable)
+
+			return
+		}
+
+		w.Write([]byte(`{"code": 200}`))
+	}))
+	defer mockServer.Close()
+
+	authHandler := &AuthHandler{
+		AuthURL: mockServer.URL,
+		Client:  mockServer.Client(),
+		Retries: 1,
+		breaker: newBreaker(2, time.Minute),
+	}
+	now := time.Now()
+	authHandler.breaker.now = func() time.Time { return now }
+
+	verify := func(expectedCode auth.Code, expectedCalls int) {
+		t.Helper()
+
+		resp := authHandler.VerifyAccessPermission(&request.Info{UserName: "alice"})
+		if resp.Code != expectedCode || calls != expectedCalls {
+			t.Fatalf("expected code %d after %d calls, got %d after %d calls", expectedCode, expectedCalls, resp.Code, calls)
+		}
+	}
+
+	// The failure is retried.
+	failures = 1
+	verify(auth.Success, 2)
+
+	// The breaker opens after two failed requests, and short circuits the requests.
+	failures = 100
+	verify(auth.Unavailable, 4)
+	verify(auth.Unavailable, 6)
+	verify(auth.Unavailable, 6)
+
+	authHandler.FailurePolicy = FailOpen
+	verify(auth.Success, 6)
+
+	// The breaker closes once the probe after the cooldown succeeds.
+	authHandler.FailurePolicy = FailClosed
+	failures = 0
+	now = now.Add(time.Minute)
+
+	verify(auth.Success, 7)
+	verify(auth.Success, 8)
+}
@@ -0,0 +1,93 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package example
+
+import (
+	"sync"
+	"time"
+	"trust-tunnel/pkg/trust-tunnel-agent/monitor"
+)
+
+// breaker is the circuit breaker of the auth server. It opens after threshold consecutive failures and short
+// circuits the requests for the cooldown, then lets one request through to probe whether the server recovers.
+type breaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	lock     sync.Mutex
+	failures int
+	// openUntil is when the cooldown of the open breaker ends, zero if the breaker is closed.
+	openUntil time.Time
+	// probing is whether a request probing the server is in flight after the cooldown.
+	probing bool
+	// now returns the current time, it's replaced in tests.
+	now func() time.Time
+}
+
+func newBreaker(threshold int, cooldown time.Duration) *breaker {
+	return &breaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+		now:       time.Now,
+	}
+}
+
+// allow returns whether the request may be sent to the auth server.
+func (b *breaker) allow() bool {
+	if b == nil {
+		return true
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.openUntil.IsZero() {
+		return true
+	}
+
+	if b.probing || b.now().Before(b.openUntil) {
+		return false
+	}
+
+	b.probing = true
+
+	return true
+}
+
+// record records the result of the request allowed by allow.
+func (b *breaker) record(ok bool) {
+	if b == nil {
+		return
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.probing = false
+
+	if ok {
+		b.failures = 0
+		b.openUntil = time.Time{}
+		monitor.MetricsAuthCircuitOpen.Set(0)
+
+		return
+	}
+
+	b.failures++
+	if b.failures >= b.threshold {
+		b.openUntil = b.now().Add(b.cooldown)
+		monitor.MetricsAuthCircuitOpen.Set(1)
+	}
+}
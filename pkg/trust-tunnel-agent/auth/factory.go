@@ -24,6 +24,44 @@ import (
 type Config struct {
 	Name   string            `toml:"name"`
 	Params map[string]string `toml:"params"`
+	// BreakGlass specifies the emergency access while the auth handler is unavailable.
+	BreakGlass BreakGlassConfig `toml:"break_glass"`
+	// Cache specifies caching the decisions of the auth handler.
+	Cache CacheConfig `toml:"cache"`
+	// BindUserToCert requires the user of the requests to be the common name of the verified client certificate,
+	// for the certificates issued per user. The certificates issued by the enrollment server are always bound.
+	BindUserToCert bool `toml:"bind_user_to_cert"`
+	// CertProxies are the common names of the client certificates of the jump agents, whose requests carry the users
+	// of their clients, so that they're not bound.
+	CertProxies []string `toml:"cert_proxies"`
+}
+
+// BreakGlassConfig lets sessions be established without the auth handler when it responds Unavailable,
+// so that incidents can still be handled during outages of the auth server. Such sessions are audited
+// and alerted.
+type BreakGlassConfig struct {
+	Enabled bool `toml:"enabled"`
+	// Users are the users allowed to break the glass, it's required. Nobody is allowed if it's empty.
+	Users []string `toml:"users"`
+	// AlertURL is the webhook the alerts of the break-glass sessions are posted to, it's required.
+	AlertURL string `toml:"alert_url"`
+	// Banner is shown at the beginning of the break-glass sessions, a default one is shown if it's empty.
+	Banner string `toml:"banner"`
+}
+
+// Allows returns whether the user is allowed to break the glass.
+func (c *BreakGlassConfig) Allows(user string) bool {
+	if !c.Enabled {
+		return false
+	}
+
+	for _, u := range c.Users {
+		if u == user {
+			return true
+		}
+	}
+
+	return false
 }
 
 // HandlerConfig is an interface that defines the configuration for an auth handler.
@@ -46,14 +84,27 @@ func RegisterAuthHandlerFactory(name string, factoryFunc func(config HandlerConf
 	authHandlerFactories[name] = factoryFunc
 }
 
+// HasAuthHandlerFactory returns whether an auth handler factory is registered with the given name.
+func HasAuthHandlerFactory(name string) bool {
+	_, exists := authHandlerFactories[name]
+
+	return exists
+}
+
 // CreateAuthHandlerFromConfig creates an auth handler instance based on the provided configuration.
 // cfg is a Config instance that contains the auth handler's name and parameters.
 // It returns a Handler instance, or an error if the corresponding auth handler cannot be found.
+// The handler is wrapped with a CachingHandler if the cache is enabled.
 func CreateAuthHandlerFromConfig(cfg Config) (Handler, error) {
 	factoryFunc, exists := authHandlerFactories[cfg.Name]
 	if !exists {
 		return nil, fmt.Errorf("authorization handler not found: %s", cfg.Name)
 	}
 
-	return factoryFunc(cfg.Params), nil
+	handler := factoryFunc(cfg.Params)
+	if cfg.Cache.TTL > 0 || cfg.Cache.NegativeTTL > 0 {
+		return NewCachingHandler(handler, cfg.Cache), nil
+	}
+
+	return handler, nil
 }
@@ -14,7 +14,12 @@
 
 package auth
 
-import "trust-tunnel/pkg/trust-tunnel-agent/backend/request"
+import (
+	"fmt"
+	"trust-tunnel/pkg/trust-tunnel-agent/backend/request"
+
+	client "trust-tunnel/pkg/trust-tunnel-client"
+)
 
 type Code int
 
@@ -23,11 +28,42 @@ const (
 	Forbidden         Code = 403
 	Success           Code = 200
 	BadRequest        Code = 400
+	// Unavailable means the permission can't be verified for the auth server is unreachable.
+	Unavailable Code = 503
 )
 
 type Response struct {
 	Code   Code   `json:"code"`
 	ErrMsg string `json:"err_msg"`
+	// Reason is the machine-readable reason of the denial, e.g. "not_member", audited and counted in the metrics.
+	// The reason is derived from the code if it's empty.
+	Reason string `json:"reason,omitempty"`
+	// Sensitivity is the sensitivity level of the target, e.g. "high", which decides whether the output of
+	// the session is watermarked. It may be empty.
+	Sensitivity string `json:"sensitivity,omitempty"`
+	// MFA is the challenge of the second factor the user must answer before the session is established,
+	// nil if it isn't required. The handler must implement MFAVerifier to require it.
+	MFA *client.MFAChallenge `json:"mfa,omitempty"`
+}
+
+// DenialReason returns the reason of the denial.
+func (r *Response) DenialReason() string {
+	if r.Reason != "" {
+		return r.Reason
+	}
+
+	switch r.Code {
+	case Forbidden:
+		return "forbidden"
+	case Unavailable:
+		return "auth_unavailable"
+	case BadRequest:
+		return "bad_request"
+	case InternalServerErr:
+		return "auth_error"
+	default:
+		return fmt.Sprintf("code_%d", r.Code)
+	}
 }
 
 // Handler defines common methods of auth handler.
@@ -36,3 +72,10 @@ type Handler interface {
 	// req: the permission details to check for the user.
 	VerifyAccessPermission(req *request.Info) Response
 }
+
+// MFAVerifier is implemented by the auth handlers requiring a second factor, e.g. a TOTP code or a WebAuthn
+// assertion, after approving the requests.
+type MFAVerifier interface {
+	// VerifyMFA verifies the assertion of the user to the challenge returned in the response of the request.
+	VerifyMFA(req *request.Info, challenge *client.MFAChallenge, assertion string) error
+}
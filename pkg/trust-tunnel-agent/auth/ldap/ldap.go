@@ -0,0 +1,276 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package ldap implements the auth handler verifying the group membership of the users in LDAP or Active Directory.
+package ldap
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"trust-tunnel/pkg/trust-tunnel-agent/auth"
+	"trust-tunnel/pkg/trust-tunnel-agent/backend/request"
+	"trust-tunnel/pkg/trust-tunnel-client/fips"
+
+	ldapv3 "github.com/go-ldap/ldap/v3"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultUserFilter     = "(uid=%s)"
+	defaultGroupAttribute = "memberOf"
+	defaultCacheTTL       = 5 * time.Minute
+	defaultTimeout        = 5 * time.Second
+)
+
+func init() {
+	auth.RegisterAuthHandlerFactory("ldap", func(config auth.HandlerConfig) auth.Handler {
+		handler, err := NewAuthHandler(config.(map[string]string))
+		if err != nil {
+			logrus.Fatalf("Failed to create ldap auth handler: %v", err)
+		}
+
+		return handler
+	})
+}
+
+// AuthHandler approves the requests of the users who are members of the groups required by the first rule
+// matching the target and the login.
+type AuthHandler struct {
+	// URL is the URL of the LDAP server, e.g. ldaps://ad.example.com:636.
+	URL string
+	// StartTLS is whether to upgrade the ldap:// connections with StartTLS.
+	StartTLS  bool
+	TLSConfig *tls.Config
+	// BindDN and BindPassword are the credential of the service account searching the users.
+	BindDN       string
+	BindPassword string
+	// BaseDN is the base to search the users from.
+	BaseDN string
+	// UserFilter is the filter searching the user, %s is replaced with the escaped user name.
+	UserFilter string
+	// GroupAttribute is the attribute of the user listing the DNs of its groups.
+	GroupAttribute string
+	Timeout        time.Duration
+	// CacheTTL is how long the groups of the users are cached.
+	CacheTTL time.Duration
+	Rules    []Rule
+
+	lock  sync.Mutex
+	cache map[string]cachedGroups
+	// lookup returns the group DNs of the user, nil if the user doesn't exist. It's replaced in tests.
+	lookup func(user string) ([]string, error)
+	// now returns the current time, it's replaced in tests.
+	now func() time.Time
+}
+
+type cachedGroups struct {
+	groups  []string
+	expires time.Time
+}
+
+// NewAuthHandler creates the handler with the params:
+//   - url: the URL of the LDAP server, required.
+//   - bind_dn and bind_password, or bind_password_file: the credential of the service account.
+//   - base_dn: the base to search the users from, required.
+//   - user_filter: defaults to "(uid=%s)", use "(sAMAccountName=%s)" for Active Directory.
+//   - group_attribute: defaults to "memberOf".
+//   - rules_file: the TOML file of the rules, required.
+//   - start_tls, tls_ca and tls_insecure_skip_verify: the TLS configuration.
+//   - timeout and cache_ttl: default to 5s and 5m.
+func NewAuthHandler(params map[string]string) (*AuthHandler, error) {
+	handler := &AuthHandler{
+		URL:            params["url"],
+		StartTLS:       params["start_tls"] == "true",
+		BindDN:         params["bind_dn"],
+		BindPassword:   params["bind_password"],
+		BaseDN:         params["base_dn"],
+		UserFilter:     params["user_filter"],
+		GroupAttribute: params["group_attribute"],
+		Timeout:        defaultTimeout,
+		CacheTTL:       defaultCacheTTL,
+	}
+
+	if handler.URL == "" || handler.BaseDN == "" {
+		return nil, fmt.Errorf("url and base_dn are required")
+	}
+
+	if handler.UserFilter == "" {
+		handler.UserFilter = defaultUserFilter
+	}
+
+	if handler.GroupAttribute == "" {
+		handler.GroupAttribute = defaultGroupAttribute
+	}
+
+	if file := params["bind_password_file"]; file != "" {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("read bind_password_file error: %v", err)
+		}
+
+		handler.BindPassword = strings.TrimSpace(string(b))
+	}
+
+	for name, d := range map[string]*time.Duration{"timeout": &handler.Timeout, "cache_ttl": &handler.CacheTTL} {
+		if v := params[name]; v != "" {
+			var err error
+			if *d, err = time.ParseDuration(v); err != nil {
+				return nil, fmt.Errorf("invalid %s: %v", name, err)
+			}
+		}
+	}
+
+	handler.TLSConfig = &tls.Config{InsecureSkipVerify: params["tls_insecure_skip_verify"] == "true"}
+	fips.Apply(handler.TLSConfig)
+
+	if ca := params["tls_ca"]; ca != "" {
+		pem, err := os.ReadFile(ca)
+		if err != nil {
+			return nil, fmt.Errorf("read tls_ca error: %v", err)
+		}
+
+		handler.TLSConfig.RootCAs = x509.NewCertPool()
+		if !handler.TLSConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in tls_ca %s", ca)
+		}
+	}
+
+	if params["rules_file"] == "" {
+		return nil, fmt.Errorf("rules_file is required")
+	}
+
+	rules, err := LoadRules(params["rules_file"])
+	if err != nil {
+		return nil, err
+	}
+
+	handler.Rules = rules
+
+	return handler, nil
+}
+
+// VerifyAccessPermission approves the request if the user is a member of any group required by the first rule
+// matching the request. Requests matching no rules are denied.
+func (handler *AuthHandler) VerifyAccessPermission(req *request.Info) auth.Response {
+	rule := matchRule(handler.Rules, req)
+	if rule == nil {
+		return auth.Response{
+			Code:   auth.Forbidden,
+			ErrMsg: "no rule matches the target",
+			Reason: "no_rule",
+		}
+	}
+
+	groups, err := handler.groups(req.UserName)
+	if err != nil {
+		return auth.Response{
+			Code:   auth.Unavailable,
+			ErrMsg: err.Error(),
+		}
+	}
+
+	if !rule.allows(groups) {
+		return auth.Response{
+			Code:   auth.Forbidden,
+			ErrMsg: fmt.Sprintf("%s isn't a member of the required groups", req.UserName),
+			Reason: "not_member",
+		}
+	}
+
+	return auth.Response{
+		Code:        auth.Success,
+		Sensitivity: rule.Sensitivity,
+	}
+}
+
+// groups returns the cached groups of the user, or looks them up if they have expired.
+func (handler *AuthHandler) groups(user string) ([]string, error) {
+	now := time.Now
+	if handler.now != nil {
+		now = handler.now
+	}
+
+	handler.lock.Lock()
+	cached, ok := handler.cache[user]
+	handler.lock.Unlock()
+
+	if ok && now().Before(cached.expires) {
+		return cached.groups, nil
+	}
+
+	lookup := handler.lookup
+	if lookup == nil {
+		lookup = handler.lookupGroups
+	}
+
+	groups, err := lookup(user)
+	if err != nil {
+		return nil, err
+	}
+
+	handler.lock.Lock()
+	if handler.cache == nil {
+		handler.cache = make(map[string]cachedGroups)
+	}
+	handler.cache[user] = cachedGroups{groups: groups, expires: now().Add(handler.CacheTTL)}
+	handler.lock.Unlock()
+
+	return groups, nil
+}
+
+// lookupGroups searches the user in the LDAP server and returns the DNs of its groups.
+func (handler *AuthHandler) lookupGroups(user string) ([]string, error) {
+	conn, err := ldapv3.DialURL(handler.URL, ldapv3.DialWithDialer(&net.Dialer{Timeout: handler.Timeout}),
+		ldapv3.DialWithTLSConfig(handler.TLSConfig))
+	if err != nil {
+		return nil, fmt.Errorf("dial ldap server error: %v", err)
+	}
+	defer conn.Close()
+
+	conn.SetTimeout(handler.Timeout)
+
+	if handler.StartTLS {
+		if err = conn.StartTLS(handler.TLSConfig); err != nil {
+			return nil, fmt.Errorf("ldap StartTLS error: %v", err)
+		}
+	}
+
+	if handler.BindDN != "" {
+		if err = conn.Bind(handler.BindDN, handler.BindPassword); err != nil {
+			return nil, fmt.Errorf("ldap bind error: %v", err)
+		}
+	}
+
+	result, err := conn.Search(ldapv3.NewSearchRequest(handler.BaseDN, ldapv3.ScopeWholeSubtree, ldapv3.NeverDerefAliases,
+		2, int(handler.Timeout.Seconds()), false, strings.ReplaceAll(handler.UserFilter, "%s", ldapv3.EscapeFilter(user)),
+		[]string{handler.GroupAttribute}, nil))
+	if err != nil {
+		return nil, fmt.Errorf("ldap search error: %v", err)
+	}
+
+	switch len(result.Entries) {
+	case 0:
+		return nil, nil
+	case 1:
+		return result.Entries[0].GetAttributeValues(handler.GroupAttribute), nil
+	default:
+		return nil, fmt.Errorf("multiple ldap entries found for user %s", user)
+	}
+}
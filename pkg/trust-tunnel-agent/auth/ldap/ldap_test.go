@@ -0,0 +1,107 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ldap
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+	"trust-tunnel/pkg/trust-tunnel-agent/auth"
+	"trust-tunnel/pkg/trust-tunnel-agent/backend/request"
+
+	client "trust-tunnel/pkg/trust-tunnel-client"
+)
+
+const testRules = `
+[[rule]]
+target_type = "container"
+pods = ["payment-*"]
+groups = ["CN=Payment SRE,OU=Groups,DC=example,DC=com"]
+sensitivity = "high"
+
+[[rule]]
+logins = ["root"]
+groups = ["ops"]
+`
+
+func TestVerifyAccessPermission(t *testing.T) {
+	rulesFile := filepath.Join(t.TempDir(), "rules.toml")
+	if err := os.WriteFile(rulesFile, []byte(testRules), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	handler, err := NewAuthHandler(map[string]string{
+		"url":        "ldaps://127.0.0.1:636",
+		"base_dn":    "DC=example,DC=com",
+		"rules_file": rulesFile,
+	})
+	if err != nil {
+		t.Fatalf("create handler error: %v", err)
+	}
+
+	lookups := 0
+	handler.lookup = func(user string) ([]string, error) {
+		lookups++
+
+		switch user {
+		case "alice":
+			return []string{"cn=payment sre,ou=groups,dc=example,dc=com"}, nil
+		case "bob":
+			return []string{"CN=Ops,OU=Groups,DC=example,DC=com"}, nil
+		case "down":
+			return nil, errors.New("connection refused")
+		default:
+			return nil, nil
+		}
+	}
+
+	now := time.Now()
+	handler.now = func() time.Time { return now }
+
+	tests := []struct {
+		name        string
+		req         *request.Info
+		code        auth.Code
+		sensitivity string
+	}{
+		{"member of the DN", &request.Info{UserName: "alice", TargetType: client.TargetContainer, PodName: "payment-1"}, auth.Success, "high"},
+		{"not a member", &request.Info{UserName: "bob", TargetType: client.TargetContainer, PodName: "payment-1"}, auth.Forbidden, ""},
+		{"member of the CN", &request.Info{UserName: "bob", LoginName: "root"}, auth.Success, ""},
+		{"no rule", &request.Info{UserName: "bob", LoginName: "admin"}, auth.Forbidden, ""},
+		{"unknown user", &request.Info{UserName: "eve", LoginName: "root"}, auth.Forbidden, ""},
+		{"ldap down", &request.Info{UserName: "down", LoginName: "root"}, auth.Unavailable, ""},
+	}
+
+	for _, tc := range tests {
+		resp := handler.VerifyAccessPermission(tc.req)
+		if resp.Code != tc.code || resp.Sensitivity != tc.sensitivity {
+			t.Errorf("%s: expected %d %q, got %+v", tc.name, tc.code, tc.sensitivity, resp)
+		}
+	}
+
+	// The groups of alice, bob and eve are cached.
+	if lookups != 4 {
+		t.Fatalf("expected 4 lookups, got %d", lookups)
+	}
+
+	now = now.Add(defaultCacheTTL)
+	handler.VerifyAccessPermission(&request.Info{UserName: "bob", LoginName: "root"})
+
+	if lookups != 5 {
+		t.Fatalf("expected the expired groups looked up again, got %d lookups", lookups)
+	}
+}
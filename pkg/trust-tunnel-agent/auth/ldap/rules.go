@@ -0,0 +1,138 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ldap
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"trust-tunnel/pkg/trust-tunnel-agent/backend/request"
+
+	"github.com/BurntSushi/toml"
+	ldapv3 "github.com/go-ldap/ldap/v3"
+	client "trust-tunnel/pkg/trust-tunnel-client"
+)
+
+// Rule requires the groups of the users logging in to the matching targets. The empty fields match everything,
+// and the others are lists of glob patterns.
+type Rule struct {
+	// TargetType is "phys" or "container".
+	TargetType string   `toml:"target_type"`
+	Pods       []string `toml:"pods"`
+	// Containers match the names or the IDs of the containers.
+	Containers []string `toml:"containers"`
+	Logins     []string `toml:"logins"`
+	// Groups are the DNs or the CNs of the groups, the users must be a member of any of them.
+	Groups []string `toml:"groups"`
+	// Sensitivity is the sensitivity level of the matching targets.
+	Sensitivity string `toml:"sensitivity"`
+}
+
+// LoadRules loads the rules from the TOML file, in [[rule]] tables.
+func LoadRules(file string) ([]Rule, error) {
+	var rules struct {
+		Rule []Rule `toml:"rule"`
+	}
+
+	if _, err := toml.DecodeFile(file, &rules); err != nil {
+		return nil, fmt.Errorf("load rules error: %v", err)
+	}
+
+	for i, rule := range rules.Rule {
+		if rule.TargetType != "" && rule.TargetType != "phys" && rule.TargetType != "container" {
+			return nil, fmt.Errorf("invalid target_type %q of rule %d", rule.TargetType, i)
+		}
+
+		if len(rule.Groups) == 0 {
+			return nil, fmt.Errorf("groups of rule %d are required", i)
+		}
+	}
+
+	return rules.Rule, nil
+}
+
+// matchRule returns the first rule matching the request, nil if none matches.
+func matchRule(rules []Rule, req *request.Info) *Rule {
+	targetType := "phys"
+	if req.TargetType == client.TargetContainer {
+		targetType = "container"
+	}
+
+	for i := range rules {
+		rule := &rules[i]
+
+		if rule.TargetType != "" && rule.TargetType != targetType {
+			continue
+		}
+
+		if targetType == "container" && (!matchAny(rule.Pods, req.PodName) ||
+			!(matchAny(rule.Containers, req.ContainerName) || matchAny(rule.Containers, req.ContainerID))) {
+			continue
+		}
+
+		if matchAny(rule.Logins, req.LoginName) {
+			return rule
+		}
+	}
+
+	return nil
+}
+
+// matchAny returns whether the value matches any of the patterns, or the patterns are empty.
+func matchAny(patterns []string, value string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, value); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// allows returns whether any of the group DNs is required by the rule. The groups of the rule are compared
+// with the DNs, or with their CNs if they aren't DNs, case-insensitively.
+func (rule *Rule) allows(groupDNs []string) bool {
+	for _, dn := range groupDNs {
+		cn := commonName(dn)
+
+		for _, group := range rule.Groups {
+			if strings.EqualFold(group, dn) || (!strings.Contains(group, "=") && strings.EqualFold(group, cn)) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// commonName returns the CN of the first RDN of the DN, empty if it's not a CN.
+func commonName(dn string) string {
+	parsed, err := ldapv3.ParseDN(dn)
+	if err != nil || len(parsed.RDNs) == 0 {
+		return ""
+	}
+
+	for _, attr := range parsed.RDNs[0].Attributes {
+		if strings.EqualFold(attr.Type, "CN") {
+			return attr.Value
+		}
+	}
+
+	return ""
+}
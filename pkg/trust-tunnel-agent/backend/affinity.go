@@ -0,0 +1,179 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"trust-tunnel/pkg/common/sessionutil"
+	"trust-tunnel/pkg/trust-tunnel-agent/backend/request"
+)
+
+const (
+	headerSessionID     = "Session-Id"
+	headerAgentInstance = "Agent-Instance"
+	headerAffinityToken = "Affinity-Token"
+	headerCorrelationID = "Correlation-Id"
+)
+
+// affinity identifies the agent instance holding a session,
+// it's issued to the client as an opaque token so that a reattachment can be routed back to the instance.
+// The tokens are signed with the key, so that the agent never redirects the clients to the addresses they choose.
+type affinity struct {
+	// Instance is the ID of the agent instance.
+	Instance string `json:"instance"`
+
+	// Address is the address through which the agent instance can be reached directly.
+	Address string `json:"address,omitempty"`
+
+	// key signs the tokens, it's shared by the instances redirecting the reattachments to each other.
+	key []byte
+}
+
+// encode encodes the affinity into a token, "<payload>.<signature>".
+func (a *affinity) encode() string {
+	b, _ := json.Marshal(a)
+	payload := base64.RawURLEncoding.EncodeToString(b)
+
+	return payload + "." + base64.RawURLEncoding.EncodeToString(a.sign(payload))
+}
+
+// sign returns the HMAC-SHA256 of the payload with the key.
+func (a *affinity) sign(payload string) []byte {
+	mac := hmac.New(sha256.New, a.key)
+	mac.Write([]byte(payload))
+
+	return mac.Sum(nil)
+}
+
+// decode decodes the affinity from the token, which must be signed with the key of a.
+func (a *affinity) decode(token string) (*affinity, error) {
+	payload, signature, ok := strings.Cut(token, ".")
+	if !ok {
+		return nil, fmt.Errorf("invalid affinity token: no signature")
+	}
+
+	mac, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil || !hmac.Equal(mac, a.sign(payload)) {
+		return nil, fmt.Errorf("invalid affinity token: bad signature")
+	}
+
+	b, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, fmt.Errorf("invalid affinity token: %v", err)
+	}
+
+	var owner affinity
+	if err = json.Unmarshal(b, &owner); err != nil {
+		return nil, fmt.Errorf("invalid affinity token: %v", err)
+	}
+
+	if owner.Instance == "" {
+		return nil, fmt.Errorf("invalid affinity token: empty instance")
+	}
+
+	return &owner, nil
+}
+
+// newAffinity creates the affinity of this agent instance from the session configuration.
+// The instance ID defaults to the hostname and the address defaults to the main IP of the host.
+// The key is random if it isn't configured, so only the tokens issued by this instance are trusted.
+func newAffinity(c *SessionConfig) *affinity {
+	a := &affinity{
+		Instance: c.InstanceID,
+		Address:  c.AdvertiseAddress,
+		key:      []byte(c.AffinityKey),
+	}
+
+	if len(a.key) == 0 {
+		a.key = make([]byte, 32)
+		rand.Read(a.key)
+	}
+
+	if a.Address == "" {
+		a.Address = sessionutil.GetMainIP()
+	}
+
+	if a.Instance == "" {
+		name, err := sessionutil.GetHostName()
+		if err != nil || name == "" {
+			name = a.Address
+		}
+
+		a.Instance = name
+	}
+
+	return a
+}
+
+// InstanceID returns the ID of this agent instance.
+func (handler *Handler) InstanceID() string {
+	return handler.affinity.Instance
+}
+
+// redirectToOwner redirects the reattachment request to the agent instance holding the session,
+// if the affinity token in the request is issued by another instance.
+// Returns true if the request has been responded.
+func (handler *Handler) redirectToOwner(w http.ResponseWriter, r *http.Request, info *request.Info) bool {
+	if info.SessionID == "" || info.AffinityToken == "" {
+		return false
+	}
+
+	owner, err := handler.affinity.decode(info.AffinityToken)
+	if err != nil {
+		logger.Warnf("ignore affinity token of session %s: %v", info.SessionID, err)
+
+		return false
+	}
+
+	if owner.Instance == handler.affinity.Instance {
+		return false
+	}
+
+	w.Header().Set(headerAgentInstance, handler.affinity.Instance)
+
+	if owner.Address == "" {
+		logger.Warnf("session %s belongs to agent instance %s without address", info.SessionID, owner.Instance)
+		http.Error(w, fmt.Sprintf("session %s belongs to agent instance %s", info.SessionID, owner.Instance), http.StatusMisdirectedRequest)
+
+		return true
+	}
+
+	host := owner.Address
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		// Use the port which the client connects to if the owner doesn't advertise one.
+		if _, port, err := net.SplitHostPort(r.Host); err == nil {
+			host = net.JoinHostPort(sessionutil.TrimHostBrackets(owner.Address), port)
+		}
+	}
+
+	location := url.URL{Scheme: "http", Host: host, Path: r.URL.Path}
+	if r.TLS != nil {
+		location.Scheme = "https"
+	}
+
+	logger.Infof("redirect session %s to agent instance %s at %s", info.SessionID, owner.Instance, host)
+	http.Redirect(w, r, location.String(), http.StatusTemporaryRedirect)
+
+	return true
+}
@@ -0,0 +1,82 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"trust-tunnel/pkg/trust-tunnel-agent/backend/request"
+)
+
+func TestRedirectToOwner(t *testing.T) {
+	key := []byte("shared-key")
+	handler := &Handler{affinity: &affinity{Instance: "agent-a", Address: "10.0.0.1", key: key}}
+
+	tests := []struct {
+		name     string
+		owner    *affinity
+		code     int
+		location string
+	}{
+		{"own session", &affinity{Instance: "agent-a", Address: "10.0.0.1", key: key}, 0, ""},
+		{"owner without port", &affinity{Instance: "agent-b", Address: "10.0.0.2", key: key}, http.StatusTemporaryRedirect, "http://10.0.0.2:5006/exec"},
+		{"owner with port", &affinity{Instance: "agent-b", Address: "10.0.0.2:6006", key: key}, http.StatusTemporaryRedirect, "http://10.0.0.2:6006/exec"},
+		{"owner without address", &affinity{Instance: "agent-b", key: key}, http.StatusMisdirectedRequest, ""},
+		{"forged token", &affinity{Instance: "agent-b", Address: "evil.example.com", key: []byte("forged")}, 0, ""},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodGet, "http://lb.example.com:5006/exec", nil)
+		w := httptest.NewRecorder()
+		info := &request.Info{SessionID: "s1", AffinityToken: test.owner.encode()}
+
+		responded := handler.redirectToOwner(w, r, info)
+		if responded != (test.code != 0) {
+			t.Errorf("%s: unexpected responded %v", test.name, responded)
+
+			continue
+		}
+
+		if !responded {
+			continue
+		}
+
+		if w.Code != test.code {
+			t.Errorf("%s: unexpected status code %d", test.name, w.Code)
+		}
+
+		if location := w.Header().Get("Location"); location != test.location {
+			t.Errorf("%s: unexpected location %s", test.name, location)
+		}
+	}
+}
+
+func TestDecodeAffinityToken(t *testing.T) {
+	a := &affinity{Instance: "agent-a", key: []byte("shared-key")}
+
+	if owner, err := a.decode(a.encode()); err != nil || owner.Instance != "agent-a" {
+		t.Errorf("unexpected owner %v, error %v", owner, err)
+	}
+
+	// The unsigned tokens of the earlier releases aren't trusted, nor the signed ones without an instance.
+	null := &affinity{key: a.key}
+	for _, token := range []string{"", "not-base64!", "bnVsbA", "bnVsbA." + strings.Split(null.encode(), ".")[1]} {
+		if _, err := a.decode(token); err == nil {
+			t.Errorf("expected error for token %q", token)
+		}
+	}
+}
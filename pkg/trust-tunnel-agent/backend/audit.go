@@ -20,9 +20,14 @@ import (
 	"trust-tunnel/pkg/common/logutil"
 	"trust-tunnel/pkg/common/sessionutil"
 	"trust-tunnel/pkg/trust-tunnel-agent/backend/request"
+	"trust-tunnel/pkg/trust-tunnel-agent/monitor"
+	"trust-tunnel/pkg/trust-tunnel-agent/proctrack"
+	"trust-tunnel/pkg/trust-tunnel-agent/session"
+
+	client "trust-tunnel/pkg/trust-tunnel-client"
 )
 
-var auditLogger = logutil.GetLogger("trust-tunnel-audit")
+var auditLogger = logutil.GetAuditLogger("trust-tunnel-audit")
 
 // LogInfo records the login and operation information of a user.
 type LogInfo struct {
@@ -52,14 +57,195 @@ type LogInfo struct {
 
 	// SrcPort represents the source port of the session request.
 	SrcPort int `json:"src_port"`
+
+	// JumpTarget represents the target agent which the session is proxied to by this agent.
+	JumpTarget string `json:"jump_target,omitempty"`
+
+	// JumpVia represents the jump agent which proxies the session to this agent.
+	JumpVia string `json:"jump_via,omitempty"`
+
+	// BreakGlass represents whether the session is established by breaking the glass while the auth handler is down.
+	BreakGlass bool `json:"break_glass,omitempty"`
+
+	// Tenant represents the tenant the session belongs to.
+	Tenant string `json:"tenant,omitempty"`
+
+	// Recording represents the path of the asciicast recording of the session on the agent.
+	Recording string `json:"recording,omitempty"`
+
+	// DualControl represents whether the session is under dual control, run only while another user witnesses it.
+	DualControl bool `json:"dual_control,omitempty"`
+
+	// Witnesses represents the other users who have observed the session under dual control.
+	Witnesses []string `json:"witnesses,omitempty"`
+
+	// Logs represents the options of streaming the output of the main process of the container, it's set if the
+	// session streams the logs instead of running the command.
+	Logs *client.LogsOptions `json:"logs,omitempty"`
+
+	// File represents the file verb run by the agent, it's set if the session reads a file instead of running the
+	// command.
+	File *client.FileRequest `json:"file,omitempty"`
+
+	// Copy represents the copy of the files done by the agent, it's set if the session copies the files instead of
+	// running the command.
+	Copy *client.CopyRequest `json:"copy,omitempty"`
+
+	// Forward represents the port forward done by the agent, it's set if the session forwards the connections
+	// instead of running the command.
+	Forward *client.ForwardRequest `json:"forward,omitempty"`
+
+	// Top represents whether the session prints the snapshot of the target instead of running the command.
+	Top bool `json:"top,omitempty"`
+
+	// Verb represents the verb run natively by the agent, it's set if the session runs a verb instead of the command.
+	Verb *client.VerbRequest `json:"verb,omitempty"`
+
+	// VerbScope represents the auth scope the verb is authorized with.
+	VerbScope string `json:"verb_scope,omitempty"`
+
+	// Tags represents the key/value pairs tagging the session, e.g. the incident it's opened for.
+	Tags map[string]string `json:"tags,omitempty"`
+
+	// User represents the user requesting the session, it's set in the denial log.
+	User string `json:"user,omitempty"`
+
+	// Observer represents the user observing the session, it's set in the log of the observer attaching to the
+	// session.
+	Observer string `json:"observer,omitempty"`
+
+	// DenialReason represents why the request is denied, e.g. "forbidden", it's set in the denial log.
+	DenialReason string `json:"denial_reason,omitempty"`
+
+	// DenialMessage represents the message of the denial from the auth handler, it's set in the denial log.
+	DenialMessage string `json:"denial_message,omitempty"`
+
+	// AuthLatencyMs represents how long the auth handler took to decide in milliseconds, it's set in the denial log.
+	AuthLatencyMs int64 `json:"auth_latency_ms,omitempty"`
+
+	// LogoutTime represents the time when the session is terminated, it's set in the termination log.
+	LogoutTime string `json:"logout_time,omitempty"`
+
+	// ExecTime represents the time when the command is executed within the session, it's set in the exec log.
+	ExecTime string `json:"exec_time,omitempty"`
+
+	// Exe represents the path of the binary executed within the session, it's set in the exec log.
+	Exe string `json:"exe,omitempty"`
+
+	// PID represents the process executing the command within the session, it's set in the exec log.
+	PID int `json:"pid,omitempty"`
+
+	// ExecIncomplete represents whether the command executed within the session isn't fully known, e.g. the
+	// process exits before its command line is read, it's set in the exec log.
+	ExecIncomplete bool `json:"exec_incomplete,omitempty"`
+
+	// TerminationReason represents why the session is terminated, it's set in the termination log.
+	TerminationReason string `json:"termination_reason,omitempty"`
+
+	// Processes represents the processes spawned within the session, it's set in the termination log.
+	Processes []proctrack.Process `json:"processes,omitempty"`
+
+	// FileAccess represents the file read within the session, it's set in the termination log.
+	FileAccess *session.FileAccess `json:"file_access,omitempty"`
+
+	// CopyStats represents the files copied within the session, it's set in the termination log.
+	CopyStats *session.CopyStats `json:"copy_stats,omitempty"`
+
+	// ForwardStats represents the connections forwarded within the session, it's set in the termination log.
+	ForwardStats *session.ForwardStats `json:"forward_stats,omitempty"`
 }
 
 // constructAuditInfo generates the audit log of the specified struct.
-func constructAuditInfo(req *request.Info) {
+// remoteAddr is the network address of the client sending the request.
+func constructAuditInfo(req *request.Info, remoteAddr string) {
+	logInfo := newLogInfo(req, req.SessionID)
+	logInfo.SrcIP, logInfo.SrcPort = sessionutil.SplitHostPort(remoteAddr)
+
+	timeNow := time.Now().Format("2006.01.02 15:04:05")
+	logInfo.LoginTime = timeNow
+	logInfo.GmtCreate = timeNow
+	printLog(logInfo)
+}
+
+// auditObserve generates the audit log of an observer attaching to a live session.
+func auditObserve(req *request.Info, remoteAddr string) {
+	logInfo := newLogInfo(req, req.SessionID)
+	logInfo.SrcIP, logInfo.SrcPort = sessionutil.SplitHostPort(remoteAddr)
+	logInfo.Observer = req.UserName
+
+	timeNow := time.Now().Format("2006.01.02 15:04:05")
+	logInfo.LoginTime = timeNow
+	logInfo.GmtCreate = timeNow
+	printLog(logInfo)
+}
+
+// auditDenial generates the audit log of a denied request, and counts the denial by the reason.
+func auditDenial(req *request.Info, remoteAddr, reason, message string, authLatency time.Duration) {
+	monitor.MetricsAuthDenial.WithLabelValues(reason).Inc()
+
+	logInfo := newLogInfo(req, req.SessionID)
+	logInfo.SrcIP, logInfo.SrcPort = sessionutil.SplitHostPort(remoteAddr)
+	logInfo.User = req.UserName
+	logInfo.DenialReason = reason
+	logInfo.DenialMessage = message
+	logInfo.AuthLatencyMs = authLatency.Milliseconds()
+	logInfo.GmtCreate = time.Now().Format("2006.01.02 15:04:05")
+	printLog(logInfo)
+
+	notifyDenied(req, remoteAddr, reason, message)
+}
+
+// auditTermination generates the audit log of the termination of a session.
+func auditTermination(req *request.Info, sessID string, reason client.TerminationReason, processes []proctrack.Process,
+	fileAccess *session.FileAccess, copyStats *session.CopyStats, forwardStats *session.ForwardStats) {
+	logInfo := newLogInfo(req, sessID)
+	logInfo.TerminationReason = string(reason)
+	logInfo.Processes = processes
+	logInfo.FileAccess = fileAccess
+	logInfo.CopyStats = copyStats
+	logInfo.ForwardStats = forwardStats
+
+	timeNow := time.Now().Format("2006.01.02 15:04:05")
+	logInfo.LogoutTime = timeNow
+	logInfo.GmtCreate = timeNow
+	printLog(logInfo)
+}
+
+// auditExec generates the audit log of a command executed within a session.
+func auditExec(req *request.Info, sessID string, p proctrack.Process) {
+	logInfo := newLogInfo(req, sessID)
+	logInfo.Cmd = p.Cmd
+	logInfo.Exe = p.Exe
+	logInfo.PID = p.PID
+	logInfo.ExecIncomplete = p.Incomplete
+
+	timeNow := p.Time.Format("2006.01.02 15:04:05")
+	logInfo.ExecTime = timeNow
+	logInfo.GmtCreate = timeNow
+	printLog(logInfo)
+}
+
+// newLogInfo creates the audit log of the session with the fields from the request.
+func newLogInfo(req *request.Info, sessID string) LogInfo {
 	agentAddr := sessionutil.GetMainIP()
 	logInfo := LogInfo{
-		SessionID: req.SessionID,
-		UserName:  req.LoginName,
+		SessionID:   sessID,
+		UserName:    req.LoginName,
+		JumpTarget:  req.JumpTarget,
+		JumpVia:     req.JumpVia,
+		BreakGlass:  req.BreakGlass,
+		Tenant:      req.Tenant,
+		Recording:   req.Recording,
+		DualControl: req.DualControl,
+		Witnesses:   req.Witnesses,
+		Logs:        req.Logs,
+		File:        req.File,
+		Copy:        req.Copy,
+		Forward:     req.Forward,
+		Top:         req.Top,
+		Verb:        req.Verb,
+		VerbScope:   req.VerbScope,
+		Tags:        req.Tags,
 	}
 
 	if req.TargetType == 0 {
@@ -77,10 +263,8 @@ func constructAuditInfo(req *request.Info) {
 	}
 
 	logInfo.Cmd = command
-	timeNow := time.Now().Format("2006.01.02 15:04:05")
-	logInfo.LoginTime = timeNow
-	logInfo.GmtCreate = timeNow
-	printLog(logInfo)
+
+	return logInfo
 }
 
 // printLog prints the log in the format of json string.
@@ -91,5 +275,5 @@ func printLog(info LogInfo) {
 	}
 
 	s := string(b)
-	auditLogger.Info(s)
+	auditLoggerOf(info.Tenant).Info(s)
 }
@@ -0,0 +1,102 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+	"trust-tunnel/pkg/common/sessionutil"
+	"trust-tunnel/pkg/trust-tunnel-agent/backend/request"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// breakGlassAlertTimeout is the timeout of posting an alert to the webhook.
+	breakGlassAlertTimeout = 10 * time.Second
+
+	defaultBreakGlassBanner = "BREAK-GLASS SESSION: the auth server is unavailable, this session is established " +
+		"without authorization, every command is audited and the security team is alerted."
+)
+
+var breakGlassAlertClient = &http.Client{Timeout: breakGlassAlertTimeout}
+
+// BreakGlassAlert is posted to the alert webhook when a session is established by breaking the glass.
+type BreakGlassAlert struct {
+	Event     string        `json:"event"`
+	Time      time.Time     `json:"time"`
+	Agent     string        `json:"agent"`
+	SessionID string        `json:"session_id,omitempty"`
+	SrcIP     string        `json:"src_ip"`
+	Request   *request.Info `json:"request"`
+}
+
+// alertBreakGlass posts the alert of the break-glass session in background, the session isn't held up by the
+// webhook. The alert is logged as well in case the webhook is down too.
+func (handler *Handler) alertBreakGlass(req *request.Info, sessID, remoteAddr string) {
+	alert := &BreakGlassAlert{
+		Event:     "break_glass",
+		Time:      time.Now(),
+		Agent:     sessionutil.GetMainIP(),
+		SessionID: sessID,
+		Request:   req,
+	}
+	alert.SrcIP, _ = sessionutil.SplitHostPort(remoteAddr)
+
+	b, err := json.Marshal(alert)
+	if err != nil {
+		return
+	}
+
+	logger.Warnf("break-glass session: %s", b)
+
+	go func() {
+		resp, err := breakGlassAlertClient.Post(handler.config.AuthConfig.BreakGlass.AlertURL, "application/json", bytes.NewReader(b))
+		if err != nil {
+			logger.Errorf("post break-glass alert failed: %v", err)
+
+			return
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode/100 != 2 {
+			logger.Errorf("post break-glass alert failed with status %d", resp.StatusCode)
+		}
+	}()
+}
+
+// showBreakGlassBanner tells the user the session is established by breaking the glass. The banner goes to
+// the terminal of TTY sessions, or stderr otherwise to leave the output of the command intact.
+func (handler *Handler) showBreakGlassBanner(conn *websocket.Conn, tty bool) {
+	if err := writeNotice(conn, tty, handler.breakGlassBanner()); err != nil {
+		logger.Warnf("show break-glass banner failed: %v", err)
+	}
+}
+
+// breakGlassBanner returns the banner of the break-glass sessions.
+func (handler *Handler) breakGlassBanner() string {
+	banner := handler.config.AuthConfig.BreakGlass.Banner
+	if banner == "" {
+		banner = defaultBreakGlassBanner
+	}
+
+	line := strings.Repeat("*", 80)
+
+	return fmt.Sprintf("%s\n%s\n%s", line, banner, line)
+}
@@ -0,0 +1,61 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+	"trust-tunnel/pkg/trust-tunnel-agent/auth"
+	"trust-tunnel/pkg/trust-tunnel-agent/backend/request"
+)
+
+func TestBreakGlass(t *testing.T) {
+	conf := auth.BreakGlassConfig{Enabled: true, Users: []string{"alice"}}
+	if !conf.Allows("alice") || conf.Allows("bob") {
+		t.Fatalf("only alice should be allowed to break the glass")
+	}
+
+	if (&auth.BreakGlassConfig{Enabled: true}).Allows("alice") {
+		t.Fatalf("nobody should be allowed to break the glass without the users")
+	}
+
+	alerts := make(chan BreakGlassAlert, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var alert BreakGlassAlert
+		if err := json.NewDecoder(r.Body).Decode(&alert); err != nil {
+			t.Errorf("decode alert failed: %v", err)
+		}
+
+		alerts <- alert
+	}))
+	defer server.Close()
+
+	conf.AlertURL = server.URL
+	handler := &Handler{config: &Config{AuthConfig: auth.Config{BreakGlass: conf}}}
+	handler.alertBreakGlass(&request.Info{UserName: "alice", BreakGlass: true}, "20240101000000", "10.0.0.1:4321")
+
+	select {
+	case alert := <-alerts:
+		if alert.Event != "break_glass" || alert.SessionID != "20240101000000" || alert.SrcIP != "10.0.0.1" ||
+			alert.Request.UserName != "alice" || !alert.Request.BreakGlass {
+			t.Fatalf("unexpected alert: %+v", alert)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("alert isn't posted")
+	}
+}
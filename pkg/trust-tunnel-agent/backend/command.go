@@ -0,0 +1,144 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+	"trust-tunnel/pkg/common/sessionutil"
+	"trust-tunnel/pkg/trust-tunnel-agent/backend/request"
+	"trust-tunnel/pkg/trust-tunnel-client/protocol"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	defaultMaxCommandLength = 256 << 10
+	// commandFrameTimeout is how long the command frame is waited for after the upgrade.
+	commandFrameTimeout = 30 * time.Second
+
+	// errCommandFrame is the message prefix of the errors reading the command frame, it's mapped to an error code
+	// by sessionutil.WrapErrorWithCode.
+	errCommandFrame = "read command frame error"
+)
+
+// maxCommandLength returns the maximum length of the commands in bytes.
+func (c *SessionConfig) maxCommandLength() int {
+	if c.MaxCommandLength <= 0 {
+		return defaultMaxCommandLength
+	}
+
+	return c.MaxCommandLength
+}
+
+// checkCommandLength checks the total length of the arguments of the command against the limit.
+func (c *SessionConfig) checkCommandLength(cmd []string) error {
+	length := 0
+	for _, arg := range cmd {
+		length += len(arg)
+	}
+
+	if limit := c.maxCommandLength(); length > limit {
+		return fmt.Errorf("command of %d bytes exceeds the limit of %d bytes", length, limit)
+	}
+
+	return nil
+}
+
+// maxCommandFrame returns the maximum length of the command frames, which carry the arguments encoded in base64 with
+// the JSON punctuation.
+func (c *SessionConfig) maxCommandFrame() int {
+	return len(protocol.CommandPrefix) + c.maxCommandLength()*2 + 1024
+}
+
+// readCommand reads the command of the request from the command frame, the first frame after the upgrade.
+func (c *SessionConfig) readCommand(conn *websocket.Conn, info *request.Info) error {
+	conn.SetReadDeadline(time.Now().Add(commandFrameTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	messageType, r, err := conn.NextReader()
+	if err != nil {
+		return fmt.Errorf("%s: %v", errCommandFrame, err)
+	}
+
+	if messageType != websocket.TextMessage {
+		return fmt.Errorf("%s: not a text frame", errCommandFrame)
+	}
+
+	msg, err := io.ReadAll(io.LimitReader(r, int64(info.CommandFrame)+1))
+	if err != nil {
+		return fmt.Errorf("%s: %v", errCommandFrame, err)
+	}
+
+	if len(msg) > info.CommandFrame {
+		return fmt.Errorf("%s: frame exceeds the length of %d bytes", errCommandFrame, info.CommandFrame)
+	}
+
+	if info.Cmd, err = protocol.DecodeCommandFrame(msg); err != nil {
+		return fmt.Errorf("%s: %v", errCommandFrame, err)
+	}
+
+	info.UseBase64 = true
+
+	if err = c.checkCommandLength(info.Cmd); err != nil {
+		return fmt.Errorf("%s: %v", errCommandFrame, err)
+	}
+
+	return nil
+}
+
+// upgradeForCommand upgrades the connection to read the command from the command frame, the errors reading it are
+// told by the close frame. The response headers of the jump sessions are issued by the target agent in its reply.
+func (handler *Handler) upgradeForCommand(w http.ResponseWriter, r *http.Request, info *request.Info, responseHeader http.Header) (*websocket.Conn, error) {
+	if info.JumpTarget != "" {
+		responseHeader = http.Header{protocol.HeaderProtocolVersion: []string{strconv.Itoa(protocol.Version)}}
+	}
+
+	conn, err := handler.upgraderOf(info).Upgrade(w, r, responseHeader)
+	if err != nil {
+		return nil, fmt.Errorf("websocket upgrade error: %v", err)
+	}
+
+	if err = handler.config.SessionConfig.readCommand(conn, info); err != nil {
+		refuseUpgraded(conn, sessionutil.WrapErrorWithCode(err.Error()))
+		conn.Close()
+
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+// replyCommand replies the command frame with the response headers once the session is authorized.
+func replyCommand(conn *websocket.Conn, responseHeader http.Header) error {
+	return conn.WriteMessage(websocket.TextMessage, protocol.EncodeCommandReply(&protocol.CommandReply{
+		SessionID:     responseHeader.Get(headerSessionID),
+		AffinityToken: responseHeader.Get(headerAffinityToken),
+		MFA:           responseHeader.Get(protocol.HeaderMFA),
+	}))
+}
+
+// refuseUpgraded tells the client why the session is refused by the close frame, if the connection has been upgraded
+// to read the command frame.
+func refuseUpgraded(conn *websocket.Conn, errMsg string) {
+	if conn == nil {
+		return
+	}
+
+	conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseUnsupportedData, truncWebsocketErrMsg("Establish session error: "+errMsg)))
+}
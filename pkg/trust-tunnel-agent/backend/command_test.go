@@ -0,0 +1,80 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"trust-tunnel/pkg/trust-tunnel-agent/backend/request"
+	"trust-tunnel/pkg/trust-tunnel-client/protocol"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestReadCommand(t *testing.T) {
+	c := &SessionConfig{MaxCommandLength: 16}
+	cmds := make(chan []string, 1)
+	errs := make(chan error, 1)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		info := &request.Info{CommandFrame: 64}
+		errs <- c.readCommand(conn, info)
+		cmds <- info.Cmd
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		frame []byte
+		ok    bool
+	}{
+		{protocol.EncodeCommandFrame([]string{"sh", "-c", "uptime"}), true},
+		// The arguments exceed MaxCommandLength.
+		{protocol.EncodeCommandFrame([]string{"sh", "-c", "echo 0123456789"}), false},
+		// The frame exceeds the length in the header.
+		{protocol.EncodeCommandFrame([]string{strings.Repeat("a", 60)}), false},
+		{[]byte("resize: 24,80"), false},
+	}
+
+	for _, test := range tests {
+		conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		conn.WriteMessage(websocket.TextMessage, test.frame)
+
+		err = <-errs
+		cmd := <-cmds
+
+		if (err == nil) != test.ok {
+			t.Errorf("readCommand(%q) = %v, expected ok %v", test.frame, err, test.ok)
+		}
+
+		if want, _ := protocol.DecodeCommandFrame(test.frame); test.ok && !reflect.DeepEqual(cmd, want) {
+			t.Errorf("got command %q, want %q", cmd, want)
+		}
+
+		conn.Close()
+	}
+}
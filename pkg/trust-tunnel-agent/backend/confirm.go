@@ -0,0 +1,88 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package backend
+
+import (
+	"fmt"
+	"time"
+	agentSession "trust-tunnel/pkg/trust-tunnel-agent/session"
+	"trust-tunnel/pkg/trust-tunnel-client/protocol"
+
+	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// confirmTimeout is the time for the user to confirm the resolved command.
+	confirmTimeout = 2 * time.Minute
+
+	// errNotConfirmed is the message prefix of the errors confirming the command, it's mapped to an error code
+	// by sessionutil.WrapErrorWithCode.
+	errNotConfirmed = "command not confirmed"
+)
+
+// confirmHook returns the hook of the session config echoing the command resolved by the session to the client,
+// which runs it only once the client confirms it.
+func confirmHook(requestLogger *logrus.Entry, conn *websocket.Conn, sessConf *agentSession.Config) func([]string, string) error {
+	return func(cmd []string, dir string) error {
+		err := confirmCommand(conn, &protocol.Confirmation{Cmd: cmd, User: sessConf.LoginName, Dir: dir, Target: sessConf.ContainerID})
+		if err != nil {
+			return err
+		}
+
+		requestLogger.Infof("command confirmed: %q in %s", cmd, dir)
+
+		return nil
+	}
+}
+
+// confirmCommand sends the confirmation to the client, and waits for the client to confirm it.
+func confirmCommand(conn *websocket.Conn, confirmation *protocol.Confirmation) error {
+	if err := conn.WriteMessage(websocket.TextMessage, protocol.EncodeConfirmation(confirmation)); err != nil {
+		return fmt.Errorf("%s: send confirmation error: %v", errNotConfirmed, err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(confirmTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	msgType, msg, err := conn.ReadMessage()
+	if err != nil {
+		return fmt.Errorf("%s: read answer error: %v", errNotConfirmed, err)
+	}
+
+	if msgType != websocket.TextMessage {
+		return fmt.Errorf("%s: invalid confirmation answer", errNotConfirmed)
+	}
+
+	confirmed, err := protocol.DecodeConfirmAnswer(msg)
+	if err != nil {
+		return fmt.Errorf("%s: %v", errNotConfirmed, err)
+	}
+
+	if !confirmed {
+		return fmt.Errorf("%s: declined by the client", errNotConfirmed)
+	}
+
+	return nil
+}
+
+// notifyReattach tells the client asking for the confirmation that the session is reattached, nothing is run then.
+func notifyReattach(conn *websocket.Conn, sessConf *agentSession.Config) error {
+	return conn.WriteMessage(websocket.TextMessage, protocol.EncodeConfirmation(&protocol.Confirmation{
+		Cmd:      sessConf.Cmd,
+		User:     sessConf.LoginName,
+		Target:   sessConf.ContainerID,
+		Reattach: true,
+	}))
+}
@@ -0,0 +1,74 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package backend
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"trust-tunnel/pkg/trust-tunnel-client/protocol"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestConfirmCommand(t *testing.T) {
+	confirmation := &protocol.Confirmation{Cmd: []string{"/bin/sh", "-c", "cd /root;rm -rf ./tmp"}, User: "root", Dir: "/root"}
+	errs := make(chan error, 1)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		errs <- confirmCommand(conn, confirmation)
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		answer []byte
+		ok     bool
+	}{
+		{protocol.EncodeConfirmAnswer(true), true},
+		{protocol.EncodeConfirmAnswer(false), false},
+		{[]byte("resize: 24,80"), false},
+	}
+
+	for _, test := range tests {
+		conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, msg, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if echoed, err := protocol.DecodeConfirmation(msg); err != nil || !reflect.DeepEqual(echoed, confirmation) {
+			t.Errorf("got confirmation %+v %v, want %+v", echoed, err, confirmation)
+		}
+
+		conn.WriteMessage(websocket.TextMessage, test.answer)
+
+		if err = <-errs; (err == nil) != test.ok {
+			t.Errorf("confirmCommand answered with %q = %v, expected ok %v", test.answer, err, test.ok)
+		}
+
+		conn.Close()
+	}
+}
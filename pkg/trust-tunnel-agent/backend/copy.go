@@ -0,0 +1,56 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package backend
+
+import (
+	"fmt"
+)
+
+// defaultCopyMaxBytes is the default maximum total size of the files copied by a session.
+const defaultCopyMaxBytes = 1 << 30
+
+// CopyConfig specifies the copies of the files to and from the targets, which are done by the agent as tar streams
+// without spawning any process in the targets.
+type CopyConfig struct {
+	// Enabled specifies whether to serve the copies.
+	Enabled bool `toml:"enabled"`
+
+	// AllowedPaths are the files and the directories allowed to copy, all paths are allowed if it's empty.
+	AllowedPaths []string `toml:"allowed_paths"`
+
+	// DeniedPaths are the files and the directories denied to copy, even if they're under the allowed ones.
+	DeniedPaths []string `toml:"denied_paths"`
+
+	// MaxBytes is the maximum total size of the regular files copied by a session. Defaults to 1 GiB.
+	MaxBytes int64 `toml:"max_bytes"`
+}
+
+// withDefaults returns the configuration with the defaults filled in.
+func (c CopyConfig) withDefaults() CopyConfig {
+	if c.MaxBytes <= 0 {
+		c.MaxBytes = defaultCopyMaxBytes
+	}
+
+	return c
+}
+
+// checkPath checks if the path is allowed to copy. It's checked for the path requested and for every path copied
+// under it, and the symbolic links are never followed, so that the paths copied are the paths checked.
+func (c *CopyConfig) checkPath(p string) error {
+	if !c.Enabled {
+		return fmt.Errorf("copies are disabled")
+	}
+
+	return checkPathPolicy(p, c.AllowedPaths, c.DeniedPaths)
+}
@@ -0,0 +1,101 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"fmt"
+	"time"
+	"trust-tunnel/pkg/trust-tunnel-agent/backend/request"
+
+	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
+)
+
+// witnessBarrierWriteTimeout is the timeout of sending the ping ending the input typed before the witness attached.
+const witnessBarrierWriteTimeout = 10 * time.Second
+
+// awaitingSession is a new session under dual control awaiting its witness before it's established.
+type awaitingSession struct {
+	requestInfo *request.Info
+	observers   *observerSet
+}
+
+// awaitWitness waits for a user other than the writer to observe the new session under dual control before it's
+// established, so that nothing is run unwitnessed, and returns the observers of the session. The writer is told
+// how to be witnessed meanwhile.
+func (handler *Handler) awaitWitness(requestLogger *logrus.Entry, conn *websocket.Conn, req *request.Info,
+	sessID string) (*observerSet, error) {
+	conf := handler.config.ObserveConfig.withDefaults()
+	observers := newDualControlSet(conf.MaxObservers, req.UserName)
+
+	handler.lock.Lock()
+	if _, ok := handler.awaiting[sessID]; ok {
+		handler.lock.Unlock()
+
+		return nil, fmt.Errorf("dual control error: session %s is awaiting its witness already", sessID)
+	}
+
+	if handler.awaiting == nil {
+		handler.awaiting = make(map[string]*awaitingSession)
+	}
+
+	handler.awaiting[sessID] = &awaitingSession{requestInfo: req, observers: observers}
+	handler.lock.Unlock()
+
+	defer func() {
+		handler.lock.Lock()
+		delete(handler.awaiting, sessID)
+		handler.lock.Unlock()
+	}()
+
+	notice := fmt.Sprintf("[trust-tunnel] dual control: waiting up to %v for another user to observe the session "+
+		"with --observe %s, the input typed until then is discarded", conf.WitnessTimeout, sessID)
+	if err := writeNotice(conn, req.Tty, notice); err != nil {
+		requestLogger.Warnln("Notify dual control error: ", err)
+	}
+
+	witness, ok := observers.awaitWitness(conf.WitnessTimeout)
+	if !ok {
+		err := fmt.Errorf("dual control error: no other user observed the session within %v", conf.WitnessTimeout)
+		observers.end(websocket.FormatCloseMessage(websocket.CloseNormalClosure, "session not witnessed"))
+
+		return nil, err
+	}
+
+	requestLogger.Infof("session witnessed by %s", witness)
+
+	if err := writeNotice(conn, req.Tty, fmt.Sprintf("[trust-tunnel] %s is witnessing the session", witness)); err != nil {
+		requestLogger.Warnln("Notify dual control error: ", err)
+	}
+
+	return observers, nil
+}
+
+// discardTypedAhead discards the input the writer typed while the session awaited its witness, which is up to
+// the pong of the ping sent now, so that nothing typed before the witness attached is run unseen by it.
+func (sessConn *Connection) discardTypedAhead() error {
+	barrier := "witnessed " + sessConn.sessID
+
+	sessConn.inputBarrier.Store(true)
+	sessConn.conn.SetPongHandler(func(data string) error {
+		if data == barrier {
+			sessConn.inputBarrier.Store(false)
+		}
+
+		return nil
+	})
+
+	return sessConn.conn.WriteControl(websocket.PingMessage, []byte(barrier), time.Now().Add(witnessBarrierWriteTimeout))
+}
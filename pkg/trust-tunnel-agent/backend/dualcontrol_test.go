@@ -0,0 +1,208 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+	"trust-tunnel/pkg/trust-tunnel-agent/backend/request"
+
+	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
+)
+
+func TestDualControlSet(t *testing.T) {
+	set := newDualControlSet(defaultMaxObservers, "alice")
+	if !set.locked() {
+		t.Errorf("the session without witnesses should be locked")
+	}
+
+	// The writer observing its own session isn't its witness.
+	self := newObserver(nil, "alice", nil)
+	if err := set.add(self); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if _, ok := set.awaitWitness(10 * time.Millisecond); ok || !set.locked() {
+		t.Errorf("the writer shouldn't witness its own session")
+	}
+
+	bob := newObserver(nil, "bob", nil)
+	if err := set.add(bob); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if witness, ok := set.awaitWitness(time.Second); !ok || witness != "bob" || set.locked() {
+		t.Errorf("unexpected witness %q, %v", witness, ok)
+	}
+
+	// The input is locked again once the witness leaves, until another one attaches.
+	set.remove(bob)
+
+	if !set.locked() {
+		t.Errorf("the session should be locked once the witness leaves")
+	}
+
+	set.add(newObserver(nil, "carol", nil))
+	set.add(newObserver(nil, "bob", nil))
+
+	if set.locked() || !slices.Equal(set.witnessList(), []string{"bob", "carol"}) {
+		t.Errorf("unexpected witnesses %v", set.witnessList())
+	}
+
+	// The sessions not under dual control, or unable to be observed, are never locked.
+	if newObserverSet(1).locked() || (*observerSet)(nil).locked() || (*observerSet)(nil).witnessList() != nil {
+		t.Errorf("the sessions not under dual control shouldn't be locked")
+	}
+}
+
+func TestObserveConfigDualControl(t *testing.T) {
+	c := &ObserveConfig{Enabled: true, DualControl: []string{"critical", "default"}}
+	if !c.dualControl("critical") || !c.dualControl("") || c.dualControl("low") {
+		t.Errorf("unexpected dual control of %v", c.DualControl)
+	}
+
+	c.Enabled = false
+	if c.dualControl("critical") {
+		t.Errorf("dual control should require the observers")
+	}
+}
+
+// dialPair returns the both ends of a websocket connection.
+func dialPair(t *testing.T) (server, client *websocket.Conn) {
+	conns := make(chan *websocket.Conn, 1)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+
+		conns <- conn
+	}))
+	t.Cleanup(srv.Close)
+
+	client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	server = <-conns
+
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+
+	return server, client
+}
+
+func TestAwaitWitness(t *testing.T) {
+	handler := &Handler{config: &Config{ObserveConfig: ObserveConfig{
+		Enabled: true, DualControl: []string{"default"}, WitnessTimeout: 50 * time.Millisecond,
+	}}}
+	req := &request.Info{UserName: "alice"}
+	requestLogger := logrus.NewEntry(logrus.New())
+
+	server, client := dialPair(t)
+
+	// The session not witnessed in time is refused, and it can't be observed since then.
+	if _, err := handler.awaitWitness(requestLogger, server, req, "db-fix"); err == nil ||
+		!strings.Contains(err.Error(), "dual control error") {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if _, observers := handler.observable("db-fix"); observers != nil {
+		t.Errorf("the session refused shouldn't be observable")
+	}
+
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	if _, msg, err := client.ReadMessage(); err != nil || !strings.Contains(string(msg), "--observe db-fix") {
+		t.Errorf("unexpected notice %q, error %v", msg, err)
+	}
+
+	// The session awaiting its witness is observable, and established once witnessed.
+	handler.config.ObserveConfig.WitnessTimeout = 5 * time.Second
+	done := make(chan *observerSet, 1)
+
+	go func() {
+		observers, err := handler.awaitWitness(requestLogger, server, req, "db-fix")
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+
+		done <- observers
+	}()
+
+	var observers *observerSet
+	for observers == nil {
+		time.Sleep(10 * time.Millisecond)
+
+		_, observers = handler.observable("db-fix")
+	}
+
+	observers.add(newObserver(nil, "bob", nil))
+
+	if witnessed := <-done; witnessed != observers || witnessed.locked() {
+		t.Errorf("unexpected observers %v", witnessed)
+	}
+}
+
+func TestDiscardTypedAhead(t *testing.T) {
+	server, client := dialPair(t)
+	pinged := make(chan struct{})
+
+	client.SetPingHandler(func(data string) error {
+		err := client.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(time.Second))
+		close(pinged)
+
+		return err
+	})
+
+	go client.ReadMessage()
+
+	// The input typed before the barrier is discarded, the one after it isn't.
+	client.WriteMessage(websocket.BinaryMessage, []byte("early"))
+
+	sessConn := &Connection{conn: server, sessID: "db-fix"}
+	if err := sessConn.discardTypedAhead(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	<-pinged
+	client.WriteMessage(websocket.BinaryMessage, []byte("late"))
+
+	var discarded []string
+
+	for _, want := range []string{"early", "late"} {
+		_, msg, err := server.ReadMessage()
+		if err != nil || string(msg) != want {
+			t.Fatalf("unexpected message %q, error %v", msg, err)
+		}
+
+		if sessConn.inputBarrier.Load() {
+			discarded = append(discarded, want)
+		}
+	}
+
+	if !slices.Equal(discarded, []string{"early"}) {
+		t.Errorf("unexpected input discarded %v", discarded)
+	}
+}
@@ -0,0 +1,89 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// defaultForwardEnv are the name patterns of the environment variables forwarded from the client by default,
+// the terminal type and the locale.
+var defaultForwardEnv = []string{"TERM", "COLORTERM", "LANG", "LANGUAGE", "LC_*"}
+
+// protectedEnv are the name patterns of the environment variables set by the agent or changing how the commands are
+// loaded or the shells run them, which are never forwarded, even if they're allowed by forward_env, e.g. "*".
+var protectedEnv = []string{
+	"PATH", "HOME", "PWD", "SHELL", "USER", "LOGNAME", "TARGET_ROOT", "RequestedIP", "LD_*", "GCONV_PATH",
+	"BASH_ENV", "ENV", "IFS", "PS4", "PROMPT_COMMAND", "SHELLOPTS", "BASHOPTS",
+}
+
+// envNamePattern matches the names of the environment variables, as "LC_*" would match "LC_A;B" as well.
+var envNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]{0,63}$`)
+
+// envValuePattern matches the values of the forwarded environment variables, e.g. "xterm-kitty", "en_US.UTF-8@euro"
+// or "/var/log/app", which can't carry shell metacharacters or control characters to the command.
+var envValuePattern = regexp.MustCompile(`^[A-Za-z0-9._@:+,/=-]{1,256}$`)
+
+// forwardEnv returns the environment variables of the client ("NAME=value") allowed to be forwarded to the command,
+// and the names of the rejected ones, both sorted. The terminal type and the locale forwarded by default are only
+// hints for the command, so they're dropped silently rather than rejected.
+func (c *SessionConfig) forwardEnv(env map[string]string) (forwarded, rejected []string) {
+	patterns := c.ForwardEnv
+	if patterns == nil {
+		patterns = defaultForwardEnv
+	}
+
+	for name, value := range env {
+		if !envNamePattern.MatchString(name) || !envValuePattern.MatchString(value) ||
+			!matchAny(patterns, name) || matchAny(protectedEnv, name) {
+			if !matchAny(defaultForwardEnv, name) {
+				rejected = append(rejected, name)
+			}
+
+			continue
+		}
+
+		forwarded = append(forwarded, name+"="+value)
+	}
+
+	sort.Strings(forwarded)
+	sort.Strings(rejected)
+
+	return forwarded, rejected
+}
+
+// envNotice returns the notice telling the client which of its environment variables are rejected, e.g. as they
+// aren't allowed by forward_env or their values carry spaces, or "" if none is.
+func (c *SessionConfig) envNotice(env map[string]string) string {
+	if _, rejected := c.forwardEnv(env); len(rejected) > 0 {
+		return "[trust-tunnel] environment variables not forwarded by the agent: " + strings.Join(rejected, ", ")
+	}
+
+	return ""
+}
+
+// matchAny returns whether the name matches any of the patterns.
+func matchAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,78 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestForwardEnv(t *testing.T) {
+	env := map[string]string{
+		"TERM":        "xterm-kitty",
+		"LANG":        "en_US.UTF-8",
+		"LC_CTYPE":    "C.UTF-8",
+		"LC_A;B":      "C",
+		"LC_MESSAGES": "$(reboot)",
+		"PATH":        "/tmp",
+	}
+
+	c := &SessionConfig{}
+
+	want := []string{"LANG=en_US.UTF-8", "LC_CTYPE=C.UTF-8", "TERM=xterm-kitty"}
+	if got, _ := c.forwardEnv(env); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	c.ForwardEnv = []string{"TERM"}
+
+	if got, _ := c.forwardEnv(env); !reflect.DeepEqual(got, []string{"TERM=xterm-kitty"}) {
+		t.Errorf("got %q, want only TERM", got)
+	}
+
+	c.ForwardEnv = []string{}
+
+	if got, _ := c.forwardEnv(env); len(got) != 0 {
+		t.Errorf("got %q, want nothing forwarded", got)
+	}
+
+	// The custom variables are forwarded if allowed, but never the ones set by the agent.
+	env["APP_LOG_DIR"] = "/var/log/app"
+	env["LD_PRELOAD"] = "/tmp/evil.so"
+	env["BASH_ENV"] = "/tmp/evil.sh"
+	env["JAVA_OPTS"] = "-Xmx1g -Dx=y"
+	c.ForwardEnv = []string{"*"}
+
+	want = []string{"APP_LOG_DIR=/var/log/app", "LANG=en_US.UTF-8", "LC_CTYPE=C.UTF-8", "TERM=xterm-kitty"}
+	got, rejected := c.forwardEnv(env)
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	// The rejected variables are told to the client, but not the malformed locale, as it's only a hint.
+	if want := []string{"BASH_ENV", "JAVA_OPTS", "LD_PRELOAD", "PATH"}; !reflect.DeepEqual(rejected, want) {
+		t.Errorf("got rejected %q, want %q", rejected, want)
+	}
+
+	wantNotice := "[trust-tunnel] environment variables not forwarded by the agent: BASH_ENV, JAVA_OPTS, LD_PRELOAD, PATH"
+	if notice := c.envNotice(env); notice != wantNotice {
+		t.Errorf("got notice %q, want %q", notice, wantNotice)
+	}
+
+	if notice := c.envNotice(map[string]string{"TERM": "xterm-kitty"}); notice != "" {
+		t.Errorf("got notice %q, want none", notice)
+	}
+}
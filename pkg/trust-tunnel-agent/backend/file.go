@@ -0,0 +1,89 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// defaultFileMaxBytes is the default maximum size of the files shown by cat and hashed.
+const defaultFileMaxBytes = 10 << 20
+
+// FileConfig specifies the file verbs cat, tail and stat, which read the files in the targets by the agent without
+// spawning a shell, so that most support tasks can be done without the permission to run commands.
+type FileConfig struct {
+	// Enabled specifies whether to serve the file verbs.
+	Enabled bool `toml:"enabled"`
+
+	// AllowedPaths are the files and the directories allowed to read, all paths are allowed if it's empty.
+	AllowedPaths []string `toml:"allowed_paths"`
+
+	// DeniedPaths are the files and the directories denied to read, even if they're under the allowed ones.
+	DeniedPaths []string `toml:"denied_paths"`
+
+	// MaxBytes is the maximum size of the files shown by cat, and of the files whose hash is audited.
+	// Defaults to 10 MiB.
+	MaxBytes int64 `toml:"max_bytes"`
+}
+
+// withDefaults returns the configuration with the defaults filled in.
+func (c FileConfig) withDefaults() FileConfig {
+	if c.MaxBytes <= 0 {
+		c.MaxBytes = defaultFileMaxBytes
+	}
+
+	return c
+}
+
+// checkPath checks if the file is allowed to read. The path is absolute and clean, and the symbolic links are
+// refused on reading, so that the path read is the path checked.
+func (c *FileConfig) checkPath(p string) error {
+	if !c.Enabled {
+		return fmt.Errorf("file verbs are disabled")
+	}
+
+	return checkPathPolicy(p, c.AllowedPaths, c.DeniedPaths)
+}
+
+// checkPathPolicy checks if the path is under the allowed paths and isn't under the denied ones, all paths are
+// allowed if there are no allowed paths.
+func checkPathPolicy(p string, allowedPaths, deniedPaths []string) error {
+	for _, denied := range deniedPaths {
+		if underPath(p, denied) {
+			return fmt.Errorf("%s is denied by %s", p, denied)
+		}
+	}
+
+	if len(allowedPaths) == 0 {
+		return nil
+	}
+
+	for _, allowed := range allowedPaths {
+		if underPath(p, allowed) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%s isn't under the allowed paths", p)
+}
+
+// underPath returns whether the path is the directory or under it.
+func underPath(p, dir string) bool {
+	dir = path.Clean(dir)
+
+	return p == dir || dir == "/" || strings.HasPrefix(p, dir+"/")
+}
@@ -0,0 +1,40 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import "testing"
+
+func TestFileConfigCheckPath(t *testing.T) {
+	c := &FileConfig{Enabled: true, AllowedPaths: []string{"/etc", "/var/log/"}, DeniedPaths: []string{"/etc/shadow"}}
+
+	for p, allowed := range map[string]bool{
+		"/etc":             true,
+		"/etc/hosts":       true,
+		"/var/log/app.log": true,
+		"/etc/shadow":      false,
+		"/etc/shadow-":     true,
+		"/etcetera":        false,
+		"/root/.bashrc":    false,
+	} {
+		if err := c.checkPath(p); (err == nil) != allowed {
+			t.Errorf("checkPath(%s) = %v", p, err)
+		}
+	}
+
+	c.Enabled = false
+	if err := c.checkPath("/etc/hosts"); err == nil {
+		t.Error("file verbs should be disabled")
+	}
+}
@@ -0,0 +1,97 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package backend
+
+import (
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+
+	client "trust-tunnel/pkg/trust-tunnel-client"
+)
+
+// defaultForwardMaxStreams is the default maximum number of the connections forwarded by a session at once.
+const defaultForwardMaxStreams = 16
+
+// ForwardConfig specifies the port forwards to the targets, which are dialed by the agent in the network namespaces
+// of the targets without spawning any process in them.
+type ForwardConfig struct {
+	// Enabled specifies whether to serve the port forwards.
+	Enabled bool `toml:"enabled"`
+
+	// AllowedPorts are the ports allowed to forward to, all ports are allowed if it's empty.
+	AllowedPorts []int `toml:"allowed_ports"`
+
+	// AllowedHosts are the patterns of the hosts allowed to forward to besides the loopback of the targets, e.g.
+	// "*.svc.cluster.local" or "10.0.0.5", matched by path.Match. No other host is allowed if it's empty.
+	AllowedHosts []string `toml:"allowed_hosts"`
+
+	// AllowReverse specifies whether to serve the reverse forwards, where the agent listens on the loopback of the
+	// targets and forwards the connections to the clients, e.g. for the processes in the targets to reach the
+	// debuggers of the operators.
+	AllowReverse bool `toml:"allow_reverse"`
+
+	// ReversePorts are the ports allowed to listen on for the reverse forwards, all ports are allowed if it's empty.
+	ReversePorts []int `toml:"reverse_ports"`
+
+	// MaxStreams is the maximum number of the connections forwarded by a session at once. Defaults to 16.
+	MaxStreams int `toml:"max_streams"`
+}
+
+// withDefaults returns the configuration with the defaults filled in.
+func (c ForwardConfig) withDefaults() ForwardConfig {
+	if c.MaxStreams <= 0 {
+		c.MaxStreams = defaultForwardMaxStreams
+	}
+
+	return c
+}
+
+// check checks if the host and the port of the request are allowed to forward to.
+func (c *ForwardConfig) check(req *client.ForwardRequest) error {
+	if !c.Enabled {
+		return fmt.Errorf("port forwarding is disabled")
+	}
+
+	if req.Reverse {
+		if !c.AllowReverse {
+			return fmt.Errorf("reverse port forwarding is disabled")
+		}
+
+		if len(c.ReversePorts) > 0 && !slices.Contains(c.ReversePorts, req.Port) {
+			return fmt.Errorf("port %d isn't allowed to forward from", req.Port)
+		}
+
+		return nil
+	}
+
+	if len(c.AllowedPorts) > 0 && !slices.Contains(c.AllowedPorts, req.Port) {
+		return fmt.Errorf("port %d isn't allowed to forward to", req.Port)
+	}
+
+	if req.Host == "" {
+		return nil
+	}
+
+	// The names are matched case-insensitively, with or without the trailing dot.
+	host := strings.ToLower(strings.TrimSuffix(req.Host, "."))
+	for _, pattern := range c.AllowedHosts {
+		if ok, _ := path.Match(strings.ToLower(pattern), host); ok {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("host %s isn't allowed to forward to", req.Host)
+}
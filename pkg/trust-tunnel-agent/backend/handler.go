@@ -15,18 +15,26 @@
 package backend
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"strconv"
 	"sync"
 	"time"
 	"trust-tunnel/pkg/common/logutil"
 	"trust-tunnel/pkg/common/sessionutil"
+	"trust-tunnel/pkg/common/watermark"
 	"trust-tunnel/pkg/trust-tunnel-agent/auth"
 	"trust-tunnel/pkg/trust-tunnel-agent/backend/request"
+	"trust-tunnel/pkg/trust-tunnel-agent/monitor"
+	"trust-tunnel/pkg/trust-tunnel-agent/proctrack"
+	"trust-tunnel/pkg/trust-tunnel-agent/recordstore"
 	"trust-tunnel/pkg/trust-tunnel-agent/sidecar"
+	"trust-tunnel/pkg/trust-tunnel-client/protocol"
 
 	_ "trust-tunnel/pkg/trust-tunnel-agent/auth/example"
+	_ "trust-tunnel/pkg/trust-tunnel-agent/auth/ldap"
 	agentSession "trust-tunnel/pkg/trust-tunnel-agent/session"
 	client "trust-tunnel/pkg/trust-tunnel-client"
 
@@ -38,9 +46,9 @@ import (
 
 var logger = logutil.GetLogger("trust-tunnel-agent")
 
-const (
-	maxWebsocketControlMsgLength = 123
-)
+// streamTraceSampler samples the per-message traces of the session streams, which are logged for every chunk
+// of the input and output.
+var streamTraceSampler = logutil.NewSampler(20, 1000, time.Second)
 
 // Config represents the configuration for the Handler.
 type Config struct {
@@ -55,47 +63,124 @@ type Config struct {
 
 	// SidecarConfig specifies the sidecar configuration.
 	SidecarConfig sidecar.Config
+
+	// NetworkConfig specifies the network options of client connections.
+	NetworkConfig NetworkConfig
+
+	// JumpConfig specifies the jump agent configuration.
+	JumpConfig JumpConfig
+
+	// SecurityConfig specifies the security labels of the sidecar containers and the nsenter children.
+	SecurityConfig agentSession.SecurityConfig
+
+	// RunConfig specifies the synchronous exec API on POST /run.
+	RunConfig RunConfig
+
+	// KubeExecConfig specifies the exec endpoint compatible with Kubernetes.
+	KubeExecConfig KubeExecConfig
+
+	// TenantConfig specifies the tenants served with isolated policies.
+	TenantConfig TenantConfig
+
+	// FileConfig specifies the file verbs reading the files in the targets by the agent.
+	FileConfig FileConfig
+
+	// CopyConfig specifies the copies of the files to and from the targets by the agent.
+	CopyConfig CopyConfig
+
+	// ForwardConfig specifies the port forwards to the targets by the agent.
+	ForwardConfig ForwardConfig
+
+	// VerbConfig specifies the verbs run natively by the agent.
+	VerbConfig VerbConfig
+
+	// TagConfig specifies the policy of the session tags.
+	TagConfig TagConfig
+
+	// NotifyConfig specifies the webhooks notified of the session lifecycle events.
+	NotifyConfig NotifyConfig
+
+	// ObserveConfig specifies the read-only observers of the live sessions.
+	ObserveConfig ObserveConfig
 }
 
 // Handler represents a WebSocket handler for establishing sessions.
 type Handler struct {
-	config            *Config
-	staleSessions     map[string]*StaleSession
-	dockerClient      dockerAPIClient.CommonAPIClient
-	containerdClient  *containerd.Client
-	authHandler       auth.Handler
-	lock              sync.Mutex
-	currentSidecarNum int
+	config        *Config
+	staleSessions map[string]*StaleSession
+	runtime       *runtimeClient
+	authHandler   auth.Handler
+	lock          sync.Mutex
+	// sidecars accounts the sidecars attached to containers.
+	sidecars *sidecarQuota
+	// connections are the connections of the active sessions.
+	connections map[*Connection]struct{}
+	// serving counts the connections not yet recorded as terminated, drained is closed once it drops to zero
+	// after the handler is shut down.
+	serving      int
+	shuttingDown bool
+	drained      chan struct{}
+	// affinity identifies this agent instance in the affinity tokens issued to clients.
+	affinity *affinity
+	upgrader websocket.Upgrader
+	// bulkUpgrader upgrades the sessions of the frames larger than the default, with the write buffers fitting them.
+	bulkUpgrader websocket.Upgrader
+	// jumper proxies sessions to other agents, it's nil if jumping is disabled.
+	jumper *jumper
+	// tenants are the configured tenants by name, it's nil if tenants are disabled.
+	tenants map[string]*tenant
+	// tags checks the tags of the sessions and counts them in the metrics.
+	tags *tagPolicy
+	// verbCache caches the results of the idempotent verbs run by POST /run, it's nil if caching is disabled.
+	verbCache *verbCache
+	// recordUploader uploads the recordings to the object storage, it's nil if they're only kept on the node.
+	recordUploader *recordstore.Uploader
+	// awaiting are the new sessions under dual control awaiting their witnesses by the session IDs.
+	awaiting map[string]*awaitingSession
 }
 
 // NewHandler creates a new Handler with the given configuration.
 func NewHandler(c *Config) (*Handler, error) {
+	sessionutil.SetMainIPConfig(sessionutil.MainIPConfig{
+		AdvertiseAddress:  c.SessionConfig.AdvertiseAddress,
+		InterfacePriority: c.SessionConfig.InterfacePriority,
+	})
+
 	h := &Handler{
 		config:        c,
 		staleSessions: make(map[string]*StaleSession),
+		connections:   make(map[*Connection]struct{}),
+		affinity:      newAffinity(&c.SessionConfig),
+		sidecars:      newSidecarQuota(c.SidecarConfig.Limit, c.SidecarConfig.PerContainerLimit),
+		verbCache:     newVerbCache(c.VerbConfig.Cache),
+		upgrader: websocket.Upgrader{
+			ReadBufferSize:  c.NetworkConfig.ReadBufferSize,
+			WriteBufferSize: c.NetworkConfig.WriteBufferSize,
+		},
 	}
-	// Create a container client based on the container runtime.
-	if h.config.ContainerConfig.ContainerRuntime == agentSession.Docker {
-		dockerClient, err := sessionutil.CreateDockerClient(c.ContainerConfig.Endpoint, c.ContainerConfig.DockerAPIVersion)
-		if err != nil {
-			logger.Errorf("create container API client error: %s", err.Error())
-		} else {
-			h.dockerClient = dockerClient
-		}
-	} else {
-		containerdClient, err := containerd.New(c.ContainerConfig.Endpoint)
-		if err != nil {
-			logger.Errorf("create containerd API client error: %s", err.Error())
-		} else {
-			h.containerdClient = containerdClient
-		}
+
+	_, bulkFrameSize := c.NetworkConfig.frameSizes()
+	h.bulkUpgrader = websocket.Upgrader{
+		ReadBufferSize:  c.NetworkConfig.ReadBufferSize,
+		WriteBufferSize: max(c.NetworkConfig.WriteBufferSize, bulkFrameSize),
+	}
+
+	// Create a container client based on the container runtime, and check its health periodically.
+	h.runtime = newRuntimeClient(&c.ContainerConfig)
+	go h.runtime.checkPeriodically(c.ContainerConfig.HealthCheckPeriod)
+	monitor.RegisterReadinessCheck("container_runtime", h.runtime.ready)
+	monitor.SetStatusProvider(h.status)
+
+	jumper, err := newJumper(&c.JumpConfig)
+	if err != nil {
+		return nil, err
 	}
 
+	h.jumper = jumper
+
 	// Init the authHandler.
 	var authHandler auth.Handler
 
-	var err error
-
 	if c.AuthConfig.Name != "" {
 		authHandler, err = auth.CreateAuthHandlerFromConfig(c.AuthConfig)
 		if err != nil {
@@ -105,13 +190,68 @@ func NewHandler(c *Config) (*Handler, error) {
 
 	h.authHandler = authHandler
 
-	// Pull the sidecar image during booting.
-	err := sidecar.Init(c.ContainerConfig.Endpoint, c.SidecarConfig.Image, c.SidecarConfig.ImageHubAuth, h.dockerClient)
-	if err != nil {
-		logger.Errorf("init sidecar with image %s error: %v, ignore it", c.SidecarConfig.Image, err)
+	if cache, ok := authHandler.(*auth.CachingHandler); ok {
+		monitor.SetAuthCacheInvalidator(cache.Invalidate)
+	}
+
+	if h.tenants, err = newTenants(&c.TenantConfig, &c.AuthConfig); err != nil {
+		return nil, err
+	}
+
+	if h.tags, err = newTagPolicy(&c.TagConfig); err != nil {
+		return nil, err
+	}
+
+	if sessionNotifier, err = newNotifier(&c.NotifyConfig); err != nil {
+		return nil, err
+	}
+
+	if h.recordUploader, err = recordstore.New(&c.SessionConfig.RecordUpload, c.SessionConfig.RecordDir); err != nil {
+		return nil, fmt.Errorf("record_upload: %v", err)
+	}
+
+	// The recordings left by the previous runs are uploaded as well.
+	if h.recordUploader != nil {
+		monitor.Go("record_upload", h.recordUploader.Run)
+	}
+
+	if c.AuthConfig.BreakGlass.Enabled && len(c.AuthConfig.BreakGlass.Users) == 0 {
+		return nil, fmt.Errorf("users are required for break-glass access")
+	}
+
+	if c.AuthConfig.BreakGlass.Enabled && c.AuthConfig.BreakGlass.AlertURL == "" {
+		return nil, fmt.Errorf("alert_url is required for break-glass access")
+	}
+
+	// The break-glass sessions are never left unrecorded.
+	if c.AuthConfig.BreakGlass.Enabled && c.SessionConfig.RecordDir == "" {
+		return nil, fmt.Errorf("session_config.record_dir is required for break-glass access")
+	}
+
+	// The sessions under dual control can't be run without their witnesses observing them.
+	if len(c.ObserveConfig.DualControl) > 0 && !c.ObserveConfig.Enabled {
+		return nil, fmt.Errorf("observe_config.enabled is required for dual control")
+	}
+
+	// Set up the sidecar image verifier, refuse to start with an invalid verification policy.
+	if err = sidecar.SetupVerifier(c.SidecarConfig.Verify); err != nil {
+		return nil, err
+	}
+
+	// Sidecars aren't used in nsexec clean mode.
+	if c.ContainerConfig.CleanMode != agentSession.CleanModeNsexec {
+		// Pull and verify the sidecar image during booting.
+		dockerClient, err := h.runtime.docker()
+		if err == nil {
+			err = sidecar.Init(c.ContainerConfig.Endpoint, &c.SidecarConfig, dockerClient)
+		}
+
+		if err != nil {
+			logger.Errorf("init sidecar with image %s error: %v, ignore it", c.SidecarConfig.Image, err)
+		}
+		// Clean legacy sidecar container periodically.
+		go sidecar.CleanLegacyContainerPeriodically(h.runtime.docker)
 	}
-	// Clean legacy sidecar container periodically.
-	go sidecar.CleanLegacyContainerPeriodically(h.dockerClient)
 
 	// Delay release stale sessions.
 	go h.delayReleaseSession()
@@ -119,12 +259,11 @@ func NewHandler(c *Config) (*Handler, error) {
 	return h, nil
 }
 
-var upgrader = websocket.Upgrader{}
-
 // Handle handles the incoming HTTP request and establishes a new session.
 func (handler *Handler) Handle(w http.ResponseWriter, r *http.Request) {
-	// Create a logger for the incoming request.
-	requestLogger := logger.WithField("request_from", r.RemoteAddr)
+	// Create a logger for the incoming request, correlating its entries before the session ID is known.
+	correlationID := logutil.NewCorrelationID()
+	requestLogger := logger.WithField("request_from", r.RemoteAddr).WithField(logutil.FieldCorrelationID, correlationID)
 
 	// Get the request information from the incoming request.
 	requestInfo, err := request.GetRequestInfo(r)
@@ -137,123 +276,422 @@ func (handler *Handler) Handle(w http.ResponseWriter, r *http.Request) {
 	// Log the request information.
 	requestLogger.Infoln("Request info: ", requestInfo)
 
+	// Identify the tenant to apply its policies.
+	if _, err = handler.identifyTenant(r, requestInfo); err != nil {
+		requestLogger.Warnf("authorization failed: %v", err)
+		auditDenial(requestInfo, r.RemoteAddr, "unknown_tenant", err.Error(), 0)
+
+		return
+	}
+
+	if err = handler.bindIdentity(r, requestInfo); err != nil {
+		requestLogger.Warnf("authorization failed: %v", err)
+		auditDenial(requestInfo, r.RemoteAddr, "identity_mismatch", err.Error(), 0)
+		http.Error(w, "permission denied", http.StatusForbidden)
+
+		return
+	}
+
+	// Redirect the reattachment to the agent instance holding the session.
+	// The affinity token of a jump request is issued by the target agent, so it's left to the target.
+	if requestInfo.JumpTarget == "" && handler.redirectToOwner(w, r, requestInfo) {
+		return
+	}
+
+	// The tags are checked before authorization, so that the auth handler decides on the valid tags.
+	if err = handler.tags.check(requestInfo.Tags); err != nil {
+		requestLogger.Warnf("authorization failed: %v", err)
+		auditDenial(requestInfo, r.RemoteAddr, "tag_denied", err.Error(), 0)
+
+		return
+	}
+
+	// The observers attach to the live sessions of the target agent instead of starting sessions.
+	if requestInfo.Observe && requestInfo.JumpTarget == "" {
+		handler.observe(w, r, requestLogger, requestInfo, correlationID)
+
+		return
+	}
+
+	// The verbs are authorized with their scopes, resolved by the target agent.
+	if requestInfo.JumpTarget == "" {
+		if err = handler.resolveVerb(requestInfo); err != nil {
+			requestLogger.Warnf("authorization failed: %v", err)
+			auditDenial(requestInfo, r.RemoteAddr, "verb_denied", err.Error(), 0)
+
+			return
+		}
+	}
+
+	// Refuse the commands too long before reading them from the command frame.
+	if err = handler.config.SessionConfig.checkCommandLength(requestInfo.Cmd); err == nil &&
+		requestInfo.CommandFrame > handler.config.SessionConfig.maxCommandFrame() {
+		err = fmt.Errorf("command frame of %d bytes exceeds the limit", requestInfo.CommandFrame)
+	}
+
+	if err != nil {
+		requestLogger.Warnln("Request invalid: ", err)
+		http.Error(w, "request error: "+err.Error(), http.StatusRequestEntityTooLarge)
+
+		return
+	}
+
+	// If session ID is not given, create a new one.
+	sessID := requestInfo.SessionID
+	if sessID == "" {
+		sessID = newSessionID()
+	}
+
+	// Issue the session ID and the affinity token for reattachment.
+	responseHeader := http.Header{}
+	responseHeader.Set(headerSessionID, sessID)
+	responseHeader.Set(headerAgentInstance, handler.affinity.Instance)
+	responseHeader.Set(headerAffinityToken, handler.affinity.encode())
+	responseHeader.Set(headerCorrelationID, correlationID)
+	responseHeader.Set(protocol.HeaderProtocolVersion, strconv.Itoa(protocol.Version))
+
+	// The output of the jump sessions is framed by the target agent.
+	if requestInfo.JumpTarget == "" {
+		responseHeader.Set(protocol.HeaderFrameSize, strconv.Itoa(handler.frameSize(requestInfo)))
+	}
+
+	// The command in the command frame is authorized, so the connection is upgraded to read it first, and the session
+	// is refused by the close frame instead of the HTTP response since then.
+	var conn *websocket.Conn
+
+	if requestInfo.CommandFrame > 0 {
+		if conn, err = handler.upgradeForCommand(w, r, requestInfo, responseHeader); err != nil {
+			requestLogger.Warnln("Request invalid: ", err)
+
+			return
+		}
+		defer conn.Close()
+	}
+
 	// Check if the user has the permission the access the target.
-	if handler.authHandler != nil {
-		authResult := handler.authHandler.VerifyAccessPermission(requestInfo)
-		if authResult.Code != auth.Success {
-			logger.Errorf("authorization failed:%v", authResult)
+	authz, ok := handler.authorize(requestLogger, requestInfo, r.RemoteAddr)
+	if !ok {
+		refuseUpgraded(conn, "authorization failed")
+
+		return
+	}
+
+	// The file verbs are checked against the path policies of the target agent.
+	if requestInfo.File != nil && requestInfo.JumpTarget == "" {
+		if err = handler.config.FileConfig.checkPath(requestInfo.File.Path); err != nil {
+			requestLogger.Warnf("authorization failed: %v", err)
+			auditDenial(requestInfo, r.RemoteAddr, "file_denied", err.Error(), authz.latency)
+
+			return
+		}
+	}
+
+	// So are the copies, the paths under the path copied are checked as they're copied.
+	if requestInfo.Copy != nil && requestInfo.JumpTarget == "" {
+		if err = handler.config.CopyConfig.checkPath(requestInfo.Copy.Path); err != nil {
+			requestLogger.Warnf("authorization failed: %v", err)
+			auditDenial(requestInfo, r.RemoteAddr, "copy_denied", err.Error(), authz.latency)
+
+			return
+		}
+	}
+
+	// And the port forwards against the hosts and the ports allowed.
+	if requestInfo.Forward != nil && requestInfo.JumpTarget == "" {
+		if err = handler.config.ForwardConfig.check(requestInfo.Forward); err != nil {
+			requestLogger.Warnf("authorization failed: %v", err)
+			auditDenial(requestInfo, r.RemoteAddr, "forward_denied", err.Error(), authz.latency)
+
+			return
+		}
+	}
+
+	// The sessions to the targets under dual control are only run while another user witnesses them.
+	if requestInfo.JumpTarget == "" && handler.config.ObserveConfig.dualControl(authz.sensitivity) {
+		requestInfo.DualControl = true
+
+		// Only the sessions with the IDs given by the clients can be observed, so can be witnessed.
+		if requestInfo.SessionID == "" {
+			errMsg := "dual control error: the session ID must be given for the session to be witnessed"
+			requestLogger.Warnf("authorization failed: %s", errMsg)
+			auditDenial(requestInfo, r.RemoteAddr, "dual_control", errMsg, authz.latency)
+
+			if conn == nil {
+				http.Error(w, sessionutil.WrapErrorWithCode(errMsg), http.StatusForbidden)
+			}
+
+			refuseUpgraded(conn, errMsg)
 
 			return
 		}
 	}
 
 	// Construct request info to audit log.
-	constructAuditInfo(requestInfo)
+	constructAuditInfo(requestInfo, r.RemoteAddr)
 
-	// Upgrade the HTTP connection to a WebSocket connection.
-	conn, err := upgrader.Upgrade(w, r, nil)
-	if err != nil {
-		requestLogger.Warnln("Websocket upgrade error: ", err)
+	// Proxy the session to the target agent if this agent is the jump agent.
+	if requestInfo.JumpTarget != "" {
+		// The challenge can't be told apart from the frames relayed from the target agent.
+		if authz.mfa != nil {
+			requestLogger.Errorf("authorization failed: MFA can't be required on the jump agent, require it on the target instead")
+			auditDenial(requestInfo, r.RemoteAddr, "mfa_on_jump", "MFA can't be required on the jump agent", authz.latency)
+			refuseUpgraded(conn, "MFA can't be required on the jump agent")
+
+			return
+		}
+
+		if requestInfo.BreakGlass {
+			handler.alertBreakGlass(requestInfo, "", r.RemoteAddr)
+		}
+
+		handler.jump(w, r, requestInfo, conn)
 
 		return
 	}
-	defer conn.Close()
+
+	if authz.mfa != nil && requestInfo.MFA {
+		responseHeader.Set(protocol.HeaderMFA, authz.mfa.Type)
+	}
 
 	// Create a session configuration from the request information.
-	sessConf := &agentSession.Config{
-		TargetType:       requestInfo.TargetType,
-		UserName:         requestInfo.UserName,
-		LoginName:        requestInfo.LoginName,
-		LoginGroup:       requestInfo.LoginGroup,
-		ContainerID:      requestInfo.ContainerID,
-		Cmd:              requestInfo.Cmd,
-		Tty:              requestInfo.Tty,
-		Interactive:      requestInfo.Interactive,
-		PhysTunnel:       handler.config.SessionConfig.PhysTunnel,
-		SidecarImage:     handler.config.SidecarConfig.Image,
-		ImageHubAuth:     handler.config.SidecarConfig.ImageHubAuth,
-		Cpus:             requestInfo.Cpus,
-		MemoryMB:         requestInfo.MemoryMB,
-		DisableCleanMode: requestInfo.DisableCleanMode,
-		RootfsPrefix:     handler.config.ContainerConfig.RootfsPrefix,
+	sessConf := handler.newSessionConfig(requestInfo, sessID)
+	runtime := handler.runtimeLabel(sessConf)
+
+	// Refuse new sessions before the upgrade if no sidecar is available, so that the client can back off
+	// by the occupancy and the retry hint in the response headers.
+	if requestInfo.SessionID == "" {
+		if err = handler.checkSidecarQuota(requestLogger, w.Header(), sessConf, sessID, runtime); err != nil {
+			if conn == nil {
+				http.Error(w, "Establish session error: "+err.Error(), http.StatusServiceUnavailable)
+			}
+
+			refuseUpgraded(conn, err.Error())
+
+			return
+		}
+	}
+
+	if requestInfo.BreakGlass {
+		handler.alertBreakGlass(requestInfo, sessID, r.RemoteAddr)
+	}
+
+	// Upgrade the HTTP connection to a WebSocket connection, or reply the command frame if it's been upgraded.
+	if conn == nil {
+		conn, err = handler.upgraderOf(requestInfo).Upgrade(w, r, responseHeader)
+		if err != nil {
+			requestLogger.Warnln("Websocket upgrade error: ", err)
+
+			return
+		}
+		defer conn.Close()
+	} else if err = replyCommand(conn, responseHeader); err != nil {
+		requestLogger.Warnln("Reply command frame error: ", err)
+
+		return
+	}
+
+	// Verify the second factor before the session is established or reattached.
+	if authz.mfa != nil {
+		if err = handler.verifyMFA(conn, requestInfo, authz.mfa); err != nil {
+			auditDenial(requestInfo, r.RemoteAddr, "mfa_failed", err.Error(), authz.latency)
+
+			errMsg := sessionutil.WrapErrorWithCode(err.Error())
+			requestLogger.Warn(errMsg)
+			conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseUnsupportedData, truncWebsocketErrMsg("Establish session error: "+errMsg)))
+
+			return
+		}
+
+		requestLogger.Infof("MFA (%s) verified", authz.mfa.Type)
 	}
 
 	var (
-		sess   agentSession.Session
-		sessID = requestInfo.SessionID
+		sess      agentSession.Session
+		size      termSize
+		rec       *recording
+		resume    *resumeBuffer
+		observers *observerSet
 	)
 
+	startTime := time.Now()
+
 	// Find un-released sessions from list, and reuse it if exists.
 	handler.lock.Lock()
-	if staleSess, ok := handler.staleSessions[sessID]; ok && sessID != "" && requestInfo.UserName == staleSess.userName {
+	if staleSess, ok := handler.staleSessions[sessID]; ok && requestInfo.SessionID != "" && requestInfo.UserName == staleSess.userName {
 		sess = staleSess.sess
+		startTime = staleSess.startTime
+		size = staleSess.size
+		rec = staleSess.recording
+		resume = staleSess.resume
+		observers = staleSess.observers
 		// Remove stale session from list.
 		delete(handler.staleSessions, sessID)
 		requestLogger.Infof("reuse stale session %s", sessID)
 	}
 	handler.lock.Unlock()
 
-	// If session ID is not found in stale sessions, create a new session.
-	if sessID == "" {
-		sessID = time.Now().Format("20060102150405")
-	}
-
 	// Create a logger for the session.
-	requestLogger = requestLogger.WithField("session_id", sessID)
+	requestLogger = requestLogger.WithField(logutil.FieldSessionID, sessID)
+	defer logutil.CloseSessionFile(sessID)
 
-	// Check if the session needs to attach a sidecar to the container.
-	var isSidecarSession bool
+	// Check if the session needs to attach a sidecar to the container, and whether the new session is witnessed.
+	var isSidecarSession, witnessed bool
 
 	// Session ID not found in stale sessions, create a new session.
 	if sess == nil {
-		if sessConf.TargetType == client.TargetContainer {
-			isSidecarSession, err = handler.containerPreCheck(sessConf, handler.config.ContainerConfig.ContainerRuntime)
-			if err != nil {
-				errMsg := sessionutil.WrapErrorWithCode(sessionutil.WrapContainerError(err.Error(), sessConf.ContainerID))
-				logger.Error(errMsg)
+		// The command is echoed for the confirmation once it's resolved by the session, right before it's run.
+		if requestInfo.Confirm {
+			sessConf.Confirm = confirmHook(requestLogger, conn, sessConf)
+		}
+
+		// Nothing is run under dual control until the witness observes the session.
+		if requestInfo.DualControl {
+			if observers, err = handler.awaitWitness(requestLogger, conn, requestInfo, sessID); err != nil {
+				auditDenial(requestInfo, r.RemoteAddr, "no_witness", err.Error(), authz.latency)
+
+				errMsg := sessionutil.WrapErrorWithCode(err.Error())
+				requestLogger.Warn(errMsg)
 				conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseUnsupportedData, truncWebsocketErrMsg("Establish session error: "+errMsg)))
 
 				return
 			}
+
+			witnessed = true
 		}
 
-		sess, err = agentSession.EstablishSession(sessConf, handler.dockerClient, handler.containerdClient, handler.config.ContainerConfig.ContainerRuntime)
-		if err != nil {
-			requestLogger.Warnf("Establish session error: %v", err)
+		if notice := handler.config.SessionConfig.envNotice(requestInfo.Env); notice != "" {
+			if err = writeNotice(conn, requestInfo.Tty, notice); err != nil {
+				requestLogger.Warnln("Notify rejected environment variables error: ", err)
+			}
+		}
+
+		// Start recording before the session is established, so that nothing is run unrecorded.
+		if rec, err = handler.startRecording(requestLogger, requestInfo, sessID); err != nil {
+			observers.end(websocket.FormatCloseMessage(websocket.CloseNormalClosure, "session not established"))
+
 			errMsg := sessionutil.WrapErrorWithCode(err.Error())
-			logger.Error(errMsg)
+			requestLogger.Error(errMsg)
 			conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseUnsupportedData, truncWebsocketErrMsg("Establish session error: "+errMsg)))
 
 			return
 		}
 
-		if isSidecarSession {
-			handler.currentSidecarNum++
+		sess, isSidecarSession, err = handler.establishSession(requestLogger, sessConf, sessID, runtime)
+		if err != nil {
+			rec.close()
+			observers.end(websocket.FormatCloseMessage(websocket.CloseNormalClosure, "session not established"))
+			conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseUnsupportedData, truncWebsocketErrMsg("Establish session error: "+err.Error())))
+
+			return
 		}
 
-		requestLogger.Infoln("new session established")
+		handler.tags.count(requestInfo.Tags, sessID)
+		notifyStart(requestInfo, sessID, r.RemoteAddr)
+
+		// Only the sessions with the IDs given by the clients can be reattached.
+		if limit := handler.config.SessionConfig.resumeBufferSize(); limit > 0 && requestInfo.SessionID != "" {
+			resume = newResumeBuffer(limit)
+		}
+	} else if requestInfo.Confirm {
+		if err = notifyReattach(conn, sessConf); err != nil {
+			requestLogger.Warnln("Notify reattachment error: ", err)
+		}
+	}
+
+	if rec != nil {
+		requestInfo.Recording = rec.path
+	}
+
+	// Only the sessions with the IDs given by the clients can be observed, as they're looked up by the IDs.
+	if requestInfo.SessionID != "" {
+		observers = handler.observersOf(observers, requestInfo)
 	}
 
 	// Create a new connection for the session.
 	sessConn := &Connection{
-		conn: conn,
-		sess: sess,
+		terminal: terminal{sess: sess, recording: rec, size: size},
+		conn:     conn,
 		// Create a new command logger.
-		cmdLogger: createCmdLogger(requestLogger, requestInfo),
-		errCh:     make(chan error, 1),
-		doneCh:    make(chan struct{}),
+		cmdLogger:   createCmdLogger(requestLogger, requestInfo),
+		errCh:       make(chan error, 1),
+		doneCh:      make(chan struct{}),
+		startTime:   startTime,
+		resume:      resume,
+		observers:   observers,
+		sessID:      sessID,
+		requestInfo: requestInfo,
+		tty:         requestInfo.Tty,
+		// The input of copies is a tar stream, and the one of port forwards is the forward frames, rather than commands.
+		rawInput: requestInfo.Copy != nil || requestInfo.Forward != nil,
+	}
+
+	// Only the interactive sessions can be kept open by the user.
+	if requestInfo.Interactive {
+		sessConn.idleWarning = handler.config.SessionConfig.IdleWarning
 	}
 	defer sessConn.cmdLogger.Destroy()
 
+	// Watermark the terminal output of sensitive targets, the output of commands without a terminal is left
+	// intact as it may be binary.
+	if interval, ok := handler.config.SessionConfig.watermarkInterval(authz.sensitivity); ok && requestInfo.Tty {
+		sessConn.watermark = watermark.NewWriter(nil, watermark.Mark{User: requestInfo.UserName, SessionID: sessID}, interval)
+	}
+
+	if requestInfo.BreakGlass {
+		handler.showBreakGlassBanner(conn, requestInfo.Tty)
+	}
+
+	// The input typed while the new session awaited its witness isn't run.
+	if witnessed {
+		if err = sessConn.discardTypedAhead(); err != nil {
+			requestLogger.Warnln("Discard input typed ahead error: ", err)
+		}
+	}
+
+	sessConn.active()
+
+	// Re-apply the terminal size of the reused session, the size may be pending when the client disconnected.
+	sessConn.applySize()
+
+	// Take over the output of the session from the previous connection, and replay the output buffered meanwhile.
+	if resume != nil {
+		resume.attach(sessConn)
+
+		if err = sessConn.replay(resume.take(false, false)); err != nil {
+			requestLogger.Warnln("Replay buffered output error: ", err)
+		}
+	}
+
+	handler.lock.Lock()
+	handler.connections[sessConn] = struct{}{}
+	handler.serving++
+	shuttingDown := handler.shuttingDown
+	handler.lock.Unlock()
+
+	defer handler.served()
+
+	// The session established while the agent is shutting down is terminated right away.
+	if shuttingDown {
+		sessConn.terminate(client.TerminationAgentShutdown)
+	}
+
 	// Start the input, output, and error processing goroutines.
-	go sessConn.processRemoteInput()
-	go sessConn.processLocalOutput()
-	go sessConn.processLocalError()
+	monitor.Go("session_input", sessConn.processRemoteInput)
+	monitor.Go("session_output", sessConn.processLocalOutput)
+	monitor.Go("session_error", sessConn.processLocalError)
+	monitor.Go("session_keepalive", func() {
+		sessConn.keepAlive(handler.config.NetworkConfig.pingPeriod())
+	})
+	monitor.Go("session_limits", func() {
+		sessConn.enforceLimits(handler.config.SessionConfig.IdleTimeout, handler.config.SessionConfig.MaxDuration)
+	})
 
 	// Wait for an error to occur.
 	err = <-sessConn.errCh
 
 	handler.lock.Lock()
+	delete(handler.connections, sessConn)
+
 	if err != nil {
 		// Client is closed abnormally.
 		// Append stale session to list for delay release.
@@ -262,6 +700,13 @@ func (handler *Handler) Handle(w http.ResponseWriter, r *http.Request) {
 			sess:             sess,
 			deathClock:       time.After(handler.config.SessionConfig.DelayReleaseSessionTimeout),
 			isSidecarSession: isSidecarSession,
+			startTime:        startTime,
+			requestInfo:      requestInfo,
+			runtime:          runtime,
+			size:             sessConn.lastSize(),
+			recording:        rec,
+			resume:           resume,
+			observers:        observers,
 		}
 
 		requestLogger.Infof("reserve session %s\n", sessID)
@@ -269,72 +714,330 @@ func (handler *Handler) Handle(w http.ResponseWriter, r *http.Request) {
 		// Do cleanup.
 		err = handler.releaseSession(sessID, sess)
 		if err == nil && isSidecarSession {
-			handler.currentSidecarNum--
+			handler.sidecars.release(sessConf.ContainerID)
 		}
+
+		rec.close()
 	}
 	handler.lock.Unlock()
 
 	if err != nil {
 		requestLogger.Infoln("session disconnected with err: ", err)
-	} else {
-		requestLogger.Infoln("session disconnected")
+
+		return
+	}
+
+	requestLogger.Infoln("session disconnected")
+
+	reason := sessConn.terminationReason()
+	if reason == "" {
+		reason = client.TerminationClientClose
 	}
+
+	requestInfo.Witnesses = observers.witnessList()
+	recordTermination(requestLogger, requestInfo, sess, sessID, runtime, reason)
 }
 
-// containerPreCheck does some pre-checks before establishing the session:
-// 1. check if the container runtime is ready.
-// 2. check if the current sidecar container num exceeds the limit.
-func (handler *Handler) containerPreCheck(sessConf *agentSession.Config, runtime agentSession.ContainerRuntime) (bool, error) {
-	var isContainerSidecarSession bool
+// authorization is the decision of the auth handler on a request.
+type authorization struct {
+	sensitivity string
+	// mfa is the challenge of the second factor required by the auth handler.
+	mfa *client.MFAChallenge
+	// latency is how long the auth handler took to decide.
+	latency time.Duration
+}
 
-	err := handler.checkContainerRuntime(sessConf, runtime)
-	if err != nil {
-		return isContainerSidecarSession, err
+// authorize checks if the user has the permission to access the target, breaking the glass if it's allowed while
+// the auth handler is unavailable. The denials are audited, and false is returned for them.
+func (handler *Handler) authorize(requestLogger *logrus.Entry, req *request.Info, remoteAddr string) (*authorization, bool) {
+	authz := &authorization{}
+
+	authHandler := handler.authHandlerOf(req)
+	if authHandler == nil {
+		return authz, true
 	}
 
-	return handler.checkSidecarNum(sessConf, runtime)
+	authStart := time.Now()
+	authResult := authHandler.VerifyAccessPermission(req)
+	authz.latency = time.Since(authStart)
+
+	req.Sensitivity = authResult.Sensitivity
+
+	switch {
+	case authResult.Code == auth.Success:
+		authz.sensitivity = authResult.Sensitivity
+		authz.mfa = authResult.MFA
+	case authResult.Code == auth.Unavailable && handler.config.AuthConfig.BreakGlass.Allows(req.UserName):
+		requestLogger.Warnf("auth handler is unavailable, break the glass for %s: %s", req.UserName, authResult.ErrMsg)
+
+		req.BreakGlass = true
+	default:
+		requestLogger.Errorf("authorization failed:%v", authResult)
+		auditDenial(req, remoteAddr, authResult.DenialReason(), authResult.ErrMsg, authz.latency)
+
+		return nil, false
+	}
+
+	return authz, true
 }
 
-// checkContainerRuntime checks if the container runtime is ready.
-func (handler *Handler) checkContainerRuntime(sessConf *agentSession.Config, runtime agentSession.ContainerRuntime) error {
-	var err error
-	// In case of when trust-tunnel-agent starts,the container daemon is not ready,but after some time the container daemon is ready again,
-	if sessConf.TargetType == client.TargetContainer && (runtime == agentSession.Docker) && handler.dockerClient == nil {
-		handler.dockerClient, err = sessionutil.CreateDockerClient(handler.config.ContainerConfig.Endpoint, handler.config.ContainerConfig.DockerAPIVersion)
-		if err != nil {
-			return err
-		}
-	} else if runtime == agentSession.Containerd && handler.containerdClient == nil {
-		handler.containerdClient, err = containerd.New(handler.config.ContainerConfig.Endpoint)
-		if err != nil {
-			return err
+// newSessionConfig creates a session configuration from the request information.
+func (handler *Handler) newSessionConfig(requestInfo *request.Info, sessID string) *agentSession.Config {
+	env, _ := handler.config.SessionConfig.forwardEnv(requestInfo.Env)
+	sessConf := &agentSession.Config{
+		TargetType:          requestInfo.TargetType,
+		UserName:            requestInfo.UserName,
+		LoginName:           requestInfo.LoginName,
+		LoginGroup:          requestInfo.LoginGroup,
+		ContainerID:         requestInfo.ContainerID,
+		Cmd:                 requestInfo.Cmd,
+		Shell:               requestInfo.Shell,
+		Tools:               requestInfo.Tools,
+		Tty:                 requestInfo.Tty,
+		Env:                 env,
+		Logs:                requestInfo.Logs,
+		File:                requestInfo.File,
+		FileMaxBytes:        handler.config.FileConfig.withDefaults().MaxBytes,
+		Verb:                sessionVerb(requestInfo),
+		VerbCheckPath:       handler.config.FileConfig.checkPath,
+		Copy:                requestInfo.Copy,
+		CopyMaxBytes:        handler.config.CopyConfig.withDefaults().MaxBytes,
+		CopyCheckPath:       handler.config.CopyConfig.checkPath,
+		Forward:             requestInfo.Forward,
+		ForwardMaxStreams:   handler.config.ForwardConfig.withDefaults().MaxStreams,
+		Interactive:         requestInfo.Interactive,
+		FrameSize:           handler.frameSize(requestInfo),
+		PhysTunnel:          handler.config.SessionConfig.PhysTunnel,
+		SidecarImage:        handler.sidecarImageOf(requestInfo),
+		ImageHubAuth:        handler.config.SidecarConfig.ImageHubAuth,
+		SidecarImageTarball: handler.config.SidecarConfig.ImageTarball,
+		Cpus:                requestInfo.Cpus,
+		MemoryMB:            requestInfo.MemoryMB,
+		DisableCleanMode:    requestInfo.DisableCleanMode,
+		RootfsPrefix:        handler.config.ContainerConfig.RootfsPrefix,
+		ContainerNamespace:  handler.config.ContainerConfig.Namespace,
+		CleanMode:           handler.config.ContainerConfig.CleanMode,
+		CgroupRoot:          handler.config.ContainerConfig.CgroupRoot,
+		PausedWait:          handler.config.ContainerConfig.PausedWaitTimeout,
+		LegacyCdRewrite:     handler.config.ContainerConfig.LegacyCdRewrite,
+		Security:            handler.config.SecurityConfig,
+	}
+
+	// The commands of break-glass sessions are always audited.
+	if handler.config.SessionConfig.ExecAudit || requestInfo.BreakGlass {
+		sessConf.OnExec = func(p proctrack.Process) {
+			auditExec(requestInfo, sessID, p)
 		}
 	}
 
-	return nil
+	return sessConf
 }
 
-// checkSidecarNum checks if current sidecar num exceeds the limit.
-func (handler *Handler) checkSidecarNum(sessConf *agentSession.Config, runtime agentSession.ContainerRuntime) (bool, error) {
-	var isContainerSidecarSession bool
+// establishSession establishes a new session, and returns whether a sidecar is attached to the container for it.
+// The error is wrapped with its code.
+func (handler *Handler) establishSession(requestLogger *logrus.Entry, sessConf *agentSession.Config, sessID, runtime string) (agentSession.Session, bool, error) {
+	var (
+		// Check if the session needs to attach a sidecar to the container.
+		isSidecarSession bool
+
+		dockerClient     dockerAPIClient.CommonAPIClient
+		containerdClient *containerd.Client
+		runtimeClients   *runtimeClients
+		err              error
+	)
+
+	start := time.Now()
+
+	if sessConf.TargetType == client.TargetContainer {
+		// The clients are kept open for the session until it's released, even if they're replaced meanwhile.
+		if runtimeClients, err = handler.runtime.acquire(); err == nil {
+			dockerClient, containerdClient = runtimeClients.docker, runtimeClients.containerd
+		}
+
+		// Reserve the sidecar before it's created, it's released if the session fails.
+		if err == nil && needsSidecar(sessConf, handler.config.ContainerConfig.ContainerRuntime) {
+			if err = handler.sidecars.acquire(sessConf.ContainerID); err == nil {
+				isSidecarSession = true
+			}
+		}
 
-	if runtime == agentSession.Docker {
-		if !sessConf.DisableCleanMode {
-			isContainerSidecarSession = true
-			// if current sidecar num exceed the limit,just return error.
-			if handler.currentSidecarNum >= handler.config.SidecarConfig.Limit {
-				return isContainerSidecarSession, fmt.Errorf("current sidecar num exceed the limit: %d,%d ", handler.currentSidecarNum, handler.config.SidecarConfig.Limit)
+		if err != nil {
+			if runtimeClients != nil {
+				handler.runtime.release(runtimeClients)
 			}
+
+			errMsg := sessionutil.WrapContainerError(err.Error(), sessConf.ContainerID)
+			monitor.IncWithSessionID(monitor.MetricsEstablishSessionError.WithLabelValues(sessionutil.ErrorCode(errMsg), runtime), sessID)
+			errMsg = sessionutil.WrapErrorWithCode(errMsg)
+			requestLogger.Error(errMsg)
+
+			return nil, false, errors.New(errMsg)
+		}
+	}
+
+	sess, err := agentSession.EstablishSession(sessConf, dockerClient, containerdClient, handler.config.ContainerConfig.ContainerRuntime)
+	if err != nil {
+		requestLogger.Warnf("Establish session error: %v", err)
+
+		if runtimeClients != nil {
+			handler.runtime.release(runtimeClients)
+		}
+
+		if isSidecarSession {
+			handler.sidecars.release(sessConf.ContainerID)
 		}
+
+		monitor.IncWithSessionID(monitor.MetricsEstablishSessionError.WithLabelValues(sessionutil.ErrorCode(err.Error()), runtime), sessID)
+		errMsg := sessionutil.WrapErrorWithCode(err.Error())
+		requestLogger.Error(errMsg)
+
+		return nil, false, errors.New(errMsg)
+	}
+
+	monitor.IncWithSessionID(monitor.MetricsEstablishSessionSuccess.WithLabelValues(runtime), sessID)
+	monitor.ObserveWithSessionID(monitor.MetricsEstablishSessionRt.WithLabelValues(runtime), float64(time.Since(start).Milliseconds()), sessID)
+
+	if runtimeClients != nil {
+		handler.runtime.bind(sess, runtimeClients)
+	}
+
+	requestLogger.Infoln("new session established")
+
+	return sess, isSidecarSession, nil
+}
+
+// defaultShutdownTimeout is how long the agent waits for the terminated sessions by default when it's shutting down.
+const defaultShutdownTimeout = 10 * time.Second
+
+// Shutdown terminates the active sessions for the agent is shutting down, and waits for their terminations
+// to be recorded up to the shutdown timeout. The sessions established afterwards are terminated right away.
+func (handler *Handler) Shutdown() {
+	handler.lock.Lock()
+	connections := make([]*Connection, 0, len(handler.connections))
+
+	for sessConn := range handler.connections {
+		connections = append(connections, sessConn)
+	}
+
+	handler.shuttingDown = true
+	drained := make(chan struct{})
+
+	if handler.serving == 0 {
+		close(drained)
+	} else {
+		handler.drained = drained
+	}
+	handler.lock.Unlock()
+
+	for _, sessConn := range connections {
+		sessConn.terminate(client.TerminationAgentShutdown)
+	}
+
+	// Wait for the terminations to be recorded and audited, as the agent exits after the shutdown.
+	timeout := handler.config.SessionConfig.ShutdownTimeout
+	if timeout <= 0 {
+		timeout = defaultShutdownTimeout
+	}
+
+	select {
+	case <-drained:
+	case <-time.After(timeout):
+		logger.Warnf("%d sessions aren't recorded as terminated in %v before the agent exits", handler.servingCount(), timeout)
+	}
+}
+
+// served marks a connection as recorded as terminated.
+func (handler *Handler) served() {
+	handler.lock.Lock()
+	defer handler.lock.Unlock()
+
+	handler.serving--
+	if handler.serving == 0 && handler.drained != nil {
+		close(handler.drained)
+		handler.drained = nil
+	}
+}
+
+// servingCount returns the number of the connections not yet recorded as terminated.
+func (handler *Handler) servingCount() int {
+	handler.lock.Lock()
+	defer handler.lock.Unlock()
+
+	return handler.serving
+}
+
+// status fills the session and runtime states of the handler in the agent status.
+func (handler *Handler) status(status *monitor.Status) {
+	handler.lock.Lock()
+	status.ActiveSessions = len(handler.connections)
+	status.StaleSessions = len(handler.staleSessions)
+	status.Sidecars = handler.sidecars.count()
+	handler.lock.Unlock()
+
+	status.Instance = handler.affinity.Instance
+	status.SidecarLimit = handler.config.SidecarConfig.Limit
+	status.ContainerRuntime = string(handler.config.ContainerConfig.ContainerRuntime)
+	status.RuntimeHealthy = true
+
+	if err := handler.runtime.ready(); err != nil {
+		status.RuntimeHealthy = false
+		status.RuntimeError = err.Error()
+	}
+}
+
+// runtimeLabel returns the runtime label of session metrics, "host" for physical hosts.
+func (handler *Handler) runtimeLabel(sessConf *agentSession.Config) string {
+	if sessConf.TargetType == client.TargetPhys {
+		return "host"
 	}
 
-	return false, nil
+	return string(handler.config.ContainerConfig.ContainerRuntime)
+}
+
+// checkSidecarQuota checks if a sidecar is available for the new session, setting the occupancy and the retry
+// hint in the response header if not.
+func (handler *Handler) checkSidecarQuota(requestLogger *logrus.Entry, header http.Header, sessConf *agentSession.Config, sessID, runtime string) error {
+	if sessConf.TargetType != client.TargetContainer || !needsSidecar(sessConf, handler.config.ContainerConfig.ContainerRuntime) {
+		return nil
+	}
+
+	err := handler.sidecars.check(sessConf.ContainerID, header)
+	if err == nil {
+		return nil
+	}
+
+	errMsg := sessionutil.WrapContainerError(err.Error(), sessConf.ContainerID)
+	monitor.IncWithSessionID(monitor.MetricsEstablishSessionError.WithLabelValues(sessionutil.ErrorCode(errMsg), runtime), sessID)
+	errMsg = sessionutil.WrapErrorWithCode(errMsg)
+	requestLogger.Warn(errMsg)
+
+	return errors.New(errMsg)
+}
+
+// frameSize returns the size of the output frames of the session of the request.
+func (handler *Handler) frameSize(info *request.Info) int {
+	return handler.config.NetworkConfig.frameSize(info.FrameProfile, info.FrameSize)
+}
+
+// upgraderOf returns the upgrader of the session of the request, whose write buffers fit its output frames.
+func (handler *Handler) upgraderOf(info *request.Info) *websocket.Upgrader {
+	if defaultSize, _ := handler.config.NetworkConfig.frameSizes(); handler.frameSize(info) > defaultSize {
+		return &handler.bulkUpgrader
+	}
+
+	return &handler.upgrader
+}
+
+// needsSidecar returns whether a sidecar is attached to the container for the session.
+// The logs are streamed from the runtime, and the files, the verbs and the port forwards are read, run and dialed by
+// the agent, without a sidecar.
+func needsSidecar(sessConf *agentSession.Config, runtime agentSession.ContainerRuntime) bool {
+	return sessConf.Logs == nil && sessConf.File == nil && sessConf.Verb == nil && sessConf.Copy == nil && sessConf.Forward == nil && runtime == agentSession.Docker && sessConf.CleanMode != agentSession.CleanModeNsexec && !sessConf.DisableCleanMode
 }
 
 // createCmdLogger creates a new CmdLogger with the given logger and request information.
 func createCmdLogger(logger *logrus.Entry, req *request.Info) *logutil.CmdLogger {
 	fields := logrus.Fields{
-		"session_id":         req.SessionID,
 		"user_name":          req.UserName,
 		"login_name":         req.LoginName,
 		"target_type":        req.TargetType,
@@ -345,9 +1048,22 @@ func createCmdLogger(logger *logrus.Entry, req *request.Info) *logutil.CmdLogger
 		"cpus":               req.Cpus,
 		"memoryMB":           req.MemoryMB,
 		"disable_clean_mode": req.DisableCleanMode,
+		"break_glass":        req.BreakGlass,
+	}
+
+	if len(req.Tags) > 0 {
+		fields["tags"] = req.Tags
 	}
 	logger = logger.WithFields(fields)
-	cmdLogger := logutil.NewCmdLogger(logger)
+
+	// Reconstruct the command lines from the keystrokes in terminals.
+	var cmdLogger *logutil.CmdLogger
+	if req.Tty {
+		cmdLogger = logutil.NewTTYCmdLogger(logger)
+	} else {
+		cmdLogger = logutil.NewCmdLogger(logger)
+	}
+
 	logger.Debugf("InitCmd: %#v", req.Cmd)
 
 	return cmdLogger
@@ -357,9 +1073,5 @@ func createCmdLogger(logger *logrus.Entry, req *request.Info) *logutil.CmdLogger
 // All control frames MUST have a payload length of 125 bytes or fewer and MUST NOT be fragmented.
 // Two bytes reserved for the close code,so we have 123 bytes left for the error message.
 func truncWebsocketErrMsg(errMsg string) string {
-	if len(errMsg) > maxWebsocketControlMsgLength {
-		errMsg = errMsg[0:maxWebsocketControlMsgLength]
-	}
-
-	return errMsg
+	return protocol.TruncateClosePayload(errMsg)
 }
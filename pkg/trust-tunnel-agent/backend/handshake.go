@@ -0,0 +1,257 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	"trust-tunnel/pkg/common/sessionutil"
+	"trust-tunnel/pkg/trust-tunnel-agent/monitor"
+)
+
+// handshakeErrorPrefix is the prefix of the handshake errors logged by net/http.
+const handshakeErrorPrefix = "http: TLS handshake error from "
+
+// HandshakeFailure is the audit log of a failed TLS or NTLS handshake, which may be a probe or a misconfigured
+// client.
+type HandshakeFailure struct {
+	Event    string `json:"event"`
+	Listener string `json:"listener"`
+	Protocol string `json:"protocol"`
+	SrcIP    string `json:"src_ip"`
+	SrcPort  int    `json:"src_port"`
+	// ServerName is the SNI sent by the client.
+	ServerName string `json:"server_name,omitempty"`
+	// Versions and Ciphers are offered by the client.
+	Versions []string `json:"versions,omitempty"`
+	Ciphers  []string `json:"ciphers,omitempty"`
+	// Cipher is negotiated before the failure, which is known only for NTLS.
+	Cipher string `json:"cipher,omitempty"`
+	// Reason classifies Message, e.g. "bad_certificate" or "not_tls".
+	Reason    string `json:"reason"`
+	Message   string `json:"message"`
+	GmtCreate string `json:"gmt_create"`
+}
+
+// HandshakeAuditor audits the failed handshakes of a listener to the audit log and counts them by the reason.
+type HandshakeAuditor struct {
+	listener string
+	// hellos are the TLS ClientHellos of the connections being served, by the remote addresses.
+	hellos sync.Map
+}
+
+// NewHandshakeAuditor creates the auditor of the handshakes of the listener, e.g. "session" or "monitor".
+func NewHandshakeAuditor(listener string) *HandshakeAuditor {
+	return &HandshakeAuditor{listener: listener}
+}
+
+// Hook hooks the TLS server to record the ClientHellos and to audit the handshake errors logged by it.
+func (a *HandshakeAuditor) Hook(server *http.Server) {
+	if server.TLSConfig == nil {
+		return
+	}
+
+	getConfig := server.TLSConfig.GetConfigForClient
+	server.TLSConfig.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		a.hellos.Store(hello.Conn.RemoteAddr().String(), hello)
+
+		if getConfig != nil {
+			return getConfig(hello)
+		}
+
+		return nil, nil
+	}
+
+	// The handshake errors are logged before the connections are closed.
+	connState := server.ConnState
+	server.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state != http.StateNew {
+			a.hellos.Delete(conn.RemoteAddr().String())
+		}
+
+		if connState != nil {
+			connState(conn, state)
+		}
+	}
+
+	server.ErrorLog = log.New(a, "", 0)
+}
+
+// Write audits the handshake errors logged by the server, the other errors are logged as they are.
+func (a *HandshakeAuditor) Write(p []byte) (int, error) {
+	line := strings.TrimSpace(string(p))
+
+	rest, ok := strings.CutPrefix(line, handshakeErrorPrefix)
+	if !ok {
+		logger.Warn(line)
+
+		return len(p), nil
+	}
+
+	addr, message, _ := strings.Cut(rest, ": ")
+	failure := a.newFailure("tls", addr, message)
+
+	if v, ok := a.hellos.Load(addr); ok {
+		hello := v.(*tls.ClientHelloInfo)
+		failure.ServerName = hello.ServerName
+
+		for _, version := range hello.SupportedVersions {
+			failure.Versions = append(failure.Versions, tls.VersionName(version))
+		}
+
+		for _, cipher := range hello.CipherSuites {
+			failure.Ciphers = append(failure.Ciphers, tls.CipherSuiteName(cipher))
+		}
+	}
+
+	auditHandshakeFailure(failure)
+
+	return len(p), nil
+}
+
+// WrapNTLS wraps the NTLS listener to audit the failed handshakes. The handshakes are done on the first reads or
+// writes of the connections, which are served by the HTTP server without knowing NTLS.
+func (a *HandshakeAuditor) WrapNTLS(l net.Listener) net.Listener {
+	return &ntlsListener{Listener: l, auditor: a}
+}
+
+// newFailure creates the audit log of the failed handshake with the peer and the error.
+func (a *HandshakeAuditor) newFailure(protocol, addr, message string) *HandshakeFailure {
+	failure := &HandshakeFailure{
+		Event:     "handshake_failed",
+		Listener:  a.listener,
+		Protocol:  protocol,
+		Reason:    handshakeFailureReason(message),
+		Message:   message,
+		GmtCreate: time.Now().Format("2006.01.02 15:04:05"),
+	}
+	failure.SrcIP, failure.SrcPort = sessionutil.SplitHostPort(addr)
+
+	return failure
+}
+
+// auditHandshakeFailure prints the audit log of the failed handshake and counts it.
+func auditHandshakeFailure(failure *HandshakeFailure) {
+	monitor.MetricsHandshakeFailures.WithLabelValues(failure.Listener, failure.Protocol, failure.Reason).Inc()
+
+	if b, err := json.Marshal(failure); err == nil {
+		auditLogger.Info(string(b))
+	}
+}
+
+// handshakeFailureReason classifies the handshake error of Go crypto or Tongsuo into a few reasons.
+func handshakeFailureReason(message string) string {
+	m := strings.ToLower(message)
+
+	switch {
+	case strings.Contains(m, "eof") || strings.Contains(m, "connection reset") || strings.Contains(m, "broken pipe"):
+		return "eof"
+	case strings.Contains(m, "timeout"):
+		return "timeout"
+	case strings.Contains(m, "does not look like a tls handshake") || strings.Contains(m, "wrong version number") ||
+		strings.Contains(m, "http request"):
+		return "not_tls"
+	case strings.Contains(m, "didn't provide a certificate") || strings.Contains(m, "did not return a certificate") ||
+		strings.Contains(m, "certificate required"):
+		return "no_client_cert"
+	case strings.Contains(m, "certificate") || strings.Contains(m, "unknown ca") || strings.Contains(m, "x509"):
+		return "bad_certificate"
+	case strings.Contains(m, "protocol version") || strings.Contains(m, "unsupported version"):
+		return "protocol_version"
+	case strings.Contains(m, "cipher"):
+		return "no_shared_cipher"
+	default:
+		return "other"
+	}
+}
+
+// handshaker is implemented by the NTLS connections.
+type handshaker interface {
+	Handshake() error
+	GetVersion() (string, error)
+	CurrentCipher() (string, error)
+}
+
+// ntlsListener audits the failed handshakes of the accepted NTLS connections.
+type ntlsListener struct {
+	net.Listener
+	auditor *HandshakeAuditor
+}
+
+func (l *ntlsListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	if _, ok := conn.(handshaker); !ok {
+		return conn, nil
+	}
+
+	return &ntlsConn{Conn: conn, auditor: l.auditor}, nil
+}
+
+// ntlsConn does the handshake explicitly before the first read or write, so that its failure can be audited.
+type ntlsConn struct {
+	net.Conn
+	auditor *HandshakeAuditor
+	once    sync.Once
+	err     error
+}
+
+// handshake does the handshake once, and returns its error.
+func (c *ntlsConn) handshake() error {
+	c.once.Do(func() {
+		conn := c.Conn.(handshaker)
+		if c.err = conn.Handshake(); c.err == nil {
+			return
+		}
+
+		failure := c.auditor.newFailure("ntls", c.RemoteAddr().String(), c.err.Error())
+		if version, err := conn.GetVersion(); err == nil {
+			failure.Versions = []string{version}
+		}
+
+		if cipher, err := conn.CurrentCipher(); err == nil {
+			failure.Cipher = cipher
+		}
+
+		auditHandshakeFailure(failure)
+	})
+
+	return c.err
+}
+
+func (c *ntlsConn) Read(b []byte) (int, error) {
+	if err := c.handshake(); err != nil {
+		return 0, err
+	}
+
+	return c.Conn.Read(b)
+}
+
+func (c *ntlsConn) Write(b []byte) (int, error) {
+	if err := c.handshake(); err != nil {
+		return 0, err
+	}
+
+	return c.Conn.Write(b)
+}
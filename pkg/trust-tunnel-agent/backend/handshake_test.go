@@ -0,0 +1,117 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+// entryHook keeps the logged entries.
+type entryHook struct {
+	entries []*logrus.Entry
+}
+
+func (h *entryHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (h *entryHook) Fire(entry *logrus.Entry) error {
+	h.entries = append(h.entries, entry)
+
+	return nil
+}
+
+func TestHandshakeFailureReason(t *testing.T) {
+	tests := map[string]string{
+		"EOF": "eof",
+		"read tcp 10.0.0.2:8000->10.0.0.1:4567: i/o timeout":                                        "timeout",
+		"client sent an HTTP request to an HTTPS server":                                            "not_tls",
+		"tls: first record does not look like a TLS handshake":                                      "not_tls",
+		"tls: client didn't provide a certificate":                                                  "no_client_cert",
+		"tls: failed to verify certificate: x509: certificate signed by unknown authority":          "bad_certificate",
+		"tls: client offered only unsupported versions: [301]":                                      "protocol_version",
+		"tls: no cipher suite supported by both client and server":                                  "no_shared_cipher",
+		"SSL errors: SSL routines:tls_process_client_certificate:peer did not return a certificate": "no_client_cert",
+		"something else": "other",
+	}
+
+	for message, want := range tests {
+		if got := handshakeFailureReason(message); got != want {
+			t.Errorf("handshakeFailureReason(%q) = %s, want %s", message, got, want)
+		}
+	}
+}
+
+func TestHandshakeAuditorWrite(t *testing.T) {
+	hook := &entryHook{}
+	hooks := auditLogger.ReplaceHooks(logrus.LevelHooks{})
+
+	defer auditLogger.ReplaceHooks(hooks)
+
+	auditLogger.AddHook(hook)
+
+	a := NewHandshakeAuditor("session")
+	a.hellos.Store("10.0.0.1:4567", &tls.ClientHelloInfo{
+		ServerName:        "agent.example.com",
+		SupportedVersions: []uint16{tls.VersionTLS13},
+		CipherSuites:      []uint16{tls.TLS_AES_128_GCM_SHA256},
+	})
+
+	line := "http: TLS handshake error from 10.0.0.1:4567: tls: client didn't provide a certificate\n"
+	if _, err := a.Write([]byte(line)); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(hook.entries) != 1 {
+		t.Fatalf("got %d audit logs, want 1", len(hook.entries))
+	}
+
+	var failure HandshakeFailure
+	if err := json.Unmarshal([]byte(hook.entries[0].Message), &failure); err != nil {
+		t.Fatal(err)
+	}
+
+	failure.GmtCreate = ""
+
+	want := HandshakeFailure{
+		Event:      "handshake_failed",
+		Listener:   "session",
+		Protocol:   "tls",
+		SrcIP:      "10.0.0.1",
+		SrcPort:    4567,
+		ServerName: "agent.example.com",
+		Versions:   []string{"TLS 1.3"},
+		Ciphers:    []string{"TLS_AES_128_GCM_SHA256"},
+		Reason:     "no_client_cert",
+		Message:    "tls: client didn't provide a certificate",
+	}
+	if !reflect.DeepEqual(failure, want) {
+		t.Errorf("got %+v, want %+v", failure, want)
+	}
+
+	// The other errors aren't audited.
+	if _, err := a.Write([]byte("http: Accept error: too many open files\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(hook.entries) != 1 {
+		t.Errorf("got %d audit logs, want 1", len(hook.entries))
+	}
+}
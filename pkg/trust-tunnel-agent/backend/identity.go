@@ -0,0 +1,51 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"trust-tunnel/pkg/trust-tunnel-agent/backend/request"
+	"trust-tunnel/pkg/trust-tunnel-agent/enroll"
+)
+
+// bindIdentity checks the user of the request against the verified client certificate, so that a user can't act as
+// another by naming it in the request, e.g. in the User-Name header or the body of /run. The auth handlers, including
+// LDAP, and the break-glass users all decide on the bound user then. The certificates are bound if they're issued by
+// the enrollment server, or if bind_user_to_cert is set, except the ones of the jump agents listed in cert_proxies.
+func (handler *Handler) bindIdentity(r *http.Request, info *request.Info) error {
+	c := &handler.config.AuthConfig
+
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		if c.BindUserToCert {
+			return fmt.Errorf("verified client certificate is required to identify the user")
+		}
+
+		return nil
+	}
+
+	cert := r.TLS.VerifiedChains[0][0]
+
+	if !enroll.Enrolled(cert) && (!c.BindUserToCert || slices.Contains(c.CertProxies, cert.Subject.CommonName)) {
+		return nil
+	}
+
+	if info.UserName != cert.Subject.CommonName {
+		return fmt.Errorf("user %q isn't the one of the client certificate %q", info.UserName, cert.Subject.CommonName)
+	}
+
+	return nil
+}
@@ -0,0 +1,73 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"trust-tunnel/pkg/trust-tunnel-agent/auth"
+	"trust-tunnel/pkg/trust-tunnel-agent/backend/request"
+)
+
+func TestBindIdentity(t *testing.T) {
+	enrolled := &x509.Certificate{
+		Subject: pkix.Name{CommonName: "alice"},
+		URIs:    []*url.URL{{Scheme: "urn", Opaque: "trust-tunnel:enrolled"}},
+	}
+	issued := &x509.Certificate{Subject: pkix.Name{CommonName: "alice"}}
+	proxy := &x509.Certificate{Subject: pkix.Name{CommonName: "trust-tunnel-agent"}}
+
+	tests := []struct {
+		name    string
+		config  auth.Config
+		cert    *x509.Certificate
+		user    string
+		wantErr bool
+	}{
+		{name: "enrolled", cert: enrolled, user: "alice"},
+		{name: "enrolled as another user", cert: enrolled, user: "bob", wantErr: true},
+		{name: "not bound", cert: issued, user: "bob"},
+		{name: "no certificate", user: "bob"},
+		{name: "bound", config: auth.Config{BindUserToCert: true}, cert: issued, user: "alice"},
+		{name: "bound as another user", config: auth.Config{BindUserToCert: true}, cert: issued, user: "bob", wantErr: true},
+		{name: "bound without certificate", config: auth.Config{BindUserToCert: true}, user: "alice", wantErr: true},
+		{
+			name:   "proxy",
+			config: auth.Config{BindUserToCert: true, CertProxies: []string{"trust-tunnel-agent"}},
+			cert:   proxy,
+			user:   "bob",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := &Handler{config: &Config{AuthConfig: tt.config}}
+
+			r := httptest.NewRequest("GET", "/", nil)
+			if tt.cert != nil {
+				r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{tt.cert}}}
+			}
+
+			err := handler.bindIdentity(r, &request.Info{UserName: tt.user})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("got error %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
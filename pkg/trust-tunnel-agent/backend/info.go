@@ -0,0 +1,213 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"encoding/json"
+	"net/http"
+	"trust-tunnel/pkg/trust-tunnel-agent/monitor"
+	"trust-tunnel/pkg/trust-tunnel-client/fips"
+	"trust-tunnel/pkg/trust-tunnel-client/protocol"
+
+	agentSession "trust-tunnel/pkg/trust-tunnel-agent/session"
+)
+
+// AgentInfo is the inventory and the capabilities of the agent responded by GET /info, so that the orchestration
+// layers can discover what each agent of a fleet of mixed versions serves. The features and the limits unknown to
+// an agent are absent, which is the same as disabled.
+type AgentInfo struct {
+	Version  string          `json:"version"`
+	Instance string          `json:"instance"`
+	Protocol ProtocolInfo    `json:"protocol"`
+	Runtimes RuntimesInfo    `json:"runtimes"`
+	Features map[string]bool `json:"features"`
+	// FIPS is the FIPS mode of the crypto, "boringcrypto" or "restricted", absent if it's off.
+	FIPS string `json:"fips,omitempty"`
+	// Verbs are the names of the verbs served.
+	Verbs  []string   `json:"verbs"`
+	Limits LimitsInfo `json:"limits"`
+}
+
+// ProtocolInfo describes the wire protocol served by the agent.
+type ProtocolInfo struct {
+	Name string `json:"name"`
+	// Versions are the versions of the protocol served.
+	Versions []int `json:"versions"`
+	// Endpoints are the paths of the HTTP endpoints served.
+	Endpoints []string `json:"endpoints"`
+}
+
+// RuntimesInfo describes the runtimes the sessions are established with.
+type RuntimesInfo struct {
+	// Container is the container runtime, "docker" or "containerd".
+	Container string `json:"container"`
+	// PhysTunnel is the way to establish the sessions to the physical host, "nsenter" or "sshd".
+	PhysTunnel string `json:"phys_tunnel"`
+}
+
+// LimitsInfo describes the limits of the agent, zero means unlimited.
+type LimitsInfo struct {
+	Sidecars             int   `json:"sidecars"`
+	SidecarsPerContainer int   `json:"sidecars_per_container"`
+	IdleTimeoutSeconds   int64 `json:"idle_timeout_seconds"`
+	MaxDurationSeconds   int64 `json:"max_duration_seconds"`
+	// The limits of POST /run, absent if it's disabled.
+	RunMaxTimeoutSeconds int64 `json:"run_max_timeout_seconds,omitempty"`
+	RunMaxBodyBytes      int64 `json:"run_max_body_bytes,omitempty"`
+	RunMaxOutputBytes    int   `json:"run_max_output_bytes,omitempty"`
+	// FileMaxBytes is the maximum size of the files read by the file verbs, absent if they're disabled.
+	FileMaxBytes int64 `json:"file_max_bytes,omitempty"`
+	// CopyMaxBytes is the maximum total size of the files copied by a session, absent if the copies are disabled.
+	CopyMaxBytes int64 `json:"copy_max_bytes,omitempty"`
+	// ForwardMaxStreams is the maximum number of the connections forwarded by a session at once, absent if the port
+	// forwards are disabled.
+	ForwardMaxStreams int `json:"forward_max_streams,omitempty"`
+	// Tags and TagValueLength are the maximum number of the session tags and the maximum length of their values.
+	Tags           int `json:"tags"`
+	TagValueLength int `json:"tag_value_length"`
+	// CommandLength is the maximum total length of the arguments of the commands.
+	CommandLength int `json:"command_length"`
+	// HeaderBytes is the maximum size of the request headers, absent if it's the default of the HTTP server.
+	HeaderBytes int `json:"header_bytes,omitempty"`
+	// FrameSize and BulkFrameSize are the sizes of the output frames of the default and the bulk profiles, the
+	// latter bounds the sizes requested.
+	FrameSize     int `json:"frame_size"`
+	BulkFrameSize int `json:"bulk_frame_size"`
+}
+
+// Info responds the inventory and the capabilities of the agent in JSON.
+func (handler *Handler) Info(w http.ResponseWriter, _ *http.Request) {
+	info, err := handler.info()
+	if err != nil {
+		logger.Errorf("get agent info error: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(info)
+}
+
+// info collects the inventory and the capabilities of the agent from its configuration.
+func (handler *Handler) info() (*AgentInfo, error) {
+	spec, err := protocol.LoadSpec()
+	if err != nil {
+		return nil, err
+	}
+
+	conf := handler.config
+	info := &AgentInfo{
+		Version:  monitor.Version(),
+		Instance: handler.affinity.Instance,
+		Protocol: ProtocolInfo{
+			Name:      spec.Name,
+			Versions:  protocolVersions(spec.Version),
+			Endpoints: []string{"/exec", "/info"},
+		},
+		Runtimes: RuntimesInfo{
+			Container:  string(conf.ContainerConfig.ContainerRuntime),
+			PhysTunnel: conf.SessionConfig.PhysTunnel,
+		},
+		Features: map[string]bool{
+			"run":              conf.RunConfig.Enabled,
+			"jump":             conf.JumpConfig.Enabled,
+			"logs":             true,
+			"file":             conf.FileConfig.Enabled,
+			"top":              true,
+			"verbs":            conf.VerbConfig.Enabled,
+			"tags":             true,
+			"notify":           len(conf.NotifyConfig.Webhooks) > 0,
+			"tenants":          conf.TenantConfig.Source != "",
+			"break_glass":      conf.AuthConfig.BreakGlass.Enabled,
+			"exec_audit":       conf.SessionConfig.ExecAudit,
+			"exec_tracer_ebpf": conf.SessionConfig.ExecTracer == ExecTracerEBPF,
+			"watermark":        len(conf.SessionConfig.Watermark) > 0,
+			"copy":             conf.CopyConfig.Enabled,
+			"port_forward":     conf.ForwardConfig.Enabled,
+			"reverse_forward":  conf.ForwardConfig.Enabled && conf.ForwardConfig.AllowReverse,
+			"recording":        false,
+			"fips":             fips.Enabled(),
+			"command_frame":    true,
+			"confirm":          true,
+			"observe":          conf.ObserveConfig.Enabled,
+		},
+		FIPS:  fips.Mode(),
+		Verbs: handler.servedVerbs(),
+		Limits: LimitsInfo{
+			Sidecars:             conf.SidecarConfig.Limit,
+			SidecarsPerContainer: conf.SidecarConfig.PerContainerLimit,
+			IdleTimeoutSeconds:   int64(conf.SessionConfig.IdleTimeout.Seconds()),
+			MaxDurationSeconds:   int64(conf.SessionConfig.MaxDuration.Seconds()),
+			Tags:                 conf.TagConfig.withDefaults().MaxTags,
+			TagValueLength:       conf.TagConfig.withDefaults().MaxValueLength,
+			CommandLength:        conf.SessionConfig.maxCommandLength(),
+			HeaderBytes:          conf.NetworkConfig.MaxHeaderBytes,
+		},
+	}
+
+	info.Limits.FrameSize, info.Limits.BulkFrameSize = conf.NetworkConfig.frameSizes()
+
+	if conf.RunConfig.Enabled {
+		run := conf.RunConfig.withDefaults()
+		info.Protocol.Endpoints = append(info.Protocol.Endpoints, "/run")
+		info.Limits.RunMaxTimeoutSeconds = int64(run.MaxTimeout.Seconds())
+		info.Limits.RunMaxBodyBytes = run.MaxBodyBytes
+		info.Limits.RunMaxOutputBytes = run.MaxOutputBytes
+	}
+
+	if conf.FileConfig.Enabled {
+		info.Limits.FileMaxBytes = conf.FileConfig.withDefaults().MaxBytes
+	}
+
+	if conf.CopyConfig.Enabled {
+		info.Limits.CopyMaxBytes = conf.CopyConfig.withDefaults().MaxBytes
+	}
+
+	if conf.ForwardConfig.Enabled {
+		info.Protocol.Endpoints = append(info.Protocol.Endpoints, protocol.ForwardPath)
+		info.Limits.ForwardMaxStreams = conf.ForwardConfig.withDefaults().MaxStreams
+	}
+
+	return info, nil
+}
+
+// servedVerbs returns the names of the verbs served, the top requests aren't counted.
+func (handler *Handler) servedVerbs() []string {
+	verbs := []string{}
+
+	conf := &handler.config.VerbConfig
+	if !conf.Enabled {
+		return verbs
+	}
+
+	for _, name := range agentSession.VerbNames() {
+		if _, err := conf.checkVerb(name); err == nil {
+			verbs = append(verbs, name)
+		}
+	}
+
+	return verbs
+}
+
+// protocolVersions returns the versions of the protocol served, which are all up to the latest.
+func protocolVersions(latest int) []int {
+	versions := make([]int, 0, latest)
+	for v := 1; v <= latest; v++ {
+		versions = append(versions, v)
+	}
+
+	return versions
+}
@@ -0,0 +1,69 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestInfo(t *testing.T) {
+	handler := &Handler{
+		affinity: &affinity{Instance: "agent-a"},
+		config: &Config{
+			SessionConfig: SessionConfig{PhysTunnel: "nsenter", IdleTimeout: 10 * time.Minute},
+			RunConfig:     RunConfig{Enabled: true},
+			VerbConfig:    VerbConfig{Enabled: true, Allowed: []string{"ps", "netdiag"}},
+		},
+	}
+
+	w := httptest.NewRecorder()
+	handler.Info(w, httptest.NewRequest(http.MethodGet, "/info", nil))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d: %s", w.Code, w.Body.String())
+	}
+
+	var info AgentInfo
+	if err := json.Unmarshal(w.Body.Bytes(), &info); err != nil {
+		t.Fatal(err)
+	}
+
+	if info.Instance != "agent-a" || info.Protocol.Name != "trust-tunnel" || len(info.Protocol.Versions) == 0 {
+		t.Errorf("unexpected info %+v", info)
+	}
+
+	if !reflect.DeepEqual(info.Protocol.Endpoints, []string{"/exec", "/info", "/run"}) {
+		t.Errorf("unexpected endpoints %v", info.Protocol.Endpoints)
+	}
+
+	if !info.Features["run"] || info.Features["file"] || info.Features["copy"] {
+		t.Errorf("unexpected features %v", info.Features)
+	}
+
+	if !reflect.DeepEqual(info.Verbs, []string{"netdiag", "ps"}) {
+		t.Errorf("unexpected verbs %v", info.Verbs)
+	}
+
+	// The limits of POST /run are reported with the defaults, and those of the disabled file verbs are absent.
+	if info.Limits.IdleTimeoutSeconds != 600 || info.Limits.RunMaxTimeoutSeconds != 300 || info.Limits.FileMaxBytes != 0 ||
+		info.Limits.FrameSize != 4096 || info.Limits.BulkFrameSize != 64<<10 {
+		t.Errorf("unexpected limits %+v", info.Limits)
+	}
+}
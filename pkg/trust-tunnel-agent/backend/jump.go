@@ -0,0 +1,274 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+	"trust-tunnel/pkg/common/sessionutil"
+	"trust-tunnel/pkg/trust-tunnel-agent/backend/request"
+	"trust-tunnel/pkg/trust-tunnel-agent/monitor"
+	"trust-tunnel/pkg/trust-tunnel-client/protocol"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	headerJumpTarget = "Jump-Target"
+	headerJumpVia    = "Jump-Via"
+
+	jumpDialTimeout = 30 * time.Second
+
+	// errJumpFailed is the message prefix of jump errors, it's mapped to an error code
+	// by sessionutil.WrapErrorWithCode.
+	errJumpFailed = "jump to target agent failed"
+)
+
+// JumpConfig specifies whether and where this agent proxies sessions to other agents as a jump agent,
+// which enables access into isolated network segments reachable only from this agent.
+type JumpConfig struct {
+	// Enabled indicates whether this agent accepts jump requests.
+	Enabled bool `toml:"enabled"`
+
+	// AllowedTargets lists the CIDRs (e.g. "10.1.0.0/16") of the target agents that can be jumped to.
+	AllowedTargets []string `toml:"allowed_targets"`
+
+	// ServerName is the name to verify the certificates of the target agents against, defaults to the host being
+	// dialed, the same as the clients without --tls-server-name.
+	ServerName string `toml:"server_name"`
+
+	// TLSConfig is the TLS configuration for dialing target agents, TLS isn't used if it's nil.
+	TLSConfig *tls.Config `toml:"-"`
+}
+
+// jumper proxies sessions to target agents.
+type jumper struct {
+	config         *JumpConfig
+	allowedTargets []*net.IPNet
+	dialer         *websocket.Dialer
+}
+
+// newJumper creates a jumper from the configuration, returns nil if jumping is disabled.
+func newJumper(config *JumpConfig) (*jumper, error) {
+	if !config.Enabled {
+		return nil, nil
+	}
+
+	if len(config.AllowedTargets) == 0 {
+		return nil, fmt.Errorf("allowed targets are required for jump agent")
+	}
+
+	j := &jumper{
+		config: config,
+		dialer: &websocket.Dialer{
+			TLSClientConfig:  config.TLSConfig,
+			HandshakeTimeout: jumpDialTimeout,
+		},
+	}
+
+	for _, cidr := range config.AllowedTargets {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid allowed target %s: %v", cidr, err)
+		}
+
+		j.allowedTargets = append(j.allowedTargets, ipNet)
+	}
+
+	return j, nil
+}
+
+// checkTarget checks whether the target agent address is allowed to jump to.
+func (j *jumper) checkTarget(target string) error {
+	host, port, err := net.SplitHostPort(target)
+	if err != nil || port == "" {
+		return fmt.Errorf("invalid target %s", target)
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return fmt.Errorf("target %s isn't an IP address", target)
+	}
+
+	for _, ipNet := range j.allowedTargets {
+		if ipNet.Contains(ip) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("target %s isn't allowed", target)
+}
+
+// dial dials the target agent with the request headers of the client, except the websocket handshake ones.
+func (j *jumper) dial(r *http.Request, info *request.Info, via string) (*websocket.Conn, *http.Response, error) {
+	u := url.URL{Scheme: "ws", Host: info.JumpTarget, Path: r.URL.Path}
+	if j.config.TLSConfig != nil {
+		u.Scheme = "wss"
+	}
+
+	header := http.Header{}
+
+	for k, v := range request.Header(r) {
+		switch k {
+		case "Upgrade", "Connection", "Sec-Websocket-Key", "Sec-Websocket-Version", "Sec-Websocket-Extensions", "Sec-Websocket-Protocol", headerJumpTarget:
+			continue
+		}
+
+		header[k] = v
+	}
+
+	host, _ := sessionutil.SplitHostPort(info.JumpTarget)
+	header.Set("Agent-Addr", host)
+	header.Set(headerJumpVia, via)
+
+	// The command frame read by this agent is sent as it's encoded by this agent.
+	if info.CommandFrame > 0 {
+		header.Set(protocol.HeaderCommandFrame, strconv.Itoa(len(protocol.EncodeCommandFrame(info.Cmd))))
+	}
+
+	conn, resp, err := j.dialer.Dial(u.String(), header)
+	if resp != nil && resp.Body != nil {
+		resp.Body.Close()
+	}
+
+	return conn, resp, err
+}
+
+// jump proxies the session to the target agent given in the request, both hops have been authorized and audited.
+// conn is the connection upgraded to read the command frame, or nil.
+func (handler *Handler) jump(w http.ResponseWriter, r *http.Request, info *request.Info, conn *websocket.Conn) {
+	requestLogger := logger.WithField("request_from", r.RemoteAddr).WithField("jump_target", info.JumpTarget)
+
+	var (
+		target *websocket.Conn
+		resp   *http.Response
+		err    error
+	)
+
+	if handler.jumper == nil {
+		err = fmt.Errorf("jumping isn't enabled on agent %s", handler.affinity.Instance)
+	} else if err = handler.jumper.checkTarget(info.JumpTarget); err == nil {
+		target, resp, err = handler.jumper.dial(r, info, handler.affinity.Instance)
+	}
+
+	// Pass the redirect to the agent instance holding the session back to the client, which can't be done once the
+	// connection is upgraded.
+	if err != nil && resp != nil && (resp.StatusCode == http.StatusTemporaryRedirect || resp.StatusCode == http.StatusPermanentRedirect) {
+		requestLogger.Infof("session is redirected to %s", resp.Header.Get("Location"))
+
+		if conn == nil {
+			http.Redirect(w, r, resp.Header.Get("Location"), resp.StatusCode)
+
+			return
+		}
+
+		err = fmt.Errorf("session is redirected to %s", resp.Header.Get("Location"))
+	}
+
+	// The target agent unable to ask for the confirmation would run the command at once, so it isn't sent.
+	if err == nil && info.Confirm {
+		if version, _ := strconv.Atoi(resp.Header.Get(protocol.HeaderProtocolVersion)); version < protocol.ConfirmVersion {
+			target.Close()
+
+			err = fmt.Errorf("target agent doesn't support the confirmation of commands, which requires protocol version %d", protocol.ConfirmVersion)
+		}
+	}
+
+	// Send the command frame to the target agent, which replies it with the response headers to the client.
+	if err == nil && info.CommandFrame > 0 {
+		if err = target.WriteMessage(websocket.TextMessage, protocol.EncodeCommandFrame(info.Cmd)); err != nil {
+			target.Close()
+		}
+	}
+
+	if conn == nil {
+		// Pass the session ID and affinity token issued by the target agent back to the client.
+		responseHeader := http.Header{}
+
+		if resp != nil {
+			for _, k := range []string{headerSessionID, headerAgentInstance, headerAffinityToken, protocol.HeaderMFA, protocol.HeaderProtocolVersion, protocol.HeaderFrameSize} {
+				if v := resp.Header.Get(k); v != "" {
+					responseHeader.Set(k, v)
+				}
+			}
+		}
+
+		var upgradeErr error
+
+		conn, upgradeErr = handler.upgrader.Upgrade(w, r, responseHeader)
+		if upgradeErr != nil {
+			requestLogger.Warnln("Websocket upgrade error: ", upgradeErr)
+
+			if target != nil {
+				target.Close()
+			}
+
+			return
+		}
+		defer conn.Close()
+	}
+
+	if err != nil {
+		monitor.IncWithSessionID(monitor.MetricsEstablishSessionError.WithLabelValues(sessionutil.ErrorCode(errJumpFailed), "jump"), info.SessionID)
+		errMsg := sessionutil.WrapErrorWithCode(fmt.Sprintf("%s: %v", errJumpFailed, err))
+		requestLogger.Error(errMsg)
+		conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseUnsupportedData, truncWebsocketErrMsg("Establish session error: "+errMsg)))
+
+		return
+	}
+	defer target.Close()
+
+	requestLogger.Infoln("jump session established")
+
+	errCh := make(chan error, 2)
+
+	monitor.Go("jump_relay", func() {
+		relayMessages(target, conn, errCh)
+	})
+	monitor.Go("jump_relay", func() {
+		relayMessages(conn, target, errCh)
+	})
+
+	err = <-errCh
+
+	requestLogger.Infof("jump session disconnected: %v", err)
+}
+
+// relayMessages copies the websocket messages from src to dst, including the close message.
+func relayMessages(dst, src *websocket.Conn, errCh chan<- error) {
+	for {
+		msgType, msg, err := src.ReadMessage()
+		if err != nil {
+			if closeErr, ok := err.(*websocket.CloseError); ok {
+				dst.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(closeErr.Code, closeErr.Text))
+			}
+
+			errCh <- err
+
+			return
+		}
+
+		if err = dst.WriteMessage(msgType, msg); err != nil {
+			errCh <- err
+
+			return
+		}
+	}
+}
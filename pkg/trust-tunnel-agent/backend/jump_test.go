@@ -0,0 +1,131 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"trust-tunnel/pkg/trust-tunnel-agent/backend/request"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestJump(t *testing.T) {
+	// Set up a fake target agent echoing a message and closing the session.
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(headerJumpVia) != "jump-agent" || r.Header.Get(headerJumpTarget) != "" {
+			http.Error(w, "unexpected headers", http.StatusBadRequest)
+
+			return
+		}
+
+		header := http.Header{}
+		header.Set(headerSessionID, "s1")
+
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, header)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		msgType, msg, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+
+		conn.WriteMessage(msgType, msg)
+		conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, `{"Code":3}`))
+	}))
+	defer target.Close()
+
+	targetAddr := strings.TrimPrefix(target.URL, "http://")
+
+	jumper, err := newJumper(&JumpConfig{Enabled: true, AllowedTargets: []string{"127.0.0.0/8"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	handler := &Handler{affinity: &affinity{Instance: "jump-agent"}, jumper: jumper}
+
+	jump := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		info, err := request.GetRequestInfo(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+
+			return
+		}
+
+		handler.jump(w, r, info, nil)
+	}))
+	defer jump.Close()
+
+	header := http.Header{
+		"Command":     []string{"ls"},
+		"Target-Type": []string{"physical"},
+		"Jump-Target": []string{targetAddr},
+	}
+
+	conn, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(jump.URL, "http")+"/exec", header)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer conn.Close()
+
+	if resp.Header.Get(headerSessionID) != "s1" {
+		t.Errorf("session ID of target agent isn't passed back")
+	}
+
+	if err = conn.WriteMessage(websocket.BinaryMessage, []byte("hello")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	_, msg, err := conn.ReadMessage()
+	if err != nil || string(msg) != "hello" {
+		t.Fatalf("unexpected message: %s, %v", msg, err)
+	}
+
+	_, _, err = conn.ReadMessage()
+	if closeErr, ok := err.(*websocket.CloseError); !ok || closeErr.Code != websocket.CloseNormalClosure || closeErr.Text != `{"Code":3}` {
+		t.Errorf("unexpected close error: %v", err)
+	}
+}
+
+func TestJumpCheckTarget(t *testing.T) {
+	jumper, err := newJumper(&JumpConfig{Enabled: true, AllowedTargets: []string{"10.1.0.0/16", "fd00::/8"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	tests := map[string]bool{
+		"10.1.2.3:5006":   true,
+		"[fd00::1]:5006":  true,
+		"10.2.0.1:5006":   false,
+		"10.1.2.3":        false,
+		"agent.xyz:5006":  false,
+		"127.0.0.1:19104": false,
+	}
+
+	for target, allowed := range tests {
+		if err := jumper.checkTarget(target); (err == nil) != allowed {
+			t.Errorf("checkTarget(%s) = %v, expected allowed %v", target, err, allowed)
+		}
+	}
+
+	if _, err := newJumper(&JumpConfig{Enabled: true}); err == nil {
+		t.Errorf("expected error without allowed targets")
+	}
+}
@@ -0,0 +1,572 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+	"trust-tunnel/pkg/common/logutil"
+	"trust-tunnel/pkg/common/sessionutil"
+	"trust-tunnel/pkg/trust-tunnel-agent/backend/request"
+	"trust-tunnel/pkg/trust-tunnel-agent/monitor"
+
+	agentSession "trust-tunnel/pkg/trust-tunnel-agent/session"
+	client "trust-tunnel/pkg/trust-tunnel-client"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+)
+
+// KubeExecPath is the route of the exec endpoint, the path of the exec subresource of the pods in Kubernetes.
+const KubeExecPath = "/api/v1/namespaces/{namespace}/pods/{pod}/exec"
+
+const (
+	// kubeExecProtocolV5 is v4 adding the close channel, with which the client closes the stdin of the command.
+	kubeExecProtocolV5 = "v5.channel.k8s.io"
+	// kubeExecProtocolV4 carries the exit code of the command in the status written to the error channel.
+	kubeExecProtocolV4 = "v4.channel.k8s.io"
+)
+
+// The channels of the Kubernetes remotecommand protocol, every message starts with the byte of its channel.
+const (
+	kubeChannelStdin byte = iota
+	kubeChannelStdout
+	kubeChannelStderr
+	kubeChannelError
+	kubeChannelResize
+	// kubeChannelClose closes the channel in the second byte of the message, since v5.
+	kubeChannelClose byte = 255
+)
+
+// kubeExecProtocols are the subprotocols served, in the order preferred.
+var kubeExecProtocols = []string{kubeExecProtocolV5, kubeExecProtocolV4}
+
+// KubeExecConfig specifies the exec endpoint compatible with Kubernetes, for the tools speaking the remotecommand
+// protocol over WebSocket, e.g. kubectl and the WebSocket executor of client-go.
+type KubeExecConfig struct {
+	// Enabled specifies whether to serve KubeExecPath.
+	Enabled bool `toml:"enabled"`
+}
+
+// kubeExecOptions are the streams requested by the exec request.
+type kubeExecOptions struct {
+	stdin, stdout, stderr, tty bool
+}
+
+// kubeStatus is the status of Kubernetes written to the error channel once the command exits.
+type kubeStatus struct {
+	Metadata struct{}           `json:"metadata"`
+	Status   string             `json:"status"`
+	Message  string             `json:"message,omitempty"`
+	Reason   string             `json:"reason,omitempty"`
+	Details  *kubeStatusDetails `json:"details,omitempty"`
+}
+
+type kubeStatusDetails struct {
+	Causes []kubeStatusCause `json:"causes,omitempty"`
+}
+
+type kubeStatusCause struct {
+	Reason  string `json:"reason,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// kubeTerminalSize is the message of the resize channel.
+type kubeTerminalSize struct {
+	Width  uint16
+	Height uint16
+}
+
+// getKubeExecInfo converts the exec request of the pod into the request information. The command and the streams
+// are in the query as kubectl sends them, the container is the target, and the user is given by the User-Name
+// header, or the Impersonate-User header of kubectl --as.
+func getKubeExecInfo(r *http.Request, pod string) (*request.Info, *kubeExecOptions, error) {
+	query := r.URL.Query()
+	header := request.Header(r)
+
+	info := &request.Info{
+		UserName:   header.Get("User-Name"),
+		LoginName:  header.Get("Login-Name"),
+		LoginGroup: header.Get("Login-Group"),
+		TargetType: client.TargetContainer,
+		PodName:    pod,
+		Cmd:        query["command"],
+	}
+
+	if info.UserName == "" {
+		info.UserName = header.Get("Impersonate-User")
+	}
+
+	if info.ContainerID = query.Get("container"); info.ContainerID == "" {
+		return nil, nil, fmt.Errorf("no container")
+	}
+
+	info.ContainerName = info.ContainerID
+
+	if len(info.Cmd) == 0 {
+		return nil, nil, fmt.Errorf("no command")
+	}
+
+	opts := &kubeExecOptions{}
+
+	for name, value := range map[string]*bool{"stdin": &opts.stdin, "stdout": &opts.stdout, "stderr": &opts.stderr, "tty": &opts.tty} {
+		if s := query.Get(name); s != "" {
+			var err error
+			if *value, err = strconv.ParseBool(s); err != nil {
+				return nil, nil, fmt.Errorf("invalid %s argument: %s", name, s)
+			}
+		}
+	}
+
+	if !opts.stdin && !opts.stdout && !opts.stderr {
+		return nil, nil, fmt.Errorf("at least one of stdin, stdout and stderr is required")
+	}
+
+	// The stderr is merged into the stdout by the terminal.
+	if opts.tty {
+		opts.stderr = false
+	}
+
+	info.Interactive = opts.stdin
+	info.Tty = opts.tty
+
+	return info, opts, nil
+}
+
+// KubeExec runs a command in a container over the Kubernetes remotecommand protocol, so that kubectl and client-go
+// can exec into the containers of the agent directly. Only the WebSocket streaming is served, as SPDY is deprecated
+// by Kubernetes. It's authorized and audited as the websocket sessions.
+func (handler *Handler) KubeExec(w http.ResponseWriter, r *http.Request) {
+	correlationID := logutil.NewCorrelationID()
+	requestLogger := logger.WithField("request_from", r.RemoteAddr).WithField(logutil.FieldCorrelationID, correlationID)
+
+	w.Header().Set(headerCorrelationID, correlationID)
+
+	if !websocket.IsWebSocketUpgrade(r) {
+		http.Error(w, "request error: only the WebSocket streaming of remotecommand is supported", http.StatusBadRequest)
+
+		return
+	}
+
+	if selectKubeExecProtocol(websocket.Subprotocols(r)) == "" {
+		http.Error(w, fmt.Sprintf("request error: unsupported subprotocols, one of %v is required", kubeExecProtocols), http.StatusBadRequest)
+
+		return
+	}
+
+	requestInfo, opts, err := getKubeExecInfo(r, mux.Vars(r)["pod"])
+	if err == nil {
+		err = handler.config.SessionConfig.checkCommandLength(requestInfo.Cmd)
+	}
+
+	if err != nil {
+		requestLogger.Warnln("Kube exec request invalid: ", err)
+		http.Error(w, "request error: "+err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	requestLogger.Infoln("Kube exec request info: ", requestInfo)
+
+	if _, err = handler.identifyTenant(r, requestInfo); err != nil {
+		requestLogger.Warnf("authorization failed: %v", err)
+		auditDenial(requestInfo, r.RemoteAddr, "unknown_tenant", err.Error(), 0)
+		http.Error(w, "permission denied", http.StatusForbidden)
+
+		return
+	}
+
+	if err = handler.bindIdentity(r, requestInfo); err != nil {
+		requestLogger.Warnf("authorization failed: %v", err)
+		auditDenial(requestInfo, r.RemoteAddr, "identity_mismatch", err.Error(), 0)
+		http.Error(w, "permission denied", http.StatusForbidden)
+
+		return
+	}
+
+	if err = handler.tags.check(requestInfo.Tags); err != nil {
+		requestLogger.Warnf("authorization failed: %v", err)
+		auditDenial(requestInfo, r.RemoteAddr, "tag_denied", err.Error(), 0)
+		http.Error(w, err.Error(), http.StatusForbidden)
+
+		return
+	}
+
+	authz, ok := handler.authorize(requestLogger, requestInfo, r.RemoteAddr)
+	if !ok {
+		http.Error(w, "permission denied", http.StatusForbidden)
+
+		return
+	}
+
+	// The challenge can't be answered by the Kubernetes clients.
+	if authz.mfa != nil {
+		auditDenial(requestInfo, r.RemoteAddr, "mfa_unsupported", "MFA can't be answered on kube exec", authz.latency)
+		http.Error(w, "MFA is required, use the websocket API instead", http.StatusForbidden)
+
+		return
+	}
+
+	// Nobody can witness the kube exec sessions, as they can't be observed.
+	if handler.config.ObserveConfig.dualControl(authz.sensitivity) {
+		auditDenial(requestInfo, r.RemoteAddr, "dual_control_unsupported", "dual control can't be applied on kube exec", authz.latency)
+		http.Error(w, "dual control is required, use the websocket API instead", http.StatusForbidden)
+
+		return
+	}
+
+	constructAuditInfo(requestInfo, r.RemoteAddr)
+
+	sessID := newSessionID()
+	if requestInfo.BreakGlass {
+		handler.alertBreakGlass(requestInfo, sessID, r.RemoteAddr)
+	}
+
+	sessConf := handler.newSessionConfig(requestInfo, sessID)
+	runtime := handler.runtimeLabel(sessConf)
+	requestLogger = requestLogger.WithField(logutil.FieldSessionID, sessID)
+	defer logutil.CloseSessionFile(sessID)
+
+	if err = handler.checkSidecarQuota(requestLogger, w.Header(), sessConf, sessID, runtime); err != nil {
+		http.Error(w, "Establish session error: "+err.Error(), http.StatusServiceUnavailable)
+
+		return
+	}
+
+	responseHeader := http.Header{}
+	responseHeader.Set(headerSessionID, sessID)
+
+	upgrader := handler.upgrader
+	upgrader.Subprotocols = kubeExecProtocols
+
+	conn, err := upgrader.Upgrade(w, r, responseHeader)
+	if err != nil {
+		requestLogger.Warnln("Websocket upgrade error: ", err)
+
+		return
+	}
+	defer conn.Close()
+
+	kubeConn := &kubeExecConn{conn: conn, opts: opts}
+
+	// The failures since the upgrade are told by the status, as the Kubernetes clients expect.
+	rec, err := handler.startRecording(requestLogger, requestInfo, sessID)
+	if err != nil {
+		errMsg := sessionutil.WrapErrorWithCode(err.Error())
+		requestLogger.Error(errMsg)
+		kubeConn.fail("Establish session error: " + errMsg)
+
+		return
+	}
+	defer rec.close()
+
+	sess, isSidecarSession, err := handler.establishSession(requestLogger, sessConf, sessID, runtime)
+	if err != nil {
+		kubeConn.fail("Establish session error: " + err.Error())
+
+		return
+	}
+
+	if rec != nil {
+		requestInfo.Recording = rec.path
+	}
+
+	handler.tags.count(requestInfo.Tags, sessID)
+	notifyStart(requestInfo, sessID, r.RemoteAddr)
+
+	kubeConn.terminal = terminal{sess: sess, recording: rec}
+	reason := kubeConn.serve(handler.config.SessionConfig.MaxDuration)
+
+	handler.lock.Lock()
+	if err = handler.releaseSession(sessID, sess); err == nil && isSidecarSession {
+		handler.sidecars.release(sessConf.ContainerID)
+	}
+	handler.lock.Unlock()
+
+	recordTermination(requestLogger, requestInfo, sess, sessID, runtime, reason)
+}
+
+// selectKubeExecProtocol returns the subprotocol preferred among the ones of the client, it's empty if none is
+// served.
+func selectKubeExecProtocol(protocols []string) string {
+	for _, served := range kubeExecProtocols {
+		for _, p := range protocols {
+			if p == served {
+				return served
+			}
+		}
+	}
+
+	return ""
+}
+
+// kubeExecConn streams a session over the Kubernetes remotecommand protocol.
+type kubeExecConn struct {
+	terminal
+
+	conn *websocket.Conn
+	opts *kubeExecOptions
+	// lock serializes the writes to the connection.
+	lock sync.Mutex
+}
+
+// serve streams the session until the command exits, the client goes away or the session lasts for maxDuration,
+// then writes the status of the command, and returns why the session is terminated.
+func (kubeConn *kubeExecConn) serve(maxDuration time.Duration) client.TerminationReason {
+	// The client is told that the connection is established by an empty message of the first channel written.
+	first := kubeChannelError
+
+	switch {
+	case kubeConn.opts.stdout:
+		first = kubeChannelStdout
+	case kubeConn.opts.stderr:
+		first = kubeChannelStderr
+	}
+
+	if err := kubeConn.write(first, nil); err != nil {
+		return client.TerminationDisconnected
+	}
+
+	inputDone := make(chan struct{})
+	stdoutCh := make(chan error, 1)
+	stderrCh := make(chan error, 1)
+
+	monitor.Go("kube_exec_input", func() {
+		defer close(inputDone)
+		kubeConn.processInput()
+	})
+	monitor.Go("kube_exec_output", func() {
+		stdoutCh <- kubeConn.processOutput(kubeChannelStdout, kubeConn.sess.NextStdout, kubeConn.sess.StdoutDone)
+	})
+	monitor.Go("kube_exec_output", func() {
+		stderrCh <- kubeConn.processOutput(kubeChannelStderr, kubeConn.sess.NextStderr, kubeConn.sess.StderrDone)
+	})
+
+	var timeout <-chan time.Time
+
+	if maxDuration > 0 {
+		timer := time.NewTimer(maxDuration)
+		defer timer.Stop()
+
+		timeout = timer.C
+	}
+
+	var (
+		reason client.TerminationReason
+		status *kubeStatus
+	)
+
+	// The exit code is available once the output is drained.
+	for stdoutCh != nil || stderrCh != nil {
+		select {
+		case err := <-stdoutCh:
+			stdoutCh = nil
+
+			if err != nil {
+				reason, status = client.TerminationRuntimeFailure, kubeFailure(err.Error())
+			}
+		case err := <-stderrCh:
+			stderrCh = nil
+
+			if err != nil {
+				reason, status = client.TerminationRuntimeFailure, kubeFailure(err.Error())
+			}
+		case <-timeout:
+			reason, status = client.TerminationMaxDuration, kubeFailure("session terminated for max-duration")
+		case <-inputDone:
+			// The client has gone away, or it has closed the connection.
+			reason = client.TerminationDisconnected
+		}
+
+		if reason != "" {
+			break
+		}
+	}
+
+	if reason == "" {
+		exitCode := kubeConn.sess.ExitCode()
+		reason, status = client.TerminationExited, kubeExitStatus(exitCode)
+
+		if reporter, ok := kubeConn.sess.(agentSession.OOMReporter); ok && exitCode != 0 && reporter.OOMKilled() {
+			reason = client.TerminationOOM
+		}
+	}
+
+	if status != nil {
+		data, _ := json.Marshal(status)
+		kubeConn.write(kubeChannelError, data)
+	}
+
+	kubeConn.lock.Lock()
+	kubeConn.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+		time.Now().Add(closeWriteTimeout))
+	kubeConn.lock.Unlock()
+
+	return reason
+}
+
+// kubeExitStatus returns the status of the command exiting with the code.
+func kubeExitStatus(exitCode int) *kubeStatus {
+	switch {
+	case exitCode == 0:
+		return &kubeStatus{Status: "Success"}
+	case exitCode < 0 || exitCode > 255:
+		return kubeFailure(fmt.Sprintf("command terminated with unknown exit code %d", exitCode))
+	}
+
+	status := kubeFailure(fmt.Sprintf("command terminated with non-zero exit code: exit code %d", exitCode))
+	status.Reason = "NonZeroExitCode"
+	status.Details = &kubeStatusDetails{Causes: []kubeStatusCause{{Reason: "ExitCode", Message: strconv.Itoa(exitCode)}}}
+
+	return status
+}
+
+// kubeFailure returns the status of the failure.
+func kubeFailure(msg string) *kubeStatus {
+	return &kubeStatus{Status: "Failure", Message: msg}
+}
+
+// fail writes the status of the failure and closes the connection.
+func (kubeConn *kubeExecConn) fail(msg string) {
+	data, _ := json.Marshal(kubeFailure(msg))
+	kubeConn.write(kubeChannelError, data)
+	kubeConn.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+		time.Now().Add(closeWriteTimeout))
+}
+
+// write writes the data to the channel as a message.
+func (kubeConn *kubeExecConn) write(channel byte, data []byte) error {
+	kubeConn.lock.Lock()
+	defer kubeConn.lock.Unlock()
+
+	w, err := kubeConn.conn.NextWriter(websocket.BinaryMessage)
+	if err != nil {
+		return err
+	}
+
+	if _, err = w.Write(append([]byte{channel}, data...)); err != nil {
+		w.Close()
+
+		return err
+	}
+
+	return w.Close()
+}
+
+// processOutput writes the output of the stream to the channel until it ends, the output of the streams not
+// requested is discarded.
+func (kubeConn *kubeExecConn) processOutput(channel byte, next func() (io.Reader, error), done func() error) error {
+	defer done()
+
+	requested := kubeConn.opts.stdout
+	if channel == kubeChannelStderr {
+		requested = kubeConn.opts.stderr
+	}
+
+	for {
+		reader, err := next()
+		if err == io.EOF {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if reader == nil {
+			continue
+		}
+
+		// The terminal is ready once the command writes output.
+		kubeConn.applySize()
+
+		data, err := io.ReadAll(reader)
+		if err != nil {
+			return err
+		}
+
+		if !requested || len(data) == 0 {
+			continue
+		}
+
+		// The output of both stdout and stderr is recorded as the terminal shows them.
+		if kubeConn.recording != nil {
+			kubeConn.recording.recorder.Output().Write(data)
+		}
+
+		if err = kubeConn.write(channel, data); err != nil {
+			return fmt.Errorf("write output to kube exec client error: %v", err)
+		}
+	}
+}
+
+// processInput passes the stdin and the terminal sizes of the client to the session until the client goes away.
+func (kubeConn *kubeExecConn) processInput() {
+	for {
+		msgType, data, err := kubeConn.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+
+		if msgType != websocket.BinaryMessage || len(data) == 0 {
+			continue
+		}
+
+		switch channel, payload := data[0], data[1:]; channel {
+		case kubeChannelStdin:
+			if kubeConn.opts.stdin && len(payload) > 0 {
+				if err = kubeConn.writeStdin(payload); err != nil {
+					logger.Warnf("write stdin of kube exec error: %v", err)
+
+					return
+				}
+			}
+		case kubeChannelResize:
+			var size kubeTerminalSize
+			if err = json.Unmarshal(payload, &size); err == nil && size.Width > 0 && size.Height > 0 {
+				kubeConn.resize(int(size.Height), int(size.Width))
+			}
+		case kubeChannelClose:
+			// The stdin of the client reaches EOF, pass it to the command.
+			if bytes.Equal(payload, []byte{kubeChannelStdin}) {
+				if err = kubeConn.sess.CloseStdin(); err != nil {
+					logger.Warnf("close cmd's stdin error: %v", err)
+				}
+			}
+		}
+	}
+}
+
+// writeStdin writes the input to the stdin of the session.
+func (kubeConn *kubeExecConn) writeStdin(input []byte) error {
+	stdin, err := kubeConn.sess.NextStdin()
+	if err != nil {
+		return err
+	}
+
+	if kubeConn.recording != nil && kubeConn.recording.input {
+		kubeConn.recording.recorder.Input().Write(input)
+	}
+
+	_, err = stdin.Write(input)
+
+	return err
+}
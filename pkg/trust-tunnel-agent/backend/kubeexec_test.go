@@ -0,0 +1,147 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	client "trust-tunnel/pkg/trust-tunnel-client"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestGetKubeExecInfo(t *testing.T) {
+	for _, tc := range []struct {
+		query string
+		opts  kubeExecOptions
+		err   string
+	}{
+		{"container=nginx&command=ls&command=-l&stdout=true&stderr=true", kubeExecOptions{stdout: true, stderr: true}, ""},
+		{"container=nginx&command=sh&stdin=1&stdout=1&stderr=1&tty=1", kubeExecOptions{stdin: true, stdout: true, tty: true}, ""},
+		{"command=ls&stdout=true", kubeExecOptions{}, "no container"},
+		{"container=nginx&stdout=true", kubeExecOptions{}, "no command"},
+		{"container=nginx&command=ls&stdout=yes", kubeExecOptions{}, "invalid stdout argument: yes"},
+		{"container=nginx&command=ls", kubeExecOptions{}, "at least one of stdin, stdout and stderr is required"},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/api/v1/namespaces/default/pods/web-0/exec?"+tc.query, nil)
+		r.Header.Set("Impersonate-User", "alice")
+
+		info, opts, err := getKubeExecInfo(r, "web-0")
+		if tc.err != "" {
+			if err == nil || err.Error() != tc.err {
+				t.Errorf("%s: expected error %q, got %v", tc.query, tc.err, err)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", tc.query, err)
+		}
+
+		if *opts != tc.opts || info.UserName != "alice" || info.PodName != "web-0" || info.ContainerID != "nginx" ||
+			info.TargetType != client.TargetContainer || info.Tty != tc.opts.tty || info.Interactive != tc.opts.stdin {
+			t.Errorf("%s: unexpected request %v, options %+v", tc.query, info, opts)
+		}
+	}
+}
+
+func TestKubeExitStatus(t *testing.T) {
+	for code, expected := range map[int]string{
+		0:  `{"metadata":{},"status":"Success"}`,
+		3:  `{"metadata":{},"status":"Failure","message":"command terminated with non-zero exit code: exit code 3","reason":"NonZeroExitCode","details":{"causes":[{"reason":"ExitCode","message":"3"}]}}`,
+		-1: `{"metadata":{},"status":"Failure","message":"command terminated with unknown exit code -1"}`,
+	} {
+		if data, _ := json.Marshal(kubeExitStatus(code)); string(data) != expected {
+			t.Errorf("exit code %d: unexpected status %s", code, data)
+		}
+	}
+}
+
+func TestKubeExecConn(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upgrader := websocket.Upgrader{Subprotocols: kubeExecProtocols}
+
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("unexpected upgrade error: %v", err)
+
+			return
+		}
+		defer conn.Close()
+
+		kubeConn := &kubeExecConn{terminal: terminal{sess: newFakeSession()}, conn: conn, opts: &kubeExecOptions{stdin: true, stdout: true, stderr: true}}
+		if reason := kubeConn.serve(time.Minute); reason != client.TerminationExited {
+			t.Errorf("unexpected reason %s", reason)
+		}
+	}))
+	defer server.Close()
+
+	u, _ := url.Parse(server.URL)
+	u.Scheme = "ws"
+
+	dialer := websocket.Dialer{Subprotocols: []string{kubeExecProtocolV5}}
+
+	conn, _, err := dialer.Dial(u.String(), nil)
+	if err != nil {
+		t.Fatalf("unexpected dial error: %v", err)
+	}
+	defer conn.Close()
+
+	if conn.Subprotocol() != kubeExecProtocolV5 {
+		t.Fatalf("unexpected subprotocol %q", conn.Subprotocol())
+	}
+
+	// The stdin is echoed by the session, which exits once the stdin is closed.
+	conn.WriteMessage(websocket.BinaryMessage, append([]byte{kubeChannelStdin}, "hello world"...))
+	conn.WriteMessage(websocket.BinaryMessage, []byte{kubeChannelClose, kubeChannelStdin})
+
+	var (
+		output [kubeChannelResize]strings.Builder
+		first  = true
+	)
+
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			break
+		}
+
+		// The connection is told to be established by the empty message of the stdout.
+		if first && (len(data) != 1 || data[0] != kubeChannelStdout) {
+			t.Fatalf("unexpected first message %q", data)
+		}
+
+		first = false
+
+		output[data[0]].Write(data[1:])
+	}
+
+	if output[kubeChannelStdout].String() != "hello world" || output[kubeChannelStderr].String() != "err" {
+		t.Errorf("unexpected output %q, %q", output[kubeChannelStdout].String(), output[kubeChannelStderr].String())
+	}
+
+	var status kubeStatus
+	if err = json.Unmarshal([]byte(output[kubeChannelError].String()), &status); err != nil || status.Reason != "NonZeroExitCode" ||
+		status.Details.Causes[0].Message != "3" {
+		t.Errorf("unexpected status %s: %v", output[kubeChannelError].String(), err)
+	}
+}
@@ -15,34 +15,56 @@
 package backend
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"strings"
 
 	"github.com/gorilla/websocket"
+	agentSession "trust-tunnel/pkg/trust-tunnel-agent/session"
 	client "trust-tunnel/pkg/trust-tunnel-client"
 )
 
 // processLocalOutput handles local output by preparing and sending a normal session closure message.
 func (sessConn *Connection) processLocalOutput() {
 	err := sessConn.processOutOrErr(false)
+	// The next connection of the session tells how it ends.
+	if errors.Is(err, errDetached) {
+		return
+	}
+
 	// Close the connection in output processing.
 	msg := client.NormalCloseMessage{
 		Code: sessConn.sess.ExitCode(),
 	}
 
+	reason := client.TerminationExited
+
 	if err != nil {
 		if !strings.Contains(err.Error(), "close sent") {
 			// normal closed
 			msg.Err = err
+			reason = client.TerminationRuntimeFailure
 		}
+	} else if reporter, ok := sessConn.sess.(agentSession.OOMReporter); ok && msg.Code != 0 && reporter.OOMKilled() {
+		reason = client.TerminationOOM
 	}
 
+	// The reason is kept if the session has been terminated for other reasons.
+	sessConn.setReason(reason)
+	msg.Reason = sessConn.terminationReason()
+
 	data, _ := json.Marshal(msg)
+	closeMsg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, truncWebsocketErrMsg(string(data)))
+
+	// The observers are told how the session ends as well.
+	sessConn.observers.end(closeMsg)
 
 	sessConn.lock.Lock()
 	defer sessConn.lock.Unlock()
-	sessConn.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, truncWebsocketErrMsg(string(data))))
+	sessConn.conn.WriteMessage(websocket.CloseMessage, closeMsg)
 }
 
 func (sessConn *Connection) processLocalError() {
@@ -51,8 +73,13 @@ func (sessConn *Connection) processLocalError() {
 
 // processOutOrErr handles the session's output or errors.
 // processErr indicates whether it's processing stderr or stdout.
-func (sessConn *Connection) processOutOrErr(processErr bool) error {
+func (sessConn *Connection) processOutOrErr(processErr bool) (err error) {
 	defer func() {
+		// The stream is drained by the next connection of the session.
+		if errors.Is(err, errDetached) {
+			return
+		}
+
 		if processErr {
 			sessConn.sess.StderrDone()
 		} else {
@@ -60,26 +87,32 @@ func (sessConn *Connection) processOutOrErr(processErr bool) error {
 		}
 	}()
 
+	// The stream is read by the previous connection until it has buffered the frame read after the reattachment.
+	if sessConn.resume != nil {
+		streamLock := sessConn.resume.streamLock(processErr)
+		streamLock.Lock()
+		defer streamLock.Unlock()
+
+		if err = sessConn.replay(sessConn.resume.take(true, processErr)); err != nil {
+			return sessConn.bufferOutput(processErr)
+		}
+	}
+
 	for {
 		select {
 		case <-sessConn.doneCh:
+			if sessConn.resume != nil {
+				return sessConn.bufferOutput(processErr)
+			}
+
 			return nil
 		default:
 		}
 
-		var (
-			// Read from cmd in container or host.
-			cmdReader io.Reader
-
-			err error
-		)
-
-		if processErr {
-			cmdReader, err = sessConn.sess.NextStderr()
-		} else {
-			cmdReader, err = sessConn.sess.NextStdout()
-		}
+		var cmdReader io.Reader
 
+		// Read from cmd in container or host.
+		cmdReader, err = sessConn.next(processErr)
 		if err != nil {
 			if err == io.EOF {
 				// Connection closed
@@ -91,10 +124,121 @@ func (sessConn *Connection) processOutOrErr(processErr bool) error {
 			return err
 		}
 
+		// The frame read once the connection is detached is left to the next connection, as it may not fail to be
+		// written to the broken connection.
+		if sessConn.resume != nil && sessConn.detached() {
+			if err = sessConn.bufferFrame(cmdReader, processErr); err != nil {
+				return err
+			}
+
+			return sessConn.bufferOutput(processErr)
+		}
+
+		// The terminal is ready once the command writes output.
+		sessConn.applySize()
+
 		if err = sessConn.write(cmdReader, processErr); err != nil {
+			if sessConn.resume == nil {
+				return err
+			}
+
+			// The frame failed to be written is replayed by the next connection as well.
+			if seeker, ok := cmdReader.(io.Seeker); ok {
+				if _, seekErr := seeker.Seek(0, io.SeekStart); seekErr == nil {
+					sessConn.bufferFrame(cmdReader, processErr)
+				}
+			}
+
+			return sessConn.bufferOutput(processErr)
+		}
+	}
+}
+
+// next returns the next frame of the stderr if isErr, or of the stdout.
+func (sessConn *Connection) next(isErr bool) (io.Reader, error) {
+	if isErr {
+		return sessConn.sess.NextStderr()
+	}
+
+	return sessConn.sess.NextStdout()
+}
+
+// bufferOutput reads the output of the stream into the resume buffer once the connection is detached, until the
+// session is reattached by another connection, which errDetached is returned for, or the stream ends.
+func (sessConn *Connection) bufferOutput(isErr bool) error {
+	for sessConn.resume.attached(sessConn) {
+		reader, err := sessConn.next(isErr)
+		if err == io.EOF {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if err = sessConn.bufferFrame(reader, isErr); err != nil {
 			return err
 		}
 	}
+
+	return errDetached
+}
+
+// bufferFrame buffers the frame for the next connection of the session.
+func (sessConn *Connection) bufferFrame(reader io.Reader, isErr bool) error {
+	if reader == nil {
+		return nil
+	}
+
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return err
+	}
+
+	sessConn.resume.push(data, isErr)
+
+	return nil
+}
+
+// detached returns whether the connection is detached from the session.
+func (sessConn *Connection) detached() bool {
+	select {
+	case <-sessConn.doneCh:
+		return true
+	default:
+		return false
+	}
+}
+
+// replay writes the output buffered while the session was detached, telling how much of it was dropped for the
+// buffer was full. The frames failed to be written are put back to the buffer.
+func (sessConn *Connection) replay(frames []outputFrame, dropped int) error {
+	if dropped > 0 {
+		notice := fmt.Sprintf("[trust-tunnel] %d bytes of output were dropped while the session was detached", dropped)
+		if sessConn.tty {
+			notice = "\n" + notice
+		}
+
+		sessConn.lock.Lock()
+		err := writeNotice(sessConn.conn, sessConn.tty, notice)
+		sessConn.lock.Unlock()
+
+		if err != nil {
+			sessConn.resume.unshift(frames)
+
+			return err
+		}
+	}
+
+	for i, frame := range frames {
+		if err := sessConn.write(bytes.NewReader(frame.data), frame.isErr); err != nil {
+			sessConn.resume.unshift(frames[i:])
+
+			return err
+		}
+	}
+
+	return nil
 }
 
 // write is used to send data to the websocket connection.
@@ -136,8 +280,27 @@ func (sessConn *Connection) write(reader io.Reader, isErr bool) error {
 	// Copy data from reader to msgWriter. If reader is not nil, because the check is done above.
 	var n int64
 
+	var dst io.Writer = msgWriter
+	if !isErr && sessConn.watermark != nil {
+		sessConn.watermark.Reset(msgWriter)
+		dst = sessConn.watermark
+	}
+
+	// The output of both stdout and stderr is recorded as the terminal shows them, once it's written to the client,
+	// the output failed to be written is recorded as it's replayed.
+	if sessConn.recording != nil {
+		dst = io.MultiWriter(dst, sessConn.recording.recorder.Output())
+	}
+
+	// The output is relayed to the observers once it's written to the writer of the session.
+	var observed *bytes.Buffer
+	if sessConn.observers.observed() {
+		observed = &bytes.Buffer{}
+		reader = io.TeeReader(reader, observed)
+	}
+
 	if reader != nil {
-		n, err = io.Copy(msgWriter, reader)
+		n, err = io.Copy(dst, reader)
 		if err != nil {
 			logger.Errorf("copy message to websocket failed: %v", err)
 
@@ -145,7 +308,15 @@ func (sessConn *Connection) write(reader io.Reader, isErr bool) error {
 		}
 	}
 
-	logger.Tracef("write output back to websocket %d bytes", n)
+	streamTraceSampler.Tracef(logger, "write output back to websocket %d bytes", n)
+
+	if observed != nil && observed.Len() > 0 {
+		sessConn.observers.send(observed.Bytes(), isErr)
+	}
+
+	if n > 0 {
+		sessConn.active()
+	}
 
 	return nil
 }
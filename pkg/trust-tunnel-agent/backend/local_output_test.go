@@ -0,0 +1,70 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func BenchmarkConnectionWrite(b *testing.B) {
+	connCh := make(chan *websocket.Conn, 1)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+
+		connCh <- conn
+	}))
+	defer server.Close()
+
+	clientConn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		b.Fatalf("unexpected error: %v", err)
+	}
+	defer clientConn.Close()
+
+	// Discard the output on the client side.
+	go func() {
+		for {
+			if _, _, err := clientConn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	conn := <-connCh
+	defer conn.Close()
+
+	sessConn := &Connection{conn: conn}
+	chunk := bytes.Repeat([]byte("a"), 4096)
+
+	b.SetBytes(int64(len(chunk)))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if err := sessConn.write(bytes.NewReader(chunk), false); err != nil {
+			b.Fatalf("unexpected error: %v", err)
+		}
+	}
+}
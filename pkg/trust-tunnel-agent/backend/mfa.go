@@ -0,0 +1,77 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+	"trust-tunnel/pkg/trust-tunnel-agent/auth"
+	"trust-tunnel/pkg/trust-tunnel-agent/backend/request"
+	"trust-tunnel/pkg/trust-tunnel-client/protocol"
+
+	"github.com/gorilla/websocket"
+	client "trust-tunnel/pkg/trust-tunnel-client"
+)
+
+const (
+	// mfaTimeout is the time for the user to answer the MFA challenge.
+	mfaTimeout = 2 * time.Minute
+
+	// errMFAFailed is the message prefix of MFA errors, it's mapped to an error code
+	// by sessionutil.WrapErrorWithCode.
+	errMFAFailed = "MFA verification failed"
+)
+
+// verifyMFA relays the MFA challenge to the client, and verifies the assertion answered by the user
+// with the auth handler.
+func (handler *Handler) verifyMFA(conn *websocket.Conn, info *request.Info, challenge *client.MFAChallenge) error {
+	if !info.MFA {
+		return fmt.Errorf("%s: MFA is required, but the client can't answer the challenge, upgrade it", errMFAFailed)
+	}
+
+	verifier, ok := handler.authHandlerOf(info).(auth.MFAVerifier)
+	if !ok {
+		return fmt.Errorf("%s: the auth handler can't verify MFA", errMFAFailed)
+	}
+
+	data, err := json.Marshal(challenge)
+	if err != nil {
+		return fmt.Errorf("%s: %v", errMFAFailed, err)
+	}
+
+	if err = conn.WriteMessage(websocket.TextMessage, append([]byte(protocol.MFAPrefix), data...)); err != nil {
+		return fmt.Errorf("%s: send challenge error: %v", errMFAFailed, err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(mfaTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	msgType, msg, err := conn.ReadMessage()
+	if err != nil {
+		return fmt.Errorf("%s: read assertion error: %v", errMFAFailed, err)
+	}
+
+	if msgType != websocket.TextMessage || !strings.HasPrefix(string(msg), protocol.MFAPrefix) {
+		return fmt.Errorf("%s: invalid assertion", errMFAFailed)
+	}
+
+	if err = verifier.VerifyMFA(info, challenge, string(msg[len(protocol.MFAPrefix):])); err != nil {
+		return fmt.Errorf("%s: %v", errMFAFailed, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,107 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"trust-tunnel/pkg/trust-tunnel-agent/auth"
+	"trust-tunnel/pkg/trust-tunnel-agent/backend/request"
+	"trust-tunnel/pkg/trust-tunnel-client/protocol"
+
+	"github.com/gorilla/websocket"
+	client "trust-tunnel/pkg/trust-tunnel-client"
+)
+
+// totpAuthHandler approves every request, and accepts the code "123456" as the TOTP code.
+type totpAuthHandler struct{}
+
+func (totpAuthHandler) VerifyAccessPermission(*request.Info) auth.Response {
+	return auth.Response{Code: auth.Success}
+}
+
+func (totpAuthHandler) VerifyMFA(_ *request.Info, _ *client.MFAChallenge, assertion string) error {
+	if assertion != "123456" {
+		return errors.New("wrong code")
+	}
+
+	return nil
+}
+
+func TestVerifyMFA(t *testing.T) {
+	handler := &Handler{authHandler: totpAuthHandler{}}
+	challenge := &client.MFAChallenge{Type: "totp", Prompt: "TOTP code: "}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		info, _ := request.GetRequestInfo(r)
+
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, http.Header{protocol.HeaderMFA: []string{challenge.Type}})
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		if err = handler.verifyMFA(conn, info, challenge); err != nil {
+			conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseUnsupportedData, err.Error()))
+
+			return
+		}
+
+		conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, `{"Code":0,"Err":null}`))
+	}))
+	defer server.Close()
+
+	host, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+	portNum, _ := strconv.Atoi(port)
+
+	for _, code := range []string{"123456", "000000"} {
+		var prompt string
+
+		c := &client.Client{
+			AgentAddr: host,
+			AgentPort: portNum,
+			Command:   []string{"ls"},
+			MFAPrompt: func(challenge *client.MFAChallenge) (string, error) {
+				prompt = challenge.Prompt
+
+				return code, nil
+			},
+		}
+
+		session, err := c.Start(nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if prompt != challenge.Prompt {
+			t.Errorf("got prompt %q", prompt)
+		}
+
+		_, err = io.ReadAll(session)
+		if code == "123456" && err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+
+		if code != "123456" && (err == nil || !strings.Contains(err.Error(), errMFAFailed)) {
+			t.Errorf("expected MFA error, got %v", err)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"time"
+	agentSession "trust-tunnel/pkg/trust-tunnel-agent/session"
+	"trust-tunnel/pkg/trust-tunnel-client/protocol"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	defaultPingPeriod = 30 * time.Second
+	pingWriteTimeout  = 10 * time.Second
+
+	// defaultBulkFrameSize is the default frame size of the bulk profile, and minFrameSize is the smallest frame
+	// size the clients may request.
+	defaultBulkFrameSize = 64 << 10
+	minFrameSize         = 512
+)
+
+// NetworkConfig specifies the network options of the connections from clients,
+// which keep long-lived sessions alive behind NATs and firewalls dropping idle connections.
+type NetworkConfig struct {
+	// TCPKeepAlive specifies the keep-alive period of the accepted TCP connections.
+	// Defaults to 15 seconds if zero, and keep-alive is disabled if negative.
+	TCPKeepAlive time.Duration `toml:"tcp_keepalive"`
+
+	// PingPeriod specifies the period of sending websocket pings to clients.
+	// Defaults to 30 seconds if zero, and pings are disabled if negative.
+	PingPeriod time.Duration `toml:"ping_period"`
+
+	// ReadBufferSize and WriteBufferSize specify the websocket I/O buffer sizes in bytes,
+	// the buffers of the HTTP server are used if zero.
+	ReadBufferSize  int `toml:"read_buffer_size"`
+	WriteBufferSize int `toml:"write_buffer_size"`
+
+	// MaxHeaderBytes specifies the maximum size of the request headers in bytes, the default of the HTTP server
+	// (1 MiB) is used if zero. The long commands should be sent in the command frame instead.
+	MaxHeaderBytes int `toml:"max_header_bytes"`
+
+	// FrameSize specifies the most bytes of the session output read at once, which bounds the output frames, and
+	// BulkFrameSize specifies the one of the bulk profile, selected by the copies and by the clients transferring
+	// much output, e.g. large cats. Default to 4096 and 64 KiB if zero. The clients may request the frame sizes up
+	// to BulkFrameSize, and the sessions of the bulk frames are written with the buffers of their size.
+	FrameSize     int `toml:"frame_size"`
+	BulkFrameSize int `toml:"bulk_frame_size"`
+}
+
+// frameSizes returns the frame size of the default profile and the one of the bulk profile.
+func (c *NetworkConfig) frameSizes() (int, int) {
+	size, bulk := c.FrameSize, c.BulkFrameSize
+	if size <= 0 {
+		size = agentSession.DefaultFrameSize
+	}
+
+	if bulk <= 0 {
+		bulk = defaultBulkFrameSize
+	}
+
+	return size, max(size, bulk)
+}
+
+// frameSize returns the frame size of the sessions requesting the profile, or the size requested within the limits
+// if it's positive.
+func (c *NetworkConfig) frameSize(profile string, requested int) int {
+	size, bulk := c.frameSizes()
+
+	switch {
+	case requested > 0:
+		return min(max(requested, minFrameSize), bulk)
+	case profile == protocol.FrameProfileBulk:
+		return bulk
+	default:
+		return size
+	}
+}
+
+// pingPeriod returns the period of websocket pings, zero means pings are disabled.
+func (c *NetworkConfig) pingPeriod() time.Duration {
+	if c.PingPeriod == 0 {
+		return defaultPingPeriod
+	}
+
+	if c.PingPeriod < 0 {
+		return 0
+	}
+
+	return c.PingPeriod
+}
+
+// keepAlive sends websocket pings periodically until the connection is done,
+// so that the connection isn't considered idle by NATs even if there is no input or output.
+func (sessConn *Connection) keepAlive(period time.Duration) {
+	if period <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-sessConn.doneCh:
+			return
+		case <-ticker.C:
+			if err := sessConn.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(pingWriteTimeout)); err != nil {
+				logger.Debugf("send ping error: %v", err)
+
+				return
+			}
+		}
+	}
+}
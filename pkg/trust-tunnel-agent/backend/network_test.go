@@ -0,0 +1,44 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package backend
+
+import (
+	"testing"
+	"trust-tunnel/pkg/trust-tunnel-client/protocol"
+)
+
+func TestFrameSize(t *testing.T) {
+	for _, test := range []struct {
+		config    NetworkConfig
+		profile   string
+		requested int
+		want      int
+	}{
+		{NetworkConfig{}, "", 0, 4096},
+		{NetworkConfig{}, protocol.FrameProfileBulk, 0, 64 << 10},
+		{NetworkConfig{FrameSize: 8192, BulkFrameSize: 1 << 20}, protocol.FrameProfileDefault, 0, 8192},
+		{NetworkConfig{FrameSize: 8192, BulkFrameSize: 1 << 20}, protocol.FrameProfileBulk, 0, 1 << 20},
+		// The sizes requested override the profile within the limits.
+		{NetworkConfig{}, protocol.FrameProfileBulk, 16384, 16384},
+		{NetworkConfig{}, "", 100, 512},
+		{NetworkConfig{}, "", 1 << 30, 64 << 10},
+		// The bulk frames are never smaller than the default ones.
+		{NetworkConfig{FrameSize: 128 << 10}, protocol.FrameProfileBulk, 0, 128 << 10},
+	} {
+		if got := test.config.frameSize(test.profile, test.requested); got != test.want {
+			t.Errorf("got frame size %d of %+v with profile %q and %d requested, want %d", got, test.config, test.profile,
+				test.requested, test.want)
+		}
+	}
+}
@@ -0,0 +1,35 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+// writeNotice injects the notice of the agent, e.g. a banner or a warning, into the output of the session.
+// It goes to the terminal of TTY sessions with the line endings of terminals, or stderr otherwise to leave the
+// output of the command intact. The callers writing while the output is relayed must hold the lock of the
+// connection.
+func writeNotice(conn *websocket.Conn, tty bool, notice string) error {
+	msgType, newline := websocket.TextMessage, "\n"
+	if tty {
+		msgType, newline = websocket.BinaryMessage, "\r\n"
+		notice = strings.ReplaceAll(notice, "\n", newline)
+	}
+
+	return conn.WriteMessage(msgType, []byte(notice+newline))
+}
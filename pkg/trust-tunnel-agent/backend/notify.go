@@ -0,0 +1,347 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"slices"
+	"sync"
+	"text/template"
+	"time"
+	"trust-tunnel/pkg/common/sessionutil"
+	"trust-tunnel/pkg/trust-tunnel-agent/backend/request"
+	"trust-tunnel/pkg/trust-tunnel-agent/monitor"
+
+	client "trust-tunnel/pkg/trust-tunnel-client"
+)
+
+// The events of the session lifecycle posted to the webhooks.
+const (
+	EventSessionStart  = "session_start"
+	EventSessionEnd    = "session_end"
+	EventSessionDenied = "session_denied"
+)
+
+// The types of the webhooks.
+const (
+	WebhookGeneric  = "generic"
+	WebhookSlack    = "slack"
+	WebhookDingTalk = "dingtalk"
+)
+
+const (
+	// notifyTimeout is the timeout of posting an event to a webhook.
+	notifyTimeout = 10 * time.Second
+
+	defaultWebhookRatePerMinute = 60
+
+	// defaultWebhookTemplate is the text of the chat messages if the template isn't given.
+	defaultWebhookTemplate = "trust-tunnel {{.Event}}: {{.Request.UserName}} as {{.Request.LoginName}} on {{.Target}}" +
+		"{{if .SessionID}}, session {{.SessionID}}{{end}}{{if .Reason}}, {{.Reason}}{{end}}" +
+		"{{if .Message}}: {{.Message}}{{end}}"
+)
+
+var notifyClient = &http.Client{Timeout: notifyTimeout}
+
+// NotifyConfig specifies the webhooks notified of the session lifecycle events.
+type NotifyConfig struct {
+	Webhooks []WebhookConfig `toml:"webhooks"`
+}
+
+// WebhookConfig specifies a webhook notified of the session lifecycle events.
+type WebhookConfig struct {
+	// Name identifies the webhook in the logs and the metrics.
+	Name string `toml:"name"`
+
+	// Type is "slack" or "dingtalk" to post the text of Template as a chat message, or "generic" to post the
+	// SessionEvent in JSON, or the text of Template if it's given. Defaults to "generic".
+	Type string `toml:"type"`
+
+	URL string `toml:"url"`
+
+	// Events are the events posted, "session_start", "session_end" or "session_denied", all if it's empty.
+	Events []string `toml:"events"`
+
+	// Sensitivities are the sensitivity levels of the targets given by the auth handler whose events are posted,
+	// "default" for the targets without a level. The events of all targets are posted if it's empty.
+	Sensitivities []string `toml:"sensitivities"`
+
+	// Template is the text/template of the message, executed with the SessionEvent.
+	Template string `toml:"template"`
+
+	// RatePerMinute is the maximum events posted per minute, the others are dropped. Defaults to 60.
+	RatePerMinute int `toml:"rate_per_minute"`
+}
+
+// SessionEvent is posted to the webhooks on the lifecycle events of the sessions.
+type SessionEvent struct {
+	Event     string    `json:"event"`
+	Time      time.Time `json:"time"`
+	Agent     string    `json:"agent"`
+	SessionID string    `json:"session_id,omitempty"`
+	SrcIP     string    `json:"src_ip,omitempty"`
+	// Target is the pod and the container, or the IP address of the host.
+	Target      string `json:"target"`
+	Sensitivity string `json:"sensitivity,omitempty"`
+	// Reason is the termination reason of session_end, or the denial reason of session_denied.
+	Reason string `json:"reason,omitempty"`
+	// Message is the message of the denial.
+	Message string        `json:"message,omitempty"`
+	Request *request.Info `json:"request"`
+}
+
+// webhook posts the events to a configured webhook.
+type webhook struct {
+	config   WebhookConfig
+	template *template.Template
+
+	lock sync.Mutex
+	// window is the start of the current minute of rate limiting, and posted is the events posted in it.
+	window time.Time
+	posted int
+}
+
+// notifier notifies the webhooks of the session lifecycle events.
+type notifier struct {
+	webhooks []*webhook
+}
+
+// sessionNotifier notifies the webhooks of the session lifecycle events, set up with the handler.
+// The events aren't posted if it's nil.
+var sessionNotifier *notifier
+
+// newNotifier creates the notifier of the configured webhooks, it's nil if no webhook is configured.
+func newNotifier(c *NotifyConfig) (*notifier, error) {
+	if len(c.Webhooks) == 0 {
+		return nil, nil
+	}
+
+	n := &notifier{}
+
+	for i := range c.Webhooks {
+		w := &webhook{config: c.Webhooks[i]}
+		if err := w.init(); err != nil {
+			return nil, fmt.Errorf("webhook %s: %v", w.config.Name, err)
+		}
+
+		n.webhooks = append(n.webhooks, w)
+	}
+
+	return n, nil
+}
+
+// init checks the configuration of the webhook and fills in the defaults.
+func (w *webhook) init() error {
+	if w.config.Name == "" {
+		w.config.Name = w.config.URL
+	}
+
+	if w.config.URL == "" {
+		return fmt.Errorf("url is required")
+	}
+
+	switch w.config.Type {
+	case "":
+		w.config.Type = WebhookGeneric
+	case WebhookGeneric, WebhookSlack, WebhookDingTalk:
+	default:
+		return fmt.Errorf("unknown type %q", w.config.Type)
+	}
+
+	for _, event := range w.config.Events {
+		switch event {
+		case EventSessionStart, EventSessionEnd, EventSessionDenied:
+		default:
+			return fmt.Errorf("unknown event %q", event)
+		}
+	}
+
+	if w.config.RatePerMinute <= 0 {
+		w.config.RatePerMinute = defaultWebhookRatePerMinute
+	}
+
+	text := w.config.Template
+	if text == "" && w.config.Type == WebhookGeneric {
+		return nil
+	}
+
+	if text == "" {
+		text = defaultWebhookTemplate
+	}
+
+	var err error
+	if w.template, err = template.New(w.config.Name).Parse(text); err != nil {
+		return fmt.Errorf("invalid template: %v", err)
+	}
+
+	return nil
+}
+
+// matches returns whether the event is posted to the webhook.
+func (w *webhook) matches(event *SessionEvent) bool {
+	if len(w.config.Events) > 0 && !slices.Contains(w.config.Events, event.Event) {
+		return false
+	}
+
+	sensitivity := event.Sensitivity
+	if sensitivity == "" {
+		sensitivity = "default"
+	}
+
+	return len(w.config.Sensitivities) == 0 || slices.Contains(w.config.Sensitivities, sensitivity)
+}
+
+// allow returns whether the event is within the rate limit of the webhook.
+func (w *webhook) allow(now time.Time) bool {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if now.Sub(w.window) >= time.Minute {
+		w.window = now
+		w.posted = 0
+	}
+
+	if w.posted >= w.config.RatePerMinute {
+		return false
+	}
+
+	w.posted++
+
+	return true
+}
+
+// body returns the body of the event posted to the webhook.
+func (w *webhook) body(event *SessionEvent) ([]byte, error) {
+	if w.template == nil {
+		return json.Marshal(event)
+	}
+
+	var text bytes.Buffer
+	if err := w.template.Execute(&text, event); err != nil {
+		return nil, err
+	}
+
+	switch w.config.Type {
+	case WebhookSlack:
+		return json.Marshal(map[string]string{"text": text.String()})
+	case WebhookDingTalk:
+		return json.Marshal(map[string]interface{}{"msgtype": "text", "text": map[string]string{"content": text.String()}})
+	default:
+		return text.Bytes(), nil
+	}
+}
+
+// post posts the event to the webhook.
+func (w *webhook) post(event *SessionEvent) error {
+	b, err := w.body(event)
+	if err != nil {
+		return err
+	}
+
+	resp, err := notifyClient.Post(w.config.URL, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// notify posts the event to the matching webhooks in background, the sessions aren't held up by the webhooks.
+// The events beyond the rate limits are dropped.
+func (n *notifier) notify(event *SessionEvent) {
+	if n == nil {
+		return
+	}
+
+	event.Time = time.Now()
+	event.Agent = sessionutil.GetMainIP()
+	event.Target = eventTarget(event.Request)
+
+	if event.Sensitivity == "" {
+		event.Sensitivity = event.Request.Sensitivity
+	}
+
+	for _, w := range n.webhooks {
+		if !w.matches(event) {
+			continue
+		}
+
+		if !w.allow(event.Time) {
+			monitor.MetricsNotifications.WithLabelValues(w.config.Name, "dropped").Inc()
+			logger.Warnf("webhook %s is rate limited, drop the %s event of session %s", w.config.Name, event.Event, event.SessionID)
+
+			continue
+		}
+
+		w := w
+
+		monitor.Go("notify", func() {
+			if err := w.post(event); err != nil {
+				monitor.MetricsNotifications.WithLabelValues(w.config.Name, "failed").Inc()
+				logger.Errorf("post %s event to webhook %s failed: %v", event.Event, w.config.Name, err)
+
+				return
+			}
+
+			monitor.MetricsNotifications.WithLabelValues(w.config.Name, "sent").Inc()
+		})
+	}
+}
+
+// notifyStart notifies the webhooks that the session is established.
+func notifyStart(req *request.Info, sessID, remoteAddr string) {
+	event := &SessionEvent{Event: EventSessionStart, SessionID: sessID, Request: req}
+	event.SrcIP, _ = sessionutil.SplitHostPort(remoteAddr)
+	sessionNotifier.notify(event)
+}
+
+// notifyEnd notifies the webhooks that the session is terminated.
+func notifyEnd(req *request.Info, sessID string, reason client.TerminationReason) {
+	sessionNotifier.notify(&SessionEvent{Event: EventSessionEnd, SessionID: sessID, Reason: string(reason), Request: req})
+}
+
+// notifyDenied notifies the webhooks that the request is denied.
+func notifyDenied(req *request.Info, remoteAddr, reason, message string) {
+	event := &SessionEvent{Event: EventSessionDenied, SessionID: req.SessionID, Reason: reason, Message: message, Request: req}
+	event.SrcIP, _ = sessionutil.SplitHostPort(remoteAddr)
+	sessionNotifier.notify(event)
+}
+
+// eventTarget describes the target of the request.
+func eventTarget(req *request.Info) string {
+	if req.TargetType == client.TargetPhys {
+		if req.IPAddress != "" {
+			return req.IPAddress
+		}
+
+		return sessionutil.GetMainIP()
+	}
+
+	container := req.ContainerName
+	if container == "" {
+		container = req.ContainerID
+	}
+
+	return path.Join(req.PodName, container)
+}
@@ -0,0 +1,91 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+	"trust-tunnel/pkg/trust-tunnel-agent/backend/request"
+
+	client "trust-tunnel/pkg/trust-tunnel-client"
+)
+
+func TestNotifier(t *testing.T) {
+	bodies := make(chan string, 4)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		bodies <- r.URL.Path + " " + string(b)
+	}))
+	defer server.Close()
+
+	n, err := newNotifier(&NotifyConfig{Webhooks: []WebhookConfig{
+		{Name: "generic", URL: server.URL + "/generic", Events: []string{EventSessionDenied}},
+		{Name: "slack", Type: WebhookSlack, URL: server.URL + "/slack", Sensitivities: []string{"high"}, RatePerMinute: 1},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	receive := func() string {
+		t.Helper()
+
+		select {
+		case body := <-bodies:
+			return body
+		case <-time.After(5 * time.Second):
+			t.Fatal("event isn't posted")
+		}
+
+		return ""
+	}
+
+	req := &request.Info{UserName: "alice", LoginName: "root", TargetType: client.TargetContainer, PodName: "pod", ContainerName: "app"}
+
+	// The start of the session to a target without a level matches neither of the webhooks.
+	n.notify(&SessionEvent{Event: EventSessionStart, SessionID: "1", Request: req})
+
+	n.notify(&SessionEvent{Event: EventSessionDenied, Reason: "forbidden", Request: req})
+
+	var event SessionEvent
+	if body := receive(); json.Unmarshal([]byte(body[len("/generic "):]), &event) != nil || event.Target != "pod/app" ||
+		event.Reason != "forbidden" || event.Request.UserName != "alice" {
+		t.Fatalf("unexpected event %s", body)
+	}
+
+	req.Sensitivity = "high"
+	n.notify(&SessionEvent{Event: EventSessionEnd, SessionID: "1", Reason: string(client.TerminationExited), Request: req})
+
+	expected := `/slack {"text":"trust-tunnel session_end: alice as root on pod/app, session 1, exited"}`
+	if body := receive(); body != expected {
+		t.Fatalf("expected %s, got %s", expected, body)
+	}
+
+	// The events beyond the rate limit are dropped.
+	n.notify(&SessionEvent{Event: EventSessionEnd, SessionID: "2", Request: req})
+
+	select {
+	case body := <-bodies:
+		t.Fatalf("event beyond the rate limit is posted: %s", body)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if _, err = newNotifier(&NotifyConfig{Webhooks: []WebhookConfig{{URL: server.URL, Type: "email"}}}); err == nil {
+		t.Error("unknown type should be refused")
+	}
+}
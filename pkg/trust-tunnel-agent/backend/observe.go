@@ -0,0 +1,552 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package backend
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+	"trust-tunnel/pkg/common/logutil"
+	"trust-tunnel/pkg/common/watermark"
+	"trust-tunnel/pkg/trust-tunnel-agent/backend/request"
+	"trust-tunnel/pkg/trust-tunnel-agent/monitor"
+	"trust-tunnel/pkg/trust-tunnel-client/protocol"
+
+	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultMaxObservers = 4
+
+	defaultWitnessTimeout = 5 * time.Minute
+
+	// observerQueueSize is how many frames are queued for an observer, which is dropped once it falls further behind,
+	// so that the slow observers never hold up the session.
+	observerQueueSize = 256
+)
+
+var errSessionEnded = errors.New("the session has ended")
+
+// ObserveConfig specifies the read-only observers attaching to the live sessions, e.g. to shadow a troubleshooting
+// session together.
+type ObserveConfig struct {
+	// Enabled specifies whether the sessions can be observed.
+	Enabled bool `toml:"enabled"`
+
+	// MaxObservers is the maximum number of the observers of a session at once. Defaults to 4.
+	MaxObservers int `toml:"max_observers"`
+
+	// DualControl lists the sensitivity levels of the targets given by the auth handler whose sessions are under
+	// dual control: they're only established once another user observes them as the witness, and their input is
+	// discarded while no witness observes them. The level "default" applies to the targets without a level.
+	DualControl []string `toml:"dual_control"`
+
+	// WitnessTimeout is how long the sessions under dual control wait for their witnesses before they're refused.
+	// Defaults to 5m.
+	WitnessTimeout time.Duration `toml:"witness_timeout"`
+}
+
+// withDefaults returns the configuration with the defaults filled in.
+func (c ObserveConfig) withDefaults() ObserveConfig {
+	if c.MaxObservers <= 0 {
+		c.MaxObservers = defaultMaxObservers
+	}
+
+	if c.WitnessTimeout <= 0 {
+		c.WitnessTimeout = defaultWitnessTimeout
+	}
+
+	return c
+}
+
+// dualControl returns whether the sessions to the targets of the sensitivity level are under dual control.
+func (c *ObserveConfig) dualControl(sensitivity string) bool {
+	if sensitivity == "" {
+		sensitivity = "default"
+	}
+
+	return c.Enabled && slices.Contains(c.DualControl, sensitivity)
+}
+
+// observerFrame is a message relayed to an observer.
+type observerFrame struct {
+	msgType int
+	data    []byte
+}
+
+// observer is a read-only connection attached to a live session, receiving the output of the session.
+type observer struct {
+	conn *websocket.Conn
+	user string
+	// watermark watermarks the terminal output relayed to the observer if it's not nil.
+	watermark *watermark.Writer
+	frames    chan observerFrame
+	// done is closed once the observer is detached from the session, with closeMsg to send then.
+	done      chan struct{}
+	closeMsg  []byte
+	closeOnce sync.Once
+}
+
+// newObserver returns the observer of the connection.
+func newObserver(conn *websocket.Conn, user string, wm *watermark.Writer) *observer {
+	return &observer{
+		conn:      conn,
+		user:      user,
+		watermark: wm,
+		frames:    make(chan observerFrame, observerQueueSize),
+		done:      make(chan struct{}),
+	}
+}
+
+// detach stops relaying to the observer, which is sent the close message if it's not nil.
+func (o *observer) detach(closeMsg []byte) {
+	o.closeOnce.Do(func() {
+		o.closeMsg = closeMsg
+		close(o.done)
+	})
+}
+
+// serve relays the frames to the observer until it's detached, pinging it once per period if it's positive.
+// The connection is closed once the frames queued are relayed.
+func (o *observer) serve(pingPeriod time.Duration) {
+	defer o.conn.Close()
+
+	var ping <-chan time.Time
+
+	if pingPeriod > 0 {
+		ticker := time.NewTicker(pingPeriod)
+		defer ticker.Stop()
+
+		ping = ticker.C
+	}
+
+	for {
+		select {
+		case frame := <-o.frames:
+			if err := o.write(frame); err != nil {
+				logger.Debugf("relay output to observer %s error: %v", o.user, err)
+
+				return
+			}
+		case <-ping:
+			if err := o.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(pingWriteTimeout)); err != nil {
+				logger.Debugf("send ping to observer %s error: %v", o.user, err)
+
+				return
+			}
+		case <-o.done:
+			for {
+				select {
+				case frame := <-o.frames:
+					if err := o.write(frame); err != nil {
+						return
+					}
+				default:
+					if o.closeMsg != nil {
+						o.conn.WriteMessage(websocket.CloseMessage, o.closeMsg)
+					}
+
+					return
+				}
+			}
+		}
+	}
+}
+
+// write writes the frame to the observer, the terminal output is watermarked for the observer.
+func (o *observer) write(frame observerFrame) error {
+	if frame.msgType != websocket.BinaryMessage || o.watermark == nil {
+		return o.conn.WriteMessage(frame.msgType, frame.data)
+	}
+
+	msgWriter, err := o.conn.NextWriter(frame.msgType)
+	if err != nil {
+		return err
+	}
+
+	o.watermark.Reset(msgWriter)
+
+	if _, err = o.watermark.Write(frame.data); err != nil {
+		msgWriter.Close()
+
+		return err
+	}
+
+	return msgWriter.Close()
+}
+
+// observerSet is the observers of a session, shared by the connections of the session across reattachments.
+type observerSet struct {
+	lock      sync.Mutex
+	observers map[*observer]struct{}
+	limit     int
+	// ended is set once the output of the session ends, no observer is attached since then.
+	ended bool
+
+	// owner is the writer of the session under dual control, it's empty if the session isn't under dual control.
+	// The witnesses are the other users who have observed the session, and witnessed is closed once the first
+	// of them attaches.
+	owner     string
+	witnesses []string
+	witnessed chan struct{}
+}
+
+// newObserverSet returns the observers of a session of at most limit observers at once.
+func newObserverSet(limit int) *observerSet {
+	return &observerSet{observers: make(map[*observer]struct{}), limit: limit}
+}
+
+// newDualControlSet returns the observers of a session of the owner under dual control.
+func newDualControlSet(limit int, owner string) *observerSet {
+	s := newObserverSet(limit)
+	s.owner = owner
+	s.witnessed = make(chan struct{})
+
+	return s
+}
+
+// add attaches the observer to the session.
+func (s *observerSet) add(o *observer) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.ended {
+		return errSessionEnded
+	}
+
+	if len(s.observers) >= s.limit {
+		return fmt.Errorf("the session has %d observers already", len(s.observers))
+	}
+
+	s.observers[o] = struct{}{}
+
+	// The owner can't witness its own session.
+	if s.owner != "" && o.user != s.owner {
+		if len(s.witnesses) == 0 {
+			close(s.witnessed)
+		}
+
+		if !slices.Contains(s.witnesses, o.user) {
+			s.witnesses = append(s.witnesses, o.user)
+		}
+	}
+
+	return nil
+}
+
+// awaitWitness waits up to timeout for the first witness of the session under dual control, and returns it.
+func (s *observerSet) awaitWitness(timeout time.Duration) (string, bool) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-s.witnessed:
+	case <-timer.C:
+		return "", false
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.witnesses[0], true
+}
+
+// locked returns whether the input of the session is discarded, which is while no witness observes the session under
+// dual control. The set may be nil for the sessions unable to be observed.
+func (s *observerSet) locked() bool {
+	if s == nil || s.owner == "" {
+		return false
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for o := range s.observers {
+		if o.user != s.owner {
+			return false
+		}
+	}
+
+	return true
+}
+
+// witnessList returns the users who have witnessed the session, the set may be nil.
+func (s *observerSet) witnessList() []string {
+	if s == nil {
+		return nil
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return slices.Clone(s.witnesses)
+}
+
+// remove detaches the observer from the session, and returns whether it was attached.
+func (s *observerSet) remove(o *observer) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, ok := s.observers[o]; !ok {
+		return false
+	}
+
+	delete(s.observers, o)
+	o.detach(nil)
+
+	return true
+}
+
+// observed returns whether the session has any observer, the set may be nil for the sessions unable to be observed.
+func (s *observerSet) observed() bool {
+	if s == nil {
+		return false
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return len(s.observers) > 0
+}
+
+// send relays the output of the session to the observers, the observers falling behind are dropped.
+func (s *observerSet) send(data []byte, isErr bool) {
+	frame := observerFrame{msgType: websocket.BinaryMessage, data: data}
+	if isErr {
+		frame.msgType = websocket.TextMessage
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for o := range s.observers {
+		select {
+		case o.frames <- frame:
+		default:
+			logger.Warnf("observer %s falls behind the session, drop it", o.user)
+
+			delete(s.observers, o)
+			o.detach(websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "observer falls behind the session"))
+		}
+	}
+}
+
+// end detaches the observers once the output of the session ends, sending them the close message of the session.
+func (s *observerSet) end(closeMsg []byte) {
+	if s == nil {
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.ended = true
+
+	for o := range s.observers {
+		delete(s.observers, o)
+		o.detach(closeMsg)
+	}
+}
+
+// observersOf returns the observers of the session, which are the ones of the previous connection of the reattached
+// session unless its output ended with the connection. It's nil if the observers are disabled. The new observers of
+// the session under dual control await a witness again.
+func (handler *Handler) observersOf(prev *observerSet, req *request.Info) *observerSet {
+	if !handler.config.ObserveConfig.Enabled {
+		return nil
+	}
+
+	if prev != nil {
+		prev.lock.Lock()
+		ended := prev.ended
+		prev.lock.Unlock()
+
+		if !ended {
+			return prev
+		}
+	}
+
+	limit := handler.config.ObserveConfig.withDefaults().MaxObservers
+	if req.DualControl {
+		return newDualControlSet(limit, req.UserName)
+	}
+
+	return newObserverSet(limit)
+}
+
+// liveConnection returns the connection attached to the live session of the ID which can be observed, or nil.
+func (handler *Handler) liveConnection(sessID string) *Connection {
+	handler.lock.Lock()
+	defer handler.lock.Unlock()
+
+	for sessConn := range handler.connections {
+		if sessConn.sessID == sessID && sessConn.observers != nil {
+			return sessConn
+		}
+	}
+
+	return nil
+}
+
+// observable returns the request and the observers of the live session of the ID which can be observed, or of the
+// new session of the ID awaiting its witness under dual control. The observers are nil if there's no such session.
+func (handler *Handler) observable(sessID string) (*request.Info, *observerSet) {
+	if sessConn := handler.liveConnection(sessID); sessConn != nil {
+		return sessConn.requestInfo, sessConn.observers
+	}
+
+	handler.lock.Lock()
+	defer handler.lock.Unlock()
+
+	if awaiting, ok := handler.awaiting[sessID]; ok {
+		return awaiting.requestInfo, awaiting.observers
+	}
+
+	return nil, nil
+}
+
+// observedRequest returns the request of the observer to authorize, which is the request of the session on behalf of
+// the observer.
+func observedRequest(sessInfo, observerInfo *request.Info) *request.Info {
+	req := *sessInfo
+	req.UserName = observerInfo.UserName
+	req.JumpVia = observerInfo.JumpVia
+	req.AffinityToken = observerInfo.AffinityToken
+	req.MFA = observerInfo.MFA
+	req.Tags = observerInfo.Tags
+	req.Observe = true
+	req.Interactive = false
+	req.BreakGlass = false
+	req.Sensitivity = ""
+	req.Env = nil
+	req.CommandFrame = 0
+	req.Confirm = false
+
+	return &req
+}
+
+// observe attaches the request to the live session of its session ID as a read-only observer. The observer is
+// authorized for the target of the session, and the writer of the session is told that it's observed.
+func (handler *Handler) observe(w http.ResponseWriter, r *http.Request, requestLogger *logrus.Entry, requestInfo *request.Info,
+	correlationID string) {
+	sessID := requestInfo.SessionID
+	requestLogger = requestLogger.WithField(logutil.FieldSessionID, sessID)
+
+	if !handler.config.ObserveConfig.Enabled {
+		requestLogger.Warnln("Request invalid: observers are disabled")
+		http.Error(w, "request error: observers are disabled", http.StatusForbidden)
+
+		return
+	}
+
+	sessInfo, observers := handler.observable(sessID)
+	if observers == nil {
+		requestLogger.Warnf("Request invalid: no live session %s to observe", sessID)
+		http.Error(w, "request error: no live session to observe", http.StatusNotFound)
+
+		return
+	}
+
+	req := observedRequest(sessInfo, requestInfo)
+	if requestInfo.Tenant != req.Tenant {
+		err := fmt.Errorf("session %s belongs to another tenant", sessID)
+		requestLogger.Warnf("authorization failed: %v", err)
+		auditDenial(req, r.RemoteAddr, "tenant_mismatch", err.Error(), 0)
+
+		return
+	}
+
+	authz, ok := handler.authorize(requestLogger, req, r.RemoteAddr)
+	if !ok {
+		return
+	}
+
+	// The observers are only let in by the auth handler, without challenges.
+	if req.BreakGlass || authz.mfa != nil {
+		err := fmt.Errorf("observers can't break the glass or answer MFA challenges")
+		requestLogger.Warnf("authorization failed: %v", err)
+		auditDenial(req, r.RemoteAddr, "observe_denied", err.Error(), authz.latency)
+
+		return
+	}
+
+	responseHeader := http.Header{}
+	responseHeader.Set(headerSessionID, sessID)
+	responseHeader.Set(headerCorrelationID, correlationID)
+	responseHeader.Set(protocol.HeaderProtocolVersion, strconv.Itoa(protocol.Version))
+
+	conn, err := handler.upgrader.Upgrade(w, r, responseHeader)
+	if err != nil {
+		requestLogger.Warnln("Upgrade observer error: ", err)
+
+		return
+	}
+	defer conn.Close()
+
+	var wm *watermark.Writer
+	if interval, ok := handler.config.SessionConfig.watermarkInterval(authz.sensitivity); ok && req.Tty {
+		wm = watermark.NewWriter(nil, watermark.Mark{User: req.UserName, SessionID: sessID}, interval)
+	}
+
+	o := newObserver(conn, req.UserName, wm)
+	if err = observers.add(o); err != nil {
+		requestLogger.Warnln("Attach observer error: ", err)
+		refuseUpgraded(conn, err.Error())
+
+		return
+	}
+
+	auditObserve(req, r.RemoteAddr)
+	requestLogger.Infof("observer %s attached", req.UserName)
+	handler.notifyObserved(sessID, fmt.Sprintf("[trust-tunnel] %s is observing the session", req.UserName))
+
+	served := make(chan struct{})
+
+	monitor.Go("observer_output", func() {
+		defer close(served)
+
+		o.serve(handler.config.NetworkConfig.pingPeriod())
+	})
+
+	// The input of the observer is discarded, it's read for the close frame and the pongs.
+	for {
+		if _, _, err = conn.ReadMessage(); err != nil {
+			break
+		}
+	}
+
+	if observers.remove(o) {
+		handler.notifyObserved(sessID, fmt.Sprintf("[trust-tunnel] %s stopped observing the session", req.UserName))
+	}
+
+	<-served
+	requestLogger.Infof("observer %s detached", req.UserName)
+}
+
+// notifyObserved tells the writer of the session attached at the moment about its observers.
+func (handler *Handler) notifyObserved(sessID, notice string) {
+	sessConn := handler.liveConnection(sessID)
+	if sessConn == nil {
+		return
+	}
+
+	if err := sessConn.notify(notice); err != nil {
+		logger.Warnf("notify observed session failed: %v", err)
+	}
+}
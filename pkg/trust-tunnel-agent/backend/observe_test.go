@@ -0,0 +1,153 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package backend
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+	"trust-tunnel/pkg/trust-tunnel-agent/backend/request"
+	"trust-tunnel/pkg/trust-tunnel-agent/sessionio"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestObserverSet(t *testing.T) {
+	set := newObserverSet(1)
+	o := newObserver(nil, "alice", nil)
+
+	if err := set.add(o); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if err := set.add(newObserver(nil, "bob", nil)); err == nil {
+		t.Errorf("observers beyond the limit should be refused")
+	}
+
+	set.send([]byte("err"), true)
+
+	if frame := <-o.frames; frame.msgType != websocket.TextMessage || string(frame.data) != "err" {
+		t.Errorf("unexpected frame %v", frame)
+	}
+
+	// The observer falling behind is dropped instead of holding up the session.
+	for i := 0; i <= observerQueueSize; i++ {
+		set.send([]byte("out"), false)
+	}
+
+	select {
+	case <-o.done:
+	default:
+		t.Fatalf("observer falling behind should be dropped")
+	}
+
+	if set.observed() || o.closeMsg == nil {
+		t.Errorf("unexpected observer %v, close message %q", set.observers, o.closeMsg)
+	}
+
+	// The observers are told how the session ends, and no observer is attached since then.
+	o = newObserver(nil, "bob", nil)
+	if err := set.add(o); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	set.end([]byte("closed"))
+
+	if string(o.closeMsg) != "closed" || set.observed() {
+		t.Errorf("unexpected close message %q", o.closeMsg)
+	}
+
+	if err := set.add(newObserver(nil, "carol", nil)); !errors.Is(err, errSessionEnded) {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	// The reattached session gets new observers once the output of the previous connection ended.
+	handler := &Handler{config: &Config{ObserveConfig: ObserveConfig{Enabled: true}}}
+	if next := handler.observersOf(set, &request.Info{}); next == set || next.limit != defaultMaxObservers {
+		t.Errorf("unexpected observers %v", next)
+	}
+
+	if handler.observersOf(nil, &request.Info{}) == nil {
+		t.Errorf("observers should be created for the new sessions")
+	}
+
+	handler.config.ObserveConfig.Enabled = false
+	if handler.observersOf(nil, &request.Info{}) != nil {
+		t.Errorf("observers should be disabled")
+	}
+}
+
+func TestConnectionObservers(t *testing.T) {
+	sess := streamSession{sessionio.New()}
+	observers := newObserverSet(defaultMaxObservers)
+	attached := make(chan struct{}, 1)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+
+		if r.URL.Path == "/observe" {
+			o := newObserver(conn, "bob", nil)
+			observers.add(o)
+			attached <- struct{}{}
+
+			o.serve(0)
+
+			return
+		}
+
+		sessConn := &Connection{terminal: terminal{sess: sess}, conn: conn, observers: observers,
+			errCh: make(chan error, 1), doneCh: make(chan struct{})}
+
+		go sessConn.processLocalOutput()
+		go sessConn.processLocalError()
+	}))
+	defer server.Close()
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer conn.Close()
+
+	observerConn, _, err := websocket.DefaultDialer.Dial(url+"/observe", nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer observerConn.Close()
+
+	<-attached
+
+	// The output is relayed to both the writer and the observer.
+	sess.Stdout.Write([]byte("one"))
+	sess.Stderr.Write([]byte("err"))
+	readOutput(t, conn, "one", "err")
+	readOutput(t, observerConn, "one", "err")
+
+	// The observer is told that the session ends.
+	sess.Clean()
+
+	observerConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	if _, _, err = observerConn.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
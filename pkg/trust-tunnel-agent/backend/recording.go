@@ -0,0 +1,142 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"trust-tunnel/pkg/common/asciicast"
+	"trust-tunnel/pkg/trust-tunnel-agent/backend/request"
+	"trust-tunnel/pkg/trust-tunnel-agent/recordstore"
+
+	"github.com/sirupsen/logrus"
+)
+
+// maxRecordingSuffix is the largest suffix tried for the recording of a session ID already recorded.
+const maxRecordingSuffix = 100
+
+// recordingFileNameExp matches the session IDs safe for the names of the recordings.
+var recordingFileNameExp = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// recording is the asciicast recording of a session, kept across the reattachments of the session.
+type recording struct {
+	recorder *asciicast.Recorder
+	path     string
+	// input is whether the input of the session is recorded.
+	input bool
+	// uploader uploads the recording once it's closed, it's nil if the recordings aren't uploaded.
+	uploader *recordstore.Uploader
+}
+
+// recordable returns whether the session of the request is recorded. The copies and the port forwards carry tar
+// and forward frames rather than terminal I/O, and the files read are audited by their paths and hashes instead.
+func recordable(req *request.Info) bool {
+	return req.Copy == nil && req.Forward == nil && req.File == nil
+}
+
+// startRecording creates the recording of the new session of the request, it's nil if the session isn't recorded.
+// The session must be refused if the recording can't be created, so that no session escapes the recording.
+func (handler *Handler) startRecording(requestLogger *logrus.Entry, req *request.Info, sessID string) (*recording, error) {
+	conf := &handler.config.SessionConfig
+	if conf.RecordDir == "" || !recordable(req) {
+		return nil, nil
+	}
+
+	if !recordingFileNameExp.MatchString(sessID) || sessID == "." || sessID == ".." {
+		return nil, fmt.Errorf("session recording error: invalid session id %q", sessID)
+	}
+
+	if err := os.MkdirAll(conf.RecordDir, 0o700); err != nil {
+		return nil, fmt.Errorf("session recording error: %v", err)
+	}
+
+	path, f, err := handler.recordUploader.Create(func() (string, *os.File, error) {
+		return createRecordingFile(conf.RecordDir, sessID)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("session recording error: %v", err)
+	}
+
+	header := asciicast.Header{
+		Command: strings.Join(req.Cmd, " "),
+		Title:   fmt.Sprintf("%s@%s %s", req.LoginName, recordingTarget(req), sessID),
+	}
+
+	if term := req.Env["TERM"]; term != "" {
+		header.Env = map[string]string{"TERM": term}
+	}
+
+	requestLogger.Infof("record session to %s", path)
+
+	return &recording{
+		recorder: asciicast.NewRecorder(f, header),
+		path:     path,
+		input:    conf.RecordInput,
+		uploader: handler.recordUploader,
+	}, nil
+}
+
+// createRecordingFile creates the recording file <session id>.cast in the directory. The sessions established
+// within the same second share the ID, and the recordings of the later ones are suffixed with -1, -2 and so on.
+func createRecordingFile(dir, sessID string) (string, *os.File, error) {
+	for i := 0; ; i++ {
+		name := sessID
+		if i > 0 {
+			name = fmt.Sprintf("%s-%d", sessID, i)
+		}
+
+		path := filepath.Join(dir, name+".cast")
+
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+		if err == nil {
+			return path, f, nil
+		}
+
+		if !os.IsExist(err) || i >= maxRecordingSuffix {
+			return "", nil, err
+		}
+	}
+}
+
+// recordingTarget returns the target of the session shown in the title of the recording.
+func recordingTarget(req *request.Info) string {
+	switch {
+	case req.PodName != "":
+		return req.PodName
+	case req.ContainerName != "":
+		return req.ContainerName
+	case req.ContainerID != "":
+		return req.ContainerID
+	default:
+		return req.AgentAddr
+	}
+}
+
+// close closes the recording if it's not nil, the failures of writing it are logged. The recording is uploaded
+// then if the uploads are configured.
+func (rec *recording) close() {
+	if rec == nil {
+		return
+	}
+
+	if err := rec.recorder.Close(); err != nil {
+		logger.Errorf("write session recording %s error: %v", rec.path, err)
+	}
+
+	rec.uploader.Finish(rec.path)
+}
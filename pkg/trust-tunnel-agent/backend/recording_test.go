@@ -0,0 +1,72 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"trust-tunnel/pkg/trust-tunnel-agent/backend/request"
+
+	"github.com/sirupsen/logrus"
+	client "trust-tunnel/pkg/trust-tunnel-client"
+)
+
+func TestStartRecording(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "recordings")
+	handler := &Handler{config: &Config{SessionConfig: SessionConfig{RecordDir: dir}}}
+	requestLogger := logrus.NewEntry(logrus.New())
+	req := &request.Info{LoginName: "root", PodName: "web-0", Cmd: []string{"bash", "-l"}}
+
+	// The sessions established within the same second share the ID.
+	var paths []string
+
+	for i := 0; i < 2; i++ {
+		rec, err := handler.startRecording(requestLogger, req, "20261017010203")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		rec.recorder.Output().Write([]byte("hello\n"))
+		rec.close()
+
+		paths = append(paths, rec.path)
+	}
+
+	if paths[0] != filepath.Join(dir, "20261017010203.cast") || paths[1] != filepath.Join(dir, "20261017010203-1.cast") {
+		t.Errorf("unexpected recording paths %v", paths)
+	}
+
+	data, err := os.ReadFile(paths[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(string(data), `"command":"bash -l","title":"root@web-0 20261017010203"`) ||
+		!strings.Contains(string(data), `"o","hello\n"]`) {
+		t.Errorf("unexpected recording %s", data)
+	}
+
+	if _, err = handler.startRecording(requestLogger, req, "../escape"); err == nil {
+		t.Error("expected error of invalid session id")
+	}
+
+	// The copies aren't recorded.
+	rec, err := handler.startRecording(requestLogger, &request.Info{Copy: &client.CopyRequest{}}, "20261017010204")
+	if rec != nil || err != nil {
+		t.Errorf("unexpected recording of copy %v %v", rec, err)
+	}
+}
@@ -16,17 +16,14 @@ package backend
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
-	"strconv"
 	"strings"
+	"trust-tunnel/pkg/trust-tunnel-client/protocol"
 
 	"github.com/gorilla/websocket"
-)
-
-const (
-	resizeHeader = "resize: "
-	closeHeader  = "close session"
+	client "trust-tunnel/pkg/trust-tunnel-client"
 )
 
 // processRemoteInput processes incoming messages from a remote connection.
@@ -40,16 +37,23 @@ func (sessConn *Connection) processRemoteInput() {
 		close(sessConn.errCh)
 	}()
 
+	// lockNoticed is whether the writer is told that the input is discarded since it's locked.
+	lockNoticed := false
+
 	for {
 		msgType, msgReader, err := sessConn.conn.NextReader()
 		if err != nil {
 			if closeErr, ok := err.(*websocket.CloseError); ok && closeErr.Code == websocket.CloseNormalClosure {
 				// normal close, ignore error
+				sessConn.setReason(client.TerminationClientClose)
+
 				return
 			}
 			// Network connection closed indicates IO closing, so do "unexpected EOF"
 			if strings.Contains(err.Error(), "use of closed network connection") ||
 				strings.Contains(err.Error(), "unexpected EOF") {
+				sessConn.setReason(client.TerminationClientClose)
+
 				return
 			}
 
@@ -71,22 +75,20 @@ func (sessConn *Connection) processRemoteInput() {
 
 			msg = msg[:n]
 
-			if bytes.HasPrefix(msg, []byte(resizeHeader)) {
-				msg = bytes.TrimPrefix(msg, []byte(resizeHeader))
-
-				vals := bytes.Split(msg, []byte(","))
-				if len(vals) == 2 {
-					h, _ := strconv.Atoi(string(vals[0]))
-					w, _ := strconv.Atoi(string(vals[1]))
-
-					if h > 0 && w > 0 {
-						sessConn.sess.Resize(h, w)
-					}
+			if bytes.HasPrefix(msg, []byte(protocol.ResizePrefix)) {
+				if h, w, ok := protocol.DecodeResize(msg); ok {
+					sessConn.resize(h, w)
 				}
-			} else if bytes.HasPrefix(msg, []byte(closeHeader)) {
+			} else if bytes.HasPrefix(msg, []byte(protocol.CloseSession)) {
 				logger.Debug("received close message,return")
+				sessConn.setReason(client.TerminationClientClose)
 
 				return
+			} else if bytes.HasPrefix(msg, []byte(protocol.CloseStdin)) {
+				// The input of the client reaches EOF, pass it to the command.
+				if err := sessConn.sess.CloseStdin(); err != nil {
+					logger.Warnf("close cmd's stdin error: %v", err)
+				}
 			}
 
 			continue
@@ -96,7 +98,33 @@ func (sessConn *Connection) processRemoteInput() {
 			continue
 		}
 
+		// The input of the sessions under dual control is discarded while no witness observes them.
+		if sessConn.inputBarrier.Load() {
+			continue
+		}
+
+		if sessConn.observers.locked() {
+			if !lockNoticed {
+				lockNoticed = true
+
+				if err = sessConn.notify("[trust-tunnel] dual control: the input is discarded until another user observes the session"); err != nil {
+					logger.Warnf("notify locked input failed: %v", err)
+				}
+			}
+
+			continue
+		}
+
+		lockNoticed = false
+
+		sessConn.active()
+
 		cmdStdin, err := sessConn.sess.NextStdin()
+		if errors.Is(err, io.EOF) {
+			// The session is cleaned, and its output tells how it ends.
+			return
+		}
+
 		if err != nil || cmdStdin == nil {
 			sessConn.errCh <- fmt.Errorf("got cmd's stdin error: %v", err)
 
@@ -104,15 +132,26 @@ func (sessConn *Connection) processRemoteInput() {
 		}
 
 		// teeReader is used for logging cmd from user input.
-		teeReader := io.TeeReader(msgReader, sessConn.cmdLogger)
+		var input io.Reader = msgReader
+		if !sessConn.rawInput {
+			input = io.TeeReader(msgReader, sessConn.cmdLogger)
+		}
+
+		if sessConn.recording != nil && sessConn.recording.input {
+			input = io.TeeReader(input, sessConn.recording.recorder.Input())
+		}
+
+		n, err := io.Copy(cmdStdin, input)
+		if errors.Is(err, io.EOF) {
+			return
+		}
 
-		n, err := io.Copy(cmdStdin, teeReader)
 		if err != nil {
 			sessConn.errCh <- fmt.Errorf("copy data from websocket to cmd's stdin failed: %v", err)
 
 			return
 		}
 
-		logger.Tracef("write to cmd's stdin %d bytes", n)
+		streamTraceSampler.Tracef(logger, "write to cmd's stdin %d bytes", n)
 	}
 }
@@ -15,13 +15,18 @@
 package request
 
 import (
-	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"math"
+	"net"
 	"net/http"
+	"path"
+	"regexp"
 	"strconv"
+	"strings"
 
 	client "trust-tunnel/pkg/trust-tunnel-client"
+	"trust-tunnel/pkg/trust-tunnel-client/protocol"
 )
 
 type Info struct {
@@ -37,12 +42,63 @@ type Info struct {
 	Interactive      bool              `json:"interactive"`
 	Tty              bool              `json:"tty"`
 	Cmd              []string          `json:"cmd"`
+	Shell            string            `json:"shell,omitempty"`
+	Tools            bool              `json:"tools,omitempty"`
 	UseBase64        bool              `json:"use_base64"`
 	IPAddress        string            `json:"ip_address"`
 	AppName          string            `json:"app_name"`
 	Cpus             float64           `json:"cpus"`
 	MemoryMB         int               `json:"memory_mb"`
 	DisableCleanMode bool              `json:"disable_clean_mode"`
+	AffinityToken    string            `json:"affinity_token"`
+	JumpTarget       string            `json:"jump_target"`
+	JumpVia          string            `json:"jump_via"`
+	// MFA is whether the client can answer MFA challenges.
+	MFA bool `json:"mfa,omitempty"`
+	// BreakGlass is whether the session is established without authorization for the auth handler is unavailable.
+	// It's set by the agent rather than the client.
+	BreakGlass bool `json:"break_glass,omitempty"`
+	// Sensitivity is the sensitivity level of the target given by the auth handler, set by the agent.
+	Sensitivity string `json:"sensitivity,omitempty"`
+	// Tenant is the tenant the request belongs to, identified by the agent from a header or the client certificate.
+	Tenant string `json:"tenant,omitempty"`
+	// Recording is the path of the recording of the session, set by the agent.
+	Recording string `json:"recording,omitempty"`
+	// DualControl is whether the session is only run while another user observes it as the witness, set by the agent.
+	DualControl bool `json:"dual_control,omitempty"`
+	// Witnesses are the other users who have observed the session under dual control, set by the agent.
+	Witnesses []string `json:"witnesses,omitempty"`
+	// Logs is set to stream the output of the main process of the container instead of running Cmd.
+	Logs *client.LogsOptions `json:"logs,omitempty"`
+	// File is set to read the file in the target by the agent instead of running Cmd.
+	File *client.FileRequest `json:"file,omitempty"`
+	// Copy is set to copy the files to or from the target by the agent instead of running Cmd.
+	Copy *client.CopyRequest `json:"copy,omitempty"`
+	// Forward is set to forward the connections of the client to the port of the target instead of running Cmd,
+	// on the forward endpoint.
+	Forward *client.ForwardRequest `json:"forward,omitempty"`
+	// Top is set to print the snapshot of the target instead of running Cmd.
+	Top bool `json:"top,omitempty"`
+	// Verb is set to run the verb natively by the agent instead of running Cmd.
+	Verb *client.VerbRequest `json:"verb,omitempty"`
+	// VerbScope is the auth scope of Verb, set by the agent serving the verb.
+	VerbScope string `json:"verb_scope,omitempty"`
+	// Tags are the key/value pairs tagging the session, checked against the tag policy of the agent.
+	Tags map[string]string `json:"tags,omitempty"`
+	// Env are the environment variables of the client to forward to the command, e.g. TERM and LANG, filtered by the
+	// policy of the agent.
+	Env map[string]string `json:"env,omitempty"`
+	// CommandFrame is the length of the command frame, which carries Cmd instead of the headers if it's positive.
+	CommandFrame int `json:"command_frame,omitempty"`
+	// Confirm is whether the client confirms the command resolved by the agent before it's run.
+	Confirm bool `json:"confirm,omitempty"`
+	// Observe is whether the client attaches to the live session of SessionID as a read-only observer instead of
+	// running Cmd.
+	Observe bool `json:"observe,omitempty"`
+	// FrameProfile is the tuning profile of the output frames, protocol.FrameProfileBulk for the copies.
+	FrameProfile string `json:"frame_profile,omitempty"`
+	// FrameSize is the size of the output frames requested, bounded by the agent, if it's positive.
+	FrameSize int `json:"frame_size,omitempty"`
 }
 
 // String returns the JSON representation of the request information.
@@ -58,42 +114,59 @@ func GetRequestInfo(r *http.Request) (*Info, error) {
 
 	var err error
 
-	tmp := r.Header["Session-Id"]
+	header := Header(r)
+
+	tmp := header["Session-Id"]
 	if len(tmp) > 0 {
 		info.SessionID = tmp[0]
 	}
 
-	tmp = r.Header["Agent-Addr"]
+	tmp = header["Affinity-Token"]
+	if len(tmp) > 0 {
+		info.AffinityToken = tmp[0]
+	}
+
+	tmp = header["Jump-Target"]
+	if len(tmp) > 0 {
+		info.JumpTarget = tmp[0]
+	}
+
+	tmp = header["Jump-Via"]
+	if len(tmp) > 0 {
+		info.JumpVia = tmp[0]
+	}
+
+	tmp = header["Agent-Addr"]
 	if len(tmp) > 0 {
 		info.AgentAddr = tmp[0]
 	}
 
-	tmp = r.Header["User-Name"]
+	tmp = header["User-Name"]
 	if len(tmp) > 0 {
 		info.UserName = tmp[0]
 	}
 
-	tmp = r.Header["App-Name"]
+	tmp = header["App-Name"]
 	if len(tmp) > 0 {
 		info.AppName = tmp[0]
 	}
 
-	tmp = r.Header["Ip-Address"]
+	tmp = header["Ip-Address"]
 	if len(tmp) > 0 {
 		info.IPAddress = tmp[0]
 	}
 
-	tmp = r.Header["Login-Name"]
+	tmp = header["Login-Name"]
 	if len(tmp) > 0 {
 		info.LoginName = tmp[0]
 	}
 
-	tmp = r.Header["Login-Group"]
+	tmp = header["Login-Group"]
 	if len(tmp) > 0 {
 		info.LoginGroup = tmp[0]
 	}
 
-	tmp = r.Header["Target-Type"]
+	tmp = header["Target-Type"]
 	if len(tmp) > 0 {
 		if tmp[0] == "physical" {
 			info.TargetType = client.TargetPhys
@@ -105,25 +178,25 @@ func GetRequestInfo(r *http.Request) (*Info, error) {
 	}
 
 	if info.TargetType == client.TargetContainer {
-		tmp = r.Header["Pod-Name"]
+		tmp = header["Pod-Name"]
 		if len(tmp) == 0 {
 			return nil, fmt.Errorf("request error: no pod name of container target")
 		}
 
 		info.PodName = tmp[0]
 
-		tmp = r.Header["Container-Id"]
+		tmp = header["Container-Id"]
 		if len(tmp) > 0 {
 			info.ContainerID = tmp[0]
 		}
 
-		tmp = r.Header["Container-Name"]
+		tmp = header["Container-Name"]
 		if len(tmp) > 0 {
 			info.ContainerName = tmp[0]
 		}
 	}
 
-	tmp = r.Header["Interactive"]
+	tmp = header["Interactive"]
 	if len(tmp) > 0 {
 		info.Interactive, err = strconv.ParseBool(tmp[0])
 		if err != nil {
@@ -131,7 +204,7 @@ func GetRequestInfo(r *http.Request) (*Info, error) {
 		}
 	}
 
-	tmp = r.Header["Tty"]
+	tmp = header["Tty"]
 	if len(tmp) > 0 {
 		info.Tty, err = strconv.ParseBool(tmp[0])
 		if err != nil {
@@ -139,41 +212,144 @@ func GetRequestInfo(r *http.Request) (*Info, error) {
 		}
 	}
 
-	tmp = r.Header["Command-Base64-Encode"]
+	if info.FrameProfile, info.FrameSize, err = getFrameOptions(header); err != nil {
+		return nil, err
+	}
+
+	tmp = header[protocol.HeaderLogs]
+	if len(tmp) > 0 && tmp[0] == "1" {
+		if info.Logs, err = getLogsOptions(&info, header); err != nil {
+			return nil, err
+		}
+	}
+
+	tmp = header[protocol.HeaderFileVerb]
+	if len(tmp) > 0 && tmp[0] != "" {
+		if info.Logs != nil {
+			return nil, fmt.Errorf("request error: logs and file verbs can't be requested together")
+		}
+
+		if info.File, err = getFileRequest(&info, header); err != nil {
+			return nil, err
+		}
+	}
+
+	tmp = header[protocol.HeaderCopy]
+	if len(tmp) > 0 && tmp[0] != "" {
+		if info.Logs != nil || info.File != nil {
+			return nil, fmt.Errorf("request error: copies can't be requested with logs or file verbs")
+		}
+
+		if info.Copy, err = getCopyRequest(&info, header); err != nil {
+			return nil, err
+		}
+	}
+
+	if r.URL != nil && r.URL.Path == protocol.ForwardPath {
+		if info.Logs != nil || info.File != nil || info.Copy != nil {
+			return nil, fmt.Errorf("request error: port forwards can't be requested with logs, file verbs or copies")
+		}
+
+		if info.Forward, err = getForwardRequest(&info, header); err != nil {
+			return nil, err
+		}
+	} else if len(header[protocol.HeaderForwardPort]) > 0 || len(header[protocol.HeaderForwardHost]) > 0 || len(header[protocol.HeaderForwardReverse]) > 0 {
+		return nil, fmt.Errorf("request error: forward port, host and reverse are only allowed on %s", protocol.ForwardPath)
+	}
+
+	tmp = header[protocol.HeaderTop]
+	if len(tmp) > 0 && tmp[0] == "1" {
+		if info.Logs != nil || info.File != nil || info.Copy != nil || info.Forward != nil {
+			return nil, fmt.Errorf("request error: top can't be requested with logs, file verbs, copies or port forwards")
+		}
+
+		info.Top = true
+		info.Interactive = false
+		info.Tty = false
+	}
+
+	tmp = header[protocol.HeaderVerb]
+	if len(tmp) > 0 && tmp[0] != "" {
+		if info.Logs != nil || info.File != nil || info.Copy != nil || info.Forward != nil || info.Top {
+			return nil, fmt.Errorf("request error: verbs can't be requested with logs, file verbs, copies, port forwards or top")
+		}
+
+		info.Verb = &client.VerbRequest{Name: tmp[0]}
+		if info.Verb.Args, err = protocol.DecodeCommand(header[protocol.HeaderVerbArgs]); err != nil {
+			return nil, fmt.Errorf("request error: invalid verb arguments: %v", err)
+		}
+
+		info.Interactive = false
+		info.Tty = false
+	}
+
+	tmp = header[protocol.HeaderCommandFrame]
+	if len(tmp) > 0 && tmp[0] != "" {
+		if info.CommandFrame, err = getCommandFrame(&info, header); err != nil {
+			return nil, err
+		}
+	}
+
+	tmp = header[protocol.HeaderConfirm]
+	if len(tmp) > 0 && tmp[0] == "1" {
+		if err = checkConfirm(&info, header); err != nil {
+			return nil, err
+		}
+
+		info.Confirm = true
+	}
+
+	tmp = header[protocol.HeaderObserve]
+	if len(tmp) > 0 && tmp[0] == "1" {
+		if err = checkObserve(&info, header); err != nil {
+			return nil, err
+		}
+
+		info.Observe = true
+		info.Interactive = false
+	}
+
+	tmp = header["Command-Base64-Encode"]
 	if len(tmp) == 0 {
-		tmp = r.Header["Command"]
-		if len(tmp) == 0 {
+		// The command in the command frame is read after the upgrade.
+		tmp = header["Command"]
+		if len(tmp) == 0 && info.Logs == nil && info.File == nil && info.Copy == nil && info.Forward == nil && !info.Top &&
+			info.Verb == nil && info.CommandFrame == 0 && !info.Observe {
 			return nil, fmt.Errorf("request error: no command")
 		}
 
 		info.Cmd = tmp
 	} else {
-		// base64 decode
-		var decodedCommand []string
-
-		for _, encodedString := range tmp {
-			decodedData, err := base64.StdEncoding.DecodeString(encodedString)
-			if err != nil {
-				return nil, fmt.Errorf("decoding command error:%v", err)
-			}
-
-			decodedCommand = append(decodedCommand, string(decodedData))
+		info.Cmd, err = protocol.DecodeCommand(tmp)
+		if err != nil {
+			return nil, fmt.Errorf("decoding command error:%v", err)
 		}
 
 		info.UseBase64 = true
+	}
+
+	tmp = header["Shell"]
+	if len(tmp) > 0 && tmp[0] != "" {
+		if tmp[0] != client.ShellAuto {
+			return nil, fmt.Errorf("request error: invalid shell argument: %s", tmp[0])
+		}
 
-		info.Cmd = decodedCommand
+		info.Shell = tmp[0]
 	}
 
-	tmp = r.Header["Cpus"]
+	tmp = header["Cpus"]
 	if len(tmp) > 0 {
 		info.Cpus, err = strconv.ParseFloat(tmp[0], 64)
 		if err != nil {
 			return nil, fmt.Errorf("request error: invalid cpus argument: %v", err)
 		}
+
+		if math.IsNaN(info.Cpus) || math.IsInf(info.Cpus, 0) {
+			return nil, fmt.Errorf("request error: invalid cpus argument: %s", tmp[0])
+		}
 	}
 
-	tmp = r.Header["Memory"]
+	tmp = header["Memory"]
 	if len(tmp) > 0 {
 		info.MemoryMB, err = strconv.Atoi(tmp[0])
 		if err != nil {
@@ -181,10 +357,305 @@ func GetRequestInfo(r *http.Request) (*Info, error) {
 		}
 	}
 
-	tmp = r.Header["Disable-Clean-Mode"]
+	tmp = header["Tools"]
+	if len(tmp) > 0 && tmp[0] == "1" {
+		if info.TargetType != client.TargetContainer {
+			return nil, fmt.Errorf("request error: tools are only available for containers")
+		}
+
+		if info.Logs != nil || info.File != nil || info.Copy != nil || info.Forward != nil || info.Top || info.Verb != nil {
+			return nil, fmt.Errorf("request error: tools aren't available with logs, file verbs, copies, port forwards, top or verbs")
+		}
+
+		info.Tools = true
+	}
+
+	tmp = header["Disable-Clean-Mode"]
 	if len(tmp) > 0 && tmp[0] == "1" {
 		info.DisableCleanMode = true
 	}
 
+	tmp = header[protocol.HeaderMFA]
+	if len(tmp) > 0 && tmp[0] == "1" {
+		info.MFA = true
+	}
+
+	if info.Tags, err = getTags(header[protocol.HeaderTag]); err != nil {
+		return nil, err
+	}
+
+	info.Env = getEnv(header[protocol.HeaderEnv])
+
 	return &info, nil
 }
+
+// getLogsOptions returns the options of streaming the output of the main process of the container.
+// The output is streamed as it is, so the session is neither interactive nor a TTY.
+func getLogsOptions(info *Info, header http.Header) (*client.LogsOptions, error) {
+	if info.TargetType != client.TargetContainer {
+		return nil, fmt.Errorf("request error: logs are only available for containers")
+	}
+
+	logs := &client.LogsOptions{Tail: -1}
+
+	tmp := header[protocol.HeaderLogsTail]
+	if len(tmp) > 0 && tmp[0] != "" {
+		tail, err := strconv.Atoi(tmp[0])
+		if err != nil {
+			return nil, fmt.Errorf("request error: invalid logs tail argument: %v", err)
+		}
+
+		logs.Tail = tail
+	}
+
+	tmp = header[protocol.HeaderLogsFollow]
+	logs.Follow = len(tmp) > 0 && tmp[0] == "1"
+
+	info.Interactive = false
+	info.Tty = false
+
+	return logs, nil
+}
+
+// getFileRequest returns the file to read in the target. The path must be absolute and clean, so that the path
+// policies of the agent are matched against the path read.
+func getFileRequest(info *Info, header http.Header) (*client.FileRequest, error) {
+	file := &client.FileRequest{Verb: header.Get(protocol.HeaderFileVerb), Path: header.Get(protocol.HeaderFilePath)}
+
+	switch file.Verb {
+	case client.FileVerbCat, client.FileVerbTail, client.FileVerbStat:
+	default:
+		return nil, fmt.Errorf("request error: invalid file verb: %s", file.Verb)
+	}
+
+	if !path.IsAbs(file.Path) || path.Clean(file.Path) != file.Path {
+		return nil, fmt.Errorf("request error: file path must be absolute and clean: %q", file.Path)
+	}
+
+	tmp := header[protocol.HeaderFileLines]
+	if len(tmp) > 0 && tmp[0] != "" {
+		lines, err := strconv.Atoi(tmp[0])
+		if err != nil || lines < 0 {
+			return nil, fmt.Errorf("request error: invalid file lines argument: %s", tmp[0])
+		}
+
+		file.Lines = lines
+	}
+
+	info.Interactive = false
+	info.Tty = false
+
+	return file, nil
+}
+
+// getCopyRequest returns the files to copy to or from the target, which requires the protocol version supporting it.
+// The path must be absolute and clean as the paths of the file verbs. The input is the tar stream copied to the
+// target, so the session is interactive then, but never a TTY.
+func getCopyRequest(info *Info, header http.Header) (*client.CopyRequest, error) {
+	version, _ := strconv.Atoi(header.Get(protocol.HeaderProtocolVersion))
+	if version < protocol.CopyVersion {
+		return nil, fmt.Errorf("request error: copies require protocol version %d", protocol.CopyVersion)
+	}
+
+	cp := &client.CopyRequest{Direction: header.Get(protocol.HeaderCopy), Path: header.Get(protocol.HeaderCopyPath)}
+
+	switch cp.Direction {
+	case client.CopyToTarget, client.CopyFromTarget:
+	default:
+		return nil, fmt.Errorf("request error: invalid copy direction: %s", cp.Direction)
+	}
+
+	if !path.IsAbs(cp.Path) || path.Clean(cp.Path) != cp.Path {
+		return nil, fmt.Errorf("request error: copy path must be absolute and clean: %q", cp.Path)
+	}
+
+	info.Interactive = cp.Direction == client.CopyToTarget
+	info.Tty = false
+
+	// The tar streams are transferred in the bulk frames unless the client asks otherwise.
+	if info.FrameProfile == "" {
+		info.FrameProfile = protocol.FrameProfileBulk
+	}
+
+	return cp, nil
+}
+
+// getFrameOptions returns the tuning profile and the size of the output frames requested.
+func getFrameOptions(header http.Header) (string, int, error) {
+	profile := header.Get(protocol.HeaderFrameProfile)
+
+	switch profile {
+	case "", protocol.FrameProfileDefault, protocol.FrameProfileBulk:
+	default:
+		return "", 0, fmt.Errorf("request error: invalid frame profile: %s", profile)
+	}
+
+	var size int
+
+	if tmp := header.Get(protocol.HeaderFrameSize); tmp != "" {
+		var err error
+		if size, err = strconv.Atoi(tmp); err != nil || size <= 0 {
+			return "", 0, fmt.Errorf("request error: invalid frame size: %s", tmp)
+		}
+	}
+
+	return profile, size, nil
+}
+
+// forwardHostPattern matches the host names the connections may be forwarded to, the trailing dot is allowed for the
+// fully qualified ones.
+var forwardHostPattern = regexp.MustCompile(`^[A-Za-z0-9_]([A-Za-z0-9_.-]*[A-Za-z0-9_.])?$`)
+
+// getForwardRequest returns the host and the port to forward the connections to, which require the protocol versions
+// supporting them. The input is the forward frames of the connections, so the session is interactive, but never a TTY.
+func getForwardRequest(info *Info, header http.Header) (*client.ForwardRequest, error) {
+	version, _ := strconv.Atoi(header.Get(protocol.HeaderProtocolVersion))
+	if version < protocol.ForwardVersion {
+		return nil, fmt.Errorf("request error: port forwards require protocol version %d", protocol.ForwardVersion)
+	}
+
+	port, err := strconv.Atoi(header.Get(protocol.HeaderForwardPort))
+	if err != nil || port < 1 || port > 65535 {
+		return nil, fmt.Errorf("request error: invalid forward port: %q", header.Get(protocol.HeaderForwardPort))
+	}
+
+	host := header.Get(protocol.HeaderForwardHost)
+	if host != "" {
+		if version < protocol.ForwardHostVersion {
+			return nil, fmt.Errorf("request error: forward hosts require protocol version %d", protocol.ForwardHostVersion)
+		}
+
+		if net.ParseIP(host) == nil && (len(host) > 253 || !forwardHostPattern.MatchString(host)) {
+			return nil, fmt.Errorf("request error: invalid forward host: %q", host)
+		}
+	}
+
+	reverse := header.Get(protocol.HeaderForwardReverse) == "1"
+	if reverse {
+		if version < protocol.ReverseForwardVersion {
+			return nil, fmt.Errorf("request error: reverse forwards require protocol version %d", protocol.ReverseForwardVersion)
+		}
+
+		if host != "" {
+			return nil, fmt.Errorf("request error: reverse forwards listen on the loopback of the target, not %s", host)
+		}
+	}
+
+	info.Interactive = true
+	info.Tty = false
+
+	return &client.ForwardRequest{Host: host, Port: port, Reverse: reverse}, nil
+}
+
+// getCommandFrame returns the length of the command frame, which requires the protocol version supporting it.
+func getCommandFrame(info *Info, header http.Header) (int, error) {
+	version, _ := strconv.Atoi(header.Get(protocol.HeaderProtocolVersion))
+	if version < protocol.CommandFrameVersion {
+		return 0, fmt.Errorf("request error: command frame requires protocol version %d", protocol.CommandFrameVersion)
+	}
+
+	if info.Logs != nil || info.File != nil || info.Copy != nil || info.Forward != nil || info.Top || info.Verb != nil {
+		return 0, fmt.Errorf("request error: command frame can't be requested with logs, file verbs, copies, port forwards, top or verbs")
+	}
+
+	length, err := strconv.Atoi(header.Get(protocol.HeaderCommandFrame))
+	if err != nil || length <= 0 {
+		return 0, fmt.Errorf("request error: invalid command frame length: %s", header.Get(protocol.HeaderCommandFrame))
+	}
+
+	return length, nil
+}
+
+// checkConfirm checks the confirmation of the command, which requires the command frame so that the client can tell
+// whether the agent supports it before sending the command.
+func checkConfirm(info *Info, header http.Header) error {
+	version, _ := strconv.Atoi(header.Get(protocol.HeaderProtocolVersion))
+	if version < protocol.ConfirmVersion || info.CommandFrame == 0 {
+		return fmt.Errorf("request error: confirmation requires the command frame and protocol version %d", protocol.ConfirmVersion)
+	}
+
+	return nil
+}
+
+// checkObserve checks the request observing the session of its ID, which attaches to the session instead of running
+// anything.
+func checkObserve(info *Info, header http.Header) error {
+	version, _ := strconv.Atoi(header.Get(protocol.HeaderProtocolVersion))
+	if version < protocol.ObserveVersion {
+		return fmt.Errorf("request error: observers require protocol version %d", protocol.ObserveVersion)
+	}
+
+	if info.SessionID == "" {
+		return fmt.Errorf("request error: no session ID to observe")
+	}
+
+	if info.Logs != nil || info.File != nil || info.Copy != nil || info.Forward != nil || info.Top || info.Verb != nil ||
+		info.CommandFrame > 0 {
+		return fmt.Errorf("request error: observers can't request logs, file verbs, copies, port forwards, top, verbs or command frames")
+	}
+
+	return nil
+}
+
+// getTags returns the tags of the session from the "key=value" values of the tag headers.
+func getTags(values []string) (map[string]string, error) {
+	if len(values) == 0 {
+		return nil, nil
+	}
+
+	tags := make(map[string]string, len(values))
+
+	for _, v := range values {
+		key, value, ok := strings.Cut(v, "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("request error: invalid tag: %q", v)
+		}
+
+		if _, ok = tags[key]; ok {
+			return nil, fmt.Errorf("request error: duplicate tag: %s", key)
+		}
+
+		tags[key] = value
+	}
+
+	return tags, nil
+}
+
+// getEnv returns the environment variables of the client from the "NAME=value" values of the env headers,
+// skipping the malformed ones, as they are only hints for the command.
+func getEnv(values []string) map[string]string {
+	if len(values) == 0 {
+		return nil
+	}
+
+	env := make(map[string]string, len(values))
+
+	for _, v := range values {
+		if name, value, ok := strings.Cut(v, "="); ok && name != "" {
+			env[name] = value
+		}
+	}
+
+	return env
+}
+
+// Header returns the headers of the request. Browsers can't set the headers of WebSocket handshakes,
+// so the headers may be passed in the query string instead, and the ones in the headers take precedence.
+func Header(r *http.Request) http.Header {
+	if r.URL == nil || r.URL.RawQuery == "" {
+		return r.Header
+	}
+
+	query := r.URL.Query()
+
+	header := r.Header.Clone()
+
+	for key, values := range query {
+		key = http.CanonicalHeaderKey(key)
+		if _, ok := header[key]; !ok {
+			header[key] = values
+		}
+	}
+
+	return header
+}
@@ -0,0 +1,462 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package request
+
+import (
+	"encoding/base64"
+	"math"
+	"net/http"
+	"net/url"
+	"reflect"
+	"testing"
+	"trust-tunnel/pkg/trust-tunnel-client/protocol"
+
+	client "trust-tunnel/pkg/trust-tunnel-client"
+)
+
+func FuzzGetRequestInfo(f *testing.F) {
+	f.Add("physical", "", "true", "true", "ls -l", "", "0.5", "512")
+	f.Add("container", "pod", "false", "false", "", base64.StdEncoding.EncodeToString([]byte("pwd")), "1", "0")
+	f.Add("container", "", "1", "0", "ls", "!!!", "NaN", "-1")
+	f.Add("unknown", "pod", "yes", "no", "", "", "Inf", "1e9")
+
+	f.Fuzz(func(t *testing.T, targetType, podName, interactive, tty, command, encodedCommand, cpus, memory string) {
+		header := http.Header{}
+		for key, value := range map[string]string{
+			"Target-Type":           targetType,
+			"Pod-Name":              podName,
+			"Interactive":           interactive,
+			"Tty":                   tty,
+			"Command":               command,
+			"Command-Base64-Encode": encodedCommand,
+			"Cpus":                  cpus,
+			"Memory":                memory,
+		} {
+			if value != "" {
+				header[key] = []string{value}
+			}
+		}
+
+		info, err := GetRequestInfo(&http.Request{Header: header})
+		if err != nil {
+			return
+		}
+
+		if info.TargetType != client.TargetPhys && info.TargetType != client.TargetContainer {
+			t.Errorf("unexpected target type %v", info.TargetType)
+		}
+
+		if info.TargetType == client.TargetContainer && info.PodName == "" {
+			t.Errorf("empty pod name of container target")
+		}
+
+		if math.IsNaN(info.Cpus) || math.IsInf(info.Cpus, 0) {
+			t.Errorf("unexpected cpus %v", info.Cpus)
+		}
+
+		expectedCmd := []string{command}
+
+		if encodedCommand != "" {
+			decoded, err := base64.StdEncoding.DecodeString(encodedCommand)
+			if err != nil {
+				t.Fatalf("invalid base64 command %q is accepted", encodedCommand)
+			}
+
+			expectedCmd = []string{string(decoded)}
+		}
+
+		if !reflect.DeepEqual(info.Cmd, expectedCmd) {
+			t.Errorf("expected command %q, got %q", expectedCmd, info.Cmd)
+		}
+	})
+}
+
+func TestQueryHeaders(t *testing.T) {
+	u, _ := url.Parse("/exec?User-Name=mallory&Login-Name=root&Command-Base64-Encode=bHM%3D&Command-Base64-Encode=LWw%3D")
+
+	info, err := GetRequestInfo(&http.Request{URL: u, Header: http.Header{"User-Name": []string{"alice"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The headers take precedence over the query string.
+	if info.UserName != "alice" || info.LoginName != "root" || !reflect.DeepEqual(info.Cmd, []string{"ls", "-l"}) {
+		t.Errorf("unexpected request info %s", info)
+	}
+}
+
+func TestLogsHeaders(t *testing.T) {
+	header := http.Header{
+		"Target-Type": []string{"container"},
+		"Pod-Name":    []string{"pod"},
+		"Tty":         []string{"true"},
+		"Logs":        []string{"1"},
+		"Logs-Follow": []string{"1"},
+		"Logs-Tail":   []string{"100"},
+	}
+
+	info, err := GetRequestInfo(&http.Request{Header: header})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The command isn't required, and the output is streamed without a TTY.
+	if !reflect.DeepEqual(info.Logs, &client.LogsOptions{Follow: true, Tail: 100}) || info.Tty {
+		t.Errorf("unexpected request info %s", info)
+	}
+
+	header["Target-Type"] = []string{"physical"}
+
+	if _, err = GetRequestInfo(&http.Request{Header: header}); err == nil {
+		t.Error("logs of physical hosts should be refused")
+	}
+}
+
+func TestFileHeaders(t *testing.T) {
+	header := http.Header{
+		"Target-Type": []string{"physical"},
+		"File-Verb":   []string{"tail"},
+		"File-Path":   []string{"/var/log/messages"},
+		"File-Lines":  []string{"20"},
+	}
+
+	info, err := GetRequestInfo(&http.Request{Header: header})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(info.File, &client.FileRequest{Verb: "tail", Path: "/var/log/messages", Lines: 20}) {
+		t.Errorf("unexpected request info %s", info)
+	}
+
+	for _, p := range []string{"var/log/messages", "/var/log/../../etc/shadow"} {
+		header["File-Path"] = []string{p}
+
+		if _, err = GetRequestInfo(&http.Request{Header: header}); err == nil {
+			t.Errorf("path %s should be refused", p)
+		}
+	}
+}
+
+func TestCopyHeaders(t *testing.T) {
+	header := http.Header{
+		"Target-Type":      []string{"physical"},
+		"Copy":             []string{"to"},
+		"Copy-Path":        []string{"/tmp"},
+		"Protocol-Version": []string{"4"},
+		"Tty":              []string{"true"},
+	}
+
+	info, err := GetRequestInfo(&http.Request{Header: header})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(info.Copy, &client.CopyRequest{Direction: "to", Path: "/tmp"}) || !info.Interactive || info.Tty {
+		t.Errorf("unexpected request info %s", info)
+	}
+
+	header["Copy"] = []string{"from"}
+
+	if info, err = GetRequestInfo(&http.Request{Header: header}); err != nil || info.Interactive {
+		t.Errorf("unexpected request info %s and error %v", info, err)
+	}
+
+	for name, value := range map[string]string{"Copy": "both", "Copy-Path": "/tmp/../etc", "Protocol-Version": "3"} {
+		refused := header.Clone()
+		refused[name] = []string{value}
+
+		if _, err = GetRequestInfo(&http.Request{Header: refused}); err == nil {
+			t.Errorf("%s %s should be refused", name, value)
+		}
+	}
+}
+
+func TestForwardHeaders(t *testing.T) {
+	header := http.Header{
+		"Target-Type":      []string{"physical"},
+		"Forward-Port":     []string{"8080"},
+		"Protocol-Version": []string{"5"},
+		"Tty":              []string{"true"},
+	}
+
+	info, err := GetRequestInfo(&http.Request{URL: &url.URL{Path: protocol.ForwardPath}, Header: header})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(info.Forward, &client.ForwardRequest{Port: 8080}) || !info.Interactive || info.Tty {
+		t.Errorf("unexpected request info %s", info)
+	}
+
+	// The forward port is only allowed on the forward endpoint.
+	if _, err = GetRequestInfo(&http.Request{URL: &url.URL{Path: protocol.Path}, Header: header}); err == nil {
+		t.Errorf("forward port should be refused on %s", protocol.Path)
+	}
+
+	for name, value := range map[string]string{"Forward-Port": "65536", "Protocol-Version": "4", "Top": "1", "Forward-Host": "db"} {
+		refused := header.Clone()
+		refused[name] = []string{value}
+
+		if _, err = GetRequestInfo(&http.Request{URL: &url.URL{Path: protocol.ForwardPath}, Header: refused}); err == nil {
+			t.Errorf("%s %s should be refused", name, value)
+		}
+	}
+
+	// The hosts require protocol version 7.
+	header["Protocol-Version"] = []string{"7"}
+
+	for host, valid := range map[string]bool{"db": true, "db.prod.svc.cluster.local.": true, "10.0.0.5": true, "fd00::5": true, "-db": false, "db:5432": false, "a b": false} {
+		header["Forward-Host"] = []string{host}
+
+		info, err = GetRequestInfo(&http.Request{URL: &url.URL{Path: protocol.ForwardPath}, Header: header})
+		if valid && (err != nil || info.Forward.Host != host) || !valid && err == nil {
+			t.Errorf("unexpected request info %s and error %v of host %q", info, err, host)
+		}
+	}
+
+	// The reverse forwards require protocol version 8, and listen on the loopback only.
+	header["Forward-Reverse"] = []string{"1"}
+	if _, err = GetRequestInfo(&http.Request{URL: &url.URL{Path: protocol.ForwardPath}, Header: header}); err == nil {
+		t.Errorf("reverse forward with a host should be refused")
+	}
+
+	delete(header, "Forward-Host")
+	if _, err = GetRequestInfo(&http.Request{URL: &url.URL{Path: protocol.ForwardPath}, Header: header}); err == nil {
+		t.Errorf("reverse forward of protocol version 7 should be refused")
+	}
+
+	header["Protocol-Version"] = []string{"8"}
+
+	info, err = GetRequestInfo(&http.Request{URL: &url.URL{Path: protocol.ForwardPath}, Header: header})
+	if err != nil || !reflect.DeepEqual(info.Forward, &client.ForwardRequest{Port: 8080, Reverse: true}) {
+		t.Errorf("unexpected request info %s and error %v", info, err)
+	}
+}
+
+func TestFrameHeaders(t *testing.T) {
+	header := http.Header{"Target-Type": []string{"physical"}, "Command": []string{"cat"}, "Frame-Profile": []string{"bulk"}}
+
+	info, err := GetRequestInfo(&http.Request{Header: header})
+	if err != nil || info.FrameProfile != protocol.FrameProfileBulk || info.FrameSize != 0 {
+		t.Errorf("unexpected request info %s and error %v", info, err)
+	}
+
+	header["Frame-Size"] = []string{"16384"}
+
+	if info, err = GetRequestInfo(&http.Request{Header: header}); err != nil || info.FrameSize != 16384 {
+		t.Errorf("unexpected request info %s and error %v", info, err)
+	}
+
+	// The copies select the bulk profile by default.
+	copyHeader := http.Header{"Copy": []string{"from"}, "Copy-Path": []string{"/tmp"}, "Protocol-Version": []string{"4"}}
+
+	if info, err = GetRequestInfo(&http.Request{Header: copyHeader}); err != nil || info.FrameProfile != protocol.FrameProfileBulk {
+		t.Errorf("unexpected request info %s and error %v", info, err)
+	}
+
+	for name, value := range map[string]string{"Frame-Profile": "huge", "Frame-Size": "0"} {
+		refused := header.Clone()
+		refused[name] = []string{value}
+
+		if _, err = GetRequestInfo(&http.Request{Header: refused}); err == nil {
+			t.Errorf("%s %s should be refused", name, value)
+		}
+	}
+}
+
+func TestTopHeader(t *testing.T) {
+	header := http.Header{"Target-Type": []string{"physical"}, "Top": []string{"1"}, "Interactive": []string{"true"}}
+
+	info, err := GetRequestInfo(&http.Request{Header: header})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !info.Top || info.Interactive {
+		t.Errorf("unexpected request info %s", info)
+	}
+
+	header["File-Verb"] = []string{"stat"}
+	header["File-Path"] = []string{"/etc/hosts"}
+
+	if _, err = GetRequestInfo(&http.Request{Header: header}); err == nil {
+		t.Error("top with a file verb should be refused")
+	}
+}
+
+func TestVerbHeaders(t *testing.T) {
+	header := http.Header{
+		"Target-Type": []string{"physical"},
+		"Verb":        []string{"file-read"},
+		"Verb-Args":   protocol.EncodeCommand([]string{"/etc/hosts"}),
+	}
+
+	info, err := GetRequestInfo(&http.Request{Header: header})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(info.Verb, &client.VerbRequest{Name: "file-read", Args: []string{"/etc/hosts"}}) {
+		t.Errorf("unexpected request info %s", info)
+	}
+
+	header["Verb-Args"] = []string{"not base64"}
+
+	if _, err = GetRequestInfo(&http.Request{Header: header}); err == nil {
+		t.Error("invalid verb arguments should be refused")
+	}
+}
+
+func TestTagHeaders(t *testing.T) {
+	header := http.Header{
+		"Target-Type": []string{"physical"},
+		"Command":     []string{"uptime"},
+		"Tag":         []string{"incident=INC-1234", "note=a=b"},
+	}
+
+	info, err := GetRequestInfo(&http.Request{Header: header})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(info.Tags, map[string]string{"incident": "INC-1234", "note": "a=b"}) {
+		t.Errorf("unexpected request info %s", info)
+	}
+
+	for _, tags := range [][]string{{"incident"}, {"=INC-1234"}, {"incident=INC-1", "incident=INC-2"}} {
+		header["Tag"] = tags
+
+		if _, err = GetRequestInfo(&http.Request{Header: header}); err == nil {
+			t.Errorf("tags %q should be refused", tags)
+		}
+	}
+}
+
+func TestEnvHeaders(t *testing.T) {
+	header := http.Header{
+		"Target-Type": []string{"physical"},
+		"Command":     []string{"bash"},
+		"Env":         []string{"TERM=xterm-kitty", "LANG=C.UTF-8", "=x", "BOGUS"},
+	}
+
+	info, err := GetRequestInfo(&http.Request{Header: header})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(info.Env, map[string]string{"TERM": "xterm-kitty", "LANG": "C.UTF-8"}) {
+		t.Errorf("unexpected request info %s", info)
+	}
+}
+
+func TestCommandFrameHeaders(t *testing.T) {
+	header := http.Header{
+		"Target-Type":                  []string{"physical"},
+		protocol.HeaderProtocolVersion: []string{"2"},
+		protocol.HeaderCommandFrame:    []string{"4096"},
+	}
+
+	info, err := GetRequestInfo(&http.Request{Header: header})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if info.CommandFrame != 4096 || info.Cmd != nil {
+		t.Errorf("unexpected request info %s", info)
+	}
+
+	for _, h := range []http.Header{
+		{protocol.HeaderProtocolVersion: nil},
+		{protocol.HeaderCommandFrame: []string{"-1"}},
+		{protocol.HeaderTop: []string{"1"}},
+	} {
+		refused := header.Clone()
+		for k, v := range h {
+			refused[k] = v
+		}
+
+		if _, err = GetRequestInfo(&http.Request{Header: refused}); err == nil {
+			t.Errorf("command frame with %v should be refused", h)
+		}
+	}
+}
+
+func TestConfirmHeaders(t *testing.T) {
+	header := http.Header{
+		"Target-Type":                  []string{"physical"},
+		protocol.HeaderProtocolVersion: []string{"3"},
+		protocol.HeaderCommandFrame:    []string{"4096"},
+		protocol.HeaderConfirm:         []string{"1"},
+	}
+
+	info, err := GetRequestInfo(&http.Request{Header: header})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !info.Confirm {
+		t.Errorf("unexpected request info %s", info)
+	}
+
+	for _, h := range []http.Header{
+		{protocol.HeaderProtocolVersion: []string{"2"}},
+		{protocol.HeaderCommandFrame: nil, "Command": []string{"ls"}},
+	} {
+		refused := header.Clone()
+		for k, v := range h {
+			refused[k] = v
+		}
+
+		if _, err = GetRequestInfo(&http.Request{Header: refused}); err == nil {
+			t.Errorf("confirmation with %v should be refused", h)
+		}
+	}
+}
+
+func TestObserveHeaders(t *testing.T) {
+	header := http.Header{
+		"Session-Id":                   []string{"20240102150405"},
+		"Target-Type":                  []string{"physical"},
+		"Interactive":                  []string{"true"},
+		protocol.HeaderProtocolVersion: []string{"6"},
+		protocol.HeaderObserve:         []string{"1"},
+	}
+
+	info, err := GetRequestInfo(&http.Request{Header: header})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !info.Observe || info.Interactive || len(info.Cmd) != 0 {
+		t.Errorf("unexpected request info %s", info)
+	}
+
+	for _, h := range []http.Header{
+		{protocol.HeaderProtocolVersion: []string{"5"}},
+		{"Session-Id": nil},
+		{protocol.HeaderTop: []string{"1"}},
+		{protocol.HeaderCommandFrame: []string{"4096"}},
+	} {
+		refused := header.Clone()
+		for k, v := range h {
+			refused[k] = v
+		}
+
+		if _, err = GetRequestInfo(&http.Request{Header: refused}); err == nil {
+			t.Errorf("observer with %v should be refused", h)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"sync"
+	"trust-tunnel/pkg/trust-tunnel-agent/session"
+)
+
+// maxResizeAttempts is the number of attempts to apply a terminal size before it's given up, as the terminal of
+// some sessions never becomes resizable, e.g. the commands without a TTY.
+const maxResizeAttempts = 10
+
+// termSize is the size of the terminal requested by the client.
+type termSize struct {
+	height, width int
+	// pending is whether the size is yet to be applied to the session.
+	pending bool
+	// attempts is the number of the failed attempts to apply the size.
+	attempts int
+}
+
+// terminal is a session served to a client, whose terminal is resized as the client requests, by the websocket
+// sessions and the other frontends alike.
+type terminal struct {
+	// sess represents the client's session, used for maintaining session state.
+	sess session.Session
+	// recording records the terminal I/O of the session if it's not nil.
+	recording *recording
+	// size is the latest terminal size requested by the client, kept pending until the terminal is ready.
+	size     termSize
+	sizeLock sync.Mutex
+}
+
+// resize records the terminal size requested by the client and applies it. The latest size is kept pending if the
+// terminal isn't ready yet, e.g. the sidecar is still starting, and applied once the session writes output.
+func (term *terminal) resize(height, width int) {
+	term.sizeLock.Lock()
+	term.size = termSize{height: height, width: width, pending: true}
+	term.sizeLock.Unlock()
+
+	if term.recording != nil {
+		term.recording.recorder.Resize(width, height)
+	}
+
+	term.applySize()
+}
+
+// applySize applies the pending terminal size to the session.
+func (term *terminal) applySize() {
+	term.sizeLock.Lock()
+	defer term.sizeLock.Unlock()
+
+	// The size is kept pending until the session is attached.
+	size := &term.size
+	if !size.pending || term.sess == nil {
+		return
+	}
+
+	if err := term.sess.Resize(size.height, size.width); err != nil {
+		if size.attempts++; size.attempts >= maxResizeAttempts {
+			logger.Warnf("give up resizing the terminal to %dx%d: %v", size.width, size.height, err)
+
+			size.pending = false
+
+			return
+		}
+
+		logger.Debugf("terminal isn't ready, resize to %dx%d later: %v", size.width, size.height, err)
+
+		return
+	}
+
+	size.pending = false
+}
+
+// lastSize returns the latest terminal size of the session, to be applied again if the session is reused, as it may
+// not have been applied before the client disconnected.
+func (term *terminal) lastSize() termSize {
+	term.sizeLock.Lock()
+	defer term.sizeLock.Unlock()
+
+	size := term.size
+	size.pending = size.height > 0 && size.width > 0
+	size.attempts = 0
+
+	return size
+}
@@ -0,0 +1,80 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"errors"
+	"testing"
+)
+
+// resizeSession records the sizes applied to it, and fails to resize until it's ready.
+type resizeSession struct {
+	*fakeSession
+	ready bool
+	sizes [][2]int
+}
+
+func (s *resizeSession) Resize(h, w int) error {
+	if !s.ready {
+		return errors.New("no terminal")
+	}
+
+	s.sizes = append(s.sizes, [2]int{h, w})
+
+	return nil
+}
+
+func TestResizeBeforeReady(t *testing.T) {
+	sess := &resizeSession{fakeSession: newFakeSession()}
+	sessConn := &Connection{terminal: terminal{sess: sess}}
+
+	sessConn.resize(24, 80)
+	sessConn.resize(50, 200)
+	sessConn.applySize()
+
+	if len(sess.sizes) != 0 {
+		t.Fatalf("resized before the terminal is ready: %v", sess.sizes)
+	}
+
+	sess.ready = true
+
+	sessConn.applySize()
+	sessConn.applySize()
+
+	if len(sess.sizes) != 1 || sess.sizes[0] != [2]int{50, 200} {
+		t.Fatalf("got sizes %v, want only the latest one applied once", sess.sizes)
+	}
+
+	// The size is applied again to the reused session.
+	reused := &Connection{terminal: terminal{sess: sess, size: sessConn.lastSize()}}
+	reused.applySize()
+
+	if len(sess.sizes) != 2 || sess.sizes[1] != [2]int{50, 200} {
+		t.Fatalf("got sizes %v, want the size re-applied", sess.sizes)
+	}
+}
+
+func TestResizeGiveUp(t *testing.T) {
+	sessConn := &Connection{terminal: terminal{sess: &resizeSession{fakeSession: newFakeSession()}}}
+	sessConn.resize(50, 200)
+
+	for i := 0; i < maxResizeAttempts; i++ {
+		sessConn.applySize()
+	}
+
+	if sessConn.size.pending {
+		t.Errorf("the size is still pending after %d attempts", maxResizeAttempts)
+	}
+}
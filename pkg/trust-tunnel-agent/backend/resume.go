@@ -0,0 +1,154 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"errors"
+	"sync"
+)
+
+// defaultResumeBufferSize is the most bytes of the output buffered for a detached session by default.
+const defaultResumeBufferSize = 1 << 20
+
+// errDetached tells the output of the connection is taken over by the next connection of the session.
+var errDetached = errors.New("session is reattached by another connection")
+
+// resumeBufferSize returns the most bytes of the output buffered for a detached session, zero if nothing is.
+func (c *SessionConfig) resumeBufferSize() int {
+	switch {
+	case c.ResumeBufferSize < 0:
+		return 0
+	case c.ResumeBufferSize == 0:
+		return defaultResumeBufferSize
+	default:
+		return c.ResumeBufferSize
+	}
+}
+
+// outputFrame is a frame of the output of a session.
+type outputFrame struct {
+	data  []byte
+	isErr bool
+}
+
+// resumeBuffer buffers the output of a session while it's detached from the client, to be replayed once the
+// session is reattached, so that the commands survive the network blips without losing their output. The oldest
+// output is dropped once the buffer is full, the commands are never blocked by a detached client.
+type resumeBuffer struct {
+	// stdoutLock and stderrLock are held by the connection reading the stdout and the stderr of the session, the
+	// detached connection keeps reading the output into the buffer until the next connection takes over.
+	stdoutLock sync.Mutex
+	stderrLock sync.Mutex
+
+	lock sync.Mutex
+	// owner is the connection the session is attached to last.
+	owner   *Connection
+	frames  []outputFrame
+	size    int
+	limit   int
+	dropped int
+}
+
+func newResumeBuffer(limit int) *resumeBuffer {
+	return &resumeBuffer{limit: limit}
+}
+
+// streamLock returns the lock of reading the stdout, or the stderr if isErr.
+func (b *resumeBuffer) streamLock(isErr bool) *sync.Mutex {
+	if isErr {
+		return &b.stderrLock
+	}
+
+	return &b.stdoutLock
+}
+
+// attach attaches the session to the connection, the connections attached before stop reading the output once
+// they have buffered the frames they read.
+func (b *resumeBuffer) attach(sessConn *Connection) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.owner = sessConn
+}
+
+// attached returns whether the session is attached to the connection.
+func (b *resumeBuffer) attached(sessConn *Connection) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return b.owner == sessConn
+}
+
+// push buffers the frame, dropping the oldest output beyond the limit.
+func (b *resumeBuffer) push(data []byte, isErr bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.frames = append(b.frames, outputFrame{data: data, isErr: isErr})
+	b.size += len(data)
+
+	for b.size > b.limit {
+		excess := b.size - b.limit
+
+		oldest := &b.frames[0]
+		if len(oldest.data) > excess {
+			oldest.data = oldest.data[excess:]
+			b.size -= excess
+			b.dropped += excess
+
+			break
+		}
+
+		b.size -= len(oldest.data)
+		b.dropped += len(oldest.data)
+		b.frames = b.frames[1:]
+	}
+}
+
+// unshift puts the frames failed to be replayed back to the front of the buffer, they are never dropped.
+func (b *resumeBuffer) unshift(frames []outputFrame) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	for _, frame := range frames {
+		b.size += len(frame.data)
+	}
+
+	b.frames = append(append([]outputFrame{}, frames...), b.frames...)
+}
+
+// take removes and returns the buffered frames in order, and the bytes dropped before them. Only the frames of the
+// stderr, or the stdout, are taken if filter is set.
+func (b *resumeBuffer) take(filter, isErr bool) ([]outputFrame, int) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	var taken, kept []outputFrame
+
+	for _, frame := range b.frames {
+		if filter && frame.isErr != isErr {
+			kept = append(kept, frame)
+		} else {
+			taken = append(taken, frame)
+			b.size -= len(frame.data)
+		}
+	}
+
+	b.frames = kept
+	dropped := b.dropped
+	b.dropped = 0
+
+	return taken, dropped
+}
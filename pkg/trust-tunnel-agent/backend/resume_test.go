@@ -0,0 +1,152 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+	"trust-tunnel/pkg/trust-tunnel-agent/sessionio"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestResumeBuffer(t *testing.T) {
+	b := newResumeBuffer(8)
+	b.push([]byte("0123"), false)
+	b.push([]byte("err"), true)
+	b.push([]byte("456789"), false)
+
+	// The oldest output beyond the limit is dropped.
+	frames, dropped := b.take(true, true)
+	if len(frames) != 1 || string(frames[0].data) != "rr" || dropped != 5 {
+		t.Fatalf("unexpected frames %v, dropped %d", frames, dropped)
+	}
+
+	frames, dropped = b.take(false, false)
+	if len(frames) != 1 || string(frames[0].data) != "456789" || dropped != 0 || b.size != 0 {
+		t.Fatalf("unexpected frames %v, dropped %d", frames, dropped)
+	}
+
+	// The frames put back are kept in front.
+	b.push([]byte("ab"), true)
+	b.unshift([]outputFrame{{data: []byte("cd")}})
+
+	frames, _ = b.take(false, false)
+	if len(frames) != 2 || string(frames[0].data) != "cd" || string(frames[1].data) != "ab" || !frames[1].isErr {
+		t.Errorf("unexpected frames %v", frames)
+	}
+}
+
+// streamSession is a session whose output is written to its streams by the test.
+type streamSession struct {
+	*sessionio.Streams
+}
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+func (s streamSession) NextStdin() (io.WriteCloser, error) { return nopWriteCloser{io.Discard}, nil }
+func (s streamSession) CloseStdin() error                  { return nil }
+func (s streamSession) Clean() error                       { s.Close(); return nil }
+func (s streamSession) Resize(int, int) error              { return nil }
+func (s streamSession) ExitCode() int                      { return 0 }
+
+// readOutput reads the messages of the connection until the stdout and the stderr are read as expected.
+func readOutput(t *testing.T, conn *websocket.Conn, stdout, stderr string) {
+	t.Helper()
+
+	var gotStdout, gotStderr strings.Builder
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	for gotStdout.String() != stdout || gotStderr.String() != stderr {
+		msgType, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("read %q, %q, then error: %v", gotStdout.String(), gotStderr.String(), err)
+		}
+
+		if msgType == websocket.BinaryMessage {
+			gotStdout.Write(data)
+		} else {
+			gotStderr.Write(data)
+		}
+	}
+}
+
+func TestConnectionResume(t *testing.T) {
+	sess := streamSession{sessionio.New()}
+	defer sess.Clean()
+
+	resume := newResumeBuffer(1 << 10)
+	sessConnCh := make(chan *Connection, 1)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+
+		sessConn := &Connection{terminal: terminal{sess: sess}, conn: conn, resume: resume,
+			errCh: make(chan error, 1), doneCh: make(chan struct{})}
+
+		resume.attach(sessConn)
+		sessConn.replay(resume.take(false, false))
+
+		go sessConn.processLocalOutput()
+		go sessConn.processLocalError()
+		go sessConn.processRemoteInput()
+
+		sessConnCh <- sessConn
+	}))
+	defer server.Close()
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	sessConn := <-sessConnCh
+
+	sess.Stdout.Write([]byte("one"))
+	readOutput(t, conn, "one", "")
+
+	// The output is buffered once the client is disconnected.
+	conn.UnderlyingConn().Close()
+	<-sessConn.doneCh
+
+	sess.Stdout.Write([]byte("two"))
+	sess.Stderr.Write([]byte("err"))
+
+	conn, _, err = websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer conn.Close()
+
+	<-sessConnCh
+
+	// The output buffered is replayed once the session is reattached, and the output is streamed afterwards.
+	readOutput(t, conn, "two", "err")
+
+	sess.Stdout.Write([]byte("three"))
+	readOutput(t, conn, "three", "")
+}
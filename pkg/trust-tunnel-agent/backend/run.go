@@ -0,0 +1,529 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+	"trust-tunnel/pkg/common/logutil"
+	"trust-tunnel/pkg/common/sessionutil"
+	"trust-tunnel/pkg/trust-tunnel-agent/backend/request"
+	"trust-tunnel/pkg/trust-tunnel-agent/monitor"
+
+	agentSession "trust-tunnel/pkg/trust-tunnel-agent/session"
+	client "trust-tunnel/pkg/trust-tunnel-client"
+)
+
+const (
+	defaultRunMaxBodyBytes   = 1 << 20
+	defaultRunMaxOutputBytes = 1 << 20
+	defaultRunTimeout        = 30 * time.Second
+	defaultRunMaxTimeout     = 5 * time.Minute
+)
+
+// RunConfig specifies the synchronous exec API on POST /run, for the scripts and probes which don't need streaming.
+type RunConfig struct {
+	// Enabled specifies whether to serve POST /run.
+	Enabled bool `toml:"enabled"`
+
+	// MaxBodyBytes is the maximum size of the request body including the stdin, defaults to 1 MiB.
+	MaxBodyBytes int64 `toml:"max_body_bytes"`
+
+	// MaxOutputBytes is the maximum size of the stdout and the stderr each, the rest is discarded.
+	// Defaults to 1 MiB.
+	MaxOutputBytes int `toml:"max_output_bytes"`
+
+	// DefaultTimeout is the timeout of the commands if it's not requested, defaults to 30 seconds.
+	DefaultTimeout time.Duration `toml:"default_timeout"`
+
+	// MaxTimeout caps the timeout requested, defaults to 5 minutes.
+	MaxTimeout time.Duration `toml:"max_timeout"`
+}
+
+// withDefaults returns the configuration with the defaults filled in.
+func (c RunConfig) withDefaults() RunConfig {
+	if c.MaxBodyBytes <= 0 {
+		c.MaxBodyBytes = defaultRunMaxBodyBytes
+	}
+
+	if c.MaxOutputBytes <= 0 {
+		c.MaxOutputBytes = defaultRunMaxOutputBytes
+	}
+
+	if c.DefaultTimeout <= 0 {
+		c.DefaultTimeout = defaultRunTimeout
+	}
+
+	if c.MaxTimeout <= 0 {
+		c.MaxTimeout = defaultRunMaxTimeout
+	}
+
+	return c
+}
+
+// RunRequest is the request body of POST /run, the fields match the headers of the websocket API.
+type RunRequest struct {
+	UserName   string `json:"user_name"`
+	LoginName  string `json:"login_name"`
+	LoginGroup string `json:"login_group"`
+	// TargetType is "physical" or "container", defaults to "physical".
+	TargetType    string   `json:"target_type"`
+	IPAddress     string   `json:"ip_address"`
+	PodName       string   `json:"pod_name"`
+	ContainerID   string   `json:"container_id"`
+	ContainerName string   `json:"container_name"`
+	Cmd           []string `json:"cmd"`
+	// Verb is the name of the verb run natively by the agent instead of Cmd, with the arguments of VerbArgs.
+	Verb     string   `json:"verb"`
+	VerbArgs []string `json:"verb_args"`
+	Shell    string   `json:"shell"`
+	Tools    bool     `json:"tools"`
+	// Stdin is written to the command, whose stdin is closed then.
+	Stdin string `json:"stdin"`
+	// Timeout is the timeout of the command, e.g. "10s", capped by the max timeout of the agent.
+	Timeout          string  `json:"timeout"`
+	Cpus             float64 `json:"cpus"`
+	MemoryMB         int     `json:"memory_mb"`
+	DisableCleanMode bool    `json:"disable_clean_mode"`
+	// Tags are the key/value pairs tagging the session, e.g. {"incident": "INC-1234"}.
+	Tags map[string]string `json:"tags"`
+}
+
+// RunResponse is the response body of POST /run.
+type RunResponse struct {
+	SessionID string `json:"session_id,omitempty"`
+	// ExitCode is the exit code of the command, -1 if it's killed for the timeout or isn't run.
+	ExitCode int    `json:"exit_code"`
+	Stdout   string `json:"stdout"`
+	Stderr   string `json:"stderr"`
+	// Truncated is whether the stdout or the stderr exceeds the max output size of the agent.
+	Truncated bool `json:"truncated,omitempty"`
+	// Reason is why the session is terminated, e.g. "exited", or "max-duration" for the timeout.
+	Reason client.TerminationReason `json:"reason,omitempty"`
+	// Error is the error establishing or running the session, wrapped with its code.
+	Error string `json:"error,omitempty"`
+	// Cached is whether the result is the one of an earlier run of the idempotent verb, whose session it tells.
+	Cached bool `json:"cached,omitempty"`
+}
+
+// info converts the request into the request information, and returns the timeout of the command.
+func (req *RunRequest) info(conf *RunConfig) (*request.Info, time.Duration, error) {
+	info := &request.Info{
+		UserName:         req.UserName,
+		LoginName:        req.LoginName,
+		LoginGroup:       req.LoginGroup,
+		IPAddress:        req.IPAddress,
+		Cmd:              req.Cmd,
+		Shell:            req.Shell,
+		Tools:            req.Tools,
+		Interactive:      req.Stdin != "",
+		Cpus:             req.Cpus,
+		MemoryMB:         req.MemoryMB,
+		DisableCleanMode: req.DisableCleanMode,
+		Tags:             req.Tags,
+	}
+
+	switch req.TargetType {
+	case "", "physical":
+		info.TargetType = client.TargetPhys
+	case "container":
+		if req.PodName == "" {
+			return nil, 0, fmt.Errorf("no pod name of container target")
+		}
+
+		info.TargetType = client.TargetContainer
+		info.PodName = req.PodName
+		info.ContainerID = req.ContainerID
+		info.ContainerName = req.ContainerName
+	default:
+		return nil, 0, fmt.Errorf("invalid target type")
+	}
+
+	if req.Verb != "" {
+		if len(req.Cmd) > 0 || req.Stdin != "" || req.Shell != "" || req.Tools {
+			return nil, 0, fmt.Errorf("verbs can't be run with cmd, stdin, shell or tools")
+		}
+
+		info.Verb = &client.VerbRequest{Name: req.Verb, Args: req.VerbArgs}
+	} else if len(req.Cmd) == 0 {
+		return nil, 0, fmt.Errorf("no command")
+	}
+
+	if req.Shell != "" && req.Shell != client.ShellAuto {
+		return nil, 0, fmt.Errorf("invalid shell argument: %s", req.Shell)
+	}
+
+	timeout := conf.DefaultTimeout
+
+	if req.Timeout != "" {
+		var err error
+		if timeout, err = time.ParseDuration(req.Timeout); err != nil || timeout <= 0 {
+			return nil, 0, fmt.Errorf("invalid timeout: %s", req.Timeout)
+		}
+	}
+
+	if timeout > conf.MaxTimeout {
+		timeout = conf.MaxTimeout
+	}
+
+	return info, timeout, nil
+}
+
+// Run executes a non-interactive command synchronously, and responds its output and exit code in JSON.
+// It's authorized and audited as the websocket sessions.
+func (handler *Handler) Run(w http.ResponseWriter, r *http.Request) {
+	correlationID := logutil.NewCorrelationID()
+	requestLogger := logger.WithField("request_from", r.RemoteAddr).WithField(logutil.FieldCorrelationID, correlationID)
+	conf := handler.config.RunConfig.withDefaults()
+
+	w.Header().Set(headerCorrelationID, correlationID)
+
+	var runReq RunRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, conf.MaxBodyBytes)).Decode(&runReq); err != nil {
+		requestLogger.Warnln("Run request invalid: ", err)
+		writeRunError(w, http.StatusBadRequest, "", fmt.Sprintf("request error: %v", err))
+
+		return
+	}
+
+	requestInfo, timeout, err := runReq.info(&conf)
+	if err == nil {
+		err = handler.config.SessionConfig.checkCommandLength(requestInfo.Cmd)
+	}
+
+	if err != nil {
+		requestLogger.Warnln("Run request invalid: ", err)
+		writeRunError(w, http.StatusBadRequest, "", fmt.Sprintf("request error: %v", err))
+
+		return
+	}
+
+	requestLogger.Infoln("Run request info: ", requestInfo)
+
+	if _, err = handler.identifyTenant(r, requestInfo); err != nil {
+		requestLogger.Warnf("authorization failed: %v", err)
+		auditDenial(requestInfo, r.RemoteAddr, "unknown_tenant", err.Error(), 0)
+		writeRunError(w, http.StatusForbidden, "", "permission denied")
+
+		return
+	}
+
+	if err = handler.bindIdentity(r, requestInfo); err != nil {
+		requestLogger.Warnf("authorization failed: %v", err)
+		auditDenial(requestInfo, r.RemoteAddr, "identity_mismatch", err.Error(), 0)
+		writeRunError(w, http.StatusForbidden, "", "permission denied")
+
+		return
+	}
+
+	if err = handler.tags.check(requestInfo.Tags); err != nil {
+		requestLogger.Warnf("authorization failed: %v", err)
+		auditDenial(requestInfo, r.RemoteAddr, "tag_denied", err.Error(), 0)
+		writeRunError(w, http.StatusForbidden, "", err.Error())
+
+		return
+	}
+
+	if err = handler.resolveVerb(requestInfo); err != nil {
+		requestLogger.Warnf("authorization failed: %v", err)
+		auditDenial(requestInfo, r.RemoteAddr, "verb_denied", err.Error(), 0)
+		writeRunError(w, http.StatusForbidden, "", err.Error())
+
+		return
+	}
+
+	authz, ok := handler.authorize(requestLogger, requestInfo, r.RemoteAddr)
+	if !ok {
+		writeRunError(w, http.StatusForbidden, "", "permission denied")
+
+		return
+	}
+
+	// The challenge can't be answered without the websocket.
+	if authz.mfa != nil {
+		auditDenial(requestInfo, r.RemoteAddr, "mfa_unsupported", "MFA can't be answered on /run", authz.latency)
+		writeRunError(w, http.StatusForbidden, "", "MFA is required, use the websocket API instead")
+
+		return
+	}
+
+	// Nobody can witness the commands run on /run.
+	if handler.config.ObserveConfig.dualControl(authz.sensitivity) {
+		auditDenial(requestInfo, r.RemoteAddr, "dual_control_unsupported", "dual control can't be applied on /run", authz.latency)
+		writeRunError(w, http.StatusForbidden, "", "dual control is required, use the websocket API instead")
+
+		return
+	}
+
+	constructAuditInfo(requestInfo, r.RemoteAddr)
+
+	// The requests polling the same idempotent verb share its result within the TTL of the cache, they're
+	// authorized and audited as the others though.
+	var (
+		resp *RunResponse
+		fill func(*RunResponse)
+	)
+
+	if key, ok := handler.verbCache.key(requestInfo); ok {
+		var (
+			cached *RunResponse
+			age    time.Duration
+		)
+
+		if cached, age, fill = handler.verbCache.get(r.Context(), key); cached != nil {
+			requestLogger.Infof("reuse the result of verb %s run by session %s", requestInfo.Verb.Name, cached.SessionID)
+
+			cached.Cached = true
+			w.Header().Set("Age", strconv.Itoa(int(age.Seconds())))
+			writeRunResponse(w, http.StatusOK, cached)
+
+			return
+		}
+
+		defer func() {
+			fill(resp)
+		}()
+	}
+
+	sessID := newSessionID()
+	if requestInfo.BreakGlass {
+		handler.alertBreakGlass(requestInfo, sessID, r.RemoteAddr)
+	}
+
+	sessConf := handler.newSessionConfig(requestInfo, sessID)
+	runtime := handler.runtimeLabel(sessConf)
+	requestLogger = requestLogger.WithField(logutil.FieldSessionID, sessID)
+	defer logutil.CloseSessionFile(sessID)
+
+	if err = handler.checkSidecarQuota(requestLogger, w.Header(), sessConf, sessID, runtime); err != nil {
+		writeRunError(w, http.StatusServiceUnavailable, sessID, "Establish session error: "+err.Error())
+
+		return
+	}
+
+	// Start recording before the session is established, so that nothing is run unrecorded.
+	rec, err := handler.startRecording(requestLogger, requestInfo, sessID)
+	if err != nil {
+		errMsg := sessionutil.WrapErrorWithCode(err.Error())
+		requestLogger.Error(errMsg)
+		writeRunError(w, http.StatusInternalServerError, sessID, "Establish session error: "+errMsg)
+
+		return
+	}
+	defer rec.close()
+
+	sess, isSidecarSession, err := handler.establishSession(requestLogger, sessConf, sessID, runtime)
+	if err != nil {
+		writeRunError(w, http.StatusInternalServerError, sessID, "Establish session error: "+err.Error())
+
+		return
+	}
+
+	if rec != nil {
+		requestInfo.Recording = rec.path
+	}
+
+	handler.tags.count(requestInfo.Tags, sessID)
+	notifyStart(requestInfo, sessID, r.RemoteAddr)
+
+	resp = runSession(r.Context(), sess, runReq.Stdin, timeout, conf.MaxOutputBytes, rec)
+	resp.SessionID = sessID
+
+	// Kill the command if it's still running, and clean up.
+	handler.lock.Lock()
+	if err = handler.releaseSession(sessID, sess); err == nil && isSidecarSession {
+		handler.sidecars.release(sessConf.ContainerID)
+	}
+	handler.lock.Unlock()
+
+	recordTermination(requestLogger, requestInfo, sess, sessID, runtime, resp.Reason)
+	writeRunResponse(w, http.StatusOK, resp)
+}
+
+// runSession writes the stdin to the session and collects the output until the command exits, the timeout
+// expires or the client goes away. The whole output is recorded to rec if it isn't nil, even beyond the output
+// returned.
+func runSession(ctx context.Context, sess agentSession.Session, stdin string, timeout time.Duration, maxOutputBytes int,
+	rec *recording) *RunResponse {
+	stdout := &limitedBuffer{max: maxOutputBytes}
+	stderr := &limitedBuffer{max: maxOutputBytes}
+	stdoutCh := make(chan error, 1)
+	stderrCh := make(chan error, 1)
+
+	// The output of both stdout and stderr is recorded as the terminal would show them.
+	var stdoutWriter, stderrWriter io.Writer = stdout, stderr
+	if rec != nil {
+		stdoutWriter = io.MultiWriter(stdout, rec.recorder.Output())
+		stderrWriter = io.MultiWriter(stderr, rec.recorder.Output())
+
+		if rec.input && stdin != "" {
+			rec.recorder.Input().Write([]byte(stdin))
+		}
+	}
+
+	monitor.Go("run_output", func() {
+		stdoutCh <- collectOutput(sess.NextStdout, sess.StdoutDone, stdoutWriter)
+	})
+	monitor.Go("run_output", func() {
+		stderrCh <- collectOutput(sess.NextStderr, sess.StderrDone, stderrWriter)
+	})
+
+	// The stdin is written in background, since the command may not read it before writing the output,
+	// or may not read it at all.
+	if stdin != "" {
+		go func() {
+			if err := writeStdin(sess, stdin); err != nil {
+				logger.Warnf("write stdin of run request failed: %v", err)
+			}
+		}()
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	resp := &RunResponse{ExitCode: -1}
+
+	// The exit code is available once the stdout is done, the stderr is waited for as well to be complete.
+	for stdoutCh != nil || stderrCh != nil {
+		select {
+		case err := <-stdoutCh:
+			stdoutCh = nil
+
+			if err != nil {
+				resp.Reason, resp.Error = client.TerminationRuntimeFailure, err.Error()
+			}
+		case <-stderrCh:
+			stderrCh = nil
+		case <-timer.C:
+			resp.Reason = client.TerminationMaxDuration
+		case <-ctx.Done():
+			resp.Reason = client.TerminationDisconnected
+		}
+
+		if resp.Reason != "" {
+			break
+		}
+	}
+
+	if resp.Reason == "" {
+		resp.ExitCode = sess.ExitCode()
+		resp.Reason = client.TerminationExited
+
+		if reporter, ok := sess.(agentSession.OOMReporter); ok && resp.ExitCode != 0 && reporter.OOMKilled() {
+			resp.Reason = client.TerminationOOM
+		}
+	}
+
+	resp.Stdout, resp.Stderr = stdout.String(), stderr.String()
+	resp.Truncated = stdout.isTruncated() || stderr.isTruncated()
+
+	return resp
+}
+
+// writeStdin writes the input to the command and closes its stdin.
+func writeStdin(sess agentSession.Session, stdin string) error {
+	in, err := sess.NextStdin()
+	if err != nil {
+		return fmt.Errorf("get stdin of command error: %v", err)
+	}
+
+	if _, err = io.WriteString(in, stdin); err != nil {
+		return fmt.Errorf("write stdin of command error: %v", err)
+	}
+
+	return sess.CloseStdin()
+}
+
+// collectOutput copies the output streams of the command into the writer until EOF, then signals it's done.
+func collectOutput(next func() (io.Reader, error), done func() error, w io.Writer) error {
+	defer done()
+
+	for {
+		reader, err := next()
+		if err == io.EOF {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if reader == nil {
+			continue
+		}
+
+		if _, err = io.Copy(w, reader); err != nil {
+			return err
+		}
+	}
+}
+
+// limitedBuffer keeps the first max bytes written to it, and discards the rest.
+type limitedBuffer struct {
+	lock      sync.Mutex
+	buf       bytes.Buffer
+	max       int
+	truncated bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	room := b.max - b.buf.Len()
+	if len(p) > room {
+		b.truncated = true
+		if room > 0 {
+			b.buf.Write(p[:room])
+		}
+
+		return len(p), nil
+	}
+
+	return b.buf.Write(p)
+}
+
+func (b *limitedBuffer) String() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return b.buf.String()
+}
+
+func (b *limitedBuffer) isTruncated() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return b.truncated
+}
+
+// writeRunResponse writes the response of POST /run in JSON.
+func writeRunResponse(w http.ResponseWriter, status int, resp *RunResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// writeRunError writes the error response of POST /run.
+func writeRunError(w http.ResponseWriter, status int, sessID, errMsg string) {
+	writeRunResponse(w, status, &RunResponse{SessionID: sessID, ExitCode: -1, Error: errMsg})
+}
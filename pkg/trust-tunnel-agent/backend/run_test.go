@@ -0,0 +1,132 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"context"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+	"trust-tunnel/pkg/trust-tunnel-agent/backend/request"
+
+	"github.com/sirupsen/logrus"
+	client "trust-tunnel/pkg/trust-tunnel-client"
+)
+
+// fakeSession echoes the stdin to the stdout, writes "err" to the stderr and exits with code 3 once the stdin
+// is closed.
+type fakeSession struct {
+	stdin  *io.PipeWriter
+	stdout *io.PipeReader
+	sent   bool
+}
+
+func newFakeSession() *fakeSession {
+	r, w := io.Pipe()
+
+	return &fakeSession{stdin: w, stdout: r}
+}
+
+func (s *fakeSession) NextStdin() (io.WriteCloser, error) { return s.stdin, nil }
+func (s *fakeSession) CloseStdin() error                  { return s.stdin.Close() }
+func (s *fakeSession) StdoutDone() error                  { return nil }
+func (s *fakeSession) StderrDone() error                  { return nil }
+func (s *fakeSession) Clean() error                       { return s.stdout.Close() }
+func (s *fakeSession) Resize(int, int) error              { return nil }
+func (s *fakeSession) ExitCode() int                      { return 3 }
+
+func (s *fakeSession) NextStdout() (io.Reader, error) {
+	buf := make([]byte, 4)
+
+	n, err := s.stdout.Read(buf)
+	if err != nil {
+		return nil, io.EOF
+	}
+
+	return strings.NewReader(string(buf[:n])), nil
+}
+
+func (s *fakeSession) NextStderr() (io.Reader, error) {
+	if s.sent {
+		return nil, io.EOF
+	}
+
+	s.sent = true
+
+	return strings.NewReader("err"), nil
+}
+
+func TestRunSession(t *testing.T) {
+	resp := runSession(context.Background(), newFakeSession(), "hello world", time.Minute, 8, nil)
+	if resp.ExitCode != 3 || resp.Reason != client.TerminationExited || resp.Stdout != "hello wo" || !resp.Truncated || resp.Stderr != "err" {
+		t.Fatalf("unexpected response: %+v", resp)
+	}
+
+	// The stdin is never closed, so the command runs until the timeout.
+	sess := newFakeSession()
+	resp = runSession(context.Background(), sess, "", 100*time.Millisecond, 8, nil)
+	sess.Clean()
+
+	if resp.ExitCode != -1 || resp.Reason != client.TerminationMaxDuration {
+		t.Fatalf("unexpected response: %+v", resp)
+	}
+
+	// The whole output is recorded, even beyond the output returned.
+	handler := &Handler{config: &Config{SessionConfig: SessionConfig{RecordDir: t.TempDir(), RecordInput: true}}}
+
+	rec, err := handler.startRecording(logrus.NewEntry(logrus.New()), &request.Info{Cmd: []string{"cat"}}, "20261017010203")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	runSession(context.Background(), newFakeSession(), "hello world", time.Minute, 8, rec)
+	rec.close()
+
+	data, err := os.ReadFile(rec.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, event := range []string{`"i","hello world"]`, `"o","rld"]`, `"o","err"]`} {
+		if !strings.Contains(string(data), event) {
+			t.Errorf("event %s isn't recorded in %s", event, data)
+		}
+	}
+}
+
+func TestRunRequest(t *testing.T) {
+	conf := RunConfig{MaxTimeout: time.Minute}.withDefaults()
+
+	for _, tc := range []struct {
+		req     RunRequest
+		timeout time.Duration
+		err     string
+	}{
+		{RunRequest{Cmd: []string{"uptime"}}, defaultRunTimeout, ""},
+		{RunRequest{Cmd: []string{"uptime"}, Timeout: "1h"}, time.Minute, ""},
+		{RunRequest{Cmd: []string{"uptime"}, TargetType: "container"}, 0, "no pod name of container target"},
+		{RunRequest{Cmd: []string{"uptime"}, Timeout: "-1s"}, 0, "invalid timeout: -1s"},
+		{RunRequest{}, 0, "no command"},
+		{RunRequest{Verb: "ps"}, defaultRunTimeout, ""},
+		{RunRequest{Verb: "ps", Cmd: []string{"uptime"}}, 0, "verbs can't be run with cmd, stdin, shell or tools"},
+	} {
+		_, timeout, err := tc.req.info(&conf)
+		if (err == nil && tc.err != "") || (err != nil && err.Error() != tc.err) || timeout != tc.timeout {
+			t.Errorf("%+v: expected %s %q, got %s %v", tc.req, tc.timeout, tc.err, timeout, err)
+		}
+	}
+}
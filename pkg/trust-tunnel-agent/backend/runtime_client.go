@@ -0,0 +1,282 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+	"trust-tunnel/pkg/common/sessionutil"
+	"trust-tunnel/pkg/trust-tunnel-agent/faults"
+	"trust-tunnel/pkg/trust-tunnel-agent/monitor"
+
+	agentSession "trust-tunnel/pkg/trust-tunnel-agent/session"
+
+	"github.com/containerd/containerd"
+	dockerAPIClient "github.com/docker/docker/client"
+)
+
+const (
+	defaultHealthCheckPeriod = 10 * time.Second
+	healthCheckTimeout       = 5 * time.Second
+)
+
+// runtimeClient keeps the client of the container runtime endpoint, and checks its health periodically.
+// The client is created on demand, and it's replaced once the health check fails, e.g. after the container daemon
+// restarts. The replaced clients are closed once the sessions using them are released, as a failed check may be
+// a transient hiccup which the sessions survive.
+type runtimeClient struct {
+	config *agentSession.ContainerConfig
+
+	lock    sync.RWMutex
+	current *runtimeClients
+	// sessions maps the sessions to the clients they were established with.
+	sessions map[agentSession.Session]*runtimeClients
+	// err is the error of the last creation or health check, nil means the runtime is healthy.
+	err error
+}
+
+// runtimeClients are the clients of a connection to the container runtime.
+type runtimeClients struct {
+	docker     dockerAPIClient.CommonAPIClient
+	containerd *containerd.Client
+	// users is the number of the sessions using the clients.
+	users int
+	// retired indicates the clients are replaced, they're closed once they aren't used.
+	retired bool
+}
+
+// close closes the clients.
+func (rc *runtimeClients) close() {
+	if rc.docker != nil {
+		rc.docker.Close()
+	}
+
+	if rc.containerd != nil {
+		rc.containerd.Close()
+	}
+}
+
+// newRuntimeClient creates a runtimeClient and tries to connect to the container runtime.
+func newRuntimeClient(config *agentSession.ContainerConfig) *runtimeClient {
+	c := &runtimeClient{config: config, sessions: make(map[agentSession.Session]*runtimeClients)}
+
+	c.lock.Lock()
+	c.err = c.connect()
+	c.lock.Unlock()
+
+	if c.err != nil {
+		logger.Errorf("create %s API client error: %v", config.ContainerRuntime, c.err)
+	}
+
+	return c
+}
+
+// connect creates the clients of the container runtime if they don't exist, the caller must hold the lock.
+func (c *runtimeClient) connect() error {
+	if c.current != nil {
+		return nil
+	}
+
+	var (
+		rc  runtimeClients
+		err error
+	)
+
+	if c.config.ContainerRuntime == agentSession.Docker {
+		rc.docker, err = sessionutil.CreateDockerClient(c.config.Endpoint, c.config.DockerAPIVersion, faults.DockerOpts()...)
+	} else {
+		rc.containerd, err = containerd.New(c.config.Endpoint, faults.ContainerdOpts()...)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	c.current = &rc
+
+	return nil
+}
+
+// acquire returns the current clients of the container runtime for a session, which are kept open until they're
+// released, even if they're replaced meanwhile. The clients are re-created if they have been replaced.
+func (c *runtimeClient) acquire() (*runtimeClients, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if err := c.connect(); err != nil {
+		return nil, fmt.Errorf("%s daemon is unavailable: %v", c.config.ContainerRuntime, err)
+	}
+
+	c.current.users++
+
+	return c.current, nil
+}
+
+// release releases the clients acquired, and closes them if they're replaced and no longer used.
+func (c *runtimeClient) release(rc *runtimeClients) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.releaseLocked(rc)
+}
+
+func (c *runtimeClient) releaseLocked(rc *runtimeClients) {
+	rc.users--
+
+	if rc.retired && rc.users <= 0 {
+		rc.close()
+	}
+}
+
+// bind binds the session to the clients acquired for it, which are released with the session by unbind.
+func (c *runtimeClient) bind(sess agentSession.Session, rc *runtimeClients) {
+	c.lock.Lock()
+	c.sessions[sess] = rc
+	c.lock.Unlock()
+}
+
+// unbind releases the clients the session was established with, if any.
+func (c *runtimeClient) unbind(sess agentSession.Session) {
+	if c == nil {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if rc, ok := c.sessions[sess]; ok {
+		delete(c.sessions, sess)
+		c.releaseLocked(rc)
+	}
+}
+
+// clients returns the current clients of the container runtime, they're re-created if they have been replaced.
+// The clients may be closed once they're replaced, use acquire for the sessions outliving a health check.
+func (c *runtimeClient) clients() (dockerAPIClient.CommonAPIClient, *containerd.Client, error) {
+	c.lock.RLock()
+	rc := c.current
+	c.lock.RUnlock()
+
+	if rc == nil {
+		c.lock.Lock()
+		err := c.connect()
+		rc = c.current
+		c.lock.Unlock()
+
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s daemon is unavailable: %v", c.config.ContainerRuntime, err)
+		}
+	}
+
+	return rc.docker, rc.containerd, nil
+}
+
+// docker returns the docker client, it's used by the sidecar routines.
+func (c *runtimeClient) docker() (dockerAPIClient.CommonAPIClient, error) {
+	dockerClient, _, err := c.clients()
+	if err != nil {
+		return nil, err
+	}
+
+	if dockerClient == nil {
+		return nil, fmt.Errorf("container runtime isn't docker")
+	}
+
+	return dockerClient, nil
+}
+
+// check pings the container runtime, and replaces the clients if it's unhealthy.
+func (c *runtimeClient) check() error {
+	dockerClient, containerdClient, err := c.clients()
+	if err == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), healthCheckTimeout)
+
+		if dockerClient != nil {
+			_, err = dockerClient.Ping(ctx)
+		} else {
+			var serving bool
+
+			serving, err = containerdClient.IsServing(ctx)
+			if err == nil && !serving {
+				err = fmt.Errorf("containerd is not serving")
+			}
+		}
+
+		cancel()
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if err != nil && c.err == nil {
+		logger.Errorf("%s health check failed: %v", c.config.ContainerRuntime, err)
+	} else if err == nil && c.err != nil {
+		logger.Infof("%s is healthy again", c.config.ContainerRuntime)
+	}
+
+	c.err = err
+
+	if err != nil {
+		c.replace()
+		monitor.MetricsContainerRuntimeHealthy.Set(0)
+	} else {
+		monitor.MetricsContainerRuntimeHealthy.Set(1)
+	}
+
+	return err
+}
+
+// replace retires the current clients and creates new ones, the caller must hold the lock. The retired clients are
+// closed once the sessions using them are released, and the new ones are created on the next use if it fails.
+func (c *runtimeClient) replace() {
+	if old := c.current; old != nil {
+		old.retired = true
+		if old.users <= 0 {
+			old.close()
+		}
+
+		c.current = nil
+	}
+
+	if err := c.connect(); err != nil {
+		logger.Warnf("re-create %s API client error: %v", c.config.ContainerRuntime, err)
+	}
+}
+
+// checkPeriodically checks the health of the container runtime periodically.
+func (c *runtimeClient) checkPeriodically(period time.Duration) {
+	if period <= 0 {
+		period = defaultHealthCheckPeriod
+	}
+
+	for {
+		c.check()
+		time.Sleep(period)
+	}
+}
+
+// ready returns the cached health state of the container runtime.
+func (c *runtimeClient) ready() error {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	if c.err != nil {
+		return fmt.Errorf("%s is unhealthy: %v", c.config.ContainerRuntime, c.err)
+	}
+
+	return nil
+}
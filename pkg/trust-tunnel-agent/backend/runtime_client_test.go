@@ -0,0 +1,83 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package backend
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	agentSession "trust-tunnel/pkg/trust-tunnel-agent/session"
+
+	"github.com/docker/docker/api/types"
+	dockerAPIClient "github.com/docker/docker/client"
+)
+
+// fakePingClient is a docker client failing the health checks.
+type fakePingClient struct {
+	dockerAPIClient.CommonAPIClient
+
+	closed bool
+}
+
+func (c *fakePingClient) Ping(_ context.Context) (types.Ping, error) {
+	return types.Ping{}, fmt.Errorf("context deadline exceeded")
+}
+
+func (c *fakePingClient) Close() error {
+	c.closed = true
+
+	return nil
+}
+
+func TestRuntimeClientReplace(t *testing.T) {
+	old := &fakePingClient{}
+	c := &runtimeClient{
+		config:   &agentSession.ContainerConfig{ContainerRuntime: agentSession.Docker, Endpoint: "unix:///nonexistent/docker.sock"},
+		current:  &runtimeClients{docker: old},
+		sessions: make(map[agentSession.Session]*runtimeClients),
+	}
+
+	rc, err := c.acquire()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sess := &fakeSession{}
+	c.bind(sess, rc)
+
+	// The clients used by the session are replaced but kept open on a failed check.
+	if err = c.check(); err == nil {
+		t.Fatalf("expected the health check to fail")
+	}
+
+	if old.closed || c.current == rc || c.current == nil {
+		t.Fatalf("clients aren't replaced while kept open, closed %v", old.closed)
+	}
+
+	c.unbind(sess)
+
+	if !old.closed {
+		t.Errorf("replaced clients aren't closed once released")
+	}
+
+	// The clients without sessions are closed right away.
+	unused := &fakePingClient{}
+	c.current = &runtimeClients{docker: unused}
+	c.check()
+
+	if !unused.closed {
+		t.Errorf("unused clients aren't closed once replaced")
+	}
+}
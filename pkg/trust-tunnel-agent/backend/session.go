@@ -15,12 +15,37 @@
 package backend
 
 import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
 	"sync"
+	"sync/atomic"
 	"time"
 	"trust-tunnel/pkg/common/logutil"
+	"trust-tunnel/pkg/common/watermark"
+	"trust-tunnel/pkg/trust-tunnel-agent/backend/request"
+	"trust-tunnel/pkg/trust-tunnel-agent/monitor"
+	"trust-tunnel/pkg/trust-tunnel-agent/proctrack"
+	"trust-tunnel/pkg/trust-tunnel-agent/recordstore"
 	"trust-tunnel/pkg/trust-tunnel-agent/session"
 
 	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
+	client "trust-tunnel/pkg/trust-tunnel-client"
+)
+
+const (
+	// ExecTracerProc traces the commands executed by the process events, reading them from /proc.
+	ExecTracerProc = "proc"
+
+	// ExecTracerEBPF traces the commands executed by eBPF, copying them as they are executed.
+	ExecTracerEBPF = "ebpf"
+
+	// limitCheckPeriod is the period of checking the idle timeout and the maximum duration of sessions.
+	limitCheckPeriod = time.Second
+
+	closeWriteTimeout = 5 * time.Second
 )
 
 // SessionConfig is a structure for session configuration, used to store information related to session configurations.
@@ -30,6 +55,97 @@ type SessionConfig struct {
 
 	// DelayReleaseSessionTimeout defines the timeout duration for delaying session release.
 	DelayReleaseSessionTimeout time.Duration `toml:"delay_release_session_timeout"`
+
+	// ResumeBufferSize specifies the most bytes of the output buffered while a session is detached, which is
+	// replayed once the session is reattached, the oldest output is dropped beyond it. Defaults to 1 MiB if zero,
+	// nothing is buffered if negative.
+	ResumeBufferSize int `toml:"resume_buffer_size"`
+
+	// InstanceID identifies this agent instance in the affinity tokens, defaults to the hostname.
+	InstanceID string `toml:"instance_id"`
+
+	// AdvertiseAddress is the address ("host" or "host:port") through which this agent instance can be reached
+	// directly, reattachments landing on other instances behind a load balancer are redirected to it.
+	// It also overrides the main IP of the host reported in audit logs.
+	// Defaults to the main IP of the host.
+	AdvertiseAddress string `toml:"advertise_address"`
+
+	// AffinityKey is the key signing the affinity tokens, shared by the agent instances behind the same load
+	// balancer, e.g. "env://TRUST_TUNNEL_AFFINITY_KEY". The tokens of the other instances aren't trusted, and the
+	// reattachments aren't redirected, if it's empty, as a random key is used then.
+	AffinityKey string `toml:"affinity_key"`
+
+	// InterfacePriority lists the interface name patterns (e.g. "bond*", "eth0") in descending priority,
+	// the main IP of the host is chosen from the interface with the highest priority.
+	InterfacePriority []string `toml:"interface_priority"`
+
+	// IdleTimeout specifies the duration after which a session without input or output is terminated.
+	// No timeout if not positive.
+	IdleTimeout time.Duration `toml:"idle_timeout"`
+
+	// IdleWarning specifies how long before the idle timeout the interactive sessions are warned, so that the user
+	// can keep the session open by pressing a key. No warning if not positive.
+	IdleWarning time.Duration `toml:"idle_warning"`
+
+	// MaxDuration specifies the maximum duration of a session, including the reattachments.
+	// No limit if not positive.
+	MaxDuration time.Duration `toml:"max_duration"`
+
+	// ShutdownTimeout specifies how long the agent waits for the terminated sessions to be recorded and audited
+	// when it's shutting down. Defaults to 10 seconds if not positive.
+	ShutdownTimeout time.Duration `toml:"shutdown_timeout"`
+
+	// ExecAudit specifies whether to audit every command executed within the sessions, which can't be evaded by
+	// disabling the shell history. It requires the process tracking.
+	ExecAudit bool `toml:"exec_audit"`
+
+	// ExecTracer specifies how the commands audited are traced: ExecTracerProc by the process events, following
+	// the process trees, or ExecTracerEBPF by eBPF on the entries of the syscalls, in the cgroups of the sessions.
+	// Defaults to ExecTracerProc if empty.
+	ExecTracer string `toml:"exec_tracer"`
+
+	// Watermark maps the sensitivity levels of targets given by the auth handler to the intervals of watermarking
+	// the terminal output of the sessions with the user and the session ID. The level "default" applies to
+	// the targets without a level. The output isn't watermarked if the level isn't listed.
+	Watermark map[string]time.Duration `toml:"watermark"`
+
+	// ForwardEnv lists the name patterns (e.g. "LC_*") of the environment variables forwarded from the clients to
+	// the commands. Defaults to the terminal type and the locale: TERM, COLORTERM, LANG, LANGUAGE and LC_*.
+	// Nothing is forwarded if it's empty, and TERM is xterm-256color then. The custom variables given by
+	// `trust-tunnel-client -e`, e.g. "APP_*", are forwarded if listed, but never the ones set by the agent or
+	// changing how the commands are run, e.g. PATH, HOME, LD_* and BASH_ENV. The clients are told which variables
+	// are rejected.
+	ForwardEnv []string `toml:"forward_env"`
+
+	// MaxCommandLength specifies the maximum total length of the arguments of the commands in bytes, whether they're
+	// sent in the headers or the command frame. Defaults to 256 KiB if not positive.
+	MaxCommandLength int `toml:"max_command_length"`
+
+	// RecordDir is the directory of the recordings of the sessions in the asciicast v2 format, <session id>.cast,
+	// which replay the output and the terminal sizes of the sessions with timing. Sessions are refused if their
+	// recordings can't be created. The copies, the port forwards and the files read aren't recorded.
+	// Nothing is recorded if it's empty.
+	RecordDir string `toml:"record_dir"`
+
+	// RecordInput specifies whether the input of the sessions is recorded as well, which may carry the passwords
+	// typed without echo.
+	RecordInput bool `toml:"record_input"`
+
+	// RecordUpload specifies the object storage the recordings are uploaded to once the sessions end, after which
+	// they're removed from RecordDir.
+	RecordUpload recordstore.Config `toml:"record_upload"`
+}
+
+// watermarkInterval returns the interval of watermarking the sessions to targets of the sensitivity level,
+// and whether to watermark them.
+func (c *SessionConfig) watermarkInterval(sensitivity string) (time.Duration, bool) {
+	if sensitivity == "" {
+		sensitivity = "default"
+	}
+
+	interval, ok := c.Watermark[sensitivity]
+
+	return interval, ok && interval > 0
 }
 
 // StaleSession represents a stale session that needs to be released.
@@ -39,19 +155,186 @@ type StaleSession struct {
 	// Death count down.
 	deathClock       <-chan time.Time
 	isSidecarSession bool
+	// startTime is the time when the session was established.
+	startTime time.Time
+	// requestInfo and runtime are used to record the termination of the session.
+	requestInfo *request.Info
+	runtime     string
+	// size is the terminal size of the session, re-applied when the session is reused.
+	size termSize
+	// recording is the recording of the session, continued when the session is reused.
+	recording *recording
+	// resume buffers the output of the session, replayed when the session is reused.
+	resume *resumeBuffer
+	// observers are the observers of the session, kept attached when the session is reused.
+	observers *observerSet
 }
 
 // Connection represents a client connection, encapsulating the management of session and websocket connections.
 type Connection struct {
-	// sess represents the client's session, used for maintaining session state.
-	sess session.Session
+	// terminal is the client's session, with the terminal sizes requested by the client.
+	terminal
+
 	// conn represents the client's websocket connection, used for sending and receiving messages.
 	conn *websocket.Conn
 	// cmdLogger is used for logging command operations, providing detailed operation records.
 	cmdLogger *logutil.CmdLogger
-	errCh     chan error
-	doneCh    chan struct{}
-	lock      sync.Mutex
+	// watermark watermarks the output of the session if it's not nil.
+	watermark *watermark.Writer
+	// resume buffers the output of the session once the connection is detached if it's not nil.
+	resume *resumeBuffer
+	// observers relays the output of the session to its read-only observers, it's nil if it can't be observed.
+	observers *observerSet
+	// sessID and requestInfo are the ID and the request of the session, which the observers look up.
+	sessID      string
+	requestInfo *request.Info
+
+	errCh  chan error
+	doneCh chan struct{}
+	lock   sync.Mutex
+
+	// startTime is the time when the session was established.
+	startTime time.Time
+	// lastActive is the time of the last input or output in unix nanoseconds.
+	lastActive atomic.Int64
+	// idleWarning is how long before the idle timeout the session is warned, it's zero for no warning.
+	idleWarning time.Duration
+	// tty is whether the session has a terminal, which the notices are formatted for.
+	tty bool
+	// rawInput is whether the input isn't logged as commands.
+	rawInput bool
+	// inputBarrier is set while the input typed before the witness of the session attached is discarded.
+	inputBarrier atomic.Bool
+	// reason is why the session is terminated, the first reason set is kept.
+	reason     client.TerminationReason
+	reasonLock sync.Mutex
+}
+
+// active records the input or output of the session.
+func (sessConn *Connection) active() {
+	sessConn.lastActive.Store(time.Now().UnixNano())
+}
+
+// setReason sets the termination reason unless it has been set, and returns whether it's set.
+func (sessConn *Connection) setReason(reason client.TerminationReason) bool {
+	sessConn.reasonLock.Lock()
+	defer sessConn.reasonLock.Unlock()
+
+	if sessConn.reason != "" {
+		return false
+	}
+
+	sessConn.reason = reason
+
+	return true
+}
+
+// terminationReason returns the termination reason of the session.
+func (sessConn *Connection) terminationReason() client.TerminationReason {
+	sessConn.reasonLock.Lock()
+	defer sessConn.reasonLock.Unlock()
+
+	return sessConn.reason
+}
+
+// terminate terminates the session for the reason. The final status frame carrying the reason is sent
+// and the connection is closed, then the session is released by the handler.
+func (sessConn *Connection) terminate(reason client.TerminationReason) {
+	if !sessConn.setReason(reason) {
+		return
+	}
+
+	logger.Infof("terminate session for %s", reason)
+
+	data, _ := json.Marshal(client.NormalCloseMessage{Code: -1, Reason: reason})
+
+	sessConn.lock.Lock()
+	sessConn.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, truncWebsocketErrMsg(string(data))),
+		time.Now().Add(closeWriteTimeout))
+	sessConn.lock.Unlock()
+
+	sessConn.conn.Close()
+}
+
+// warnIdle warns the user that the session will be terminated for inactivity in the remaining time.
+// The warning isn't counted as activity.
+func (sessConn *Connection) warnIdle(remaining time.Duration) {
+	notice := fmt.Sprintf("[trust-tunnel] session will close in %v for inactivity, press any key to keep it open",
+		remaining.Round(time.Second))
+
+	if err := sessConn.notify(notice); err != nil {
+		logger.Warnf("warn idle session failed: %v", err)
+	}
+}
+
+// notify writes the notice of the agent into the output of the session.
+func (sessConn *Connection) notify(notice string) error {
+	// The terminal may be in the middle of the prompt.
+	if sessConn.tty {
+		notice = "\n" + notice
+	}
+
+	sessConn.lock.Lock()
+	defer sessConn.lock.Unlock()
+
+	return writeNotice(sessConn.conn, sessConn.tty, notice)
+}
+
+// enforceLimits terminates the session once it's idle for idleTimeout, or it lasts for maxDuration.
+// The session is warned once idleWarning before the idle timeout, and again if it's idle again after activity.
+func (sessConn *Connection) enforceLimits(idleTimeout, maxDuration time.Duration) {
+	if idleTimeout <= 0 && maxDuration <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(limitCheckPeriod)
+	defer ticker.Stop()
+
+	warned := false
+
+	for {
+		select {
+		case <-sessConn.doneCh:
+			return
+		case now := <-ticker.C:
+			if maxDuration > 0 && now.Sub(sessConn.startTime) >= maxDuration {
+				sessConn.terminate(client.TerminationMaxDuration)
+
+				return
+			}
+
+			if idleTimeout <= 0 {
+				continue
+			}
+
+			idle := now.Sub(time.Unix(0, sessConn.lastActive.Load()))
+			if idle >= idleTimeout {
+				sessConn.terminate(client.TerminationIdleTimeout)
+
+				return
+			}
+
+			if sessConn.idleWarning <= 0 || sessConn.idleWarning >= idleTimeout {
+				continue
+			}
+
+			if idle < idleTimeout-sessConn.idleWarning {
+				warned = false
+			} else if !warned {
+				sessConn.warnIdle(idleTimeout - idle)
+				warned = true
+			}
+		}
+	}
+}
+
+// newSessionID returns a new session ID, the time it's started at followed by a random suffix, so that the sessions
+// started within the same second don't share their IDs, recordings or reattachments.
+func newSessionID() string {
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+
+	return time.Now().Format("20060102150405") + "-" + hex.EncodeToString(suffix)
 }
 
 // delayReleaseSession periodically checks for stale sessions and releases them if they are outdated.
@@ -68,8 +351,13 @@ func (handler *Handler) delayReleaseSession() {
 
 				err := handler.releaseSession(id, staleSess.sess)
 				if err == nil && staleSess.isSidecarSession {
-					handler.currentSidecarNum--
+					handler.sidecars.release(staleSess.requestInfo.ContainerID)
 				}
+
+				staleSess.recording.close()
+
+				staleSess.requestInfo.Witnesses = staleSess.observers.witnessList()
+				recordTermination(logger.WithField("session_id", id), staleSess.requestInfo, staleSess.sess, id, staleSess.runtime, client.TerminationDisconnected)
 			default:
 			}
 		}
@@ -79,16 +367,52 @@ func (handler *Handler) delayReleaseSession() {
 
 // releaseSession releases the given session and removes it from the stale sessions list.
 func (handler *Handler) releaseSession(id string, sess session.Session) error {
-	logger.Debugf("release session %s", id)
+	sessLogger := logger.WithField(logutil.FieldSessionID, id)
+	sessLogger.Debugf("release session %s", id)
 
 	// Clean up the session.
 	err := sess.Clean()
 	if err != nil {
-		logger.Errorf("clean session err:%v", err)
+		sessLogger.Errorf("clean session err:%v", err)
 	}
 
+	handler.runtime.unbind(sess)
+
+	logutil.CloseSessionFile(id)
+
 	// Remove the session from the stale sessions list.
 	delete(handler.staleSessions, id)
 
 	return err
 }
+
+// recordTermination logs, audits and counts the termination of a session.
+// The processes spawned within the session are audited if they are tracked, and so are the files read or copied
+// and the connections forwarded within it.
+func recordTermination(requestLogger *logrus.Entry, req *request.Info, sess session.Session, sessID, runtime string,
+	reason client.TerminationReason) {
+	var processes []proctrack.Process
+	if reporter, ok := sess.(session.ProcessReporter); ok {
+		processes = reporter.Processes()
+	}
+
+	var fileAccess *session.FileAccess
+	if reporter, ok := sess.(session.FileReporter); ok {
+		fileAccess = reporter.FileAccess()
+	}
+
+	var copyStats *session.CopyStats
+	if reporter, ok := sess.(session.CopyReporter); ok {
+		copyStats = reporter.CopyStats()
+	}
+
+	var forwardStats *session.ForwardStats
+	if reporter, ok := sess.(session.ForwardReporter); ok {
+		forwardStats = reporter.ForwardStats()
+	}
+
+	requestLogger.WithField("reason", reason).Infoln("session terminated")
+	auditTermination(req, sessID, reason, processes, fileAccess, copyStats, forwardStats)
+	monitor.MetricsSessionTermination.WithLabelValues(string(reason), runtime).Inc()
+	notifyEnd(req, sessID, reason)
+}
@@ -0,0 +1,163 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	client "trust-tunnel/pkg/trust-tunnel-client"
+)
+
+func TestEnforceLimits(t *testing.T) {
+	sessConnCh := make(chan *Connection, 1)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+
+		sessConn := &Connection{conn: conn, doneCh: make(chan struct{}), startTime: time.Now()}
+		sessConn.active()
+		sessConnCh <- sessConn
+
+		sessConn.enforceLimits(time.Second, time.Hour)
+	}))
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer conn.Close()
+
+	_, _, err = conn.ReadMessage()
+
+	closeErr, ok := err.(*websocket.CloseError)
+	if !ok {
+		t.Fatalf("expected close error, got %v", err)
+	}
+
+	var msg client.NormalCloseMessage
+	if err := json.Unmarshal([]byte(closeErr.Text), &msg); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if msg.Reason != client.TerminationIdleTimeout {
+		t.Errorf("expected reason %q, got %q", client.TerminationIdleTimeout, msg.Reason)
+	}
+
+	// The first reason is kept.
+	sessConn := <-sessConnCh
+	if sessConn.setReason(client.TerminationClientClose) || sessConn.terminationReason() != client.TerminationIdleTimeout {
+		t.Errorf("expected reason %q to be kept, got %q", client.TerminationIdleTimeout, sessConn.terminationReason())
+	}
+}
+
+func TestIdleWarning(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+
+		sessConn := &Connection{conn: conn, doneCh: make(chan struct{}), startTime: time.Now(), tty: true, idleWarning: 1500 * time.Millisecond}
+		sessConn.active()
+		sessConn.enforceLimits(2*time.Second, time.Hour)
+	}))
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer conn.Close()
+
+	// The warning is written to the terminal once before the session is terminated.
+	msgType, data, err := conn.ReadMessage()
+	if err != nil || msgType != websocket.BinaryMessage || !strings.HasPrefix(string(data), "\r\n[trust-tunnel] session will close in ") ||
+		!strings.HasSuffix(string(data), "\r\n") {
+		t.Fatalf("unexpected warning %q, %v", data, err)
+	}
+
+	if _, _, err = conn.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+		t.Fatalf("expected the session terminated, got %v", err)
+	}
+}
+
+func TestShutdownWaitsForSessions(t *testing.T) {
+	handler := &Handler{
+		config:      &Config{SessionConfig: SessionConfig{ShutdownTimeout: time.Minute}},
+		connections: make(map[*Connection]struct{}),
+		serving:     2,
+	}
+
+	done := make(chan struct{})
+
+	go func() {
+		handler.Shutdown()
+		close(done)
+	}()
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-done:
+			t.Fatalf("shutdown returned with %d sessions serving", 2-i)
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		handler.served()
+	}
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("shutdown didn't return after the sessions are served")
+	}
+
+	// The shutdown returns after the timeout if the sessions aren't served.
+	handler = &Handler{
+		config:      &Config{SessionConfig: SessionConfig{ShutdownTimeout: 50 * time.Millisecond}},
+		connections: make(map[*Connection]struct{}),
+		serving:     1,
+	}
+
+	start := time.Now()
+	handler.Shutdown()
+
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("shutdown returned in %v before the timeout", elapsed)
+	}
+}
+
+func TestNewSessionID(t *testing.T) {
+	seen := make(map[string]bool)
+
+	// The sessions started within the same second get different IDs, which are safe for the recordings.
+	for i := 0; i < 100; i++ {
+		id := newSessionID()
+		if seen[id] || !recordingFileNameExp.MatchString(id) {
+			t.Fatalf("unexpected session ID %s", id)
+		}
+
+		seen[id] = true
+	}
+}
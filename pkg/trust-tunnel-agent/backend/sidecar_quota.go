@@ -0,0 +1,125 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+	"trust-tunnel/pkg/trust-tunnel-client/protocol"
+)
+
+// sidecarRetryAfter is the hint of when to retry the sessions refused for no sidecar is available.
+const sidecarRetryAfter = 30 * time.Second
+
+// sidecarQuota accounts the sidecars attached to containers against the limit of the node and the limit of each
+// container, as many sidecars sharing the PID namespace of a container degrade it badly.
+type sidecarQuota struct {
+	lock sync.Mutex
+	// limit is the maximum sidecars of the node.
+	limit int
+	// perContainerLimit is the maximum sidecars attached to a container, unlimited if it's zero.
+	perContainerLimit int
+	total             int
+	containers        map[string]int
+}
+
+// newSidecarQuota creates a sidecarQuota with the given limits.
+func newSidecarQuota(limit, perContainerLimit int) *sidecarQuota {
+	return &sidecarQuota{
+		limit:             limit,
+		perContainerLimit: perContainerLimit,
+		containers:        make(map[string]int),
+	}
+}
+
+// acquire reserves a sidecar attached to the container, it's released by release.
+func (q *sidecarQuota) acquire(containerID string) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if err := q.available(containerID); err != nil {
+		return err
+	}
+
+	q.total++
+	q.containers[containerID]++
+
+	return nil
+}
+
+// release releases a sidecar attached to the container.
+func (q *sidecarQuota) release(containerID string) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if q.containers[containerID] == 0 {
+		return
+	}
+
+	q.total--
+
+	if q.containers[containerID]--; q.containers[containerID] == 0 {
+		delete(q.containers, containerID)
+	}
+}
+
+// available checks if a sidecar can be attached to the container, the lock must be held.
+func (q *sidecarQuota) available(containerID string) error {
+	retryAfter := int(sidecarRetryAfter.Seconds())
+
+	if q.total >= q.limit {
+		return fmt.Errorf("current sidecar num exceed the limit: %d,%d, retry after %ds", q.total, q.limit, retryAfter)
+	}
+
+	if q.perContainerLimit > 0 && q.containers[containerID] >= q.perContainerLimit {
+		return fmt.Errorf("sidecar num of the container exceed the limit: %d,%d, retry after %ds",
+			q.containers[containerID], q.perContainerLimit, retryAfter)
+	}
+
+	return nil
+}
+
+// check checks if a sidecar can be attached to the container without reserving it. If not, the occupancy of
+// the node and the container, and the hint of when to retry are set in the response header.
+func (q *sidecarQuota) check(containerID string, header http.Header) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	err := q.available(containerID)
+	if err == nil {
+		return nil
+	}
+
+	header.Set(protocol.HeaderSidecarOccupancy, protocol.FormatOccupancy(q.total, q.limit))
+
+	if q.perContainerLimit > 0 {
+		header.Set(protocol.HeaderContainerSidecarOccupancy, protocol.FormatOccupancy(q.containers[containerID], q.perContainerLimit))
+	}
+
+	header.Set(protocol.HeaderRetryAfter, strconv.Itoa(int(sidecarRetryAfter.Seconds())))
+
+	return err
+}
+
+// count returns the number of the sidecars.
+func (q *sidecarQuota) count() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	return q.total
+}
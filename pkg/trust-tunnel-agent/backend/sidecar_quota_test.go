@@ -0,0 +1,69 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"net/http"
+	"testing"
+	"trust-tunnel/pkg/trust-tunnel-client/protocol"
+)
+
+func TestSidecarQuota(t *testing.T) {
+	q := newSidecarQuota(3, 2)
+
+	for _, id := range []string{"a", "a", "b"} {
+		if err := q.acquire(id); err != nil {
+			t.Fatalf("acquire a sidecar of %s: %v", id, err)
+		}
+	}
+
+	if err := q.acquire("c"); err == nil {
+		t.Error("the limit of the node should be enforced")
+	}
+
+	q.release("b")
+
+	if err := q.acquire("a"); err == nil {
+		t.Error("the limit of the container should be enforced")
+	}
+
+	// Releasing the sidecars never acquired doesn't break the accounting.
+	q.release("unknown")
+
+	if err := q.acquire("c"); err != nil || q.count() != 3 {
+		t.Errorf("unexpected accounting %d: %v", q.count(), err)
+	}
+}
+
+func TestSidecarQuotaCheck(t *testing.T) {
+	q := newSidecarQuota(3, 2)
+	header := http.Header{}
+
+	if err := q.check("a", header); err != nil || len(header) != 0 {
+		t.Fatalf("unexpected check of an empty quota: %v %v", header, err)
+	}
+
+	q.acquire("a")
+	q.acquire("a")
+
+	if err := q.check("a", header); err == nil {
+		t.Fatal("the limit of the container should be enforced")
+	}
+
+	if header.Get(protocol.HeaderSidecarOccupancy) != "2/3" || header.Get(protocol.HeaderContainerSidecarOccupancy) != "2/2" ||
+		header.Get(protocol.HeaderRetryAfter) != "30" || q.count() != 2 {
+		t.Errorf("unexpected headers %v of %d sidecars", header, q.count())
+	}
+}
@@ -0,0 +1,670 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+	"trust-tunnel/pkg/common/logutil"
+	"trust-tunnel/pkg/common/sessionutil"
+	"trust-tunnel/pkg/trust-tunnel-agent/backend/request"
+	"trust-tunnel/pkg/trust-tunnel-agent/monitor"
+	"trust-tunnel/pkg/trust-tunnel-client/fips"
+
+	agentSession "trust-tunnel/pkg/trust-tunnel-agent/session"
+	client "trust-tunnel/pkg/trust-tunnel-client"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	defaultSSHAddr = ":2222"
+
+	// sshHandshakeTimeout is how long the SSH clients have to authenticate.
+	sshHandshakeTimeout = 30 * time.Second
+
+	// sshPermUser and sshPermTenant are the extensions of the permissions carrying the user and the tenant of the
+	// authorized key the client is authenticated with.
+	sshPermUser   = "user"
+	sshPermTenant = "tenant"
+
+	// sshFailureExitCode is the exit status of the sessions failing to be established, as OpenSSH exits with.
+	sshFailureExitCode = 255
+)
+
+// SSHConfig specifies the SSH frontend, which bridges the standard ssh and scp clients into the sessions, where
+// installing the client isn't possible. The SSH user is the login name on physical hosts, and
+// <login name>/<pod>/<container> for containers.
+type SSHConfig struct {
+	Enabled bool `toml:"enabled"`
+
+	// Addr is the address the SSH server listens on, defaults to ":2222".
+	Addr string `toml:"addr"`
+
+	// HostKeys are the paths of the private host keys of the agent, at least one is required.
+	HostKeys []string `toml:"host_keys"`
+
+	// AuthorizedKeys is the path of the public keys of the users in the authorized_keys format, whose comments are
+	// the user names, and whose tenant="<name>" options are the tenants. It's read for every authentication, so
+	// the keys are changed without restarting the agent.
+	AuthorizedKeys string `toml:"authorized_keys"`
+}
+
+// withDefaults returns the configuration with the defaults filled in.
+func (c SSHConfig) withDefaults() SSHConfig {
+	if c.Addr == "" {
+		c.Addr = defaultSSHAddr
+	}
+
+	return c
+}
+
+// sshTarget is the target of an SSH session, given by the SSH user.
+type sshTarget struct {
+	loginName     string
+	podName       string
+	containerName string
+}
+
+// parseSSHUser parses the SSH user, which is the login name on physical hosts, and <login name>/<pod>/<container>
+// for containers.
+func parseSSHUser(user string) (*sshTarget, error) {
+	parts := strings.Split(user, "/")
+
+	switch {
+	case len(parts) == 1 && parts[0] != "":
+		return &sshTarget{loginName: parts[0]}, nil
+	case len(parts) == 3 && parts[0] != "" && parts[1] != "" && parts[2] != "":
+		return &sshTarget{loginName: parts[0], podName: parts[1], containerName: parts[2]}, nil
+	default:
+		return nil, fmt.Errorf("invalid ssh user %q, expected <login name> or <login name>/<pod>/<container>", user)
+	}
+}
+
+// SSHServer serves the SSH clients with the sessions of the handler, authorized and audited as the websocket
+// sessions.
+type SSHServer struct {
+	handler *Handler
+	conf    SSHConfig
+	config  *ssh.ServerConfig
+}
+
+// NewSSHServer creates the SSH server of the handler.
+func (handler *Handler) NewSSHServer(c *SSHConfig) (*SSHServer, error) {
+	s := &SSHServer{handler: handler, conf: c.withDefaults()}
+
+	if s.conf.AuthorizedKeys == "" {
+		return nil, fmt.Errorf("authorized_keys of the ssh server is required")
+	}
+
+	s.config = &ssh.ServerConfig{PublicKeyCallback: s.authenticate}
+
+	// Only the approved algorithms are negotiated in FIPS mode.
+	if fips.Enabled() {
+		s.config.Ciphers = []string{"aes128-gcm@openssh.com", "aes256-gcm@openssh.com", "aes128-ctr", "aes256-ctr"}
+		s.config.KeyExchanges = []string{"ecdh-sha2-nistp256", "ecdh-sha2-nistp384"}
+		s.config.MACs = []string{"hmac-sha2-256-etm@openssh.com", "hmac-sha2-512-etm@openssh.com", "hmac-sha2-256", "hmac-sha2-512"}
+		s.config.PublicKeyAuthAlgorithms = []string{ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSASHA512, ssh.KeyAlgoECDSA256, ssh.KeyAlgoECDSA384}
+	}
+
+	if len(s.conf.HostKeys) == 0 {
+		return nil, fmt.Errorf("host_keys of the ssh server are required")
+	}
+
+	for _, path := range s.conf.HostKeys {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("read ssh host key error: %v", err)
+		}
+
+		signer, err := ssh.ParsePrivateKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("parse ssh host key %s error: %v", path, err)
+		}
+
+		if fips.Enabled() && signer.PublicKey().Type() != ssh.KeyAlgoRSA && !strings.HasPrefix(signer.PublicKey().Type(), "ecdsa-") {
+			return nil, fmt.Errorf("ssh host key %s of type %s isn't approved in FIPS mode", path, signer.PublicKey().Type())
+		}
+
+		s.config.AddHostKey(signer)
+	}
+
+	return s, nil
+}
+
+// Addr returns the address the SSH server listens on.
+func (s *SSHServer) Addr() string {
+	return s.conf.Addr
+}
+
+// Serve serves the SSH connections accepted by the listener until it fails.
+func (s *SSHServer) Serve(ln net.Listener) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+
+		monitor.Go("ssh_conn", func() {
+			s.serveConn(conn)
+		})
+	}
+}
+
+// authenticate authenticates the client by its public key in the authorized keys, the comment of the key is the
+// user.
+func (s *SSHServer) authenticate(meta ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+	if _, err := parseSSHUser(meta.User()); err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(s.conf.AuthorizedKeys)
+	if err != nil {
+		logger.Errorf("read ssh authorized keys error: %v", err)
+
+		return nil, fmt.Errorf("no authorized keys")
+	}
+
+	for len(data) > 0 {
+		authorized, comment, options, rest, err := ssh.ParseAuthorizedKey(data)
+		if err != nil {
+			break
+		}
+
+		data = rest
+
+		if comment == "" || !bytes.Equal(authorized.Marshal(), key.Marshal()) {
+			continue
+		}
+
+		perms := &ssh.Permissions{Extensions: map[string]string{sshPermUser: comment}}
+
+		for _, option := range options {
+			if tenant, ok := strings.CutPrefix(option, sshPermTenant+"="); ok {
+				perms.Extensions[sshPermTenant] = strings.Trim(tenant, `"`)
+			}
+		}
+
+		return perms, nil
+	}
+
+	return nil, fmt.Errorf("unknown public key for %s", meta.User())
+}
+
+// serveConn serves the session channels of the SSH connection.
+func (s *SSHServer) serveConn(conn net.Conn) {
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(sshHandshakeTimeout))
+
+	sshConn, channels, requests, err := ssh.NewServerConn(conn, s.config)
+	if err != nil {
+		logger.Warnf("ssh handshake from %s error: %v", conn.RemoteAddr(), err)
+
+		return
+	}
+	defer sshConn.Close()
+
+	conn.SetDeadline(time.Time{})
+
+	go ssh.DiscardRequests(requests)
+
+	// closed is closed once the client disconnects, which terminates its sessions.
+	closed := make(chan struct{})
+
+	go func() {
+		sshConn.Wait()
+		close(closed)
+	}()
+
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "only session channels are supported")
+
+			continue
+		}
+
+		channel, channelRequests, err := newChannel.Accept()
+		if err != nil {
+			logger.Warnf("accept ssh channel error: %v", err)
+
+			continue
+		}
+
+		monitor.Go("ssh_session", func() {
+			defer channel.Close()
+
+			s.serveChannel(sshConn, channel, channelRequests, closed)
+		})
+	}
+}
+
+// sshPtyRequest is the payload of the pty-req request.
+type sshPtyRequest struct {
+	Term          string
+	Columns, Rows uint32
+	Width, Height uint32
+	Modes         string
+}
+
+// sshWindowChange is the payload of the window-change request.
+type sshWindowChange struct {
+	Columns, Rows uint32
+	Width, Height uint32
+}
+
+// serveChannel runs the session requested by the shell or the exec request of the channel.
+func (s *SSHServer) serveChannel(sshConn *ssh.ServerConn, channel ssh.Channel, requests <-chan *ssh.Request, closed <-chan struct{}) {
+	var (
+		pty *sshPtyRequest
+		env = make(map[string]string)
+		cmd []string
+	)
+
+	// Collect the terminal and the environment until the session is requested.
+	for cmd == nil {
+		req, ok := <-requests
+		if !ok {
+			return
+		}
+
+		ok = true
+
+		switch req.Type {
+		case "pty-req":
+			pty = &sshPtyRequest{}
+			if err := ssh.Unmarshal(req.Payload, pty); err != nil {
+				pty, ok = nil, false
+			}
+		case "env":
+			var kv struct{ Name, Value string }
+			if ok = ssh.Unmarshal(req.Payload, &kv) == nil; ok {
+				env[kv.Name] = kv.Value
+			}
+		case "shell":
+			cmd = []string{}
+		case "exec":
+			var exec struct{ Command string }
+			if ok = ssh.Unmarshal(req.Payload, &exec) == nil && exec.Command != ""; ok {
+				cmd = []string{exec.Command}
+			}
+		default:
+			// The subsystems, e.g. sftp, aren't supported, scp -O copies by exec instead.
+			ok = false
+		}
+
+		if req.WantReply {
+			req.Reply(ok, nil)
+		}
+	}
+
+	if pty != nil && pty.Term != "" {
+		env["TERM"] = pty.Term
+	}
+
+	sshSess := &sshSession{channel: channel}
+	exitCode := s.handleSession(sshConn, sshSess, cmd, env, pty, requests, closed)
+
+	if exitCode >= 0 {
+		channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{uint32(exitCode)}))
+	} else {
+		channel.SendRequest("exit-signal", false, ssh.Marshal(struct {
+			Signal     string
+			CoreDumped bool
+			Error      string
+			Lang       string
+		}{Signal: "KILL"}))
+	}
+}
+
+// handleSession authorizes, establishes and serves the session of the channel, and returns the exit code of the
+// command, sshFailureExitCode if the session isn't established, or -1 if the command is terminated.
+func (s *SSHServer) handleSession(sshConn *ssh.ServerConn, sshSess *sshSession, cmd []string, env map[string]string, pty *sshPtyRequest,
+	requests <-chan *ssh.Request, closed <-chan struct{}) int {
+	handler := s.handler
+	remoteAddr := sshConn.RemoteAddr().String()
+	correlationID := logutil.NewCorrelationID()
+	requestLogger := logger.WithField("request_from", remoteAddr).WithField(logutil.FieldCorrelationID, correlationID)
+
+	target, _ := parseSSHUser(sshConn.User())
+
+	requestInfo := &request.Info{
+		UserName:    sshConn.Permissions.Extensions[sshPermUser],
+		LoginName:   target.loginName,
+		TargetType:  client.TargetPhys,
+		Cmd:         cmd,
+		Shell:       client.ShellAuto,
+		Interactive: true,
+		Tty:         pty != nil,
+		AppName:     string(sshConn.ClientVersion()),
+		Env:         env,
+	}
+
+	if target.podName != "" {
+		requestInfo.TargetType = client.TargetContainer
+		requestInfo.PodName = target.podName
+		requestInfo.ContainerID = target.containerName
+		requestInfo.ContainerName = target.containerName
+	}
+
+	if err := handler.config.SessionConfig.checkCommandLength(requestInfo.Cmd); err != nil {
+		requestLogger.Warnln("SSH request invalid: ", err)
+		sshSess.notice("request error: " + err.Error())
+
+		return sshFailureExitCode
+	}
+
+	requestLogger.Infoln("SSH request info: ", requestInfo)
+
+	if handler.config.TenantConfig.Source != "" {
+		if _, err := handler.assignTenant(sshConn.Permissions.Extensions[sshPermTenant], "ssh key", requestInfo); err != nil {
+			requestLogger.Warnf("authorization failed: %v", err)
+			auditDenial(requestInfo, remoteAddr, "unknown_tenant", err.Error(), 0)
+			sshSess.notice("permission denied")
+
+			return sshFailureExitCode
+		}
+	}
+
+	if err := handler.tags.check(requestInfo.Tags); err != nil {
+		requestLogger.Warnf("authorization failed: %v", err)
+		auditDenial(requestInfo, remoteAddr, "tag_denied", err.Error(), 0)
+		sshSess.notice(err.Error())
+
+		return sshFailureExitCode
+	}
+
+	authz, ok := handler.authorize(requestLogger, requestInfo, remoteAddr)
+	if !ok {
+		sshSess.notice("permission denied")
+
+		return sshFailureExitCode
+	}
+
+	// The challenges of the auth handlers aren't relayed to the SSH clients.
+	if authz.mfa != nil {
+		auditDenial(requestInfo, remoteAddr, "mfa_unsupported", "MFA can't be answered over ssh", authz.latency)
+		sshSess.notice("MFA is required, use trust-tunnel-client instead")
+
+		return sshFailureExitCode
+	}
+
+	// Nobody can witness the SSH sessions, as they can't be observed.
+	if handler.config.ObserveConfig.dualControl(authz.sensitivity) {
+		auditDenial(requestInfo, remoteAddr, "dual_control_unsupported", "dual control can't be applied over ssh", authz.latency)
+		sshSess.notice("dual control is required, use trust-tunnel-client instead")
+
+		return sshFailureExitCode
+	}
+
+	constructAuditInfo(requestInfo, remoteAddr)
+
+	sessID := newSessionID()
+	if requestInfo.BreakGlass {
+		handler.alertBreakGlass(requestInfo, sessID, remoteAddr)
+		sshSess.notice(strings.ReplaceAll(handler.breakGlassBanner(), "\n", "\r\n"))
+	}
+
+	if notice := handler.config.SessionConfig.envNotice(requestInfo.Env); notice != "" {
+		sshSess.notice(notice)
+	}
+
+	sessConf := handler.newSessionConfig(requestInfo, sessID)
+	runtime := handler.runtimeLabel(sessConf)
+	requestLogger = requestLogger.WithField(logutil.FieldSessionID, sessID)
+	defer logutil.CloseSessionFile(sessID)
+
+	rec, err := handler.startRecording(requestLogger, requestInfo, sessID)
+	if err != nil {
+		errMsg := sessionutil.WrapErrorWithCode(err.Error())
+		requestLogger.Error(errMsg)
+		sshSess.notice("Establish session error: " + errMsg)
+
+		return sshFailureExitCode
+	}
+	defer rec.close()
+
+	sshSess.recording = rec
+	if pty != nil {
+		sshSess.resize(int(pty.Rows), int(pty.Columns))
+	}
+
+	// The window changes are applied once the session is established.
+	monitor.Go("ssh_requests", func() {
+		sshSess.processRequests(requests)
+	})
+
+	if err = handler.checkSidecarQuota(requestLogger, make(map[string][]string), sessConf, sessID, runtime); err != nil {
+		sshSess.notice("Establish session error: " + err.Error())
+
+		return sshFailureExitCode
+	}
+
+	sess, isSidecarSession, err := handler.establishSession(requestLogger, sessConf, sessID, runtime)
+	if err != nil {
+		sshSess.notice("Establish session error: " + err.Error())
+
+		return sshFailureExitCode
+	}
+
+	if rec != nil {
+		requestInfo.Recording = rec.path
+	}
+
+	handler.tags.count(requestInfo.Tags, sessID)
+	notifyStart(requestInfo, sessID, remoteAddr)
+
+	cmdLogger := createCmdLogger(requestLogger, requestInfo)
+	defer cmdLogger.Destroy()
+
+	sshSess.attach(sess)
+	exitCode, reason := sshSess.serve(cmdLogger, handler.config.SessionConfig.MaxDuration, closed)
+
+	handler.lock.Lock()
+	if err = handler.releaseSession(sessID, sess); err == nil && isSidecarSession {
+		handler.sidecars.release(sessConf.ContainerID)
+	}
+	handler.lock.Unlock()
+
+	recordTermination(requestLogger, requestInfo, sess, sessID, runtime, reason)
+
+	return exitCode
+}
+
+// sshSession streams a session over an SSH channel.
+type sshSession struct {
+	terminal
+
+	channel ssh.Channel
+}
+
+// notice writes the message to the stderr of the client.
+func (sshSess *sshSession) notice(msg string) {
+	fmt.Fprintf(sshSess.channel.Stderr(), "%s\r\n", msg)
+}
+
+// attach attaches the established session, applying the terminal size requested meanwhile.
+func (sshSess *sshSession) attach(sess agentSession.Session) {
+	sshSess.sizeLock.Lock()
+	sshSess.sess = sess
+	sshSess.sizeLock.Unlock()
+
+	sshSess.applySize()
+}
+
+// processRequests applies the window changes of the client until the channel is closed.
+func (sshSess *sshSession) processRequests(requests <-chan *ssh.Request) {
+	for req := range requests {
+		ok := false
+
+		if req.Type == "window-change" {
+			var size sshWindowChange
+			if ok = ssh.Unmarshal(req.Payload, &size) == nil; ok && size.Rows > 0 && size.Columns > 0 {
+				sshSess.resize(int(size.Rows), int(size.Columns))
+			}
+		}
+
+		if req.WantReply {
+			req.Reply(ok, nil)
+		}
+	}
+}
+
+// serve streams the session until the command exits, the client disconnects or the session lasts for
+// maxDuration, and returns the exit code of the command and why the session is terminated.
+func (sshSess *sshSession) serve(cmdLogger io.Writer, maxDuration time.Duration, closed <-chan struct{}) (int, client.TerminationReason) {
+	stdoutCh := make(chan error, 1)
+	stderrCh := make(chan error, 1)
+
+	monitor.Go("ssh_input", func() {
+		sshSess.processInput(cmdLogger)
+	})
+	monitor.Go("ssh_output", func() {
+		stdoutCh <- sshSess.processOutput(sshSess.channel, sshSess.sess.NextStdout, sshSess.sess.StdoutDone)
+	})
+	monitor.Go("ssh_output", func() {
+		stderrCh <- sshSess.processOutput(sshSess.channel.Stderr(), sshSess.sess.NextStderr, sshSess.sess.StderrDone)
+	})
+
+	var timeout <-chan time.Time
+
+	if maxDuration > 0 {
+		timer := time.NewTimer(maxDuration)
+		defer timer.Stop()
+
+		timeout = timer.C
+	}
+
+	var reason client.TerminationReason
+
+	// The exit code is available once the output is drained.
+	for stdoutCh != nil || stderrCh != nil {
+		select {
+		case err := <-stdoutCh:
+			stdoutCh = nil
+
+			if err != nil {
+				reason = client.TerminationRuntimeFailure
+			}
+		case err := <-stderrCh:
+			stderrCh = nil
+
+			if err != nil {
+				reason = client.TerminationRuntimeFailure
+			}
+		case <-timeout:
+			reason = client.TerminationMaxDuration
+			sshSess.notice("\r\n[trust-tunnel] session terminated for max-duration")
+		case <-closed:
+			reason = client.TerminationDisconnected
+		}
+
+		if reason != "" {
+			return -1, reason
+		}
+	}
+
+	exitCode := sshSess.sess.ExitCode()
+	if reporter, ok := sshSess.sess.(agentSession.OOMReporter); ok && exitCode != 0 && reporter.OOMKilled() {
+		return exitCode, client.TerminationOOM
+	}
+
+	return exitCode, client.TerminationExited
+}
+
+// processOutput writes the output of the stream to the client until it ends.
+func (sshSess *sshSession) processOutput(w io.Writer, next func() (io.Reader, error), done func() error) error {
+	defer done()
+
+	for {
+		reader, err := next()
+		if err == io.EOF {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if reader == nil {
+			continue
+		}
+
+		// The terminal is ready once the command writes output.
+		sshSess.applySize()
+
+		// The output of both stdout and stderr is recorded as the terminal shows them.
+		if sshSess.recording != nil {
+			reader = io.TeeReader(reader, sshSess.recording.recorder.Output())
+		}
+
+		if _, err = io.Copy(w, reader); err != nil {
+			return fmt.Errorf("write output to ssh client error: %v", err)
+		}
+	}
+}
+
+// processInput passes the input of the client to the session, and closes the stdin of the command once the input
+// ends.
+func (sshSess *sshSession) processInput(cmdLogger io.Writer) {
+	buf := make([]byte, agentSession.DefaultFrameSize)
+
+	for {
+		n, err := sshSess.channel.Read(buf)
+		if n > 0 {
+			if writeErr := sshSess.writeStdin(cmdLogger, buf[:n]); writeErr != nil {
+				logger.Warnf("write stdin of ssh session error: %v", writeErr)
+
+				return
+			}
+		}
+
+		if errors.Is(err, io.EOF) {
+			if err = sshSess.sess.CloseStdin(); err != nil {
+				logger.Warnf("close cmd's stdin error: %v", err)
+			}
+
+			return
+		}
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+// writeStdin writes the input to the stdin of the session, logging it as commands.
+func (sshSess *sshSession) writeStdin(cmdLogger io.Writer, input []byte) error {
+	stdin, err := sshSess.sess.NextStdin()
+	if err != nil {
+		return err
+	}
+
+	cmdLogger.Write(input)
+
+	if sshSess.recording != nil && sshSess.recording.input {
+		sshSess.recording.recorder.Input().Write(input)
+	}
+
+	_, err = stdin.Write(input)
+
+	return err
+}
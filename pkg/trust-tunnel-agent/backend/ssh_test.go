@@ -0,0 +1,159 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	client "trust-tunnel/pkg/trust-tunnel-client"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestParseSSHUser(t *testing.T) {
+	for user, want := range map[string]*sshTarget{
+		"root":             {loginName: "root"},
+		"root/web-0/nginx": {loginName: "root", podName: "web-0", containerName: "nginx"},
+		"":                 nil,
+		"root/web-0":       nil,
+		"root//nginx":      nil,
+	} {
+		target, err := parseSSHUser(user)
+		if want == nil {
+			if err == nil {
+				t.Errorf("expected error for %q", user)
+			}
+
+			continue
+		}
+
+		if err != nil || *target != *want {
+			t.Errorf("unexpected target of %q: %+v, %v", user, target, err)
+		}
+	}
+}
+
+// fakeConnMetadata is the metadata of an SSH connection of the user.
+type fakeConnMetadata struct {
+	ssh.ConnMetadata
+
+	user string
+}
+
+func (m fakeConnMetadata) User() string { return m.user }
+
+func newSSHPublicKey(t *testing.T) ssh.PublicKey {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pub, err := ssh.NewPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return pub
+}
+
+func TestSSHAuthenticate(t *testing.T) {
+	alice, bob, eve := newSSHPublicKey(t), newSSHPublicKey(t), newSSHPublicKey(t)
+
+	path := filepath.Join(t.TempDir(), "authorized_keys")
+	keys := "# users\n" +
+		`tenant="payments" ` + strings.TrimSpace(string(ssh.MarshalAuthorizedKey(alice))) + " alice\n" +
+		strings.TrimSpace(string(ssh.MarshalAuthorizedKey(bob))) + " bob\n"
+
+	if err := os.WriteFile(path, []byte(keys), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &SSHServer{conf: SSHConfig{AuthorizedKeys: path}}
+
+	perms, err := s.authenticate(fakeConnMetadata{user: "root/web-0/nginx"}, alice)
+	if err != nil || perms.Extensions[sshPermUser] != "alice" || perms.Extensions[sshPermTenant] != "payments" {
+		t.Errorf("unexpected permissions of alice: %+v, %v", perms, err)
+	}
+
+	perms, err = s.authenticate(fakeConnMetadata{user: "root"}, bob)
+	if err != nil || perms.Extensions[sshPermUser] != "bob" || perms.Extensions[sshPermTenant] != "" {
+		t.Errorf("unexpected permissions of bob: %+v, %v", perms, err)
+	}
+
+	if _, err = s.authenticate(fakeConnMetadata{user: "root"}, eve); err == nil {
+		t.Error("expected unknown key to be refused")
+	}
+
+	if _, err = s.authenticate(fakeConnMetadata{user: "root/web-0"}, alice); err == nil {
+		t.Error("expected invalid user to be refused")
+	}
+}
+
+// fakeChannel is an SSH channel whose input is given, and whose output is collected.
+type fakeChannel struct {
+	io.Reader
+
+	stdout, stderr bytes.Buffer
+}
+
+func (c *fakeChannel) Write(p []byte) (int, error) { return c.stdout.Write(p) }
+func (c *fakeChannel) Close() error                { return nil }
+func (c *fakeChannel) CloseWrite() error           { return nil }
+func (c *fakeChannel) Stderr() io.ReadWriter       { return &c.stderr }
+func (c *fakeChannel) SendRequest(string, bool, []byte) (bool, error) {
+	return true, nil
+}
+
+func TestSSHSessionServe(t *testing.T) {
+	channel := &fakeChannel{Reader: strings.NewReader("hello world")}
+	sshSess := &sshSession{channel: channel}
+	sshSess.attach(newFakeSession())
+
+	// The stdin is echoed by the session, which exits once the stdin ends.
+	exitCode, reason := sshSess.serve(io.Discard, time.Minute, nil)
+	if exitCode != 3 || reason != client.TerminationExited {
+		t.Fatalf("unexpected exit code %d, reason %s", exitCode, reason)
+	}
+
+	if channel.stdout.String() != "hello world" || channel.stderr.String() != "err" {
+		t.Errorf("unexpected output %q, %q", channel.stdout.String(), channel.stderr.String())
+	}
+
+	// The session is terminated once the client disconnects.
+	closed := make(chan struct{})
+	close(closed)
+
+	input, inputWriter := io.Pipe()
+	defer inputWriter.Close()
+
+	sess := newFakeSession()
+	sshSess = &sshSession{channel: &fakeChannel{Reader: input}, terminal: terminal{sess: sess}}
+
+	exitCode, reason = sshSess.serve(io.Discard, time.Minute, closed)
+	sess.Clean()
+
+	if exitCode != -1 || reason != client.TerminationDisconnected {
+		t.Errorf("unexpected exit code %d, reason %s", exitCode, reason)
+	}
+}
@@ -0,0 +1,199 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"sync"
+	"trust-tunnel/pkg/trust-tunnel-agent/monitor"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	defaultTagMaxTags        = 8
+	defaultTagMaxValueLength = 128
+	defaultTagMetricValues   = 50
+
+	// otherTagValue is the metric label of the values of a metric key beyond the limit of its distinct values.
+	otherTagValue = "other"
+)
+
+// tagKeyPattern is the syntax of the keys of the tags.
+var tagKeyPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_.-]{0,62}$`)
+
+// TagConfig specifies the policy of the session tags, the key/value pairs attached by the clients, e.g.
+// incident=INC-1234, which are carried into the audit logs, the command logs and the metrics.
+type TagConfig struct {
+	// Allowed are the keys of the tags accepted, all the keys are accepted if it's empty.
+	Allowed []string `toml:"allowed"`
+
+	// Required are the keys of the tags every session must carry, e.g. the incident or the change ticket.
+	Required []string `toml:"required"`
+
+	// Patterns are the regular expressions the values of the keys must match, e.g. incident = "^INC-[0-9]+$".
+	Patterns map[string]string `toml:"patterns"`
+
+	// MaxTags is the maximum number of the tags of a session, defaults to 8.
+	MaxTags int `toml:"max_tags"`
+
+	// MaxValueLength is the maximum length of the values, defaults to 128.
+	MaxValueLength int `toml:"max_value_length"`
+
+	// MetricKeys are the keys of the tags labeled in the session_tags_total metric.
+	MetricKeys []string `toml:"metric_keys"`
+
+	// MetricValues is the maximum number of the distinct values labeled for each metric key, the others are
+	// labeled as "other" to bound the cardinality. Defaults to 50.
+	MetricValues int `toml:"metric_values"`
+}
+
+// withDefaults returns the configuration with the defaults filled in.
+func (c TagConfig) withDefaults() TagConfig {
+	if c.MaxTags <= 0 {
+		c.MaxTags = defaultTagMaxTags
+	}
+
+	if c.MaxValueLength <= 0 {
+		c.MaxValueLength = defaultTagMaxValueLength
+	}
+
+	if c.MetricValues <= 0 {
+		c.MetricValues = defaultTagMetricValues
+	}
+
+	return c
+}
+
+// tagPolicy checks the tags of the sessions against the configuration, and counts them in the metrics.
+type tagPolicy struct {
+	config   TagConfig
+	patterns map[string]*regexp.Regexp
+
+	lock sync.Mutex
+	// metricValues are the values labeled so far by the metric keys.
+	metricValues map[string]map[string]struct{}
+}
+
+// newTagPolicy creates the tag policy, the patterns must be valid regular expressions.
+func newTagPolicy(c *TagConfig) (*tagPolicy, error) {
+	p := &tagPolicy{
+		config:       c.withDefaults(),
+		patterns:     make(map[string]*regexp.Regexp, len(c.Patterns)),
+		metricValues: make(map[string]map[string]struct{}, len(c.MetricKeys)),
+	}
+
+	for key, pattern := range c.Patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern of tag %s: %v", key, err)
+		}
+
+		p.patterns[key] = re
+	}
+
+	for _, key := range c.MetricKeys {
+		p.metricValues[key] = make(map[string]struct{})
+	}
+
+	return p, nil
+}
+
+// check checks if the tags are allowed.
+func (p *tagPolicy) check(tags map[string]string) error {
+	if len(tags) > p.config.MaxTags {
+		return fmt.Errorf("too many tags: %d, at most %d", len(tags), p.config.MaxTags)
+	}
+
+	for key, value := range tags {
+		if !tagKeyPattern.MatchString(key) {
+			return fmt.Errorf("invalid tag key: %q", key)
+		}
+
+		if len(p.config.Allowed) > 0 && !slices.Contains(p.config.Allowed, key) {
+			return fmt.Errorf("tag %s isn't allowed", key)
+		}
+
+		if len(value) > p.config.MaxValueLength {
+			return fmt.Errorf("value of tag %s is longer than %d", key, p.config.MaxValueLength)
+		}
+
+		if !printable(value) {
+			return fmt.Errorf("value of tag %s isn't printable", key)
+		}
+
+		if re, ok := p.patterns[key]; ok && !re.MatchString(value) {
+			return fmt.Errorf("value of tag %s doesn't match %s", key, re)
+		}
+	}
+
+	for _, key := range p.config.Required {
+		if _, ok := tags[key]; !ok {
+			return fmt.Errorf("tag %s is required", key)
+		}
+	}
+
+	return nil
+}
+
+// count counts the established session in the metrics by the tags of the metric keys.
+func (p *tagPolicy) count(tags map[string]string, sessID string) {
+	for key, value := range tags {
+		if value, ok := p.metricValue(key, value); ok {
+			monitor.IncWithSessionID(monitor.MetricsSessionTags.WithLabelValues(key, value), sessID)
+		}
+	}
+}
+
+// metricValue returns the metric label of the value, it's false if the key isn't a metric key.
+// The first distinct values of the key are labeled as they are, and the others as "other".
+func (p *tagPolicy) metricValue(key, value string) (string, bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	values, ok := p.metricValues[key]
+	if !ok {
+		return "", false
+	}
+
+	if _, ok = values[value]; ok {
+		return value, true
+	}
+
+	if len(values) >= p.config.MetricValues {
+		return otherTagValue, true
+	}
+
+	values[value] = struct{}{}
+
+	return value, true
+}
+
+// printable returns whether the value is valid UTF-8 without control characters.
+func printable(value string) bool {
+	if !utf8.ValidString(value) {
+		return false
+	}
+
+	for _, r := range value {
+		if !unicode.IsPrint(r) {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,69 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTagPolicy(t *testing.T) {
+	p, err := newTagPolicy(&TagConfig{
+		Allowed:      []string{"incident", "team"},
+		Required:     []string{"incident"},
+		Patterns:     map[string]string{"incident": "^INC-[0-9]+$"},
+		MetricKeys:   []string{"team"},
+		MetricValues: 2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = p.check(map[string]string{"incident": "INC-1234", "team": "db"}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	for _, tags := range []map[string]string{
+		{"team": "db"},
+		{"incident": "1234"},
+		{"incident": "INC-1234", "owner": "alice"},
+		{"incident": "INC-1234", "team": "db\n"},
+		{"incident": "INC-1234", "team": strings.Repeat("x", 129)},
+	} {
+		if err = p.check(tags); err == nil {
+			t.Errorf("tags %v should be refused", tags)
+		}
+	}
+
+	if _, err = newTagPolicy(&TagConfig{Patterns: map[string]string{"incident": "("}}); err == nil {
+		t.Error("invalid pattern should be refused")
+	}
+
+	// The values beyond the limit of the metric key are labeled as other.
+	for _, c := range []struct {
+		key, value, label string
+		ok                bool
+	}{
+		{"team", "db", "db", true},
+		{"team", "web", "web", true},
+		{"team", "db", "db", true},
+		{"team", "infra", "other", true},
+		{"incident", "INC-1234", "", false},
+	} {
+		if label, ok := p.metricValue(c.key, c.value); label != c.label || ok != c.ok {
+			t.Errorf("%s=%s: expected %q %v, got %q %v", c.key, c.value, c.label, c.ok, label, ok)
+		}
+	}
+}
@@ -0,0 +1,234 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"trust-tunnel/pkg/common/logutil"
+	"trust-tunnel/pkg/trust-tunnel-agent/auth"
+	"trust-tunnel/pkg/trust-tunnel-agent/backend/request"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Sources identifying the tenant of requests.
+const (
+	// TenantFromHeader identifies the tenant by a request header, which is only accepted from the trusted proxies.
+	TenantFromHeader = "header"
+	// TenantFromCertOU identifies the tenant by the organizational unit of the client certificate.
+	TenantFromCertOU = "cert_ou"
+
+	defaultTenantHeader = "Tenant"
+)
+
+// TenantConfig specifies serving multiple tenants with isolated policies on a shared node pool.
+type TenantConfig struct {
+	// Source identifies the tenant of requests, "header" or "cert_ou". Tenants are disabled if it's empty.
+	Source string `toml:"source"`
+
+	// Header is the request header carrying the tenant with the "header" source, "Tenant" by default.
+	Header string `toml:"header"`
+
+	// TrustedProxies are the common names of the verified client certificates of the proxies setting the header
+	// with the "header" source, the header of the other clients is refused. The jump agents in cert_proxies of
+	// auth_config are trusted as well.
+	TrustedProxies []string `toml:"trusted_proxies"`
+
+	// Strict refuses the requests of unknown tenants, otherwise they're served with the agent-wide policies.
+	Strict bool `toml:"strict"`
+
+	// Tenants are the policies of the tenants.
+	Tenants []Tenant `toml:"tenants"`
+}
+
+// Tenant specifies the policies of a tenant, the agent-wide ones are used for those left empty.
+type Tenant struct {
+	Name string `toml:"name"`
+
+	// AuthHandler and AuthParams specify the auth handler of the tenant, cached as the agent-wide one.
+	AuthHandler string            `toml:"auth_handler"`
+	AuthParams  map[string]string `toml:"auth_params"`
+
+	// SidecarImage is the sidecar image of the tenant's sessions.
+	SidecarImage string `toml:"sidecar_image"`
+
+	// MaxCpus and MaxMemoryMB cap the resources of the tenant's sessions.
+	MaxCpus     float64 `toml:"max_cpus"`
+	MaxMemoryMB int     `toml:"max_memory_mb"`
+
+	// AuditLog is the log the tenant's audit logs are written into, e.g. "trust-tunnel-audit-payments".
+	AuditLog string `toml:"audit_log"`
+}
+
+// tenant is a configured tenant with its auth handler.
+type tenant struct {
+	config      *Tenant
+	authHandler auth.Handler
+}
+
+// tenantAuditLoggers are the audit loggers of the tenants with their own audit logs, set up with the handler.
+var tenantAuditLoggers = make(map[string]*logrus.Logger)
+
+// newTenants creates the configured tenants.
+func newTenants(c *TenantConfig, authConfig *auth.Config) (map[string]*tenant, error) {
+	switch c.Source {
+	case "":
+		return nil, nil
+	case TenantFromHeader, TenantFromCertOU:
+	default:
+		return nil, fmt.Errorf("unknown tenant source %q, header or cert_ou is supported", c.Source)
+	}
+
+	tenants := make(map[string]*tenant, len(c.Tenants))
+
+	for i := range c.Tenants {
+		config := &c.Tenants[i]
+		if config.Name == "" {
+			return nil, fmt.Errorf("tenant name is required")
+		}
+
+		if _, ok := tenants[config.Name]; ok {
+			return nil, fmt.Errorf("duplicate tenant %s", config.Name)
+		}
+
+		t := &tenant{config: config}
+
+		if config.AuthHandler != "" {
+			handler, err := auth.CreateAuthHandlerFromConfig(auth.Config{
+				Name:   config.AuthHandler,
+				Params: config.AuthParams,
+				Cache:  authConfig.Cache,
+			})
+			if err != nil {
+				return nil, fmt.Errorf("create auth handler of tenant %s: %v", config.Name, err)
+			}
+
+			t.authHandler = handler
+		}
+
+		if config.AuditLog != "" {
+			tenantAuditLoggers[config.Name] = logutil.GetAuditLogger(config.AuditLog)
+		}
+
+		tenants[config.Name] = t
+	}
+
+	return tenants, nil
+}
+
+// identifyTenant identifies the tenant of the request. A nil tenant is returned if tenants are disabled,
+// or if the tenant is unknown and the mode isn't strict, which is served with the agent-wide policies.
+func (handler *Handler) identifyTenant(r *http.Request, info *request.Info) (*tenant, error) {
+	c := &handler.config.TenantConfig
+	if c.Source == "" {
+		return nil, nil
+	}
+
+	var name string
+
+	switch c.Source {
+	case TenantFromHeader:
+		header := c.Header
+		if header == "" {
+			header = defaultTenantHeader
+		}
+
+		name = r.Header.Get(header)
+		if name != "" && !handler.trustedProxy(r) {
+			return nil, fmt.Errorf("tenant header %s isn't set by a trusted proxy", header)
+		}
+	case TenantFromCertOU:
+		if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 && len(r.TLS.PeerCertificates[0].Subject.OrganizationalUnit) > 0 {
+			name = r.TLS.PeerCertificates[0].Subject.OrganizationalUnit[0]
+		}
+	}
+
+	return handler.assignTenant(name, c.Source, info)
+}
+
+// trustedProxy returns whether the request is sent by a trusted proxy, identified by its verified client certificate.
+func (handler *Handler) trustedProxy(r *http.Request) bool {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return false
+	}
+
+	name := r.TLS.VerifiedChains[0][0].Subject.CommonName
+
+	return slices.Contains(handler.config.TenantConfig.TrustedProxies, name) ||
+		slices.Contains(handler.config.AuthConfig.CertProxies, name)
+}
+
+// assignTenant assigns the request to the tenant of the name given by the source, refusing the unknown tenants in
+// strict mode.
+func (handler *Handler) assignTenant(name, source string, info *request.Info) (*tenant, error) {
+	info.Tenant = name
+
+	t, ok := handler.tenants[name]
+	if !ok && handler.config.TenantConfig.Strict {
+		if name == "" {
+			return nil, fmt.Errorf("tenant isn't given by %s", source)
+		}
+
+		return nil, fmt.Errorf("unknown tenant %s", name)
+	}
+
+	t.capResources(info)
+
+	return t, nil
+}
+
+// capResources caps the resources requested by the tenant's sessions.
+func (t *tenant) capResources(info *request.Info) {
+	if t == nil {
+		return
+	}
+
+	if t.config.MaxCpus > 0 && (info.Cpus <= 0 || info.Cpus > t.config.MaxCpus) {
+		info.Cpus = t.config.MaxCpus
+	}
+
+	if t.config.MaxMemoryMB > 0 && (info.MemoryMB <= 0 || info.MemoryMB > t.config.MaxMemoryMB) {
+		info.MemoryMB = t.config.MaxMemoryMB
+	}
+}
+
+// authHandlerOf returns the auth handler of the request's tenant, the agent-wide one if the tenant has none.
+func (handler *Handler) authHandlerOf(info *request.Info) auth.Handler {
+	if t, ok := handler.tenants[info.Tenant]; ok && t.authHandler != nil {
+		return t.authHandler
+	}
+
+	return handler.authHandler
+}
+
+// sidecarImageOf returns the sidecar image of the request's tenant, the agent-wide one if the tenant has none.
+func (handler *Handler) sidecarImageOf(info *request.Info) string {
+	if t, ok := handler.tenants[info.Tenant]; ok && t.config.SidecarImage != "" {
+		return t.config.SidecarImage
+	}
+
+	return handler.config.SidecarConfig.Image
+}
+
+// auditLoggerOf returns the audit logger of the tenant, the agent-wide one if the tenant has none.
+func auditLoggerOf(tenant string) *logrus.Logger {
+	if l, ok := tenantAuditLoggers[tenant]; ok {
+		return l
+	}
+
+	return auditLogger
+}
@@ -0,0 +1,119 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http/httptest"
+	"testing"
+	"trust-tunnel/pkg/trust-tunnel-agent/backend/request"
+)
+
+func TestIdentifyTenant(t *testing.T) {
+	config := &Config{
+		TenantConfig: TenantConfig{
+			Source: TenantFromCertOU,
+			Strict: true,
+			Tenants: []Tenant{
+				{Name: "payments", SidecarImage: "payments-sidecar:latest", MaxCpus: 2, MaxMemoryMB: 1024},
+				{Name: "search"},
+			},
+		},
+	}
+	config.SidecarConfig.Image = "trust-tunnel-sidecar:latest"
+
+	tenants, err := newTenants(&config.TenantConfig, &config.AuthConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tenants["payments"].authHandler = totpAuthHandler{}
+	handler := &Handler{config: config, tenants: tenants}
+
+	identify := func(ou ...string) *request.Info {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{{Subject: pkix.Name{OrganizationalUnit: ou}}}}
+		info := &request.Info{Cpus: 4, MemoryMB: 512}
+
+		if _, err := handler.identifyTenant(r, info); err != nil {
+			return nil
+		}
+
+		return info
+	}
+
+	info := identify("payments")
+	if info == nil || info.Tenant != "payments" || info.Cpus != 2 || info.MemoryMB != 512 {
+		t.Fatalf("unexpected request of payments %+v", info)
+	}
+
+	if _, ok := handler.authHandlerOf(info).(totpAuthHandler); !ok || handler.sidecarImageOf(info) != "payments-sidecar:latest" {
+		t.Error("the policies of payments should be applied")
+	}
+
+	info = identify("search")
+	if info == nil || info.Cpus != 4 || handler.authHandlerOf(info) != nil || handler.sidecarImageOf(info) != "trust-tunnel-sidecar:latest" {
+		t.Errorf("the agent-wide policies should be applied to search, got %+v", info)
+	}
+
+	if identify("unknown") != nil || identify() != nil {
+		t.Error("unknown tenants should be refused in strict mode")
+	}
+
+	config.TenantConfig.Strict = false
+	if info = identify("unknown"); info == nil || info.Tenant != "unknown" || info.Cpus != 4 {
+		t.Errorf("unknown tenants should be served with the agent-wide policies, got %+v", info)
+	}
+}
+
+func TestIdentifyTenantByHeader(t *testing.T) {
+	config := &Config{TenantConfig: TenantConfig{
+		Source:         TenantFromHeader,
+		TrustedProxies: []string{"gateway"},
+		Tenants:        []Tenant{{Name: "payments"}},
+	}}
+	config.AuthConfig.CertProxies = []string{"jump"}
+	handler := &Handler{config: config, tenants: map[string]*tenant{"payments": {config: &config.TenantConfig.Tenants[0]}}}
+
+	identify := func(proxy string) (*request.Info, error) {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set(defaultTenantHeader, "payments")
+
+		if proxy != "" {
+			cert := &x509.Certificate{Subject: pkix.Name{CommonName: proxy}}
+			r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}, VerifiedChains: [][]*x509.Certificate{{cert}}}
+		}
+
+		info := &request.Info{}
+		_, err := handler.identifyTenant(r, info)
+
+		return info, err
+	}
+
+	// The header is only accepted from the trusted proxies and the jump agents.
+	for _, proxy := range []string{"gateway", "jump"} {
+		if info, err := identify(proxy); err != nil || info.Tenant != "payments" {
+			t.Errorf("the tenant set by %s should be accepted, got %+v, %v", proxy, info, err)
+		}
+	}
+
+	for _, proxy := range []string{"alice", ""} {
+		if _, err := identify(proxy); err == nil {
+			t.Errorf("the tenant set by %q should be refused", proxy)
+		}
+	}
+}
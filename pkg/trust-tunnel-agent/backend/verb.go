@@ -0,0 +1,93 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"fmt"
+	"trust-tunnel/pkg/trust-tunnel-agent/backend/request"
+	agentSession "trust-tunnel/pkg/trust-tunnel-agent/session"
+
+	client "trust-tunnel/pkg/trust-tunnel-client"
+)
+
+// VerbConfig specifies the verbs, the operations run natively by the agent, each authorized with its own scope,
+// so that they can be granted without granting shell access.
+type VerbConfig struct {
+	// Enabled specifies whether to serve the verbs.
+	Enabled bool `toml:"enabled"`
+
+	// Allowed are the names of the verbs served, all the registered verbs are served if it's empty.
+	Allowed []string `toml:"allowed"`
+
+	// Cache specifies caching the results of the idempotent verbs run by POST /run.
+	Cache VerbCacheConfig `toml:"cache"`
+}
+
+// checkVerb checks if the verb is served, and returns its auth scope.
+func (c *VerbConfig) checkVerb(name string) (string, error) {
+	if !c.Enabled {
+		return "", fmt.Errorf("verbs are disabled")
+	}
+
+	verb, ok := agentSession.LookupVerb(name)
+	if !ok {
+		return "", fmt.Errorf("unknown verb: %s", name)
+	}
+
+	if len(c.Allowed) == 0 {
+		return verb.Scope(), nil
+	}
+
+	for _, allowed := range c.Allowed {
+		if allowed == name {
+			return verb.Scope(), nil
+		}
+	}
+
+	return "", fmt.Errorf("verb %s isn't allowed", name)
+}
+
+// resolveVerb sets the auth scope of the verb of the request, so that the auth handler authorizes it by the scope.
+// The top request is the built-in top verb, served even if the verbs are disabled.
+func (handler *Handler) resolveVerb(req *request.Info) error {
+	if req.Top {
+		verb, _ := agentSession.LookupVerb(agentSession.VerbTop)
+		req.VerbScope = verb.Scope()
+
+		return nil
+	}
+
+	if req.Verb == nil {
+		return nil
+	}
+
+	scope, err := handler.config.VerbConfig.checkVerb(req.Verb.Name)
+	if err != nil {
+		return err
+	}
+
+	req.VerbScope = scope
+
+	return nil
+}
+
+// sessionVerb returns the verb run by the session of the request, nil if it runs a command.
+func sessionVerb(req *request.Info) *client.VerbRequest {
+	if req.Top {
+		return &client.VerbRequest{Name: agentSession.VerbTop}
+	}
+
+	return req.Verb
+}
@@ -0,0 +1,222 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package backend
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+	"trust-tunnel/pkg/trust-tunnel-agent/backend/request"
+	"trust-tunnel/pkg/trust-tunnel-agent/monitor"
+	agentSession "trust-tunnel/pkg/trust-tunnel-agent/session"
+
+	client "trust-tunnel/pkg/trust-tunnel-client"
+)
+
+// defaultVerbCacheMaxEntries is the default maximum number of cached verb results.
+const defaultVerbCacheMaxEntries = 1000
+
+// VerbCacheConfig specifies caching the results of the idempotent verbs run by POST /run, e.g. for the dashboards
+// polling the same diagnostics, keyed by the target, the verb and its arguments. The requests are still authorized
+// and audited one by one, only the runs are shared.
+type VerbCacheConfig struct {
+	// TTL is how long the results are cached, they aren't cached if it's zero.
+	TTL time.Duration `toml:"ttl"`
+	// MaxEntries is the maximum number of cached results, defaults to 1000.
+	MaxEntries int `toml:"max_entries"`
+}
+
+// verbCacheKey identifies the runs of the same verb with the same arguments against the same target, as the same
+// login of the same tenant, since the output of the verbs may differ by the privileges of the login.
+type verbCacheKey struct {
+	tenant     string
+	loginName  string
+	loginGroup string
+	targetType client.TargetType
+	ipAddress  string
+	pod        string
+	container  string
+	verb       string
+	args       string
+}
+
+type verbCacheEntry struct {
+	// done is closed once the run is done, resp is nil if its result isn't cached.
+	done    chan struct{}
+	resp    *RunResponse
+	created time.Time
+	expires time.Time
+}
+
+// verbCache caches the results of the idempotent verbs, the requests arriving while the verb runs share its result.
+type verbCache struct {
+	config VerbCacheConfig
+
+	lock    sync.Mutex
+	entries map[verbCacheKey]*verbCacheEntry
+	// now returns the current time, it's replaced in tests.
+	now func() time.Time
+}
+
+// newVerbCache returns the cache of the verb results, or nil if it's disabled.
+func newVerbCache(config VerbCacheConfig) *verbCache {
+	if config.TTL <= 0 {
+		return nil
+	}
+
+	if config.MaxEntries <= 0 {
+		config.MaxEntries = defaultVerbCacheMaxEntries
+	}
+
+	return &verbCache{
+		config:  config,
+		entries: make(map[verbCacheKey]*verbCacheEntry),
+		now:     time.Now,
+	}
+}
+
+// key returns the key of the request, false if its result can't be cached, i.e. it doesn't run an idempotent verb
+// or the cache is disabled.
+func (c *verbCache) key(req *request.Info) (verbCacheKey, bool) {
+	if c == nil || req.Verb == nil {
+		return verbCacheKey{}, false
+	}
+
+	verb, ok := agentSession.LookupVerb(req.Verb.Name)
+	if !ok {
+		return verbCacheKey{}, false
+	}
+
+	if idempotent, ok := verb.(agentSession.IdempotentVerb); !ok || !idempotent.Idempotent() {
+		return verbCacheKey{}, false
+	}
+
+	return verbCacheKey{
+		tenant:     req.Tenant,
+		loginName:  req.LoginName,
+		loginGroup: req.LoginGroup,
+		targetType: req.TargetType,
+		ipAddress:  req.IPAddress,
+		pod:        req.PodName,
+		container:  req.ContainerID + "/" + req.ContainerName,
+		verb:       req.Verb.Name,
+		args:       strings.Join(req.Verb.Args, "\x00"),
+	}, true
+}
+
+// get returns the cached result of the key and its age, waiting for the run in flight if any. Otherwise it returns
+// a nil result and the function the caller must call with the result of its own run, which is nil if it fails to
+// run, so that it's shared with the other requests.
+func (c *verbCache) get(ctx context.Context, key verbCacheKey) (*RunResponse, time.Duration, func(*RunResponse)) {
+	c.lock.Lock()
+	entry, ok := c.entries[key]
+
+	if ok {
+		select {
+		case <-entry.done:
+			if now := c.now(); now.Before(entry.expires) {
+				c.lock.Unlock()
+				monitor.MetricsVerbCache.WithLabelValues("hit").Inc()
+
+				resp := *entry.resp
+
+				return &resp, now.Sub(entry.created), nil
+			}
+		default:
+			c.lock.Unlock()
+
+			select {
+			case <-entry.done:
+			case <-ctx.Done():
+			}
+
+			// The requests run the verb themselves if the result isn't cached.
+			if resp := entry.sharedResp(); resp != nil {
+				monitor.MetricsVerbCache.WithLabelValues("shared").Inc()
+
+				return resp, 0, nil
+			}
+
+			monitor.MetricsVerbCache.WithLabelValues("miss").Inc()
+
+			return nil, 0, func(*RunResponse) {}
+		}
+	}
+
+	entry = &verbCacheEntry{done: make(chan struct{})}
+	c.put(key, entry)
+	c.lock.Unlock()
+	monitor.MetricsVerbCache.WithLabelValues("miss").Inc()
+
+	return nil, 0, func(resp *RunResponse) {
+		c.lock.Lock()
+		defer c.lock.Unlock()
+
+		// Only the results of the verbs succeeded are cached, the failures may be transient.
+		if resp != nil && resp.Reason == client.TerminationExited && resp.ExitCode == 0 {
+			cached := *resp
+			entry.resp = &cached
+			entry.created = c.now()
+			entry.expires = entry.created.Add(c.config.TTL)
+		} else if c.entries[key] == entry {
+			delete(c.entries, key)
+		}
+
+		close(entry.done)
+	}
+}
+
+// sharedResp returns a copy of the result of the run done, nil if it isn't done or its result isn't cached.
+func (entry *verbCacheEntry) sharedResp() *RunResponse {
+	select {
+	case <-entry.done:
+	default:
+		return nil
+	}
+
+	if entry.resp == nil {
+		return nil
+	}
+
+	resp := *entry.resp
+
+	return &resp
+}
+
+// put caches the entry, making room by dropping the expired entries, or arbitrary ones done if none has expired.
+// It must be called with the lock held.
+func (c *verbCache) put(key verbCacheKey, entry *verbCacheEntry) {
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= c.config.MaxEntries {
+		now := c.now()
+
+		for k, e := range c.entries {
+			if e.resp != nil && !now.Before(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+
+		for k, e := range c.entries {
+			if len(c.entries) < c.config.MaxEntries {
+				break
+			}
+
+			if e.resp != nil {
+				delete(c.entries, k)
+			}
+		}
+	}
+
+	c.entries[key] = entry
+}
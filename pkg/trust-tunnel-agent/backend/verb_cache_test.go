@@ -0,0 +1,115 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package backend
+
+import (
+	"context"
+	"testing"
+	"time"
+	"trust-tunnel/pkg/trust-tunnel-agent/backend/request"
+	agentSession "trust-tunnel/pkg/trust-tunnel-agent/session"
+
+	client "trust-tunnel/pkg/trust-tunnel-client"
+)
+
+func TestVerbCacheKey(t *testing.T) {
+	if newVerbCache(VerbCacheConfig{}) != nil {
+		t.Fatalf("cache should be disabled without TTL")
+	}
+
+	c := newVerbCache(VerbCacheConfig{TTL: time.Second})
+
+	ps := &request.Info{PodName: "web-0", Verb: &client.VerbRequest{Name: agentSession.VerbPs, Args: []string{"a", "b"}}}
+	key, ok := c.key(ps)
+
+	if !ok {
+		t.Fatalf("ps should be cached")
+	}
+
+	// The arguments are told apart even if they join into the same string.
+	other := &request.Info{PodName: "web-0", Verb: &client.VerbRequest{Name: agentSession.VerbPs, Args: []string{"ab"}}}
+	if otherKey, _ := c.key(other); otherKey == key {
+		t.Errorf("keys of different arguments should differ")
+	}
+
+	// The logins on the same target don't share the results, nor do the tenants.
+	for _, req := range []*request.Info{
+		{PodName: "web-0", LoginName: "root", Verb: ps.Verb},
+		{PodName: "web-0", LoginGroup: "admin", Verb: ps.Verb},
+		{PodName: "web-0", Tenant: "team-a", Verb: ps.Verb},
+	} {
+		if otherKey, _ := c.key(req); otherKey == key {
+			t.Errorf("keys of %+v should differ from the one of %+v", req, ps)
+		}
+	}
+
+	for _, req := range []*request.Info{
+		{Cmd: []string{"ps"}},
+		{Verb: &client.VerbRequest{Name: agentSession.VerbFileRead, Args: []string{"/etc/hosts"}}},
+	} {
+		if _, ok = c.key(req); ok {
+			t.Errorf("%s shouldn't be cached", req)
+		}
+	}
+}
+
+func TestVerbCache(t *testing.T) {
+	c := newVerbCache(VerbCacheConfig{TTL: time.Second})
+	now := time.Now()
+	c.now = func() time.Time { return now }
+
+	key := verbCacheKey{verb: agentSession.VerbPs}
+
+	resp, _, fill := c.get(context.Background(), key)
+	if resp != nil || fill == nil {
+		t.Fatalf("unexpected result %v", resp)
+	}
+
+	// The requests arriving while the verb runs share its result.
+	shared := make(chan *RunResponse)
+
+	go func() {
+		resp, _, _ := c.get(context.Background(), key)
+		shared <- resp
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	fill(&RunResponse{SessionID: "1", Stdout: "out", Reason: client.TerminationExited})
+
+	if resp = <-shared; resp == nil || resp.SessionID != "1" {
+		t.Errorf("unexpected shared result %v", resp)
+	}
+
+	now = now.Add(500 * time.Millisecond)
+
+	resp, age, _ := c.get(context.Background(), key)
+	if resp == nil || resp.Stdout != "out" || age != 500*time.Millisecond {
+		t.Errorf("unexpected cached result %v, age %v", resp, age)
+	}
+
+	// The result expires after the TTL, and the failures aren't cached.
+	now = now.Add(time.Second)
+
+	if resp, _, fill = c.get(context.Background(), key); resp != nil {
+		t.Fatalf("unexpected expired result %v", resp)
+	}
+
+	fill(&RunResponse{ExitCode: 1, Reason: client.TerminationExited})
+
+	if resp, _, fill = c.get(context.Background(), key); resp != nil {
+		t.Errorf("unexpected failed result %v", resp)
+	}
+
+	fill(nil)
+}
@@ -0,0 +1,48 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"testing"
+	"trust-tunnel/pkg/trust-tunnel-agent/backend/request"
+
+	client "trust-tunnel/pkg/trust-tunnel-client"
+)
+
+func TestResolveVerb(t *testing.T) {
+	handler := &Handler{config: &Config{VerbConfig: VerbConfig{Allowed: []string{"ps", "netdiag"}}}}
+
+	// The top request is served even if the verbs are disabled.
+	req := &request.Info{Top: true}
+	if err := handler.resolveVerb(req); err != nil || req.VerbScope != "verb:top" {
+		t.Errorf("unexpected scope %q, %v", req.VerbScope, err)
+	}
+
+	req = &request.Info{Verb: &client.VerbRequest{Name: "ps"}}
+	if err := handler.resolveVerb(req); err == nil {
+		t.Error("verbs should be disabled")
+	}
+
+	handler.config.VerbConfig.Enabled = true
+	if err := handler.resolveVerb(req); err != nil || req.VerbScope != "verb:ps" {
+		t.Errorf("unexpected scope %q, %v", req.VerbScope, err)
+	}
+
+	for _, name := range []string{"top", "unknown"} {
+		if err := handler.resolveVerb(&request.Info{Verb: &client.VerbRequest{Name: name}}); err == nil {
+			t.Errorf("verb %s should be refused", name)
+		}
+	}
+}
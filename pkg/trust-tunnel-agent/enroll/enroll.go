@@ -0,0 +1,247 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package enroll implements the enrollment server issuing short-lived client certificates, so that operators
+// don't need long-lived certificates. Clients prove their identity with the SSO tokens verified by a pluggable
+// token verifier, and submit certificate signing requests signed with their in-memory keys.
+package enroll
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+	"trust-tunnel/pkg/common/logutil"
+	"trust-tunnel/pkg/trust-tunnel-client/fips"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	defaultAddr    = ":5007"
+	defaultCertTTL = time.Hour
+
+	// maxCSRSize is the maximum size of the certificate signing requests.
+	maxCSRSize = 64 * 1024
+
+	// clockSkew is subtracted from the start of the validity period to tolerate the clock skew.
+	clockSkew = 5 * time.Minute
+)
+
+var logger = logutil.GetLogger("trust-tunnel-agent")
+
+// enrolledURN is the URI SAN marking the certificates issued by the enrollment server, whose common names are the
+// identities verified by the tokens.
+const enrolledURN = "trust-tunnel:enrolled"
+
+// Enrolled returns whether the certificate is issued by the enrollment server, so that its common name identifies
+// the user.
+func Enrolled(cert *x509.Certificate) bool {
+	for _, u := range cert.URIs {
+		if u.Scheme == "urn" && u.Opaque == enrolledURN {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Config defines the configuration of the enrollment server.
+type Config struct {
+	// Enabled indicates whether the enrollment server is enabled.
+	Enabled bool `toml:"enabled"`
+
+	// Addr is the address to listen on, defaults to ":5007".
+	Addr string `toml:"addr"`
+
+	// TLSCert and TLSKey are the paths of the server certificate and key. Clients don't have
+	// certificates before the enrollment, so they are authenticated by the tokens only.
+	TLSCert string `toml:"tls_cert"`
+	TLSKey  string `toml:"tls_key"`
+
+	// CACert and CAKey are the paths of the CA certificate and key signing the client certificates.
+	// The CA certificate should be trusted by the tls_ca of the agents.
+	CACert string `toml:"ca_cert"`
+	CAKey  string `toml:"ca_key"`
+
+	// CertTTL is the validity period of the issued certificates, defaults to 1 hour.
+	CertTTL time.Duration `toml:"cert_ttl"`
+
+	// TokenVerifier is the name of the verifier of the SSO tokens, and TokenVerifierParams are its parameters.
+	TokenVerifier       string            `toml:"token_verifier"`
+	TokenVerifierParams map[string]string `toml:"token_verifier_params"`
+}
+
+// Server signs the certificate signing requests of the clients authenticated by the tokens.
+type Server struct {
+	ca       *x509.Certificate
+	caKey    any
+	ttl      time.Duration
+	verifier TokenVerifier
+	// now returns the current time, it's replaced in tests.
+	now func() time.Time
+}
+
+// NewServer creates the enrollment server with the given configuration.
+// The TLS config of the returned http server is set, it should be served by ListenAndServeTLS.
+func NewServer(config *Config) (*http.Server, error) {
+	s, err := newServer(config)
+	if err != nil {
+		return nil, err
+	}
+
+	cert, err := tls.LoadX509KeyPair(config.TLSCert, config.TLSKey)
+	if err != nil {
+		return nil, fmt.Errorf("load enrollment server certificate error: %v", err)
+	}
+
+	addr := config.Addr
+	if addr == "" {
+		addr = defaultAddr
+	}
+
+	if err = fips.CheckCertificate(&cert); err != nil {
+		return nil, fmt.Errorf("enrollment server certificate: %v", err)
+	}
+
+	r := mux.NewRouter()
+	r.Handle("/enroll", s).Methods(http.MethodPost)
+
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
+	fips.Apply(tlsConfig)
+
+	return &http.Server{
+		Addr:      addr,
+		Handler:   r,
+		TLSConfig: tlsConfig,
+	}, nil
+}
+
+// newServer loads the CA and creates the token verifier.
+func newServer(config *Config) (*Server, error) {
+	ca, err := tls.LoadX509KeyPair(config.CACert, config.CAKey)
+	if err != nil {
+		return nil, fmt.Errorf("load enrollment CA error: %v", err)
+	}
+
+	caCert, err := x509.ParseCertificate(ca.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("parse enrollment CA error: %v", err)
+	}
+
+	verifier, err := CreateTokenVerifier(config.TokenVerifier, config.TokenVerifierParams)
+	if err != nil {
+		return nil, err
+	}
+
+	ttl := config.CertTTL
+	if ttl <= 0 {
+		ttl = defaultCertTTL
+	}
+
+	return &Server{
+		ca:       caCert,
+		caKey:    ca.PrivateKey,
+		ttl:      ttl,
+		verifier: verifier,
+		now:      time.Now,
+	}, nil
+}
+
+// ServeHTTP signs the PEM encoded certificate signing request in the body, and responds with the PEM encoded
+// certificate. The SSO token is given by the bearer authorization header.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		http.Error(w, "missing token", http.StatusUnauthorized)
+
+		return
+	}
+
+	identity, err := s.verifier.Verify(r.Context(), token)
+	if err != nil {
+		logger.Warnf("reject enrollment from %s: %v", r.RemoteAddr, err)
+		http.Error(w, "invalid token", http.StatusUnauthorized)
+
+		return
+	}
+
+	data, err := io.ReadAll(io.LimitReader(r.Body, maxCSRSize))
+	if err != nil {
+		http.Error(w, "read request error", http.StatusBadRequest)
+
+		return
+	}
+
+	cert, err := s.sign(data, identity)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	logger.Infof("issued certificate for %s to %s, expires at %s", identity, r.RemoteAddr, cert.NotAfter.Format(time.RFC3339))
+
+	w.Header().Set("Content-Type", "application/x-pem-file")
+	pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+}
+
+// sign issues a client certificate for the identity with the public key of the certificate signing request.
+// The subject is set to the identity verified by the token, the one requested is ignored.
+func (s *Server) sign(data []byte, identity string) (*x509.Certificate, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE REQUEST" {
+		return nil, fmt.Errorf("no certificate request found")
+	}
+
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("parse certificate request error: %v", err)
+	}
+
+	if err := csr.CheckSignature(); err != nil {
+		return nil, fmt.Errorf("invalid certificate request signature: %v", err)
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+
+	now := s.now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: identity},
+		NotBefore:    now.Add(-clockSkew),
+		NotAfter:     now.Add(s.ttl),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		URIs:         []*url.URL{{Scheme: "urn", Opaque: enrolledURN}},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, s.ca, csr.PublicKey, s.caKey)
+	if err != nil {
+		return nil, fmt.Errorf("sign certificate error: %v", err)
+	}
+
+	return x509.ParseCertificate(der)
+}
@@ -0,0 +1,199 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package enroll
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type staticVerifier map[string]string
+
+func (v staticVerifier) Verify(_ context.Context, token string) (string, error) {
+	if identity, ok := v[token]; ok {
+		return identity, nil
+	}
+
+	return "", fmt.Errorf("unknown token")
+}
+
+func init() {
+	RegisterTokenVerifier("static", func(params map[string]string) (TokenVerifier, error) {
+		return staticVerifier(params), nil
+	})
+}
+
+// writeCA writes a self-signed CA certificate and its key to PEM files in dir.
+func writeCA(t *testing.T, dir string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key error: %v", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("create certificate error: %v", err)
+	}
+
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+	certFile, keyFile := filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca-key.pem")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0o600)
+
+	return certFile, keyFile
+}
+
+func newCSR(t *testing.T, subject string) string {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{Subject: pkix.Name{CommonName: subject}}, key)
+	if err != nil {
+		t.Fatalf("create certificate request error: %v", err)
+	}
+
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csr}))
+}
+
+func TestEnroll(t *testing.T) {
+	caCert, caKey := writeCA(t, t.TempDir())
+
+	s, err := newServer(&Config{
+		CACert:              caCert,
+		CAKey:               caKey,
+		CertTTL:             10 * time.Minute,
+		TokenVerifier:       "static",
+		TokenVerifierParams: map[string]string{"good": "alice"},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		name           string
+		token          string
+		body           string
+		expectedStatus int
+	}{
+		{"issued", "good", newCSR(t, "root"), http.StatusOK},
+		{"missing token", "", newCSR(t, "alice"), http.StatusUnauthorized},
+		{"invalid token", "bad", newCSR(t, "alice"), http.StatusUnauthorized},
+		{"invalid request", "good", "not a request", http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/enroll", strings.NewReader(tt.body))
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+
+			w := httptest.NewRecorder()
+			s.ServeHTTP(w, req)
+
+			if w.Code != tt.expectedStatus {
+				t.Fatalf("got status %d, want %d: %s", w.Code, tt.expectedStatus, w.Body.String())
+			}
+
+			if w.Code != http.StatusOK {
+				return
+			}
+
+			block, _ := pem.Decode(w.Body.Bytes())
+			if block == nil {
+				t.Fatalf("no certificate in response %q", w.Body.String())
+			}
+
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				t.Fatalf("parse certificate error: %v", err)
+			}
+
+			// The requested subject is replaced by the identity of the token.
+			if cert.Subject.CommonName != "alice" || !Enrolled(cert) {
+				t.Errorf("got subject %q enrolled %v, want %q enrolled", cert.Subject.CommonName, Enrolled(cert), "alice")
+			}
+
+			if err := cert.CheckSignatureFrom(s.ca); err != nil {
+				t.Errorf("certificate is not signed by the CA: %v", err)
+			}
+
+			if ttl := time.Until(cert.NotAfter); ttl > 10*time.Minute || ttl < 9*time.Minute {
+				t.Errorf("unexpected expiry %s", cert.NotAfter)
+			}
+		})
+	}
+}
+
+func TestWebhookVerifier(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Header.Get("Authorization") {
+		case "Bearer good":
+			w.Write([]byte(`{"sub":"alice","email":"alice@example.com"}`))
+		case "Bearer anonymous":
+			w.Write([]byte(`{}`))
+		default:
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer server.Close()
+
+	verifier, err := CreateTokenVerifier("webhook", map[string]string{"url": server.URL})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if identity, err := verifier.Verify(context.Background(), "good"); err != nil || identity != "alice" {
+		t.Errorf("got identity %q and error %v", identity, err)
+	}
+
+	for _, token := range []string{"anonymous", "bad"} {
+		if _, err := verifier.Verify(context.Background(), token); err == nil {
+			t.Errorf("expected error with token %q", token)
+		}
+	}
+
+	verifier, _ = CreateTokenVerifier("webhook", map[string]string{"url": server.URL, "identity_field": "email"})
+	if identity, err := verifier.Verify(context.Background(), "good"); err != nil || identity != "alice@example.com" {
+		t.Errorf("got identity %q and error %v", identity, err)
+	}
+
+	if _, err := CreateTokenVerifier("webhook", nil); err == nil {
+		t.Error("expected error without url")
+	}
+}
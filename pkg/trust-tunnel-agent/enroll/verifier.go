@@ -0,0 +1,115 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package enroll
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// webhookTimeout is the timeout of verifying tokens with the webhook.
+const webhookTimeout = 10 * time.Second
+
+// TokenVerifier verifies the SSO tokens of the clients.
+type TokenVerifier interface {
+	// Verify verifies the token, and returns the identity of its owner, which becomes the subject of the certificate.
+	Verify(ctx context.Context, token string) (string, error)
+}
+
+// tokenVerifierFactories stores the token verifier factory functions by their names.
+var tokenVerifierFactories = map[string]func(params map[string]string) (TokenVerifier, error){
+	"webhook": newWebhookVerifier,
+}
+
+// RegisterTokenVerifier registers a factory function for a token verifier.
+// If the token verifier name is already registered, it panics.
+func RegisterTokenVerifier(name string, factoryFunc func(params map[string]string) (TokenVerifier, error)) {
+	if _, exists := tokenVerifierFactories[name]; exists {
+		panic("token verifier already registered")
+	}
+
+	tokenVerifierFactories[name] = factoryFunc
+}
+
+// CreateTokenVerifier creates a token verifier by its name with the parameters.
+func CreateTokenVerifier(name string, params map[string]string) (TokenVerifier, error) {
+	factoryFunc, exists := tokenVerifierFactories[name]
+	if !exists {
+		return nil, fmt.Errorf("token verifier not found: %s", name)
+	}
+
+	return factoryFunc(params)
+}
+
+// webhookVerifier verifies the tokens with the userinfo endpoint of the SSO provider, e.g. the OIDC one.
+// The token is sent as the bearer token, and the identity is read from the field of the JSON response.
+type webhookVerifier struct {
+	url   string
+	field string
+	cli   *http.Client
+}
+
+// newWebhookVerifier creates a webhook verifier with the "url" of the endpoint, and the "identity_field"
+// of the response which defaults to "sub".
+func newWebhookVerifier(params map[string]string) (TokenVerifier, error) {
+	if params["url"] == "" {
+		return nil, fmt.Errorf("url of the webhook token verifier is required")
+	}
+
+	field := params["identity_field"]
+	if field == "" {
+		field = "sub"
+	}
+
+	return &webhookVerifier{
+		url:   params["url"],
+		field: field,
+		cli:   &http.Client{Timeout: webhookTimeout},
+	}, nil
+}
+
+func (v *webhookVerifier) Verify(ctx context.Context, token string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, v.url, nil)
+	if err != nil {
+		return "", err
+	}
+
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := v.cli.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("verify token error: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token is rejected with status %d", resp.StatusCode)
+	}
+
+	var info map[string]any
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return "", fmt.Errorf("decode token info error: %v", err)
+	}
+
+	identity, _ := info[v.field].(string)
+	if identity == "" {
+		return "", fmt.Errorf("no %s found in token info", v.field)
+	}
+
+	return identity, nil
+}
@@ -0,0 +1,59 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build faultinject
+
+package faults
+
+import (
+	"github.com/containerd/containerd"
+	dockerClient "github.com/docker/docker/client"
+)
+
+// config is the faults configured by the environment variables.
+var config = loadConfig()
+
+// loadConfig loads the faults from the environment variables.
+func loadConfig() *Config {
+	config, err := ConfigFromEnv()
+	if err != nil {
+		logger.Errorf("fault injection is disabled: %v", err)
+
+		return nil
+	}
+
+	if config != nil {
+		logger.Warnf("fault injection is enabled: %+v", *config)
+	}
+
+	return config
+}
+
+// DockerOpts returns the options of the docker client injecting the configured faults.
+func DockerOpts() []dockerClient.Opt {
+	if config == nil {
+		return nil
+	}
+
+	return []dockerClient.Opt{config.dockerOpt}
+}
+
+// ContainerdOpts returns the options of the containerd client injecting the configured faults.
+func ContainerdOpts() []containerd.ClientOpt {
+	if config == nil {
+		return nil
+	}
+
+	return config.containerdOpts()
+}
@@ -0,0 +1,213 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package faults injects delays and failures into the calls to the container runtimes at configured rates,
+// so that races such as the ones with daemon restarts can be reproduced in automated tests.
+// The injection is only compiled into the agent built with the "faultinject" tag, and configured by
+// the environment variables:
+//
+//	TRUST_TUNNEL_FAULT_DELAY       delay of the calls, e.g. "200ms"
+//	TRUST_TUNNEL_FAULT_DELAY_RATE  rate of the calls delayed, from 0 to 1
+//	TRUST_TUNNEL_FAULT_ERROR_RATE  rate of the calls failed, from 0 to 1
+//	TRUST_TUNNEL_FAULT_MATCH       regular expression matching the calls to inject faults into,
+//	                               e.g. "POST .*/containers/create" for docker, or "Tasks/Start" for containerd
+//
+// The streams hijacked for attaching to the commands are not affected.
+package faults
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"time"
+	"trust-tunnel/pkg/common/logutil"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/pkg/dialer"
+	dockerClient "github.com/docker/docker/client"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/backoff"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	envDelay     = "TRUST_TUNNEL_FAULT_DELAY"
+	envDelayRate = "TRUST_TUNNEL_FAULT_DELAY_RATE"
+	envErrorRate = "TRUST_TUNNEL_FAULT_ERROR_RATE"
+	envMatch     = "TRUST_TUNNEL_FAULT_MATCH"
+)
+
+var logger = logutil.GetLogger("trust-tunnel-agent-faults")
+
+// ErrInjected is the error of the failed calls.
+var ErrInjected = errors.New("injected fault")
+
+// Config defines the faults to inject.
+type Config struct {
+	// Delay is the delay of the calls.
+	Delay time.Duration
+
+	// DelayRate is the rate of the calls delayed.
+	DelayRate float64
+
+	// ErrorRate is the rate of the calls failed.
+	ErrorRate float64
+
+	// Match matches the names of the calls to inject faults into, all calls if nil.
+	Match *regexp.Regexp
+}
+
+// ConfigFromEnv parses the config from the environment variables, nil is returned if no fault is configured.
+func ConfigFromEnv() (*Config, error) {
+	var (
+		config Config
+		err    error
+	)
+
+	if v := os.Getenv(envDelay); v != "" {
+		if config.Delay, err = time.ParseDuration(v); err != nil {
+			return nil, fmt.Errorf("invalid %s: %v", envDelay, err)
+		}
+	}
+
+	if config.DelayRate, err = parseRate(envDelayRate); err != nil {
+		return nil, err
+	}
+
+	if config.ErrorRate, err = parseRate(envErrorRate); err != nil {
+		return nil, err
+	}
+
+	if v := os.Getenv(envMatch); v != "" {
+		if config.Match, err = regexp.Compile(v); err != nil {
+			return nil, fmt.Errorf("invalid %s: %v", envMatch, err)
+		}
+	}
+
+	if (config.Delay <= 0 || config.DelayRate <= 0) && config.ErrorRate <= 0 {
+		return nil, nil
+	}
+
+	return &config, nil
+}
+
+// parseRate parses the rate in the environment variable.
+func parseRate(env string) (float64, error) {
+	v := os.Getenv(env)
+	if v == "" {
+		return 0, nil
+	}
+
+	rate, err := strconv.ParseFloat(v, 64)
+	if err != nil || rate < 0 || rate > 1 {
+		return 0, fmt.Errorf("invalid %s: %q isn't a rate from 0 to 1", env, v)
+	}
+
+	return rate, nil
+}
+
+// inject delays or fails the call with the name at the configured rates.
+func (c *Config) inject(ctx context.Context, name string) error {
+	if c.Match != nil && !c.Match.MatchString(name) {
+		return nil
+	}
+
+	if c.Delay > 0 && rand.Float64() < c.DelayRate {
+		logger.Debugf("delay %s for %v", name, c.Delay)
+
+		select {
+		case <-time.After(c.Delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	if rand.Float64() < c.ErrorRate {
+		logger.Debugf("fail %s", name)
+
+		return fmt.Errorf("%w: %s", ErrInjected, name)
+	}
+
+	return nil
+}
+
+// roundTripper injects faults into the requests to the docker daemon.
+type roundTripper struct {
+	config *Config
+	base   http.RoundTripper
+}
+
+func (t *roundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := t.config.inject(req.Context(), req.Method+" "+req.URL.Path); err != nil {
+		return nil, err
+	}
+
+	return t.base.RoundTrip(req)
+}
+
+// unaryInterceptor injects faults into the unary calls to containerd, the failures look like the ones
+// when containerd is unavailable.
+func (c *Config) unaryInterceptor(ctx context.Context, method string, req, reply interface{},
+	cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption,
+) error {
+	if err := c.inject(ctx, method); err != nil {
+		return status.Error(codes.Unavailable, err.Error())
+	}
+
+	return invoker(ctx, method, req, reply, cc, opts...)
+}
+
+// streamInterceptor injects faults into the creation of the streams to containerd.
+func (c *Config) streamInterceptor(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string,
+	streamer grpc.Streamer, opts ...grpc.CallOption,
+) (grpc.ClientStream, error) {
+	if err := c.inject(ctx, method); err != nil {
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+
+	return streamer(ctx, desc, cc, method, opts...)
+}
+
+// dockerOpt wraps the transport of the docker client to inject faults into the requests.
+func (c *Config) dockerOpt(cli *dockerClient.Client) error {
+	httpClient := cli.HTTPClient()
+	httpClient.Transport = &roundTripper{config: c, base: httpClient.Transport}
+
+	return dockerClient.WithHTTPClient(httpClient)(cli)
+}
+
+// containerdOpts returns the options of the containerd client to inject faults into the calls.
+// The dial options replace the default ones of containerd, so the defaults are repeated here.
+func (c *Config) containerdOpts() []containerd.ClientOpt {
+	backoffConfig := backoff.DefaultConfig
+	backoffConfig.MaxDelay = 3 * time.Second
+
+	return []containerd.ClientOpt{containerd.WithDialOpts([]grpc.DialOption{
+		grpc.WithBlock(),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.FailOnNonTempDialError(true),
+		grpc.WithConnectParams(grpc.ConnectParams{Backoff: backoffConfig}),
+		grpc.WithContextDialer(dialer.ContextDialer),
+		grpc.WithReturnConnectionError(),
+		grpc.WithChainUnaryInterceptor(c.unaryInterceptor),
+		grpc.WithChainStreamInterceptor(c.streamInterceptor),
+	})}
+}
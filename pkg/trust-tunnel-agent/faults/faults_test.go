@@ -0,0 +1,105 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package faults
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	dockerClient "github.com/docker/docker/client"
+)
+
+func TestConfigFromEnv(t *testing.T) {
+	config, err := ConfigFromEnv()
+	if err != nil || config != nil {
+		t.Fatalf("expected no fault configured, got %v and %v", config, err)
+	}
+
+	t.Setenv(envDelay, "100ms")
+	t.Setenv(envDelayRate, "0.5")
+	t.Setenv(envMatch, "containers/create")
+
+	config, err = ConfigFromEnv()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if config.Delay != 100*time.Millisecond || config.DelayRate != 0.5 || config.ErrorRate != 0 || config.Match.String() != "containers/create" {
+		t.Errorf("unexpected config %+v", *config)
+	}
+
+	t.Setenv(envErrorRate, "2")
+
+	if _, err := ConfigFromEnv(); err == nil {
+		t.Errorf("expected error of invalid rate")
+	}
+}
+
+func TestInject(t *testing.T) {
+	config := &Config{Delay: 50 * time.Millisecond, DelayRate: 1, ErrorRate: 1, Match: regexp.MustCompile("Tasks/Start")}
+
+	if err := config.inject(context.Background(), "/containerd.services.tasks.v1.Tasks/Kill"); err != nil {
+		t.Errorf("unexpected error of unmatched call: %v", err)
+	}
+
+	start := time.Now()
+
+	if err := config.inject(context.Background(), "/containerd.services.tasks.v1.Tasks/Start"); !errors.Is(err, ErrInjected) {
+		t.Errorf("expected injected error, got %v", err)
+	}
+
+	if elapsed := time.Since(start); elapsed < config.Delay {
+		t.Errorf("expected delay %v, got %v", config.Delay, elapsed)
+	}
+
+	// The delay is canceled with the context.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	config.Delay = time.Hour
+	if err := config.inject(ctx, "/containerd.services.tasks.v1.Tasks/Start"); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected canceled error, got %v", err)
+	}
+}
+
+func TestDockerOpt(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Api-Version", "1.41")
+	}))
+	defer server.Close()
+
+	config := &Config{ErrorRate: 1, Match: regexp.MustCompile("^POST ")}
+
+	cli, err := dockerClient.NewClientWithOpts(dockerClient.WithHost("tcp://"+strings.TrimPrefix(server.URL, "http://")),
+		dockerClient.WithVersion("1.41"), config.dockerOpt)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer cli.Close()
+
+	if _, err := cli.Ping(context.Background()); err != nil {
+		t.Errorf("unexpected error of unmatched request: %v", err)
+	}
+
+	if err := cli.ContainerKill(context.Background(), "c1", "KILL"); !errors.Is(err, ErrInjected) {
+		t.Errorf("expected injected error, got %v", err)
+	}
+}
@@ -0,0 +1,55 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package monitor
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+)
+
+var (
+	authCacheLock sync.RWMutex
+	// authCacheInvalidator drops the cached auth decisions of the user, or all of them if the user is empty.
+	authCacheInvalidator func(user string) int
+)
+
+// SetAuthCacheInvalidator sets the function invalidating the auth decision cache.
+func SetAuthCacheInvalidator(invalidator func(user string) int) {
+	authCacheLock.Lock()
+	defer authCacheLock.Unlock()
+
+	authCacheInvalidator = invalidator
+}
+
+// AuthCacheHandler invalidates the cached auth decisions of the user in the "user" query parameter, or all of
+// them without the parameter, e.g. after the permissions are revoked. It responds the number of the dropped
+// decisions in JSON.
+func AuthCacheHandler(w http.ResponseWriter, r *http.Request) {
+	authCacheLock.RLock()
+	invalidator := authCacheInvalidator
+	authCacheLock.RUnlock()
+
+	if invalidator == nil {
+		http.Error(w, "auth decision cache is disabled", http.StatusNotFound)
+
+		return
+	}
+
+	n := invalidator(r.URL.Query().Get("user"))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"invalidated": n})
+}
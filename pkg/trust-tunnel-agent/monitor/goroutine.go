@@ -0,0 +1,49 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package monitor
+
+import (
+	"context"
+	"runtime/pprof"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// MetricsGoroutines counts the goroutines started by Go on module. The goroutines, file descriptors and memory
+// of the whole agent are exported by the Go and process collectors of the default registry, as go_goroutines,
+// process_open_fds and go_memstats_heap_inuse_bytes etc.
+var MetricsGoroutines = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "agent_goroutines",
+	Help: "The count of goroutines of the agent on module",
+}, []string{"module"})
+
+func init() {
+	prometheus.MustRegister(MetricsGoroutines)
+}
+
+// Go runs the function in a goroutine counted in agent_goroutines by the module, and labeled with the module in
+// the goroutine profiles, so that a leaking module can be told from the dashboards and the profiles.
+func Go(module string, f func()) {
+	gauge := MetricsGoroutines.WithLabelValues(module)
+	gauge.Inc()
+
+	go func() {
+		defer gauge.Dec()
+
+		pprof.Do(context.Background(), pprof.Labels("module", module), func(context.Context) {
+			f()
+		})
+	}()
+}
@@ -0,0 +1,46 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package monitor
+
+import (
+	"runtime"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestGo(t *testing.T) {
+	gauge := MetricsGoroutines.WithLabelValues("test")
+	release := make(chan struct{})
+	done := make(chan struct{})
+
+	Go("test", func() {
+		<-release
+	})
+
+	if n := testutil.ToFloat64(gauge); n != 1 {
+		t.Fatalf("expected 1 goroutine running, got %v", n)
+	}
+
+	Go("test", func() {
+		close(done)
+	})
+	<-done
+	close(release)
+
+	for testutil.ToFloat64(gauge) != 0 {
+		runtime.Gosched()
+	}
+}
@@ -42,13 +42,24 @@ var (
 
 	MetricsEstablishSessionError = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Name: "establish_session_error",
-		Help: "The count of establish session error",
-	}, []string{})
+		Help: "The count of establish session error on error code and runtime",
+	}, []string{"code", "runtime"})
 
 	MetricsEstablishSessionSuccess = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Name: "establish_session_success",
-		Help: "The count of establish session success",
-	}, []string{})
+		Help: "The count of establish session success on runtime",
+	}, []string{"runtime"})
+
+	MetricsEstablishSessionRt = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "establish_session_rt_ms",
+		Help:    "The time of establishing a session in milliseconds",
+		Buckets: []float64{10, 50, 100, 500, 1000, 3000, 10000},
+	}, []string{"runtime"})
+
+	MetricsSessionTermination = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "session_termination_total",
+		Help: "The count of session terminations on reason and runtime",
+	}, []string{"reason", "runtime"})
 
 	MetricsKillLegacyProcessCount = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Name: "kill_residual_process_count",
@@ -59,6 +70,61 @@ var (
 		Name: "legacy_sidecar_count",
 		Help: "The count of legacy sidecar container",
 	})
+
+	MetricsSidecarImageVerify = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "sidecar_image_verify_total",
+		Help: "The count of sidecar image signature verification on result",
+	}, []string{"result"})
+
+	MetricsContainerRuntimeHealthy = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "container_runtime_healthy",
+		Help: "Whether the container runtime passes the health check",
+	})
+
+	MetricsAuthCache = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "auth_cache_total",
+		Help: "The count of auth decision cache lookups on result, hit or miss",
+	}, []string{"result"})
+
+	MetricsAuthRequest = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "auth_request_total",
+		Help: "The count of requests to the auth server on result, ok, error, retry or short_circuit",
+	}, []string{"result"})
+
+	MetricsAuthCircuitOpen = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "auth_circuit_open",
+		Help: "Whether the circuit breaker of the auth server is open",
+	})
+
+	MetricsAuthDenial = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "auth_denial_total",
+		Help: "The count of denied session requests on reason",
+	}, []string{"reason"})
+
+	MetricsSessionTags = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "session_tags_total",
+		Help: "The count of established sessions on the tags of the metric keys, the values beyond the limit are counted as other",
+	}, []string{"key", "value"})
+
+	MetricsNotifications = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "notifications_total",
+		Help: "The count of session events posted to the webhooks on webhook and result, sent, failed or dropped",
+	}, []string{"webhook", "result"})
+
+	MetricsVerbCache = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "verb_cache_total",
+		Help: "The count of verb result cache lookups of POST /run on result, hit, shared or miss",
+	}, []string{"result"})
+
+	MetricsRecordingUploads = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "recording_uploads_total",
+		Help: "The count of session recordings on the result in the object storage, uploaded, failed or expired",
+	}, []string{"result"})
+
+	MetricsHandshakeFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "handshake_failures_total",
+		Help: "The count of failed TLS and NTLS handshakes on listener, protocol and reason",
+	}, []string{"listener", "protocol", "reason"})
 )
 
 func init() {
@@ -69,7 +135,43 @@ func init() {
 		MetricsVerifyClientCertError,
 		MetricsEstablishSessionError,
 		MetricsEstablishSessionSuccess,
+		MetricsEstablishSessionRt,
+		MetricsSessionTermination,
 		MetricsKillLegacyProcessCount,
 		MetricsLegacySidecarCount,
+		MetricsSidecarImageVerify,
+		MetricsContainerRuntimeHealthy,
+		MetricsAuthCache,
+		MetricsAuthRequest,
+		MetricsAuthCircuitOpen,
+		MetricsAuthDenial,
+		MetricsSessionTags,
+		MetricsNotifications,
+		MetricsVerbCache,
+		MetricsRecordingUploads,
+		MetricsHandshakeFailures,
 	)
 }
+
+// IncWithSessionID increments the counter and attaches the session ID as the exemplar,
+// so that the session can be found from dashboards.
+func IncWithSessionID(counter prometheus.Counter, sessID string) {
+	if adder, ok := counter.(prometheus.ExemplarAdder); ok && sessID != "" {
+		adder.AddWithExemplar(1, prometheus.Labels{"session_id": sessID})
+
+		return
+	}
+
+	counter.Inc()
+}
+
+// ObserveWithSessionID observes the value and attaches the session ID as the exemplar.
+func ObserveWithSessionID(observer prometheus.Observer, value float64, sessID string) {
+	if exemplarObserver, ok := observer.(prometheus.ExemplarObserver); ok && sessID != "" {
+		exemplarObserver.ObserveWithExemplar(value, prometheus.Labels{"session_id": sessID})
+
+		return
+	}
+
+	observer.Observe(value)
+}
@@ -0,0 +1,61 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package monitor
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var (
+	readinessLock   sync.RWMutex
+	readinessChecks = make(map[string]func() error)
+)
+
+// RegisterReadinessCheck registers a check of the agent readiness, the agent is ready only if all the checks pass.
+func RegisterReadinessCheck(name string, check func() error) {
+	readinessLock.Lock()
+	defer readinessLock.Unlock()
+
+	readinessChecks[name] = check
+}
+
+// ReadyzHandler responds 200 if the agent is ready, otherwise 503 with the failed checks.
+// The checks are expected to return cached states so that probes are cheap.
+func ReadyzHandler(w http.ResponseWriter, _ *http.Request) {
+	readinessLock.RLock()
+
+	var failures []string
+
+	for name, check := range readinessChecks {
+		if err := check(); err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %v", name, err))
+		}
+	}
+
+	readinessLock.RUnlock()
+
+	if len(failures) > 0 {
+		sort.Strings(failures)
+		http.Error(w, strings.Join(failures, "\n"), http.StatusServiceUnavailable)
+
+		return
+	}
+
+	fmt.Fprintln(w, "ok")
+}
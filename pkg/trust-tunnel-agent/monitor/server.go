@@ -0,0 +1,208 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package monitor
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"strings"
+	"trust-tunnel/pkg/trust-tunnel-client/fips"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const defaultAddr = ":19104"
+
+// Config defines the configuration of the monitoring server which serves /metrics, /readyz and /status,
+// and invalidates the auth decision cache on /auth/cache.
+type Config struct {
+	// Disabled indicates whether the monitoring server is disabled.
+	Disabled bool `toml:"disabled"`
+
+	// Addr is the address to listen on, defaults to ":19104".
+	// Use "127.0.0.1:19104" to expose the metrics to local collectors only.
+	Addr string `toml:"addr"`
+
+	// TLSCert and TLSKey are the paths of the server certificate and key, the server is served over TLS if set.
+	TLSCert string `toml:"tls_cert"`
+	TLSKey  string `toml:"tls_key"`
+
+	// TLSCA is the path of the CA certificate to verify client certificates, optional.
+	TLSCA string `toml:"tls_ca"`
+
+	// BasicAuth specifies the credential required to access /metrics and /status with basic authentication.
+	BasicAuth *BasicAuth `toml:"basic_auth"`
+
+	// BearerToken is the token required to access /metrics and /status with bearer authentication.
+	BearerToken string `toml:"bearer_token"`
+
+	// Pprof specifies whether to serve the profiles of the agent on /debug/pprof/ with the authentication of
+	// /metrics, e.g. the goroutine profile labeled with the modules to find leaking goroutines.
+	Pprof bool `toml:"pprof"`
+}
+
+// BasicAuth defines the username and password of basic authentication.
+type BasicAuth struct {
+	Username string `toml:"username"`
+	Password string `toml:"password"`
+}
+
+// NewServer creates the monitoring server with the given configuration.
+// The TLS config of the returned server is set if TLS is enabled, it should be served by ListenAndServeTLS then.
+// /metrics and /status share the authentication, while /readyz is not authenticated so that it can be used by probes.
+func NewServer(config *Config) (*http.Server, error) {
+	addr := config.Addr
+	if addr == "" {
+		addr = defaultAddr
+	}
+
+	server := &http.Server{
+		Addr: addr,
+	}
+
+	if config.TLSCert != "" || config.TLSKey != "" {
+		tlsConfig, err := config.tlsConfig()
+		if err != nil {
+			return nil, fmt.Errorf("config monitor server TLS error: %v", err)
+		}
+
+		server.TLSConfig = tlsConfig
+	}
+
+	r := mux.NewRouter()
+	// Exemplars are exposed only in the OpenMetrics format.
+	metricsHandler := promhttp.InstrumentMetricHandler(prometheus.DefaultRegisterer,
+		promhttp.HandlerFor(prometheus.DefaultGatherer, promhttp.HandlerOpts{EnableOpenMetrics: true}))
+
+	r.Handle("/metrics", config.authenticate(metricsHandler))
+	r.Handle("/status", config.authenticate(http.HandlerFunc(StatusHandler)))
+	r.HandleFunc("/readyz", ReadyzHandler)
+
+	// The profiles expose the internals of the agent, and the cache invalidation changes its state, so they are
+	// refused unless the clients are authenticated.
+	if config.Pprof {
+		r.Handle("/debug/pprof/cmdline", config.requireAuth(http.HandlerFunc(pprof.Cmdline)))
+		r.Handle("/debug/pprof/profile", config.requireAuth(http.HandlerFunc(pprof.Profile)))
+		r.Handle("/debug/pprof/symbol", config.requireAuth(http.HandlerFunc(pprof.Symbol)))
+		r.Handle("/debug/pprof/trace", config.requireAuth(http.HandlerFunc(pprof.Trace)))
+		r.PathPrefix("/debug/pprof/").Handler(config.requireAuth(http.HandlerFunc(pprof.Index)))
+	}
+	r.Handle("/auth/cache", config.requireAuth(http.HandlerFunc(AuthCacheHandler))).Methods(http.MethodDelete)
+	server.Handler = r
+
+	return server, nil
+}
+
+// tlsConfig loads the certificates of the monitoring server.
+func (c *Config) tlsConfig() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(c.TLSCert, c.TLSKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = fips.CheckCertificate(&cert); err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	}
+	fips.Apply(tlsConfig)
+
+	if c.TLSCA != "" {
+		caCert, err := os.ReadFile(c.TLSCA)
+		if err != nil {
+			return nil, err
+		}
+
+		pool := x509.NewCertPool()
+		pool.AppendCertsFromPEM(caCert)
+
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return tlsConfig, nil
+}
+
+// authenticate wraps the handler to require the configured basic or bearer credential,
+// requests are passed through if neither is configured.
+func (c *Config) authenticate(next http.Handler) http.Handler {
+	if c.BasicAuth == nil && c.BearerToken == "" {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if c.authorized(r) {
+			next.ServeHTTP(w, r)
+
+			return
+		}
+
+		if c.BasicAuth != nil {
+			w.Header().Set("WWW-Authenticate", `Basic realm="trust-tunnel-agent"`)
+		}
+
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+	})
+}
+
+// requireAuth wraps the handler as authenticate does, but refuses all the requests if the clients can't be
+// authenticated, i.e. neither credential nor the client certificates are required.
+func (c *Config) requireAuth(next http.Handler) http.Handler {
+	if !c.Authenticated() {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "forbidden: basic_auth, bearer_token or tls_ca is required", http.StatusForbidden)
+		})
+	}
+
+	return c.authenticate(next)
+}
+
+// Authenticated returns whether the clients are authenticated, by either credential or the client certificates.
+func (c *Config) Authenticated() bool {
+	return c.BasicAuth != nil || c.BearerToken != "" || (c.TLSCA != "" && c.TLSCert != "")
+}
+
+// authorized checks whether the request carries a valid credential.
+func (c *Config) authorized(r *http.Request) bool {
+	if c.BasicAuth != nil {
+		if username, password, ok := r.BasicAuth(); ok &&
+			secureEqual(username, c.BasicAuth.Username) && secureEqual(password, c.BasicAuth.Password) {
+			return true
+		}
+	}
+
+	if c.BearerToken != "" {
+		auth := r.Header.Get("Authorization")
+		if token, ok := strings.CutPrefix(auth, "Bearer "); ok && secureEqual(token, c.BearerToken) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// secureEqual compares the strings in constant time.
+func secureEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
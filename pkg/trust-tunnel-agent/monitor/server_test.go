@@ -0,0 +1,89 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package monitor
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAuthenticate(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	tests := []struct {
+		name   string
+		config Config
+		setup  func(r *http.Request)
+		want   int
+	}{
+		{"no auth configured", Config{}, func(r *http.Request) {}, http.StatusOK},
+		{"basic auth ok", Config{BasicAuth: &BasicAuth{Username: "prom", Password: "secret"}},
+			func(r *http.Request) { r.SetBasicAuth("prom", "secret") }, http.StatusOK},
+		{"basic auth wrong password", Config{BasicAuth: &BasicAuth{Username: "prom", Password: "secret"}},
+			func(r *http.Request) { r.SetBasicAuth("prom", "wrong") }, http.StatusUnauthorized},
+		{"bearer ok", Config{BearerToken: "token"},
+			func(r *http.Request) { r.Header.Set("Authorization", "Bearer token") }, http.StatusOK},
+		{"bearer missing", Config{BearerToken: "token"}, func(r *http.Request) {}, http.StatusUnauthorized},
+		{"either credential", Config{BasicAuth: &BasicAuth{Username: "prom", Password: "secret"}, BearerToken: "token"},
+			func(r *http.Request) { r.Header.Set("Authorization", "Bearer token") }, http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+			tt.setup(r)
+
+			w := httptest.NewRecorder()
+			tt.config.authenticate(next).ServeHTTP(w, r)
+
+			if w.Code != tt.want {
+				t.Errorf("got status %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestRequireAuth(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	tests := []struct {
+		name   string
+		config Config
+		header string
+		want   int
+	}{
+		{"no auth configured", Config{}, "", http.StatusForbidden},
+		{"bearer ok", Config{BearerToken: "token"}, "Bearer token", http.StatusOK},
+		{"bearer missing", Config{BearerToken: "token"}, "", http.StatusUnauthorized},
+		{"client certificates", Config{TLSCert: "server.crt", TLSKey: "server.key", TLSCA: "ca.crt"}, "", http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodDelete, "/auth/cache", nil)
+			if tt.header != "" {
+				r.Header.Set("Authorization", tt.header)
+			}
+
+			w := httptest.NewRecorder()
+			tt.config.requireAuth(next).ServeHTTP(w, r)
+
+			if w.Code != tt.want {
+				t.Errorf("got status %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
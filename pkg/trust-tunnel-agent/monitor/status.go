@@ -0,0 +1,90 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package monitor
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Status represents the status of the agent reported by /status, it's used for node triage.
+type Status struct {
+	Version          string    `json:"version"`
+	Instance         string    `json:"instance"`
+	StartTime        time.Time `json:"start_time"`
+	ActiveSessions   int       `json:"active_sessions"`
+	StaleSessions    int       `json:"stale_sessions"`
+	Sidecars         int       `json:"sidecars"`
+	SidecarLimit     int       `json:"sidecar_limit"`
+	ContainerRuntime string    `json:"container_runtime"`
+	RuntimeHealthy   bool      `json:"runtime_healthy"`
+	RuntimeError     string    `json:"runtime_error,omitempty"`
+}
+
+var (
+	statusLock     sync.RWMutex
+	version        string
+	startTime      = time.Now()
+	statusProvider func(status *Status)
+)
+
+// SetVersion sets the version of the agent reported in the status.
+func SetVersion(v string) {
+	statusLock.Lock()
+	defer statusLock.Unlock()
+
+	version = v
+}
+
+// Version returns the version of the agent.
+func Version() string {
+	statusLock.RLock()
+	defer statusLock.RUnlock()
+
+	return version
+}
+
+// SetStatusProvider sets the function filling the session and runtime states in the status.
+func SetStatusProvider(provider func(status *Status)) {
+	statusLock.Lock()
+	defer statusLock.Unlock()
+
+	statusProvider = provider
+}
+
+// GetStatus returns the current status of the agent.
+func GetStatus() *Status {
+	statusLock.RLock()
+	defer statusLock.RUnlock()
+
+	status := &Status{
+		Version:   version,
+		StartTime: startTime,
+	}
+
+	if statusProvider != nil {
+		statusProvider(status)
+	}
+
+	return status
+}
+
+// StatusHandler responds the status of the agent in JSON.
+func StatusHandler(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(GetStatus())
+}
@@ -0,0 +1,167 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+
+package proctrack
+
+import (
+	"encoding/binary"
+	"fmt"
+	"syscall"
+)
+
+// The constants of the proc connector, see linux/connector.h and linux/cn_proc.h.
+const (
+	netlinkConnector  = 11
+	cnIdxProc         = 1
+	cnValProc         = 1
+	procCnMcastListen = 1
+
+	procEventFork = 0x00000001
+	procEventExec = 0x00000002
+	procEventExit = 0x80000000
+
+	// cnMsgSize is the size of struct cn_msg.
+	cnMsgSize = 20
+	// procEventHeaderSize is the size of the header of struct proc_event before the event data.
+	procEventHeaderSize = 16
+	// receiveBufferSize is the socket receive buffer size, large enough to hold the bursts of events.
+	receiveBufferSize = 4 << 20
+)
+
+// listen subscribes the process events from the proc connector.
+func listen() (<-chan event, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, netlinkConnector)
+	if err != nil {
+		return nil, fmt.Errorf("create netlink socket error: %v", err)
+	}
+
+	if err = syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK, Groups: cnIdxProc}); err != nil {
+		syscall.Close(fd)
+
+		return nil, fmt.Errorf("bind netlink socket error: %v", err)
+	}
+
+	// It's fine to fail, then the default buffer size is used.
+	syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_RCVBUFFORCE, receiveBufferSize)
+
+	if err = syscall.Sendto(fd, listenMessage(), 0, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		syscall.Close(fd)
+
+		return nil, fmt.Errorf("subscribe process events error: %v", err)
+	}
+
+	events := make(chan event, 1024)
+
+	go receive(fd, events)
+
+	return events, nil
+}
+
+// listenMessage returns the netlink message subscribing the process events.
+func listenMessage() []byte {
+	size := syscall.NLMSG_HDRLEN + cnMsgSize + 4
+	msg := make([]byte, size)
+
+	binary.NativeEndian.PutUint32(msg[0:], uint32(size))
+	binary.NativeEndian.PutUint16(msg[4:], syscall.NLMSG_DONE)
+
+	data := msg[syscall.NLMSG_HDRLEN:]
+	binary.NativeEndian.PutUint32(data[0:], cnIdxProc)
+	binary.NativeEndian.PutUint32(data[4:], cnValProc)
+	binary.NativeEndian.PutUint16(data[16:], 4)
+	binary.NativeEndian.PutUint32(data[cnMsgSize:], procCnMcastListen)
+
+	return msg
+}
+
+// receive reads the process events from the socket until it fails.
+func receive(fd int, events chan<- event) {
+	defer close(events)
+	defer syscall.Close(fd)
+
+	buf := make([]byte, syscall.Getpagesize())
+
+	for {
+		n, _, err := syscall.Recvfrom(fd, buf, 0)
+		if err == syscall.EINTR {
+			continue
+		}
+
+		// The events are lost if the buffer overflows, the processes spawned meanwhile may be untracked.
+		if err == syscall.ENOBUFS {
+			logger.Warnf("process events are lost for the receive buffer overflows")
+
+			continue
+		}
+
+		if err != nil {
+			logger.Errorf("receive process events error: %v", err)
+
+			return
+		}
+
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			continue
+		}
+
+		for _, msg := range msgs {
+			if e, ok := parseEvent(msg.Data); ok {
+				events <- e
+			}
+		}
+	}
+}
+
+// parseEvent parses the data of a proc connector message, the events other than the process fork, exec and
+// exit, e.g. the thread ones, are ignored.
+func parseEvent(data []byte) (event, bool) {
+	if len(data) < cnMsgSize+procEventHeaderSize {
+		return event{}, false
+	}
+
+	what := binary.NativeEndian.Uint32(data[cnMsgSize:])
+	body := data[cnMsgSize+procEventHeaderSize:]
+	field := func(i int) int {
+		return int(int32(binary.NativeEndian.Uint32(body[i*4:])))
+	}
+
+	switch what {
+	case procEventFork:
+		// parent_pid, parent_tgid, child_pid, child_tgid.
+		if len(body) < 16 || field(2) != field(3) {
+			return event{}, false
+		}
+
+		return event{kind: eventFork, pid: field(3), ppid: field(1)}, true
+	case procEventExec:
+		// process_pid, process_tgid.
+		if len(body) < 8 {
+			return event{}, false
+		}
+
+		return event{kind: eventExec, pid: field(1)}, true
+	case procEventExit:
+		// process_pid, process_tgid, exit_code, exit_signal.
+		if len(body) < 8 || field(0) != field(1) {
+			return event{}, false
+		}
+
+		return event{kind: eventExit, pid: field(1)}, true
+	}
+
+	return event{}, false
+}
@@ -0,0 +1,60 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+
+package proctrack
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func TestParseEvent(t *testing.T) {
+	message := func(what uint32, fields ...uint32) []byte {
+		data := make([]byte, cnMsgSize+procEventHeaderSize+len(fields)*4)
+		binary.NativeEndian.PutUint32(data[cnMsgSize:], what)
+
+		for i, f := range fields {
+			binary.NativeEndian.PutUint32(data[cnMsgSize+procEventHeaderSize+i*4:], f)
+		}
+
+		return data
+	}
+
+	tests := []struct {
+		name     string
+		data     []byte
+		expected event
+		ok       bool
+	}{
+		{"fork", message(procEventFork, 10, 10, 11, 11), event{kind: eventFork, pid: 11, ppid: 10}, true},
+		{"fork from thread", message(procEventFork, 12, 10, 13, 13), event{kind: eventFork, pid: 13, ppid: 10}, true},
+		{"thread", message(procEventFork, 10, 10, 11, 10), event{}, false},
+		{"exec", message(procEventExec, 11, 11), event{kind: eventExec, pid: 11}, true},
+		{"exit", message(procEventExit, 11, 11, 0, 17), event{kind: eventExit, pid: 11}, true},
+		{"thread exit", message(procEventExit, 12, 11, 0, 0), event{}, false},
+		{"uid", message(0x4, 11, 11, 0, 0), event{}, false},
+		{"short", message(procEventFork, 10, 10), event{}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, ok := parseEvent(tt.data)
+			if e != tt.expected || ok != tt.ok {
+				t.Errorf("expected %+v %v, got %+v %v", tt.expected, tt.ok, e, ok)
+			}
+		})
+	}
+}
@@ -12,17 +12,12 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-//go:build windows
-// +build windows
+//go:build !linux
 
-package app
+package proctrack
 
-import (
-	client "trust-tunnel/pkg/trust-tunnel-client"
-	"trust-tunnel/pkg/util/logutil"
-)
+import "fmt"
 
-var logger = logutil.GetLogger("trust-tunnel-agent")
-
-func setupSignal(session client.Session) {
+func listen() (<-chan event, error) {
+	return nil, fmt.Errorf("process events are only supported on linux")
 }
@@ -0,0 +1,267 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proctrack
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// The layout of the exec events written by the eBPF tracer: the cgroup ID, the PID, the number of the arguments
+// copied, whether there are more, the path executed and the arguments, each truncated to its size.
+const (
+	maxExecArgs     = 20
+	maxExecArgSize  = 128
+	maxExecPathSize = 256
+
+	eventCgroupOffset    = 0
+	eventPIDOffset       = 8
+	eventArgcOffset      = 12
+	eventTruncatedOffset = 16
+	eventPathOffset      = 24
+	eventArgsOffset      = eventPathOffset + maxExecPathSize
+	eventSize            = eventArgsOffset + maxExecArgs*maxExecArgSize
+)
+
+// cgroupRoot is where the cgroup v2 hierarchy of the host is mounted.
+const cgroupRoot = "/sys/fs/cgroup"
+
+// execEvent is a command executed, traced by eBPF on the entry of the syscall.
+type execEvent struct {
+	cgroup    uint64
+	pid       int
+	path      string
+	args      []string
+	truncated bool
+	time      time.Time
+}
+
+// execTracer dispatches the commands traced by eBPF to the traces by the cgroups executing them.
+var execTracer = struct {
+	lock    sync.Mutex
+	started bool
+	cgroups map[uint64]*CgroupTrace
+	// recent is the ring of the recent events, next is where the next event is put.
+	recent [recentEvents]execEvent
+	next   int
+}{cgroups: make(map[uint64]*CgroupTrace)}
+
+// StartExecTracer starts tracing the commands executed on the host by eBPF, so that the commands of the cgroups
+// traced are recorded with their arguments as they are executed. It requires linux 5.5, cgroup v2, the host PID
+// and cgroup namespaces, and CAP_SYS_ADMIN or CAP_BPF with CAP_PERFMON.
+func StartExecTracer() error {
+	execTracer.lock.Lock()
+	defer execTracer.lock.Unlock()
+
+	if execTracer.started {
+		return nil
+	}
+
+	if _, err := os.Stat(filepath.Join(cgroupRoot, "cgroup.controllers")); err != nil {
+		return fmt.Errorf("cgroup v2 is required at %s: %v", cgroupRoot, err)
+	}
+
+	events, err := listenExecs()
+	if err != nil {
+		return fmt.Errorf("load exec tracer error: %v", err)
+	}
+
+	execTracer.started = true
+
+	go dispatchExecs(events)
+
+	return nil
+}
+
+// ExecTracerEnabled returns whether the eBPF exec tracer is started.
+func ExecTracerEnabled() bool {
+	execTracer.lock.Lock()
+	defer execTracer.lock.Unlock()
+
+	return execTracer.started
+}
+
+// CgroupTrace is the trace of the commands executed in a cgroup.
+type CgroupTrace struct {
+	id     uint64
+	onExec func(Process)
+}
+
+// TraceCgroup calls onExec with the commands executed in the cgroup of the path, including the recent ones executed
+// before, e.g. by the process placed in it. Unlike the process tree, the processes leaving the tree, e.g. by forking
+// twice, are traced as long as they are in the cgroup, so the cgroup must be the session's own.
+func TraceCgroup(path string, onExec func(Process)) (*CgroupTrace, error) {
+	var stat syscall.Stat_t
+	if err := syscall.Stat(path, &stat); err != nil {
+		return nil, fmt.Errorf("stat cgroup %s error: %v", path, err)
+	}
+
+	// The ID of a cgroup v2 is the inode number of its directory.
+	trace := &CgroupTrace{id: stat.Ino, onExec: onExec}
+
+	execTracer.lock.Lock()
+
+	if !execTracer.started {
+		execTracer.lock.Unlock()
+
+		return nil, fmt.Errorf("exec tracer isn't started")
+	}
+
+	execTracer.cgroups[trace.id] = trace
+
+	var executed []execEvent
+
+	for i := 0; i < recentEvents; i++ {
+		if e := execTracer.recent[(execTracer.next+i)%recentEvents]; e.cgroup == trace.id && e.pid != 0 {
+			executed = append(executed, e)
+		}
+	}
+
+	execTracer.lock.Unlock()
+
+	for _, e := range executed {
+		onExec(e.process())
+	}
+
+	return trace, nil
+}
+
+// Close stops tracing the cgroup.
+func (t *CgroupTrace) Close() {
+	execTracer.lock.Lock()
+	defer execTracer.lock.Unlock()
+
+	if execTracer.cgroups[t.id] == t {
+		delete(execTracer.cgroups, t.id)
+	}
+}
+
+// ProcessCgroup returns the path of the cgroup v2 of the process.
+func ProcessCgroup(pid int) (string, error) {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/cgroup", pid))
+	if err != nil {
+		return "", err
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		if p, ok := strings.CutPrefix(line, "0::"); ok {
+			return filepath.Join(cgroupRoot, p), nil
+		}
+	}
+
+	return "", fmt.Errorf("process %d isn't in a cgroup v2", pid)
+}
+
+// dispatchExecs records the recent events, and calls the traces of the cgroups executing them.
+func dispatchExecs(events <-chan execEvent) {
+	for e := range events {
+		execTracer.lock.Lock()
+
+		execTracer.recent[execTracer.next] = e
+		execTracer.next = (execTracer.next + 1) % recentEvents
+		trace := execTracer.cgroups[e.cgroup]
+
+		execTracer.lock.Unlock()
+
+		// The callback may be slow, e.g. writing audit logs, so it's called without the lock.
+		if trace != nil {
+			trace.onExec(e.process())
+		}
+	}
+
+	logger.Warnf("exec events stopped")
+}
+
+// parseExecEvent parses the exec event written by the eBPF tracer.
+func parseExecEvent(data []byte) (execEvent, bool) {
+	if len(data) < eventSize {
+		return execEvent{}, false
+	}
+
+	e := execEvent{
+		cgroup:    binary.NativeEndian.Uint64(data[eventCgroupOffset:]),
+		pid:       int(binary.NativeEndian.Uint32(data[eventPIDOffset:])),
+		path:      cString(data[eventPathOffset : eventPathOffset+maxExecPathSize]),
+		truncated: binary.NativeEndian.Uint32(data[eventTruncatedOffset:]) != 0,
+		time:      time.Now(),
+	}
+
+	argc := min(int(binary.NativeEndian.Uint32(data[eventArgcOffset:])), maxExecArgs)
+	for i := 0; i < argc; i++ {
+		offset := eventArgsOffset + i*maxExecArgSize
+		arg := cString(data[offset : offset+maxExecArgSize])
+
+		// The string copied is always terminated, so the one filling the buffer may be cut.
+		if len(arg) == maxExecArgSize-1 {
+			e.truncated = true
+		}
+
+		e.args = append(e.args, arg)
+	}
+
+	return e, true
+}
+
+// process returns the process executing the command of the event.
+func (e execEvent) process() Process {
+	return Process{
+		PID:        e.pid,
+		PPID:       parentPID(e.pid),
+		Cmd:        strings.Join(e.args, " "),
+		Exe:        e.path,
+		Time:       e.time,
+		Incomplete: e.truncated,
+	}
+}
+
+// cString returns the string terminated by the first NUL in the buffer.
+func cString(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+
+	return string(b)
+}
+
+// parentPID returns the PID of the parent of the process, or 0 if it has exited.
+func parentPID(pid int) int {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0
+	}
+
+	// The fields after the command name, which may contain spaces or parentheses, start from the state.
+	end := strings.LastIndexByte(string(data), ')')
+	if end < 0 {
+		return 0
+	}
+
+	fields := strings.Fields(string(data[end+1:]))
+	if len(fields) < 2 {
+		return 0
+	}
+
+	ppid, _ := strconv.Atoi(fields[1])
+
+	return ppid
+}
@@ -0,0 +1,212 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+
+package proctrack
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/asm"
+	"github.com/cilium/ebpf/link"
+	"github.com/cilium/ebpf/perf"
+	"github.com/cilium/ebpf/rlimit"
+)
+
+// bpfCurrentCPU is BPF_F_CURRENT_CPU, which outputs the event to the perf buffer of the current CPU.
+const bpfCurrentCPU = 0xffffffff
+
+// execTracepoints are the tracepoints of the syscalls executing commands, with the offsets of the path and the
+// arguments in their contexts, see /sys/kernel/tracing/events/syscalls/*/format.
+var execTracepoints = []struct {
+	name       string
+	path, argv int16
+}{
+	{name: "sys_enter_execve", path: 16, argv: 24},
+	{name: "sys_enter_execveat", path: 24, argv: 32},
+}
+
+// listenExecs loads the eBPF programs tracing the entries of execve and execveat, which copy the path and the
+// arguments from the memory of the process as the command is executed, so they can't be missed or replaced as the
+// ones read from /proc afterwards. The commands failing to be executed are traced as well.
+func listenExecs() (<-chan execEvent, error) {
+	// The locked memory is accounted to the cgroup rather than limited by the rlimit since linux 5.11.
+	if err := rlimit.RemoveMemlock(); err != nil {
+		return nil, fmt.Errorf("remove memlock limit error: %v", err)
+	}
+
+	scratch, err := ebpf.NewMap(&ebpf.MapSpec{Type: ebpf.PerCPUArray, KeySize: 4, ValueSize: eventSize, MaxEntries: 1})
+	if err != nil {
+		return nil, fmt.Errorf("create event map error: %v", err)
+	}
+
+	events, err := ebpf.NewMap(&ebpf.MapSpec{Type: ebpf.PerfEventArray})
+	if err != nil {
+		scratch.Close()
+
+		return nil, fmt.Errorf("create perf event map error: %v", err)
+	}
+
+	var links []link.Link
+
+	closeAll := func() {
+		for _, l := range links {
+			l.Close()
+		}
+
+		events.Close()
+		scratch.Close()
+	}
+
+	for _, tp := range execTracepoints {
+		prog, err := ebpf.NewProgram(&ebpf.ProgramSpec{
+			Type:         ebpf.TracePoint,
+			License:      "Dual BSD/GPL",
+			Instructions: execProgram(scratch, events, tp.path, tp.argv),
+		})
+		if err != nil {
+			closeAll()
+
+			return nil, fmt.Errorf("load program of %s error: %v", tp.name, err)
+		}
+
+		l, err := link.Tracepoint("syscalls", tp.name, prog, nil)
+
+		// The program is kept by the link once it's attached.
+		prog.Close()
+
+		if err != nil {
+			closeAll()
+
+			return nil, fmt.Errorf("attach to %s error: %v", tp.name, err)
+		}
+
+		links = append(links, l)
+	}
+
+	reader, err := perf.NewReader(events, 64*os.Getpagesize())
+	if err != nil {
+		closeAll()
+
+		return nil, fmt.Errorf("create perf reader error: %v", err)
+	}
+
+	execs := make(chan execEvent, 1024)
+
+	go readExecs(reader, execs)
+
+	return execs, nil
+}
+
+// execProgram returns the program writing the exec event of the syscall to the perf buffer, whose context has the
+// path and the arguments at the offsets. The event is built in the per-CPU scratch map, for it's larger than the
+// stack, and the loop copying the arguments is unrolled for the verifier.
+func execProgram(scratch, events *ebpf.Map, pathOffset, argvOffset int16) asm.Instructions {
+	insns := asm.Instructions{
+		// r6 is the context, r7 the event in the scratch map, and r8 the arguments.
+		asm.Mov.Reg(asm.R6, asm.R1),
+		asm.StoreImm(asm.RFP, -4, 0, asm.Word),
+		asm.LoadMapPtr(asm.R1, scratch.FD()),
+		asm.Mov.Reg(asm.R2, asm.RFP),
+		asm.Add.Imm(asm.R2, -4),
+		asm.FnMapLookupElem.Call(),
+		asm.JEq.Imm(asm.R0, 0, "exit"),
+		asm.Mov.Reg(asm.R7, asm.R0),
+
+		asm.FnGetCurrentCgroupId.Call(),
+		asm.StoreMem(asm.R7, eventCgroupOffset, asm.R0, asm.DWord),
+		asm.FnGetCurrentPidTgid.Call(),
+		asm.RSh.Imm(asm.R0, 32),
+		asm.StoreMem(asm.R7, eventPIDOffset, asm.R0, asm.Word),
+		asm.StoreImm(asm.R7, eventArgcOffset, 0, asm.Word),
+		asm.StoreImm(asm.R7, eventTruncatedOffset, 0, asm.Word),
+
+		asm.Mov.Reg(asm.R1, asm.R7),
+		asm.Add.Imm(asm.R1, eventPathOffset),
+		asm.Mov.Imm(asm.R2, maxExecPathSize),
+		asm.LoadMem(asm.R3, asm.R6, pathOffset, asm.DWord),
+		asm.FnProbeReadUserStr.Call(),
+		asm.LoadMem(asm.R8, asm.R6, argvOffset, asm.DWord),
+	}
+
+	// The pointer to the argument i is read into the stack, the arguments end at the null one. A pointer after the
+	// last argument copied marks the event truncated.
+	for i := 0; i <= maxExecArgs; i++ {
+		insns = append(insns,
+			asm.Mov.Reg(asm.R1, asm.RFP),
+			asm.Add.Imm(asm.R1, -16),
+			asm.Mov.Imm(asm.R2, 8),
+			asm.Mov.Reg(asm.R3, asm.R8),
+			asm.Add.Imm(asm.R3, int32(i*8)),
+			asm.FnProbeReadUser.Call(),
+			asm.JNE.Imm(asm.R0, 0, "output"),
+			asm.LoadMem(asm.R3, asm.RFP, -16, asm.DWord),
+			asm.JEq.Imm(asm.R3, 0, "output"),
+		)
+
+		if i == maxExecArgs {
+			insns = append(insns, asm.StoreImm(asm.R7, eventTruncatedOffset, 1, asm.Word))
+
+			break
+		}
+
+		insns = append(insns,
+			asm.Mov.Reg(asm.R1, asm.R7),
+			asm.Add.Imm(asm.R1, int32(eventArgsOffset+i*maxExecArgSize)),
+			asm.Mov.Imm(asm.R2, maxExecArgSize),
+			asm.FnProbeReadUserStr.Call(),
+			asm.StoreImm(asm.R7, eventArgcOffset, int64(i+1), asm.Word),
+		)
+	}
+
+	return append(insns,
+		asm.Mov.Reg(asm.R1, asm.R6).WithSymbol("output"),
+		asm.LoadMapPtr(asm.R2, events.FD()),
+		asm.LoadImm(asm.R3, bpfCurrentCPU, asm.DWord),
+		asm.Mov.Reg(asm.R4, asm.R7),
+		asm.Mov.Imm(asm.R5, eventSize),
+		asm.FnPerfEventOutput.Call(),
+		asm.Mov.Imm(asm.R0, 0).WithSymbol("exit"),
+		asm.Return(),
+	)
+}
+
+// readExecs reads the exec events from the perf buffers until it fails.
+func readExecs(reader *perf.Reader, execs chan<- execEvent) {
+	defer close(execs)
+	defer reader.Close()
+
+	for {
+		record, err := reader.Read()
+		if err != nil {
+			logger.Errorf("read exec events error: %v", err)
+
+			return
+		}
+
+		// The events are lost if the buffer overflows, the commands executed meanwhile aren't audited.
+		if record.LostSamples > 0 {
+			logger.Warnf("%d exec events are lost for the perf buffer overflows", record.LostSamples)
+
+			continue
+		}
+
+		if e, ok := parseExecEvent(record.RawSample); ok {
+			execs <- e
+		}
+	}
+}
@@ -0,0 +1,147 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proctrack
+
+import (
+	"encoding/binary"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// testExecEvent returns the exec event written by the eBPF tracer.
+func testExecEvent(cgroup uint64, pid int, path string, args ...string) []byte {
+	data := make([]byte, eventSize)
+	binary.NativeEndian.PutUint64(data[eventCgroupOffset:], cgroup)
+	binary.NativeEndian.PutUint32(data[eventPIDOffset:], uint32(pid))
+	binary.NativeEndian.PutUint32(data[eventArgcOffset:], uint32(min(len(args), maxExecArgs)))
+	copy(data[eventPathOffset:eventPathOffset+maxExecPathSize-1], path)
+
+	for i, arg := range args {
+		if i == maxExecArgs {
+			binary.NativeEndian.PutUint32(data[eventTruncatedOffset:], 1)
+
+			break
+		}
+
+		offset := eventArgsOffset + i*maxExecArgSize
+		copy(data[offset:offset+maxExecArgSize-1], arg)
+	}
+
+	return data
+}
+
+func TestParseExecEvent(t *testing.T) {
+	e, ok := parseExecEvent(testExecEvent(7, 100, "/bin/ls", "ls", "-l", "/tmp"))
+	if !ok || e.cgroup != 7 || e.pid != 100 || e.path != "/bin/ls" || !reflect.DeepEqual(e.args, []string{"ls", "-l", "/tmp"}) || e.truncated {
+		t.Errorf("unexpected event %+v", e)
+	}
+
+	// The arguments beyond the limit, or cut to the size, mark the event truncated.
+	many := make([]string, maxExecArgs+1)
+	for _, args := range [][]string{many, {"echo", strings.Repeat("x", maxExecArgSize)}} {
+		if e, ok = parseExecEvent(testExecEvent(7, 100, "/bin/echo", args...)); !ok || !e.truncated {
+			t.Errorf("event of %d arguments should be truncated, got %+v", len(args), e)
+		}
+	}
+
+	if _, ok = parseExecEvent(make([]byte, eventSize-1)); ok {
+		t.Error("short event should be refused")
+	}
+}
+
+func TestTraceCgroup(t *testing.T) {
+	dir := t.TempDir()
+
+	var stat syscall.Stat_t
+	if err := syscall.Stat(dir, &stat); err != nil {
+		t.Fatal(err)
+	}
+
+	execTracer.lock.Lock()
+	execTracer.started = true
+	execTracer.recent = [recentEvents]execEvent{}
+	execTracer.lock.Unlock()
+
+	defer func() {
+		execTracer.lock.Lock()
+		execTracer.started = false
+		execTracer.lock.Unlock()
+	}()
+
+	events := make(chan execEvent, 8)
+	done := make(chan struct{})
+
+	go func() {
+		dispatchExecs(events)
+		close(done)
+	}()
+
+	parse := func(cgroup uint64, pid int, args ...string) execEvent {
+		e, _ := parseExecEvent(testExecEvent(cgroup, pid, "/bin/"+args[0], args...))
+
+		return e
+	}
+
+	// The command executed in the cgroup before it's traced is replayed.
+	events <- parse(stat.Ino, 100, "sh", "-c", "setsid sleep 1 &")
+	events <- parse(stat.Ino+1, 200, "other")
+
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		execTracer.lock.Lock()
+		n := execTracer.recent[(execTracer.next+recentEvents-1)%recentEvents].pid
+		execTracer.lock.Unlock()
+
+		if n == 200 || time.Now().After(deadline) {
+			break
+		}
+	}
+
+	executed := make(chan Process, 8)
+
+	trace, err := TraceCgroup(dir, func(p Process) { executed <- p })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The daemonized process is traced though it has left the process tree, as it's still in the cgroup.
+	events <- parse(stat.Ino, 300, "sleep", "1")
+
+	var cmds []string
+	for len(cmds) < 2 {
+		select {
+		case p := <-executed:
+			cmds = append(cmds, p.Cmd)
+		case <-time.After(time.Second):
+			t.Fatalf("got commands %q only", cmds)
+		}
+	}
+
+	trace.Close()
+	events <- parse(stat.Ino, 400, "after", "close")
+	close(events)
+	<-done
+	close(executed)
+
+	for p := range executed {
+		cmds = append(cmds, p.Cmd)
+	}
+
+	if want := []string{"sh -c setsid sleep 1 &", "sleep 1"}; !reflect.DeepEqual(cmds, want) {
+		t.Errorf("got commands %q, want %q", cmds, want)
+	}
+}
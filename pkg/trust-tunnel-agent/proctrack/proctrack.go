@@ -0,0 +1,431 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package proctrack tracks the processes spawned within sessions live by the process events of the kernel,
+// so that the processes escaping from their parents, e.g. daemonized ones, are still audited and cleaned.
+package proctrack
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"trust-tunnel/pkg/common/logutil"
+	"trust-tunnel/pkg/common/sessionutil"
+)
+
+// maxProcesses is the maximum number of processes recorded in a tree, the processes beyond it are still
+// tracked for cleanup but not recorded for audit.
+const maxProcesses = 1000
+
+var logger = logutil.GetLogger("trust-tunnel-agent")
+
+// Process is a process spawned within a session.
+type Process struct {
+	PID  int    `json:"pid"`
+	PPID int    `json:"ppid"`
+	Cmd  string `json:"cmd"`
+	// Exe is the path of the executed binary.
+	Exe string `json:"exe,omitempty"`
+	// Time is when the process is forked, or found if it's spawned before the tracking.
+	Time time.Time `json:"time"`
+	// Incomplete is set if the command isn't fully known when the process executes it. The kernel only
+	// notifies the PID, so the command is read from /proc afterwards, when the process may have exited
+	// or executed another command.
+	Incomplete bool `json:"incomplete,omitempty"`
+}
+
+// Tree is the tree of the processes spawned by the root process of a session.
+type Tree struct {
+	lock sync.Mutex
+	root int
+	// processes records the processes in the order of creation.
+	processes []Process
+	// alive is the set of the processes which haven't exited.
+	alive map[int]bool
+	// starts is the start times of the alive processes in clock ticks, so that the processes reusing the PIDs
+	// of the exited ones aren't killed.
+	starts map[int]uint64
+	// dropped is the number of processes not recorded for exceeding maxProcesses.
+	dropped int
+	// onExec is called with the process executing a command if it's set.
+	onExec func(Process)
+}
+
+// Processes returns the processes in the tree in the order of creation.
+func (t *Tree) Processes() []Process {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	return append([]Process(nil), t.processes...)
+}
+
+// Kill sends SIGTERM to the alive descendants of the root process, the later spawned ones are killed first.
+func (t *Tree) Kill() {
+	t.lock.Lock()
+	pids := make([]int, 0, len(t.alive))
+	killed := make(map[int]bool, len(t.alive))
+
+	for i := len(t.processes) - 1; i >= 0; i-- {
+		pid := t.processes[i].PID
+		if pid != t.root && t.alive[pid] && !killed[pid] {
+			pids = append(pids, pid)
+			killed[pid] = true
+		}
+	}
+
+	// The processes not recorded for exceeding maxProcesses.
+	for pid := range t.alive {
+		if pid != t.root && !killed[pid] {
+			pids = append(pids, pid)
+		}
+	}
+
+	starts := make(map[int]uint64, len(pids))
+	for _, pid := range pids {
+		starts[pid] = t.starts[pid]
+	}
+
+	t.lock.Unlock()
+
+	for _, pid := range pids {
+		// The exit event of the process may not be handled yet when its PID is reused, or the start time is
+		// unknown if it has exited before being found.
+		start := startTime(pid)
+		if start == 0 {
+			continue
+		}
+
+		if start != starts[pid] {
+			logger.Warnf("skip killing process %d, whose PID is reused by another process", pid)
+
+			continue
+		}
+
+		syscall.Kill(pid, syscall.SIGTERM)
+	}
+}
+
+// Close stops tracking the processes of the tree, the recorded processes are kept.
+func (t *Tree) Close() {
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+
+	for pid, tree := range tracker.pids {
+		if tree == t {
+			delete(tracker.pids, pid)
+		}
+	}
+}
+
+func (t *Tree) add(p Process) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.alive[p.PID] = true
+
+	if t.starts == nil {
+		t.starts = make(map[int]uint64)
+	}
+
+	t.starts[p.PID] = startTime(p.PID)
+
+	if len(t.processes) >= maxProcesses {
+		t.dropped++
+
+		return
+	}
+
+	t.processes = append(t.processes, p)
+}
+
+// fork records the forked process, whose command line is inherited from its parent until it executes another.
+func (t *Tree) fork(pid, ppid int) {
+	cmd := cmdline(pid)
+	if cmd == "" {
+		cmd = t.cmd(ppid)
+	}
+
+	t.add(Process{PID: pid, PPID: ppid, Cmd: cmd, Time: time.Now()})
+}
+
+func (t *Tree) cmd(pid int) string {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	for i := len(t.processes) - 1; i >= 0; i-- {
+		if t.processes[i].PID == pid {
+			return t.processes[i].Cmd
+		}
+	}
+
+	return ""
+}
+
+// exec records the command executed by the process and returns the process.
+func (t *Tree) exec(pid int) Process {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	exe := executable(pid)
+	p := Process{PID: pid, Cmd: cmdline(pid), Exe: exe, Time: time.Now()}
+	// The binary changing while the command line is read means the process has executed another command.
+	p.Incomplete = p.Cmd == "" || exe == "" || executable(pid) != exe
+
+	for i := len(t.processes) - 1; i >= 0; i-- {
+		if t.processes[i].PID == pid {
+			p.PPID = t.processes[i].PPID
+			t.processes[i].Cmd, t.processes[i].Exe, t.processes[i].Incomplete = p.Cmd, p.Exe, p.Incomplete
+
+			break
+		}
+	}
+
+	return p
+}
+
+func (t *Tree) exit(pid int) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	delete(t.alive, pid)
+	delete(t.starts, pid)
+}
+
+// recentEvents is the number of the recent events kept to be replayed for the processes tracked later,
+// which may have spawned or executed others before the tracking.
+const recentEvents = 4096
+
+// tracker dispatches the process events to the trees by the PIDs.
+var tracker = struct {
+	lock    sync.Mutex
+	started bool
+	pids    map[int]*Tree
+	// recent is the ring of the recent events, next is where the next event is put.
+	recent [recentEvents]event
+	next   int
+}{pids: make(map[int]*Tree)}
+
+// Start starts tracking the process events of the kernel, it requires the host PID namespace and CAP_NET_ADMIN.
+func Start() error {
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+
+	if tracker.started {
+		return nil
+	}
+
+	events, err := listen()
+	if err != nil {
+		return fmt.Errorf("listen process events error: %v", err)
+	}
+
+	tracker.started = true
+
+	go dispatch(events)
+
+	return nil
+}
+
+// Enabled returns whether the process tracking is started.
+func Enabled() bool {
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+
+	return tracker.started
+}
+
+// Track starts tracking the processes spawned by the process with pid, the ones spawned before the tracking are
+// found in the recent events or /proc. onExec is called with the processes executing commands if it's not nil.
+// It returns nil if the tracking isn't started, then the callers should fall back to scan /proc.
+func Track(pid int, onExec func(Process)) *Tree {
+	tracker.lock.Lock()
+
+	if !tracker.started {
+		tracker.lock.Unlock()
+
+		return nil
+	}
+
+	tree := &Tree{root: pid, alive: make(map[int]bool), onExec: onExec}
+	now := time.Now()
+
+	processes, err := sessionutil.GetProcesses()
+	if err != nil {
+		logger.Warnf("find the processes spawned by process %d error: %v", pid, err)
+	}
+
+	ppids := make(map[int]int, len(processes))
+	for _, p := range processes {
+		ppids[p.PID] = p.PPID
+	}
+
+	// Replay the recent events since the process is forked.
+	events := recent()
+	forked := -1
+
+	for i := len(events) - 1; i >= 0 && forked < 0; i-- {
+		if events[i].kind == eventFork && events[i].pid == pid {
+			forked = i
+			ppids[pid] = events[i].ppid
+		}
+	}
+
+	tree.add(Process{PID: pid, PPID: ppids[pid], Cmd: cmdline(pid), Time: now})
+	tracker.pids[pid] = tree
+
+	var executed []Process
+
+	for i := forked + 1; forked >= 0 && i < len(events); i++ {
+		if p, callback := handle(events[i], tree); callback != nil {
+			executed = append(executed, p)
+		}
+	}
+
+	// The processes spawned before the recent events.
+	for _, child := range sessionutil.FindChildProcesses(pid, processes) {
+		if _, ok := tracker.pids[child]; !ok {
+			tree.add(Process{PID: child, PPID: ppids[child], Cmd: cmdline(child), Time: now})
+			tracker.pids[child] = tree
+		}
+	}
+
+	tracker.lock.Unlock()
+
+	for _, p := range executed {
+		onExec(p)
+	}
+
+	return tree
+}
+
+// event is a process event of the kernel.
+type event struct {
+	kind eventKind
+	pid  int
+	ppid int
+}
+
+type eventKind int
+
+const (
+	eventFork eventKind = iota + 1
+	eventExec
+	eventExit
+)
+
+// dispatch records the events of the tracked processes in their trees.
+func dispatch(events <-chan event) {
+	for e := range events {
+		tracker.lock.Lock()
+
+		tracker.recent[tracker.next] = e
+		tracker.next = (tracker.next + 1) % recentEvents
+
+		executed, onExec := handle(e, nil)
+
+		tracker.lock.Unlock()
+
+		// The callback may be slow, e.g. writing audit logs, so it's called without the lock.
+		if onExec != nil {
+			onExec(executed)
+		}
+	}
+
+	logger.Warnf("process events stopped")
+}
+
+// handle records the event in the tree of the process, or only if it's in tree if tree isn't nil.
+// It returns the process executing a command and the callback of its tree for exec events.
+// The caller must hold the lock of the tracker.
+func handle(e event, tree *Tree) (Process, func(Process)) {
+	pid := e.pid
+	if e.kind == eventFork {
+		pid = e.ppid
+	}
+
+	t, ok := tracker.pids[pid]
+	if !ok || (tree != nil && t != tree) {
+		return Process{}, nil
+	}
+
+	switch e.kind {
+	case eventFork:
+		tracker.pids[e.pid] = t
+		t.fork(e.pid, e.ppid)
+	case eventExec:
+		return t.exec(e.pid), t.onExec
+	case eventExit:
+		delete(tracker.pids, e.pid)
+		t.exit(e.pid)
+	}
+
+	return Process{}, nil
+}
+
+// recent returns the recent events in order. The caller must hold the lock of the tracker.
+func recent() []event {
+	events := make([]event, 0, recentEvents)
+
+	for i := 0; i < recentEvents; i++ {
+		if e := tracker.recent[(tracker.next+i)%recentEvents]; e.kind != 0 {
+			events = append(events, e)
+		}
+	}
+
+	return events
+}
+
+// executable returns the path of the binary executed by the process, or empty if it has exited.
+func executable(pid int) string {
+	exe, _ := os.Readlink(fmt.Sprintf("/proc/%d/exe", pid))
+
+	return exe
+}
+
+// startTime returns the start time of the process in clock ticks since the boot, or 0 if it has exited.
+func startTime(pid int) uint64 {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0
+	}
+
+	// The fields after the command name, which may contain spaces or parentheses, start from the state.
+	end := strings.LastIndexByte(string(data), ')')
+	if end < 0 {
+		return 0
+	}
+
+	fields := strings.Fields(string(data[end+1:]))
+	if len(fields) < 20 {
+		return 0
+	}
+
+	start, _ := strconv.ParseUint(fields[19], 10, 64)
+
+	return start
+}
+
+// cmdline returns the command line of the process, or empty if it has exited.
+func cmdline(pid int) string {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid))
+	if err != nil {
+		return ""
+	}
+
+	return strings.TrimSpace(strings.ReplaceAll(string(data), "\x00", " "))
+}
@@ -0,0 +1,214 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proctrack
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestDispatch(t *testing.T) {
+	tree := &Tree{root: 100, alive: map[int]bool{}}
+	tree.add(Process{PID: 100, Cmd: "nsenter"})
+	tracker.lock.Lock()
+	tracker.pids[100] = tree
+	tracker.lock.Unlock()
+
+	events := make(chan event, 8)
+	events <- event{kind: eventFork, pid: 101, ppid: 100}
+	events <- event{kind: eventFork, pid: 201, ppid: 200}
+	events <- event{kind: eventFork, pid: 102, ppid: 101}
+	events <- event{kind: eventExit, pid: 101}
+	// The grandchild daemonized by its parent is still in the tree.
+	events <- event{kind: eventExec, pid: 102}
+	close(events)
+
+	dispatch(events)
+
+	processes := tree.Processes()
+	if len(processes) != 3 || processes[1].PID != 101 || processes[2].PID != 102 || processes[2].PPID != 101 {
+		t.Fatalf("unexpected processes %+v", processes)
+	}
+
+	// The command of the fake process can't be read.
+	if !processes[2].Incomplete {
+		t.Errorf("process 102 isn't incomplete")
+	}
+
+	if tree.alive[101] || !tree.alive[102] {
+		t.Errorf("unexpected alive processes %v", tree.alive)
+	}
+
+	tree.Close()
+
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+
+	if tracker.pids[102] != nil {
+		t.Errorf("process 102 is still tracked")
+	}
+}
+
+func TestReplay(t *testing.T) {
+	tracker.lock.Lock()
+	started := tracker.started
+	tracker.started = true
+	tracker.lock.Unlock()
+
+	defer func() {
+		tracker.lock.Lock()
+		tracker.started = started
+		tracker.lock.Unlock()
+	}()
+
+	// The PIDs beyond the maximum of the kernel never collide with the real ones.
+	const root = 1 << 23
+
+	events := make(chan event, 8)
+	events <- event{kind: eventFork, pid: root, ppid: 1}
+	events <- event{kind: eventFork, pid: root + 1, ppid: root}
+	events <- event{kind: eventExec, pid: root + 1}
+	events <- event{kind: eventExit, pid: root + 1}
+	events <- event{kind: eventFork, pid: root + 2, ppid: root}
+	close(events)
+
+	dispatch(events)
+
+	var executed []Process
+
+	tree := Track(root, func(p Process) {
+		executed = append(executed, p)
+	})
+	defer tree.Close()
+
+	processes := tree.Processes()
+	if len(processes) != 3 || processes[0].PPID != 1 || processes[1].PID != root+1 || processes[2].PID != root+2 {
+		t.Fatalf("unexpected processes %+v", processes)
+	}
+
+	if len(executed) != 1 || executed[0].PID != root+1 || executed[0].PPID != root {
+		t.Errorf("unexpected executed processes %+v", executed)
+	}
+
+	if tree.alive[root+1] || !tree.alive[root+2] {
+		t.Errorf("unexpected alive processes %v", tree.alive)
+	}
+}
+
+func TestTrack(t *testing.T) {
+	if err := Start(); err != nil {
+		t.Skipf("process events are unavailable: %v", err)
+	}
+
+	cmd := exec.Command("sh", "-c", "sleep 30 & (sleep 31 &) ; echo started; wait")
+
+	stdout, _ := cmd.StdoutPipe()
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	executed := make(chan Process, 8)
+
+	tree := Track(cmd.Process.Pid, func(p Process) {
+		executed <- p
+	})
+	defer tree.Close()
+
+	// The children are spawned after the tracking for the output.
+	stdout.Read(make([]byte, 8))
+
+	spawned := func() map[string]bool {
+		cmds := make(map[string]bool)
+		for _, p := range tree.Processes() {
+			cmds[p.Cmd] = true
+		}
+
+		return cmds
+	}
+
+	for i := 0; i < 50 && !spawned()["sleep 31"]; i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	if cmds := spawned(); !cmds["sleep 30"] || !cmds["sleep 31"] {
+		t.Fatalf("unexpected processes %v", cmds)
+	}
+
+	// The exec of the shell itself may be notified too.
+	for sleeps := 0; sleeps < 2; {
+		p := <-executed
+		if !strings.HasPrefix(p.Cmd, "sleep 3") {
+			continue
+		}
+
+		if !strings.HasSuffix(p.Exe, "/sleep") || p.PPID == 0 || p.Incomplete {
+			t.Errorf("unexpected executed process %+v", p)
+		}
+
+		sleeps++
+	}
+
+	tree.Kill()
+	cmd.Wait()
+
+	time.Sleep(100 * time.Millisecond)
+
+	for _, p := range tree.Processes()[1:] {
+		// The orphan may be a zombie if it's not reaped by the init process.
+		stat, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", p.PID))
+		if err == nil && !strings.Contains(string(stat), ") Z ") {
+			t.Errorf("process %d %s is not killed", p.PID, p.Cmd)
+		}
+	}
+}
+
+func TestKillReusedPID(t *testing.T) {
+	cmd := exec.Command("sleep", "30")
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	defer cmd.Process.Kill()
+
+	pid := cmd.Process.Pid
+	if startTime(pid) == 0 {
+		t.Skipf("no start time of process %d", pid)
+	}
+
+	tree := &Tree{root: 1, alive: map[int]bool{}}
+	tree.add(Process{PID: pid, Cmd: "sleep 30"})
+
+	// The process with the PID is taken as another one started later.
+	tree.starts[pid]++
+	tree.Kill()
+
+	time.Sleep(100 * time.Millisecond)
+
+	if err := cmd.Process.Signal(syscall.Signal(0)); err != nil {
+		t.Fatalf("process %d reusing the PID is killed: %v", pid, err)
+	}
+
+	tree.starts[pid]--
+	tree.Kill()
+
+	if err := cmd.Wait(); err == nil {
+		t.Errorf("process %d is not killed", pid)
+	}
+}
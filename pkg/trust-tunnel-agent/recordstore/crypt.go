@@ -0,0 +1,218 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package recordstore
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	// encryptionMagic starts the encrypted recordings.
+	encryptionMagic = "TTREC1\n"
+
+	// chunkSize is the size of the plain text sealed in each chunk of the encrypted recordings.
+	chunkSize = 64 << 10
+)
+
+var errTruncated = errors.New("encrypted recording is truncated")
+
+// ParseKey parses the base64 encoded 32 bytes AES key wrapping the keys of the recordings.
+func ParseKey(s string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid encryption key: %v", err)
+	}
+
+	if len(key) != 32 {
+		return nil, fmt.Errorf("invalid encryption key: %d bytes rather than 32", len(key))
+	}
+
+	return key, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// Encrypt encrypts the recording of src to dst with a random key of its own, which is wrapped by the master key
+// in the header of dst. The recording is sealed with AES-256-GCM in chunks, and the last chunk is marked so that
+// the truncated recordings are detected.
+//
+// The encrypted recording is the magic "TTREC1\n", the 2 bytes big endian length of the wrapped key, the nonce and
+// the sealed key, then the chunks, each of the 4 bytes big endian length and the sealed text, whose nonce is the
+// sequence number of the chunk and whose additional data is 1 for the last chunk and 0 for the others.
+func Encrypt(dst io.Writer, src io.Reader, master []byte) error {
+	wrapper, err := newGCM(master)
+	if err != nil {
+		return err
+	}
+
+	key := make([]byte, 32)
+	nonce := make([]byte, wrapper.NonceSize())
+
+	if _, err = rand.Read(key); err != nil {
+		return err
+	}
+
+	if _, err = rand.Read(nonce); err != nil {
+		return err
+	}
+
+	wrapped := wrapper.Seal(nonce, nonce, key, []byte(encryptionMagic))
+
+	w := bufio.NewWriter(dst)
+	w.WriteString(encryptionMagic)
+	binary.Write(w, binary.BigEndian, uint16(len(wrapped)))
+	w.Write(wrapped)
+
+	aead, err := newGCM(key)
+	if err != nil {
+		return err
+	}
+
+	r := bufio.NewReaderSize(src, chunkSize)
+	plain := make([]byte, chunkSize)
+
+	for seq := uint64(0); ; seq++ {
+		n, err := io.ReadFull(r, plain)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+
+		// The chunk is the last one once the source is drained.
+		last := err != nil
+		if !last {
+			_, err = r.Peek(1)
+			last = err == io.EOF
+		}
+
+		sealed := aead.Seal(nil, chunkNonce(aead, seq), plain[:n], chunkData(last))
+
+		binary.Write(w, binary.BigEndian, uint32(len(sealed)))
+		w.Write(sealed)
+
+		if last {
+			return w.Flush()
+		}
+	}
+}
+
+// Decrypt decrypts the recording encrypted by Encrypt with the master key from src to dst.
+func Decrypt(dst io.Writer, src io.Reader, master []byte) error {
+	r := bufio.NewReader(src)
+
+	magic := make([]byte, len(encryptionMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != encryptionMagic {
+		return fmt.Errorf("not an encrypted recording")
+	}
+
+	var wrappedLen uint16
+	if err := binary.Read(r, binary.BigEndian, &wrappedLen); err != nil {
+		return errTruncated
+	}
+
+	wrapped := make([]byte, wrappedLen)
+	if _, err := io.ReadFull(r, wrapped); err != nil {
+		return errTruncated
+	}
+
+	wrapper, err := newGCM(master)
+	if err != nil {
+		return err
+	}
+
+	if len(wrapped) < wrapper.NonceSize() {
+		return errTruncated
+	}
+
+	key, err := wrapper.Open(nil, wrapped[:wrapper.NonceSize()], wrapped[wrapper.NonceSize():], []byte(encryptionMagic))
+	if err != nil {
+		return fmt.Errorf("unwrap the key of the recording error, the encryption key may be wrong: %v", err)
+	}
+
+	aead, err := newGCM(key)
+	if err != nil {
+		return err
+	}
+
+	for seq := uint64(0); ; seq++ {
+		var sealedLen uint32
+		if err := binary.Read(r, binary.BigEndian, &sealedLen); err != nil {
+			return errTruncated
+		}
+
+		if sealedLen > chunkSize+uint32(aead.Overhead()) {
+			return fmt.Errorf("chunk %d of %d bytes is too large", seq, sealedLen)
+		}
+
+		sealed := make([]byte, sealedLen)
+		if _, err := io.ReadFull(r, sealed); err != nil {
+			return errTruncated
+		}
+
+		last := true
+
+		plain, err := aead.Open(nil, chunkNonce(aead, seq), sealed, chunkData(last))
+		if err != nil {
+			last = false
+
+			if plain, err = aead.Open(nil, chunkNonce(aead, seq), sealed, chunkData(last)); err != nil {
+				return fmt.Errorf("decrypt chunk %d error: %v", seq, err)
+			}
+		}
+
+		if _, err = dst.Write(plain); err != nil {
+			return err
+		}
+
+		if last {
+			if _, err = r.Peek(1); err != io.EOF {
+				return fmt.Errorf("unexpected data after the last chunk")
+			}
+
+			return nil
+		}
+	}
+}
+
+// chunkNonce returns the nonce of the chunk of the sequence number.
+func chunkNonce(aead cipher.AEAD, seq uint64) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], seq)
+
+	return nonce
+}
+
+// chunkData returns the additional data of the chunk, which marks the last one.
+func chunkData(last bool) []byte {
+	if last {
+		return []byte{1}
+	}
+
+	return []byte{0}
+}
@@ -0,0 +1,85 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package recordstore
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+func TestEncrypt(t *testing.T) {
+	master := make([]byte, 32)
+	rand.Read(master)
+
+	for _, size := range []int{0, 10, chunkSize, 3*chunkSize + 7} {
+		plain := make([]byte, size)
+		rand.Read(plain)
+
+		var encrypted bytes.Buffer
+		if err := Encrypt(&encrypted, bytes.NewReader(plain), master); err != nil {
+			t.Fatalf("encrypt %d bytes error: %v", size, err)
+		}
+
+		var decrypted bytes.Buffer
+		if err := Decrypt(&decrypted, bytes.NewReader(encrypted.Bytes()), master); err != nil {
+			t.Fatalf("decrypt %d bytes error: %v", size, err)
+		}
+
+		if !bytes.Equal(decrypted.Bytes(), plain) {
+			t.Errorf("unexpected decrypted %d bytes", size)
+		}
+
+		// The truncated recordings are detected, even if the last chunk is dropped as a whole.
+		if size > chunkSize {
+			truncated := encrypted.Bytes()[:encrypted.Len()-4-size%chunkSize-16]
+			if err := Decrypt(&bytes.Buffer{}, bytes.NewReader(truncated), master); err == nil {
+				t.Errorf("truncated recording of %d bytes should be refused", size)
+			}
+		}
+	}
+
+	var encrypted bytes.Buffer
+	Encrypt(&encrypted, strings.NewReader("secret"), master)
+
+	other := make([]byte, 32)
+	rand.Read(other)
+
+	if err := Decrypt(&bytes.Buffer{}, bytes.NewReader(encrypted.Bytes()), other); err == nil {
+		t.Error("recording should not be decrypted with another key")
+	}
+
+	// Each recording is encrypted with a key of its own.
+	var again bytes.Buffer
+	Encrypt(&again, strings.NewReader("secret"), master)
+
+	if bytes.Equal(encrypted.Bytes(), again.Bytes()) {
+		t.Error("recordings should be encrypted with different keys")
+	}
+}
+
+func TestParseKey(t *testing.T) {
+	if _, err := ParseKey(base64.StdEncoding.EncodeToString(make([]byte, 32))); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	for _, key := range []string{"", "not base64", base64.StdEncoding.EncodeToString(make([]byte, 16))} {
+		if _, err := ParseKey(key); err == nil {
+			t.Errorf("%q should be refused", key)
+		}
+	}
+}
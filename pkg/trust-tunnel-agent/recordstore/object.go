@@ -0,0 +1,235 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package recordstore
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// requestTimeout is the timeout of each request to the object storage.
+const requestTimeout = 2 * time.Minute
+
+// objectClient calls the multipart upload, list and delete APIs shared by S3 and OSS.
+type objectClient struct {
+	endpoint  *url.URL
+	bucket    string
+	pathStyle bool
+	signer    signer
+	http      *http.Client
+	now       func() time.Time
+}
+
+// part is an uploaded part of a multipart upload.
+type part struct {
+	Number int    `xml:"PartNumber" json:"number"`
+	ETag   string `xml:"ETag" json:"etag"`
+}
+
+// object is an object listed in the bucket.
+type object struct {
+	Key          string    `xml:"Key"`
+	LastModified time.Time `xml:"LastModified"`
+}
+
+// storeError is the error responded by the object storage.
+type storeError struct {
+	Status  int
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+func (e *storeError) Error() string {
+	return fmt.Sprintf("%d %s: %s", e.Status, e.Code, e.Message)
+}
+
+// isNoSuchUpload returns whether the error is that the multipart upload is gone, e.g. aborted by the lifecycle
+// rules of the bucket.
+func isNoSuchUpload(err error) bool {
+	e, ok := err.(*storeError)
+
+	return ok && e.Code == "NoSuchUpload"
+}
+
+// do sends the request on the object of the key, or the bucket if it's empty, and decodes the XML response to out
+// if it's not nil.
+func (c *objectClient) do(ctx context.Context, method, key string, query map[string]string, body []byte,
+	out interface{}) (http.Header, error) {
+	u := *c.endpoint
+	path := "/" + key
+
+	if c.pathStyle {
+		path = "/" + c.bucket + path
+	} else {
+		u.Host = c.bucket + "." + u.Host
+	}
+
+	u.Path = path
+	u.RawPath = uriEncode(path, false)
+	u.RawQuery = encodeQuery(query)
+
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(body) > 0 {
+		sum := md5.Sum(body)
+		req.Header.Set("Content-MD5", base64.StdEncoding.EncodeToString(sum[:]))
+	}
+
+	c.signer.sign(req, key, body, c.now())
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	// Completing the multipart uploads may fail after 200 OK is responded.
+	if resp.StatusCode/100 != 2 || bytes.Contains(data, []byte("<Error>")) {
+		e := &storeError{Status: resp.StatusCode}
+		if xml.Unmarshal(data, e) != nil || e.Code == "" {
+			e.Code = http.StatusText(resp.StatusCode)
+		}
+
+		return nil, e
+	}
+
+	if out != nil {
+		if err = xml.Unmarshal(data, out); err != nil {
+			return nil, fmt.Errorf("decode the response of %s %s error: %v", method, key, err)
+		}
+	}
+
+	return resp.Header, nil
+}
+
+// encodeQuery encodes the query as the signatures expect, with the parameters sorted and without values if empty.
+func encodeQuery(query map[string]string) string {
+	pairs := make([]string, 0, len(query))
+
+	for name, value := range query {
+		if value == "" {
+			pairs = append(pairs, uriEncode(name, true))
+		} else {
+			pairs = append(pairs, uriEncode(name, true)+"="+uriEncode(value, true))
+		}
+	}
+
+	sort.Strings(pairs)
+
+	return strings.Join(pairs, "&")
+}
+
+// createUpload initiates a multipart upload of the object and returns its ID.
+func (c *objectClient) createUpload(ctx context.Context, key string) (string, error) {
+	var result struct {
+		UploadID string `xml:"UploadId"`
+	}
+
+	if _, err := c.do(ctx, http.MethodPost, key, map[string]string{"uploads": ""}, nil, &result); err != nil {
+		return "", err
+	}
+
+	return result.UploadID, nil
+}
+
+// uploadPart uploads the part of the number and returns its ETag.
+func (c *objectClient) uploadPart(ctx context.Context, key, uploadID string, number int, data []byte) (string, error) {
+	query := map[string]string{"partNumber": fmt.Sprint(number), "uploadId": uploadID}
+
+	header, err := c.do(ctx, http.MethodPut, key, query, data, nil)
+	if err != nil {
+		return "", err
+	}
+
+	return header.Get("ETag"), nil
+}
+
+// completeUpload completes the multipart upload with the parts.
+func (c *objectClient) completeUpload(ctx context.Context, key, uploadID string, parts []part) error {
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []part   `xml:"Part"`
+	}{Parts: parts})
+	if err != nil {
+		return err
+	}
+
+	_, err = c.do(ctx, http.MethodPost, key, map[string]string{"uploadId": uploadID}, body, nil)
+
+	return err
+}
+
+// list lists the objects of the prefix, calling fn with each page of them.
+func (c *objectClient) list(ctx context.Context, prefix string, fn func(objects []object) error) error {
+	marker := ""
+
+	for {
+		var result struct {
+			IsTruncated bool     `xml:"IsTruncated"`
+			NextMarker  string   `xml:"NextMarker"`
+			Contents    []object `xml:"Contents"`
+		}
+
+		query := map[string]string{"prefix": prefix}
+		if marker != "" {
+			query["marker"] = marker
+		}
+
+		if _, err := c.do(ctx, http.MethodGet, "", query, nil, &result); err != nil {
+			return err
+		}
+
+		if err := fn(result.Contents); err != nil {
+			return err
+		}
+
+		if !result.IsTruncated || len(result.Contents) == 0 {
+			return nil
+		}
+
+		// S3 only responds the next marker with a delimiter, the last key is the marker then.
+		if marker = result.NextMarker; marker == "" {
+			marker = result.Contents[len(result.Contents)-1].Key
+		}
+	}
+}
+
+// delete deletes the object.
+func (c *objectClient) delete(ctx context.Context, key string) error {
+	_, err := c.do(ctx, http.MethodDelete, key, nil, nil, nil)
+
+	return err
+}
@@ -0,0 +1,191 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package recordstore
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// signer signs the requests to the object storage on the object of the key, which is empty for the bucket.
+type signer interface {
+	sign(req *http.Request, key string, body []byte, now time.Time)
+}
+
+// s3Signer signs the requests to S3 with the signature version 4.
+type s3Signer struct {
+	accessKeyID     string
+	secretAccessKey string
+	region          string
+}
+
+func (s *s3Signer) sign(req *http.Request, _ string, body []byte, now time.Time) {
+	payloadHash := sha256.Sum256(body)
+	amzDate := now.UTC().Format("20060102T150405Z")
+	scope := fmt.Sprintf("%s/%s/s3/aws4_request", amzDate[:8], s.region)
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payloadHash[:]))
+
+	// All the headers set are signed along with the host.
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		uriEncode(req.URL.Path, false),
+		canonicalQuery(req),
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, hex.EncodeToString(requestHash[:])}, "\n")
+
+	key := []byte("AWS4" + s.secretAccessKey)
+	for _, part := range []string{amzDate[:8], s.region, "s3", "aws4_request"} {
+		key = hmacSum(sha256.New, key, part)
+	}
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKeyID, scope, signedHeaders, hex.EncodeToString(hmacSum(sha256.New, key, stringToSign))))
+}
+
+// canonicalQuery returns the query of the request sorted and encoded as signed by S3.
+func canonicalQuery(req *http.Request) string {
+	query := req.URL.Query()
+
+	pairs := make([]string, 0, len(query))
+	for name, values := range query {
+		for _, value := range values {
+			pairs = append(pairs, uriEncode(name, true)+"="+uriEncode(value, true))
+		}
+	}
+
+	sort.Strings(pairs)
+
+	return strings.Join(pairs, "&")
+}
+
+// ossSubResources are the query parameters of the requests signed by OSS.
+var ossSubResources = map[string]bool{"uploads": true, "uploadId": true, "partNumber": true}
+
+// ossSigner signs the requests to Alibaba Cloud OSS with the signature version 1.
+type ossSigner struct {
+	accessKeyID     string
+	accessKeySecret string
+	bucket          string
+}
+
+func (s *ossSigner) sign(req *http.Request, key string, _ []byte, now time.Time) {
+	req.Header.Set("Date", now.UTC().Format(http.TimeFormat))
+
+	var ossHeaders []string
+
+	for name, values := range req.Header {
+		if name = strings.ToLower(name); strings.HasPrefix(name, "x-oss-") {
+			ossHeaders = append(ossHeaders, name+":"+strings.TrimSpace(strings.Join(values, ","))+"\n")
+		}
+	}
+
+	sort.Strings(ossHeaders)
+
+	// The resource is the bucket and the object key as is, whichever way the bucket is addressed.
+	resource := "/" + s.bucket + "/" + key
+
+	var subResources []string
+
+	for name, values := range req.URL.Query() {
+		if !ossSubResources[name] {
+			continue
+		}
+
+		if values[0] == "" {
+			subResources = append(subResources, name)
+		} else {
+			subResources = append(subResources, name+"="+values[0])
+		}
+	}
+
+	if len(subResources) > 0 {
+		sort.Strings(subResources)
+		resource += "?" + strings.Join(subResources, "&")
+	}
+
+	stringToSign := strings.Join([]string{
+		req.Method,
+		req.Header.Get("Content-MD5"),
+		req.Header.Get("Content-Type"),
+		req.Header.Get("Date"),
+		strings.Join(ossHeaders, "") + resource,
+	}, "\n")
+
+	signature := base64.StdEncoding.EncodeToString(hmacSum(sha1.New, []byte(s.accessKeySecret), stringToSign))
+	req.Header.Set("Authorization", "OSS "+s.accessKeyID+":"+signature)
+}
+
+func hmacSum(h func() hash.Hash, key []byte, data string) []byte {
+	mac := hmac.New(h, key)
+	mac.Write([]byte(data))
+
+	return mac.Sum(nil)
+}
+
+// uriEncode encodes the string as RFC 3986 like the signatures of S3 expect, the slashes are kept unless slash
+// is true.
+func uriEncode(s string, slash bool) string {
+	var b strings.Builder
+
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !slash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+
+	return b.String()
+}
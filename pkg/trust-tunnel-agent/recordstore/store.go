@@ -0,0 +1,484 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package recordstore uploads the session recordings to object storage, Amazon S3 or the compatible stores and
+// Alibaba Cloud OSS, so that they survive the loss of the node. The recordings are uploaded once the sessions end,
+// each encrypted with a random key of its own wrapped by the configured key, and the uploads interrupted by
+// restarts of the agent are resumed from the parts already uploaded.
+package recordstore
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"trust-tunnel/pkg/common/logutil"
+	"trust-tunnel/pkg/trust-tunnel-agent/monitor"
+)
+
+// The drivers of the object storage.
+const (
+	DriverS3  = "s3"
+	DriverOSS = "oss"
+)
+
+const (
+	defaultInterval = time.Minute
+
+	// sweepInterval is the interval of deleting the recordings beyond the retention.
+	sweepInterval = time.Hour
+
+	// partSize is the size of the parts of the multipart uploads, at least 5 MiB as S3 requires.
+	partSize = 8 << 20
+
+	// recordingSuffix is the suffix of the recordings, and encryptedSuffix is appended to it once encrypted.
+	recordingSuffix = ".cast"
+	encryptedSuffix = ".enc"
+
+	// stateSuffix is appended to the recordings being uploaded for the state of their multipart uploads.
+	stateSuffix = ".upload"
+
+	// tmpSuffix is appended to the recordings being encrypted.
+	tmpSuffix = ".tmp"
+)
+
+var logger = logutil.GetLogger("trust-tunnel-agent")
+
+// Config specifies the object storage the recordings are uploaded to.
+type Config struct {
+	// Driver is "s3" for Amazon S3 or the compatible stores, e.g. MinIO, or "oss" for Alibaba Cloud OSS.
+	// The recordings are only kept in record_dir if it's empty.
+	Driver string `toml:"driver"`
+
+	// Endpoint is the URL of the service, e.g. "https://s3.us-east-1.amazonaws.com" or
+	// "https://oss-cn-hangzhou.aliyuncs.com".
+	Endpoint string `toml:"endpoint"`
+
+	// Region is the region of the bucket signing the requests to S3, e.g. "us-east-1".
+	Region string `toml:"region"`
+
+	Bucket string `toml:"bucket"`
+
+	// PathStyle addresses the bucket in the path of the URLs rather than the host name, as the stores compatible
+	// with S3 may require.
+	PathStyle bool `toml:"path_style"`
+
+	// Prefix is prepended to the keys of the recordings, <prefix><node>/<recording file>.
+	Prefix string `toml:"prefix"`
+
+	// Node names this agent in the keys of the recordings. Defaults to the hostname.
+	Node string `toml:"node"`
+
+	AccessKeyID string `toml:"access_key_id"`
+
+	// SecretAccessKey is the secret of the access key, e.g. "env://TRUST_TUNNEL_RECORD_SECRET".
+	SecretAccessKey string `toml:"secret_access_key"`
+
+	// EncryptionKey is the base64 encoded 32 bytes AES key wrapping the random key encrypting each recording,
+	// e.g. "file:///run/secrets/record-key". The recordings are uploaded unencrypted if it's empty.
+	EncryptionKey string `toml:"encryption_key"`
+
+	// Retention is how long the recordings of this node are kept in the bucket, they're kept forever if it's not
+	// positive.
+	Retention time.Duration `toml:"retention"`
+
+	// Interval is the interval of retrying the failed uploads. Defaults to 1m.
+	Interval time.Duration `toml:"interval"`
+}
+
+// uploadState is the state of the multipart upload of a recording, saved to resume it once the agent restarts.
+type uploadState struct {
+	Key      string `json:"key"`
+	UploadID string `json:"upload_id"`
+	// Parts are the parts uploaded in order.
+	Parts []part `json:"parts"`
+}
+
+// Uploader uploads the recordings of the directory once they're finished.
+type Uploader struct {
+	config *Config
+	dir    string
+	key    []byte
+	client *objectClient
+
+	lock sync.Mutex
+	// active are the paths of the recordings being written.
+	active map[string]struct{}
+	// wake wakes the upload loop once a recording is finished.
+	wake chan struct{}
+}
+
+// New creates the uploader of the recordings in the directory, it's nil if no driver is configured.
+func New(c *Config, dir string) (*Uploader, error) {
+	if c.Driver == "" {
+		return nil, nil
+	}
+
+	if dir == "" {
+		return nil, fmt.Errorf("record_dir is required to upload the recordings")
+	}
+
+	var s signer
+
+	switch c.Driver {
+	case DriverS3:
+		if c.Region == "" {
+			return nil, fmt.Errorf("region is required by %s", c.Driver)
+		}
+
+		s = &s3Signer{accessKeyID: c.AccessKeyID, secretAccessKey: c.SecretAccessKey, region: c.Region}
+	case DriverOSS:
+		s = &ossSigner{accessKeyID: c.AccessKeyID, accessKeySecret: c.SecretAccessKey, bucket: c.Bucket}
+	default:
+		return nil, fmt.Errorf("unknown driver %q, %q or %q is supported", c.Driver, DriverS3, DriverOSS)
+	}
+
+	endpoint, err := url.Parse(c.Endpoint)
+	if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid endpoint %q", c.Endpoint)
+	}
+
+	if c.Bucket == "" || c.AccessKeyID == "" || c.SecretAccessKey == "" {
+		return nil, fmt.Errorf("bucket, access_key_id and secret_access_key are required")
+	}
+
+	u := &Uploader{
+		config: c,
+		dir:    dir,
+		client: &objectClient{
+			endpoint:  endpoint,
+			bucket:    c.Bucket,
+			pathStyle: c.PathStyle,
+			signer:    s,
+			http:      &http.Client{},
+			now:       time.Now,
+		},
+		active: make(map[string]struct{}),
+		wake:   make(chan struct{}, 1),
+	}
+
+	if c.EncryptionKey != "" {
+		if u.key, err = ParseKey(c.EncryptionKey); err != nil {
+			return nil, err
+		}
+	}
+
+	if c.Node == "" {
+		if c.Node, err = os.Hostname(); err != nil {
+			return nil, fmt.Errorf("node name is required: %v", err)
+		}
+	}
+
+	return u, nil
+}
+
+// Create creates a recording with create, which isn't uploaded until it's finished by Finish.
+func (u *Uploader) Create(create func() (string, *os.File, error)) (string, *os.File, error) {
+	if u == nil {
+		return create()
+	}
+
+	// The recording is marked active before the upload loop may find it.
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	path, f, err := create()
+	if err == nil {
+		u.active[path] = struct{}{}
+	}
+
+	return path, f, err
+}
+
+// Finish marks the recording finished, which is uploaded then.
+func (u *Uploader) Finish(path string) {
+	if u == nil {
+		return
+	}
+
+	u.lock.Lock()
+	delete(u.active, path)
+	u.lock.Unlock()
+
+	select {
+	case u.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run uploads the finished recordings, including the ones left by the previous runs of the agent, and retries the
+// failed uploads periodically. It deletes the recordings beyond the retention as well.
+func (u *Uploader) Run() {
+	interval := u.config.Interval
+	if interval <= 0 {
+		interval = defaultInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var swept time.Time
+
+	for {
+		u.uploadAll(context.Background())
+
+		if u.config.Retention > 0 && time.Since(swept) >= sweepInterval {
+			if err := u.sweep(context.Background()); err != nil {
+				logger.Errorf("expire the recordings error: %v", err)
+			}
+
+			swept = time.Now()
+		}
+
+		select {
+		case <-ticker.C:
+		case <-u.wake:
+		}
+	}
+}
+
+// uploadAll uploads the finished recordings of the directory.
+func (u *Uploader) uploadAll(ctx context.Context) {
+	entries, err := os.ReadDir(u.dir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.Errorf("read the recordings in %s error: %v", u.dir, err)
+		}
+
+		return
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.Type().IsRegular() ||
+			(!strings.HasSuffix(name, recordingSuffix) && !strings.HasSuffix(name, recordingSuffix+encryptedSuffix)) {
+			continue
+		}
+
+		path := filepath.Join(u.dir, name)
+
+		u.lock.Lock()
+		_, active := u.active[path]
+		u.lock.Unlock()
+
+		if active {
+			continue
+		}
+
+		if err = u.upload(ctx, path); err != nil {
+			monitor.MetricsRecordingUploads.WithLabelValues("failed").Inc()
+			logger.Errorf("upload the recording %s error: %v", path, err)
+
+			continue
+		}
+
+		monitor.MetricsRecordingUploads.WithLabelValues("uploaded").Inc()
+	}
+}
+
+// upload encrypts the recording if the key is configured, uploads it and removes it once uploaded.
+func (u *Uploader) upload(ctx context.Context, path string) error {
+	if u.key != nil && strings.HasSuffix(path, recordingSuffix) {
+		encrypted := path + encryptedSuffix
+
+		// The encrypted recording is complete once it exists, and the upload of it may have been started.
+		if _, err := os.Stat(encrypted); os.IsNotExist(err) {
+			if err = encryptFile(path, encrypted, u.key); err != nil {
+				return fmt.Errorf("encrypt error: %v", err)
+			}
+		}
+
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+
+		path = encrypted
+	}
+
+	key := u.config.Prefix + u.config.Node + "/" + filepath.Base(path)
+
+	state, err := loadState(path + stateSuffix)
+	if err != nil {
+		return err
+	}
+
+	if state == nil || state.Key != key {
+		uploadID, err := u.client.createUpload(ctx, key)
+		if err != nil {
+			return err
+		}
+
+		state = &uploadState{Key: key, UploadID: uploadID}
+		if err = saveState(path+stateSuffix, state); err != nil {
+			return err
+		}
+	}
+
+	if err = u.uploadParts(ctx, path, state); err == nil {
+		err = u.client.completeUpload(ctx, key, state.UploadID, state.Parts)
+	}
+
+	if err != nil {
+		// The upload is started over if it's gone, e.g. aborted by the lifecycle rules of the bucket.
+		if isNoSuchUpload(err) {
+			os.Remove(path + stateSuffix)
+		}
+
+		return err
+	}
+
+	logger.Infof("uploaded the recording %s to %s", path, key)
+
+	if err = os.Remove(path + stateSuffix); err != nil {
+		return err
+	}
+
+	return os.Remove(path)
+}
+
+// uploadParts uploads the parts of the recording not uploaded yet, saving the state after each part.
+func (u *Uploader) uploadParts(ctx context.Context, path string, state *uploadState) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, partSize)
+
+	// An empty recording is uploaded as a single empty part.
+	for offset := int64(len(state.Parts)) * partSize; offset < info.Size() || len(state.Parts) == 0; offset += partSize {
+		n, err := f.ReadAt(buf, offset)
+		if err != nil && err != io.EOF {
+			return err
+		}
+
+		number := len(state.Parts) + 1
+
+		etag, err := u.client.uploadPart(ctx, state.Key, state.UploadID, number, buf[:n])
+		if err != nil {
+			return err
+		}
+
+		state.Parts = append(state.Parts, part{Number: number, ETag: etag})
+		if err = saveState(path+stateSuffix, state); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// sweep deletes the recordings of this node beyond the retention.
+func (u *Uploader) sweep(ctx context.Context) error {
+	expiry := time.Now().Add(-u.config.Retention)
+
+	return u.client.list(ctx, u.config.Prefix+u.config.Node+"/", func(objects []object) error {
+		for _, o := range objects {
+			if !o.LastModified.Before(expiry) {
+				continue
+			}
+
+			if err := u.client.delete(ctx, o.Key); err != nil {
+				return err
+			}
+
+			monitor.MetricsRecordingUploads.WithLabelValues("expired").Inc()
+			logger.Infof("deleted the recording %s beyond the retention", o.Key)
+		}
+
+		return nil
+	})
+}
+
+// encryptFile encrypts the recording of src to dst, which is created once the recording is encrypted completely.
+func encryptFile(src, dst string, key []byte) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	tmp := dst + tmpSuffix
+
+	out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+
+	if err = Encrypt(out, in, key); err == nil {
+		err = out.Sync()
+	}
+
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err == nil {
+		err = os.Rename(tmp, dst)
+	}
+
+	if err != nil {
+		os.Remove(tmp)
+	}
+
+	return err
+}
+
+// loadState loads the state of the upload, it's nil if the upload isn't started.
+func loadState(path string) (*uploadState, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	state := &uploadState{}
+	if err = json.Unmarshal(data, state); err != nil {
+		// The state written partially is discarded, and the upload is started over.
+		logger.Warnf("discard the upload state %s: %v", path, err)
+
+		return nil, nil
+	}
+
+	return state, nil
+}
+
+// saveState saves the state of the upload atomically.
+func saveState(path string, state *uploadState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	tmp := path + tmpSuffix
+	if err = os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
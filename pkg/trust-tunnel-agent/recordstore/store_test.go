@@ -0,0 +1,316 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package recordstore
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeStore is an object storage serving the multipart upload, list and delete APIs in the path style.
+type fakeStore struct {
+	t    *testing.T
+	lock sync.Mutex
+
+	uploads  map[string]map[int][]byte
+	objects  map[string][]byte
+	modified map[string]time.Time
+	// partPuts counts the uploads of the parts, and failPart fails the upload of the part of the number once.
+	partPuts int
+	failPart int
+}
+
+func newFakeStore(t *testing.T) (*fakeStore, *httptest.Server) {
+	s := &fakeStore{
+		t:        t,
+		uploads:  make(map[string]map[int][]byte),
+		objects:  make(map[string][]byte),
+		modified: make(map[string]time.Time),
+	}
+
+	server := httptest.NewServer(s)
+	t.Cleanup(server.Close)
+
+	return s, server
+}
+
+func (s *fakeStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AK/") {
+		http.Error(w, "<Error><Code>AccessDenied</Code></Error>", http.StatusForbidden)
+
+		return
+	}
+
+	body, _ := io.ReadAll(r.Body)
+	if sum := md5.Sum(body); len(body) > 0 && r.Header.Get("Content-MD5") != base64.StdEncoding.EncodeToString(sum[:]) {
+		http.Error(w, "<Error><Code>BadDigest</Code></Error>", http.StatusBadRequest)
+
+		return
+	}
+
+	key := strings.TrimPrefix(r.URL.Path, "/bucket/")
+	query := r.URL.Query()
+	uploadID := query.Get("uploadId")
+
+	switch {
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		uploadID = fmt.Sprintf("upload-%d", len(s.uploads))
+		s.uploads[uploadID] = make(map[int][]byte)
+		fmt.Fprintf(w, "<InitiateMultipartUploadResult><UploadId>%s</UploadId></InitiateMultipartUploadResult>", uploadID)
+	case r.Method == http.MethodPut && uploadID != "":
+		number, _ := strconv.Atoi(query.Get("partNumber"))
+		if s.uploads[uploadID] == nil {
+			http.Error(w, "<Error><Code>NoSuchUpload</Code></Error>", http.StatusNotFound)
+
+			return
+		}
+
+		s.partPuts++
+		if number == s.failPart {
+			s.failPart = 0
+			http.Error(w, "<Error><Code>InternalError</Code></Error>", http.StatusInternalServerError)
+
+			return
+		}
+
+		s.uploads[uploadID][number] = body
+		w.Header().Set("ETag", etag(body))
+	case r.Method == http.MethodPost && uploadID != "":
+		var complete struct {
+			Parts []part `xml:"Part"`
+		}
+
+		xml.Unmarshal(body, &complete)
+
+		var object []byte
+
+		for i, p := range complete.Parts {
+			data, ok := s.uploads[uploadID][p.Number]
+			if !ok || p.Number != i+1 || p.ETag != etag(data) {
+				fmt.Fprint(w, "<Error><Code>InvalidPart</Code></Error>")
+
+				return
+			}
+
+			object = append(object, data...)
+		}
+
+		delete(s.uploads, uploadID)
+		s.objects[key] = object
+		s.modified[key] = time.Now()
+	case r.Method == http.MethodGet && key == "":
+		var keys []string
+
+		for k := range s.objects {
+			if strings.HasPrefix(k, query.Get("prefix")) && k > query.Get("marker") {
+				keys = append(keys, k)
+			}
+		}
+
+		sort.Strings(keys)
+
+		// A page lists a single object, so the pages are walked with the markers.
+		fmt.Fprintf(w, "<ListBucketResult><IsTruncated>%v</IsTruncated>", len(keys) > 1)
+
+		for _, k := range keys[:min(len(keys), 1)] {
+			fmt.Fprintf(w, "<Contents><Key>%s</Key><LastModified>%s</LastModified></Contents>", k,
+				s.modified[k].UTC().Format(time.RFC3339))
+		}
+
+		fmt.Fprint(w, "</ListBucketResult>")
+	case r.Method == http.MethodDelete:
+		delete(s.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		s.t.Errorf("unexpected request %s %s", r.Method, r.URL)
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+// etag returns the ETag of the data, the quoted MD5 of it.
+func etag(data []byte) string {
+	sum := md5.Sum(data)
+
+	return fmt.Sprintf("%q", hex.EncodeToString(sum[:]))
+}
+
+func TestUploader(t *testing.T) {
+	store, server := newFakeStore(t)
+	dir := t.TempDir()
+
+	master := make([]byte, 32)
+	rand.Read(master)
+
+	u, err := New(&Config{
+		Driver:          DriverS3,
+		Endpoint:        server.URL,
+		Region:          "us-east-1",
+		Bucket:          "bucket",
+		PathStyle:       true,
+		Prefix:          "rec/",
+		Node:            "node-1",
+		AccessKeyID:     "AK",
+		SecretAccessKey: "SK",
+		EncryptionKey:   base64.StdEncoding.EncodeToString(master),
+		Retention:       time.Hour,
+	}, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The recording left by the previous run spans two parts, and the second part fails at first.
+	finished := make([]byte, partSize+10)
+	rand.Read(finished)
+	os.WriteFile(filepath.Join(dir, "a.cast"), finished, 0o600)
+
+	store.failPart = 2
+
+	path, f, err := u.Create(func() (string, *os.File, error) {
+		path := filepath.Join(dir, "b.cast")
+		f, err := os.Create(path)
+
+		return path, f, err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f.WriteString("active\n")
+	f.Close()
+
+	ctx := context.Background()
+
+	u.uploadAll(ctx)
+
+	// The recording is encrypted before it's uploaded, and the upload is resumed from the part uploaded.
+	if _, err = os.Stat(filepath.Join(dir, "a.cast")); !os.IsNotExist(err) {
+		t.Errorf("plain recording should be removed once encrypted: %v", err)
+	}
+
+	state, _ := loadState(filepath.Join(dir, "a.cast.enc.upload"))
+	if state == nil || len(state.Parts) != 1 {
+		t.Fatalf("unexpected upload state %+v", state)
+	}
+
+	u.uploadAll(ctx)
+
+	if store.partPuts != 3 {
+		t.Errorf("unexpected %d uploads of the parts, the uploaded part should not be uploaded again", store.partPuts)
+	}
+
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 || entries[0].Name() != "b.cast" {
+		t.Errorf("unexpected files left %v", entries)
+	}
+
+	var decrypted bytes.Buffer
+	if err = Decrypt(&decrypted, bytes.NewReader(store.objects["rec/node-1/a.cast.enc"]), master); err != nil ||
+		!bytes.Equal(decrypted.Bytes(), finished) {
+		t.Fatalf("unexpected uploaded recording: %v", err)
+	}
+
+	// The active recording is uploaded once it's finished.
+	if _, ok := store.objects["rec/node-1/b.cast.enc"]; ok {
+		t.Fatal("active recording should not be uploaded")
+	}
+
+	u.Finish(path)
+	u.uploadAll(ctx)
+
+	if _, ok := store.objects["rec/node-1/b.cast.enc"]; !ok {
+		t.Fatal("finished recording is not uploaded")
+	}
+
+	// The upload gone is started over.
+	os.WriteFile(filepath.Join(dir, "c.cast.enc"), []byte("encrypted"), 0o600)
+	saveState(filepath.Join(dir, "c.cast.enc.upload"), &uploadState{Key: "rec/node-1/c.cast.enc", UploadID: "gone"})
+
+	if err = u.upload(ctx, filepath.Join(dir, "c.cast.enc")); !isNoSuchUpload(err) {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	if err = u.upload(ctx, filepath.Join(dir, "c.cast.enc")); err != nil || string(store.objects["rec/node-1/c.cast.enc"]) != "encrypted" {
+		t.Fatalf("upload is not started over: %v", err)
+	}
+
+	// The recordings of this node beyond the retention are deleted.
+	store.modified["rec/node-1/a.cast.enc"] = time.Now().Add(-2 * time.Hour)
+	store.objects["rec/node-2/old.cast"] = nil
+	store.modified["rec/node-2/old.cast"] = time.Now().Add(-2 * time.Hour)
+
+	if err = u.sweep(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	var keys []string
+	for k := range store.objects {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	if strings.Join(keys, " ") != "rec/node-1/b.cast.enc rec/node-1/c.cast.enc rec/node-2/old.cast" {
+		t.Errorf("unexpected recordings kept %v", keys)
+	}
+}
+
+func TestNew(t *testing.T) {
+	if u, err := New(&Config{}, ""); u != nil || err != nil {
+		t.Errorf("unexpected uploader %v %v", u, err)
+	}
+
+	valid := Config{Driver: DriverOSS, Endpoint: "https://oss-cn-hangzhou.aliyuncs.com", Bucket: "b", AccessKeyID: "a", SecretAccessKey: "s"}
+	if _, err := New(&valid, "/recordings"); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	for _, modify := range []func(c *Config){
+		func(c *Config) { c.Driver = "gcs" },
+		func(c *Config) { c.Driver = DriverS3 },
+		func(c *Config) { c.Endpoint = "oss-cn-hangzhou.aliyuncs.com" },
+		func(c *Config) { c.Bucket = "" },
+		func(c *Config) { c.EncryptionKey = "short" },
+	} {
+		c := valid
+		modify(&c)
+
+		if _, err := New(&c, "/recordings"); err == nil {
+			t.Errorf("%+v should be refused", c)
+		}
+	}
+
+	if _, err := New(&valid, ""); err == nil {
+		t.Error("record_dir should be required")
+	}
+}
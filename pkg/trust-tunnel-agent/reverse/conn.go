@@ -0,0 +1,84 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package reverse
+
+import (
+	"io"
+	"net"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// websocketConn adapts a websocket connection to a byte stream, in which data is carried by binary messages.
+type websocketConn struct {
+	*websocket.Conn
+
+	// reader is the reader of the current message.
+	reader io.Reader
+}
+
+var _ net.Conn = &websocketConn{}
+
+func newWebsocketConn(conn *websocket.Conn) *websocketConn {
+	return &websocketConn{Conn: conn}
+}
+
+func (c *websocketConn) Read(p []byte) (int, error) {
+	for {
+		if c.reader == nil {
+			msgType, reader, err := c.NextReader()
+			if err != nil {
+				return 0, err
+			}
+
+			if msgType != websocket.BinaryMessage {
+				continue
+			}
+
+			c.reader = reader
+		}
+
+		n, err := c.reader.Read(p)
+		if err == io.EOF {
+			// Move on to the next message.
+			c.reader = nil
+
+			if n == 0 {
+				continue
+			}
+
+			err = nil
+		}
+
+		return n, err
+	}
+}
+
+func (c *websocketConn) Write(p []byte) (int, error) {
+	if err := c.WriteMessage(websocket.BinaryMessage, p); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+func (c *websocketConn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+
+	return c.SetWriteDeadline(t)
+}
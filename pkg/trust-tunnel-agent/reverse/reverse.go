@@ -0,0 +1,191 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package reverse implements the outbound-only mode of the agent, in which the agent dials the controller
+// instead of listening on an inbound port.
+//
+// The agent keeps a websocket connection to the controller, and the connection is multiplexed with yamux,
+// in which the controller opens a stream for each session request. Every stream carries the same HTTP/websocket
+// protocol as the inbound port, so the controller can pass it to client.Client.Start directly.
+package reverse
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+	"trust-tunnel/pkg/common/logutil"
+	"trust-tunnel/pkg/trust-tunnel-client/fips"
+
+	"github.com/gorilla/websocket"
+	"github.com/hashicorp/yamux"
+)
+
+var logger = logutil.GetLogger("trust-tunnel-agent")
+
+const (
+	defaultReconnectInterval = 5 * time.Second
+	maxReconnectInterval     = time.Minute
+	defaultHandshakeTimeout  = 30 * time.Second
+	stableConnectionDuration = time.Minute
+	headerAgentInstance      = "Agent-Instance"
+	headerAgentAddr          = "Agent-Addr"
+)
+
+// Config specifies the outbound-only mode.
+type Config struct {
+	// Enabled indicates whether the agent dials the controller instead of listening on the inbound port.
+	Enabled bool `toml:"enabled"`
+
+	// ControllerURL is the websocket URL of the controller, e.g. "wss://controller.example.com/agents/connect".
+	// It must be wss://.
+	ControllerURL string `toml:"controller_url"`
+
+	// TLSCA is the path of the CA certificate to verify the controller, it's required.
+	TLSCA string `toml:"tls_ca"`
+
+	// TLSCert and TLSKey are the paths of the certificate and key to authenticate the agent to the controller.
+	TLSCert string `toml:"tls_cert"`
+	TLSKey  string `toml:"tls_key"`
+
+	// ReconnectInterval is the initial interval of reconnecting to the controller, defaults to 5 seconds.
+	// The interval is doubled on every failure, up to 1 minute.
+	ReconnectInterval time.Duration `toml:"reconnect_interval"`
+}
+
+// Agent identifies the agent to the controller.
+type Agent struct {
+	// Instance is the ID of the agent instance.
+	Instance string
+
+	// Addr is the main IP of the host.
+	Addr string
+}
+
+// Serve connects to the controller and serves the session requests from it with the handler.
+// It reconnects to the controller when the connection is lost, and never returns unless the config is invalid.
+func Serve(config *Config, agent *Agent, handler http.Handler) error {
+	dialer, err := newDialer(config)
+	if err != nil {
+		return err
+	}
+
+	interval := config.ReconnectInterval
+	if interval <= 0 {
+		interval = defaultReconnectInterval
+	}
+
+	backoff := interval
+
+	for {
+		start := time.Now()
+
+		err := serveOnce(dialer, config.ControllerURL, agent, handler)
+		logger.Warnf("connection to controller %s is lost: %v", config.ControllerURL, err)
+
+		// Reset the backoff if the connection has been stable for a while.
+		if time.Since(start) > stableConnectionDuration {
+			backoff = interval
+		}
+
+		time.Sleep(backoff)
+
+		backoff *= 2
+		if backoff > maxReconnectInterval {
+			backoff = maxReconnectInterval
+		}
+	}
+}
+
+// serveOnce connects to the controller and serves the requests until the connection is lost.
+func serveOnce(dialer *websocket.Dialer, controllerURL string, agent *Agent, handler http.Handler) error {
+	header := http.Header{}
+	header.Set(headerAgentInstance, agent.Instance)
+	header.Set(headerAgentAddr, agent.Addr)
+
+	conn, resp, err := dialer.Dial(controllerURL, header)
+	if resp != nil && resp.Body != nil {
+		resp.Body.Close()
+	}
+
+	if err != nil {
+		return fmt.Errorf("dial controller error: %v", err)
+	}
+
+	logger.Infof("connected to controller %s", controllerURL)
+
+	session, err := yamux.Server(newWebsocketConn(conn), yamux.DefaultConfig())
+	if err != nil {
+		conn.Close()
+
+		return fmt.Errorf("create multiplexing session error: %v", err)
+	}
+	defer session.Close()
+
+	server := &http.Server{Handler: handler}
+
+	// Serve returns when the multiplexing session is closed.
+	return server.Serve(session)
+}
+
+// newDialer creates the websocket dialer with the TLS configuration.
+func newDialer(config *Config) (*websocket.Dialer, error) {
+	if config.ControllerURL == "" {
+		return nil, fmt.Errorf("controller url is required in outbound-only mode")
+	}
+
+	// The controller relays the requests of the clients, so it must be verified and the requests kept private.
+	if !strings.HasPrefix(config.ControllerURL, "wss://") {
+		return nil, fmt.Errorf("controller url must be wss://")
+	}
+
+	if config.TLSCA == "" {
+		return nil, fmt.Errorf("tls_ca is required to verify the controller")
+	}
+
+	caCert, err := os.ReadFile(config.TLSCA)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caCert) {
+		return nil, fmt.Errorf("no CA certificate is found in %s", config.TLSCA)
+	}
+
+	tlsConfig := &tls.Config{RootCAs: pool}
+
+	if config.TLSCert != "" {
+		cert, err := tls.LoadX509KeyPair(config.TLSCert, config.TLSKey)
+		if err != nil {
+			return nil, err
+		}
+
+		if err = fips.CheckCertificate(&cert); err != nil {
+			return nil, err
+		}
+
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	fips.Apply(tlsConfig)
+
+	return &websocket.Dialer{
+		HandshakeTimeout: defaultHandshakeTimeout,
+		TLSClientConfig:  tlsConfig,
+	}, nil
+}
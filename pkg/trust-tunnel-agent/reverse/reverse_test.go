@@ -0,0 +1,117 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package reverse
+
+import (
+	"bufio"
+	"encoding/pem"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/hashicorp/yamux"
+)
+
+func TestNewDialer(t *testing.T) {
+	for _, config := range []*Config{
+		{ControllerURL: "ws://controller/agents/connect", TLSCA: "ca.crt"},
+		{ControllerURL: "wss://controller/agents/connect"},
+	} {
+		if _, err := newDialer(config); err == nil {
+			t.Errorf("the controller of %+v shouldn't be dialed", config)
+		}
+	}
+}
+
+func TestServe(t *testing.T) {
+	sessions := make(chan *yamux.Session, 1)
+	instances := make(chan string, 1)
+
+	// Set up a fake controller which opens streams to the agent.
+	controller := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+
+		session, err := yamux.Client(newWebsocketConn(conn), yamux.DefaultConfig())
+		if err != nil {
+			return
+		}
+
+		instances <- r.Header.Get(headerAgentInstance)
+		sessions <- session
+	}))
+	defer controller.Close()
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello "+r.URL.Path)
+	})
+
+	ca := filepath.Join(t.TempDir(), "ca.crt")
+	if err := os.WriteFile(ca, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: controller.Certificate().Raw}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	config := &Config{
+		Enabled:       true,
+		ControllerURL: "ws" + strings.TrimPrefix(controller.URL, "http") + "/agents/connect",
+		TLSCA:         ca,
+	}
+
+	go Serve(config, &Agent{Instance: "agent-a"}, handler)
+
+	var session *yamux.Session
+
+	select {
+	case session = <-sessions:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("agent didn't connect to controller")
+	}
+	defer session.Close()
+
+	if instance := <-instances; instance != "agent-a" {
+		t.Errorf("unexpected agent instance %s", instance)
+	}
+
+	// Send a request through a stream.
+	stream, err := session.Open()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer stream.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, "http://agent/exec", nil)
+	if err = req.Write(stream); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(stream), req)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "hello /exec" {
+		t.Errorf("unexpected response: %s", body)
+	}
+}
@@ -0,0 +1,173 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+
+package session
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	defaultCgroupRoot = "/sys/fs/cgroup/trust-tunnel"
+	cgroupCPUPeriod   = 100000
+)
+
+// cgroup is a cgroup v2 group managed by the agent, in which the processes of a session run.
+type cgroup struct {
+	path string
+	fd   *os.File
+}
+
+// oomKilled returns whether any process in the cgroup was killed by the OOM killer.
+func (cg *cgroup) oomKilled() bool {
+	data, err := os.ReadFile(filepath.Join(cg.path, "memory.events"))
+	if err != nil {
+		return false
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		if count, ok := strings.CutPrefix(line, "oom_kill "); ok {
+			n, _ := strconv.Atoi(count)
+
+			return n > 0
+		}
+	}
+
+	return false
+}
+
+// newCgroup creates a cgroup named name under root, and applies the CPU and memory limits to it.
+// Zero limits mean unlimited.
+func newCgroup(root, name string, cpus float64, memoryMB int) (*cgroup, error) {
+	if root == "" {
+		root = defaultCgroupRoot
+	}
+
+	if _, err := os.Stat(filepath.Join(filepath.Dir(root), "cgroup.controllers")); err != nil {
+		return nil, fmt.Errorf("cgroup v2 is required under %s: %v", filepath.Dir(root), err)
+	}
+
+	if err := os.MkdirAll(root, 0o755); err != nil {
+		return nil, fmt.Errorf("create cgroup %s error: %v", root, err)
+	}
+
+	// Delegate the controllers to the session cgroups.
+	if err := os.WriteFile(filepath.Join(root, "cgroup.subtree_control"), []byte("+cpu +memory"), 0o644); err != nil {
+		return nil, fmt.Errorf("enable cgroup controllers in %s error: %v", root, err)
+	}
+
+	path := filepath.Join(root, name)
+	if err := os.Mkdir(path, 0o755); err != nil {
+		return nil, fmt.Errorf("create cgroup %s error: %v", path, err)
+	}
+
+	cg := &cgroup{path: path}
+
+	if err := cg.setLimits(cpus, memoryMB); err != nil {
+		cg.destroy()
+
+		return nil, err
+	}
+
+	fd, err := os.OpenFile(path, os.O_RDONLY|syscall.O_DIRECTORY, 0)
+	if err != nil {
+		cg.destroy()
+
+		return nil, fmt.Errorf("open cgroup %s error: %v", path, err)
+	}
+
+	cg.fd = fd
+
+	return cg, nil
+}
+
+// dir returns the directory of the cgroup.
+func (cg *cgroup) dir() string {
+	return cg.path
+}
+
+// setLimits writes the CPU and memory limits to the cgroup.
+func (cg *cgroup) setLimits(cpus float64, memoryMB int) error {
+	if cpus > 0 {
+		quota := int64(cpus * cgroupCPUPeriod)
+		if err := os.WriteFile(filepath.Join(cg.path, "cpu.max"), []byte(fmt.Sprintf("%d %d", quota, cgroupCPUPeriod)), 0o644); err != nil {
+			return fmt.Errorf("set cpu limit of cgroup %s error: %v", cg.path, err)
+		}
+	}
+
+	if memoryMB > 0 {
+		limit := int64(memoryMB) * 1024 * 1024
+		if err := os.WriteFile(filepath.Join(cg.path, "memory.max"), []byte(strconv.FormatInt(limit, 10)), 0o644); err != nil {
+			return fmt.Errorf("set memory limit of cgroup %s error: %v", cg.path, err)
+		}
+	}
+
+	return nil
+}
+
+// apply makes the process started with attr be placed in the cgroup directly by clone3.
+func (cg *cgroup) apply(attr *syscall.SysProcAttr) {
+	attr.UseCgroupFD = true
+	attr.CgroupFD = int(cg.fd.Fd())
+}
+
+// destroy kills all the processes in the cgroup and removes it.
+func (cg *cgroup) destroy() error {
+	if cg.fd != nil {
+		cg.fd.Close()
+	}
+
+	// cgroup.kill is available since linux 5.14, fall back to kill the processes one by one.
+	if err := os.WriteFile(filepath.Join(cg.path, "cgroup.kill"), []byte("1"), 0o644); err != nil {
+		cg.killProcs()
+	}
+
+	var err error
+
+	// The cgroup can't be removed until all the processes exit.
+	for i := 0; i < 50; i++ {
+		if err = os.Remove(cg.path); err == nil || os.IsNotExist(err) {
+			return nil
+		}
+
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	return fmt.Errorf("remove cgroup %s error: %v", cg.path, err)
+}
+
+// killProcs sends SIGKILL to all the processes in the cgroup.
+func (cg *cgroup) killProcs() {
+	content, err := os.ReadFile(filepath.Join(cg.path, "cgroup.procs"))
+	if err != nil {
+		return
+	}
+
+	for _, field := range strings.Fields(string(content)) {
+		pid, err := strconv.Atoi(field)
+		if err != nil {
+			continue
+		}
+
+		syscall.Kill(pid, syscall.SIGKILL)
+	}
+}
@@ -0,0 +1,110 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//go:build linux
+
+package session
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeCgroupfs returns the root of the session cgroups in a fake cgroup v2 hierarchy.
+func fakeCgroupfs(t *testing.T) string {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "cgroup.controllers"), []byte("cpu memory pids"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	return filepath.Join(dir, "trust-tunnel")
+}
+
+func readCgroupFile(t *testing.T, path string) string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return strings.TrimSpace(string(data))
+}
+
+func TestNewCgroup(t *testing.T) {
+	if _, err := newCgroup(filepath.Join(t.TempDir(), "trust-tunnel"), "s1", 0, 0); err == nil ||
+		!strings.Contains(err.Error(), "cgroup v2 is required") {
+		t.Errorf("expected error without cgroup v2, got %v", err)
+	}
+
+	root := fakeCgroupfs(t)
+
+	cg, err := newCgroup(root, "s1", 0.5, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cg.fd.Close()
+
+	if cg.path != filepath.Join(root, "s1") {
+		t.Errorf("got path %s", cg.path)
+	}
+
+	for file, want := range map[string]string{
+		filepath.Join(root, "cgroup.subtree_control"): "+cpu +memory",
+		filepath.Join(cg.path, "cpu.max"):             "50000 100000",
+		filepath.Join(cg.path, "memory.max"):          "268435456",
+	} {
+		if got := readCgroupFile(t, file); got != want {
+			t.Errorf("%s: got %q, want %q", file, got, want)
+		}
+	}
+
+	// The limits aren't written if they're unlimited.
+	unlimited, err := newCgroup(root, "s2", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unlimited.fd.Close()
+
+	for _, file := range []string{"cpu.max", "memory.max"} {
+		if _, err := os.Stat(filepath.Join(unlimited.path, file)); !os.IsNotExist(err) {
+			t.Errorf("%s shouldn't be written: %v", file, err)
+		}
+	}
+
+	// The names of the session cgroups are unique.
+	if _, err = newCgroup(root, "s1", 0, 0); err == nil {
+		t.Errorf("expected error of the existing cgroup")
+	}
+}
+
+func TestCgroupOOMKilled(t *testing.T) {
+	cg := &cgroup{path: t.TempDir()}
+
+	if cg.oomKilled() {
+		t.Errorf("unexpected OOM kill without memory.events")
+	}
+
+	for events, want := range map[string]bool{
+		"low 0\nhigh 0\nmax 2\noom 1\noom_kill 0\n": false,
+		"low 0\nhigh 0\nmax 2\noom 1\noom_kill 1\n": true,
+	} {
+		if err := os.WriteFile(filepath.Join(cg.path, "memory.events"), []byte(events), 0o644); err != nil {
+			t.Fatal(err)
+		}
+
+		if got := cg.oomKilled(); got != want {
+			t.Errorf("memory.events %q: got %v, want %v", events, got, want)
+		}
+	}
+}
@@ -0,0 +1,43 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !linux
+
+package session
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// cgroup is a placeholder on platforms without cgroup support.
+type cgroup struct{}
+
+func newCgroup(_, _ string, _ float64, _ int) (*cgroup, error) {
+	return nil, fmt.Errorf("cgroup is only supported on linux")
+}
+
+func (cg *cgroup) dir() string {
+	return ""
+}
+
+func (cg *cgroup) apply(_ *syscall.SysProcAttr) {}
+
+func (cg *cgroup) oomKilled() bool {
+	return false
+}
+
+func (cg *cgroup) destroy() error {
+	return nil
+}
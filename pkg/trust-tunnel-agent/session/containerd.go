@@ -23,22 +23,33 @@ import (
 	"strings"
 	"syscall"
 	"time"
-	"trust-tunnel/pkg/common/sessionutil"
+	"trust-tunnel/pkg/trust-tunnel-agent/monitor"
+	"trust-tunnel/pkg/trust-tunnel-agent/sessionio"
 
 	"github.com/containerd/containerd"
 	"github.com/containerd/containerd/cio"
 	"github.com/containerd/containerd/cmd/ctr/commands"
 	"github.com/containerd/containerd/namespaces"
-	"github.com/containerd/containerd/oci"
+	"github.com/containerd/errdefs"
+	"github.com/moby/sys/user"
 	"golang.org/x/net/context"
 )
 
 const (
 	randomSeed = 1048576
+
+	// processDeleteTimeout is the timeout of deleting the half-created exec process.
+	processDeleteTimeout = 10 * time.Second
+
+	// errShimUnresponsive is the error of the shim of the container not responding, mapped to MA_541
+	// by sessionutil.WrapErrorWithCode.
+	errShimUnresponsive = "containerd shim is unresponsive"
 )
 
 // containerdSession represents a session with a containerd process.
 type containerdSession struct {
+	*sessionio.Streams
+
 	process       containerd.Process
 	stdin         *io.PipeWriter
 	stdout        *io.PipeReader
@@ -51,49 +62,28 @@ type containerdSession struct {
 	cancelFunc    gocontext.CancelFunc
 	exitCode      uint32
 	ctx           context.Context
-	stdoutDone    chan struct{}
-	stderrDone    chan struct{}
 	execID        string
 	task          containerd.Task
+	tty           bool
+	line          inputLine
+	frameSize     int
 }
 
 func (s *containerdSession) NextStdin() (io.WriteCloser, error) {
-	return s.stdin, nil
-}
-
-func (s *containerdSession) NextStdout() (io.Reader, error) {
-	reader, err := sessionutil.OneRead(s.stdout)
-	// If the pipe is closed, return EOF.
-	if err != nil && (strings.Contains(err.Error(), "closed pipe")) {
-		return nil, io.EOF
+	if s.tty {
+		return s.line.track(s.stdin), nil
 	}
 
-	return reader, err
-}
-
-func (s *containerdSession) NextStderr() (io.Reader, error) {
-	reader, err := sessionutil.OneRead(s.stderr)
-	// If the pipe is closed, return EOF.
-	if err != nil && (strings.Contains(err.Error(), "closed pipe")) {
-		return nil, io.EOF
-	}
-
-	return reader, err
-}
-
-func (s *containerdSession) StderrDone() error {
-	s.stderrDone <- struct{}{}
-
-	return nil
+	return s.stdin, nil
 }
 
-func (s *containerdSession) StdoutDone() error {
-	s.stdoutDone <- struct{}{}
-
-	return nil
+func (s *containerdSession) CloseStdin() error {
+	return closeInput(s.stdin, s.tty, &s.line)
 }
 
 func (s *containerdSession) Clean() error {
+	s.Streams.Close()
+
 	select {
 	case <-s.ctx.Done():
 		// If the context is canceled, the process is already cleaned up, no action needed.
@@ -139,9 +129,8 @@ func (s *containerdSession) wait(exitCh <-chan containerd.ExitStatus) error {
 	s.outWriterPipe.Close()
 	s.errWriterPipe.Close()
 
-	// Wait for the stdout and stderr pipes to be closed.
-	<-s.stdoutDone
-	<-s.stderrDone
+	// Wait for the output to be drained.
+	s.Wait()
 	logger.Infof("clean task process")
 
 	if !s.detach && s.process != nil {
@@ -170,27 +159,36 @@ func establishContainerdSession(c *Config, containerdClient *containerd.Client)
 
 	var session *containerdSession
 
-	var loginDir string
+	// Resolve the user in the passwd of the container rather than the host.
+	execUser, err := resolveContainerdUser(c, containerdClient)
+	if err != nil {
+		return nil, err
+	}
 
-	var err error
+	logger.Infof("resolved user %q of container %s to %s", c.LoginName, c.ContainerID, formatIDs(execUser))
 
-	// If the login name is provided in the config, get the user info.
+	// The working directory of the container is kept for the user of its image, or if the home of the login user
+	// doesn't exist in the container.
+	var loginDir string
 	if c.LoginName != "" {
-		// TODO:get gid from Config.LoginGroup
-		_, _, loginDir, err = sessionutil.GetUserInfo(c.LoginName, c.RootfsPrefix+"/etc/passwd")
+		pid, err := containerInitPid(c, nil, containerdClient, Containerd)
 		if err != nil {
 			return nil, err
 		}
+
+		loginDir = existingDir(fmt.Sprintf("/proc/%d/root", pid), execUser.Home)
 	}
 
-	if len(c.Cmd) > 0 {
-		c.Cmd[len(c.Cmd)-1] = "cd " + loginDir + ";" + c.Cmd[len(c.Cmd)-1]
+	workDir := c.workingDir(loginDir)
+
+	if err = c.confirm(c.Cmd, loginDir); err != nil {
+		return nil, err
 	}
 
 	logger.Infof("exec into container %s directly", c.ContainerID)
 
 	// Now containerd runtime only support exec.
-	session, err = execContainerd(c, containerdClient, c.ContainerNamespace)
+	session, err = execContainerd(c, containerdClient, c.ContainerNamespace, workDir, execUser)
 	if err != nil {
 		return nil, err
 	}
@@ -199,12 +197,14 @@ func establishContainerdSession(c *Config, containerdClient *containerd.Client)
 }
 
 // execContainerd implements exec into a container with containerd runtime.
-func execContainerd(c *Config, client *containerd.Client, namespace string) (*containerdSession, error) {
-	// Get the container ID, command, TTY, login name and detach flag from the config.
+// The command is run in workDir of the container if it's not empty, or the working directory of its spec,
+// as execUser resolved in the container.
+func execContainerd(c *Config, client *containerd.Client, namespace string, workDir string,
+	execUser *user.ExecUser) (*containerdSession, error) {
+	// Get the container ID, command and TTY from the config.
 	id := c.ContainerID
 	args := c.Cmd
 	tty := c.Tty
-	user := c.LoginName
 
 	// Check if the container ID is provided in the config.
 	if id == "" {
@@ -213,12 +213,22 @@ func execContainerd(c *Config, client *containerd.Client, namespace string) (*co
 
 	// Create a namespace context and a cancel function.
 	ctx := namespaces.WithNamespace(context.Background(), namespace)
-	ctx, cancel := gocontext.WithCancel(ctx) //nolint:govet
+	ctx, cancel := gocontext.WithCancel(ctx)
+
+	// Cancel the context if the session fails to be established,
+	// otherwise it's canceled when the process exits.
+	established := false
+
+	defer func() {
+		if !established {
+			cancel()
+		}
+	}()
 
 	// Load the container using the containerd client.
 	container, err := client.LoadContainer(ctx, id)
 	if err != nil {
-		return nil, fmt.Errorf("load container err:%v", err) //nolint:govet
+		return nil, fmt.Errorf("load container err:%v", err)
 	}
 
 	// Get the container spec.
@@ -227,31 +237,23 @@ func execContainerd(c *Config, client *containerd.Client, namespace string) (*co
 		return nil, err
 	}
 
-	// Check if the login name is valid.
-	if user != "" {
-		c, err := container.Info(ctx)
-		if err != nil {
-			return nil, err
-		}
-
-		if err := oci.WithUser(user)(ctx, client, &c, spec); err != nil {
-			return nil, err
-		}
-	}
-
 	// Set the process task exec arguments.
 	pSpec := spec.Process
 	pSpec.Terminal = tty
 	pSpec.Args = args
-	pSpec.Env = []string{
-		"PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin",
-		"TERM=xterm-256color",
+	pSpec.User.UID = uint32(execUser.Uid)
+	pSpec.User.GID = uint32(execUser.Gid)
+	pSpec.User.AdditionalGids = additionalGids(execUser)
+
+	if workDir != "" {
+		pSpec.Cwd = workDir
 	}
+	pSpec.Env = c.environ("HOME="+execUser.Home, "PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin")
 
 	// Create a task to execute commands in the container.
 	task, err := container.Task(ctx, nil)
 	if err != nil {
-		return nil, err
+		return nil, wrapContainerdError(err, id)
 	}
 
 	var ioCreator cio.Creator
@@ -269,6 +271,30 @@ func execContainerd(c *Config, client *containerd.Client, namespace string) (*co
 
 	ioCreator = cio.NewCreator(cioOpts...)
 
+	var process containerd.Process
+
+	// Roll back the half-created process and close the pipes if the session fails to be established,
+	// it runs before the context is canceled.
+	defer func() {
+		if established {
+			return
+		}
+
+		if process != nil {
+			deleteCtx, deleteCancel := gocontext.WithTimeout(namespaces.WithNamespace(gocontext.Background(), namespace),
+				processDeleteTimeout)
+			defer deleteCancel()
+
+			if _, err := process.Delete(deleteCtx, containerd.WithProcessKill); err != nil {
+				logger.Warnf("delete exec process %s of container %s error: %v", process.ID(), id, err)
+			}
+		}
+
+		inWriterPipe.Close()
+		outWriterPipe.Close()
+		errWriterPipe.Close()
+	}()
+
 	// Generate a random exec ID.
 	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
 	randomNumber := rng.Intn(randomSeed)
@@ -276,19 +302,19 @@ func execContainerd(c *Config, client *containerd.Client, namespace string) (*co
 	logger.Infof("exec id is %s", execID)
 
 	// Execute the process task using the cio creator.
-	process, err := task.Exec(ctx, execID, pSpec, ioCreator)
+	process, err = task.Exec(ctx, execID, pSpec, ioCreator)
 	if err != nil {
-		return nil, err
+		return nil, wrapContainerdError(err, id)
 	}
 
 	// Wait for the process to finish and get the status channel.
 	statusC, err := process.Wait(ctx)
 	if err != nil {
-		return nil, err
+		return nil, wrapContainerdError(err, id)
 	}
 
 	if err := process.Start(ctx); err != nil {
-		return nil, err
+		return nil, wrapContainerdError(err, id)
 	}
 
 	// Forward all signals to the process.
@@ -296,6 +322,7 @@ func execContainerd(c *Config, client *containerd.Client, namespace string) (*co
 	defer commands.StopCatch(sigs)
 
 	s := &containerdSession{
+		Streams:       sessionio.New(),
 		exitCh:        statusC,
 		stdin:         inWriterPipe,
 		stdout:        outReaderPipe,
@@ -306,12 +333,38 @@ func execContainerd(c *Config, client *containerd.Client, namespace string) (*co
 		detach:        false,
 		cancelFunc:    cancel,
 		ctx:           ctx,
-		stderrDone:    make(chan struct{}),
-		stdoutDone:    make(chan struct{}),
+		frameSize:     c.FrameSize,
 		task:          task,
+		process:       process,
 		execID:        execID,
+		tty:           tty,
 	}
-	go s.wait(statusC)
+
+	s.Pump(outReaderPipe, errReaderPipe, s.frameSize)
+
+	monitor.Go("session_wait", func() {
+		s.wait(statusC)
+	})
+
+	established = true
 
 	return s, nil
 }
+
+// wrapContainerdError maps the common containerd errors of setting up the exec to the messages of their error codes,
+// logging the original ones. The other errors are returned as they are.
+func wrapContainerdError(err error, containerID string) error {
+	switch {
+	case errdefs.IsNotFound(err):
+		// The task of the container is gone, e.g. it has exited.
+		logger.Warnf("task of container %s not found: %v", containerID, err)
+
+		return fmt.Errorf("container is not running:%s", containerID)
+	case errdefs.IsUnavailable(err) || errdefs.IsDeadlineExceeded(err) || strings.Contains(err.Error(), "ttrpc: closed"):
+		logger.Warnf("shim of container %s is unresponsive: %v", containerID, err)
+
+		return fmt.Errorf("%s:%s", errShimUnresponsive, containerID)
+	}
+
+	return err
+}
@@ -0,0 +1,145 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package session
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"trust-tunnel/pkg/common/sessionutil"
+	"trust-tunnel/pkg/trust-tunnel-agent/sessionio"
+
+	"github.com/containerd/errdefs"
+)
+
+func BenchmarkContainerdOutput(b *testing.B) {
+	benchmarkNextStdout(b, func(r io.Reader) Session {
+		pr, pw := io.Pipe()
+
+		go func() {
+			io.Copy(pw, r)
+			pw.Close()
+		}()
+
+		s := &containerdSession{Streams: sessionio.New()}
+		s.Pump(pr, nil, 0)
+
+		return s
+	})
+}
+
+func TestLookupExecUser(t *testing.T) {
+	root := t.TempDir()
+	os.MkdirAll(filepath.Join(root, "etc"), 0o755)
+	os.WriteFile(filepath.Join(root, "etc/passwd"), []byte("root:x:0:0:root:/root:/bin/sh\n"+
+		"app:x:1000:1000::/home/app:/bin/sh\n"), 0o644)
+	os.WriteFile(filepath.Join(root, "etc/group"), []byte("root:x:0:\napp:x:1000:\nwheel:x:10:app\n"), 0o644)
+
+	// The passwd of the host must not be read through the links out of the root.
+	escaped := t.TempDir()
+	os.MkdirAll(filepath.Join(escaped, "etc"), 0o755)
+	os.Symlink("/etc/passwd", filepath.Join(escaped, "etc/passwd"))
+
+	tests := []struct {
+		name     string
+		root     string
+		userSpec string
+		uid, gid int
+		sgids    []int
+		home     string
+		wantErr  bool
+	}{
+		{name: "name", root: root, userSpec: "app", uid: 1000, gid: 1000, sgids: []int{10}, home: "/home/app"},
+		{name: "name and group", root: root, userSpec: "app:wheel", uid: 1000, gid: 10, home: "/home/app"},
+		{name: "ids of image", root: root, userSpec: "0:0", home: "/root"},
+		{name: "unknown id", root: root, userSpec: "2000:2000", uid: 2000, gid: 2000, home: "/"},
+		{name: "unknown name", root: root, userSpec: "nobody", wantErr: true},
+		{name: "unknown group", root: root, userSpec: "app:nogroup", wantErr: true},
+		{name: "escaped link", root: escaped, userSpec: "root", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			execUser, err := lookupExecUser(tt.root, tt.userSpec)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("expected error, got user %+v", execUser)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if execUser.Uid != tt.uid || execUser.Gid != tt.gid || execUser.Home != tt.home {
+				t.Errorf("got user %+v, want %d:%d with home %s", execUser, tt.uid, tt.gid, tt.home)
+			}
+
+			if len(tt.sgids) > 0 && !reflect.DeepEqual(execUser.Sgids, tt.sgids) {
+				t.Errorf("got groups %v, want %v", execUser.Sgids, tt.sgids)
+			}
+		})
+	}
+}
+
+func TestWrapContainerdError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		code string
+	}{
+		{name: "task not found", err: fmt.Errorf("no running task found: %w", errdefs.ErrNotFound), code: "MA_523"},
+		{name: "shim unavailable", err: fmt.Errorf("dial shim: %w", errdefs.ErrUnavailable), code: "MA_541"},
+		{name: "shim timeout", err: fmt.Errorf("start: %w", context.DeadlineExceeded), code: "MA_541"},
+		{name: "ttrpc closed", err: errors.New("failed to start exec: ttrpc: closed: unknown"), code: "MA_541"},
+		{name: "other", err: errors.New("exec: \"/app\": permission denied"), code: "MA_-1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := wrapContainerdError(tt.err, "0123456789ab")
+
+			// The messages are wrapped again by the handler before being coded.
+			errMsg := sessionutil.WrapContainerError(err.Error(), "0123456789ab")
+			if code := sessionutil.ErrorCode(errMsg); code != tt.code {
+				t.Errorf("got code %s of %q, want %s", code, errMsg, tt.code)
+			}
+		})
+	}
+}
+
+func TestContainerLoginDir(t *testing.T) {
+	root := t.TempDir()
+	os.MkdirAll(filepath.Join(root, "etc"), 0o755)
+	os.MkdirAll(filepath.Join(root, "home/app"), 0o755)
+	os.WriteFile(filepath.Join(root, "home/file"), nil, 0o644)
+	os.WriteFile(filepath.Join(root, "etc/passwd"), []byte("app:x:1000:1000::/home/app:/bin/sh\n"+
+		"gone:x:1001:1001::/home/gone:/bin/sh\nfile:x:1002:1002::/home/file:/bin/sh\n"), 0o644)
+	os.WriteFile(filepath.Join(root, "etc/group"), []byte("app:x:1000:\n"), 0o644)
+
+	// The working directory of the image is kept unless the home is a directory in the container.
+	for userSpec, want := range map[string]string{"app": "/home/app", "gone": "", "file": "", "nobody": ""} {
+		if dir := containerLoginDir(root, userSpec); dir != want {
+			t.Errorf("containerLoginDir(%s) = %q, want %q", userSpec, dir, want)
+		}
+	}
+}
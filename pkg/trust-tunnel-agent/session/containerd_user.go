@@ -0,0 +1,165 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package session
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/mount"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/continuity/fs"
+	"github.com/moby/sys/user"
+)
+
+// resolveContainerdUser resolves the login user and group of the exec in the passwd and group files of the container
+// rather than the host's, so that the users defined only in the image are found. The user of the container, i.e. the
+// USER of its image, is kept if the login user isn't given. The root filesystem of the container is read by the
+// read-only mount of its snapshot, as oci.WithUsername does for new containers.
+func resolveContainerdUser(c *Config, containerdClient *containerd.Client) (*user.ExecUser, error) {
+	ctx := namespaces.WithNamespace(context.Background(), c.ContainerNamespace)
+
+	container, err := containerdClient.LoadContainer(ctx, c.ContainerID)
+	if err != nil {
+		return nil, fmt.Errorf("load container err:%v", err)
+	}
+
+	info, err := container.Info(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	spec, err := container.Spec(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var uid, gid uint32
+	if spec.Process != nil {
+		uid, gid = spec.Process.User.UID, spec.Process.User.GID
+	}
+
+	userSpec := c.LoginName
+	if userSpec == "" {
+		userSpec = fmt.Sprintf("%d:%d", uid, gid)
+	} else if c.LoginGroup != "" {
+		userSpec += ":" + c.LoginGroup
+	}
+
+	var execUser *user.ExecUser
+
+	lookup := func(root string) error {
+		execUser, err = lookupExecUser(root, userSpec)
+
+		return err
+	}
+
+	// The containers without snapshots have their root filesystems at the absolute root path of the spec.
+	if info.Snapshotter == "" && info.SnapshotKey == "" {
+		if spec.Root == nil || spec.Root.Path == "" || spec.Root.Path[0] != '/' {
+			return nil, fmt.Errorf("rootfs absolute path is required to resolve user %s", userSpec)
+		}
+
+		err = lookup(spec.Root.Path)
+	} else {
+		var mounts []mount.Mount
+
+		mounts, err = containerdClient.SnapshotService(info.Snapshotter).Mounts(ctx, info.SnapshotKey)
+		if err != nil {
+			return nil, fmt.Errorf("get rootfs mounts of container %s error: %v", c.ContainerID, err)
+		}
+
+		// The read-only mount spares the kernel syncing the whole filesystem on unmounting.
+		err = mount.WithReadonlyTempMount(ctx, mounts, lookup)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return execUser, nil
+}
+
+// lookupExecUser resolves the user specification, "user[:group]" of names or IDs, in the passwd and group files under
+// the root directory. The IDs missing in the files are taken as they are, and the names must exist.
+func lookupExecUser(root string, userSpec string) (*user.ExecUser, error) {
+	passwdPath, err := fs.RootPath(root, "/etc/passwd")
+	if err != nil {
+		return nil, err
+	}
+
+	groupPath, err := fs.RootPath(root, "/etc/group")
+	if err != nil {
+		return nil, err
+	}
+
+	execUser, err := user.GetExecUserPath(userSpec, &user.ExecUser{Home: "/"}, passwdPath, groupPath)
+	if err != nil {
+		return nil, fmt.Errorf("user does not exist:%s: %v", userSpec, err)
+	}
+
+	return execUser, nil
+}
+
+// containerLoginDir returns the home of the user in the passwd of the container's root rather than the host's. It's
+// empty, so that the working directory of the image is kept, if the user isn't defined in the container, e.g. the
+// images without the user database, or if the home isn't a directory in the container.
+func containerLoginDir(root, userSpec string) string {
+	execUser, err := lookupExecUser(root, userSpec)
+	if err != nil {
+		logger.Warnf("resolve login directory in %s error: %v", root, err)
+
+		return ""
+	}
+
+	return existingDir(root, execUser.Home)
+}
+
+// existingDir returns the directory if it's a directory in the root, resolving the symbolic links in the root, or
+// empty otherwise.
+func existingDir(root, dir string) string {
+	p, err := fs.RootPath(root, dir)
+	if err == nil {
+		var info os.FileInfo
+		if info, err = os.Stat(p); err == nil && !info.IsDir() {
+			err = fmt.Errorf("not a directory")
+		}
+	}
+
+	if err != nil {
+		logger.Warnf("login directory %s isn't found in %s, the working directory of the image is kept: %v", dir, root, err)
+
+		return ""
+	}
+
+	return dir
+}
+
+// additionalGids returns the supplementary groups of the user as the IDs of the OCI spec.
+func additionalGids(execUser *user.ExecUser) []uint32 {
+	gids := make([]uint32, 0, len(execUser.Sgids))
+	for _, gid := range execUser.Sgids {
+		gids = append(gids, uint32(gid))
+	}
+
+	return gids
+}
+
+// formatIDs returns the uid and gid of the user for the logs.
+func formatIDs(execUser *user.ExecUser) string {
+	return strconv.Itoa(execUser.Uid) + ":" + strconv.Itoa(execUser.Gid)
+}
@@ -0,0 +1,246 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package session
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/containerd/containerd"
+	dockerClient "github.com/docker/docker/client"
+	client "trust-tunnel/pkg/trust-tunnel-client"
+)
+
+// maxAuditedCopyPaths is the maximum number of the paths copied, and of the paths skipped, kept for the audit.
+const maxAuditedCopyPaths = 100
+
+// CopyStats is the files copied by a session, audited once the session is terminated.
+type CopyStats struct {
+	// Direction is client.CopyToTarget or client.CopyFromTarget, and Path is the path in the target.
+	Direction string `json:"direction"`
+	Path      string `json:"path"`
+
+	// Files is the number of the regular files copied, and Bytes is their total size.
+	Files int   `json:"files"`
+	Bytes int64 `json:"bytes"`
+
+	// Paths are the paths copied in the target, up to maxAuditedCopyPaths of them.
+	Paths []string `json:"paths,omitempty"`
+
+	// Skipped are the paths skipped for the path policies or their types, up to maxAuditedCopyPaths of them.
+	Skipped []string `json:"skipped,omitempty"`
+}
+
+// CopyReporter is implemented by the sessions copying files.
+type CopyReporter interface {
+	// CopyStats returns the files copied so far.
+	CopyStats() *CopyStats
+}
+
+// copySession copies the files to or from the target by the agent as a tar stream, without spawning any process in
+// the target. The tar stream copied to the target is the input of the session, and the one copied from it is the
+// output. The paths are resolved in the root of the target without following symbolic links, as the file verbs.
+type copySession struct {
+	*outputSession
+
+	stdinReader *io.PipeReader
+	stdinWriter *io.PipeWriter
+
+	lock  sync.Mutex
+	stats CopyStats
+}
+
+// copyOptions are the options of copying the files, shared by both directions.
+type copyOptions struct {
+	// checkPath checks the paths copied against the path policies.
+	checkPath func(path string) error
+
+	// maxBytes is the maximum total size of the regular files copied.
+	maxBytes int64
+
+	// uid and gid own the files copied to the target, the agent's are kept if they are negative.
+	uid, gid int
+
+	// user is the user the files are read and written as, the agent's permissions are used if it's nil.
+	user *fsUser
+
+	// warn receives the warnings of the paths skipped.
+	warn io.Writer
+
+	// copied and skipped record the paths copied and skipped.
+	copied  func(path string, size int64, regular bool)
+	skipped func(path string)
+}
+
+// establishCopySession establishes a session copying the files of the config. The files are read and written with
+// the permissions of the login user resolved in the target, and the files copied to the target are owned by it.
+func establishCopySession(c *Config, apiClient dockerClient.CommonAPIClient, containerdClient *containerd.Client, containerRuntime ContainerRuntime) (Session, error) {
+	target, err := resolveVerbTarget(c, apiClient, containerdClient, containerRuntime)
+	if err != nil {
+		return nil, err
+	}
+
+	root := target.Root
+	logger.Infof("copy %s %s in %s", c.Copy.Direction, c.Copy.Path, root)
+
+	s := &copySession{outputSession: newOutputSession(), stats: CopyStats{Direction: c.Copy.Direction, Path: c.Copy.Path}}
+	s.stdinReader, s.stdinWriter = io.Pipe()
+	s.frameSize = frameSizeOf(c.FrameSize)
+
+	opts := &copyOptions{checkPath: c.CopyCheckPath, maxBytes: c.CopyMaxBytes, uid: -1, gid: -1, copied: s.copied, skipped: s.skipped}
+	if opts.checkPath == nil {
+		opts.checkPath = func(string) error { return nil }
+	}
+
+	execUser, err := lookupLoginUser(root, c)
+	if err != nil {
+		return nil, err
+	}
+
+	opts.user = fsUserOf(execUser)
+
+	if c.Copy.Direction == client.CopyToTarget && execUser != nil {
+		opts.uid, opts.gid = execUser.Uid, execUser.Gid
+	}
+
+	s.stream(c.Copy.Path, func(stdout, stderr io.Writer) error {
+		opts.warn = stderr
+
+		if c.Copy.Direction == client.CopyFromTarget {
+			if err := writeTar(root, c.Copy.Path, stdout, opts); err != nil {
+				return fmt.Errorf("copy from %s: %v", c.Copy.Path, err)
+			}
+
+			return nil
+		}
+
+		if err := extractTar(root, c.Copy.Path, s.stdinReader, opts); err != nil {
+			// The rest of the stream is discarded, so that the error is told once the client has sent it.
+			io.Copy(io.Discard, s.stdinReader)
+
+			return fmt.Errorf("copy to %s: %v", c.Copy.Path, err)
+		}
+
+		return nil
+	})
+
+	return s, nil
+}
+
+func (s *copySession) NextStdin() (io.WriteCloser, error) {
+	if s.stats.Direction != client.CopyToTarget {
+		return s.outputSession.NextStdin()
+	}
+
+	return s.stdinWriter, nil
+}
+
+func (s *copySession) CloseStdin() error {
+	return s.stdinWriter.Close()
+}
+
+func (s *copySession) Clean() error {
+	s.stdinReader.CloseWithError(fmt.Errorf("session is cleaned"))
+
+	return s.outputSession.Clean()
+}
+
+func (s *copySession) CopyStats() *CopyStats {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	stats := s.stats
+	stats.Paths = append([]string(nil), s.stats.Paths...)
+	stats.Skipped = append([]string(nil), s.stats.Skipped...)
+
+	return &stats
+}
+
+// copied records the path copied, and the size of the regular files.
+func (s *copySession) copied(p string, size int64, regular bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if regular {
+		s.stats.Files++
+		s.stats.Bytes += size
+	}
+
+	if len(s.stats.Paths) < maxAuditedCopyPaths {
+		s.stats.Paths = append(s.stats.Paths, p)
+	}
+}
+
+// skipped records the path skipped.
+func (s *copySession) skipped(p string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if len(s.stats.Skipped) < maxAuditedCopyPaths {
+		s.stats.Skipped = append(s.stats.Skipped, p)
+	}
+}
+
+// skip warns of the path skipped, and records it.
+func (o *copyOptions) skip(p, reason string) {
+	fmt.Fprintf(o.warn, "skip %s: %s\n", p, reason)
+	o.skipped(p)
+}
+
+// copyEntryPath returns the path of the tar entry relative to the directory extracted into, "." for the directory.
+// The leading slashes are ignored as tar does, and the entries escaping the directory are refused.
+func copyEntryPath(name string) (string, error) {
+	for _, elem := range strings.Split(name, "/") {
+		if elem == ".." {
+			return "", fmt.Errorf("%s escapes the directory", name)
+		}
+	}
+
+	rel := strings.TrimPrefix(path.Clean("/"+name), "/")
+	if rel == "" {
+		return ".", nil
+	}
+
+	return rel, nil
+}
+
+// copyHeader returns the tar header of the file, named as given. Only the permission bits are kept in the mode.
+func copyHeader(name string, info fs.FileInfo, link string) (*tar.Header, error) {
+	hdr := &tar.Header{Name: name, Mode: int64(info.Mode().Perm()), ModTime: info.ModTime()}
+
+	switch {
+	case info.Mode().IsRegular():
+		hdr.Typeflag = tar.TypeReg
+		hdr.Size = info.Size()
+	case info.IsDir():
+		hdr.Typeflag = tar.TypeDir
+		hdr.Name += "/"
+	case info.Mode()&fs.ModeSymlink != 0:
+		hdr.Typeflag = tar.TypeSymlink
+		hdr.Linkname = link
+	default:
+		return nil, fmt.Errorf("%s isn't a regular file, a directory or a symbolic link", name)
+	}
+
+	if uid, gid, ok := fileOwner(info); ok {
+		hdr.Uid, hdr.Gid = uid, gid
+	}
+
+	return hdr, nil
+}
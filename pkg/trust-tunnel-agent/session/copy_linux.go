@@ -0,0 +1,437 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//go:build linux
+
+package session
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// resolveBeneath resolves the paths under a directory without following any symbolic link or escaping it.
+const resolveBeneath = unix.RESOLVE_BENEATH | unix.RESOLVE_NO_SYMLINKS | unix.RESOLVE_NO_MAGICLINKS
+
+// openDirInRoot opens the directory for the *at calls as the user, resolving the path in the root as openInRoot
+// does.
+func openDirInRoot(root, dir string, u *fsUser) (int, error) {
+	rootFd, err := unix.Open(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return -1, fmt.Errorf("open root %s error: %v", root, err)
+	}
+	defer unix.Close(rootFd)
+
+	var fd int
+
+	err = u.do(func() (err error) {
+		fd, err = unix.Openat2(rootFd, dir, &unix.OpenHow{
+			Flags:   unix.O_PATH | unix.O_DIRECTORY | unix.O_CLOEXEC,
+			Resolve: unix.RESOLVE_IN_ROOT | unix.RESOLVE_NO_SYMLINKS | unix.RESOLVE_NO_MAGICLINKS,
+		})
+
+		return err
+	})
+
+	return fd, resolveError("open", dir, err)
+}
+
+// openBeneath opens the path relative to the directory, refusing the symbolic links.
+func openBeneath(dirFd int, rel string, flags int, mode uint32) (int, error) {
+	fd, err := unix.Openat2(dirFd, rel, &unix.OpenHow{
+		Flags:   uint64(flags | unix.O_CLOEXEC),
+		Mode:    uint64(mode),
+		Resolve: resolveBeneath,
+	})
+
+	return fd, resolveError("open", rel, err)
+}
+
+// resolveError returns the error of resolving the path, as openInRoot does.
+func resolveError(op, p string, err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, unix.ELOOP):
+		return fmt.Errorf("%s contains a symbolic link", p)
+	case errors.Is(err, unix.ENOSYS):
+		return fmt.Errorf("copies require linux 5.6 or later")
+	}
+
+	return &fs.PathError{Op: op, Path: p, Err: err}
+}
+
+// extractTar extracts the tar stream into the directory in the root. The files are created with the permission
+// bits of the entries and owned by the user of the options, the existing directories are kept, and the existing
+// files are overwritten unless they are linked elsewhere. Hard links and special files are skipped. The files are
+// written as the user of the options, with the user's permissions.
+func extractTar(root, dir string, r io.Reader, opts *copyOptions) error {
+	dirFd, err := openDirInRoot(root, dir, opts.user)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(dirFd)
+
+	return opts.user.do(func() error {
+		return extractEntries(dirFd, dir, r, opts)
+	})
+}
+
+// extractEntries extracts the entries of the tar stream into the opened directory, which is the dir in the root.
+func extractEntries(dirFd int, dir string, r io.Reader, opts *copyOptions) error {
+	var written int64
+
+	tr := tar.NewReader(r)
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+
+		if err != nil {
+			return fmt.Errorf("read tar stream error: %v", err)
+		}
+
+		rel, err := copyEntryPath(hdr.Name)
+		if err != nil {
+			return err
+		}
+
+		// The directory extracted into is kept as it is.
+		if rel == "." {
+			continue
+		}
+
+		target := path.Join(dir, rel)
+		if err = opts.checkPath(target); err != nil {
+			return err
+		}
+
+		if hdr.Typeflag == tar.TypeReg {
+			if written += hdr.Size; written > opts.maxBytes {
+				return fmt.Errorf("files are larger than %d bytes", opts.maxBytes)
+			}
+		}
+
+		if err = extractEntry(dirFd, rel, target, hdr, tr, opts); err != nil {
+			return err
+		}
+	}
+}
+
+// extractEntry extracts the tar entry to the path relative to the directory, which is the target in the root.
+func extractEntry(dirFd int, rel, target string, hdr *tar.Header, r io.Reader, opts *copyOptions) error {
+	switch hdr.Typeflag {
+	case tar.TypeReg, tar.TypeDir, tar.TypeSymlink:
+	default:
+		opts.skip(target, "not a regular file, a directory or a symbolic link")
+
+		return nil
+	}
+
+	parentFd, err := openBeneath(dirFd, path.Dir(rel), unix.O_PATH|unix.O_DIRECTORY, 0)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(parentFd)
+
+	base := path.Base(rel)
+	perm := uint32(hdr.Mode) & 0o777
+
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		err = extractDir(parentFd, base, perm, opts)
+	case tar.TypeSymlink:
+		err = extractSymlink(parentFd, base, hdr.Linkname, opts)
+	default:
+		err = extractFile(parentFd, base, perm, hdr, r, opts)
+	}
+
+	if err != nil {
+		return fmt.Errorf("extract %s error: %v", hdr.Name, err)
+	}
+
+	opts.copied(target, hdr.Size, hdr.Typeflag == tar.TypeReg)
+
+	return nil
+}
+
+// extractDir creates the directory, the existing one is kept as it is.
+func extractDir(parentFd int, base string, perm uint32, opts *copyOptions) error {
+	err := unix.Mkdirat(parentFd, base, 0o700)
+	if errors.Is(err, unix.EEXIST) {
+		var stat unix.Stat_t
+		if err = unix.Fstatat(parentFd, base, &stat, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+			return err
+		}
+
+		if stat.Mode&unix.S_IFMT != unix.S_IFDIR {
+			return fmt.Errorf("it exists and isn't a directory")
+		}
+
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	fd, err := openBeneath(parentFd, base, unix.O_RDONLY|unix.O_DIRECTORY, 0)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+
+	return chmodChown(fd, perm, opts)
+}
+
+// extractSymlink creates the symbolic link, replacing the file of the name unless it's a directory. The links are
+// never followed in copies, so they may point anywhere.
+func extractSymlink(parentFd int, base, link string, opts *copyOptions) error {
+	if err := unix.Unlinkat(parentFd, base, 0); err != nil && !errors.Is(err, unix.ENOENT) {
+		return err
+	}
+
+	if err := unix.Symlinkat(link, parentFd, base); err != nil {
+		return err
+	}
+
+	if opts.uid < 0 {
+		return nil
+	}
+
+	return unix.Fchownat(parentFd, base, opts.uid, opts.gid, unix.AT_SYMLINK_NOFOLLOW)
+}
+
+// extractFile writes the content of the regular file. The existing files linked elsewhere are refused, for they
+// may be the files outside the directory or denied by the path policies.
+func extractFile(parentFd int, base string, perm uint32, hdr *tar.Header, r io.Reader, opts *copyOptions) error {
+	fd, err := openBeneath(parentFd, base, unix.O_WRONLY|unix.O_CREAT|unix.O_NOFOLLOW|unix.O_NONBLOCK, 0o600)
+	if err != nil {
+		return err
+	}
+
+	f := os.NewFile(uintptr(fd), base)
+	defer f.Close()
+
+	var stat unix.Stat_t
+	if err = unix.Fstat(fd, &stat); err != nil {
+		return err
+	}
+
+	if stat.Mode&unix.S_IFMT != unix.S_IFREG {
+		return fmt.Errorf("it exists and isn't a regular file")
+	}
+
+	if stat.Nlink > 1 {
+		return fmt.Errorf("it has %d hard links", stat.Nlink)
+	}
+
+	if err = f.Truncate(0); err != nil {
+		return err
+	}
+
+	if _, err = io.CopyN(f, r, hdr.Size); err != nil {
+		return err
+	}
+
+	if err = chmodChown(fd, perm, opts); err != nil {
+		return err
+	}
+
+	mtime := unix.NsecToTimespec(hdr.ModTime.UnixNano())
+
+	return unix.UtimesNanoAt(parentFd, base, []unix.Timespec{mtime, mtime}, unix.AT_SYMLINK_NOFOLLOW)
+}
+
+// chmodChown sets the permission bits of the file, and its owner if it's given.
+func chmodChown(fd int, perm uint32, opts *copyOptions) error {
+	if opts.uid >= 0 {
+		if err := unix.Fchown(fd, opts.uid, opts.gid); err != nil {
+			return err
+		}
+	}
+
+	// The permission bits are set after the owner, which clears the setuid bits.
+	return unix.Fchmod(fd, perm)
+}
+
+// writeTar writes the tar stream of the file or the directory in the root, whose entries are named after its base
+// name. The symbolic links are written as they are, the special files and the paths denied by the path policies are
+// skipped with the warnings.
+func writeTar(root, p string, w io.Writer, opts *copyOptions) error {
+	if p == "/" {
+		return fmt.Errorf("the root can't be copied, copy the directories under it instead")
+	}
+
+	f, err := openInRoot(root, p, opts.user)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	tw := tar.NewWriter(w)
+	a := &tarArchiver{tw: tw, opts: opts}
+
+	err = opts.user.do(func() error {
+		return a.add(f, path.Base(p), p)
+	})
+	if err != nil {
+		return err
+	}
+
+	return tw.Close()
+}
+
+// tarArchiver writes the files to the tar stream.
+type tarArchiver struct {
+	tw      *tar.Writer
+	opts    *copyOptions
+	written int64
+}
+
+// add writes the opened file named as given, and the files under it if it's a directory.
+func (a *tarArchiver) add(f *os.File, name, target string) error {
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	if !info.Mode().IsRegular() && !info.IsDir() {
+		return fmt.Errorf("%s isn't a regular file or a directory", target)
+	}
+
+	hdr, err := copyHeader(name, info, "")
+	if err != nil {
+		return err
+	}
+
+	if info.Mode().IsRegular() {
+		if a.written += info.Size(); a.written > a.opts.maxBytes {
+			return fmt.Errorf("files are larger than %d bytes", a.opts.maxBytes)
+		}
+	}
+
+	if err = a.tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+
+	if info.Mode().IsRegular() {
+		// The file may be changed while it's copied, only the size in the header is written.
+		if _, err = io.CopyN(a.tw, f, info.Size()); err != nil {
+			return fmt.Errorf("read %s error: %v", target, err)
+		}
+
+		a.opts.copied(target, info.Size(), true)
+
+		return nil
+	}
+
+	a.opts.copied(target, 0, false)
+
+	return a.addChildren(f, name, target)
+}
+
+// addChildren writes the files under the directory in the order of their names.
+func (a *tarArchiver) addChildren(dir *os.File, name, target string) error {
+	entries, err := dir.ReadDir(-1)
+	if err != nil {
+		return fmt.Errorf("read directory %s error: %v", target, err)
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+
+	dirFd := int(dir.Fd())
+
+	for _, entry := range entries {
+		childName := name + "/" + entry.Name()
+		childTarget := path.Join(target, entry.Name())
+
+		if err := a.opts.checkPath(childTarget); err != nil {
+			a.opts.skip(childTarget, err.Error())
+
+			continue
+		}
+
+		switch entry.Type() {
+		case fs.ModeSymlink:
+			err = a.addSymlink(dirFd, entry.Name(), childName, childTarget)
+		case fs.ModeDir, 0:
+			err = a.addChild(dirFd, entry.Name(), childName, childTarget)
+		default:
+			a.opts.skip(childTarget, "not a regular file, a directory or a symbolic link")
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// addChild writes the file or the directory under the directory.
+func (a *tarArchiver) addChild(dirFd int, base, name, target string) error {
+	fd, err := openBeneath(dirFd, base, unix.O_RDONLY|unix.O_NOFOLLOW|unix.O_NONBLOCK|unix.O_NOCTTY, 0)
+	if err != nil {
+		return err
+	}
+
+	f := os.NewFile(uintptr(fd), target)
+	defer f.Close()
+
+	return a.add(f, name, target)
+}
+
+// addSymlink writes the symbolic link under the directory as it is.
+func (a *tarArchiver) addSymlink(dirFd int, base, name, target string) error {
+	buf := make([]byte, unix.PathMax)
+
+	n, err := unix.Readlinkat(dirFd, base, buf)
+	if err != nil {
+		return &fs.PathError{Op: "readlink", Path: target, Err: err}
+	}
+
+	var stat unix.Stat_t
+	if err = unix.Fstatat(dirFd, base, &stat, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+		return &fs.PathError{Op: "lstat", Path: target, Err: err}
+	}
+
+	hdr := &tar.Header{
+		Typeflag: tar.TypeSymlink,
+		Name:     name,
+		Linkname: string(buf[:n]),
+		Mode:     0o777,
+		Uid:      int(stat.Uid),
+		Gid:      int(stat.Gid),
+		ModTime:  time.Unix(stat.Mtim.Unix()),
+	}
+
+	if err = a.tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+
+	a.opts.copied(target, 0, false)
+
+	return nil
+}
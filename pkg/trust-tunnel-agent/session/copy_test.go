@@ -0,0 +1,178 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//go:build linux
+
+package session
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testCopyOptions(warn io.Writer) *copyOptions {
+	return &copyOptions{
+		checkPath: func(p string) error {
+			if strings.HasSuffix(p, "/secret") {
+				return fmt.Errorf("%s is denied", p)
+			}
+
+			return nil
+		},
+		maxBytes: 1 << 20,
+		uid:      -1,
+		gid:      -1,
+		warn:     warn,
+		copied:   func(string, int64, bool) {},
+		skipped:  func(string) {},
+	}
+}
+
+func TestCopyRoundTrip(t *testing.T) {
+	src, dst := t.TempDir(), t.TempDir()
+
+	for _, dir := range []string{filepath.Join(src, "data/sub"), filepath.Join(dst, "dst")} {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for name, content := range map[string]string{"data/a": "a\n", "data/sub/b": "bb\n", "data/secret": "s\n"} {
+		if err := os.WriteFile(filepath.Join(src, name), []byte(content), 0o640); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := os.Symlink("/etc/passwd", filepath.Join(src, "data/link")); err != nil {
+		t.Fatal(err)
+	}
+
+	var stream, warn bytes.Buffer
+	if err := writeTar(src, "/data", &stream, testCopyOptions(&warn)); err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(warn.String(), "skip /data/secret") {
+		t.Errorf("the denied path should be skipped, got warnings %q", warn.String())
+	}
+
+	if err := extractTar(dst, "/dst", &stream, testCopyOptions(&warn)); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile(filepath.Join(dst, "dst/data/sub/b"))
+	if err != nil || string(b) != "bb\n" {
+		t.Errorf("unexpected content %q, %v", b, err)
+	}
+
+	if info, err := os.Stat(filepath.Join(dst, "dst/data/a")); err != nil || info.Mode().Perm() != 0o640 {
+		t.Errorf("unexpected file %v, %v", info, err)
+	}
+
+	if link, err := os.Readlink(filepath.Join(dst, "dst/data/link")); err != nil || link != "/etc/passwd" {
+		t.Errorf("unexpected link %q, %v", link, err)
+	}
+
+	if _, err := os.Lstat(filepath.Join(dst, "dst/data/secret")); !os.IsNotExist(err) {
+		t.Errorf("the denied path shouldn't be copied, got %v", err)
+	}
+
+	// The entries can't escape the directory, nor be written through the symbolic links.
+	for _, name := range []string{"../escaped", "data/link/passwd", "data/secret"} {
+		var evil bytes.Buffer
+
+		tw := tar.NewWriter(&evil)
+		tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: name, Mode: 0o644, Size: 1})
+		tw.Write([]byte("x"))
+		tw.Close()
+
+		if err := extractTar(dst, "/dst", &evil, testCopyOptions(&warn)); err == nil {
+			t.Errorf("%s should be refused", name)
+		}
+	}
+
+	// The files larger than the limit are refused.
+	opts := testCopyOptions(&warn)
+	opts.maxBytes = 2
+
+	if err := writeTar(src, "/data", io.Discard, opts); err == nil {
+		t.Error("the files larger than the limit should be refused")
+	}
+}
+
+func TestCopyAsUser(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("switching the filesystem IDs requires root")
+	}
+
+	root := t.TempDir()
+	if err := os.Chmod(root, 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Mkdir(filepath.Join(root, "home"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Chown(filepath.Join(root, "home"), 65534, 65534); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(filepath.Join(root, "private"), []byte("p\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	var stream, warn bytes.Buffer
+
+	tw := tar.NewWriter(&stream)
+	tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: "f", Mode: 0o644, Size: 1})
+	tw.Write([]byte("x"))
+	tw.Close()
+
+	opts := testCopyOptions(&warn)
+	opts.user = &fsUser{uid: 65534, gid: 65534}
+
+	// The directory denied to the user by its permissions is refused, and the one of the user is written as it.
+	if err := extractTar(root, "/", bytes.NewReader(stream.Bytes()), opts); err == nil {
+		t.Error("copy to the directory of root should be refused")
+	}
+
+	if err := extractTar(root, "/home", bytes.NewReader(stream.Bytes()), opts); err != nil {
+		t.Fatal(err)
+	}
+
+	if uid, _, ok := fileOwner(mustStat(t, filepath.Join(root, "home/f"))); !ok || uid != 65534 {
+		t.Errorf("the file copied should be owned by the user, got %d", uid)
+	}
+
+	if err := writeTar(root, "/private", io.Discard, opts); err == nil {
+		t.Error("copy from the private file should be refused")
+	}
+}
+
+func mustStat(t *testing.T, p string) os.FileInfo {
+	t.Helper()
+
+	info, err := os.Stat(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return info
+}
@@ -16,7 +16,6 @@ package session
 
 import (
 	"bufio"
-	"bytes"
 	"context"
 	"encoding/binary"
 	"fmt"
@@ -24,7 +23,12 @@ import (
 	"net"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 	"trust-tunnel/pkg/common/sessionutil"
+	"trust-tunnel/pkg/trust-tunnel-agent/monitor"
+	"trust-tunnel/pkg/trust-tunnel-agent/proctrack"
+	"trust-tunnel/pkg/trust-tunnel-agent/sessionio"
 	"trust-tunnel/pkg/trust-tunnel-agent/sidecar"
 
 	"github.com/docker/docker/api/types"
@@ -53,7 +57,6 @@ type ContainerRuntime string
 const (
 	Docker     ContainerRuntime = "docker"
 	Containerd ContainerRuntime = "containerd"
-	bufferSize                  = 4096
 )
 
 const (
@@ -68,7 +71,12 @@ const (
 	DefaultMemoryMB = 512 // 512MB
 )
 
+// exitCodeTornDown is the exit code of the sessions torn down before their output is drained, which is unknown.
+const exitCodeTornDown = -1
+
 type dockerSession struct {
+	*sessionio.Streams
+
 	ctx       context.Context
 	client    client.CommonAPIClient
 	respID    string
@@ -76,68 +84,117 @@ type dockerSession struct {
 	conn      net.Conn
 	reader    *bufio.Reader
 	tty       bool
-	stdoutCh  chan io.Reader
-	stderrCh  chan io.Reader
 	sidecarID string
+	// line tracks whether the input written to the terminal ends in the middle of a line.
+	line inputLine
+	// frameSize is the most bytes read from the output at once.
+	frameSize int
+	// tree tracks the processes spawned in the sidecar, it's nil if the process tracking is unavailable.
+	tree *proctrack.Tree
+	// trace traces the commands executed in the cgroup of the sidecar by eBPF, it's nil if they are tracked by
+	// the tree.
+	trace *proctrack.CgroupTrace
+
+	// closed is set once the session is cleaned, after which the attach connection isn't written and all the
+	// streams end with io.EOF. The writes hold the read lock, and the connection is closed with the write lock.
+	closed atomic.Bool
+	lock   sync.RWMutex
+}
 
-	stdoutDone chan struct{}
-	stderrDone chan struct{}
-
-	lock sync.Mutex
+// dockerStdin writes the input of the session to the attach connection until the session is cleaned.
+type dockerStdin struct {
+	s *dockerSession
 }
 
-func (s *dockerSession) NextStdin() (io.WriteCloser, error) {
-	s.lock.Lock()
-	defer s.lock.Unlock()
+func (w dockerStdin) Write(p []byte) (int, error) {
+	w.s.lock.RLock()
+	defer w.s.lock.RUnlock()
 
-	if s.conn == nil {
-		return nil, io.EOF
+	if w.s.closed.Load() {
+		return 0, io.EOF
 	}
 
-	return s.conn, nil
-}
+	n, err := w.s.conn.Write(p)
+	w.s.line.wrote(p[:n])
 
-func (s *dockerSession) NextStdout() (io.Reader, error) {
-	r, ok := <-s.stdoutCh
-	if !ok {
-		return nil, io.EOF
+	if err != nil && w.s.closed.Load() {
+		// The pending write is failed by the clean.
+		return n, io.EOF
 	}
 
-	return r, nil
+	return n, err
+}
+
+func (w dockerStdin) Close() error {
+	return w.s.CloseStdin()
 }
 
-func (s *dockerSession) NextStderr() (io.Reader, error) {
-	r, ok := <-s.stderrCh
-	if !ok {
+func (s *dockerSession) NextStdin() (io.WriteCloser, error) {
+	if s.closed.Load() {
 		return nil, io.EOF
 	}
 
-	return r, nil
+	return dockerStdin{s: s}, nil
 }
 
-func (s *dockerSession) StderrDone() error {
-	s.stderrDone <- struct{}{}
+func (s *dockerSession) CloseStdin() error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
 
-	return nil
+	if s.closed.Load() {
+		return io.EOF
+	}
+
+	if s.tty {
+		_, err := s.conn.Write(s.line.eof())
+
+		return err
+	}
+
+	// Half-close the hijacked connection, the output is still read from it.
+	if conn, ok := s.conn.(interface{ CloseWrite() error }); ok {
+		return conn.CloseWrite()
+	}
+
+	return fmt.Errorf("stdin of the docker session can't be closed alone")
 }
 
-func (s *dockerSession) StdoutDone() error {
-	s.stdoutDone <- struct{}{}
+func (s *dockerSession) OOMKilled() bool {
+	// Commands executed in the target container directly share its memory limit,
+	// only the sidecar container tells the OOM kill of the session.
+	if s.isExec {
+		return false
+	}
 
-	return nil
+	inspect, err := s.client.ContainerInspect(context.Background(), s.respID)
+	if err != nil || inspect.State == nil {
+		return false
+	}
+
+	return inspect.State.OOMKilled
 }
 
 func (s *dockerSession) Clean() error {
-	s.lock.Lock()
-	s.conn.Close()
-	s.conn = nil
-	s.lock.Unlock()
+	s.Streams.Close()
+
+	if s.closed.CompareAndSwap(false, true) {
+		// Fail the pending writes, so that the connection is closed once they return.
+		s.conn.SetWriteDeadline(time.Now())
+
+		s.lock.Lock()
+		s.conn.Close()
+		s.lock.Unlock()
+	}
 
 	err := s.cleanLegacyProcess(s.isExec)
 	if err != nil && !strings.Contains(err.Error(), "process already finished") {
 		logger.Errorf("kill legacy process err:%v", err)
 	}
 
+	if s.trace != nil {
+		s.trace.Close()
+	}
+
 	if !s.isExec {
 		// Remove sidecar container.
 		err := s.client.ContainerRemove(context.Background(), s.respID, container.RemoveOptions{Force: true})
@@ -170,10 +227,18 @@ func (s *dockerSession) Resize(h, w int) error {
 }
 
 func (s *dockerSession) ExitCode() int {
-	<-s.stdoutDone
-	<-s.stderrDone
+	if !s.Wait() {
+		if s.Context().Err() != nil {
+			logger.WithField("container", s.respID).Warnf("session is torn down before its output is drained")
 
-	ctx := context.Background()
+			return exitCodeTornDown
+		}
+
+		logger.WithField("container", s.respID).Warnf("output isn't drained in %v, read the exit code anyway", s.DrainTimeout)
+	}
+
+	// The waits below are canceled once the session is torn down.
+	ctx := s.Context()
 
 	if s.isExec {
 		inspect, err := s.client.ContainerExecInspect(ctx, s.respID)
@@ -186,7 +251,7 @@ func (s *dockerSession) ExitCode() int {
 		return inspect.ExitCode
 	}
 
-	statusCode, err := waitContainer(s.client, s.respID)
+	statusCode, err := waitContainer(ctx, s.client, s.respID)
 	if err != nil {
 		logger.Errorf("wait container error: %s", err.Error())
 
@@ -208,15 +273,20 @@ func establishDockerSession(c *Config, containerClient client.CommonAPIClient) (
 
 	var err error
 
+	// Resolve the login directory in the passwd of the container rather than the host.
 	if c.LoginName != "" {
-		_, _, loginDir, err = sessionutil.GetUserInfo(c.LoginName, c.RootfsPrefix+"/etc/passwd")
+		pid, err := containerInitPid(c, containerClient, nil, Docker)
 		if err != nil {
 			return nil, fmt.Errorf("%s", sessionutil.WrapContainerError(err.Error(), c.ContainerID))
 		}
+
+		loginDir = containerLoginDir(fmt.Sprintf("/proc/%d/root", pid), c.LoginName)
 	}
 
-	if len(c.Cmd) > 0 {
-		c.Cmd[len(c.Cmd)-1] = "cd " + loginDir + ";" + c.Cmd[len(c.Cmd)-1]
+	workDir := c.workingDir(loginDir)
+
+	if err = c.confirm(c.Cmd, loginDir); err != nil {
+		return nil, err
 	}
 
 	// If clean mode is disabled, exec into the container directly.
@@ -224,30 +294,34 @@ func establishDockerSession(c *Config, containerClient client.CommonAPIClient) (
 		logger.WithFields(logrus.Fields{"disable-clean-mode": c.DisableCleanMode}).
 			Infof("exec into container %s directly", c.ContainerID)
 
-		s, err = execContainer(c, containerClient)
+		s, err = execContainer(c, containerClient, workDir)
 	} else {
 		// Otherwise, attach a sidecar to the container and execute the command using nsenter inside it.
 		logger.WithFields(logrus.Fields{"disable-clean-mode": c.DisableCleanMode}).
 			Infof("attach sidecar to container %s", c.ContainerID)
 
-		s, err = attachSidecar(c, containerClient)
+		s, err = attachSidecar(c, containerClient, workDir)
 	}
 
 	if err != nil {
 		return nil, fmt.Errorf("%s", sessionutil.WrapContainerError(err.Error(), c.ContainerID))
 	}
 
-	go s.handleStreamOutput(!c.DisableCleanMode)
+	monitor.Go("session_stream", func() {
+		s.handleStreamOutput(!c.DisableCleanMode)
+	})
 
 	return s, nil
 }
 
 // attachSidecar attaches a sidecar container to the given container and returns a new Docker session.
-func attachSidecar(c *Config, apiClient client.CommonAPIClient) (*dockerSession, error) {
+// The command is run in workDir of the container if it's not empty.
+func attachSidecar(c *Config, apiClient client.CommonAPIClient, workDir string) (*dockerSession, error) {
 	ctx := context.Background()
 
-	// Pull the sidecar image if it's not already present.
-	image, err := sidecar.PullMissingImage(c.SidecarImage, c.ImageHubAuth, false, apiClient)
+	// Pull or load the sidecar image if it's not already present,
+	// and refuse to start the privileged sidecar if its image isn't signed by a trusted key.
+	image, err := sidecar.PrepareImage(c.SidecarImage, c.ImageHubAuth, c.SidecarImageTarball, apiClient)
 	if err != nil {
 		return nil, err
 	}
@@ -262,6 +336,13 @@ func attachSidecar(c *Config, apiClient client.CommonAPIClient) (*dockerSession,
 		cmd = append(cmd, "-g", c.LoginGroup)
 	}
 
+	// The tools run in the root of the container instead.
+	if c.Tools {
+		cmd = append(cmd, "-T")
+	} else if workDir != "" {
+		cmd = append(cmd, "-w", workDir)
+	}
+
 	cmd = append(cmd, c.Cmd...)
 
 	// Configure the container to run the command inside the sidecar.
@@ -270,7 +351,7 @@ func attachSidecar(c *Config, apiClient client.CommonAPIClient) (*dockerSession,
 		AttachStdin:  true,
 		AttachStdout: true,
 		Cmd:          cmd,
-		Env:          []string{"RequestedIP=0.0.0.0", "HOME=/home/" + c.LoginName},
+		Env:          c.environ("RequestedIP=0.0.0.0", "HOME=/home/"+c.LoginName),
 		Entrypoint:   nil,
 		Image:        image,
 		OpenStdin:    c.Interactive,
@@ -301,6 +382,17 @@ func attachSidecar(c *Config, apiClient client.CommonAPIClient) (*dockerSession,
 		},
 	}
 
+	hostConfig.SecurityOpt, err = c.Security.dockerSecurityOpts()
+	if err != nil {
+		return nil, err
+	}
+
+	// Privileged containers must opt out of the user namespace remapping of the daemon, the user namespace
+	// of the target is entered by the sidecar then.
+	if daemonRemapsUsers(ctx, apiClient) {
+		hostConfig.UsernsMode = "host"
+	}
+
 	// Configure the container to run the command inside the sidecar.
 	netConfig := &network.NetworkingConfig{}
 	cname := ""
@@ -308,7 +400,7 @@ func attachSidecar(c *Config, apiClient client.CommonAPIClient) (*dockerSession,
 	// Create the sidecar container.
 	createResp, err := apiClient.ContainerCreate(ctx, contConfig, hostConfig, netConfig, nil, cname)
 	if err != nil {
-		return nil, fmt.Errorf("create container exec error: %v", err)
+		return nil, c.Security.wrapSecurityError(fmt.Errorf("create container exec error: %v", err))
 	}
 
 	attachOptions := container.AttachOptions{
@@ -325,39 +417,101 @@ func attachSidecar(c *Config, apiClient client.CommonAPIClient) (*dockerSession,
 
 	// Start the sidecar container.
 	if err = apiClient.ContainerStart(ctx, createResp.ID, container.StartOptions{}); err != nil {
-		return nil, fmt.Errorf("start container error: %v", err)
+		return nil, c.Security.wrapSecurityError(fmt.Errorf("start container error: %v", err))
 	}
 
+	tree, trace := trackSidecar(ctx, apiClient, createResp.ID, c.OnExec)
+
 	// Return a new Docker session for the sidecar container.
 	return &dockerSession{
-		ctx:        ctx,
-		client:     apiClient,
-		respID:     createResp.ID,
-		isExec:     false,
-		conn:       resp.Conn,
-		reader:     resp.Reader,
-		tty:        c.Tty,
-		stdoutCh:   make(chan io.Reader, 64),
-		stderrCh:   make(chan io.Reader, 64),
-		stdoutDone: make(chan struct{}, 1),
-		stderrDone: make(chan struct{}, 1),
-		sidecarID:  createResp.ID,
+		tree:      tree,
+		trace:     trace,
+		ctx:       ctx,
+		client:    apiClient,
+		respID:    createResp.ID,
+		isExec:    false,
+		conn:      resp.Conn,
+		reader:    resp.Reader,
+		Streams:   sessionio.New(),
+		tty:       c.Tty,
+		frameSize: c.FrameSize,
+		sidecarID: createResp.ID,
 	}, nil
 }
 
+// trackSidecar starts tracking the processes spawned in the sidecar container. The commands executed are traced
+// by eBPF in the cgroup of the sidecar if the exec tracer is started, including the ones executed before, which
+// are replayed, otherwise they are tracked by the tree.
+func trackSidecar(ctx context.Context, apiClient client.CommonAPIClient, id string, onExec func(proctrack.Process)) (*proctrack.Tree, *proctrack.CgroupTrace) {
+	if !proctrack.Enabled() {
+		return nil, nil
+	}
+
+	cont, err := apiClient.ContainerInspect(ctx, id)
+	if err != nil {
+		logger.WithField("container", id).Warnf("inspect container error, processes are not tracked: %v", err)
+
+		return nil, nil
+	}
+
+	if onExec == nil || !proctrack.ExecTracerEnabled() {
+		return proctrack.Track(cont.State.Pid, onExec), nil
+	}
+
+	dir, err := proctrack.ProcessCgroup(cont.State.Pid)
+	if err == nil {
+		var trace *proctrack.CgroupTrace
+		if trace, err = proctrack.TraceCgroup(dir, onExec); err == nil {
+			return proctrack.Track(cont.State.Pid, nil), trace
+		}
+	}
+
+	logger.WithField("container", id).Warnf("trace commands in cgroup error, fall back to the process events: %v", err)
+
+	return proctrack.Track(cont.State.Pid, onExec), nil
+}
+
+func (s *dockerSession) Processes() []proctrack.Process {
+	if s.tree == nil {
+		return nil
+	}
+
+	return s.tree.Processes()
+}
+
+// daemonRemapsUsers returns whether the docker daemon remaps the users of containers with userns-remap.
+func daemonRemapsUsers(ctx context.Context, apiClient client.CommonAPIClient) bool {
+	info, err := apiClient.Info(ctx)
+	if err != nil {
+		logger.Warnf("get docker info error: %v", err)
+
+		return false
+	}
+
+	for _, opt := range info.SecurityOptions {
+		if strings.Contains(opt, "name=userns") {
+			return true
+		}
+	}
+
+	return false
+}
+
 // execContainer executes the given command inside the given container using the way of 'docker exec',
-// returns a new Docker session.
-func execContainer(c *Config, apiClient client.CommonAPIClient) (*dockerSession, error) {
+// returns a new Docker session. The command is run in workDir of the container if it's not empty.
+func execContainer(c *Config, apiClient client.CommonAPIClient, workDir string) (*dockerSession, error) {
 	ctx := context.Background()
 
 	// Configure the exec config.
 	createExecConfig := types.ExecConfig{
 		Cmd:          c.Cmd,
 		Tty:          c.Tty,
+		Env:          c.Env,
 		AttachStderr: true,
 		AttachStdout: true,
 		AttachStdin:  c.Interactive,
 		User:         c.LoginName,
+		WorkingDir:   workDir,
 	}
 
 	createResp, err := apiClient.ContainerExecCreate(ctx, c.ContainerID, createExecConfig)
@@ -371,17 +525,15 @@ func execContainer(c *Config, apiClient client.CommonAPIClient) (*dockerSession,
 	}
 
 	return &dockerSession{
-		ctx:        ctx,
-		client:     apiClient,
-		respID:     createResp.ID,
-		isExec:     true,
-		conn:       attachResp.Conn,
-		reader:     attachResp.Reader,
-		tty:        c.Tty,
-		stdoutCh:   make(chan io.Reader, 64),
-		stderrCh:   make(chan io.Reader, 64),
-		stdoutDone: make(chan struct{}, 1),
-		stderrDone: make(chan struct{}, 1),
+		ctx:       ctx,
+		client:    apiClient,
+		respID:    createResp.ID,
+		isExec:    true,
+		conn:      attachResp.Conn,
+		reader:    attachResp.Reader,
+		Streams:   sessionio.New(),
+		tty:       c.Tty,
+		frameSize: c.FrameSize,
 	}, nil
 }
 
@@ -399,35 +551,22 @@ func (s *dockerSession) handleStreamOutput(exec bool) {
 
 // streamUnifiedOutput reads the output stream directly and sends it without distinguishing between stdout and stderr.
 func (s *dockerSession) streamUnifiedOutput() {
-	// The reader can be used directly.
-	for {
-		buf := make([]byte, bufferSize)
+	s.Stderr.End(nil)
 
-		n, err := s.reader.Read(buf)
-		if n > 0 {
-			reader := bytes.NewReader(buf[:n])
-			s.stdoutCh <- reader
-		}
-
-		if err != nil {
-			if err != io.EOF &&
-				!strings.Contains(err.Error(), "use of closed network connection") {
-				// connection is closed.
-				logger.WithField("container", s.respID).Warnf("read container tty error: %v", err)
-			}
-
-			close(s.stdoutCh)
-
-			close(s.stderrCh)
-
-			return
-		}
+	// The reader can be used directly.
+	if err := s.Stdout.Pump(s.reader, s.frameSize); err != nil {
+		logger.WithField("container", s.respID).Warnf("read container tty error: %v", err)
 	}
 }
 
 // streamSplitOutput first reads and parses the header of the output,
 // then sends the data to the corresponding channel based on the frame type (stdout or stderr).
+// The output streams are ended once the connection is closed or an invalid frame is read.
 func (s *dockerSession) streamSplitOutput() {
+	defer s.End()
+
+	size := frameSizeOf(s.frameSize)
+
 	for {
 		var (
 			metadata []byte
@@ -437,9 +576,6 @@ func (s *dockerSession) streamSplitOutput() {
 		metadata, err = s.reader.Peek(stdWriterPrefixLen)
 		if err != nil {
 			// Connection is closed.
-			close(s.stdoutCh)
-			close(s.stderrCh)
-
 			return
 		}
 
@@ -448,6 +584,24 @@ func (s *dockerSession) streamSplitOutput() {
 		stream := stdType(metadata[stdWriterFdIndex])
 		frameSize := int(binary.BigEndian.Uint32(metadata[stdWriterSizeIndex : stdWriterSizeIndex+4]))
 
+		// Check the first byte to know where to write.
+		var output *sessionio.Stream
+
+		switch stream {
+		case stdin:
+			logger.WithField("container", s.respID).Errorf("got stdin output from exec connection")
+
+			return
+		case stdout:
+			output = s.Stdout
+		case stderr:
+			output = s.Stderr
+		default:
+			logger.WithField("container", s.respID).Errorf("Unrecognized input header: %d", stream)
+
+			return
+		}
+
 		// Bytes that are already read.
 		nr := 0
 
@@ -457,10 +611,10 @@ func (s *dockerSession) streamSplitOutput() {
 			left := frameSize - nr
 			if left <= 0 {
 				break
-			} else if left < bufferSize {
+			} else if left < size {
 				buffer = make([]byte, left)
 			} else {
-				buffer = make([]byte, bufferSize)
+				buffer = make([]byte, size)
 			}
 
 			n, err := io.ReadFull(s.reader, buffer)
@@ -475,22 +629,8 @@ func (s *dockerSession) streamSplitOutput() {
 			}
 
 			nr += n
-			reader := bytes.NewReader(buffer[:n])
-			// Check the first byte to know where to write.
-			switch stream {
-			case stdin:
-				logger.WithField("container", s.respID).Errorf("got stdin output from exec connection")
-
-				return
-			case stdout:
-				// Write on stdout.
-				s.stdoutCh <- reader
-			case stderr:
-				// Write on stderr.
-				s.stderrCh <- reader
-			default:
-				logger.WithField("container", s.respID).Errorf("Unrecognized input header: %d", stream)
 
+			if output.Send(buffer[:n]) != nil {
 				return
 			}
 		}
@@ -513,9 +653,14 @@ func (s *dockerSession) cleanLegacyProcess(isExec bool) error {
 
 	pid := cont.State.Pid
 	// Kill the children processes first.
-	err = sessionutil.KillProcessGroup(pid, "/superman.sh", true)
-	if err != nil && !strings.Contains(err.Error(), "process already finished") {
-		return err
+	if s.tree != nil {
+		s.tree.Kill()
+		s.tree.Close()
+	} else {
+		err = sessionutil.KillProcessGroup(pid, "/superman.sh", true)
+		if err != nil && !strings.Contains(err.Error(), "process already finished") {
+			return err
+		}
 	}
 
 	// Kill the process itself.
@@ -523,8 +668,8 @@ func (s *dockerSession) cleanLegacyProcess(isExec bool) error {
 }
 
 // waitContainer waits for the container to stop running and returns its exit status code.
-func waitContainer(cli client.CommonAPIClient, containerID string) (int, error) {
-	statusCh, errCh := cli.ContainerWait(context.Background(), containerID, container.WaitConditionNotRunning)
+func waitContainer(ctx context.Context, cli client.CommonAPIClient, containerID string) (int, error) {
+	statusCh, errCh := cli.ContainerWait(ctx, containerID, container.WaitConditionNotRunning)
 
 	for {
 		select {
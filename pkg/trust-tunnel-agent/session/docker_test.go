@@ -0,0 +1,374 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package session
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+	"trust-tunnel/pkg/trust-tunnel-agent/sessionio"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+)
+
+// fakeDockerClient is a docker client recording the removed containers,
+// the calls of the methods not overridden panic.
+type fakeDockerClient struct {
+	client.CommonAPIClient
+
+	removed   []string
+	removeErr error
+	exitCode  int
+}
+
+func (c *fakeDockerClient) ContainerExecInspect(_ context.Context, _ string) (types.ContainerExecInspect, error) {
+	return types.ContainerExecInspect{ExitCode: c.exitCode}, nil
+}
+
+func (c *fakeDockerClient) ContainerInspect(_ context.Context, id string) (types.ContainerJSON, error) {
+	return types.ContainerJSON{}, fmt.Errorf("No such container: %s", id)
+}
+
+func (c *fakeDockerClient) ContainerRemove(_ context.Context, id string, options container.RemoveOptions) error {
+	if !options.Force {
+		return fmt.Errorf("container %s is running", id)
+	}
+
+	if c.removeErr != nil {
+		return c.removeErr
+	}
+
+	c.removed = append(c.removed, id)
+
+	return nil
+}
+
+// frame returns the frame of the multiplexed output of docker.
+func frame(stream stdType, data string) string {
+	header := make([]byte, stdWriterPrefixLen)
+	header[stdWriterFdIndex] = byte(stream)
+	binary.BigEndian.PutUint32(header[stdWriterSizeIndex:], uint32(len(data)))
+
+	return string(header) + data
+}
+
+// newTestDockerSession returns a docker session reading the output from the reader.
+func newTestDockerSession(reader io.Reader, isExec bool, apiClient client.CommonAPIClient) *dockerSession {
+	conn, _ := net.Pipe()
+
+	return &dockerSession{
+		Streams:   sessionio.New(),
+		ctx:       context.Background(),
+		client:    apiClient,
+		respID:    "sidecar",
+		isExec:    isExec,
+		conn:      conn,
+		reader:    bufio.NewReader(reader),
+		sidecarID: "sidecar",
+	}
+}
+
+// readChunks reads the chunks of the stream until it ends.
+func readChunks(next func() (io.Reader, error)) []string {
+	var chunks []string
+
+	for {
+		reader, err := next()
+		if err != nil {
+			return chunks
+		}
+
+		data, _ := io.ReadAll(reader)
+		chunks = append(chunks, string(data))
+	}
+}
+
+func TestStreamSplitOutput(t *testing.T) {
+	large := strings.Repeat("a", DefaultFrameSize+10)
+
+	tests := []struct {
+		name           string
+		input          string
+		oneByte        bool
+		expectedStdout []string
+		expectedStderr []string
+	}{
+		{
+			name:           "frames",
+			input:          frame(stdout, "hello") + frame(stderr, "oops") + frame(stdout, "world"),
+			expectedStdout: []string{"hello", "world"},
+			expectedStderr: []string{"oops"},
+		},
+		{
+			name:           "frames read byte by byte",
+			input:          frame(stdout, "hello") + frame(stderr, "oops") + frame(stdout, "world"),
+			oneByte:        true,
+			expectedStdout: []string{"hello", "world"},
+			expectedStderr: []string{"oops"},
+		},
+		{
+			name:           "empty frame",
+			input:          frame(stdout, "") + frame(stdout, "hello"),
+			expectedStdout: []string{"hello"},
+		},
+		{
+			name:           "oversized frame",
+			input:          frame(stdout, large),
+			expectedStdout: []string{large[:DefaultFrameSize], large[DefaultFrameSize:]},
+		},
+		{
+			name:           "truncated header",
+			input:          frame(stdout, "hello") + frame(stdout, "world")[:3],
+			expectedStdout: []string{"hello"},
+		},
+		{
+			name:  "truncated frame",
+			input: frame(stdout, "hello world")[:stdWriterPrefixLen+5],
+		},
+		{
+			name:           "stdin frame",
+			input:          frame(stdout, "hello") + frame(stdin, "") + frame(stdout, "world"),
+			expectedStdout: []string{"hello"},
+		},
+		{
+			name:           "invalid header",
+			input:          frame(stderr, "oops") + frame(7, "") + frame(stdout, "world"),
+			expectedStderr: []string{"oops"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var reader io.Reader = strings.NewReader(test.input)
+			if test.oneByte {
+				reader = iotest.OneByteReader(reader)
+			}
+
+			s := newTestDockerSession(reader, true, nil)
+			s.streamSplitOutput()
+
+			if stdout := readChunks(s.NextStdout); !reflect.DeepEqual(stdout, test.expectedStdout) {
+				t.Errorf("expected stdout chunks %q, got %q", test.expectedStdout, stdout)
+			}
+
+			if stderr := readChunks(s.NextStderr); !reflect.DeepEqual(stderr, test.expectedStderr) {
+				t.Errorf("expected stderr chunks %q, got %q", test.expectedStderr, stderr)
+			}
+		})
+	}
+}
+
+func TestDockerSessionClean(t *testing.T) {
+	// The sidecar container is removed, and cleaning again is harmless.
+	apiClient := &fakeDockerClient{}
+	s := newTestDockerSession(&bytes.Buffer{}, false, apiClient)
+
+	if err := s.Clean(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if err := s.Clean(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if expected := []string{"sidecar", "sidecar"}; !reflect.DeepEqual(apiClient.removed, expected) {
+		t.Errorf("expected removed containers %q, got %q", expected, apiClient.removed)
+	}
+
+	if _, err := s.NextStdin(); err != io.EOF {
+		t.Errorf("expected EOF of the cleaned session's stdin, got %v", err)
+	}
+
+	// The streams of the cleaned session end, and the writes don't reach the closed connection.
+	if _, err := s.NextStdout(); err != io.EOF {
+		t.Errorf("expected EOF of the cleaned session's stdout, got %v", err)
+	}
+
+	if _, err := (dockerStdin{s: s}).Write([]byte("ls\n")); err != io.EOF {
+		t.Errorf("expected EOF writing to the cleaned session, got %v", err)
+	}
+
+	// The pending writes are failed with EOF as well.
+	s = newTestDockerSession(&bytes.Buffer{}, false, &fakeDockerClient{})
+
+	stdin, err := s.NextStdin()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	writeErr := make(chan error, 1)
+
+	go func() {
+		_, err := stdin.Write([]byte("ls\n"))
+		writeErr <- err
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	s.Clean()
+
+	if err := <-writeErr; err != io.EOF {
+		t.Errorf("expected EOF of the pending write, got %v", err)
+	}
+
+	// The target container is kept for exec sessions.
+	apiClient = &fakeDockerClient{}
+	if err := newTestDockerSession(&bytes.Buffer{}, true, apiClient).Clean(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(apiClient.removed) != 0 {
+		t.Errorf("expected no removed containers, got %q", apiClient.removed)
+	}
+
+	// The failure of removing the sidecar is returned.
+	apiClient = &fakeDockerClient{removeErr: fmt.Errorf("daemon is unavailable")}
+	if err := newTestDockerSession(&bytes.Buffer{}, false, apiClient).Clean(); err == nil {
+		t.Errorf("expected error removing the sidecar")
+	}
+}
+
+func TestDockerSessionExitCode(t *testing.T) {
+	// The exit code isn't waited for forever if the stderr is never pumped.
+	s := newTestDockerSession(strings.NewReader(frame(stdout, "hello")), true, &fakeDockerClient{exitCode: 3})
+	s.DrainTimeout = 10 * time.Millisecond
+
+	s.handleStreamOutput(true)
+	readChunks(s.NextStdout)
+	s.StdoutDone()
+
+	if code := s.ExitCode(); code != 3 {
+		t.Errorf("expected exit code 3, got %d", code)
+	}
+
+	// Nor if the session is torn down before the output ends.
+	s = newTestDockerSession(&bytes.Buffer{}, true, &fakeDockerClient{exitCode: 3})
+	exitCh := make(chan int, 1)
+
+	go func() {
+		exitCh <- s.ExitCode()
+	}()
+
+	s.Clean()
+
+	select {
+	case code := <-exitCh:
+		if code != exitCodeTornDown {
+			t.Errorf("expected exit code %d, got %d", exitCodeTornDown, code)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("exit code is blocked after the session is torn down")
+	}
+
+	// The drained streams are waited for as before.
+	s = newTestDockerSession(&bytes.Buffer{}, true, &fakeDockerClient{exitCode: 3})
+	s.StdoutDone()
+	s.StderrDone()
+
+	if !s.Wait() {
+		t.Error("expected the drained streams")
+	}
+}
+
+// benchmarkOutputSize is the size of the output in the benchmarks of the output paths.
+const benchmarkOutputSize = 1 << 20
+
+// repeatReader is an endless reader of the byte.
+type repeatReader byte
+
+func (r repeatReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = byte(r)
+	}
+
+	return len(p), nil
+}
+
+// drainChunks reads the chunks of the stream until it ends, and returns the bytes read.
+func drainChunks(next func() (io.Reader, error)) int64 {
+	var n int64
+
+	for {
+		reader, err := next()
+		if err != nil {
+			return n
+		}
+
+		m, _ := io.Copy(io.Discard, reader)
+		n += m
+	}
+}
+
+func BenchmarkStreamSplitOutput(b *testing.B) {
+	// Frames of the size docker writes.
+	data := strings.Repeat(frame(stdout, strings.Repeat("a", 32*1024)), benchmarkOutputSize/(32*1024))
+
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		s := newTestDockerSession(strings.NewReader(data), true, nil)
+
+		go s.streamSplitOutput()
+
+		go drainChunks(s.NextStderr)
+		drainChunks(s.NextStdout)
+	}
+}
+
+func BenchmarkStreamUnifiedOutput(b *testing.B) {
+	b.SetBytes(benchmarkOutputSize)
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		s := newTestDockerSession(io.LimitReader(repeatReader('a'), benchmarkOutputSize), false, nil)
+
+		go s.streamUnifiedOutput()
+
+		drainChunks(s.NextStdout)
+	}
+}
+
+func TestWorkingDir(t *testing.T) {
+	tests := []struct {
+		legacy      bool
+		cmd         []string
+		expectedCmd []string
+		expectedDir string
+	}{
+		// The commands which aren't run by "sh -c" are kept intact.
+		{false, []string{"/usr/bin/env"}, []string{"/usr/bin/env"}, "/home/admin"},
+		{false, []string{"sh", "-c", "ls"}, []string{"sh", "-c", "ls"}, "/home/admin"},
+		{true, []string{"sh", "-c", "ls"}, []string{"sh", "-c", "cd /home/admin;ls"}, ""},
+	}
+
+	for _, test := range tests {
+		c := &Config{Cmd: test.cmd, LegacyCdRewrite: test.legacy}
+
+		if dir := c.workingDir("/home/admin"); dir != test.expectedDir || !reflect.DeepEqual(c.Cmd, test.expectedCmd) {
+			t.Errorf("workingDir of %q (legacy %v) = %q %q, want %q %q", test.cmd, test.legacy, dir, c.Cmd, test.expectedDir, test.expectedCmd)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package session
+
+import "strings"
+
+// defaultTerm is the terminal type of the sessions if the client doesn't forward its own.
+const defaultTerm = "xterm-256color"
+
+// term returns the terminal type of the session, the one forwarded by the client or defaultTerm.
+func (c *Config) term() string {
+	for _, kv := range c.Env {
+		if value, ok := strings.CutPrefix(kv, "TERM="); ok {
+			return value
+		}
+	}
+
+	return defaultTerm
+}
+
+// environ returns the environment of the command, base followed by the terminal type and the variables forwarded by
+// the client. The forwarded ones can't override base, e.g. PATH or HOME, as they're filtered by the agent.
+func (c *Config) environ(base ...string) []string {
+	env := append(base, "TERM="+c.term())
+
+	for _, kv := range c.Env {
+		if !strings.HasPrefix(kv, "TERM=") {
+			env = append(env, kv)
+		}
+	}
+
+	return env
+}
@@ -0,0 +1,69 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package session
+
+import (
+	"os"
+	"os/exec"
+	"trust-tunnel/pkg/common/sessionutil"
+
+	"github.com/creack/pty"
+)
+
+// Executor runs the nsenter commands of the sessions.
+type Executor interface {
+	// Command returns the command running nsenter with the arguments.
+	Command(args ...string) *exec.Cmd
+
+	// Kill kills the processes started by the nsenter process with the pid.
+	Kill(pid int) error
+}
+
+// PTY allocates and resizes the pseudo-terminals of the TTY sessions.
+type PTY interface {
+	// Open opens a pseudo-terminal, and returns its master and slave ends.
+	Open() (master, slave *os.File, err error)
+
+	// Setsize sets the size of the pseudo-terminal with the master end.
+	Setsize(master *os.File, rows, cols uint16) error
+}
+
+// hostExecutor runs the nsenter binary on the host.
+type hostExecutor struct{}
+
+func (hostExecutor) Command(args ...string) *exec.Cmd {
+	return exec.Command("nsenter", args...)
+}
+
+func (hostExecutor) Kill(pid int) error {
+	return sessionutil.KillProcessGroup(pid, "nsenter", false)
+}
+
+// hostPTY allocates the pseudo-terminals of the host.
+type hostPTY struct{}
+
+func (hostPTY) Open() (*os.File, *os.File, error) {
+	return pty.Open()
+}
+
+func (hostPTY) Setsize(master *os.File, rows, cols uint16) error {
+	return pty.Setsize(master, &pty.Winsize{Rows: rows, Cols: cols})
+}
+
+// The executor and the pseudo-terminal allocator used by the new sessions, replaced by fakes in tests.
+var (
+	nsenterExecutor Executor = hostExecutor{}
+	ptyAllocator    PTY      = hostPTY{}
+)
@@ -0,0 +1,287 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package session
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd"
+	dockerClient "github.com/docker/docker/client"
+	"github.com/moby/sys/user"
+	client "trust-tunnel/pkg/trust-tunnel-client"
+)
+
+const (
+	// defaultFileTailLines is the number of the last lines shown by tail if it's not requested.
+	defaultFileTailLines = 10
+
+	// fileChunkSize is the size of the chunks the files are read backwards by for tail.
+	fileChunkSize = 4096
+)
+
+// FileAccess is the file read by a session, audited once the session is terminated.
+type FileAccess struct {
+	// Size is the size of the file in bytes.
+	Size int64 `json:"size"`
+
+	// Mode is the type and the permissions of the file, e.g. "-rw-r--r--".
+	Mode string `json:"mode"`
+
+	// ModTime is the last modification time of the file.
+	ModTime string `json:"mtime"`
+
+	// SHA256 is the hash of the whole content, it's empty if the file isn't regular or is larger than the limit.
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+// FileReporter is implemented by the sessions reading a file in the target.
+type FileReporter interface {
+	// FileAccess returns the file read, it's nil if the file can't be opened.
+	FileAccess() *FileAccess
+}
+
+// fsUser is the login user whose filesystem IDs the files in the target are accessed with, so that the user can't
+// read or write the files denied to the user by their permissions. The agent's IDs are used if it's nil.
+type fsUser struct {
+	uid, gid int
+	groups   []int
+}
+
+// lookupLoginUser resolves the login user and group of the config in the root, it's nil if the login user isn't
+// given.
+func lookupLoginUser(root string, c *Config) (*user.ExecUser, error) {
+	if c.LoginName == "" {
+		return nil, nil
+	}
+
+	userSpec := c.LoginName
+	if c.LoginGroup != "" {
+		userSpec += ":" + c.LoginGroup
+	}
+
+	return lookupExecUser(root, userSpec)
+}
+
+// fsUserOf returns the user accessing the files as the login user, it's nil for root, who keeps the agent's IDs.
+func fsUserOf(execUser *user.ExecUser) *fsUser {
+	if execUser == nil || execUser.Uid == 0 {
+		return nil
+	}
+
+	return &fsUser{uid: execUser.Uid, gid: execUser.Gid, groups: execUser.Sgids}
+}
+
+// fileSession reads a file in the target by the agent, without spawning any process in the target.
+type fileSession struct {
+	*outputSession
+
+	lock   sync.Mutex
+	access *FileAccess
+}
+
+// establishFileSession establishes a session reading the file in the root of the target. The file is resolved
+// in the root without following symbolic links, so that it's the file allowed by the path policies, and opened
+// with the permissions of the login user.
+func establishFileSession(c *Config, apiClient dockerClient.CommonAPIClient, containerdClient *containerd.Client, containerRuntime ContainerRuntime) (Session, error) {
+	target, err := resolveVerbTarget(c, apiClient, containerdClient, containerRuntime)
+	if err != nil {
+		return nil, err
+	}
+
+	root := target.Root
+	logger.Infof("%s %s in %s", c.File.Verb, c.File.Path, root)
+
+	execUser, err := lookupLoginUser(root, c)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &fileSession{outputSession: newOutputSession()}
+	s.frameSize = frameSizeOf(c.FrameSize)
+	s.stream(c.File.Path, func(stdout, _ io.Writer) error {
+		if err := s.read(root, c.File, c.FileMaxBytes, fsUserOf(execUser), stdout); err != nil {
+			return fmt.Errorf("%s: %v", c.File.Verb, err)
+		}
+
+		return nil
+	})
+
+	return s, nil
+}
+
+func (s *fileSession) FileAccess() *FileAccess {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.access
+}
+
+// read writes the content, the last lines or the metadata of the file to stdout, and records the access.
+func (s *fileSession) read(root string, req *client.FileRequest, maxBytes int64, u *fsUser, stdout io.Writer) error {
+	access, err := readFile(root, req, maxBytes, u, stdout)
+
+	s.lock.Lock()
+	s.access = access
+	s.lock.Unlock()
+
+	return err
+}
+
+// readFile writes the content, the last lines or the metadata of the file in the root to stdout, opening it as
+// the user. The access is returned once the file is opened, even if it fails to be read then.
+func readFile(root string, req *client.FileRequest, maxBytes int64, u *fsUser, stdout io.Writer) (*FileAccess, error) {
+	f, err := openInRoot(root, req.Path, u)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	access := &FileAccess{Size: info.Size(), Mode: info.Mode().String(), ModTime: info.ModTime().UTC().Format(time.RFC3339)}
+
+	if req.Verb == client.FileVerbStat {
+		if info.Mode().IsRegular() && info.Size() <= maxBytes {
+			if access.SHA256, err = hashFile(f); err != nil {
+				return access, err
+			}
+		}
+
+		_, err = io.WriteString(stdout, formatStat(req.Path, info, access))
+
+		return access, err
+	}
+
+	if !info.Mode().IsRegular() {
+		return access, fmt.Errorf("%s isn't a regular file", req.Path)
+	}
+
+	if req.Verb == client.FileVerbCat {
+		if info.Size() > maxBytes {
+			return access, fmt.Errorf("%s is larger than %d bytes, use tail instead", req.Path, maxBytes)
+		}
+
+		hash := sha256.New()
+		if _, err = io.Copy(io.MultiWriter(stdout, hash), io.LimitReader(f, maxBytes)); err != nil {
+			return access, err
+		}
+
+		access.SHA256 = hex.EncodeToString(hash.Sum(nil))
+
+		return access, nil
+	}
+
+	lines := req.Lines
+	if lines <= 0 {
+		lines = defaultFileTailLines
+	}
+
+	tail, err := tailLines(f, info.Size(), lines, maxBytes)
+	if err != nil {
+		return access, err
+	}
+
+	if _, err = stdout.Write(tail); err != nil {
+		return access, err
+	}
+
+	if info.Size() <= maxBytes {
+		access.SHA256, err = hashFile(f)
+	}
+
+	return access, err
+}
+
+// hashFile returns the hash of the whole content of the file.
+func hashFile(f *os.File) (string, error) {
+	hash := sha256.New()
+	if _, err := io.Copy(hash, io.NewSectionReader(f, 0, 1<<62)); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// tailLines returns the last n lines of the file of the size, within the last maxBytes bytes.
+func tailLines(r io.ReaderAt, size int64, n int, maxBytes int64) ([]byte, error) {
+	start := size - maxBytes
+	if start < 0 {
+		start = 0
+	}
+
+	var tail []byte
+
+	newlines := 0
+
+	for pos := size; pos > start; {
+		chunk := make([]byte, min(fileChunkSize, pos-start))
+		pos -= int64(len(chunk))
+
+		if _, err := r.ReadAt(chunk, pos); err != nil && err != io.EOF {
+			return nil, err
+		}
+
+		for i := len(chunk) - 1; i >= 0; i-- {
+			// The line break ending the file doesn't start a line.
+			if chunk[i] != '\n' || pos+int64(i) == size-1 {
+				continue
+			}
+
+			if newlines++; newlines == n {
+				return append(chunk[i+1:], tail...), nil
+			}
+		}
+
+		tail = append(chunk, tail...)
+	}
+
+	return tail, nil
+}
+
+// formatStat returns the metadata of the file shown by stat.
+func formatStat(p string, info fs.FileInfo, access *FileAccess) string {
+	fileType := "regular file"
+
+	switch {
+	case info.IsDir():
+		fileType = "directory"
+	case !info.Mode().IsRegular():
+		fileType = info.Mode().Type().String()
+	}
+
+	text := fmt.Sprintf("path: %s\ntype: %s\nsize: %d\nmode: %s\n", p, fileType, access.Size, access.Mode)
+
+	if uid, gid, ok := fileOwner(info); ok {
+		text += fmt.Sprintf("uid: %d\ngid: %d\n", uid, gid)
+	}
+
+	text += fmt.Sprintf("modified: %s\n", access.ModTime)
+
+	if access.SHA256 != "" {
+		text += fmt.Sprintf("sha256: %s\n", access.SHA256)
+	}
+
+	return text
+}
@@ -0,0 +1,131 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+
+package session
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"runtime"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// openInRoot opens the file for reading as the user, resolving the path in the root as if the root were "/", and
+// refusing the symbolic links, so that the file can't escape the root or the path policies. The root itself is
+// opened by the agent, for its parents on the host may not be searchable by the user. It requires linux 5.6.
+func openInRoot(root, path string, u *fsUser) (*os.File, error) {
+	rootFd, err := unix.Open(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("open root %s error: %v", root, err)
+	}
+	defer unix.Close(rootFd)
+
+	var fd int
+
+	err = u.do(func() (err error) {
+		fd, err = unix.Openat2(rootFd, path, &unix.OpenHow{
+			Flags:   unix.O_RDONLY | unix.O_CLOEXEC | unix.O_NOCTTY | unix.O_NONBLOCK,
+			Resolve: unix.RESOLVE_IN_ROOT | unix.RESOLVE_NO_SYMLINKS | unix.RESOLVE_NO_MAGICLINKS,
+		})
+
+		return err
+	})
+
+	switch {
+	case errors.Is(err, unix.ELOOP):
+		return nil, fmt.Errorf("%s contains a symbolic link", path)
+	case errors.Is(err, unix.ENOSYS):
+		return nil, fmt.Errorf("file verbs require linux 5.6 or later")
+	case err != nil:
+		return nil, &fs.PathError{Op: "open", Path: path, Err: err}
+	}
+
+	return os.NewFile(uintptr(fd), path), nil
+}
+
+// fileOwner returns the owner of the file.
+func fileOwner(info fs.FileInfo) (int, int, bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, false
+	}
+
+	return int(stat.Uid), int(stat.Gid), true
+}
+
+// do runs fn on a thread whose filesystem IDs and supplementary groups are the user's, so that the files are
+// accessed with the permissions of the user rather than the agent's. The IDs are per thread on linux, so the thread
+// is locked meanwhile, and is discarded with the goroutine if the agent's IDs fail to be restored.
+func (u *fsUser) do(fn func() error) error {
+	if u == nil {
+		return fn()
+	}
+
+	runtime.LockOSThread()
+
+	groups, err := unix.Getgroups()
+	if err != nil {
+		runtime.UnlockOSThread()
+
+		return fmt.Errorf("get groups error: %v", err)
+	}
+
+	uid, gid := unix.Geteuid(), unix.Getegid()
+
+	if err = setFsIDs(u.uid, u.gid, u.groups); err != nil {
+		err = fmt.Errorf("switch to user %d:%d error: %v", u.uid, u.gid, err)
+	} else {
+		err = fn()
+	}
+
+	if restoreErr := setFsIDs(uid, gid, groups); restoreErr != nil {
+		logger.Errorf("restore filesystem IDs %d:%d error: %v", uid, gid, restoreErr)
+
+		return err
+	}
+
+	runtime.UnlockOSThread()
+
+	return err
+}
+
+// setFsIDs sets the filesystem IDs and the supplementary groups of the current thread, unix.Setgroups sets them of
+// the current thread only, unlike syscall.Setgroups. The fsuid is set last, for the filesystem capabilities are
+// dropped once it isn't root.
+func setFsIDs(uid, gid int, groups []int) error {
+	if err := unix.Setgroups(groups); err != nil {
+		return fmt.Errorf("set groups error: %v", err)
+	}
+
+	// The calls return the previous IDs rather than the errors, so the IDs are read back to be checked.
+	unix.Setfsgid(gid)
+
+	if fsgid, _ := unix.SetfsgidRetGid(-1); fsgid != gid {
+		return fmt.Errorf("set fsgid %d error: %v", gid, unix.EPERM)
+	}
+
+	unix.Setfsuid(uid)
+
+	if fsuid, _ := unix.SetfsuidRetUid(-1); fsuid != uid {
+		return fmt.Errorf("set fsuid %d error: %v", uid, unix.EPERM)
+	}
+
+	return nil
+}
@@ -0,0 +1,118 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package session
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	client "trust-tunnel/pkg/trust-tunnel-client"
+)
+
+func TestTailLines(t *testing.T) {
+	content := strings.Repeat("line\n", 2000) + "last\n"
+
+	for _, c := range []struct {
+		n        int
+		maxBytes int64
+		want     string
+	}{
+		{n: 1, maxBytes: 1 << 20, want: "last\n"},
+		{n: 3, maxBytes: 1 << 20, want: "line\nline\nlast\n"},
+		{n: 5000, maxBytes: 1 << 20, want: content},
+		{n: 5000, maxBytes: 7, want: "e\nlast\n"},
+	} {
+		tail, err := tailLines(strings.NewReader(content), int64(len(content)), c.n, c.maxBytes)
+		if err != nil || string(tail) != c.want {
+			t.Errorf("tailLines(%d, %d) = %q, %v", c.n, c.maxBytes, tail, err)
+		}
+	}
+}
+
+func TestFileSessionRead(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "etc"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(filepath.Join(root, "etc/hosts"), []byte("127.0.0.1 localhost\n::1 localhost\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Symlink("/etc/hosts", filepath.Join(root, "etc/link")); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &fileSession{}
+
+	var stdout bytes.Buffer
+	if err := s.read(root, &client.FileRequest{Verb: client.FileVerbTail, Path: "/etc/hosts", Lines: 1}, 1<<20, nil, &stdout); err != nil {
+		t.Fatal(err)
+	}
+
+	access := s.FileAccess()
+	if stdout.String() != "::1 localhost\n" || access.Size != 34 || len(access.SHA256) != 64 {
+		t.Errorf("unexpected output %q and access %+v", stdout.String(), access)
+	}
+
+	// The file larger than the limit is refused by cat.
+	if err := s.read(root, &client.FileRequest{Verb: client.FileVerbCat, Path: "/etc/hosts"}, 10, nil, &stdout); err == nil {
+		t.Error("cat of the large file should be refused")
+	}
+
+	// The path can't escape the root, and the symbolic links aren't followed.
+	for _, p := range []string{"/../../etc/passwd", "/etc/link"} {
+		if err := s.read(root, &client.FileRequest{Verb: client.FileVerbCat, Path: p}, 1<<20, nil, &stdout); err == nil {
+			t.Errorf("%s should be refused", p)
+		}
+	}
+}
+
+func TestFileSessionReadAsUser(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("switching the filesystem IDs requires root")
+	}
+
+	root := t.TempDir()
+	if err := os.Chmod(root, 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, perm := range map[string]os.FileMode{"public": 0o644, "private": 0o600} {
+		if err := os.WriteFile(filepath.Join(root, name), []byte(name+"\n"), perm); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s := &fileSession{}
+	nobody := &fsUser{uid: 65534, gid: 65534}
+
+	var stdout bytes.Buffer
+	if err := s.read(root, &client.FileRequest{Verb: client.FileVerbCat, Path: "/public"}, 1<<20, nobody, &stdout); err != nil || stdout.String() != "public\n" {
+		t.Errorf("cat of the public file = %q, %v", stdout.String(), err)
+	}
+
+	// The file denied to the user by its permissions is refused, though the agent can read it.
+	if err := s.read(root, &client.FileRequest{Verb: client.FileVerbCat, Path: "/private"}, 1<<20, nobody, &stdout); err == nil {
+		t.Error("cat of the private file should be refused")
+	}
+
+	if err := s.read(root, &client.FileRequest{Verb: client.FileVerbCat, Path: "/private"}, 1<<20, nil, &stdout); err != nil {
+		t.Errorf("cat of the private file by the agent error: %v", err)
+	}
+}
@@ -0,0 +1,178 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package session
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
+	"trust-tunnel/pkg/trust-tunnel-client/forward"
+
+	"github.com/containerd/containerd"
+	dockerClient "github.com/docker/docker/client"
+)
+
+// forwardDialTimeout is the timeout of connecting to the port forwarded.
+const forwardDialTimeout = 10 * time.Second
+
+// ForwardStats is the connections forwarded by a session, audited once the session is terminated.
+type ForwardStats struct {
+	// Host and Port are the host and the port forwarded to, the host is empty for the loopback.
+	Host string `json:"host,omitempty"`
+	Port int    `json:"port"`
+
+	// Reverse is whether the connections to Port of the loopback are forwarded to the client instead.
+	Reverse bool `json:"reverse,omitempty"`
+
+	forward.Stats
+}
+
+// ForwardReporter is implemented by the sessions forwarding connections.
+type ForwardReporter interface {
+	// ForwardStats returns the connections forwarded so far.
+	ForwardStats() *ForwardStats
+}
+
+// forwardSession forwards the connections of the client to the port of the host, or of the loopback, in the
+// target's network namespace, or the connections to the port of the loopback to the client if it's reversed,
+// without spawning any process in the target. The forward frames of the client are the input of the session, and
+// the ones of the agent are the output.
+type forwardSession struct {
+	*outputSession
+
+	stdinReader *io.PipeReader
+	stdinWriter *io.PipeWriter
+
+	host    string
+	port    int
+	reverse bool
+	mux     atomic.Pointer[forward.Mux]
+}
+
+// establishForwardSession establishes a session forwarding the connections to the host and the port of the config,
+// up to ForwardMaxStreams of them at once. The host is resolved by the target for each connection.
+func establishForwardSession(c *Config, apiClient dockerClient.CommonAPIClient, containerdClient *containerd.Client, containerRuntime ContainerRuntime) (Session, error) {
+	target, err := resolveVerbTarget(c, apiClient, containerdClient, containerRuntime)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.Forward.Reverse {
+		return establishReverseForward(c, target)
+	}
+
+	host, port := c.Forward.Host, c.Forward.Port
+
+	name := fmt.Sprintf("port %d", port)
+	if host != "" {
+		name = net.JoinHostPort(host, strconv.Itoa(port))
+	}
+
+	logger.Infof("forward to %s in the network namespace of %d", name, target.PID)
+
+	s := &forwardSession{outputSession: newOutputSession(), host: host, port: port}
+	s.stdinReader, s.stdinWriter = io.Pipe()
+
+	dial := func() (net.Conn, error) {
+		return dialTarget(target, host, port)
+	}
+
+	s.stream(name, func(stdout, _ io.Writer) error {
+		mux := forward.NewAgent(s.stdinReader, stdout, dial, c.ForwardMaxStreams)
+		s.mux.Store(mux)
+
+		if err := mux.Serve(); err != nil {
+			return fmt.Errorf("forward to %s: %v", name, err)
+		}
+
+		return nil
+	})
+
+	return s, nil
+}
+
+// establishReverseForward establishes a session listening on the port of the loopback in the target's network
+// namespace, whose connections are forwarded to the client, up to ForwardMaxStreams of them at once. The listener
+// is closed once the session ends.
+func establishReverseForward(c *Config, target *VerbTarget) (Session, error) {
+	port := c.Forward.Port
+
+	listener, err := listenInNetns(target.PID, net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	if err != nil {
+		return nil, fmt.Errorf("listen on port %d: %v", port, err)
+	}
+
+	logger.Infof("forward from port %d in the network namespace of %d", port, target.PID)
+
+	s := &forwardSession{outputSession: newOutputSession(), port: port, reverse: true}
+	s.stdinReader, s.stdinWriter = io.Pipe()
+
+	name := fmt.Sprintf("port %d", port)
+
+	s.stream(name, func(stdout, _ io.Writer) error {
+		defer listener.Close()
+
+		mux := forward.NewReverseAgent(s.stdinReader, stdout, c.ForwardMaxStreams)
+		s.mux.Store(mux)
+
+		go func() {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+
+				// The connections beyond the limit are refused, and the others fail once the mux is closed.
+				if err = mux.Open(conn); err != nil && !errors.Is(err, forward.ErrTooManyStreams) {
+					return
+				}
+			}
+		}()
+
+		if err := mux.Serve(); err != nil {
+			return fmt.Errorf("forward from %s: %v", name, err)
+		}
+
+		return nil
+	})
+
+	return s, nil
+}
+
+func (s *forwardSession) NextStdin() (io.WriteCloser, error) {
+	return s.stdinWriter, nil
+}
+
+func (s *forwardSession) CloseStdin() error {
+	return s.stdinWriter.Close()
+}
+
+func (s *forwardSession) Clean() error {
+	s.stdinReader.CloseWithError(fmt.Errorf("session is cleaned"))
+
+	return s.outputSession.Clean()
+}
+
+func (s *forwardSession) ForwardStats() *ForwardStats {
+	stats := &ForwardStats{Host: s.host, Port: s.port, Reverse: s.reverse}
+	if mux := s.mux.Load(); mux != nil {
+		stats.Stats = mux.Stats()
+	}
+
+	return stats
+}
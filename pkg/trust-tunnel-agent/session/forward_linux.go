@@ -0,0 +1,80 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//go:build linux
+
+package session
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+
+	"golang.org/x/sys/unix"
+)
+
+// dialInNetns connects to the address over the network, "tcp" or "udp", in the network namespace of the process.
+func dialInNetns(pid int, network, addr string) (net.Conn, error) {
+	var conn net.Conn
+
+	err := inNetns(pid, func() (err error) {
+		conn, err = net.DialTimeout(network, addr, forwardDialTimeout)
+
+		return err
+	})
+
+	return conn, err
+}
+
+// listenInNetns listens on the TCP address in the network namespace of the process.
+func listenInNetns(pid int, addr string) (net.Listener, error) {
+	var listener net.Listener
+
+	err := inNetns(pid, func() (err error) {
+		listener, err = net.Listen("tcp", addr)
+
+		return err
+	})
+
+	return listener, err
+}
+
+// inNetns runs fn in the network namespace of the process, the sockets created by fn stay in it. fn is run by a
+// dedicated thread entering the namespace, which is locked and never unlocked, so that it's terminated with the
+// goroutine rather than serving others in the namespace.
+func inNetns(pid int, fn func() error) error {
+	ch := make(chan error, 1)
+
+	go func() {
+		runtime.LockOSThread()
+
+		ns, err := os.Open(fmt.Sprintf("/proc/%d/ns/net", pid))
+		if err != nil {
+			ch <- fmt.Errorf("open the network namespace: %v", err)
+
+			return
+		}
+		defer ns.Close()
+
+		if err := unix.Setns(int(ns.Fd()), unix.CLONE_NEWNET); err != nil {
+			ch <- fmt.Errorf("enter the network namespace: %v", err)
+
+			return
+		}
+
+		ch <- fn()
+	}()
+
+	return <-ch
+}
@@ -0,0 +1,31 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//go:build !linux
+
+package session
+
+import (
+	"fmt"
+	"net"
+)
+
+// dialInNetns is a placeholder on platforms without network namespaces.
+func dialInNetns(_ int, _, _ string) (net.Conn, error) {
+	return nil, fmt.Errorf("port forwarding is only supported on linux")
+}
+
+// listenInNetns is a placeholder on platforms without network namespaces.
+func listenInNetns(_ int, _ string) (net.Listener, error) {
+	return nil, fmt.Errorf("port forwarding is only supported on linux")
+}
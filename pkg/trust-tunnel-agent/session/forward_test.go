@@ -0,0 +1,244 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//go:build linux
+
+package session
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	client "trust-tunnel/pkg/trust-tunnel-client"
+	"trust-tunnel/pkg/trust-tunnel-client/forward"
+)
+
+func TestDialInNetns(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go func() {
+		conn, err := l.Accept()
+		if err == nil {
+			conn.Write([]byte("hello"))
+			conn.Close()
+		}
+	}()
+
+	conn, err := dialInNetns(os.Getpid(), "tcp", l.Addr().String())
+	if err != nil && strings.Contains(err.Error(), "operation not permitted") {
+		t.Skipf("entering the network namespace requires CAP_SYS_ADMIN: %v", err)
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if data, err := io.ReadAll(conn); err != nil || string(data) != "hello" {
+		t.Errorf("got %q, %v", data, err)
+	}
+
+	if _, err := dialInNetns(1<<22+1, "tcp", l.Addr().String()); err == nil || !strings.Contains(err.Error(), "open the network namespace") {
+		t.Errorf("got %v dialing in the namespace of a missing process", err)
+	}
+}
+
+// serveDNS answers the A queries of the name with the address, and the others with NXDOMAIN.
+func serveDNS(conn net.PacketConn, name string, addr net.IP) {
+	buf := make([]byte, 512)
+
+	for {
+		n, peer, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+
+		// The question follows the header of 12 bytes, as the labels of the name, the type and the class.
+		var labels []string
+
+		i := 12
+		for i < n && buf[i] != 0 {
+			labels = append(labels, string(buf[i+1:i+1+int(buf[i])]))
+			i += 1 + int(buf[i])
+		}
+
+		question := buf[12 : i+5]
+		qtype := binary.BigEndian.Uint16(buf[i+1:])
+
+		resp := append([]byte{buf[0], buf[1], 0x81, 0x80, 0, 1, 0, 0, 0, 0, 0, 0}, question...)
+
+		switch {
+		case strings.Join(labels, ".")+"." != name:
+			resp[3] |= 3
+		case qtype == 1:
+			resp[7] = 1
+			resp = append(resp, 0xc0, 12, 0, 1, 0, 1, 0, 0, 0, 60, 0, 4)
+			resp = append(resp, addr.To4()...)
+		}
+
+		conn.WriteTo(resp, peer)
+	}
+}
+
+func TestResolveInNetns(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	go serveDNS(conn, "db.prod.svc.cluster.local.", net.IPv4(10, 0, 0, 5))
+
+	conf := &resolvConf{servers: []string{conn.LocalAddr().String()}, search: []string{"svc.cluster.local", "prod.svc.cluster.local"}, ndots: 5}
+
+	ips, err := conf.lookup(context.Background(), os.Getpid(), "db")
+	if err != nil && strings.Contains(err.Error(), "operation not permitted") {
+		t.Skipf("entering the network namespace requires CAP_SYS_ADMIN: %v", err)
+	}
+
+	if err != nil || len(ips) != 1 || !ips[0].Equal(net.IPv4(10, 0, 0, 5)) {
+		t.Fatalf("got %v, %v", ips, err)
+	}
+
+	if _, err = conf.lookup(context.Background(), os.Getpid(), "cache"); err == nil || !strings.Contains(err.Error(), "no such host") {
+		t.Errorf("got %v resolving a missing host", err)
+	}
+}
+
+// stdoutReader reads the frames of the stdout of the session as a stream.
+type stdoutReader struct {
+	s     Session
+	frame io.Reader
+}
+
+func (r *stdoutReader) Read(p []byte) (int, error) {
+	for {
+		if r.frame != nil {
+			n, err := r.frame.Read(p)
+			if err != nil {
+				r.frame = nil
+			}
+
+			if n > 0 || err != io.EOF {
+				return n, nil
+			}
+		}
+
+		frame, err := r.s.NextStdout()
+		if err != nil {
+			r.s.StdoutDone()
+
+			return 0, err
+		}
+
+		r.frame = frame
+	}
+}
+
+func TestReverseForward(t *testing.T) {
+	local, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer local.Close()
+
+	// The local port of the client echoes the connections in upper case until they are half-closed.
+	go func() {
+		for {
+			conn, err := local.Accept()
+			if err != nil {
+				return
+			}
+
+			data, _ := io.ReadAll(conn)
+			conn.Write(bytes.ToUpper(data))
+			conn.Close()
+		}
+	}()
+
+	// The port is taken from a listener closed right away.
+	free, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	port := free.Addr().(*net.TCPAddr).Port
+	free.Close()
+
+	c := &Config{Forward: &client.ForwardRequest{Port: port, Reverse: true}, ForwardMaxStreams: 4}
+
+	sess, err := establishReverseForward(c, &VerbTarget{PID: os.Getpid(), Root: "/"})
+	if err != nil && strings.Contains(err.Error(), "operation not permitted") {
+		t.Skipf("entering the network namespace requires CAP_SYS_ADMIN: %v", err)
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.Clean()
+
+	stdin, _ := sess.NextStdin()
+
+	go func() {
+		for {
+			if _, err := sess.NextStderr(); err != nil {
+				sess.StderrDone()
+
+				return
+			}
+		}
+	}()
+
+	mux := forward.NewReverseClient(&stdoutReader{s: sess}, stdin, func() (net.Conn, error) { return net.Dial("tcp", local.Addr().String()) })
+	go mux.Serve()
+
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	conn.Write([]byte("hello"))
+	conn.(*net.TCPConn).CloseWrite()
+
+	if data, err := io.ReadAll(conn); err != nil || string(data) != "HELLO" {
+		t.Fatalf("got %q, %v", data, err)
+	}
+
+	// The listener is closed once the client ends the session.
+	sess.CloseStdin()
+
+	if code := sess.ExitCode(); code != 0 {
+		t.Errorf("got exit code %d", code)
+	}
+
+	if conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port))); err == nil {
+		conn.Close()
+		t.Errorf("port %d is still listened on", port)
+	}
+
+	if stats := sess.(ForwardReporter).ForwardStats(); !stats.Reverse || stats.Streams != 1 || stats.BytesOut != 5 {
+		t.Errorf("got stats %+v", stats)
+	}
+}
@@ -0,0 +1,333 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package session
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+	"trust-tunnel/pkg/common/sessionutil"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/docker/docker/api/types/container"
+	dockerClient "github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/stdcopy"
+)
+
+const (
+	// criMetadataExtension is the extension of the containers created by the CRI plugin of containerd,
+	// which holds the path of the log file the output of the main process is written to.
+	criMetadataExtension = "io.cri-containerd.container.metadata"
+
+	// criLogStdout and criLogStderr are the streams of the lines of CRI log files, and criLogPartial is the tag
+	// of the partial lines, which are split for they're too long.
+	criLogStdout  = "stdout"
+	criLogStderr  = "stderr"
+	criLogPartial = "P"
+)
+
+// logsPollInterval is the interval of polling the log file for the new lines when the output is followed.
+var logsPollInterval = 250 * time.Millisecond
+
+// establishLogsSession establishes a session streaming the output of the main process of the container.
+// The output is read from docker, or from the log file of the CRI plugin for containerd, as the output of
+// the main process can't be shared with the CRI plugin reading it.
+func establishLogsSession(c *Config, apiClient dockerClient.CommonAPIClient, containerdClient *containerd.Client, containerRuntime ContainerRuntime) (Session, error) {
+	if containerRuntime == Docker {
+		return establishDockerLogsSession(c, apiClient)
+	}
+
+	return establishContainerdLogsSession(c, containerdClient)
+}
+
+// establishDockerLogsSession streams the logs of the container from docker.
+func establishDockerLogsSession(c *Config, apiClient dockerClient.CommonAPIClient) (*outputSession, error) {
+	if apiClient == nil {
+		return nil, fmt.Errorf("container Client is nil")
+	}
+
+	s := newOutputSession()
+
+	info, err := apiClient.ContainerInspect(s.ctx, c.ContainerID)
+	if err != nil {
+		s.Close()
+
+		return nil, fmt.Errorf("%s", sessionutil.WrapContainerError(err.Error(), c.ContainerID))
+	}
+
+	tail := "all"
+	if c.Logs.Tail >= 0 {
+		tail = strconv.Itoa(c.Logs.Tail)
+	}
+
+	reader, err := apiClient.ContainerLogs(s.ctx, c.ContainerID, container.LogsOptions{
+		ShowStdout: true,
+		ShowStderr: true,
+		Follow:     c.Logs.Follow,
+		Tail:       tail,
+	})
+	if err != nil {
+		s.Close()
+
+		return nil, fmt.Errorf("%s", sessionutil.WrapContainerError(err.Error(), c.ContainerID))
+	}
+
+	// The output of the containers with a TTY isn't multiplexed.
+	tty := info.Config != nil && info.Config.Tty
+
+	logger.Infof("stream logs of container %s", c.ContainerID)
+
+	s.stream(c.ContainerID, func(stdout, stderr io.Writer) error {
+		defer reader.Close()
+
+		if tty {
+			_, err := io.Copy(stdout, reader)
+
+			return err
+		}
+
+		_, err := stdcopy.StdCopy(stdout, stderr, reader)
+
+		return err
+	})
+
+	return s, nil
+}
+
+// establishContainerdLogsSession streams the log file of the container written by the CRI plugin,
+// which is read under the RootfsPrefix.
+func establishContainerdLogsSession(c *Config, containerdClient *containerd.Client) (*outputSession, error) {
+	if containerdClient == nil {
+		return nil, fmt.Errorf("containerd Client is nil")
+	}
+
+	ctx := namespaces.WithNamespace(context.Background(), c.ContainerNamespace)
+
+	cont, err := containerdClient.LoadContainer(ctx, c.ContainerID)
+	if err != nil {
+		return nil, fmt.Errorf("%s", sessionutil.WrapContainerError(err.Error(), c.ContainerID))
+	}
+
+	info, err := cont.Info(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("get container info error: %v", err)
+	}
+
+	logPath, err := criLogPath(info.Extensions[criMetadataExtension])
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(c.RootfsPrefix + logPath)
+	if err != nil {
+		return nil, fmt.Errorf("open container log file error: %v", err)
+	}
+
+	logger.Infof("stream logs of container %s from %s", c.ContainerID, logPath)
+
+	s := newOutputSession()
+	s.stream(c.ContainerID, func(stdout, stderr io.Writer) error {
+		follower := &criLogFollower{path: c.RootfsPrefix + logPath, file: f, stdout: stdout, stderr: stderr}
+		defer follower.close()
+
+		return follower.run(s.ctx, c.Logs.Tail, c.Logs.Follow)
+	})
+
+	return s, nil
+}
+
+// criLogPath returns the path of the log file in the CRI metadata of the container.
+func criLogPath(metadata interface{ GetValue() []byte }) (string, error) {
+	if metadata == nil {
+		return "", fmt.Errorf("logs are only available for the containers of kubernetes with containerd")
+	}
+
+	var versioned struct {
+		Metadata struct {
+			LogPath string
+		}
+	}
+
+	if err := json.Unmarshal(metadata.GetValue(), &versioned); err != nil {
+		return "", fmt.Errorf("decode CRI metadata of container error: %v", err)
+	}
+
+	if versioned.Metadata.LogPath == "" {
+		return "", fmt.Errorf("no log file of the container")
+	}
+
+	return versioned.Metadata.LogPath, nil
+}
+
+// criLogFollower reads the log file of the CRI plugin, whose lines are "{time} {stream} {tag} {content}",
+// and writes the content to the stream. The rotations of the file are followed.
+type criLogFollower struct {
+	path   string
+	file   *os.File
+	reader *bufio.Reader
+	stdout io.Writer
+	stderr io.Writer
+
+	// pending is the incomplete line at the end of the file.
+	pending []byte
+}
+
+// run writes the last tail lines of the file, all lines if tail is negative, and then the new lines until ctx is
+// done if follow is set.
+func (f *criLogFollower) run(ctx context.Context, tail int, follow bool) error {
+	f.reader = bufio.NewReader(f.file)
+
+	lines, err := f.readLines()
+	if err != nil {
+		return err
+	}
+
+	if tail >= 0 && len(lines) > tail {
+		lines = lines[len(lines)-tail:]
+	}
+
+	for _, line := range lines {
+		if err = f.writeLine(line); err != nil {
+			return err
+		}
+	}
+
+	for follow {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(logsPollInterval):
+		}
+
+		if lines, err = f.readLines(); err != nil {
+			return err
+		}
+
+		for _, line := range lines {
+			if err = f.writeLine(line); err != nil {
+				return err
+			}
+		}
+
+		if err = f.reopenIfRotated(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// readLines reads the complete lines till the end of the file.
+func (f *criLogFollower) readLines() ([][]byte, error) {
+	var lines [][]byte
+
+	for {
+		data, err := f.reader.ReadBytes('\n')
+		f.pending = append(f.pending, data...)
+
+		if err == io.EOF {
+			return lines, nil
+		}
+
+		if err != nil {
+			return lines, err
+		}
+
+		lines = append(lines, f.pending)
+		f.pending = nil
+	}
+}
+
+// reopenIfRotated reopens the file if it's rotated, or reads it from the start if it's truncated.
+// It's called after the file is read till the end.
+func (f *criLogFollower) reopenIfRotated() error {
+	current, err := f.file.Stat()
+	if err != nil {
+		return err
+	}
+
+	latest, err := os.Stat(f.path)
+	if err != nil {
+		// The file may be being rotated.
+		return nil
+	}
+
+	offset, err := f.file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+
+	if os.SameFile(current, latest) {
+		if latest.Size() < offset {
+			f.pending = nil
+			f.reader.Reset(f.file)
+
+			_, err = f.file.Seek(0, io.SeekStart)
+		}
+
+		return err
+	}
+
+	file, err := os.Open(f.path)
+	if err != nil {
+		return nil
+	}
+
+	f.file.Close()
+	f.file = file
+	f.pending = nil
+	f.reader.Reset(file)
+
+	return nil
+}
+
+// writeLine writes the content of the line to its stream, the partial lines are written without the line break.
+func (f *criLogFollower) writeLine(line []byte) error {
+	parts := bytes.SplitN(line, []byte(" "), 4)
+	if len(parts) != 4 {
+		_, err := f.stdout.Write(line)
+
+		return err
+	}
+
+	content := parts[3]
+	if string(parts[2]) == criLogPartial {
+		content = bytes.TrimSuffix(content, []byte("\n"))
+	}
+
+	var err error
+
+	switch string(parts[1]) {
+	case criLogStderr:
+		_, err = f.stderr.Write(content)
+	case criLogStdout:
+		_, err = f.stdout.Write(content)
+	default:
+		_, err = f.stdout.Write(line)
+	}
+
+	return err
+}
+
+func (f *criLogFollower) close() {
+	f.file.Close()
+}
@@ -0,0 +1,167 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package session
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+	ttclient "trust-tunnel/pkg/trust-tunnel-client"
+)
+
+// logsDockerClient is a docker client serving the logs of a container without a TTY.
+type logsDockerClient struct {
+	client.CommonAPIClient
+
+	options container.LogsOptions
+}
+
+func (c *logsDockerClient) ContainerInspect(_ context.Context, _ string) (types.ContainerJSON, error) {
+	return types.ContainerJSON{Config: &container.Config{}}, nil
+}
+
+func (c *logsDockerClient) ContainerLogs(_ context.Context, _ string, options container.LogsOptions) (io.ReadCloser, error) {
+	c.options = options
+
+	return io.NopCloser(strings.NewReader(frame(stdout, "out\n") + frame(stderr, "err\n"))), nil
+}
+
+// readAll reads the output streams of the session until they're closed.
+func readAll(s *outputSession) (string, string) {
+	stderrCh := make(chan []string, 1)
+
+	go func() {
+		stderrCh <- readChunks(s.NextStderr)
+	}()
+
+	return strings.Join(readChunks(s.NextStdout), ""), strings.Join(<-stderrCh, "")
+}
+
+// chunks sends the chunks of the stream on the channel returned until the stream ends.
+func chunks(next func() (io.Reader, error)) <-chan io.Reader {
+	ch := make(chan io.Reader)
+
+	go func() {
+		defer close(ch)
+
+		for {
+			reader, err := next()
+			if err != nil {
+				return
+			}
+
+			ch <- reader
+		}
+	}()
+
+	return ch
+}
+
+func TestDockerLogsSession(t *testing.T) {
+	apiClient := &logsDockerClient{}
+
+	s, err := establishDockerLogsSession(&Config{ContainerID: "c", Logs: &ttclient.LogsOptions{Tail: 10}}, apiClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Clean()
+
+	if stdout, stderr := readAll(s); stdout != "out\n" || stderr != "err\n" {
+		t.Errorf("unexpected output %q %q", stdout, stderr)
+	}
+
+	if apiClient.options.Tail != "10" || apiClient.options.Follow {
+		t.Errorf("unexpected options %+v", apiClient.options)
+	}
+}
+
+func TestCRILogFollower(t *testing.T) {
+	logsPollInterval = time.Millisecond
+	path := filepath.Join(t.TempDir(), "0.log")
+
+	writeLog := func(lines ...string) {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+
+		for _, line := range lines {
+			f.WriteString(line)
+		}
+	}
+
+	writeLog("2024-01-01T00:00:00.000000000Z stdout F old\n",
+		"2024-01-01T00:00:00.000000000Z stdout P last \n",
+		"2024-01-01T00:00:00.000000000Z stdout F line\n",
+		"2024-01-01T00:00:00.000000000Z stderr F error\n")
+
+	s := newOutputSession()
+	defer s.Clean()
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.stream("c", func(stdout, stderr io.Writer) error {
+		follower := &criLogFollower{path: path, file: f, stdout: stdout, stderr: stderr}
+		defer follower.close()
+
+		return follower.run(s.ctx, 3, true)
+	})
+
+	var stdoutBuf, stderrBuf bytes.Buffer
+
+	stdoutCh, stderrCh := chunks(s.NextStdout), chunks(s.NextStderr)
+
+	expect := func(expectedStdout, expectedStderr string) {
+		for !strings.HasSuffix(stdoutBuf.String(), expectedStdout) || stderrBuf.String() != expectedStderr {
+			select {
+			case r := <-stdoutCh:
+				io.Copy(&stdoutBuf, r)
+			case r := <-stderrCh:
+				io.Copy(&stderrBuf, r)
+			case <-time.After(5 * time.Second):
+				t.Fatalf("expected output %q %q, got %q %q", expectedStdout, expectedStderr, stdoutBuf.String(), stderrBuf.String())
+			}
+		}
+	}
+
+	// The last 3 lines are shown, the partial line is joined with the next.
+	expect("last line\n", "error\n")
+
+	if stdoutBuf.String() != "last line\n" {
+		t.Errorf("unexpected output %q", stdoutBuf.String())
+	}
+
+	// The incomplete line is written once it's complete, and the rotated file is followed.
+	writeLog("2024-01-01T00:00:01.000000000Z stdout F new")
+	writeLog("\n")
+	expect("line\nnew\n", "error\n")
+
+	os.Rename(path, path+".1")
+	writeLog("2024-01-01T00:00:02.000000000Z stdout F rotated\n")
+	expect("new\nrotated\n", "error\n")
+}
@@ -20,16 +20,19 @@ import (
 	"os"
 	"os/exec"
 	"os/signal"
-	"strings"
 	"syscall"
 	"time"
 	"trust-tunnel/pkg/common/sessionutil"
-
-	"github.com/creack/pty"
+	"trust-tunnel/pkg/trust-tunnel-agent/monitor"
+	"trust-tunnel/pkg/trust-tunnel-agent/proctrack"
+	"trust-tunnel/pkg/trust-tunnel-agent/sessionio"
 )
 
 // nsenterSession represents a session structure for using nsenter to enter the host's namespace.
 type nsenterSession struct {
+	// Streams carry the output of the command.
+	*sessionio.Streams
+
 	// cmd represents the command to be executed.
 	cmd *exec.Cmd
 	// exitCode stores the exit code of the command executed in the session.
@@ -38,6 +41,10 @@ type nsenterSession struct {
 	exitCh chan struct{}
 	// tty indicates whether a pseudo-TTY is allocated for the session.
 	tty bool
+	// line tracks whether the input written to the pseudo-TTY ends in the middle of a line.
+	line inputLine
+	// frameSize is the most bytes read from the output at once.
+	frameSize int
 
 	// stdout, stderr, and stdin respectively represent the standard output, standard error, and standard input.
 	stdout io.ReadCloser
@@ -46,69 +53,78 @@ type nsenterSession struct {
 
 	// pid stores the process ID of the command executed in the session.
 	pid int
+	// tree tracks the processes spawned by the command, it's nil if the process tracking is unavailable.
+	tree *proctrack.Tree
 
-	// stdoutDone and stderrDone are used to signal the completion of reading standard output and standard error.
-	stdoutDone chan struct{}
-	stderrDone chan struct{}
+	// cgroup is the cgroup in which the processes of the session run, it's nil if they run in the agent's.
+	cgroup *cgroup
+	// trace traces the commands executed in the cgroup by eBPF, it's nil if they are tracked by the tree.
+	trace *proctrack.CgroupTrace
 
 	// ptyChan is used to receive signals related to the pseudo-TTY.
 	ptyChan chan os.Signal
 
 	// master and slave respectively represent the master and slave ends of the pseudo-TTY.
 	master, slave *os.File
+
+	// executor kills the processes of the session, and pty resizes the pseudo-TTY.
+	executor Executor
+	pty      PTY
 }
 
 func (s *nsenterSession) NextStdin() (io.WriteCloser, error) {
+	if s.tty {
+		return s.line.track(s.stdin), nil
+	}
+
 	return s.stdin, nil
 }
 
-func (s *nsenterSession) NextStdout() (io.Reader, error) {
-	reader, err := sessionutil.OneRead(s.stdout)
-	if err != nil && s.tty && (strings.Contains(err.Error(), "file already closed") ||
-		strings.Contains(err.Error(), "input/output error")) {
-		return nil, io.EOF
-	}
-
-	return reader, err
+func (s *nsenterSession) CloseStdin() error {
+	return closeInput(s.stdin, s.tty, &s.line)
 }
 
-func (s *nsenterSession) NextStderr() (io.Reader, error) {
-	reader, err := sessionutil.OneRead(s.stderr)
-	if err != nil && s.tty && (strings.Contains(err.Error(), "file already closed") ||
-		strings.Contains(err.Error(), "input/output error")) {
-		return nil, io.EOF
-	}
+func (s *nsenterSession) Clean() error {
+	logger.Infof("clean process %d when session ends", s.pid)
 
-	return reader, err
-}
+	s.Streams.Close()
 
-func (s *nsenterSession) StderrDone() error {
-	s.stderrDone <- struct{}{}
+	var err error
 
-	return nil
-}
+	if s.tree != nil {
+		s.tree.Kill()
+		s.tree.Close()
+	} else {
+		err = s.executor.Kill(s.pid)
+	}
 
-func (s *nsenterSession) StdoutDone() error {
-	s.stdoutDone <- struct{}{}
+	// Kill the processes that escaped from the process group, e.g. daemonized ones.
+	if s.cgroup != nil {
+		if cgErr := s.cgroup.destroy(); cgErr != nil {
+			logger.Warnf("destroy cgroup error: %v", cgErr)
+		}
+	}
 
-	return nil
+	if s.trace != nil {
+		s.trace.Close()
+	}
+
+	return err
 }
 
-func (s *nsenterSession) Clean() error {
-	logger.Infof("clean process %d when session ends", s.pid)
-	err := sessionutil.KillProcessGroup(s.pid, "nsenter", false)
+func (s *nsenterSession) Processes() []proctrack.Process {
+	if s.tree == nil {
+		return nil
+	}
 
-	return err
+	return s.tree.Processes()
 }
 
 func (s *nsenterSession) Resize(height, weight int) error {
 	logger.Debugf("resize to %d*%d", height, weight)
 
 	if s.master != nil {
-		return pty.Setsize(s.master, &pty.Winsize{
-			Rows: uint16(height),
-			Cols: uint16(weight),
-		})
+		return s.pty.Setsize(s.master, uint16(height), uint16(weight))
 	}
 
 	return nil
@@ -165,43 +181,120 @@ func establishNsenterSession(config *Config) (*nsenterSession, error) {
 
 	args = append(args, config.Cmd...)
 
-	cmd := exec.Command("nsenter", args...)
-	cmd.Env = []string{
-		"PWD=" + loginDir,
+	if err = config.confirm(config.Cmd, loginDir); err != nil {
+		return nil, err
+	}
+
+	cmd := nsenterExecutor.Command(args...)
+	cmd.Env = config.environ(
+		"PWD="+loginDir,
 		"PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin",
-		"TERM=xterm-256color",
+	)
+
+	session, err := newNsenterSession(cmd, config.Tty)
+	if err != nil {
+		return nil, err
 	}
 
+	session.frameSize = config.FrameSize
+
+	// The commands are traced by the cgroup of the session, so the session runs in its own rather than the agent's.
+	if config.OnExec != nil && proctrack.ExecTracerEnabled() {
+		if session.cgroup, err = newCgroup(config.CgroupRoot, fmt.Sprintf("host-%d", time.Now().UnixNano()), 0, 0); err != nil {
+			return nil, err
+		}
+
+		if cmd.SysProcAttr == nil {
+			cmd.SysProcAttr = &syscall.SysProcAttr{}
+		}
+
+		session.cgroup.apply(cmd.SysProcAttr)
+	}
+
+	if err = session.start(config); err != nil {
+		if session.cgroup != nil {
+			session.cgroup.destroy()
+		}
+
+		return nil, fmt.Errorf("nsenter host namespace failed: %v", err)
+	}
+
+	return session, nil
+}
+
+// traceExecs traces the commands executed in the cgroup of the session by eBPF before it's started, if the exec
+// tracer is started. It returns the callback left to the process tree, which is nil then.
+func (s *nsenterSession) traceExecs(onExec func(proctrack.Process)) func(proctrack.Process) {
+	if onExec == nil || s.cgroup == nil || !proctrack.ExecTracerEnabled() {
+		return onExec
+	}
+
+	trace, err := proctrack.TraceCgroup(s.cgroup.dir(), onExec)
+	if err != nil {
+		logger.Warnf("trace commands in cgroup %s error, fall back to the process events: %v", s.cgroup.dir(), err)
+
+		return onExec
+	}
+
+	s.trace = trace
+
+	return nil
+}
+
+// newNsenterSession creates an nsenterSession for the given nsenter command,
+// and sets up either a console or raw I/O for the command depending on the tty flag.
+func newNsenterSession(cmd *exec.Cmd, tty bool) (*nsenterSession, error) {
 	session := &nsenterSession{
-		cmd:        cmd,
-		tty:        config.Tty,
-		exitCh:     make(chan struct{}),
-		stderrDone: make(chan struct{}),
-		stdoutDone: make(chan struct{}),
-		ptyChan:    make(chan os.Signal, 1),
+		Streams:  sessionio.New(),
+		cmd:      cmd,
+		tty:      tty,
+		exitCh:   make(chan struct{}),
+		ptyChan:  make(chan os.Signal, 1),
+		executor: nsenterExecutor,
+		pty:      ptyAllocator,
 	}
 
 	// Set up either a console or raw I/O based on Tty flag.
-	if config.Tty {
-		if err = session.setupConsole(cmd); err != nil {
+	if tty {
+		if err := session.setupConsole(cmd); err != nil {
 			return nil, fmt.Errorf("setup console failed: %v", err)
 		}
 	} else {
-		if err = session.setupRawIO(cmd); err != nil {
+		if err := session.setupRawIO(cmd); err != nil {
 			return nil, fmt.Errorf("setup raw IO failed: %v", err)
 		}
 	}
 
-	if err = cmd.Start(); err != nil {
-		return nil, fmt.Errorf("nsenter host namespace failed: %v", err)
+	return session, nil
+}
+
+// start starts the nsenter command with the security labels and waits for it to finish in background.
+func (s *nsenterSession) start(c *Config) error {
+	onExec := s.traceExecs(c.OnExec)
+
+	if err := c.Security.start(s.cmd); err != nil {
+		if s.trace != nil {
+			s.trace.Close()
+		}
+
+		return err
 	}
 
 	// Record the PID of the started process.
-	session.pid = cmd.Process.Pid
+	s.pid = s.cmd.Process.Pid
+	s.tree = proctrack.Track(s.pid, onExec)
 
-	go session.wait()
+	// The terminal merges the stderr into the stdout.
+	stderr := s.stderr
+	if s.tty {
+		stderr = nil
+	}
 
-	return session, nil
+	s.Pump(s.stdout, stderr, s.frameSize)
+
+	monitor.Go("session_wait", s.wait)
+
+	return nil
 }
 
 // setupRawIO configures the raw I/O for the command execution.
@@ -233,7 +326,7 @@ func (s *nsenterSession) setupRawIO(cmd *exec.Cmd) error {
 // allowing it to interact with the user directly.
 func (s *nsenterSession) setupConsole(cmd *exec.Cmd) error {
 	// Start the command with a pty.
-	master, slave, err := pty.Open()
+	master, slave, err := s.pty.Open()
 	if err != nil {
 		return err
 	}
@@ -276,9 +369,8 @@ func (s *nsenterSession) wait() {
 		}
 	}
 
-	<-s.stdoutDone
-
-	<-s.stderrDone
+	// The pipes are closed by waiting for the command, so the output is drained first.
+	s.Wait()
 
 	// Get the exit code of the command.
 	s.exitCode = getExitCode(s.cmd)
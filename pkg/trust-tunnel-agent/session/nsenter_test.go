@@ -0,0 +1,272 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package session
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"os/exec"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"trust-tunnel/pkg/trust-tunnel-agent/sessionio"
+)
+
+// fakeExecutor runs the commands given to nsenter directly instead of entering the namespaces.
+type fakeExecutor struct {
+	args []string
+}
+
+func (e *fakeExecutor) Command(args ...string) *exec.Cmd {
+	e.args = args
+
+	// Skip the options of nsenter, the ones with values are followed by them.
+	i := 0
+	for i < len(args) && strings.HasPrefix(args[i], "-") {
+		switch args[i] {
+		case "-t", "-S", "-G":
+			i += 2
+		default:
+			i++
+		}
+	}
+
+	return exec.Command(args[i], args[i+1:]...)
+}
+
+func (e *fakeExecutor) Kill(pid int) error {
+	proc, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+
+	return proc.Kill()
+}
+
+// fakePTY allocates the pseudo-terminals of the host, and records the sizes set.
+type fakePTY struct {
+	hostPTY
+
+	lock  sync.Mutex
+	sizes [][2]uint16
+}
+
+func (p *fakePTY) Setsize(master *os.File, rows, cols uint16) error {
+	p.lock.Lock()
+	p.sizes = append(p.sizes, [2]uint16{rows, cols})
+	p.lock.Unlock()
+
+	return p.hostPTY.Setsize(master, rows, cols)
+}
+
+// useFakes replaces the executor and the pseudo-terminal allocator with fakes during the test.
+func useFakes(t *testing.T) (*fakeExecutor, *fakePTY) {
+	executor, pty := &fakeExecutor{}, &fakePTY{}
+
+	nsenterExecutor, ptyAllocator = executor, pty
+
+	t.Cleanup(func() {
+		nsenterExecutor, ptyAllocator = hostExecutor{}, hostPTY{}
+	})
+
+	return executor, pty
+}
+
+// drain reads the outputs of the session as the agent does until the command exits,
+// and returns the outputs and the exit code.
+func drain(t *testing.T, s Session) (string, string, int) {
+	var (
+		stdout, stderr bytes.Buffer
+		wg             sync.WaitGroup
+	)
+
+	read := func(next func() (io.Reader, error), buf *bytes.Buffer, done func() error) {
+		defer wg.Done()
+		defer done()
+
+		for {
+			reader, err := next()
+			if err != nil {
+				return
+			}
+
+			io.Copy(buf, reader)
+		}
+	}
+
+	wg.Add(2)
+
+	go read(s.NextStdout, &stdout, s.StdoutDone)
+	go read(s.NextStderr, &stderr, s.StderrDone)
+
+	finished := make(chan struct{})
+
+	go func() {
+		wg.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+	case <-time.After(10 * time.Second):
+		t.Fatal("timeout waiting for the command to exit")
+	}
+
+	return stdout.String(), stderr.String(), s.ExitCode()
+}
+
+func TestNsenterSessionExitCode(t *testing.T) {
+	executor, _ := useFakes(t)
+
+	s, err := establishNsenterSession(&Config{Cmd: []string{"sh", "-c", "echo out; echo err >&2; exit 3"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expectedArgs := []string{"-t", "1", "-m", "-u", "-i", "-n", "-p", "sh", "-c", "echo out; echo err >&2; exit 3"}
+	if !reflect.DeepEqual(executor.args, expectedArgs) {
+		t.Errorf("expected nsenter args %q, got %q", expectedArgs, executor.args)
+	}
+
+	stdout, stderr, code := drain(t, s)
+	if stdout != "out\n" || stderr != "err\n" {
+		t.Errorf("unexpected outputs %q and %q", stdout, stderr)
+	}
+
+	if code != 3 {
+		t.Errorf("expected exit code 3, got %d", code)
+	}
+}
+
+func TestNsenterSessionEOF(t *testing.T) {
+	useFakes(t)
+
+	s, err := establishNsenterSession(&Config{Cmd: []string{"cat"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	stdin, _ := s.NextStdin()
+	if _, err := stdin.Write([]byte("hello")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if err := s.CloseStdin(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	stdout, _, code := drain(t, s)
+	if stdout != "hello" || code != 0 {
+		t.Errorf("expected output %q and exit code 0, got %q and %d", "hello", stdout, code)
+	}
+}
+
+func TestNsenterSessionKill(t *testing.T) {
+	useFakes(t)
+
+	s, err := establishNsenterSession(&Config{Cmd: []string{"sleep", "30"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if err := s.Clean(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if _, _, code := drain(t, s); code == 0 {
+		t.Errorf("expected non-zero exit code of the killed command")
+	}
+}
+
+func TestNsenterSessionTTY(t *testing.T) {
+	_, pty := useFakes(t)
+
+	s, err := establishNsenterSession(&Config{Cmd: []string{"cat"}, Tty: true})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if err := s.Resize(40, 100); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if expected := [][2]uint16{{40, 100}}; !reflect.DeepEqual(pty.sizes, expected) {
+		t.Errorf("expected sizes %v, got %v", expected, pty.sizes)
+	}
+
+	// EOT ends the input of the command reading the terminal.
+	if err := s.CloseStdin(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if _, _, code := drain(t, s); code != 0 {
+		t.Errorf("expected exit code 0, got %d", code)
+	}
+}
+
+func TestNsenterSessionTTYPendingLine(t *testing.T) {
+	useFakes(t)
+
+	s, err := establishNsenterSession(&Config{Cmd: []string{"cat"}, Tty: true})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	stdin, _ := s.NextStdin()
+	if _, err := stdin.Write([]byte("hello")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// The first EOT only passes the pending line to the command, the second one ends the input.
+	if err := s.CloseStdin(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	stdout, _, code := drain(t, s)
+	if code != 0 || !strings.Contains(stdout, "hello") {
+		t.Errorf("expected output with %q and exit code 0, got %q and %d", "hello", stdout, code)
+	}
+}
+
+// benchmarkNextStdout reads the output of the session until EOF.
+func benchmarkNextStdout(b *testing.B, newSession func(io.Reader) Session) {
+	b.SetBytes(benchmarkOutputSize)
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		s := newSession(io.LimitReader(repeatReader('a'), benchmarkOutputSize))
+
+		for {
+			reader, err := s.NextStdout()
+			if err != nil {
+				break
+			}
+
+			io.Copy(io.Discard, reader)
+		}
+	}
+}
+
+func BenchmarkNsenterOutput(b *testing.B) {
+	benchmarkNextStdout(b, func(r io.Reader) Session {
+		s := &nsenterSession{Streams: sessionio.New()}
+		s.Pump(r, nil, 0)
+
+		return s
+	})
+}
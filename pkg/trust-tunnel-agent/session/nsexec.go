@@ -0,0 +1,216 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package session
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"syscall"
+	"time"
+	"trust-tunnel/pkg/common/sessionutil"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/namespaces"
+	dockerClient "github.com/docker/docker/client"
+)
+
+// CleanMode represents how commands are executed in clean mode for containers.
+type CleanMode string
+
+const (
+	// CleanModeSidecar executes commands in a sidecar container sharing the namespaces of the target container.
+	CleanModeSidecar CleanMode = "sidecar"
+
+	// CleanModeNsexec executes commands by entering the namespaces of the target container directly,
+	// the processes are placed in a new cgroup managed by the agent instead of a sidecar container.
+	CleanModeNsexec CleanMode = "nsexec"
+)
+
+// nsexecSession represents a session entering the namespaces of a container in an agent-managed cgroup, which is
+// destroyed as the session is cleaned.
+type nsexecSession struct {
+	*nsenterSession
+}
+
+func (s *nsexecSession) OOMKilled() bool {
+	return s.cgroup.oomKilled()
+}
+
+// establishNsexecSession establishes a session by entering the namespaces of the target container with nsenter,
+// the session runs in a new cgroup with the requested resource limits rather than a sidecar container.
+func establishNsexecSession(c *Config, apiClient dockerClient.CommonAPIClient, containerdClient *containerd.Client, containerRuntime ContainerRuntime) (*nsexecSession, error) {
+	logger.Infof("try to establish nsexec session into container %s", c.ContainerID)
+
+	pid, err := containerInitPid(c, apiClient, containerdClient, containerRuntime)
+	if err != nil {
+		return nil, err
+	}
+
+	targetRoot := fmt.Sprintf("/proc/%d/root", pid)
+
+	var uid, gid, loginDir string
+
+	if c.LoginName != "" {
+		uid, gid, loginDir, err = sessionutil.GetUserInfo(c.LoginName, targetRoot+"/etc/passwd")
+		if err != nil {
+			return nil, fmt.Errorf("%s", sessionutil.WrapContainerError(err.Error(), c.ContainerID))
+		}
+
+		if uid == "" {
+			return nil, fmt.Errorf("user does not exist:%s", c.LoginName)
+		}
+	}
+
+	args := []string{"-t", strconv.Itoa(pid), "-m", "-u", "-i", "-n", "-p"}
+
+	// The IDs in the target's passwd are relative to its user namespace if the runtime remaps them,
+	// e.g. dockerd with userns-remap, so the user namespace is entered as well.
+	remapped, err := userNamespaceRemapped(pid, uid, gid)
+	if err != nil {
+		return nil, fmt.Errorf("%s", sessionutil.WrapContainerError(err.Error(), c.ContainerID))
+	}
+
+	if remapped {
+		args = append(args, "-U")
+	}
+
+	if uid != "" {
+		args = append(args, "-S", uid, "-G", gid, "--wd="+loginDir)
+	}
+
+	args = append(args, c.Cmd...)
+
+	if err = c.confirm(c.Cmd, loginDir); err != nil {
+		return nil, err
+	}
+
+	cmd := nsenterExecutor.Command(args...)
+	cmd.Env = c.environ(
+		"HOME="+loginDir,
+		"PWD="+loginDir,
+		"PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin",
+	)
+
+	session, err := newNsenterSession(cmd, c.Tty)
+	if err != nil {
+		return nil, err
+	}
+
+	session.frameSize = c.FrameSize
+
+	name := fmt.Sprintf("%s-%d", shortID(c.ContainerID), time.Now().UnixNano())
+
+	cg, err := newCgroup(c.CgroupRoot, name, c.Cpus, c.MemoryMB)
+	if err != nil {
+		return nil, err
+	}
+
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+
+	cg.apply(cmd.SysProcAttr)
+	session.cgroup = cg
+
+	if err = session.start(c); err != nil {
+		cg.destroy()
+
+		return nil, fmt.Errorf("nsenter container namespace failed: %v", err)
+	}
+
+	return &nsexecSession{nsenterSession: session}, nil
+}
+
+// userNamespaceRemapped returns whether the user namespace of the process is remapped,
+// and checks that the uid and gid, if given, are mapped in it.
+func userNamespaceRemapped(pid int, uid, gid string) (bool, error) {
+	uidMap, gidMap, err := sessionutil.ReadIDMaps(pid)
+	if err != nil {
+		return false, fmt.Errorf("user namespace remapping error: %v", err)
+	}
+
+	if !uidMap.Remapped() && !gidMap.Remapped() {
+		return false, nil
+	}
+
+	for _, id := range []struct {
+		kind  string
+		value string
+		idMap sessionutil.IDMap
+	}{{"uid", uid, uidMap}, {"gid", gid, gidMap}} {
+		if id.value == "" {
+			continue
+		}
+
+		value, err := strconv.ParseUint(id.value, 10, 32)
+		if err != nil {
+			return false, fmt.Errorf("user namespace remapping error: invalid %s %s", id.kind, id.value)
+		}
+
+		if _, ok := id.idMap.ToHost(uint32(value)); !ok {
+			return false, fmt.Errorf("user namespace remapping error: %s %s isn't mapped in the container", id.kind, id.value)
+		}
+	}
+
+	return true, nil
+}
+
+// containerInitPid returns the PID of the init process of the running container.
+func containerInitPid(c *Config, apiClient dockerClient.CommonAPIClient, containerdClient *containerd.Client, containerRuntime ContainerRuntime) (int, error) {
+	if containerRuntime == Docker {
+		if apiClient == nil {
+			return 0, fmt.Errorf("container Client is nil")
+		}
+
+		info, err := apiClient.ContainerInspect(context.Background(), c.ContainerID)
+		if err != nil {
+			return 0, err
+		}
+
+		if info.State == nil || !info.State.Running || info.State.Pid == 0 {
+			return 0, fmt.Errorf("container %s is not running", c.ContainerID)
+		}
+
+		return info.State.Pid, nil
+	}
+
+	if containerdClient == nil {
+		return 0, fmt.Errorf("containerd Client is nil")
+	}
+
+	ctx := namespaces.WithNamespace(context.Background(), c.ContainerNamespace)
+
+	container, err := containerdClient.LoadContainer(ctx, c.ContainerID)
+	if err != nil {
+		return 0, fmt.Errorf("load container err:%v", err)
+	}
+
+	task, err := container.Task(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("container %s is not running: %v", c.ContainerID, err)
+	}
+
+	return int(task.Pid()), nil
+}
+
+// shortID returns the first 12 characters of the container ID.
+func shortID(id string) string {
+	if len(id) > 12 {
+		return id[:12]
+	}
+
+	return id
+}
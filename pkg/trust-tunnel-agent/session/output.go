@@ -0,0 +1,128 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package session
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"trust-tunnel/pkg/trust-tunnel-agent/monitor"
+	"trust-tunnel/pkg/trust-tunnel-agent/sessionio"
+)
+
+// outputSession streams the output read by the agent rather than a command, e.g. the logs of a container.
+// It takes no input.
+type outputSession struct {
+	*sessionio.Streams
+
+	// ctx is canceled once the session is cleaned.
+	ctx context.Context
+
+	// exitCode is 1 if the output fails to be read.
+	exitCode atomic.Int32
+
+	// frameSize buffers the stdout into the frames of its size if it's positive, for the output read at once rather
+	// than followed, e.g. the files. The output buffered is flushed once it's read.
+	frameSize int
+}
+
+func newOutputSession() *outputSession {
+	streams := sessionio.New()
+
+	return &outputSession{Streams: streams, ctx: streams.Context()}
+}
+
+func (s *outputSession) NextStdin() (io.WriteCloser, error) {
+	return nil, fmt.Errorf("the session takes no input")
+}
+
+func (s *outputSession) CloseStdin() error {
+	return nil
+}
+
+func (s *outputSession) Clean() error {
+	s.Close()
+
+	return nil
+}
+
+func (s *outputSession) Resize(_, _ int) error {
+	return nil
+}
+
+func (s *outputSession) ExitCode() int {
+	s.Wait()
+
+	return int(s.exitCode.Load())
+}
+
+// stream starts streaming the output read by the function, the output streams are ended once it returns.
+// The error of the function is written to the stderr, and the session exits with 1 then.
+func (s *outputSession) stream(target string, read func(stdout, stderr io.Writer) error) {
+	monitor.Go("session_stream", func() {
+		defer s.End()
+
+		var stdout io.Writer = s.Stdout
+
+		var buffered *frameWriter
+		if s.frameSize > 0 {
+			buffered = newFrameWriter(stdout, s.frameSize)
+			stdout = buffered
+		}
+
+		err := read(stdout, s.Stderr)
+
+		if buffered != nil {
+			if flushErr := buffered.Flush(); err == nil {
+				err = flushErr
+			}
+		}
+
+		if err != nil && s.ctx.Err() == nil {
+			logger.WithField("target", target).Warnf("stream output error: %v", err)
+			s.exitCode.Store(1)
+			fmt.Fprintf(s.Stderr, "%v\n", err)
+		}
+	})
+}
+
+// frameWriter buffers the output into the frames of its size. The writes and the flushes are serialized, as the
+// output may be written by the goroutines of the read, e.g. the ones demultiplexing the streams of a container.
+type frameWriter struct {
+	lock sync.Mutex
+	buf  *bufio.Writer
+}
+
+func newFrameWriter(w io.Writer, size int) *frameWriter {
+	return &frameWriter{buf: bufio.NewWriterSize(w, size)}
+}
+
+func (f *frameWriter) Write(p []byte) (int, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return f.buf.Write(p)
+}
+
+// Flush writes the output buffered.
+func (f *frameWriter) Flush() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return f.buf.Flush()
+}
@@ -0,0 +1,80 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package session
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+)
+
+// lockedBuffer is a bytes.Buffer safe for the concurrent writes, as the frames are written by the flushing goroutine.
+type lockedBuffer struct {
+	lock sync.Mutex
+	buf  bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return b.buf.Write(p)
+}
+
+// TestFrameWriterConcurrent writes and flushes the frames from different goroutines, run it with -race.
+func TestFrameWriterConcurrent(t *testing.T) {
+	var out lockedBuffer
+
+	w := newFrameWriter(&out, 64)
+	line := []byte("0123456789\n")
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for j := 0; j < 100; j++ {
+				if _, err := w.Write(line); err != nil {
+					t.Error(err)
+
+					return
+				}
+			}
+		}()
+	}
+
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		for i := 0; i < 100; i++ {
+			w.Flush()
+		}
+	}()
+
+	wg.Wait()
+	<-done
+
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := out.buf.Len(), 4*100*len(line); got != want {
+		t.Errorf("got %d bytes, want %d", got, want)
+	}
+}
@@ -0,0 +1,91 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package session
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/namespaces"
+	dockerClient "github.com/docker/docker/client"
+)
+
+// pausedPollInterval is the interval of polling the state of a paused container.
+var pausedPollInterval = 500 * time.Millisecond
+
+// waitUntilUnpaused waits for the paused container to be unpaused, e.g. after it's snapshotted, for at most
+// the PausedWait of the config. The sessions to a container still paused are refused, as the processes entering it
+// are frozen as well and the session would hang. The errors of inspecting the container are left to the session.
+func waitUntilUnpaused(c *Config, apiClient dockerClient.CommonAPIClient, containerdClient *containerd.Client, containerRuntime ContainerRuntime) error {
+	deadline := time.Now().Add(c.PausedWait)
+
+	for i := 0; ; i++ {
+		paused, err := containerPaused(c, apiClient, containerdClient, containerRuntime)
+		if err != nil || !paused {
+			return nil
+		}
+
+		if !time.Now().Before(deadline) {
+			return fmt.Errorf("container is paused:%s, waited %v", shortID(c.ContainerID), c.PausedWait)
+		}
+
+		if i == 0 {
+			logger.Infof("container %s is paused, wait for it to be unpaused", shortID(c.ContainerID))
+		}
+
+		time.Sleep(pausedPollInterval)
+	}
+}
+
+// containerPaused returns whether the container is paused or being paused.
+func containerPaused(c *Config, apiClient dockerClient.CommonAPIClient, containerdClient *containerd.Client, containerRuntime ContainerRuntime) (bool, error) {
+	if containerRuntime == Docker {
+		if apiClient == nil {
+			return false, fmt.Errorf("container Client is nil")
+		}
+
+		info, err := apiClient.ContainerInspect(context.Background(), c.ContainerID)
+		if err != nil {
+			return false, err
+		}
+
+		return info.State != nil && info.State.Paused, nil
+	}
+
+	if containerdClient == nil {
+		return false, fmt.Errorf("containerd Client is nil")
+	}
+
+	ctx := namespaces.WithNamespace(context.Background(), c.ContainerNamespace)
+
+	container, err := containerdClient.LoadContainer(ctx, c.ContainerID)
+	if err != nil {
+		return false, err
+	}
+
+	task, err := container.Task(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+
+	status, err := task.Status(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	return status.Status == containerd.Paused || status.Status == containerd.Pausing, nil
+}
@@ -0,0 +1,75 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package session
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+)
+
+// pausedDockerClient is a docker client reporting the container paused for the given inspections.
+type pausedDockerClient struct {
+	client.CommonAPIClient
+
+	pausedInspections int
+	inspections       int
+}
+
+func (c *pausedDockerClient) ContainerInspect(_ context.Context, _ string) (types.ContainerJSON, error) {
+	c.inspections++
+
+	return types.ContainerJSON{
+		ContainerJSONBase: &types.ContainerJSONBase{
+			State: &types.ContainerState{Running: true, Paused: c.inspections <= c.pausedInspections},
+		},
+	}, nil
+}
+
+func TestWaitUntilUnpaused(t *testing.T) {
+	pausedPollInterval = time.Millisecond
+
+	tests := []struct {
+		name              string
+		wait              time.Duration
+		pausedInspections int
+		expectedErr       bool
+	}{
+		{name: "running", pausedInspections: 0},
+		{name: "refused at once", pausedInspections: 1, expectedErr: true},
+		{name: "unpaused in time", wait: time.Minute, pausedInspections: 3},
+		{name: "paused too long", wait: 10 * time.Millisecond, pausedInspections: 1 << 30, expectedErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			apiClient := &pausedDockerClient{pausedInspections: tt.pausedInspections}
+			c := &Config{ContainerID: "0123456789abcdef", PausedWait: tt.wait}
+
+			err := waitUntilUnpaused(c, apiClient, nil, Docker)
+			if (err != nil) != tt.expectedErr {
+				t.Fatalf("unexpected error %v after %d inspections", err, apiClient.inspections)
+			}
+
+			if err != nil && !strings.Contains(err.Error(), "container is paused:0123456789ab") {
+				t.Errorf("unexpected error %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,221 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package session
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// maxNdots is the maximum of the ndots option, as the resolver of libc bounds it.
+const maxNdots = 15
+
+// resolvConf is the DNS configuration of a target, read from its /etc/resolv.conf.
+type resolvConf struct {
+	// servers are the addresses of the name servers, with the port.
+	servers []string
+	search  []string
+	ndots   int
+}
+
+// parseResolvConf parses the resolv.conf, the loopback is the name server if none is given, as libc does.
+func parseResolvConf(r io.Reader) *resolvConf {
+	conf := &resolvConf{ndots: 1}
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexAny(line, "#;"); i >= 0 {
+			line = line[:i]
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+
+		switch fields[0] {
+		case "nameserver":
+			// The addresses with zones, e.g. fe80::1%eth0, aren't supported.
+			if ip := net.ParseIP(fields[1]); ip != nil {
+				conf.servers = append(conf.servers, net.JoinHostPort(ip.String(), "53"))
+			}
+		case "domain":
+			conf.search = fields[1:2]
+		case "search":
+			conf.search = fields[1:]
+		case "options":
+			for _, option := range fields[1:] {
+				if value, ok := strings.CutPrefix(option, "ndots:"); ok {
+					if n, err := strconv.Atoi(value); err == nil && n >= 0 {
+						conf.ndots = min(n, maxNdots)
+					}
+				}
+			}
+		}
+	}
+
+	if len(conf.servers) == 0 {
+		conf.servers = []string{"127.0.0.1:53"}
+	}
+
+	return conf
+}
+
+// names returns the fully qualified names looked up for the host in order: the host with the search domains
+// appended, and the host itself first if it has ndots dots at least or ends with a dot.
+func (c *resolvConf) names(host string) []string {
+	if strings.HasSuffix(host, ".") {
+		return []string{host}
+	}
+
+	names := make([]string, 0, len(c.search)+1)
+	for _, domain := range c.search {
+		names = append(names, host+"."+strings.TrimSuffix(domain, ".")+".")
+	}
+
+	if strings.Count(host, ".") >= c.ndots {
+		return append([]string{host + "."}, names...)
+	}
+
+	return append(names, host+".")
+}
+
+// lookup queries the name servers for the names of the host in the network namespace of the process.
+func (c *resolvConf) lookup(ctx context.Context, pid int, host string) ([]net.IP, error) {
+	var next atomic.Uint32
+
+	resolver := &net.Resolver{
+		PreferGo: true,
+		// The name servers of the target are queried in turn instead of the ones of the agent.
+		Dial: func(_ context.Context, network, _ string) (net.Conn, error) {
+			server := c.servers[int(next.Add(1)-1)%len(c.servers)]
+
+			return dialInNetns(pid, network, server)
+		},
+	}
+
+	for _, name := range c.names(host) {
+		ips, err := resolver.LookupIP(ctx, "ip", name)
+
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			continue
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("resolve %s: %v", host, err)
+		}
+
+		return ips, nil
+	}
+
+	return nil, fmt.Errorf("resolve %s: no such host", host)
+}
+
+// lookupHosts returns the addresses of the host in the hosts file, or nil if it's not found.
+func lookupHosts(path, host string) []net.IP {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	host = strings.TrimSuffix(host, ".")
+
+	var ips []net.IP
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+
+		ip := net.ParseIP(fields[0])
+		if ip == nil {
+			continue
+		}
+
+		for _, name := range fields[1:] {
+			if strings.EqualFold(strings.TrimSuffix(name, "."), host) {
+				ips = append(ips, ip)
+
+				break
+			}
+		}
+	}
+
+	return ips
+}
+
+// resolveInTarget resolves the host as the target does, with the hosts file and the name servers of its
+// /etc/hosts and /etc/resolv.conf, which are queried in the network namespace of the target, so that the names
+// only known to the target resolve, e.g. the services of the cluster DNS.
+func resolveInTarget(ctx context.Context, target *VerbTarget, host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+
+	if ips := lookupHosts(filepath.Join(target.Root, "etc/hosts"), host); len(ips) > 0 {
+		return ips, nil
+	}
+
+	conf := &resolvConf{servers: []string{"127.0.0.1:53"}, ndots: 1}
+	if f, err := os.Open(filepath.Join(target.Root, "etc/resolv.conf")); err == nil {
+		conf = parseResolvConf(f)
+		f.Close()
+	}
+
+	return conf.lookup(ctx, target.PID, host)
+}
+
+// dialTarget connects to the port of the host in the network namespace of the target, or of its loopback if the
+// host is empty. The addresses of the host are tried in order.
+func dialTarget(target *VerbTarget, host string, port int) (net.Conn, error) {
+	if host == "" {
+		return dialInNetns(target.PID, "tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), forwardDialTimeout)
+	defer cancel()
+
+	ips, err := resolveInTarget(ctx, target, host)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, ip := range ips {
+		var conn net.Conn
+		if conn, err = dialInNetns(target.PID, "tcp", net.JoinHostPort(ip.String(), strconv.Itoa(port))); err == nil {
+			return conn, nil
+		}
+	}
+
+	return nil, err
+}
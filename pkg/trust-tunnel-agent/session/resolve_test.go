@@ -0,0 +1,73 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package session
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseResolvConf(t *testing.T) {
+	conf := parseResolvConf(strings.NewReader(`# generated by the kubelet
+nameserver 10.96.0.10
+nameserver fe80::1%eth0
+nameserver fd00::10 ; the secondary
+search prod.svc.cluster.local svc.cluster.local cluster.local.
+options ndots:5 timeout:2
+`))
+
+	want := &resolvConf{
+		servers: []string{"10.96.0.10:53", "[fd00::10]:53"},
+		search:  []string{"prod.svc.cluster.local", "svc.cluster.local", "cluster.local."},
+		ndots:   5,
+	}
+	if !reflect.DeepEqual(conf, want) {
+		t.Fatalf("got %+v", conf)
+	}
+
+	if names := conf.names("db"); !reflect.DeepEqual(names, []string{"db.prod.svc.cluster.local.", "db.svc.cluster.local.", "db.cluster.local.", "db."}) {
+		t.Errorf("unexpected names %v", names)
+	}
+
+	if names := conf.names("example.com."); !reflect.DeepEqual(names, []string{"example.com."}) {
+		t.Errorf("unexpected names %v", names)
+	}
+
+	// The loopback is the name server by default, and the names with enough dots are looked up as they are first.
+	conf = parseResolvConf(strings.NewReader("domain corp\n"))
+	if !reflect.DeepEqual(conf.servers, []string{"127.0.0.1:53"}) || !reflect.DeepEqual(conf.names("db.prod"), []string{"db.prod.", "db.prod.corp."}) {
+		t.Errorf("unexpected config %+v", conf)
+	}
+}
+
+func TestLookupHosts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hosts")
+	hosts := "127.0.0.1 localhost\n10.0.0.5 db db.local # the database\nfd00::5 DB\n"
+
+	if err := os.WriteFile(path, []byte(hosts), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	ips := lookupHosts(path, "db.")
+	if len(ips) != 2 || ips[0].String() != "10.0.0.5" || ips[1].String() != "fd00::5" {
+		t.Errorf("unexpected addresses %v", ips)
+	}
+
+	if ips = lookupHosts(path, "cache"); ips != nil {
+		t.Errorf("unexpected addresses %v", ips)
+	}
+}
@@ -0,0 +1,136 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package session
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// SecurityConfig specifies the security labels of the sidecar containers and the nsenter children,
+// which run with the daemon's defaults or the agent's own labels if they are empty.
+type SecurityConfig struct {
+	// SELinuxLabel is the full SELinux context, e.g. "system_u:system_r:spc_t:s0".
+	SELinuxLabel string `toml:"selinux_label"`
+
+	// AppArmorProfile is the AppArmor profile, e.g. "trust-tunnel-session" or "unconfined".
+	AppArmorProfile string `toml:"apparmor_profile"`
+}
+
+// procAttrDir is the directory of the security attributes of the current thread, it's replaced in tests.
+var procAttrDir = "/proc/thread-self/attr"
+
+// dockerSecurityOpts returns the security options of the sidecar containers.
+func (c *SecurityConfig) dockerSecurityOpts() ([]string, error) {
+	var opts []string
+
+	if c.SELinuxLabel != "" {
+		// The level may contain colons, e.g. "s0:c1,c2".
+		parts := strings.SplitN(c.SELinuxLabel, ":", 4)
+		if len(parts) != 4 {
+			return nil, fmt.Errorf("security label error: invalid SELinux label %q, user:role:type:level is expected", c.SELinuxLabel)
+		}
+
+		opts = append(opts, "label=user:"+parts[0], "label=role:"+parts[1], "label=type:"+parts[2], "label=level:"+parts[3])
+	}
+
+	if c.AppArmorProfile != "" {
+		opts = append(opts, "apparmor="+c.AppArmorProfile)
+	}
+
+	return opts, nil
+}
+
+// start starts the command with the configured labels. The labels are set as the exec attributes of a
+// dedicated thread, which are inherited by the child forked from it and applied on its exec. The thread is
+// locked and never unlocked, so that it's terminated with the goroutine rather than spawning other processes.
+func (c *SecurityConfig) start(cmd *exec.Cmd) error {
+	if c.SELinuxLabel == "" && c.AppArmorProfile == "" {
+		return cmd.Start()
+	}
+
+	errCh := make(chan error, 1)
+
+	go func() {
+		runtime.LockOSThread()
+
+		if err := c.setExecAttrs(); err != nil {
+			errCh <- err
+
+			return
+		}
+
+		errCh <- cmd.Start()
+	}()
+
+	return <-errCh
+}
+
+// setExecAttrs sets the exec attributes of the current thread.
+func (c *SecurityConfig) setExecAttrs() error {
+	if c.SELinuxLabel != "" {
+		if err := writeAttr(filepath.Join(procAttrDir, "exec"), c.SELinuxLabel); err != nil {
+			return fmt.Errorf("security label error: set SELinux exec label %q: %v; check that SELinux is enabled and "+
+				"the policy allows the agent's domain to transition to it, e.g. with \"ausearch -m avc\"", c.SELinuxLabel, err)
+		}
+	}
+
+	if c.AppArmorProfile != "" {
+		// The AppArmor specific attribute is preferred on kernels stacking the LSMs.
+		path := filepath.Join(procAttrDir, "apparmor", "exec")
+		if _, err := os.Stat(path); err != nil {
+			path = filepath.Join(procAttrDir, "exec")
+		}
+
+		if err := writeAttr(path, "exec "+c.AppArmorProfile); err != nil {
+			return fmt.Errorf("security label error: set AppArmor exec profile %q: %v; check that AppArmor is enabled and "+
+				"the profile is loaded, e.g. with \"aa-status\"", c.AppArmorProfile, err)
+		}
+	}
+
+	return nil
+}
+
+func writeAttr(path, value string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.WriteString(value)
+
+	return err
+}
+
+// wrapSecurityError marks the errors of creating or starting sidecar containers caused by the security labels.
+func (c *SecurityConfig) wrapSecurityError(err error) error {
+	if c.SELinuxLabel == "" && c.AppArmorProfile == "" {
+		return err
+	}
+
+	msg := strings.ToLower(err.Error())
+	for _, keyword := range []string{"selinux", "apparmor", "label", "permission denied"} {
+		if strings.Contains(msg, keyword) {
+			return fmt.Errorf("security label error: %v; check the selinux_label and apparmor_profile of security_config", err)
+		}
+	}
+
+	return err
+}
@@ -0,0 +1,82 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package session
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDockerSecurityOpts(t *testing.T) {
+	c := &SecurityConfig{SELinuxLabel: "system_u:system_r:spc_t:s0:c1,c2", AppArmorProfile: "trust-tunnel-session"}
+
+	opts, err := c.dockerSecurityOpts()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := []string{"label=user:system_u", "label=role:system_r", "label=type:spc_t", "label=level:s0:c1,c2", "apparmor=trust-tunnel-session"}
+	if !reflect.DeepEqual(opts, expected) {
+		t.Errorf("got options %q, want %q", opts, expected)
+	}
+
+	if opts, err := (&SecurityConfig{}).dockerSecurityOpts(); err != nil || opts != nil {
+		t.Errorf("got options %q and error %v without labels", opts, err)
+	}
+
+	if _, err := (&SecurityConfig{SELinuxLabel: "spc_t"}).dockerSecurityOpts(); err == nil {
+		t.Error("expected error with incomplete SELinux label")
+	}
+}
+
+func TestSecurityStart(t *testing.T) {
+	// Fake the attributes of the thread, the kernel applies them on the exec of the child.
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, "apparmor"), 0o755)
+	os.WriteFile(filepath.Join(dir, "exec"), nil, 0o600)
+	os.WriteFile(filepath.Join(dir, "apparmor", "exec"), nil, 0o600)
+
+	origin := procAttrDir
+	procAttrDir = dir
+
+	t.Cleanup(func() { procAttrDir = origin })
+
+	c := &SecurityConfig{SELinuxLabel: "system_u:system_r:spc_t:s0", AppArmorProfile: "trust-tunnel-session"}
+
+	cmd := exec.Command("true")
+	if err := c.start(cmd); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	cmd.Wait()
+
+	for path, expected := range map[string]string{"exec": c.SELinuxLabel, "apparmor/exec": "exec " + c.AppArmorProfile} {
+		if data, _ := os.ReadFile(filepath.Join(dir, path)); string(data) != expected {
+			t.Errorf("got %s attribute %q, want %q", path, data, expected)
+		}
+	}
+
+	// The denials are reported with the hints.
+	procAttrDir = filepath.Join(dir, "missing")
+
+	err := c.start(exec.Command("true"))
+	if err == nil || !strings.Contains(err.Error(), "security label error") || !strings.Contains(err.Error(), "ausearch") {
+		t.Errorf("got error %v, want the SELinux hint", err)
+	}
+}
@@ -15,8 +15,13 @@
 package session
 
 import (
+	"fmt"
 	"io"
+	"sync/atomic"
+	"time"
 	"trust-tunnel/pkg/common/logutil"
+	"trust-tunnel/pkg/trust-tunnel-agent/proctrack"
+	"trust-tunnel/pkg/trust-tunnel-agent/sessionio"
 
 	dockerClient "github.com/docker/docker/client"
 	client "trust-tunnel/pkg/trust-tunnel-client"
@@ -26,6 +31,9 @@ import (
 
 var logger = logutil.GetLogger("trust-tunnel-agent-session")
 
+// DefaultFrameSize is the most bytes of the output read at once by default, which bounds the output frames.
+const DefaultFrameSize = sessionio.DefaultFrameSize
+
 // Config defines the configuration for establishing a session.
 type Config struct {
 	// TargetType specifies the type of target, which can be a container or a physical host.
@@ -43,6 +51,9 @@ type Config struct {
 	// ImageHubAuth specifies the authentication information for the image hub.
 	ImageHubAuth string
 
+	// SidecarImageTarball specifies the local tarball to load the sidecar image from if pulling fails.
+	SidecarImageTarball string
+
 	// UserName specifies the username for the user's identity.
 	UserName string
 
@@ -55,12 +66,59 @@ type Config struct {
 	// Cmd specifies the commands to be executed in the target.
 	Cmd []string
 
+	// Shell is ShellAuto to run Cmd with the shell resolved in the target, Cmd is run as it is if it's empty.
+	Shell string
+
+	// Tools specifies whether to run Cmd with the tools of the sidecar
+	// in the namespaces of the target container except the mount one, for targets without shells or coreutils.
+	// The root of the target is at $TARGET_ROOT.
+	Tools bool
+
 	// Tty specifies whether the session should be a TTY session.
 	Tty bool
 
+	// Env specifies the environment variables ("NAME=value") forwarded by the client, e.g. TERM and LANG,
+	// already filtered by the policy of the agent. TERM defaults to xterm-256color.
+	Env []string
+
+	// Logs specifies to stream the output of the main process of the container instead of running Cmd if it's set.
+	Logs *client.LogsOptions
+
+	// File specifies to read the file in the target by the agent instead of running Cmd if it's set.
+	File *client.FileRequest
+
+	// FileMaxBytes specifies the maximum size of the files shown by cat, and of the files hashed.
+	FileMaxBytes int64
+
+	// Copy specifies to copy the files to or from the target by the agent instead of running Cmd if it's set.
+	Copy *client.CopyRequest
+
+	// CopyMaxBytes specifies the maximum total size of the regular files copied.
+	CopyMaxBytes int64
+
+	// CopyCheckPath checks the paths copied against the path policies.
+	CopyCheckPath func(path string) error
+
+	// Forward specifies to forward the connections of the client to the port of the target by the agent instead of
+	// running Cmd if it's set.
+	Forward *client.ForwardRequest
+
+	// ForwardMaxStreams specifies the maximum number of the connections forwarded at once, unlimited if it's zero.
+	ForwardMaxStreams int
+
+	// Verb specifies to run the verb natively by the agent instead of running Cmd if it's set.
+	Verb *client.VerbRequest
+
+	// VerbCheckPath checks the paths read by the verb against the path policies.
+	VerbCheckPath func(path string) error
+
 	// Interactive specifies whether the session should be an interactive session.
 	Interactive bool
 
+	// FrameSize specifies the most bytes of the output read at once, which bounds the output frames.
+	// DefaultFrameSize is used if it's zero.
+	FrameSize int
+
 	// PhysTunnel specifies the physical tunnel to be used for the session,'SSH' or 'nsenter'.
 	PhysTunnel string
 
@@ -77,12 +135,64 @@ type Config struct {
 	// ContainerNamespace specifies the namespace of the container.
 	// It is used in containerd session when get container info.
 	ContainerNamespace string
+
+	// CleanMode specifies how to execute commands in clean mode for containers.
+	CleanMode CleanMode
+
+	// CgroupRoot specifies the parent cgroup of the sessions in nsexec clean mode.
+	CgroupRoot string
+
+	// PausedWait specifies how long to wait for a paused container to be unpaused before refusing the session.
+	PausedWait time.Duration
+
+	// LegacyCdRewrite specifies to enter the login directory in docker and containerd sessions by prepending
+	// "cd <login dir>;" to the last argument of Cmd instead of setting the working directory.
+	LegacyCdRewrite bool
+
+	// Security specifies the security labels of the sidecar containers and the nsenter children.
+	Security SecurityConfig
+
+	// OnExec is called with every command executed within the session if the processes are tracked,
+	// including the ones run by scripts or the shell without the history.
+	OnExec func(proctrack.Process)
+
+	// Confirm is called with the command as it's run and its working directory once they are resolved, right before
+	// the command is run. The session is refused if it returns an error.
+	Confirm func(cmd []string, dir string) error
+}
+
+// workingDir returns the working directory of the command in the container, the login directory. It's empty if the
+// login directory is entered by the legacy rewrite of the command, which is applied to Cmd then, or if there's no
+// login directory, so that the working directory of the image is kept.
+func (c *Config) workingDir(loginDir string) string {
+	if !c.LegacyCdRewrite || loginDir == "" {
+		return loginDir
+	}
+
+	if len(c.Cmd) > 0 {
+		c.Cmd[len(c.Cmd)-1] = "cd " + loginDir + ";" + c.Cmd[len(c.Cmd)-1]
+	}
+
+	return ""
+}
+
+// confirm confirms the resolved command by Confirm if it's set.
+func (c *Config) confirm(cmd []string, dir string) error {
+	if c.Confirm == nil {
+		return nil
+	}
+
+	return c.Confirm(cmd, dir)
 }
 
 type Session interface {
 	// NextStdin returns the next standard input stream.
 	NextStdin() (io.WriteCloser, error)
 
+	// CloseStdin closes the standard input of the command, so that the command reads EOF.
+	// The standard output and error streams are kept open.
+	CloseStdin() error
+
 	// NextStdout returns the next standard output stream.
 	NextStdout() (io.Reader, error)
 
@@ -105,6 +215,78 @@ type Session interface {
 	ExitCode() int
 }
 
+// OOMReporter is implemented by the sessions which can tell whether the command was killed by the OOM killer.
+type OOMReporter interface {
+	// OOMKilled returns whether the command was killed by the OOM killer.
+	OOMKilled() bool
+}
+
+// ProcessReporter is implemented by the sessions which track the processes spawned within them.
+type ProcessReporter interface {
+	// Processes returns the processes spawned within the session in the order of creation.
+	Processes() []proctrack.Process
+}
+
+// eot is the end-of-transmission character, a terminal in canonical mode regards it as the end of input.
+const eot = 0x04
+
+// inputLine tracks whether the input written to a terminal ends in the middle of a line,
+// where an EOT only passes the pending line to the command instead of ending its input.
+type inputLine struct {
+	pending atomic.Bool
+}
+
+// wrote records the input written to the terminal.
+func (l *inputLine) wrote(p []byte) {
+	if len(p) == 0 {
+		return
+	}
+
+	last := p[len(p)-1]
+	l.pending.Store(last != '\n' && last != '\r' && last != eot)
+}
+
+// eof returns the characters making the reads of the command return EOF, a second EOT is needed
+// if the first one only passes a pending line.
+func (l *inputLine) eof() []byte {
+	if l.pending.Load() {
+		return []byte{eot, eot}
+	}
+
+	return []byte{eot}
+}
+
+// track returns stdin recording the input written through it in l.
+func (l *inputLine) track(stdin io.WriteCloser) io.WriteCloser {
+	return trackedInput{WriteCloser: stdin, line: l}
+}
+
+// trackedInput records the input written to a terminal in line.
+type trackedInput struct {
+	io.WriteCloser
+
+	line *inputLine
+}
+
+func (w trackedInput) Write(p []byte) (int, error) {
+	n, err := w.WriteCloser.Write(p)
+	w.line.wrote(p[:n])
+
+	return n, err
+}
+
+// closeInput closes the input stream of a command. EOT is written instead for a terminal,
+// as closing the input of a terminal doesn't make the reads of the command return EOF.
+func closeInput(stdin io.WriteCloser, tty bool, line *inputLine) error {
+	if tty {
+		_, err := stdin.Write(line.eof())
+
+		return err
+	}
+
+	return stdin.Close()
+}
+
 // ContainerConfig represents the configuration structure for container services.
 // It includes various configuration details pertinent to the container runtime environment.
 type ContainerConfig struct {
@@ -126,11 +308,81 @@ type ContainerConfig struct {
 	// Namespace is the namespace for the container runtime.
 	// This is used in containerd when getting the container info.
 	Namespace string `toml:"namespace"`
+
+	// CleanMode specifies how to execute commands in clean mode, "sidecar" or "nsexec".
+	// Defaults to "sidecar".
+	CleanMode CleanMode `toml:"clean_mode"`
+
+	// CgroupRoot specifies the cgroup v2 directory under which the agent creates a cgroup for each session
+	// in nsexec clean mode, defaults to "/sys/fs/cgroup/trust-tunnel".
+	CgroupRoot string `toml:"cgroup_root"`
+
+	// HealthCheckPeriod specifies the period of pinging the container runtime, defaults to 10 seconds.
+	// The client is re-created once the runtime is unhealthy, and the health state is reported by /readyz.
+	HealthCheckPeriod time.Duration `toml:"health_check_period"`
+
+	// PausedWaitTimeout specifies how long to wait for a paused target container, e.g. being snapshotted, to be
+	// unpaused before refusing the session. The sessions to paused containers are refused at once if it's 0.
+	PausedWaitTimeout time.Duration `toml:"paused_wait_timeout"`
+
+	// LegacyCdRewrite specifies to enter the login directory by prepending "cd <login dir>;" to the last argument of
+	// the commands instead of setting the working directory of the exec, for the sidecar images of earlier releases
+	// which don't take the working directory. It breaks the commands which aren't run by "sh -c".
+	LegacyCdRewrite bool `toml:"legacy_cd_rewrite"`
 }
 
 // EstablishSession establishes a session based on targetType in the config,
 // returns a physical session or a container session.
 func EstablishSession(config *Config, apiClient dockerClient.CommonAPIClient, containerdClient *containerd.Client, containerRuntime ContainerRuntime) (Session, error) {
+	if config.Logs != nil {
+		if config.TargetType != client.TargetContainer {
+			return nil, fmt.Errorf("logs are only available for containers")
+		}
+
+		return establishLogsSession(config, apiClient, containerdClient, containerRuntime)
+	}
+
+	if config.File != nil {
+		return establishFileSession(config, apiClient, containerdClient, containerRuntime)
+	}
+
+	if config.Copy != nil {
+		return establishCopySession(config, apiClient, containerdClient, containerRuntime)
+	}
+
+	if config.Forward != nil {
+		return establishForwardSession(config, apiClient, containerdClient, containerRuntime)
+	}
+
+	if config.Verb != nil {
+		return establishVerbSession(config, apiClient, containerdClient, containerRuntime)
+	}
+
+	if config.Tools {
+		if config.TargetType == client.TargetPhys || config.DisableCleanMode {
+			return nil, fmt.Errorf("tools are only available for containers in clean mode")
+		}
+
+		// The nsexec sessions would have to stay in the mount namespace of the agent for its tools,
+		// which exposes the files of the agent, so the tools are only run in the sidecars.
+		if config.CleanMode == CleanModeNsexec || containerRuntime != Docker {
+			return nil, fmt.Errorf("tools are only available in sidecar clean mode with %s", Docker)
+		}
+	}
+
+	// The shell is resolved in the target, so the paused container must be waited for before it.
+	if config.TargetType == client.TargetContainer {
+		if err := waitUntilUnpaused(config, apiClient, containerdClient, containerRuntime); err != nil {
+			return nil, err
+		}
+	}
+
+	if config.Shell == ShellAuto {
+		if err := resolveShell(config, apiClient, containerdClient, containerRuntime); err != nil {
+			return nil, err
+		}
+	}
+
 	if config.TargetType == client.TargetPhys {
 		return establishPhysSession(config)
 	}
@@ -150,9 +402,22 @@ func establishPhysSession(config *Config) (Session, error) {
 
 // establishContainerSession establishes a container session and returns the session and an error if any.
 func establishContainerSession(config *Config, apiClient dockerClient.CommonAPIClient, containerdClient *containerd.Client, containerRuntime ContainerRuntime) (Session, error) {
+	if config.CleanMode == CleanModeNsexec && !config.DisableCleanMode {
+		return establishNsexecSession(config, apiClient, containerdClient, containerRuntime)
+	}
+
 	if containerRuntime == Docker {
 		return establishDockerSession(config, apiClient)
 	}
 
 	return establishContainerdSession(config, containerdClient)
 }
+
+// frameSizeOf returns the frame size, DefaultFrameSize if it isn't positive.
+func frameSizeOf(size int) int {
+	if size <= 0 {
+		return DefaultFrameSize
+	}
+
+	return size
+}
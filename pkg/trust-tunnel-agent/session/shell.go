@@ -0,0 +1,127 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package session
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	dockerClient "github.com/docker/docker/client"
+	client "trust-tunnel/pkg/trust-tunnel-client"
+
+	"github.com/containerd/containerd"
+)
+
+// ShellAuto makes the agent resolve the shell in the target, rather than running the command as it is.
+const ShellAuto = client.ShellAuto
+
+// toolsShell is the shell of the sidecar and the agent images.
+const toolsShell = "/bin/sh"
+
+// shellCandidates are the shells probed in the target in order of preference.
+var shellCandidates = []string{"/bin/bash", "/usr/bin/bash", "/bin/sh", "/usr/bin/sh", "/bin/ash"}
+
+// shellNames are the names of the shells which are replaced by the resolved one when the command starts with them.
+var shellNames = map[string]bool{"bash": true, "sh": true, "ash": true, "zsh": true}
+
+// resolveShell resolves the shell in the target and synthesizes the command of the config with it.
+// The root directory of the target is the host's for physical targets, and the container's init process's
+// for container targets, which requires the agent to share the PID namespace of the host.
+func resolveShell(c *Config, apiClient dockerClient.CommonAPIClient, containerdClient *containerd.Client, containerRuntime ContainerRuntime) error {
+	root := c.RootfsPrefix
+
+	// The tools run in the root of the sidecar or the agent, both of which have /bin/sh.
+	if c.Tools {
+		c.Cmd = shellCommand(toolsShell, c.Cmd)
+
+		return nil
+	}
+
+	if c.TargetType != client.TargetPhys {
+		pid, err := containerInitPid(c, apiClient, containerdClient, containerRuntime)
+		if err != nil {
+			return err
+		}
+
+		root = fmt.Sprintf("/proc/%d/root", pid)
+	}
+
+	shell, err := findShell(root)
+	if err != nil {
+		return err
+	}
+
+	c.Cmd = shellCommand(shell, c.Cmd)
+
+	return nil
+}
+
+// findShell returns the first executable shell candidate under the root directory.
+func findShell(root string) (string, error) {
+	for _, shell := range shellCandidates {
+		// The symlinks are resolved in the root of the agent rather than the target,
+		// so they are accepted without resolving, e.g. /bin/sh linked to busybox.
+		info, err := os.Lstat(root + shell)
+		if err != nil {
+			continue
+		}
+
+		if info.Mode()&os.ModeSymlink != 0 || (info.Mode().IsRegular() && info.Mode().Perm()&0o111 != 0) {
+			return shell, nil
+		}
+	}
+
+	return "", fmt.Errorf("no shell found in the target, tried %s", strings.Join(shellCandidates, ", "))
+}
+
+// shellCommand synthesizes the command running with the shell. A leading shell name is replaced by the shell,
+// e.g. "bash -c ls" becomes "/bin/sh -c ls" if bash is missing, and other commands are run by "shell -c".
+// A single argument is run as a script, e.g. "ls | wc -l", while the arguments of a longer command are quoted,
+// so that they reach the command as they are, e.g. "a b" stays one argument and "$(x)" isn't expanded.
+func shellCommand(shell string, cmd []string) []string {
+	if len(cmd) == 0 {
+		return []string{shell}
+	}
+
+	if shellNames[path.Base(cmd[0])] {
+		return append([]string{shell}, cmd[1:]...)
+	}
+
+	if len(cmd) == 1 {
+		return []string{shell, "-c", cmd[0]}
+	}
+
+	quoted := make([]string, len(cmd))
+	for i, arg := range cmd {
+		quoted[i] = shellQuote(arg)
+	}
+
+	return []string{shell, "-c", strings.Join(quoted, " ")}
+}
+
+// shellQuote quotes the argument for the shell unless it's a plain word.
+func shellQuote(arg string) string {
+	plain := arg != "" && strings.IndexFunc(arg, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("-_./=:,+@%", r))
+	}) < 0
+
+	if plain {
+		return arg
+	}
+
+	return "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+}
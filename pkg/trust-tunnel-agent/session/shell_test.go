@@ -0,0 +1,137 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package session
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	client "trust-tunnel/pkg/trust-tunnel-client"
+)
+
+func TestFindShell(t *testing.T) {
+	tests := []struct {
+		name     string
+		files    map[string]os.FileMode
+		links    map[string]string
+		expected string
+	}{
+		{
+			name:     "bash",
+			files:    map[string]os.FileMode{"/bin/bash": 0o755, "/bin/sh": 0o755},
+			expected: "/bin/bash",
+		},
+		{
+			name:     "busybox",
+			files:    map[string]os.FileMode{"/bin/busybox": 0o755},
+			links:    map[string]string{"/bin/sh": "/bin/busybox", "/bin/ash": "/bin/busybox"},
+			expected: "/bin/sh",
+		},
+		{
+			name:     "not executable",
+			files:    map[string]os.FileMode{"/bin/bash": 0o644, "/bin/ash": 0o755},
+			expected: "/bin/ash",
+		},
+		{
+			name:  "distroless",
+			files: map[string]os.FileMode{"/app": 0o755},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+
+			for name, mode := range tt.files {
+				os.MkdirAll(filepath.Dir(root+name), 0o755)
+				os.WriteFile(root+name, nil, mode)
+			}
+
+			for name, target := range tt.links {
+				os.Symlink(target, root+name)
+			}
+
+			shell, err := findShell(root)
+			if tt.expected == "" {
+				if err == nil {
+					t.Errorf("expected error, got shell %s", shell)
+				}
+
+				return
+			}
+
+			if err != nil || shell != tt.expected {
+				t.Errorf("got shell %q and error %v, want %q", shell, err, tt.expected)
+			}
+		})
+	}
+}
+
+func TestShellCommand(t *testing.T) {
+	tests := []struct {
+		cmd      []string
+		expected []string
+	}{
+		{nil, []string{"/bin/sh"}},
+		{[]string{"bash"}, []string{"/bin/sh"}},
+		{[]string{"/bin/bash", "-c", "ls -l"}, []string{"/bin/sh", "-c", "ls -l"}},
+		{[]string{"ls", "-l"}, []string{"/bin/sh", "-c", "ls -l"}},
+		{[]string{"ls | wc -l"}, []string{"/bin/sh", "-c", "ls | wc -l"}},
+		{[]string{"echo", "a b", "$(x)", "it's", ""}, []string{"/bin/sh", "-c", `echo 'a b' '$(x)' 'it'\''s' ''`}},
+	}
+
+	for _, tt := range tests {
+		if cmd := shellCommand("/bin/sh", tt.cmd); !reflect.DeepEqual(cmd, tt.expected) {
+			t.Errorf("got command %q from %q, want %q", cmd, tt.cmd, tt.expected)
+		}
+	}
+}
+
+func TestShellCommandArgs(t *testing.T) {
+	args := []string{"a b", "$(x)", "it's", "", "*"}
+
+	cmd := shellCommand("/bin/sh", append([]string{"printf", "[%s]"}, args...))
+
+	out, err := exec.Command(cmd[0], cmd[1:]...).Output()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if expected := "[a b][$(x)][it's][][*]"; string(out) != expected {
+		t.Errorf("got output %q, want %q", out, expected)
+	}
+}
+
+func TestTools(t *testing.T) {
+	for _, c := range []*Config{
+		{TargetType: client.TargetPhys, Tools: true},
+		{TargetType: client.TargetContainer, Tools: true, DisableCleanMode: true},
+		{TargetType: client.TargetContainer, Tools: true, CleanMode: CleanModeSidecar},
+		{TargetType: client.TargetContainer, Tools: true, CleanMode: CleanModeNsexec},
+	} {
+		if _, err := EstablishSession(c, nil, nil, Containerd); err == nil {
+			t.Errorf("expected error with %+v", c)
+		}
+	}
+
+	// The shell of the tools is used without probing the target.
+	c := &Config{TargetType: client.TargetContainer, Tools: true, Shell: ShellAuto, Cmd: []string{"bash"}}
+	if err := resolveShell(c, nil, nil, Docker); err != nil || !reflect.DeepEqual(c.Cmd, []string{toolsShell}) {
+		t.Errorf("got command %q and error %v", c.Cmd, err)
+	}
+}
@@ -22,6 +22,8 @@ import (
 	"strings"
 	"time"
 	"trust-tunnel/pkg/common/sessionutil"
+	"trust-tunnel/pkg/trust-tunnel-agent/monitor"
+	"trust-tunnel/pkg/trust-tunnel-agent/sessionio"
 
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/term"
@@ -36,6 +38,8 @@ const (
 )
 
 type sshSession struct {
+	*sessionio.Streams
+
 	client  *ssh.Client
 	session *ssh.Session
 
@@ -43,38 +47,27 @@ type sshSession struct {
 	stdout io.Reader
 	stderr io.Reader
 
-	stdoutDone chan struct{}
-	stderrDone chan struct{}
-
-	exitCh   chan struct{}
-	exitCode int
+	exitCh    chan struct{}
+	exitCode  int
+	tty       bool
+	line      inputLine
+	frameSize int
 }
 
 func (s *sshSession) NextStdin() (io.WriteCloser, error) {
-	return s.stdin, nil
-}
-
-func (s *sshSession) NextStdout() (io.Reader, error) {
-	return sessionutil.OneRead(s.stdout)
-}
-
-func (s *sshSession) NextStderr() (io.Reader, error) {
-	return sessionutil.OneRead(s.stderr)
-}
-
-func (s *sshSession) StderrDone() error {
-	s.stderrDone <- struct{}{}
+	if s.tty {
+		return s.line.track(s.stdin), nil
+	}
 
-	return nil
+	return s.stdin, nil
 }
 
-func (s *sshSession) StdoutDone() error {
-	s.stdoutDone <- struct{}{}
-
-	return nil
+func (s *sshSession) CloseStdin() error {
+	return closeInput(s.stdin, s.tty, &s.line)
 }
 
 func (s *sshSession) Clean() error {
+	s.Streams.Close()
 	s.session.Close()
 	s.client.Close()
 
@@ -101,6 +94,16 @@ func (s *sshSession) ExitCode() int {
 func establishSSHSession(c *Config) (*sshSession, error) {
 	logger.Infof("try to establish ssh session")
 
+	// Only the last argument is run by the login shell of the user, in its home directory.
+	cmd := ""
+	if len(c.Cmd) > 0 {
+		cmd = c.Cmd[len(c.Cmd)-1]
+	}
+
+	if err := c.confirm([]string{cmd}, ""); err != nil {
+		return nil, err
+	}
+
 	// Insert the public key onto the host machine.
 	err := insertPubKeyOnHost(c.LoginName, c.RootfsPrefix)
 	if err != nil {
@@ -142,7 +145,14 @@ func establishSSHSession(c *Config) (*sshSession, error) {
 
 	// If TTY mode enabled, set up a pseudo-terminal (PTY) for the session.
 	if c.Tty {
-		setupSessionTTY(session)
+		setupSessionTTY(session, c.term())
+	}
+
+	// The server may refuse the variables not accepted by its configuration, e.g. AcceptEnv of OpenSSH.
+	for _, kv := range c.Env {
+		if name, value, _ := strings.Cut(kv, "="); name != "TERM" {
+			_ = session.Setenv(name, value)
+		}
 	}
 
 	stdin, err := session.StdinPipe()
@@ -154,11 +164,6 @@ func establishSSHSession(c *Config) (*sshSession, error) {
 
 	stderr, _ := session.StderrPipe()
 
-	cmd := ""
-	if len(c.Cmd) > 0 {
-		cmd = c.Cmd[len(c.Cmd)-1]
-	}
-
 	logger.Debugf("SSH exec commands: %s", cmd)
 
 	err = session.Start(cmd)
@@ -170,7 +175,10 @@ func establishSSHSession(c *Config) (*sshSession, error) {
 	}
 
 	s := getSSHSession(sshClient, session, stdin, stdout, stderr)
-	go s.wait()
+	s.tty = c.Tty
+	s.frameSize = c.FrameSize
+	s.Pump(s.stdout, s.stderr, s.frameSize)
+	monitor.Go("session_wait", s.wait)
 
 	return s, nil
 }
@@ -307,21 +315,20 @@ func addPublicKeyToAuthorizedKeys(key []byte, keyStr string, authKeysFile string
 
 func getSSHSession(client *ssh.Client, session *ssh.Session, stdin io.WriteCloser, stdout io.Reader, stderr io.Reader) *sshSession {
 	s := &sshSession{
-		client:     client,
-		session:    session,
-		stdin:      stdin,
-		stdout:     stdout,
-		stderr:     stderr,
-		exitCh:     make(chan struct{}, 1),
-		stdoutDone: make(chan struct{}, 1),
-		stderrDone: make(chan struct{}, 1),
+		Streams: sessionio.New(),
+		client:  client,
+		session: session,
+		stdin:   stdin,
+		stdout:  stdout,
+		stderr:  stderr,
+		exitCh:  make(chan struct{}, 1),
 	}
 
 	return s
 }
 
 // setupSessionTTY configures the TTY settings for the SSH session if TTY is enabled.
-func setupSessionTTY(session *ssh.Session) {
+func setupSessionTTY(session *ssh.Session, termType string) {
 	// Set up terminal modes and request a PTY
 	modes := ssh.TerminalModes{
 		ssh.ECHO:          1,
@@ -332,7 +339,7 @@ func setupSessionTTY(session *ssh.Session) {
 
 	width, height, err := term.GetSize(int(os.Stdin.Fd()))
 	if err == nil {
-		err = session.RequestPty("xterm-256color", height, width, modes)
+		err = session.RequestPty(termType, height, width, modes)
 		if err != nil {
 			logger.Errorf("Error requesting PTY: %v", err)
 		}
@@ -342,8 +349,7 @@ func setupSessionTTY(session *ssh.Session) {
 }
 
 func (s *sshSession) wait() {
-	<-s.stderrDone
-	<-s.stdoutDone
+	s.Wait()
 
 	if err := s.session.Wait(); err != nil {
 		if exitErr, ok := err.(*ssh.ExitError); ok {
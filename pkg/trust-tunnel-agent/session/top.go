@@ -0,0 +1,511 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package session
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	client "trust-tunnel/pkg/trust-tunnel-client"
+)
+
+const (
+	// topProcessCount is the number of the processes in the snapshot.
+	topProcessCount = 15
+
+	// clockTicks is USER_HZ, the unit of the CPU times in procfs, which is 100 on all the supported platforms.
+	clockTicks = 100
+
+	// maxCmdLength is the maximum length of the command lines in the snapshot.
+	maxCmdLength = 256
+)
+
+var (
+	// procDir and cgroupDir are where procfs and cgroupfs of the host are mounted in the agent's container,
+	// which requires the agent to share the PID namespace of the host.
+	procDir   = "/proc"
+	cgroupDir = "/sys/fs/cgroup"
+
+	// topSampleInterval is the interval the CPU usage is sampled over.
+	topSampleInterval = 500 * time.Millisecond
+
+	// pseudoFSTypes are the file systems without disk usage, left out of the snapshot.
+	pseudoFSTypes = map[string]bool{
+		"autofs": true, "binfmt_misc": true, "bpf": true, "cgroup": true, "cgroup2": true, "configfs": true,
+		"debugfs": true, "devpts": true, "devtmpfs": true, "fusectl": true, "hugetlbfs": true, "mqueue": true,
+		"nsfs": true, "proc": true, "pstore": true, "rpc_pipefs": true, "securityfs": true, "squashfs": true,
+		"sysfs": true, "tmpfs": true, "tracefs": true,
+	}
+)
+
+// cpuSample is the CPU time used by the processes and by the container at a time.
+type cpuSample struct {
+	time      time.Time
+	procTicks map[int]uint64
+	cgroupCPU time.Duration
+}
+
+// collectSnapshot gathers the snapshot of the host, or of the container whose init process is pid if containerID
+// is set. The failed collectors are reported in the snapshot rather than failing it.
+func collectSnapshot(ctx context.Context, pid int, containerID string) (*client.Snapshot, error) {
+	snapshot := &client.Snapshot{Time: time.Now().UTC().Format(time.RFC3339), Disks: []client.SnapshotDisk{}}
+
+	fail := func(collector string, err error) {
+		snapshot.Errors = append(snapshot.Errors, fmt.Sprintf("%s: %v", collector, err))
+	}
+
+	var err error
+	if snapshot.UptimeSeconds, err = readUptime(); err != nil {
+		fail("uptime", err)
+	}
+
+	if snapshot.Load, err = readLoad(); err != nil {
+		fail("load", err)
+	}
+
+	if snapshot.Memory, err = readMemory(); err != nil {
+		fail("memory", err)
+	}
+
+	if snapshot.Disks, err = readDisks(pid); err != nil {
+		fail("disks", err)
+	}
+
+	pidNS, err := pidNamespace(pid, containerID)
+	if err != nil {
+		return nil, err
+	}
+
+	cgroup, err := readCgroup(pid)
+	if containerID != "" && err != nil {
+		fail("container", err)
+	}
+
+	first := sampleCPU(pidNS, cgroup)
+	if err = waitSample(ctx); err != nil {
+		return nil, err
+	}
+
+	second := sampleCPU(pidNS, cgroup)
+	elapsed := second.time.Sub(first.time).Seconds()
+
+	snapshot.Processes = readProcesses(first, second, elapsed, topProcessCount)
+
+	if containerID != "" && cgroup != nil {
+		container := &client.SnapshotContainer{ID: containerID}
+		container.CPUPercent = percent((second.cgroupCPU - first.cgroupCPU).Seconds(), elapsed)
+
+		if fields, err := readStat(pid); err == nil {
+			start, _ := strconv.ParseUint(fields[19], 10, 64)
+			container.UptimeSeconds = snapshot.UptimeSeconds - float64(start)/clockTicks
+		}
+
+		if container.MemoryBytes, container.MemoryLimitBytes, container.Pids, err = cgroup.usage(); err != nil {
+			fail("container", err)
+		}
+
+		snapshot.Container = container
+	}
+
+	return snapshot, nil
+}
+
+// readUptime returns the uptime of the host in seconds.
+func readUptime() (float64, error) {
+	data, err := os.ReadFile(filepath.Join(procDir, "uptime"))
+	if err != nil {
+		return 0, err
+	}
+
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return 0, fmt.Errorf("invalid uptime %q", data)
+	}
+
+	return strconv.ParseFloat(fields[0], 64)
+}
+
+// readLoad returns the load average of the host.
+func readLoad() ([3]float64, error) {
+	var load [3]float64
+
+	data, err := os.ReadFile(filepath.Join(procDir, "loadavg"))
+	if err != nil {
+		return load, err
+	}
+
+	fields := strings.Fields(string(data))
+	if len(fields) < 3 {
+		return load, fmt.Errorf("invalid load average %q", data)
+	}
+
+	for i := range load {
+		if load[i], err = strconv.ParseFloat(fields[i], 64); err != nil {
+			return load, err
+		}
+	}
+
+	return load, nil
+}
+
+// readMemory returns the memory of the host.
+func readMemory() (client.SnapshotMemory, error) {
+	var memory client.SnapshotMemory
+
+	f, err := os.Open(filepath.Join(procDir, "meminfo"))
+	if err != nil {
+		return memory, err
+	}
+	defer f.Close()
+
+	fields := map[string]*uint64{
+		"MemTotal":     &memory.TotalBytes,
+		"MemAvailable": &memory.AvailableBytes,
+		"SwapTotal":    &memory.SwapTotalBytes,
+		"SwapFree":     &memory.SwapFreeBytes,
+	}
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// e.g. "MemTotal:       16318480 kB"
+		key, value, _ := strings.Cut(scanner.Text(), ":")
+		if field, ok := fields[key]; ok {
+			kb, _ := strconv.ParseUint(strings.TrimSuffix(strings.TrimSpace(value), " kB"), 10, 64)
+			*field = kb << 10
+		}
+	}
+
+	return memory, scanner.Err()
+}
+
+// readDisks returns the usage of the file systems mounted in the mount namespace of the process, one per device.
+func readDisks(pid int) ([]client.SnapshotDisk, error) {
+	f, err := os.Open(filepath.Join(procDir, strconv.Itoa(pid), "mountinfo"))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	root := filepath.Join(procDir, strconv.Itoa(pid), "root")
+	devices := map[string]bool{}
+	disks := []client.SnapshotDisk{}
+	unescape := strings.NewReplacer(`\040`, " ", `\011`, "\t", `\012`, "\n", `\134`, `\`)
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// e.g. "36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw,errors=continue"
+		fields := strings.Fields(scanner.Text())
+
+		sep := -1
+
+		for i, field := range fields {
+			if field == "-" {
+				sep = i
+
+				break
+			}
+		}
+
+		if sep < 5 || sep+1 >= len(fields) || pseudoFSTypes[fields[sep+1]] || devices[fields[2]] {
+			continue
+		}
+
+		mount := unescape.Replace(fields[4])
+
+		total, free, available, err := diskUsage(root + mount)
+		if err != nil || total == 0 {
+			continue
+		}
+
+		devices[fields[2]] = true
+		disks = append(disks, client.SnapshotDisk{
+			Mount:          mount,
+			FSType:         fields[sep+1],
+			TotalBytes:     total,
+			AvailableBytes: available,
+			UsedPercent:    percent(float64(total-free), float64(total-free+available)),
+		})
+	}
+
+	return disks, scanner.Err()
+}
+
+// pidNamespace returns the PID namespace of the container whose init process is pid, the processes of the
+// container are the ones in it. It's empty for hosts, whose processes are all the processes.
+func pidNamespace(pid int, containerID string) (string, error) {
+	if containerID == "" {
+		return "", nil
+	}
+
+	ns, err := os.Readlink(filepath.Join(procDir, strconv.Itoa(pid), "ns/pid"))
+	if err != nil {
+		return "", fmt.Errorf("read pid namespace error: %v", err)
+	}
+
+	return ns, nil
+}
+
+// waitSample waits for the interval between the CPU samples.
+func waitSample(ctx context.Context) error {
+	select {
+	case <-time.After(topSampleInterval):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// sampleCPU samples the CPU time used by the processes in the PID namespace, all processes if it's empty,
+// and by the cgroup if it's set.
+func sampleCPU(pidNS string, cgroup *cgroupPaths) *cpuSample {
+	sample := &cpuSample{time: time.Now(), procTicks: map[int]uint64{}}
+
+	if cgroup != nil {
+		sample.cgroupCPU, _ = cgroup.cpuUsage()
+	}
+
+	entries, err := os.ReadDir(procDir)
+	if err != nil {
+		return sample
+	}
+
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+
+		if pidNS != "" {
+			if ns, err := os.Readlink(filepath.Join(procDir, entry.Name(), "ns/pid")); err != nil || ns != pidNS {
+				continue
+			}
+		}
+
+		fields, err := readStat(pid)
+		if err != nil {
+			continue
+		}
+
+		utime, _ := strconv.ParseUint(fields[11], 10, 64)
+		stime, _ := strconv.ParseUint(fields[12], 10, 64)
+		sample.procTicks[pid] = utime + stime
+	}
+
+	return sample
+}
+
+// readProcesses returns the processes of the second sample using the most CPU between the samples, then memory,
+// at most limit processes if it's positive.
+func readProcesses(first, second *cpuSample, elapsed float64, limit int) []client.SnapshotProcess {
+	processes := make([]client.SnapshotProcess, 0, len(second.procTicks))
+
+	for pid, ticks := range second.procTicks {
+		fields, err := readStat(pid)
+		if err != nil {
+			continue
+		}
+
+		p := client.SnapshotProcess{PID: pid, State: fields[0], Comm: fields[len(fields)-1], UID: -1}
+		p.PPID, _ = strconv.Atoi(fields[1])
+		p.Threads, _ = strconv.Atoi(fields[17])
+
+		rss, _ := strconv.ParseUint(fields[21], 10, 64)
+		p.RSSBytes = rss * uint64(os.Getpagesize())
+
+		// The processes started between the samples used all of their CPU time in between.
+		p.CPUPercent = percent(float64(ticks-min(ticks, first.procTicks[pid]))/clockTicks, elapsed)
+
+		if info, err := os.Stat(filepath.Join(procDir, strconv.Itoa(pid))); err == nil {
+			if uid, _, ok := fileOwner(info); ok {
+				p.UID = uid
+			}
+		}
+
+		if cmdline, err := os.ReadFile(filepath.Join(procDir, strconv.Itoa(pid), "cmdline")); err == nil {
+			p.Cmd = strings.TrimSpace(strings.ReplaceAll(string(cmdline), "\x00", " "))
+			if len(p.Cmd) > maxCmdLength {
+				p.Cmd = p.Cmd[:maxCmdLength]
+			}
+		}
+
+		processes = append(processes, p)
+	}
+
+	sort.Slice(processes, func(i, j int) bool {
+		if processes[i].CPUPercent != processes[j].CPUPercent {
+			return processes[i].CPUPercent > processes[j].CPUPercent
+		}
+
+		return processes[i].RSSBytes > processes[j].RSSBytes
+	})
+
+	if limit > 0 && len(processes) > limit {
+		processes = processes[:limit]
+	}
+
+	return processes
+}
+
+// readStat returns the fields of /proc/<pid>/stat after the command name, starting from the state, with the
+// command name appended, so that the names with spaces or parentheses don't shift the fields.
+func readStat(pid int) ([]string, error) {
+	data, err := os.ReadFile(filepath.Join(procDir, strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return nil, err
+	}
+
+	start, end := strings.IndexByte(string(data), '('), strings.LastIndexByte(string(data), ')')
+	if start < 0 || end < start {
+		return nil, fmt.Errorf("invalid stat of process %d", pid)
+	}
+
+	fields := strings.Fields(string(data[end+1:]))
+	if len(fields) < 22 {
+		return nil, fmt.Errorf("invalid stat of process %d", pid)
+	}
+
+	return append(fields, string(data[start+1:end])), nil
+}
+
+// cgroupPaths is the cgroup of a process, a unified directory of cgroup v2, or the directories of the controllers
+// of cgroup v1.
+type cgroupPaths struct {
+	unified string
+	memory  string
+	cpuacct string
+	pids    string
+}
+
+// readCgroup returns the cgroup of the process.
+func readCgroup(pid int) (*cgroupPaths, error) {
+	data, err := os.ReadFile(filepath.Join(procDir, strconv.Itoa(pid), "cgroup"))
+	if err != nil {
+		return nil, err
+	}
+
+	paths := &cgroupPaths{}
+
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		// e.g. "0::/kubepods/burstable/pod1/abc" of v2, or "4:memory:/docker/abc" of v1.
+		parts := strings.SplitN(line, ":", 3)
+		if len(parts) != 3 {
+			continue
+		}
+
+		if parts[0] == "0" && parts[1] == "" {
+			paths.unified = filepath.Join(cgroupDir, parts[2])
+
+			continue
+		}
+
+		for _, controller := range strings.Split(parts[1], ",") {
+			switch controller {
+			case "memory":
+				paths.memory = filepath.Join(cgroupDir, "memory", parts[2])
+			case "cpuacct":
+				paths.cpuacct = filepath.Join(cgroupDir, "cpu,cpuacct", parts[2])
+				if _, err := os.Stat(paths.cpuacct); err != nil {
+					paths.cpuacct = filepath.Join(cgroupDir, "cpuacct", parts[2])
+				}
+			case "pids":
+				paths.pids = filepath.Join(cgroupDir, "pids", parts[2])
+			}
+		}
+	}
+
+	// The hybrid hierarchy has an empty unified cgroup besides the controllers of v1.
+	if paths.memory != "" {
+		paths.unified = ""
+	}
+
+	if paths.unified == "" && paths.memory == "" {
+		return nil, fmt.Errorf("no cgroup of process %d", pid)
+	}
+
+	return paths, nil
+}
+
+// cpuUsage returns the CPU time used by the cgroup.
+func (c *cgroupPaths) cpuUsage() (time.Duration, error) {
+	if c.unified == "" {
+		ns, err := readUint(filepath.Join(c.cpuacct, "cpuacct.usage"))
+
+		return time.Duration(ns), err
+	}
+
+	f, err := os.Open(filepath.Join(c.unified, "cpu.stat"))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if value, ok := strings.CutPrefix(scanner.Text(), "usage_usec "); ok {
+			usec, err := strconv.ParseUint(value, 10, 64)
+
+			return time.Duration(usec) * time.Microsecond, err
+		}
+	}
+
+	return 0, fmt.Errorf("no usage_usec in cpu.stat")
+}
+
+// usage returns the memory usage, the memory limit, 0 if unlimited, and the number of the processes of the cgroup.
+func (c *cgroupPaths) usage() (memory, limit, pids uint64, err error) {
+	memoryFile, limitFile, pidsFile := "memory.current", "memory.max", filepath.Join(c.unified, "pids.current")
+	dir := c.unified
+
+	if dir == "" {
+		memoryFile, limitFile, pidsFile = "memory.usage_in_bytes", "memory.limit_in_bytes", filepath.Join(c.pids, "pids.current")
+		dir = c.memory
+	}
+
+	if memory, err = readUint(filepath.Join(dir, memoryFile)); err != nil {
+		return 0, 0, 0, err
+	}
+
+	// The limit is "max" in v2, and the largest page-aligned int64 in v1 if unlimited.
+	if limit, err = readUint(filepath.Join(dir, limitFile)); err != nil || limit >= 1<<62 {
+		limit = 0
+	}
+
+	pids, _ = readUint(pidsFile)
+
+	return memory, limit, pids, nil
+}
+
+// percent returns the percentage rounded to 2 decimal places.
+func percent(part, total float64) float64 {
+	return math.Round(part/total*10000) / 100
+}
+
+// readUint reads the file of a single unsigned integer.
+func readUint(p string) (uint64, error) {
+	data, err := os.ReadFile(p)
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+}
@@ -0,0 +1,31 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+
+package session
+
+import "golang.org/x/sys/unix"
+
+// diskUsage returns the total, free and available bytes of the file system the path is on.
+func diskUsage(path string) (total, free, available uint64, err error) {
+	var stat unix.Statfs_t
+	if err = unix.Statfs(path, &stat); err != nil {
+		return 0, 0, 0, err
+	}
+
+	size := uint64(stat.Bsize)
+
+	return stat.Blocks * size, stat.Bfree * size, stat.Bavail * size, nil
+}
@@ -0,0 +1,102 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package session
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCollectSnapshot(t *testing.T) {
+	dir := t.TempDir()
+
+	oldProcDir, oldCgroupDir, oldInterval := procDir, cgroupDir, topSampleInterval
+	procDir, cgroupDir, topSampleInterval = filepath.Join(dir, "proc"), filepath.Join(dir, "cgroup"), 10*time.Millisecond
+
+	defer func() {
+		procDir, cgroupDir, topSampleInterval = oldProcDir, oldCgroupDir, oldInterval
+	}()
+
+	files := map[string]string{
+		"proc/uptime":  "1000.50 3000.00\n",
+		"proc/loadavg": "0.50 0.25 0.10 1/100 200\n",
+		"proc/meminfo": "MemTotal:       2048 kB\nMemFree:         512 kB\nMemAvailable:   1024 kB\nSwapTotal:         0 kB\nSwapFree:          0 kB\n",
+		// The init process of the container, started 100 seconds after the boot.
+		"proc/10/stat":      "10 (sh) S 1 10 10 0 -1 4194560 100 0 0 0 5 5 0 0 20 0 1 0 10000 4096 2 0 0\n",
+		"proc/10/cmdline":   "sh\x00-c\x00sleep infinity\x00",
+		"proc/10/cgroup":    "0::/kubepods/pod1/abc\n",
+		"proc/10/mountinfo": "1 0 253:1 / / rw - ext4 /dev/vda1 rw\n2 1 0:22 / /dev rw - tmpfs tmpfs rw\n",
+		// A process with spaces and parentheses in its name.
+		"proc/11/stat":                            "11 (my (app) x) R 10 10 10 0 -1 4194560 100 0 0 0 50 30 0 0 20 0 4 0 20000 4096 100 0 0\n",
+		"proc/11/cmdline":                         "app\x00",
+		"proc/12/stat":                            "12 (other) S 1 12 12 0 -1 4194560 100 0 0 0 500 300 0 0 20 0 1 0 30000 4096 10 0 0\n",
+		"cgroup/kubepods/pod1/abc/cpu.stat":       "usage_usec 5000000\nuser_usec 4000000\n",
+		"cgroup/kubepods/pod1/abc/memory.current": "1048576\n",
+		"cgroup/kubepods/pod1/abc/memory.max":     "max\n",
+		"cgroup/kubepods/pod1/abc/pids.current":   "2\n",
+	}
+
+	for name, content := range files {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0o755); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Process 12 is in another PID namespace, so it isn't a process of the container.
+	for pid, ns := range map[string]string{"10": "pid:[1]", "11": "pid:[1]", "12": "pid:[2]"} {
+		if err := os.Mkdir(filepath.Join(procDir, pid, "ns"), 0o755); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.Symlink(ns, filepath.Join(procDir, pid, "ns/pid")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := os.Mkdir(filepath.Join(procDir, "10/root"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	snapshot, err := collectSnapshot(context.Background(), 10, "abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if snapshot.UptimeSeconds != 1000.5 || snapshot.Load != [3]float64{0.5, 0.25, 0.1} ||
+		snapshot.Memory.TotalBytes != 2048<<10 || snapshot.Memory.AvailableBytes != 1024<<10 || len(snapshot.Errors) != 0 {
+		t.Errorf("unexpected snapshot %+v", snapshot)
+	}
+
+	// The processes are sorted by memory without CPU usage between the samples.
+	if len(snapshot.Processes) != 2 || snapshot.Processes[0].Comm != "my (app) x" || snapshot.Processes[0].PPID != 10 ||
+		snapshot.Processes[0].Threads != 4 || snapshot.Processes[1].Cmd != "sh -c sleep infinity" {
+		t.Errorf("unexpected processes %+v", snapshot.Processes)
+	}
+
+	if len(snapshot.Disks) != 1 || snapshot.Disks[0].Mount != "/" || snapshot.Disks[0].FSType != "ext4" {
+		t.Errorf("unexpected disks %+v", snapshot.Disks)
+	}
+
+	if c := snapshot.Container; c == nil || c.UptimeSeconds != 900.5 || c.MemoryBytes != 1<<20 || c.MemoryLimitBytes != 0 || c.Pids != 2 {
+		t.Errorf("unexpected container %+v", snapshot.Container)
+	}
+}
@@ -0,0 +1,173 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package session
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"trust-tunnel/pkg/common/sessionutil"
+
+	"github.com/containerd/containerd"
+	dockerClient "github.com/docker/docker/client"
+	client "trust-tunnel/pkg/trust-tunnel-client"
+)
+
+// Verb is an operation run natively by the agent instead of a command, e.g. listing the processes, so that the
+// operations can be granted to the users without granting shell access. Organizations may register their own.
+type Verb interface {
+	// Scope returns the auth scope required to run the verb, passed to the auth handler, e.g. "verb:ps".
+	Scope() string
+
+	// Run runs the verb with the request, writing the output to stdout. It should return once ctx is done.
+	Run(ctx context.Context, req *VerbCall, stdout io.Writer) error
+}
+
+// IdempotentVerb is implemented by the verbs only reading the state of their targets, e.g. the diagnostics, whose
+// results may be shared by the requests within a short time instead of running the verbs again.
+type IdempotentVerb interface {
+	Verb
+
+	// Idempotent returns whether the verb is idempotent.
+	Idempotent() bool
+}
+
+// VerbTarget is the target a verb runs against, resolved by the agent.
+type VerbTarget struct {
+	// Type is the type of the target.
+	Type client.TargetType
+
+	// ContainerID is the ID of the target container, it's empty for hosts.
+	ContainerID string
+
+	// PID is the init process of the target in the PID namespace of the host, 1 for hosts.
+	PID int
+
+	// Root is the root directory of the target in the agent.
+	Root string
+}
+
+// VerbCall is a call of a verb.
+type VerbCall struct {
+	Target VerbTarget
+
+	// Args are the arguments of the verb given by the user.
+	Args []string
+
+	// CheckPath checks the paths read by the verb against the path policies of the agent.
+	CheckPath func(path string) error
+
+	// MaxBytes is the maximum size of the files read by the verb.
+	MaxBytes int64
+}
+
+// verbs is a mapping from the names of the verbs to the verbs.
+var verbs = make(map[string]Verb)
+
+// RegisterVerb registers a verb with the name. If the name is already registered, it panics.
+func RegisterVerb(name string, verb Verb) {
+	if _, exists := verbs[name]; exists {
+		panic("verb already registered: " + name)
+	}
+
+	verbs[name] = verb
+}
+
+// LookupVerb returns the verb registered with the name.
+func LookupVerb(name string) (Verb, bool) {
+	verb, exists := verbs[name]
+
+	return verb, exists
+}
+
+// VerbNames returns the names of the registered verbs in order.
+func VerbNames() []string {
+	names := make([]string, 0, len(verbs))
+	for name := range verbs {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+// resolveVerbTarget resolves the init process and the root directory of the target.
+func resolveVerbTarget(c *Config, apiClient dockerClient.CommonAPIClient, containerdClient *containerd.Client, containerRuntime ContainerRuntime) (*VerbTarget, error) {
+	// The root of the host is mounted at the rootfs prefix in the agent's container.
+	target := &VerbTarget{Type: c.TargetType, PID: 1, Root: c.RootfsPrefix}
+	if target.Root == "" {
+		target.Root = "/"
+	}
+
+	if c.TargetType == client.TargetContainer {
+		pid, err := containerInitPid(c, apiClient, containerdClient, containerRuntime)
+		if err != nil {
+			return nil, fmt.Errorf("%s", sessionutil.WrapContainerError(err.Error(), c.ContainerID))
+		}
+
+		target.ContainerID = c.ContainerID
+		target.PID = pid
+		target.Root = fmt.Sprintf("/proc/%d/root", pid)
+	}
+
+	return target, nil
+}
+
+// establishVerbSession establishes a session running the verb of the config, the output of the verb is streamed
+// as the stdout, and its error as the stderr.
+func establishVerbSession(c *Config, apiClient dockerClient.CommonAPIClient, containerdClient *containerd.Client, containerRuntime ContainerRuntime) (Session, error) {
+	verb, ok := LookupVerb(c.Verb.Name)
+	if !ok {
+		return nil, fmt.Errorf("unknown verb: %s", c.Verb.Name)
+	}
+
+	target, err := resolveVerbTarget(c, apiClient, containerdClient, containerRuntime)
+	if err != nil {
+		return nil, err
+	}
+
+	req := &VerbCall{Target: *target, Args: c.Verb.Args, CheckPath: c.VerbCheckPath, MaxBytes: c.FileMaxBytes}
+	if req.CheckPath == nil {
+		req.CheckPath = func(string) error { return nil }
+	}
+
+	logger.Infof("run verb %s %v", c.Verb.Name, c.Verb.Args)
+
+	s := newOutputSession()
+	s.stream(c.Verb.Name, func(stdout, _ io.Writer) error {
+		if err := verb.Run(s.ctx, req, stdout); err != nil {
+			return fmt.Errorf("%s: %v", c.Verb.Name, err)
+		}
+
+		return nil
+	})
+
+	return s, nil
+}
+
+// writeJSON writes the value as indented JSON, the output of the built-in verbs.
+func writeJSON(w io.Writer, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(append(data, '\n'))
+
+	return err
+}
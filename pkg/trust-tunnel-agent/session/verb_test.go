@@ -0,0 +1,153 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package session
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type echoVerb struct{}
+
+func (echoVerb) Scope() string {
+	return "verb:echo"
+}
+
+func (echoVerb) Run(_ context.Context, req *VerbCall, stdout io.Writer) error {
+	_, err := fmt.Fprintln(stdout, req.Args)
+
+	return err
+}
+
+func TestRegisterVerb(t *testing.T) {
+	RegisterVerb("test-echo", echoVerb{})
+	defer delete(verbs, "test-echo")
+
+	verb, ok := LookupVerb("test-echo")
+	if !ok || verb.Scope() != "verb:echo" {
+		t.Fatalf("unexpected verb %v", verb)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("registering the verb twice should panic")
+		}
+	}()
+
+	RegisterVerb("test-echo", echoVerb{})
+}
+
+func TestParseHexAddr(t *testing.T) {
+	for s, want := range map[string]string{
+		"0100007F:1F90":                         "127.0.0.1:8080",
+		"00000000:0016":                         "0.0.0.0:22",
+		"00000000000000000000000001000000:0050": "[::1]:80",
+		"invalid":                               "",
+	} {
+		if got := parseHexAddr(s); got != want {
+			t.Errorf("parseHexAddr(%s) = %s, want %s", s, got, want)
+		}
+	}
+}
+
+func TestNetdiagVerb(t *testing.T) {
+	oldProcDir := procDir
+	procDir = t.TempDir()
+
+	defer func() {
+		procDir = oldProcDir
+	}()
+
+	files := map[string]string{
+		"dev": "Inter-|   Receive                                                |  Transmit\n" +
+			" face |bytes    packets errs drop fifo frame compressed multicast|bytes    packets errs drop fifo colls carrier compressed\n" +
+			"  eth0: 1000 10 1 2 0 0 0 0 2000 20 3 4 0 0 0 0\n",
+		"route": "Iface\tDestination\tGateway \tFlags\tRefCnt\tUse\tMetric\tMask\t\tMTU\tWindow\tIRTT\n" +
+			"eth0\t00000000\t0101A8C0\t0003\t0\t0\t0\t00000000\t0\t0\t0\n",
+		"tcp": "  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode\n" +
+			"   0: 00000000:1F90 00000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 1 1\n" +
+			"   1: 0100007F:1F90 0100007F:D431 01 00000000:00000000 00:00000000 00000000     0        0 2 1\n",
+		"udp": "  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode\n" +
+			"   0: 00000000:0035 00000000:0000 07 00000000:00000000 00:00000000 00000000     0        0 3 2\n",
+	}
+
+	for name, content := range files {
+		p := filepath.Join(procDir, "1/net", name)
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.WriteFile(p, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var stdout bytes.Buffer
+	if err := (netdiagVerb{}).Run(context.Background(), &VerbCall{Target: VerbTarget{PID: 1}}, &stdout); err != nil {
+		t.Fatal(err)
+	}
+
+	var diag netdiag
+	if err := json.Unmarshal(stdout.Bytes(), &diag); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(diag.Interfaces) != 1 || diag.Interfaces[0] != (netInterface{Name: "eth0", RxBytes: 1000, RxPackets: 10, RxErrors: 1,
+		RxDropped: 2, TxBytes: 2000, TxPackets: 20, TxErrors: 3, TxDropped: 4}) {
+		t.Errorf("unexpected interfaces %+v", diag.Interfaces)
+	}
+
+	if len(diag.Routes) != 1 || diag.Routes[0] != (netRoute{Interface: "eth0", Destination: "0.0.0.0/0", Gateway: "192.168.1.1"}) {
+		t.Errorf("unexpected routes %+v", diag.Routes)
+	}
+
+	if len(diag.Listeners) != 2 || diag.Listeners[0].Address != "0.0.0.0:8080" || diag.Listeners[1].Address != "0.0.0.0:53" ||
+		diag.TCPStates["LISTEN"] != 1 || diag.TCPStates["ESTABLISHED"] != 1 {
+		t.Errorf("unexpected sockets %+v %v", diag.Listeners, diag.TCPStates)
+	}
+}
+
+func TestFileReadVerb(t *testing.T) {
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "motd"), []byte("hello\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	call := &VerbCall{Target: VerbTarget{Root: root}, Args: []string{"/motd"}, MaxBytes: 1 << 20}
+	call.CheckPath = func(p string) error {
+		if p != "/motd" {
+			return fmt.Errorf("%s is denied", p)
+		}
+
+		return nil
+	}
+
+	var stdout bytes.Buffer
+	if err := (fileReadVerb{}).Run(context.Background(), call, &stdout); err != nil || stdout.String() != "hello\n" {
+		t.Errorf("unexpected output %q, %v", stdout.String(), err)
+	}
+
+	// The path is cleaned before checked.
+	call.Args = []string{"/etc/../motd/../etc/shadow"}
+	if err := (fileReadVerb{}).Run(context.Background(), call, &stdout); err == nil {
+		t.Error("the denied path should be refused")
+	}
+}
@@ -0,0 +1,310 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package session
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	client "trust-tunnel/pkg/trust-tunnel-client"
+)
+
+// The built-in verbs.
+const (
+	VerbTop      = "top"
+	VerbPs       = "ps"
+	VerbNetdiag  = "netdiag"
+	VerbFileRead = "file-read"
+)
+
+// tcpStates are the names of the states of the TCP sockets in /proc/net/tcp.
+var tcpStates = map[string]string{
+	"01": "ESTABLISHED", "02": "SYN_SENT", "03": "SYN_RECV", "04": "FIN_WAIT1", "05": "FIN_WAIT2", "06": "TIME_WAIT",
+	"07": "CLOSE", "08": "CLOSE_WAIT", "09": "LAST_ACK", "0A": "LISTEN", "0B": "CLOSING",
+}
+
+func init() {
+	RegisterVerb(VerbTop, topVerb{})
+	RegisterVerb(VerbPs, psVerb{})
+	RegisterVerb(VerbNetdiag, netdiagVerb{})
+	RegisterVerb(VerbFileRead, fileReadVerb{})
+}
+
+// topVerb prints the triage snapshot of the target, see client.Snapshot.
+type topVerb struct{}
+
+func (topVerb) Idempotent() bool {
+	return true
+}
+
+func (topVerb) Scope() string {
+	return "verb:top"
+}
+
+func (topVerb) Run(ctx context.Context, req *VerbCall, stdout io.Writer) error {
+	snapshot, err := collectSnapshot(ctx, req.Target.PID, req.Target.ContainerID)
+	if err != nil {
+		return err
+	}
+
+	return writeJSON(stdout, snapshot)
+}
+
+// psVerb prints all the processes of the target ordered by the PID.
+type psVerb struct{}
+
+func (psVerb) Idempotent() bool {
+	return true
+}
+
+func (psVerb) Scope() string {
+	return "verb:ps"
+}
+
+func (psVerb) Run(ctx context.Context, req *VerbCall, stdout io.Writer) error {
+	pidNS, err := pidNamespace(req.Target.PID, req.Target.ContainerID)
+	if err != nil {
+		return err
+	}
+
+	first := sampleCPU(pidNS, nil)
+	if err = waitSample(ctx); err != nil {
+		return err
+	}
+
+	second := sampleCPU(pidNS, nil)
+	processes := readProcesses(first, second, second.time.Sub(first.time).Seconds(), 0)
+
+	sort.Slice(processes, func(i, j int) bool {
+		return processes[i].PID < processes[j].PID
+	})
+
+	return writeJSON(stdout, processes)
+}
+
+// netdiag is the network diagnosis of the network namespace of a target.
+type netdiag struct {
+	Interfaces []netInterface `json:"interfaces"`
+	Routes     []netRoute     `json:"routes"`
+	Listeners  []netListener  `json:"listeners"`
+
+	// TCPStates are the numbers of the TCP sockets by the states.
+	TCPStates map[string]int `json:"tcp_states"`
+}
+
+type netInterface struct {
+	Name      string `json:"name"`
+	RxBytes   uint64 `json:"rx_bytes"`
+	RxPackets uint64 `json:"rx_packets"`
+	RxErrors  uint64 `json:"rx_errors"`
+	RxDropped uint64 `json:"rx_dropped"`
+	TxBytes   uint64 `json:"tx_bytes"`
+	TxPackets uint64 `json:"tx_packets"`
+	TxErrors  uint64 `json:"tx_errors"`
+	TxDropped uint64 `json:"tx_dropped"`
+}
+
+type netRoute struct {
+	Interface   string `json:"interface"`
+	Destination string `json:"destination"`
+	Gateway     string `json:"gateway"`
+}
+
+type netListener struct {
+	Protocol string `json:"protocol"`
+	Address  string `json:"address"`
+}
+
+// netdiagVerb prints the interfaces, the IPv4 routes, the listening sockets and the TCP states of the target.
+type netdiagVerb struct{}
+
+func (netdiagVerb) Idempotent() bool {
+	return true
+}
+
+func (netdiagVerb) Scope() string {
+	return "verb:netdiag"
+}
+
+func (netdiagVerb) Run(_ context.Context, req *VerbCall, stdout io.Writer) error {
+	// The files under /proc/<pid>/net are of the network namespace of the process.
+	dir := filepath.Join(procDir, strconv.Itoa(req.Target.PID), "net")
+	diag := &netdiag{Interfaces: []netInterface{}, Routes: []netRoute{}, Listeners: []netListener{}, TCPStates: map[string]int{}}
+
+	err := scanProcNet(filepath.Join(dir, "dev"), 2, func(fields []string) {
+		name, first, _ := strings.Cut(fields[0], ":")
+		if first != "" {
+			fields = append([]string{name, first}, fields[1:]...)
+		}
+
+		if len(fields) < 13 {
+			return
+		}
+
+		values := make([]uint64, 12)
+		for i := range values {
+			values[i], _ = strconv.ParseUint(fields[i+1], 10, 64)
+		}
+
+		diag.Interfaces = append(diag.Interfaces, netInterface{
+			Name:    strings.TrimSuffix(fields[0], ":"),
+			RxBytes: values[0], RxPackets: values[1], RxErrors: values[2], RxDropped: values[3],
+			TxBytes: values[8], TxPackets: values[9], TxErrors: values[10], TxDropped: values[11],
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	// e.g. "eth0	00000000	0101A8C0	0003	0	0	0	00000000	0	0	0"
+	err = scanProcNet(filepath.Join(dir, "route"), 1, func(fields []string) {
+		if len(fields) < 8 {
+			return
+		}
+
+		destination, gateway, mask := parseHexIP(fields[1]), parseHexIP(fields[2]), parseHexIP(fields[7])
+		if destination == nil || gateway == nil || mask == nil {
+			return
+		}
+
+		ones, _ := net.IPMask(mask.To4()).Size()
+		diag.Routes = append(diag.Routes, netRoute{
+			Interface:   fields[0],
+			Destination: fmt.Sprintf("%s/%d", destination, ones),
+			Gateway:     gateway.String(),
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, protocol := range []string{"tcp", "tcp6", "udp", "udp6"} {
+		// e.g. "0: 0100007F:1F90 00000000:0000 0A 00000000:00000000 00:00000000 00000000 0 0 1234 1 ..."
+		err = scanProcNet(filepath.Join(dir, protocol), 1, func(fields []string) {
+			if len(fields) < 4 {
+				return
+			}
+
+			tcp := strings.HasPrefix(protocol, "tcp")
+			if tcp {
+				diag.TCPStates[tcpStates[fields[3]]]++
+			}
+
+			// The listening TCP sockets, and the unconnected UDP sockets bound to the ports.
+			if tcp && fields[3] != "0A" || !tcp && fields[3] != "07" {
+				return
+			}
+
+			if address := parseHexAddr(fields[1]); address != "" {
+				diag.Listeners = append(diag.Listeners, netListener{Protocol: protocol, Address: address})
+			}
+		})
+
+		// IPv6 may be disabled.
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return writeJSON(stdout, diag)
+}
+
+// scanProcNet calls the function with the fields of the lines of the file under /proc/net, skipping the headers.
+func scanProcNet(p string, headers int, fn func(fields []string)) error {
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for line := 0; scanner.Scan(); line++ {
+		if fields := strings.Fields(scanner.Text()); line >= headers && len(fields) > 0 {
+			fn(fields)
+		}
+	}
+
+	return scanner.Err()
+}
+
+// parseHexIP parses the IP address in /proc/net, in hexadecimal of 32-bit words in the host byte order, which is
+// little endian on all the supported platforms.
+func parseHexIP(s string) net.IP {
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != net.IPv4len && len(b) != net.IPv6len {
+		return nil
+	}
+
+	for i := 0; i < len(b); i += 4 {
+		b[i], b[i+1], b[i+2], b[i+3] = b[i+3], b[i+2], b[i+1], b[i]
+	}
+
+	return net.IP(b)
+}
+
+// parseHexAddr parses the address of a socket in /proc/net, e.g. "0100007F:1F90" to "127.0.0.1:8080".
+func parseHexAddr(s string) string {
+	ip, port, ok := strings.Cut(s, ":")
+	if !ok {
+		return ""
+	}
+
+	addr := parseHexIP(ip)
+	if addr == nil {
+		return ""
+	}
+
+	n, err := strconv.ParseUint(port, 16, 16)
+	if err != nil {
+		return ""
+	}
+
+	return net.JoinHostPort(addr.String(), strconv.FormatUint(n, 10))
+}
+
+// fileReadVerb prints a file of the target allowed by the path policies of the agent, like cat.
+type fileReadVerb struct{}
+
+func (fileReadVerb) Scope() string {
+	return "verb:file-read"
+}
+
+func (fileReadVerb) Run(_ context.Context, req *VerbCall, stdout io.Writer) error {
+	if len(req.Args) != 1 {
+		return fmt.Errorf("usage: %s PATH", VerbFileRead)
+	}
+
+	p := filepath.Clean(req.Args[0])
+	if !filepath.IsAbs(p) {
+		return fmt.Errorf("path must be absolute: %s", req.Args[0])
+	}
+
+	if err := req.CheckPath(p); err != nil {
+		return err
+	}
+
+	_, err := readFile(req.Target.Root, &client.FileRequest{Verb: client.FileVerbCat, Path: p}, req.MaxBytes, nil, stdout)
+
+	return err
+}
@@ -0,0 +1,306 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package sessionio carries the output of the sessions from their backends to the handler. The output is pumped
+// into the streams by the frames and read by the frames until the streams end or the session is torn down, and the
+// handler tells once it has drained the streams, so that the exit code is read after all the output is sent.
+package sessionio
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"trust-tunnel/pkg/trust-tunnel-agent/monitor"
+)
+
+const (
+	// DefaultFrameSize is the most bytes of the output read and sent in a frame by default.
+	DefaultFrameSize = 4096
+
+	// DefaultDrainTimeout is how long the streams are waited for to be drained once the output has ended, after
+	// which the exit code is read anyway, e.g. if a stream was never read for an early failure.
+	DefaultDrainTimeout = 5 * time.Second
+
+	// bufferedFrames is the number of the frames buffered in a stream before the pump waits for them to be read.
+	bufferedFrames = 64
+)
+
+// ErrClosed is the error of writing to a stream of the session torn down.
+var ErrClosed = errors.New("session streams are closed")
+
+// Stream is an output stream of a session, it's written by a single pump.
+type Stream struct {
+	frames chan io.Reader
+	// err is returned by Next once the frames are read after the stream ends, it's set before frames is closed.
+	err     error
+	endOnce sync.Once
+	onEnd   func()
+
+	// closed is closed once the session is torn down.
+	closed <-chan struct{}
+
+	// drained is closed once the handler has drained the stream.
+	drained   chan struct{}
+	drainOnce sync.Once
+}
+
+func newStream(closed <-chan struct{}, onEnd func()) *Stream {
+	return &Stream{
+		frames:  make(chan io.Reader, bufferedFrames),
+		closed:  closed,
+		onEnd:   onEnd,
+		drained: make(chan struct{}),
+	}
+}
+
+// Next returns the next frame of the output. It returns io.EOF once the stream ends, or the error ending it,
+// and io.EOF at once after the session is torn down.
+func (s *Stream) Next() (io.Reader, error) {
+	select {
+	case <-s.closed:
+		return nil, io.EOF
+	default:
+	}
+
+	select {
+	case r, ok := <-s.frames:
+		if !ok {
+			return nil, s.err
+		}
+
+		return r, nil
+	case <-s.closed:
+		return nil, io.EOF
+	}
+}
+
+// Send sends the frame, which mustn't be modified afterwards. It waits for the frames buffered to be read, and
+// fails with ErrClosed once the session is torn down.
+func (s *Stream) Send(frame []byte) error {
+	select {
+	case <-s.closed:
+		return ErrClosed
+	default:
+	}
+
+	select {
+	case s.frames <- bytes.NewReader(frame):
+		return nil
+	case <-s.closed:
+		return ErrClosed
+	}
+}
+
+// Write sends a copy of p as a frame.
+func (s *Stream) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	if err := s.Send(bytes.Clone(p)); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+// End ends the stream after the frames sent, Next returns err then, or io.EOF if it's nil. Only the first call
+// takes effect, and nothing can be sent afterwards.
+func (s *Stream) End(err error) {
+	s.endOnce.Do(func() {
+		if err == nil {
+			err = io.EOF
+		}
+
+		s.err = err
+		close(s.frames)
+		s.onEnd()
+	})
+}
+
+// Pump sends the output read from r by the frames of up to size bytes, DefaultFrameSize if it's not positive,
+// until r fails, and then ends the stream. The failures of reading the closed files, pipes and connections, and
+// the terminals whose processes have exited, end the stream as io.EOF, the others end it as they are and are
+// returned.
+func (s *Stream) Pump(r io.Reader, size int) error {
+	if size <= 0 {
+		size = DefaultFrameSize
+	}
+
+	for {
+		buf := make([]byte, size)
+
+		n, err := r.Read(buf)
+		if n > 0 {
+			if sendErr := s.Send(buf[:n]); sendErr != nil {
+				s.End(nil)
+
+				return nil
+			}
+		}
+
+		if err != nil {
+			if IsClosed(err) {
+				err = nil
+			}
+
+			s.End(err)
+
+			return err
+		}
+	}
+}
+
+// Done tells that the handler has drained the stream, it can be called more than once.
+func (s *Stream) Done() {
+	s.drainOnce.Do(func() {
+		close(s.drained)
+	})
+}
+
+// IsClosed returns whether the error of reading the output tells it has ended rather than failed, the output of
+// the closed files, pipes and connections, and of the terminals whose processes have exited.
+func IsClosed(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, os.ErrClosed) || errors.Is(err, io.ErrClosedPipe) ||
+		errors.Is(err, net.ErrClosed) || errors.Is(err, syscall.EIO)
+}
+
+// Streams are the stdout and the stderr of a session, embedded by the sessions for the output methods of
+// session.Session.
+type Streams struct {
+	Stdout *Stream
+	Stderr *Stream
+
+	// ctx is canceled once the session is torn down.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// ended is closed once both of the streams end.
+	ended   chan struct{}
+	running atomic.Int32
+
+	// DrainTimeout is how long Wait waits for the streams to be drained once they end, DefaultDrainTimeout by
+	// default.
+	DrainTimeout time.Duration
+}
+
+// New creates the streams of a session.
+func New() *Streams {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	s := &Streams{ctx: ctx, cancel: cancel, ended: make(chan struct{}), DrainTimeout: DefaultDrainTimeout}
+	s.running.Store(2)
+
+	onEnd := func() {
+		if s.running.Add(-1) == 0 {
+			close(s.ended)
+		}
+	}
+
+	s.Stdout = newStream(ctx.Done(), onEnd)
+	s.Stderr = newStream(ctx.Done(), onEnd)
+
+	return s
+}
+
+// Pump pumps the output of stdout and stderr into the streams in background. The stderr is nil if it's merged into
+// the stdout, e.g. by a terminal, and the stderr stream ends at once then.
+func (s *Streams) Pump(stdout, stderr io.Reader, size int) {
+	monitor.Go("session_stdout", func() {
+		s.Stdout.Pump(stdout, size)
+	})
+
+	if stderr == nil {
+		s.Stderr.End(nil)
+
+		return
+	}
+
+	monitor.Go("session_stderr", func() {
+		s.Stderr.Pump(stderr, size)
+	})
+}
+
+// End ends both of the streams after the frames sent.
+func (s *Streams) End() {
+	s.Stdout.End(nil)
+	s.Stderr.End(nil)
+}
+
+// Close tears down the streams: the frames left are dropped, and the streams end at once.
+func (s *Streams) Close() {
+	s.cancel()
+}
+
+// Context returns the context canceled once the streams are torn down.
+func (s *Streams) Context() context.Context {
+	return s.ctx
+}
+
+// Wait waits for the streams to be drained, and returns whether they are. It gives up once the streams are torn
+// down, or once they aren't drained within DrainTimeout after both of them have ended.
+func (s *Streams) Wait() bool {
+	ended := (<-chan struct{})(s.ended)
+
+	var timeout <-chan time.Time
+
+	for _, stream := range []*Stream{s.Stdout, s.Stderr} {
+		for drained := false; !drained; {
+			select {
+			case <-stream.drained:
+				drained = true
+			case <-ended:
+				ended = nil
+				timeout = time.After(s.DrainTimeout)
+			case <-timeout:
+				return false
+			case <-s.ctx.Done():
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// NextStdout returns the next frame of the stdout.
+func (s *Streams) NextStdout() (io.Reader, error) {
+	return s.Stdout.Next()
+}
+
+// NextStderr returns the next frame of the stderr.
+func (s *Streams) NextStderr() (io.Reader, error) {
+	return s.Stderr.Next()
+}
+
+// StdoutDone tells that the stdout is drained.
+func (s *Streams) StdoutDone() error {
+	s.Stdout.Done()
+
+	return nil
+}
+
+// StderrDone tells that the stderr is drained.
+func (s *Streams) StderrDone() error {
+	s.Stderr.Done()
+
+	return nil
+}
@@ -0,0 +1,158 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sessionio
+
+import (
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+type failingReader struct {
+	data string
+	err  error
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if r.data == "" {
+		return 0, r.err
+	}
+
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+
+	return n, nil
+}
+
+func readAll(t *testing.T, s *Stream) (string, error) {
+	t.Helper()
+
+	var out strings.Builder
+
+	for {
+		r, err := s.Next()
+		if err != nil {
+			return out.String(), err
+		}
+
+		if _, err := io.Copy(&out, r); err != nil {
+			t.Fatalf("unexpected read error: %v", err)
+		}
+	}
+}
+
+func TestStreamPump(t *testing.T) {
+	failure := errors.New("broken")
+
+	tests := []struct {
+		name    string
+		err     error
+		wantErr error
+	}{
+		{name: "eof", err: io.EOF, wantErr: io.EOF},
+		{name: "closed file", err: os.ErrClosed, wantErr: io.EOF},
+		{name: "exited terminal", err: &os.PathError{Op: "read", Path: "/dev/ptmx", Err: syscall.EIO}, wantErr: io.EOF},
+		{name: "failure", err: failure, wantErr: failure},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := New()
+			defer s.Close()
+
+			go s.Stdout.Pump(&failingReader{data: "hello world", err: tt.err}, 4)
+
+			out, err := readAll(t, s.Stdout)
+			if out != "hello world" {
+				t.Errorf("unexpected output %q", out)
+			}
+
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("unexpected error %v, expected %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestStreamsClose(t *testing.T) {
+	s := New()
+
+	// Nothing reads the frames, so the pump blocks once the buffer is full.
+	pumped := make(chan error, 1)
+
+	go func() {
+		pumped <- s.Stdout.Pump(strings.NewReader(strings.Repeat("x", 2*bufferedFrames)), 1)
+	}()
+
+	s.Close()
+
+	select {
+	case err := <-pumped:
+		if err != nil {
+			t.Errorf("unexpected pump error: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("pump is blocked after close")
+	}
+
+	if _, err := s.NextStdout(); err != io.EOF {
+		t.Errorf("unexpected error %v after close", err)
+	}
+
+	if _, err := s.Stderr.Write([]byte("late")); err != ErrClosed {
+		t.Errorf("unexpected error %v writing after close", err)
+	}
+
+	if s.Wait() {
+		t.Error("streams torn down are reported drained")
+	}
+}
+
+func TestStreamsWait(t *testing.T) {
+	t.Run("drained", func(t *testing.T) {
+		s := New()
+		defer s.Close()
+
+		s.Pump(strings.NewReader("out"), nil, 0)
+
+		if _, err := readAll(t, s.Stdout); err != io.EOF {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		s.StdoutDone()
+		s.StderrDone()
+
+		if !s.Wait() {
+			t.Error("drained streams aren't reported drained")
+		}
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		s := New()
+		defer s.Close()
+
+		s.DrainTimeout = 10 * time.Millisecond
+		s.End()
+		s.StdoutDone()
+
+		if s.Wait() {
+			t.Error("undrained stderr is reported drained")
+		}
+	})
+}
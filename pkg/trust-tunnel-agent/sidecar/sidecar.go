@@ -18,6 +18,7 @@ import (
 	"bufio"
 	"context"
 	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"io"
 	"os"
@@ -28,6 +29,7 @@ import (
 	"github.com/docker/docker/api/types/container"
 	imageTypes "github.com/docker/docker/api/types/image"
 	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/jsonmessage"
 )
 
 var logger = logutil.GetLogger("trust-tunnel-agent")
@@ -44,8 +46,19 @@ type Config struct {
 	// ImageHubAuth specifies the authentication information for the image hub.
 	ImageHubAuth string
 
+	// ImageTarball specifies the path of a local image tarball (as produced by "docker save"),
+	// it's loaded when the sidecar image is missing and can't be pulled from the image hub.
+	ImageTarball string `toml:"image_tarball"`
+
 	// Limit specifies the maximum number of sidecar containers that can be existed at the same time.
 	Limit int
+
+	// PerContainerLimit specifies the maximum number of sidecar containers attached to the same container,
+	// unlimited if it's zero.
+	PerContainerLimit int `toml:"per_container_limit"`
+
+	// Verify specifies the signature verification of the sidecar image.
+	Verify VerifyConfig `toml:"verify"`
 }
 
 // PullMissingImage tries to pull a Docker image if it does not exist locally or force updating is true.
@@ -110,10 +123,86 @@ func PullMissingImage(image, auth string, force bool, apiClient client.CommonAPI
 	return image, fmt.Errorf("failed to pull image %s", image)
 }
 
+// PrepareImage makes sure the given sidecar image is present locally.
+// The image is pulled from the image hub if it's missing, and loaded from the tarball if pulling fails,
+// so that sidecars still work on air-gapped hosts. The signature of the image is verified at last.
+func PrepareImage(image, auth, tarball string, apiClient client.CommonAPIClient) (string, error) {
+	image, err := PullMissingImage(image, auth, false, apiClient)
+	if err != nil {
+		if tarball == "" {
+			return image, err
+		}
+
+		logger.Warnf("pull image %s error: %v, fall back to load it from tarball %s", image, err, tarball)
+
+		if err = LoadImageFromTarball(image, tarball, apiClient); err != nil {
+			return image, err
+		}
+	}
+
+	return image, VerifyImage(image, apiClient)
+}
+
+// LoadImageFromTarball loads the image tarball into the container runtime like "docker load",
+// and checks the given image is present afterwards.
+func LoadImageFromTarball(image, tarball string, apiClient client.CommonAPIClient) error {
+	if apiClient == nil {
+		return fmt.Errorf("container client is not ready")
+	}
+
+	f, err := os.Open(tarball)
+	if err != nil {
+		return fmt.Errorf("open image tarball error: %v", err)
+	}
+	defer f.Close()
+
+	logger.Infof("loading image %s from tarball %s", image, tarball)
+
+	resp, err := apiClient.ImageLoad(context.Background(), f, true)
+	if err != nil {
+		return fmt.Errorf("load image tarball %s error: %v", tarball, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.JSON {
+		decoder := json.NewDecoder(resp.Body)
+
+		for {
+			var msg jsonmessage.JSONMessage
+			if err := decoder.Decode(&msg); err == io.EOF {
+				break
+			} else if err != nil {
+				return fmt.Errorf("failed to read image loading content: %v", err)
+			}
+
+			if msg.Error != nil {
+				return fmt.Errorf("load image tarball %s error: %v", tarball, msg.Error)
+			}
+
+			logger.Debugf("%s", msg.Stream)
+		}
+	} else if _, err = io.Copy(io.Discard, resp.Body); err != nil {
+		return fmt.Errorf("failed to read image loading content: %v", err)
+	}
+
+	exists, err := imageExists(apiClient, image)
+	if err != nil {
+		return err
+	}
+
+	if !exists {
+		return fmt.Errorf("image %s isn't found in tarball %s", image, tarball)
+	}
+
+	logger.Infof("image %s is loaded from tarball %s", image, tarball)
+
+	return nil
+}
+
 // Init sets up the sidecar container environment.
-// It primarily verifies the availability of the Docker endpoint and pulls the required sidecar image.
+// It primarily verifies the availability of the Docker endpoint, prepares the required sidecar image and verifies its signature.
 // If the Docker environment is not ready or the image pull fails, returns an error.
-func Init(endpoint, image, auth string, apiClient client.CommonAPIClient) error {
+func Init(endpoint string, config *Config, apiClient client.CommonAPIClient) error {
 	if apiClient == nil {
 		return fmt.Errorf("container client is nil")
 	}
@@ -124,9 +213,9 @@ func Init(endpoint, image, auth string, apiClient client.CommonAPIClient) error
 		return err
 	}
 
-	image, err := PullMissingImage(image, auth, false, apiClient)
+	image, err := PrepareImage(config.Image, config.ImageHubAuth, config.ImageTarball, apiClient)
 	if err != nil {
-		logger.Errorf("pull sidecar image %s failed: %v", image, err)
+		logger.Errorf("prepare sidecar image %s failed: %v", image, err)
 
 		return err
 	}
@@ -139,16 +228,20 @@ func Init(endpoint, image, auth string, apiClient client.CommonAPIClient) error
 // In some situations, when creating a large number of sidecar sessions,
 // sidecar containers may not be successfully reclaimed due to container performance issues，
 // we need to clean legacy sidecar(not running and created an hour ago) container periodically.
-func CleanLegacyContainerPeriodically(apiClient client.CommonAPIClient) {
+// getClient returns the current container client, as the client may be re-created when the daemon restarts.
+func CleanLegacyContainerPeriodically(getClient func() (client.CommonAPIClient, error)) {
 	logger.Infof("start clean legacy trust-tunnel-sidecar containers  periodcally")
 
-	if apiClient == nil {
-		return
-	}
-
 	for {
 		time.Sleep(defaultCleanLegacySidecarPeriod)
 
+		apiClient, err := getClient()
+		if err != nil {
+			logger.Errorf("get container client error: %v", err)
+
+			continue
+		}
+
 		containers, err := apiClient.ContainerList(context.Background(), container.ListOptions{All: true})
 		if err != nil {
 			logger.Errorf("failed to list containers %v", err)
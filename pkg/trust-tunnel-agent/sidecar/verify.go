@@ -0,0 +1,261 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sidecar
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+	"trust-tunnel/pkg/trust-tunnel-agent/monitor"
+
+	"github.com/docker/docker/client"
+)
+
+const (
+	defaultCosignPath    = "cosign"
+	defaultVerifyTimeout = time.Minute
+
+	// errImageVerifyFailed is the message prefix of verification errors, it's mapped to an error code
+	// by sessionutil.WrapErrorWithCode.
+	errImageVerifyFailed = "sidecar image signature verification failed"
+)
+
+// VerifyConfig specifies how the signature of the sidecar image is verified before it's started.
+type VerifyConfig struct {
+	// Enabled indicates whether unsigned sidecar images should be refused.
+	Enabled bool `toml:"enabled"`
+
+	// CosignPath is the path of the cosign binary, "cosign" in $PATH is used if it's empty.
+	CosignPath string `toml:"cosign_path"`
+
+	// PublicKeys specifies the public keys used to verify the signature,
+	// any key reference supported by "cosign verify --key" is accepted, e.g. a file path or a KMS URI.
+	PublicKeys []string `toml:"public_keys"`
+
+	// KeylessIdentities specifies the identities accepted for keyless signatures.
+	KeylessIdentities []KeylessIdentity `toml:"keyless_identities"`
+
+	// Timeout is the timeout of a single verification, defaults to 1 minute.
+	Timeout time.Duration `toml:"timeout"`
+
+	// ImageIDs specifies the IDs of the images trusted without signatures, e.g. "sha256:..." of the image loaded
+	// from the image tarball, which has no repo digest to verify its signature against. The ID is the digest of
+	// the image config, which covers the layers, so it pins the exact image.
+	ImageIDs []string `toml:"image_ids"`
+}
+
+// KeylessIdentity represents the certificate identity of a keyless signature.
+type KeylessIdentity struct {
+	// Issuer is the OIDC issuer of the signing certificate.
+	Issuer string `toml:"issuer"`
+
+	// Subject is the identity (e.g. email or workflow URI) in the signing certificate.
+	Subject string `toml:"subject"`
+}
+
+// Verifier verifies the cosign signature of the sidecar image.
+// Verified image IDs are cached, so an image is verified only once unless it's updated.
+type Verifier struct {
+	config   VerifyConfig
+	lock     sync.Mutex
+	verified map[string]bool
+}
+
+// verifier is the verifier of sidecar images, it's set up by SetupVerifier.
+var verifier *Verifier
+
+// SetupVerifier sets up the verifier used by VerifyImage with the given configuration.
+func SetupVerifier(config VerifyConfig) error {
+	v, err := NewVerifier(config)
+	if err != nil {
+		return err
+	}
+
+	verifier = v
+
+	return nil
+}
+
+// NewVerifier creates a new Verifier with the given configuration.
+func NewVerifier(config VerifyConfig) (*Verifier, error) {
+	if config.Enabled && len(config.PublicKeys) == 0 && len(config.KeylessIdentities) == 0 && len(config.ImageIDs) == 0 {
+		return nil, fmt.Errorf("neither public keys, keyless identities nor image IDs are configured for sidecar image verification")
+	}
+
+	if config.CosignPath == "" {
+		config.CosignPath = defaultCosignPath
+	}
+
+	if config.Timeout <= 0 {
+		config.Timeout = defaultVerifyTimeout
+	}
+
+	return &Verifier{
+		config:   config,
+		verified: make(map[string]bool),
+	}, nil
+}
+
+// VerifyImage verifies the signature of the given local image if verification is enabled.
+func VerifyImage(image string, apiClient client.CommonAPIClient) error {
+	if verifier == nil {
+		return nil
+	}
+
+	return verifier.Verify(image, apiClient)
+}
+
+// Verify verifies the signature of the given local image.
+// The image is verified by its repo digest, so the signature must match the exact image present on the node.
+// The images without repo digests, i.e. loaded from tarballs, are only trusted by their IDs in ImageIDs.
+func (v *Verifier) Verify(image string, apiClient client.CommonAPIClient) error {
+	if !v.config.Enabled {
+		return nil
+	}
+
+	if apiClient == nil {
+		return fmt.Errorf("container client is not ready")
+	}
+
+	inspect, _, err := apiClient.ImageInspectWithRaw(context.Background(), image)
+	if err != nil {
+		return fmt.Errorf("%s: inspect image %s error: %v", errImageVerifyFailed, image, err)
+	}
+
+	v.lock.Lock()
+	ok := v.verified[inspect.ID]
+	v.lock.Unlock()
+
+	if ok {
+		return nil
+	}
+
+	if v.trustedID(inspect.ID) {
+		monitor.MetricsSidecarImageVerify.WithLabelValues("success").Inc()
+		logger.Infof("image %s is trusted by its ID %s", image, inspect.ID)
+
+		v.lock.Lock()
+		v.verified[inspect.ID] = true
+		v.lock.Unlock()
+
+		return nil
+	}
+
+	ref := digestReference(image, inspect.RepoDigests)
+	if ref == "" {
+		monitor.MetricsSidecarImageVerify.WithLabelValues("failure").Inc()
+
+		return fmt.Errorf("%s: image %s has no repo digest and its ID %s isn't in image_ids", errImageVerifyFailed, image, inspect.ID)
+	}
+
+	if err := v.verifyRef(ref); err != nil {
+		monitor.MetricsSidecarImageVerify.WithLabelValues("failure").Inc()
+		logger.Errorf("verify signature of image %s error: %v", ref, err)
+
+		return fmt.Errorf("%s: %s", errImageVerifyFailed, ref)
+	}
+
+	monitor.MetricsSidecarImageVerify.WithLabelValues("success").Inc()
+	logger.Infof("signature of image %s is verified", ref)
+
+	v.lock.Lock()
+	v.verified[inspect.ID] = true
+	v.lock.Unlock()
+
+	return nil
+}
+
+// trustedID returns whether the image ID is in ImageIDs, which may omit the "sha256:" prefix.
+func (v *Verifier) trustedID(id string) bool {
+	for _, trusted := range v.config.ImageIDs {
+		if trusted != "" && strings.TrimPrefix(trusted, "sha256:") == strings.TrimPrefix(id, "sha256:") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// verifyRef runs cosign against the given reference with every configured key and identity,
+// the reference is regarded as verified once any of them succeeds.
+func (v *Verifier) verifyRef(ref string) error {
+	var errs []string
+
+	for _, args := range v.cosignArgs(ref) {
+		ctx, cancel := context.WithTimeout(context.Background(), v.config.Timeout)
+
+		var stderr bytes.Buffer
+
+		cmd := exec.CommandContext(ctx, v.config.CosignPath, args...)
+		cmd.Stderr = &stderr
+
+		err := cmd.Run()
+
+		cancel()
+
+		if err == nil {
+			return nil
+		}
+
+		errs = append(errs, fmt.Sprintf("%v: %s", err, strings.TrimSpace(stderr.String())))
+	}
+
+	return fmt.Errorf("%s", strings.Join(errs, "; "))
+}
+
+// cosignArgs returns the arguments of all the cosign invocations for the given reference.
+func (v *Verifier) cosignArgs(ref string) [][]string {
+	var argsList [][]string
+
+	for _, key := range v.config.PublicKeys {
+		argsList = append(argsList, []string{"verify", "--key", key, ref})
+	}
+
+	for _, identity := range v.config.KeylessIdentities {
+		argsList = append(argsList, []string{
+			"verify",
+			"--certificate-identity", identity.Subject,
+			"--certificate-oidc-issuer", identity.Issuer,
+			ref,
+		})
+	}
+
+	return argsList
+}
+
+// digestReference picks the repo digest of the given image from the digest list,
+// the first digest is used if no repository matches.
+func digestReference(image string, repoDigests []string) string {
+	if len(repoDigests) == 0 {
+		return ""
+	}
+
+	repo := image
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		repo = image[:i]
+	}
+
+	for _, digest := range repoDigests {
+		if strings.HasPrefix(digest, repo+"@") {
+			return digest
+		}
+	}
+
+	return repoDigests[0]
+}
@@ -0,0 +1,142 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sidecar
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	imageTypes "github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/errdefs"
+)
+
+func TestDigestReference(t *testing.T) {
+	digests := []string{
+		"mirror.example.com/trust-tunnel-sidecar@sha256:aaa",
+		"localhost:5000/trust-tunnel-sidecar@sha256:bbb",
+	}
+
+	tests := []struct {
+		image    string
+		digests  []string
+		expected string
+	}{
+		{"localhost:5000/trust-tunnel-sidecar:latest", digests, "localhost:5000/trust-tunnel-sidecar@sha256:bbb"},
+		{"localhost:5000/trust-tunnel-sidecar", digests, "localhost:5000/trust-tunnel-sidecar@sha256:bbb"},
+		{"trust-tunnel-sidecar:latest", digests, "mirror.example.com/trust-tunnel-sidecar@sha256:aaa"},
+		{"trust-tunnel-sidecar:latest", nil, ""},
+	}
+
+	for _, test := range tests {
+		if ref := digestReference(test.image, test.digests); ref != test.expected {
+			t.Errorf("digestReference(%s) = %s, expected %s", test.image, ref, test.expected)
+		}
+	}
+}
+
+func TestNewVerifier(t *testing.T) {
+	if _, err := NewVerifier(VerifyConfig{Enabled: true}); err == nil {
+		t.Errorf("expected error when no key or identity is configured")
+	}
+
+	if _, err := NewVerifier(VerifyConfig{Enabled: true, ImageIDs: []string{"sha256:abc"}}); err != nil {
+		t.Errorf("unexpected error with only image IDs: %v", err)
+	}
+
+	v, err := NewVerifier(VerifyConfig{
+		Enabled:           true,
+		PublicKeys:        []string{"cosign.pub"},
+		KeylessIdentities: []KeylessIdentity{{Issuer: "https://issuer", Subject: "builder@example.com"}},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if v.config.CosignPath != defaultCosignPath || v.config.Timeout != defaultVerifyTimeout {
+		t.Errorf("unexpected defaults: %+v", v.config)
+	}
+
+	if args := v.cosignArgs("image@sha256:aaa"); len(args) != 2 {
+		t.Errorf("unexpected cosign invocations: %v", args)
+	}
+}
+
+// fakeImageClient is an air-gapped docker client, which can't pull images but loads them from tarballs.
+type fakeImageClient struct {
+	client.CommonAPIClient
+
+	loaded string
+}
+
+func (c *fakeImageClient) ImagePull(_ context.Context, ref string, _ imageTypes.PullOptions) (io.ReadCloser, error) {
+	return nil, fmt.Errorf("pull %s: no route to host", ref)
+}
+
+func (c *fakeImageClient) ImageLoad(_ context.Context, input io.Reader, _ bool) (types.ImageLoadResponse, error) {
+	data, err := io.ReadAll(input)
+	if err != nil {
+		return types.ImageLoadResponse{}, err
+	}
+
+	c.loaded = string(data)
+
+	return types.ImageLoadResponse{Body: io.NopCloser(strings.NewReader(""))}, nil
+}
+
+func (c *fakeImageClient) ImageInspectWithRaw(_ context.Context, image string) (types.ImageInspect, []byte, error) {
+	if c.loaded == "" {
+		return types.ImageInspect{}, nil, errdefs.NotFound(fmt.Errorf("no such image: %s", image))
+	}
+
+	// The images loaded from tarballs have no repo digests.
+	return types.ImageInspect{ID: "sha256:" + c.loaded}, nil, nil
+}
+
+func TestPrepareImageFromTarball(t *testing.T) {
+	tarball := filepath.Join(t.TempDir(), "sidecar.tar")
+	if err := os.WriteFile(tarball, []byte("abc"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(v *Verifier) { verifier = v }(verifier)
+
+	for _, test := range []struct {
+		ids []string
+		ok  bool
+	}{
+		{[]string{"sha256:abc"}, true},
+		{[]string{"abc"}, true},
+		{[]string{"sha256:def"}, false},
+	} {
+		v, err := NewVerifier(VerifyConfig{Enabled: true, PublicKeys: []string{"cosign.pub"}, ImageIDs: test.ids})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		verifier = v
+
+		_, err = PrepareImage("trust-tunnel-sidecar:latest", "", tarball, &fakeImageClient{})
+		if ok := err == nil; ok != test.ok {
+			t.Errorf("image_ids %v: got error %v, want ok %v", test.ids, err, test.ok)
+		}
+	}
+}
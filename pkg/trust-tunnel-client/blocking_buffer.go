@@ -18,102 +18,77 @@ import (
 	"bytes"
 	"io"
 	"sync"
-	"time"
 )
 
 // BlockingBuffer is a synchronized buffer that blocks Read operations until data is available.
+// Once it's closed, the data written before is still readable, then Read returns the error it's closed with.
 type BlockingBuffer struct {
-	readBuffer  *bytes.Buffer
-	writeBuffer *bytes.Buffer
-	// Signal channel for notifying data availability.
-	signal chan struct{}
-	lock   sync.RWMutex
+	buffer bytes.Buffer
+	// err is returned by Read once the buffer is closed and drained, nil if the buffer is open.
+	err  error
+	lock sync.Mutex
+	// cond is broadcast when data is written or the buffer is closed.
+	cond *sync.Cond
 }
 
 // NewBlockingBuffer initializes a new instance of BlockingBuffer.
 func NewBlockingBuffer() *BlockingBuffer {
-	return &BlockingBuffer{
-		readBuffer:  bytes.NewBuffer(nil),
-		writeBuffer: bytes.NewBuffer(nil),
-		signal:      make(chan struct{}, 1),
-	}
+	b := &BlockingBuffer{}
+	b.cond = sync.NewCond(&b.lock)
+
+	return b
 }
 
 // Read reads data from the buffer, blocking if the buffer is empty until data becomes available.
-func (b *BlockingBuffer) Read(p []byte) (n int, err error) {
-	for {
-		b.lock.RLock()
-		if b.readBuffer == nil {
-			return 0, io.EOF
-		}
-
-		n, err = b.readBuffer.Read(p)
-		b.lock.RUnlock()
-
-		// Two conditions:
-		// err is nil: read is finished successfully.
-		// err is some real problem: return error.
-		if err != io.EOF {
-			return
-		}
-
-		// err is io.EOF indicates that buffer is drained, wait for next read signal.
-		_, ok := <-b.signal
-		if !ok {
-			// Channel is closed.
-			return 0, io.EOF
-		}
-
-		// Move writeBuffer to readBuffer.
-		b.lock.Lock()
-		// Closed.
-		if b.readBuffer == nil {
-			return 0, io.EOF
-		}
-		// Write buffer turns to be read buffer now and old read buffer will be cleaned by GC.
-		b.readBuffer.Reset()
-		b.readBuffer = b.writeBuffer
-		// Make a new write buffer.
-		b.writeBuffer = &bytes.Buffer{}
-		b.lock.Unlock()
+func (b *BlockingBuffer) Read(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	for b.buffer.Len() == 0 && b.err == nil {
+		b.cond.Wait()
 	}
+
+	if b.buffer.Len() == 0 {
+		return 0, b.err
+	}
+
+	return b.buffer.Read(p)
 }
 
 // Write writes data into the buffer and notifies readers that data is available.
-func (b *BlockingBuffer) Write(p []byte) (n int, err error) {
+func (b *BlockingBuffer) Write(p []byte) (int, error) {
 	b.lock.Lock()
-	// Closed.
-	if b.writeBuffer == nil {
-		return 0, io.EOF
-	}
-
-	n, err = b.writeBuffer.Write(p)
-	b.lock.Unlock()
+	defer b.lock.Unlock()
 
-	// Send signal that if there are contents to read.
-	select {
-	case b.signal <- struct{}{}:
-	default:
+	if b.err != nil {
+		return 0, io.ErrClosedPipe
 	}
 
-	return
+	n, err := b.buffer.Write(p)
+	b.cond.Broadcast()
+
+	return n, err
 }
 
-// Close gracefully shuts down the buffer, ensuring all written data is read before closing.
+// Close closes the buffer, Read returns io.EOF once the data written is drained.
 func (b *BlockingBuffer) Close() error {
-	for b.readBuffer.Len() != 0 || b.writeBuffer.Len() != 0 {
-		// Wait for all data to be read before close the buffer.
-		time.Sleep(time.Millisecond * 100)
+	return b.CloseWithError(nil)
+}
+
+// CloseWithError closes the buffer, Read returns the error once the data written is drained,
+// or io.EOF if the error is nil. Closing a closed buffer has no effect.
+func (b *BlockingBuffer) CloseWithError(err error) error {
+	if err == nil {
+		err = io.EOF
 	}
 
-	close(b.signal)
 	b.lock.Lock()
+	defer b.lock.Unlock()
 
-	b.readBuffer.Reset()
-	b.writeBuffer.Reset()
-	b.readBuffer = nil
-	b.writeBuffer = nil
-	b.lock.Unlock()
+	if b.err == nil {
+		b.err = err
+		b.cond.Broadcast()
+	}
 
 	return nil
 }
@@ -16,6 +16,7 @@ package client
 
 import (
 	"bytes"
+	"errors"
 	"io"
 	"testing"
 )
@@ -83,3 +84,81 @@ func TestBlockingBuffer_ReadWriteClose(t *testing.T) {
 		t.Errorf("Expected EOF after close, got n=%d, err=%v", n, err)
 	}
 }
+
+func BenchmarkBlockingBuffer(b *testing.B) {
+	const (
+		chunkSize = 4096
+		total     = 1 << 20
+	)
+
+	chunk := bytes.Repeat([]byte("a"), chunkSize)
+	readData := make([]byte, 32*1024)
+
+	b.SetBytes(total)
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		bb := NewBlockingBuffer()
+
+		// Write the output as it's received from the websocket messages.
+		go func() {
+			for written := 0; written < total; written += chunkSize {
+				bb.Write(chunk)
+			}
+		}()
+
+		for read := 0; read < total; {
+			n, err := bb.Read(readData)
+			if err != nil {
+				b.Fatalf("Unexpected error during read: %v", err)
+			}
+
+			read += n
+		}
+	}
+}
+
+func TestBlockingBuffer_CloseWithError(t *testing.T) {
+	bb := NewBlockingBuffer()
+	expectedErr := errors.New("connection reset")
+
+	// The blocked readers are woken up by the close.
+	errCh := make(chan error, 1)
+
+	go func() {
+		_, err := bb.Read(make([]byte, 8))
+		errCh <- err
+	}()
+
+	bb.Write([]byte("testdata"))
+
+	if err := <-errCh; err != nil {
+		t.Fatalf("Unexpected error during read: %v", err)
+	}
+
+	go func() {
+		_, err := bb.Read(make([]byte, 8))
+		errCh <- err
+	}()
+
+	bb.CloseWithError(expectedErr)
+	bb.Close()
+
+	if err := <-errCh; err != expectedErr {
+		t.Errorf("Expected error %v, got %v", expectedErr, err)
+	}
+
+	// The data written before the close is drained before the error.
+	bb = NewBlockingBuffer()
+	bb.Write([]byte("testdata"))
+	bb.CloseWithError(expectedErr)
+
+	if _, err := bb.Write([]byte("more")); err != io.ErrClosedPipe {
+		t.Errorf("Expected ErrClosedPipe writing after close, got %v", err)
+	}
+
+	data, err := io.ReadAll(bb)
+	if err != expectedErr || string(data) != "testdata" {
+		t.Errorf("Expected data %q and error %v, got %q and %v", "testdata", expectedErr, data, err)
+	}
+}
@@ -17,43 +17,142 @@ package client
 import (
 	"crypto/tls"
 	"crypto/x509"
-	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"sort"
 	"strconv"
+	"strings"
+	"time"
+	"trust-tunnel/pkg/trust-tunnel-client/fips"
+	"trust-tunnel/pkg/trust-tunnel-client/protocol"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// maxRedirects is the maximum number of redirects to follow when reattaching a session.
+	maxRedirects = 3
+
+	pingWriteTimeout = 10 * time.Second
+
+	// closeSessionGracePeriod is the period to wait for the agent to close the session on timeout,
+	// the connection is closed by the client after it.
+	closeSessionGracePeriod = 5 * time.Second
 )
 
 // genTLSConfig generates a TLS configuration for the client.
 func (c *Client) genTLSConfig() (*tls.Config, error) {
-	pool := x509.NewCertPool()
+	if c.FIPS {
+		fips.Enable()
+	}
 
-	caCert, err := os.ReadFile(c.TLSCaCert)
-	if err != nil {
-		return nil, err
+	tlsConfig := &tls.Config{
+		// The host being dialed is verified by the websocket dialer if it's empty.
+		ServerName:         c.TLSServerName,
+		InsecureSkipVerify: c.TLSInsecureSkipVerify,
 	}
+	fips.Apply(tlsConfig)
 
-	pool.AppendCertsFromPEM(caCert)
+	// The system trust store is used if no CA is given.
+	if c.TLSCaCert != "" {
+		caCert, err := os.ReadFile(c.TLSCaCert)
+		if err != nil {
+			return nil, err
+		}
 
-	cert, err := tls.LoadX509KeyPair(c.TLSCert, c.TLSKey)
-	if err != nil {
-		return nil, err
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("no CA certificate found in %s", c.TLSCaCert)
+		}
+	}
+
+	if c.Credentials != nil {
+		tlsConfig.GetClientCertificate = c.Credentials.GetClientCertificate
+
+		return tlsConfig, nil
+	}
+
+	// Only the agent is authenticated if no client certificate is given.
+	if c.TLSCert != "" || c.TLSKey != "" {
+		if c.TLSCert == "" || c.TLSKey == "" {
+			return nil, fmt.Errorf("TLS certificate and key must be given together")
+		}
+
+		cert, err := tls.LoadX509KeyPair(c.TLSCert, c.TLSKey)
+		if err != nil {
+			return nil, err
+		}
+
+		if err = fips.CheckCertificate(&cert); err != nil {
+			return nil, err
+		}
+
+		tlsConfig.Certificates = []tls.Certificate{cert}
 	}
 
-	return &tls.Config{
-		RootCAs:      pool,
-		Certificates: []tls.Certificate{cert},
-		ServerName:   "trust-tunnel-agent",
-	}, nil
+	return tlsConfig, nil
+}
+
+// NTLSSupported returns whether the client is built with NTLS. TLS isn't supported by the builds with NTLS.
+func NTLSSupported() bool {
+	return ntlsSupported
+}
+
+// checkTransport refuses the options of the transport the build doesn't support, e.g. the NTLS options in the builds
+// without NTLS, instead of ignoring them.
+func (c *Client) checkTransport() error {
+	ntls := c.NtlsVerify || c.NTLSCaFile != "" || c.NTLSSignCertFile != "" || c.NTLSSignKeyFile != "" ||
+		c.NTLSEncCertFile != "" || c.NTLSEncKeyFile != "" || c.Cipher != ""
+
+	switch {
+	case c.DialTransport != nil:
+		// The transport is swapped, e.g. to browsers.
+	case ntls && !ntlsSupported:
+		return ErrNTLSUnsupported
+	case c.TLSVerify && ntlsSupported:
+		return fmt.Errorf("TLS isn't supported by the NTLS build of the client, connect with the NTLS options instead")
+	case (c.FIPS || fips.Enabled()) && (!c.TLSVerify || ntlsSupported):
+		return fmt.Errorf("TLS is required in the FIPS mode")
+	}
+
+	return nil
 }
 
 // start establishes a connection to the server and returns a session.
 func (c *Client) start(networkConnection *net.Conn) (Session, error) {
-	// Construct the server URL
+	if err := c.checkTransport(); err != nil {
+		return nil, err
+	}
+
+	if c.ConfirmCommand != nil && (c.Logs != nil || c.File != nil || c.Top || c.Verb != nil || c.copyRequest != nil ||
+		c.forwardRequest != nil || c.Observe) {
+		return nil, fmt.Errorf("only commands can be confirmed, not logs, file verbs, top, verbs, copies, port forwards or observers")
+	}
+
+	if c.Observe && c.SessionID == "" {
+		return nil, fmt.Errorf("no session ID to observe")
+	}
+
+	// Construct the server URL, IPv6 literals may be given with brackets.
+	c.AgentAddr = strings.TrimSuffix(strings.TrimPrefix(c.AgentAddr, "["), "]")
 	host := net.JoinHostPort(c.AgentAddr, strconv.Itoa(c.AgentPort))
-	urlPath := url.URL{Host: host, Path: "/exec"}
+	urlPath := url.URL{Host: host, Path: protocol.Path}
+	if c.forwardRequest != nil {
+		urlPath.Path = protocol.ForwardPath
+	}
+
+	// Dial the jump agent instead, which proxies the session to the agent.
+	if c.JumpAddr != "" {
+		urlPath.Host = c.JumpAddr
+		if _, _, err := net.SplitHostPort(c.JumpAddr); err != nil {
+			urlPath.Host = net.JoinHostPort(strings.TrimSuffix(strings.TrimPrefix(c.JumpAddr, "["), "]"), strconv.Itoa(c.AgentPort))
+		}
+	}
 
 	var tlsConfig *tls.Config
 
@@ -63,9 +162,12 @@ func (c *Client) start(networkConnection *net.Conn) (Session, error) {
 		// Use secure websockets if TLS verify is enabled.
 		urlPath.Scheme = "wss"
 
-		tlsConfig, err = c.genTLSConfig()
-		if err != nil {
-			return nil, err
+		// The TLS settings are left to the transport if it's swapped, e.g. to browsers.
+		if c.DialTransport == nil {
+			tlsConfig, err = c.genTLSConfig()
+			if err != nil {
+				return nil, err
+			}
 		}
 	} else {
 		// Use regular websockets if TLS verify is disabled.
@@ -73,12 +175,7 @@ func (c *Client) start(networkConnection *net.Conn) (Session, error) {
 	}
 
 	// Get the base64 encoded command.
-	var encodedCommand []string
-
-	for _, comm := range c.Command {
-		encodedData := base64.StdEncoding.EncodeToString([]byte(comm))
-		encodedCommand = append(encodedCommand, encodedData)
-	}
+	encodedCommand := protocol.EncodeCommand(c.Command)
 
 	// Construct the request headers.
 	header := http.Header{
@@ -96,6 +193,10 @@ func (c *Client) start(networkConnection *net.Conn) (Session, error) {
 		"Agent-Addr":            []string{c.AgentAddr},
 	}
 
+	if c.Shell != "" {
+		header["Shell"] = []string{c.Shell}
+	}
+
 	if c.DisableCleanMode {
 		header["Disable-Clean-Mode"] = []string{"1"}
 	}
@@ -113,14 +214,169 @@ func (c *Client) start(networkConnection *net.Conn) (Session, error) {
 		if len(c.ContainerID) > 0 {
 			header["Container-Id"] = []string{c.ContainerID}
 		}
+
+		if c.Tools {
+			header["Tools"] = []string{"1"}
+		}
+
+		if c.Logs != nil {
+			header[protocol.HeaderLogs] = []string{"1"}
+			header[protocol.HeaderLogsTail] = []string{strconv.Itoa(c.Logs.Tail)}
+
+			if c.Logs.Follow {
+				header[protocol.HeaderLogsFollow] = []string{"1"}
+			}
+		}
+	}
+
+	if c.File != nil {
+		header[protocol.HeaderFileVerb] = []string{c.File.Verb}
+		header[protocol.HeaderFilePath] = []string{c.File.Path}
+
+		if c.File.Lines > 0 {
+			header[protocol.HeaderFileLines] = []string{strconv.Itoa(c.File.Lines)}
+		}
+	}
+
+	if c.copyRequest != nil {
+		header[protocol.HeaderCopy] = []string{c.copyRequest.Direction}
+		header[protocol.HeaderCopyPath] = []string{c.copyRequest.Path}
+		header[protocol.HeaderProtocolVersion] = []string{strconv.Itoa(protocol.CopyVersion)}
+	}
+
+	if c.forwardRequest != nil {
+		header[protocol.HeaderForwardPort] = []string{strconv.Itoa(c.forwardRequest.Port)}
+		header[protocol.HeaderProtocolVersion] = []string{strconv.Itoa(protocol.ForwardVersion)}
+
+		if c.forwardRequest.Host != "" {
+			header[protocol.HeaderForwardHost] = []string{c.forwardRequest.Host}
+			header[protocol.HeaderProtocolVersion] = []string{strconv.Itoa(protocol.ForwardHostVersion)}
+		}
+
+		if c.forwardRequest.Reverse {
+			header[protocol.HeaderForwardReverse] = []string{"1"}
+			header[protocol.HeaderProtocolVersion] = []string{strconv.Itoa(protocol.ReverseForwardVersion)}
+		}
+	}
+
+	if c.Top {
+		header[protocol.HeaderTop] = []string{"1"}
+	}
+
+	if c.Verb != nil {
+		header[protocol.HeaderVerb] = []string{c.Verb.Name}
+		header[protocol.HeaderVerbArgs] = protocol.EncodeCommand(c.Verb.Args)
+	}
+
+	if c.Observe {
+		header[protocol.HeaderObserve] = []string{"1"}
+		header[protocol.HeaderProtocolVersion] = []string{strconv.Itoa(protocol.ObserveVersion)}
+	}
+
+	for key, value := range c.Tags {
+		header[protocol.HeaderTag] = append(header[protocol.HeaderTag], key+"="+value)
+	}
+
+	sort.Strings(header[protocol.HeaderTag])
+
+	for name, value := range c.Env {
+		header[protocol.HeaderEnv] = append(header[protocol.HeaderEnv], name+"="+value)
+	}
+
+	sort.Strings(header[protocol.HeaderEnv])
+
+	if c.AffinityToken != "" {
+		header["Affinity-Token"] = []string{c.AffinityToken}
+	}
+
+	if c.JumpAddr != "" {
+		header["Jump-Target"] = []string{host}
+	}
+
+	if c.MFAPrompt != nil {
+		header[protocol.HeaderMFA] = []string{"1"}
+	}
+
+	if c.FrameProfile != "" {
+		header[protocol.HeaderFrameProfile] = []string{c.FrameProfile}
+	}
+
+	if c.FrameSize > 0 {
+		header[protocol.HeaderFrameSize] = []string{strconv.Itoa(c.FrameSize)}
+	}
+
+	// Send the command too long for the headers in the command frame instead.
+	commandFrame := c.commandFrame(encodedCommand)
+	version := protocol.CommandFrameVersion
+
+	if c.ConfirmCommand != nil {
+		version = protocol.ConfirmVersion
+		header[protocol.HeaderConfirm] = []string{"1"}
+	}
+
+	if commandFrame != nil {
+		delete(header, "Command")
+		delete(header, "Command-Base64-Encode")
+		header[protocol.HeaderProtocolVersion] = []string{strconv.Itoa(version)}
+		header[protocol.HeaderCommandFrame] = []string{strconv.Itoa(len(commandFrame))}
+	}
+
+	for key, values := range c.ExtraHeaders {
+		key = http.CanonicalHeaderKey(key)
+		if _, ok := header[key]; !ok {
+			header[key] = values
+		}
 	}
 
 	// Dial the agent and establish a websocket connection.
-	conn, err := c.dialAgent(networkConnection, &urlPath, &header, tlsConfig)
+	conn, responseHeader, err := c.dial(networkConnection, &urlPath, &header, tlsConfig)
 	if err != nil {
+		if commandFrame != nil && errors.Is(err, websocket.ErrBadHandshake) {
+			err = fmt.Errorf("%v, the command of %d bytes is sent in the command frame, which requires protocol version %d of the agent",
+				err, len(commandFrame), version)
+		}
+
 		return nil, fmt.Errorf("connecting to agent by websocket error: %v", err)
 	}
 
+	mfa := responseHeader.Get(protocol.HeaderMFA) != ""
+
+	// The agents unable to ask for the confirmation would run the command at once, so it's sent only to the others.
+	if c.ConfirmCommand != nil {
+		if agentVersion, _ := strconv.Atoi(responseHeader.Get(protocol.HeaderProtocolVersion)); agentVersion < protocol.ConfirmVersion {
+			conn.Close()
+
+			return nil, fmt.Errorf("the agent can't confirm the command, which requires protocol version %d of the agent", protocol.ConfirmVersion)
+		}
+	}
+
+	// The agent replies the command frame once the session is authorized.
+	if commandFrame != nil {
+		if mfa, err = c.sendCommand(conn, commandFrame); err != nil {
+			conn.Close()
+
+			return nil, err
+		}
+	}
+
+	// The session is established only after the MFA challenge is answered.
+	if mfa {
+		if err = c.answerMFA(conn); err != nil {
+			conn.Close()
+
+			return nil, err
+		}
+	}
+
+	// The command is run only after the command resolved by the agent is confirmed.
+	if c.ConfirmCommand != nil {
+		if err = c.confirmCommand(conn); err != nil {
+			conn.Close()
+
+			return nil, err
+		}
+	}
+
 	// Create and return a new agent session.
 	agent := &agentConn{
 		conn:         conn,
@@ -128,12 +384,233 @@ func (c *Client) start(networkConnection *net.Conn) (Session, error) {
 		tty:          c.Tty,
 		stdoutBuffer: NewBlockingBuffer(),
 		stderrBuffer: NewBlockingBuffer(),
+		done:         make(chan struct{}),
 	}
 	go agent.ProcessMsg()
+	go agent.keepAlive(c.PingPeriod)
+	go agent.enforceTimeout(c.Timeout)
 
 	return agent, nil
 }
 
+// dial dials the agent, and follows the redirects to the agent instance holding the session.
+// The session ID and the affinity token issued by the agent are saved in the client.
+// It also returns the response headers of the agent, nil if the transport doesn't expose them.
+func (c *Client) dial(networkConnection *net.Conn, urlPath *url.URL, header *http.Header, tlsConfig *tls.Config) (Transport, http.Header, error) {
+	for i := 0; ; i++ {
+		conn, resp, err := c.dialTransport(networkConnection, urlPath, header, tlsConfig)
+		if err != nil && resp != nil && resp.StatusCode == http.StatusServiceUnavailable {
+			limitErr := newLimitError(resp, err)
+			if resp.Body != nil {
+				resp.Body.Close()
+			}
+
+			return nil, nil, limitErr
+		}
+
+		if resp != nil && resp.Body != nil {
+			resp.Body.Close()
+		}
+
+		if err == nil {
+			if resp == nil {
+				return conn, nil, nil
+			}
+
+			if sessionID := resp.Header.Get("Session-Id"); sessionID != "" {
+				c.SessionID = sessionID
+			}
+
+			if token := resp.Header.Get("Affinity-Token"); token != "" {
+				c.AffinityToken = token
+			}
+
+			return conn, resp.Header, nil
+		}
+
+		if resp == nil || (resp.StatusCode != http.StatusTemporaryRedirect && resp.StatusCode != http.StatusPermanentRedirect) {
+			return nil, nil, err
+		}
+
+		// The given connection is bound to the original agent, so the redirect can't be followed.
+		if networkConnection != nil || i >= maxRedirects {
+			return nil, nil, fmt.Errorf("%v: session is redirected to %s", err, resp.Header.Get("Location"))
+		}
+
+		location, err := url.Parse(resp.Header.Get("Location"))
+		if err != nil || location.Host == "" {
+			return nil, nil, fmt.Errorf("invalid redirect location %q", resp.Header.Get("Location"))
+		}
+
+		// The jump agent is kept, and the session is proxied to the new target.
+		if c.JumpAddr != "" {
+			header.Set("Jump-Target", location.Host)
+		} else {
+			urlPath.Host = location.Host
+		}
+
+		header.Set("Agent-Addr", location.Hostname())
+	}
+}
+
+// commandFrame returns the command frame if the command is too long for the headers, or nil.
+func (c *Client) commandFrame(encodedCommand []string) []byte {
+	threshold := c.CommandFrameThreshold
+	if threshold == 0 {
+		threshold = DefaultCommandFrameThreshold
+	}
+
+	if c.Logs != nil || c.File != nil || c.Top || c.Verb != nil || c.copyRequest != nil || c.forwardRequest != nil ||
+		c.Observe {
+		return nil
+	}
+
+	// The command to confirm is sent once the agent tells it can ask for the confirmation.
+	if c.ConfirmCommand != nil {
+		return protocol.EncodeCommandFrame(c.Command)
+	}
+
+	if threshold < 0 {
+		return nil
+	}
+
+	// The command is sent in both Command and Command-Base64-Encode.
+	length := 0
+	for i, arg := range c.Command {
+		length += len(arg) + len(encodedCommand[i])
+	}
+
+	if length <= threshold {
+		return nil
+	}
+
+	return protocol.EncodeCommandFrame(c.Command)
+}
+
+// sendCommand sends the command frame, and reads the reply of the agent with the session ID and the affinity token.
+// It also returns whether the agent challenges the client with MFA.
+func (c *Client) sendCommand(conn Transport, frame []byte) (bool, error) {
+	if err := conn.WriteMessage(websocket.TextMessage, frame); err != nil {
+		return false, fmt.Errorf("send command frame error: %v", err)
+	}
+
+	messageType, message, err := conn.ReadMessage()
+	if err != nil {
+		// The session is refused by the close frame after the command frame.
+		if closeErr, ok := err.(*websocket.CloseError); ok && closeErr.Text != "" {
+			return false, errors.New(closeErr.Text)
+		}
+
+		return false, fmt.Errorf("read command reply error: %v", err)
+	}
+
+	if messageType != websocket.TextMessage {
+		return false, fmt.Errorf("invalid command reply")
+	}
+
+	reply, err := protocol.DecodeCommandReply(message)
+	if err != nil {
+		return false, err
+	}
+
+	if reply.SessionID != "" {
+		c.SessionID = reply.SessionID
+	}
+
+	if reply.AffinityToken != "" {
+		c.AffinityToken = reply.AffinityToken
+	}
+
+	return reply.MFA != "", nil
+}
+
+// answerMFA reads the MFA challenge of the agent, and answers it with the assertion given by MFAPrompt.
+func (c *Client) answerMFA(conn Transport) error {
+	messageType, message, err := conn.ReadMessage()
+	if err != nil {
+		return fmt.Errorf("read MFA challenge error: %v", err)
+	}
+
+	if messageType != websocket.TextMessage || !strings.HasPrefix(string(message), protocol.MFAPrefix) {
+		return fmt.Errorf("invalid MFA challenge")
+	}
+
+	var challenge MFAChallenge
+	if err = json.Unmarshal(message[len(protocol.MFAPrefix):], &challenge); err != nil {
+		return fmt.Errorf("invalid MFA challenge: %v", err)
+	}
+
+	if c.MFAPrompt == nil {
+		return fmt.Errorf("MFA is required by the agent")
+	}
+
+	assertion, err := c.MFAPrompt(&challenge)
+	if err != nil {
+		return fmt.Errorf("answer MFA challenge error: %v", err)
+	}
+
+	return conn.WriteMessage(websocket.TextMessage, []byte(protocol.MFAPrefix+assertion))
+}
+
+// confirmCommand reads the command resolved by the agent, and answers whether it's confirmed by ConfirmCommand.
+func (c *Client) confirmCommand(conn Transport) error {
+	messageType, message, err := conn.ReadMessage()
+	if err != nil {
+		// The session may be refused before the command is resolved, e.g. the container isn't running.
+		if closeErr, ok := err.(*websocket.CloseError); ok && closeErr.Text != "" {
+			return errors.New(closeErr.Text)
+		}
+
+		return fmt.Errorf("read confirmation error: %v", err)
+	}
+
+	if messageType != websocket.TextMessage {
+		return fmt.Errorf("invalid confirmation")
+	}
+
+	confirmation, err := protocol.DecodeConfirmation(message)
+	if err != nil {
+		return err
+	}
+
+	// Nothing is run by reattaching the session.
+	if confirmation.Reattach {
+		return nil
+	}
+
+	confirmed, err := c.ConfirmCommand(confirmation)
+	if err != nil {
+		conn.WriteMessage(websocket.TextMessage, protocol.EncodeConfirmAnswer(false))
+
+		return fmt.Errorf("confirm command error: %v", err)
+	}
+
+	if err = conn.WriteMessage(websocket.TextMessage, protocol.EncodeConfirmAnswer(confirmed)); err != nil {
+		return fmt.Errorf("send confirmation answer error: %v", err)
+	}
+
+	if !confirmed {
+		return ErrCommandDeclined
+	}
+
+	return nil
+}
+
+// dialTransport dials the agent with DialTransport if it's given, or the websocket dialer of gorilla.
+func (c *Client) dialTransport(networkConnection *net.Conn, urlPath *url.URL, header *http.Header, tlsConfig *tls.Config) (Transport, *http.Response, error) {
+	if c.DialTransport != nil {
+		return c.DialTransport(urlPath.String(), header.Clone())
+	}
+
+	conn, resp, err := c.dialAgent(networkConnection, urlPath, header, tlsConfig)
+	if err != nil {
+		// Don't return a nil *websocket.Conn in the interface.
+		return nil, resp, err
+	}
+
+	return conn, resp, nil
+}
+
 // Start the client and try to communicate with agent on conn.
 // If conn is nil, a new connection will be established with given agent addr and port.
 // If conn it not nil, it will be used for communication with agent. It's the caller's
@@ -16,10 +16,22 @@ package client
 
 import (
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
+	"trust-tunnel/pkg/trust-tunnel-client/protocol"
 
 	"github.com/gorilla/websocket"
 )
@@ -134,7 +146,7 @@ func TestDialAgentWithMockServer(t *testing.T) {
 	// conn := &websocket.Conn{}
 
 	// Call function being tested.
-	wsConn, err := (&Client{}).dialAgent(nil, urlPath, header, tlsConfig)
+	wsConn, _, err := (&Client{}).dialAgent(nil, urlPath, header, tlsConfig)
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
@@ -144,3 +156,573 @@ func TestDialAgentWithMockServer(t *testing.T) {
 		t.Errorf("unexpected nil websocket connection")
 	}
 }
+
+func TestCommandTimeout(t *testing.T) {
+	closed := make(chan struct{})
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("failed to upgrade to websocket connection: %v", err)
+
+			return
+		}
+		defer conn.Close()
+
+		// The command never finishes, wait for the close session message.
+		for {
+			_, msg, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+
+			if string(msg) == "close session" {
+				close(closed)
+
+				return
+			}
+		}
+	}))
+	defer server.Close()
+
+	host, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+	portNum, _ := strconv.Atoi(port)
+
+	sess, err := (&Client{AgentAddr: host, AgentPort: portNum, Timeout: 100 * time.Millisecond}).Start(nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if _, err = sess.Read(make([]byte, 16)); err != ErrCommandTimeout {
+		t.Errorf("got error %v, want %v", err, ErrCommandTimeout)
+	}
+
+	select {
+	case <-closed:
+	default:
+		t.Errorf("close session message isn't sent")
+	}
+}
+
+func TestExtraHeadersAndDialerCustomizer(t *testing.T) {
+	headers := make(chan http.Header, 1)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers <- r.Header
+
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+
+		conn.Close()
+	}))
+	defer server.Close()
+
+	host, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+	portNum, _ := strconv.Atoi(port)
+
+	customized := false
+	c := &Client{
+		AgentAddr: host,
+		AgentPort: portNum,
+		UserName:  "alice",
+		ExtraHeaders: http.Header{
+			"x-trace-id": []string{"trace"},
+			"User-Name":  []string{"mallory"},
+		},
+		DialerCustomizer: func(dialer *websocket.Dialer) {
+			customized = true
+			dialer.HandshakeTimeout = time.Second
+		},
+	}
+
+	if _, err := c.Start(nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if !customized {
+		t.Error("dialer is not customized")
+	}
+
+	header := <-headers
+	if header.Get("X-Trace-Id") != "trace" {
+		t.Errorf("got trace ID %q, want %q", header.Get("X-Trace-Id"), "trace")
+	}
+
+	// The protocol headers can't be overridden.
+	if header.Get("User-Name") != "alice" {
+		t.Errorf("got user name %q, want %q", header.Get("User-Name"), "alice")
+	}
+}
+
+func TestHeadersInSpec(t *testing.T) {
+	headers := make(chan http.Header, 1)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers <- r.Header
+
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+
+		conn.Close()
+	}))
+	defer server.Close()
+
+	host, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+	portNum, _ := strconv.Atoi(port)
+
+	c := &Client{
+		SessionID: "session", AffinityToken: "token", AgentAddr: host, AgentPort: portNum, JumpAddr: host,
+		Type: TargetContainer, PodName: "pod", ContainerName: "container", ContainerID: "id", IPAddress: "ip",
+		Interactive: true, Tty: true, Command: []string{"sh"}, Shell: ShellAuto, Tools: true,
+		LoginName: "root", LoginGroup: "root", UserName: "alice", Cpus: 1, MemoryMB: 64, DisableCleanMode: true,
+		Tags: map[string]string{"incident": "INC-1234"}, Env: map[string]string{"TERM": "xterm-kitty"},
+	}
+
+	if _, err := c.Start(nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	spec, err := protocol.LoadSpec()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	specified := make(map[string]bool)
+	for _, h := range spec.RequestHeaders {
+		specified[h.Name] = true
+	}
+
+	// The client must not send headers unknown to the other implementations of the protocol.
+	for name := range <-headers {
+		if !specified[name] && name != "Connection" && name != "Upgrade" && !strings.HasPrefix(name, "Sec-Websocket-") &&
+			name != "User-Agent" {
+			t.Errorf("header %s is not in the protocol spec", name)
+		}
+	}
+}
+
+// scriptedTransport is a Transport replaying the messages of the agent, then the close frame.
+type scriptedTransport struct {
+	messages     [][2]interface{}
+	closeHandler func(code int, text string) error
+	closeText    string
+	written      chan []byte
+}
+
+func (st *scriptedTransport) ReadMessage() (int, []byte, error) {
+	if len(st.messages) == 0 {
+		st.closeHandler(websocket.CloseNormalClosure, st.closeText)
+
+		return 0, nil, &websocket.CloseError{Code: websocket.CloseNormalClosure, Text: st.closeText}
+	}
+
+	message := st.messages[0]
+	st.messages = st.messages[1:]
+
+	return message[0].(int), []byte(message[1].(string)), nil
+}
+
+func (st *scriptedTransport) WriteMessage(_ int, data []byte) error {
+	st.written <- data
+
+	return nil
+}
+
+func (st *scriptedTransport) WriteControl(int, []byte, time.Time) error {
+	return nil
+}
+
+func (st *scriptedTransport) SetCloseHandler(h func(code int, text string) error) {
+	st.closeHandler = h
+}
+
+func (st *scriptedTransport) Close() error {
+	return nil
+}
+
+func TestDialTransport(t *testing.T) {
+	transport := &scriptedTransport{
+		messages:  [][2]interface{}{{websocket.BinaryMessage, "out"}, {websocket.TextMessage, "err"}},
+		closeText: `{"Code":3,"Err":null,"Reason":"exited"}`,
+		written:   make(chan []byte, 1),
+	}
+
+	var dialedURL string
+
+	c := &Client{
+		AgentAddr:   "agent",
+		AgentPort:   5006,
+		Interactive: true,
+		Command:     []string{"ls"},
+		TLSVerify:   true,
+		TLSCaCert:   "/nonexistent",
+		DialTransport: func(url string, header http.Header) (Transport, *http.Response, error) {
+			dialedURL = url
+
+			return transport, nil, nil
+		},
+	}
+
+	session, err := c.Start(nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// The TLS settings are left to the transport.
+	if dialedURL != "wss://agent:5006/exec" {
+		t.Errorf("got URL %q", dialedURL)
+	}
+
+	if _, err = session.Write([]byte("in")); err != nil || string(<-transport.written) != "in" {
+		t.Errorf("unexpected write error: %v", err)
+	}
+
+	stdout, err := io.ReadAll(session)
+	if err != nil || string(stdout) != "out" {
+		t.Errorf("got stdout %q %v", stdout, err)
+	}
+
+	stderr := make([]byte, 8)
+
+	n, _ := session.ReadStderr(stderr)
+	if string(stderr[:n]) != "err" {
+		t.Errorf("got stderr %q", stderr[:n])
+	}
+
+	if reason := SessionTerminationReason(session); session.ExitCode() != 3 || reason != TerminationExited {
+		t.Errorf("got exit code %d reason %q", session.ExitCode(), reason)
+	}
+}
+
+func TestCommandFrame(t *testing.T) {
+	transport := &scriptedTransport{
+		messages: [][2]interface{}{
+			{websocket.TextMessage, string(protocol.EncodeCommandReply(&protocol.CommandReply{SessionID: "s2", AffinityToken: "t2"}))},
+			{websocket.BinaryMessage, "out"},
+		},
+		closeText: `{"Code":0,"Err":null,"Reason":"exited"}`,
+		written:   make(chan []byte, 1),
+	}
+
+	var dialedHeader http.Header
+
+	script := strings.Repeat("echo hello\n", 500)
+	c := &Client{
+		AgentAddr: "agent",
+		AgentPort: 5006,
+		Command:   []string{"sh", "-c", script},
+		DialTransport: func(_ string, header http.Header) (Transport, *http.Response, error) {
+			dialedHeader = header
+
+			return transport, nil, nil
+		},
+	}
+
+	session, err := c.Start(nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	frame := <-transport.written
+	if cmd, err := protocol.DecodeCommandFrame(frame); err != nil || !reflect.DeepEqual(cmd, c.Command) {
+		t.Errorf("got command frame %q %v", cmd, err)
+	}
+
+	if dialedHeader.Get(protocol.HeaderCommandFrame) != strconv.Itoa(len(frame)) ||
+		dialedHeader.Get(protocol.HeaderProtocolVersion) != "2" || dialedHeader.Get("Command-Base64-Encode") != "" {
+		t.Errorf("unexpected headers %v", dialedHeader)
+	}
+
+	if c.SessionID != "s2" || c.AffinityToken != "t2" {
+		t.Errorf("got session %s token %s", c.SessionID, c.AffinityToken)
+	}
+
+	if stdout, err := io.ReadAll(session); err != nil || string(stdout) != "out" {
+		t.Errorf("got stdout %q %v", stdout, err)
+	}
+
+	// The sessions refused after the command frame are told by the close frame.
+	transport = &scriptedTransport{
+		closeHandler: func(int, string) error { return nil },
+		closeText:    "Establish session error: authorization failed",
+		written:      make(chan []byte, 1),
+	}
+
+	if _, err = c.Start(nil); err == nil || err.Error() != transport.closeText {
+		t.Errorf("got error %v", err)
+	}
+}
+
+func TestConfirmCommand(t *testing.T) {
+	resolved := &Confirmation{Cmd: []string{"/bin/bash", "-c", "cd /root;rm -rf ./tmp"}, User: "root", Dir: "/root"}
+
+	tests := []struct {
+		name string
+		// agentVersion is the protocol version of the agent, the command isn't sent to the agents before 3.
+		agentVersion string
+		confirmed    bool
+		expectedErr  error
+	}{
+		{name: "confirmed", agentVersion: "3", confirmed: true},
+		{name: "declined", agentVersion: "3", expectedErr: ErrCommandDeclined},
+		{name: "old agent", agentVersion: "2"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			transport := &scriptedTransport{
+				messages: [][2]interface{}{
+					{websocket.TextMessage, string(protocol.EncodeCommandReply(&protocol.CommandReply{SessionID: "s3"}))},
+					{websocket.TextMessage, string(protocol.EncodeConfirmation(resolved))},
+					{websocket.BinaryMessage, "out"},
+				},
+				closeText: `{"Code":0,"Err":null,"Reason":"exited"}`,
+				written:   make(chan []byte, 2),
+			}
+
+			var (
+				dialedHeader http.Header
+				asked        *Confirmation
+			)
+
+			c := &Client{
+				AgentAddr:             "agent",
+				AgentPort:             5006,
+				Command:               []string{"rm", "-rf", "./tmp"},
+				CommandFrameThreshold: -1,
+				DialTransport: func(_ string, header http.Header) (Transport, *http.Response, error) {
+					dialedHeader = header
+
+					return transport, &http.Response{Header: http.Header{protocol.HeaderProtocolVersion: []string{test.agentVersion}}}, nil
+				},
+				ConfirmCommand: func(confirmation *Confirmation) (bool, error) {
+					asked = confirmation
+
+					return test.confirmed, nil
+				},
+			}
+
+			session, err := c.Start(nil)
+
+			if dialedHeader.Get(protocol.HeaderConfirm) != "1" || dialedHeader.Get(protocol.HeaderProtocolVersion) != "3" ||
+				dialedHeader.Get("Command-Base64-Encode") != "" {
+				t.Errorf("unexpected headers %v", dialedHeader)
+			}
+
+			if test.agentVersion != "3" {
+				if err == nil || len(transport.written) != 0 {
+					t.Errorf("the command is sent to the agent unable to confirm it: %v", err)
+				}
+
+				return
+			}
+
+			if !errors.Is(err, test.expectedErr) {
+				t.Fatalf("got error %v, expected %v", err, test.expectedErr)
+			}
+
+			if !reflect.DeepEqual(asked, resolved) {
+				t.Errorf("asked to confirm %+v, expected %+v", asked, resolved)
+			}
+
+			<-transport.written
+
+			if answer := <-transport.written; string(answer) != string(protocol.EncodeConfirmAnswer(test.confirmed)) {
+				t.Errorf("got answer %q", answer)
+			}
+
+			if test.confirmed {
+				if stdout, err := io.ReadAll(session); err != nil || string(stdout) != "out" {
+					t.Errorf("got stdout %q %v", stdout, err)
+				}
+			}
+		})
+	}
+}
+
+func TestReadErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		// closeFrame is the close frame sent by the agent, the connection is broken without it if empty.
+		closeFrame       []byte
+		expectedCode     int
+		expectedExitCode int
+	}{
+		{
+			name:             "exited",
+			closeFrame:       websocket.FormatCloseMessage(websocket.CloseNormalClosure, `{"Code":3,"Err":null,"Reason":"exited"}`),
+			expectedExitCode: 3,
+		},
+		{
+			name:             "remote error",
+			closeFrame:       websocket.FormatCloseMessage(websocket.CloseNormalClosure, `{"Code":0,"Err":"read output error","Reason":"runtime-failure"}`),
+			expectedCode:     websocket.CloseNormalClosure,
+			expectedExitCode: 0,
+		},
+		{
+			name:             "abnormal close",
+			closeFrame:       websocket.FormatCloseMessage(websocket.CloseInternalServerErr, "internal error"),
+			expectedCode:     websocket.CloseInternalServerErr,
+			expectedExitCode: -1,
+		},
+		{
+			name:             "broken connection",
+			expectedCode:     websocket.CloseAbnormalClosure,
+			expectedExitCode: -1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+
+				conn.WriteMessage(websocket.BinaryMessage, []byte("output"))
+
+				if tt.closeFrame != nil {
+					conn.WriteMessage(websocket.CloseMessage, tt.closeFrame)
+				}
+			}))
+			defer server.Close()
+
+			host, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+			portNum, _ := strconv.Atoi(port)
+
+			sess, err := (&Client{AgentAddr: host, AgentPort: portNum}).Start(nil)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			// The output is drained before the error.
+			output, err := io.ReadAll(sess)
+			if string(output) != "output" {
+				t.Errorf("got output %q, want %q", output, "output")
+			}
+
+			if tt.expectedCode == 0 {
+				if err != nil {
+					t.Errorf("got error %v, want EOF", err)
+				}
+			} else {
+				var closedErr *ConnectionClosedError
+				if !errors.As(err, &closedErr) || closedErr.Code != tt.expectedCode || closedErr.ExitCode != tt.expectedExitCode {
+					t.Errorf("got error %#v, want ConnectionClosedError with code %d and exit code %d", err, tt.expectedCode, tt.expectedExitCode)
+				}
+			}
+
+			if _, err := sess.ReadStderr(make([]byte, 16)); (err == io.EOF) != (tt.expectedCode == 0) {
+				t.Errorf("got stderr error %v", err)
+			}
+
+			if sess.ExitCode() != tt.expectedExitCode {
+				t.Errorf("got exit code %d, want %d", sess.ExitCode(), tt.expectedExitCode)
+			}
+		})
+	}
+}
+
+func TestNormalCloseMessageJSON(t *testing.T) {
+	data, err := json.Marshal(NormalCloseMessage{Code: 1, Err: errors.New("failed"), Reason: TerminationRuntimeFailure})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if string(data) != `{"Code":1,"Err":"failed","Reason":"runtime-failure"}` {
+		t.Errorf("unexpected JSON %s", data)
+	}
+
+	// Old agents marshal errors as empty objects.
+	for text, expectedErr := range map[string]string{
+		`{"Code":1,"Err":"failed"}`: "failed",
+		`{"Code":1,"Err":{}}`:       errUnknownRemote.Error(),
+		`{"Code":1,"Err":null}`:     "",
+	} {
+		var msg NormalCloseMessage
+		if err := json.Unmarshal([]byte(text), &msg); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if msg.Code != 1 || (msg.Err == nil) != (expectedErr == "") || (msg.Err != nil && msg.Err.Error() != expectedErr) {
+			t.Errorf("unexpected message %+v from %s", msg, text)
+		}
+	}
+}
+
+func TestTLSServerName(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+
+		conn.Close()
+	}))
+	defer server.Close()
+
+	urlPath := &url.URL{Scheme: "wss", Host: server.Listener.Addr().String(), Path: "/exec"}
+	pool := x509.NewCertPool()
+	pool.AddCert(server.Certificate())
+
+	// The certificate of the test server is issued for example.com and 127.0.0.1 being dialed.
+	for serverName, ok := range map[string]bool{"": true, "example.com": true, "trust-tunnel-agent": false} {
+		tlsConfig := &tls.Config{RootCAs: pool, ServerName: serverName}
+
+		if _, _, err := (&Client{}).dialAgent(nil, urlPath, &http.Header{}, tlsConfig); (err == nil) != ok {
+			t.Errorf("got error %v with server name %q", err, serverName)
+		}
+	}
+}
+
+func TestGenTLSConfig(t *testing.T) {
+	// The system trust store is used, and the client isn't authenticated by certificate.
+	tlsConfig, err := (&Client{TLSInsecureSkipVerify: true}).genTLSConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if tlsConfig.RootCAs != nil || len(tlsConfig.Certificates) != 0 || !tlsConfig.InsecureSkipVerify {
+		t.Errorf("unexpected TLS config %+v", tlsConfig)
+	}
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	os.WriteFile(caFile, []byte("not a certificate"), 0o600)
+
+	for _, c := range []*Client{
+		{TLSCaCert: caFile},
+		{TLSCert: caFile},
+		{TLSKey: caFile},
+	} {
+		if _, err := c.genTLSConfig(); err == nil {
+			t.Errorf("expected error with %+v", c)
+		}
+	}
+}
+
+func TestNTLSOptionsRefused(t *testing.T) {
+	if NTLSSupported() {
+		t.Skip("the client is built with NTLS")
+	}
+
+	c := &Client{AgentAddr: "127.0.0.1", AgentPort: 1, NTLSCaFile: "ca.pem"}
+	if _, err := c.Start(nil); !errors.Is(err, ErrNTLSUnsupported) {
+		t.Errorf("got error %v, want %v", err, ErrNTLSUnsupported)
+	}
+}
+
+func TestFIPSRequiresTLS(t *testing.T) {
+	if err := (&Client{FIPS: true}).checkTransport(); err == nil {
+		t.Error("plaintext should be refused in the FIPS mode")
+	}
+
+	if err := (&Client{FIPS: true, TLSVerify: true}).checkTransport(); err != nil && !NTLSSupported() {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
@@ -19,13 +19,16 @@ import (
 	"fmt"
 	"io"
 	"sync"
+	"sync/atomic"
+	"time"
+	"trust-tunnel/pkg/trust-tunnel-client/protocol"
 
 	"github.com/gorilla/websocket"
 )
 
 // agentConn represents a connection to an agent over a websocket.
 type agentConn struct {
-	conn        *websocket.Conn
+	conn        Transport
 	mu          sync.Mutex
 	interactive bool
 	tty         bool
@@ -34,8 +37,16 @@ type agentConn struct {
 	// Buffer to store standard error.
 	stderrBuffer *BlockingBuffer
 	err          error
+	// remoteErr is the error reported by the agent in the close message.
+	remoteErr error
 	// Exit code returned on connection close.
 	exitCode int
+	// done is closed when the connection is closed.
+	done chan struct{}
+	// timedOut is set when the session is closed because the command timed out.
+	timedOut atomic.Bool
+	// reason is the termination reason reported by the agent.
+	reason TerminationReason
 }
 
 // closeHandler handles the event of the websocket closing.
@@ -48,7 +59,7 @@ func (ac *agentConn) closeHandler(code int, text string) error {
 			if text != "" {
 				// Old CloseNormalClosure message can't be unmarshaled, so we return nil
 				// for keeping backward compatibility instead of an error.
-				ac.err = fmt.Errorf("%s", text)
+				ac.remoteErr = fmt.Errorf("%s", text)
 				ac.exitCode = -1
 			}
 
@@ -56,15 +67,42 @@ func (ac *agentConn) closeHandler(code int, text string) error {
 		}
 
 		ac.exitCode = closeMsg.Code
-		ac.err = closeMsg.Err
+		ac.remoteErr = closeMsg.Err
+		ac.reason = closeMsg.Reason
 	} else {
 		ac.exitCode = -1
-		ac.err = fmt.Errorf("%s", text)
+		ac.remoteErr = fmt.Errorf("%s", text)
 	}
 
 	return nil
 }
 
+// closedError returns the error of the reads once the connection is closed with err.
+func (ac *agentConn) closedError(err error) error {
+	if ac.timedOut.Load() {
+		return ErrCommandTimeout
+	}
+
+	closeErr, ok := err.(*websocket.CloseError)
+	if !ok || closeErr.Code == websocket.CloseAbnormalClosure {
+		// The connection is broken without a close frame.
+		ac.exitCode = -1
+
+		return &ConnectionClosedError{Code: websocket.CloseAbnormalClosure, ExitCode: -1, Err: err}
+	}
+
+	if closeErr.Code == websocket.CloseNormalClosure && ac.remoteErr == nil {
+		return io.EOF
+	}
+
+	cause := ac.remoteErr
+	if cause == nil {
+		cause = closeErr
+	}
+
+	return &ConnectionClosedError{Code: closeErr.Code, ExitCode: ac.exitCode, Err: cause}
+}
+
 // ProcessMsg processes incoming websocket messages and writes
 // them to the corresponding stdout or stderr buffers.
 func (ac *agentConn) ProcessMsg() {
@@ -73,9 +111,12 @@ func (ac *agentConn) ProcessMsg() {
 	for {
 		messageType, message, err := ac.conn.ReadMessage()
 		if err != nil {
-			ac.err = err
-			ac.stdoutBuffer.Close()
-			ac.stderrBuffer.Close()
+			ac.err = ac.closedError(err)
+
+			// The readers get the final error of the connection once the output is drained.
+			ac.stdoutBuffer.CloseWithError(ac.err)
+			ac.stderrBuffer.CloseWithError(ac.err)
+			close(ac.done)
 
 			return
 		}
@@ -89,24 +130,62 @@ func (ac *agentConn) ProcessMsg() {
 	}
 }
 
-// Read reads from the stdout buffer of the agent connection.
-func (ac *agentConn) Read(p []byte) (int, error) {
-	n, err := ac.stdoutBuffer.Read(p)
-	if err != io.EOF {
-		return n, err
+// keepAlive sends websocket pings periodically until the connection is closed,
+// so that the connection isn't considered idle by NATs even if there is no input or output.
+func (ac *agentConn) keepAlive(period time.Duration) {
+	if period <= 0 {
+		return
 	}
 
-	return 0, ac.err
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ac.done:
+			return
+		case <-ticker.C:
+			if err := ac.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(pingWriteTimeout)); err != nil {
+				return
+			}
+		}
+	}
 }
 
-// ReadStderr reads from the stderr buffer of the agent connection.
-func (ac *agentConn) ReadStderr(p []byte) (int, error) {
-	n, err := ac.stderrBuffer.Read(p)
-	if err != io.EOF {
-		return n, err
+// enforceTimeout closes the session if the command doesn't finish within the timeout,
+// and closes the connection if the agent doesn't close it in the grace period.
+func (ac *agentConn) enforceTimeout(timeout time.Duration) {
+	if timeout <= 0 {
+		return
 	}
 
-	return 0, ac.err
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-ac.done:
+		return
+	case <-timer.C:
+	}
+
+	ac.timedOut.Store(true)
+	ac.CloseSession()
+
+	select {
+	case <-ac.done:
+	case <-time.After(closeSessionGracePeriod):
+		ac.Close()
+	}
+}
+
+// Read reads from the stdout buffer of the agent connection.
+func (ac *agentConn) Read(p []byte) (int, error) {
+	return ac.stdoutBuffer.Read(p)
+}
+
+// ReadStderr reads from the stderr buffer of the agent connection.
+func (ac *agentConn) ReadStderr(p []byte) (int, error) {
+	return ac.stderrBuffer.Read(p)
 }
 
 // Write sends the provided bytes as a websocket message.
@@ -132,18 +211,18 @@ func (ac *agentConn) Close() error {
 
 // Resize sends a resize message over the websocket connection.
 func (ac *agentConn) Resize(height int, width int) error {
-	msg := fmt.Sprintf("resize: %d,%d", height, width)
+	msg := protocol.EncodeResize(height, width)
 
 	ac.mu.Lock()
 	defer ac.mu.Unlock()
-	ac.conn.WriteMessage(websocket.TextMessage, []byte(msg))
+	ac.conn.WriteMessage(websocket.TextMessage, msg)
 
 	return nil
 }
 
 // CloseSession sends a close session message over the websocket connection.
 func (ac *agentConn) CloseSession() error {
-	msg := "close session"
+	msg := protocol.CloseSession
 
 	ac.mu.Lock()
 	defer ac.mu.Unlock()
@@ -152,7 +231,25 @@ func (ac *agentConn) CloseSession() error {
 	return nil
 }
 
+// CloseStdin sends a close stdin message over the websocket connection.
+// Agents not supporting the message ignore it.
+func (ac *agentConn) CloseStdin() error {
+	if !ac.interactive {
+		return nil
+	}
+
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+
+	return ac.conn.WriteMessage(websocket.TextMessage, []byte(protocol.CloseStdin))
+}
+
 // ExitCode returns the exit code after the connection is closed.
 func (ac *agentConn) ExitCode() int {
 	return ac.exitCode
 }
+
+// TerminationReason returns the termination reason reported by the agent after the connection is closed.
+func (ac *agentConn) TerminationReason() TerminationReason {
+	return ac.reason
+}
@@ -0,0 +1,116 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package client
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+)
+
+// Copy copies the files to or from the target by the agent as a tar stream instead of running Command, like
+// kubectl cp. For CopyToTarget, the tar stream read from src is extracted into the directory req.Path of the target,
+// and for CopyFromTarget, the tar stream of the file or the directory req.Path is written to dst. The other one of
+// src and dst may be nil. It requires the agents serving the protocol version 4, and the error reported by the agent
+// is returned if the copy fails. conn is used as in Start.
+func (c *Client) Copy(conn *net.Conn, req *CopyRequest, src io.Reader, dst io.Writer) error {
+	switch {
+	case req.Direction == CopyToTarget && src == nil:
+		return fmt.Errorf("no tar stream to copy to the target")
+	case req.Direction == CopyFromTarget && dst == nil:
+		return fmt.Errorf("no writer of the tar stream copied from the target")
+	case req.Direction != CopyToTarget && req.Direction != CopyFromTarget:
+		return fmt.Errorf("invalid copy direction %q", req.Direction)
+	}
+
+	// The options of the command don't apply to the copy, which is run with a copy of the client.
+	copyClient := *c
+	copyClient.copyRequest = req
+	copyClient.Command = nil
+	copyClient.Shell = ""
+	copyClient.Interactive = req.Direction == CopyToTarget
+	copyClient.Tty = false
+
+	session, err := copyClient.start(conn)
+
+	c.SessionID, c.AffinityToken = copyClient.SessionID, copyClient.AffinityToken
+
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	// The errors of the agent are gathered to be returned.
+	var stderr bytes.Buffer
+
+	stderrDone := make(chan struct{})
+
+	go func() {
+		io.Copy(&stderr, stderrReader{session})
+		close(stderrDone)
+	}()
+
+	inputErr := make(chan error, 1)
+
+	if req.Direction == CopyToTarget {
+		go func() {
+			_, err := io.Copy(session, src)
+			if err != nil {
+				session.CloseSession()
+			} else {
+				err = CloseStdin(session)
+			}
+
+			inputErr <- err
+		}()
+	}
+
+	if dst == nil {
+		dst = io.Discard
+	}
+
+	_, err = io.Copy(dst, session)
+
+	<-stderrDone
+
+	// The session is closed by the client if the tar stream fails to be read.
+	select {
+	case inErr := <-inputErr:
+		if inErr != nil {
+			return fmt.Errorf("read the tar stream to copy error: %v", inErr)
+		}
+	default:
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if exitCode := session.ExitCode(); exitCode != 0 {
+		return fmt.Errorf("copy failed with exit code %d: %s", exitCode, strings.TrimSpace(stderr.String()))
+	}
+
+	return nil
+}
+
+// stderrReader reads the error output of the session.
+type stderrReader struct {
+	session Session
+}
+
+func (r stderrReader) Read(p []byte) (int, error) {
+	return r.session.ReadStderr(p)
+}
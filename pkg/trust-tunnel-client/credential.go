@@ -0,0 +1,74 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"crypto/tls"
+	"fmt"
+)
+
+// CredentialProvider provides the client certificate for TLS, so that the private key may live in a hardware
+// token (PKCS#11, TPM) or the OS keychain instead of a PEM file on disk. Such providers return certificates
+// whose PrivateKey is a crypto.Signer backed by the token or the keychain.
+type CredentialProvider interface {
+	// GetClientCertificate returns the client certificate when the agent requests it during the handshake.
+	GetClientCertificate(info *tls.CertificateRequestInfo) (*tls.Certificate, error)
+}
+
+// credentialProviderFactories stores the credential provider factory functions by their names.
+var credentialProviderFactories = map[string]func(params map[string]string) (CredentialProvider, error){
+	"file":   newFileCredentialProvider,
+	"enroll": newEnrollCredentialProvider,
+	"pkcs11": newPKCS11CredentialProvider,
+}
+
+// RegisterCredentialProvider registers a factory function for a credential provider.
+// If the credential provider name is already registered, it panics.
+func RegisterCredentialProvider(name string, factoryFunc func(params map[string]string) (CredentialProvider, error)) {
+	if _, exists := credentialProviderFactories[name]; exists {
+		panic("credential provider already registered")
+	}
+
+	credentialProviderFactories[name] = factoryFunc
+}
+
+// CreateCredentialProvider creates a credential provider by its name with the parameters.
+func CreateCredentialProvider(name string, params map[string]string) (CredentialProvider, error) {
+	factoryFunc, exists := credentialProviderFactories[name]
+	if !exists {
+		return nil, fmt.Errorf("credential provider not found: %s", name)
+	}
+
+	return factoryFunc(params)
+}
+
+// fileCredentialProvider provides the client certificate loaded from PEM files.
+type fileCredentialProvider struct {
+	cert tls.Certificate
+}
+
+// newFileCredentialProvider creates a credential provider loading the PEM files given by the "cert" and "key" params.
+func newFileCredentialProvider(params map[string]string) (CredentialProvider, error) {
+	cert, err := tls.LoadX509KeyPair(params["cert"], params["key"])
+	if err != nil {
+		return nil, fmt.Errorf("load client certificate error: %v", err)
+	}
+
+	return &fileCredentialProvider{cert: cert}, nil
+}
+
+func (p *fileCredentialProvider) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return &p.cert, nil
+}
@@ -0,0 +1,101 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeKeyPair writes a self-signed certificate and its key to PEM files in dir.
+func writeKeyPair(t *testing.T, dir string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key error: %v", err)
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{SerialNumber: big.NewInt(1)}, &x509.Certificate{SerialNumber: big.NewInt(1)}, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("create certificate error: %v", err)
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("marshal key error: %v", err)
+	}
+
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0o600)
+
+	return certFile, keyFile
+}
+
+type staticCredentialProvider struct {
+	cert *tls.Certificate
+}
+
+func (p *staticCredentialProvider) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return p.cert, nil
+}
+
+func TestCredentialProvider(t *testing.T) {
+	certFile, keyFile := writeKeyPair(t, t.TempDir())
+
+	provider, err := CreateCredentialProvider("file", map[string]string{"cert": certFile, "key": keyFile})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if cert, err := provider.GetClientCertificate(nil); err != nil || len(cert.Certificate) != 1 {
+		t.Errorf("got certificate %v and error %v", cert, err)
+	}
+
+	if _, err := CreateCredentialProvider("file", map[string]string{"cert": certFile}); err == nil {
+		t.Error("expected error without key")
+	}
+
+	if _, err := CreateCredentialProvider("unknown", nil); err == nil {
+		t.Error("expected error of unknown provider")
+	}
+
+	// Custom providers are registered by name, and take precedence over the certificate files.
+	expected := &tls.Certificate{}
+	RegisterCredentialProvider("static", func(map[string]string) (CredentialProvider, error) {
+		return &staticCredentialProvider{cert: expected}, nil
+	})
+
+	provider, err = CreateCredentialProvider("static", nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	tlsConfig, err := (&Client{Credentials: provider, TLSCert: "missing.pem", TLSKey: "missing.pem"}).genTLSConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if cert, _ := tlsConfig.GetClientCertificate(nil); cert != expected || len(tlsConfig.Certificates) != 0 {
+		t.Errorf("unexpected TLS config %+v", tlsConfig)
+	}
+}
@@ -0,0 +1,26 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package client is the Go SDK of the trust-tunnel agents, establishing the sessions, the copies and the port
+// forwards over the wire protocol of the protocol package.
+//
+// The SDK is the module trust-tunnel/pkg/trust-tunnel-client of its own, depending on the WebSocket library only
+// (and Tongsuo with the ntls build tag), so that embedding it doesn't pull in the container runtimes of the agent.
+// It's versioned by Semantic Versioning with the tags pkg/trust-tunnel-client/vX.Y.Z: the exported API of the
+// client, protocol, fips and forward packages is kept compatible within a major version, and the agents keep
+// serving the clients of older protocol versions, so the SDK may be upgraded independently of the agents.
+package client
+
+// Version is the semantic version of the SDK.
+const Version = "v1.0.0"
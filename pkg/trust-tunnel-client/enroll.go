@@ -0,0 +1,180 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const enrollTimeout = 30 * time.Second
+
+// enrollCredentialProvider obtains short-lived client certificates from the enrollment server of the agents,
+// and renews them once half of their lifetime has passed. The private key is kept in memory only.
+type enrollCredentialProvider struct {
+	url       string
+	token     string
+	tokenFile string
+	cli       *http.Client
+
+	// now returns the current time, it's replaced in tests.
+	now func() time.Time
+
+	lock sync.Mutex
+	cert *tls.Certificate
+	// renewAt is the time to renew the certificate.
+	renewAt time.Time
+}
+
+// newEnrollCredentialProvider creates an enrollment credential provider with the params:
+// "url" of the enrollment server, e.g. https://10.0.0.1:5007, the SSO "token" or the "token_file"
+// which is read on every enrollment so that it can be refreshed, and the optional "ca" verifying
+// the enrollment server, the system trust store is used if it's empty.
+func newEnrollCredentialProvider(params map[string]string) (CredentialProvider, error) {
+	if params["url"] == "" {
+		return nil, fmt.Errorf("url of the enrollment server is required")
+	}
+
+	if params["token"] == "" && params["token_file"] == "" {
+		return nil, fmt.Errorf("token or token_file is required for enrollment")
+	}
+
+	tlsConfig := &tls.Config{}
+
+	if params["ca"] != "" {
+		caCert, err := os.ReadFile(params["ca"])
+		if err != nil {
+			return nil, err
+		}
+
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("no CA certificate found in %s", params["ca"])
+		}
+	}
+
+	return &enrollCredentialProvider{
+		url:       strings.TrimSuffix(params["url"], "/") + "/enroll",
+		token:     params["token"],
+		tokenFile: params["token_file"],
+		cli: &http.Client{
+			Timeout:   enrollTimeout,
+			Transport: &http.Transport{TLSClientConfig: tlsConfig},
+		},
+		now: time.Now,
+	}, nil
+}
+
+// GetClientCertificate returns the enrolled certificate, a new one is enrolled if it's due for renewal.
+// The current certificate is kept if the renewal fails before it expires.
+func (p *enrollCredentialProvider) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	now := p.now()
+	if p.cert != nil && now.Before(p.renewAt) {
+		return p.cert, nil
+	}
+
+	cert, err := p.enroll()
+	if err != nil {
+		if p.cert != nil && now.Before(p.cert.Leaf.NotAfter) {
+			return p.cert, nil
+		}
+
+		return nil, err
+	}
+
+	p.cert = cert
+	p.renewAt = cert.Leaf.NotBefore.Add(cert.Leaf.NotAfter.Sub(cert.Leaf.NotBefore) / 2)
+
+	return cert, nil
+}
+
+// enroll generates a new key and gets it certified by the enrollment server.
+func (p *enrollCredentialProvider) enroll() (*tls.Certificate, error) {
+	token := p.token
+
+	if p.tokenFile != "" {
+		data, err := os.ReadFile(p.tokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("read token file error: %v", err)
+		}
+
+		token = strings.TrimSpace(string(data))
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	// The subject is set to the identity of the token by the enrollment server.
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{}, key)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, p.url, bytes.NewReader(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csr})))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/pkcs10")
+
+	resp, err := p.cli.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("enroll certificate error: %v", err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("read enrolled certificate error: %v", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("enroll certificate error: %s: %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("no certificate found in enrollment response")
+	}
+
+	leaf, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("parse enrolled certificate error: %v", err)
+	}
+
+	return &tls.Certificate{
+		Certificate: [][]byte{block.Bytes},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}, nil
+}
@@ -0,0 +1,146 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newEnrollServer starts a fake enrollment server issuing certificates valid for ttl to the token "good",
+// and returns the CA file verifying it and the counter of the issued certificates.
+func newEnrollServer(t *testing.T, ttl time.Duration) (*httptest.Server, string, *int) {
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ca := &x509.Certificate{SerialNumber: big.NewInt(1), IsCA: true, BasicConstraintsValid: true, KeyUsage: x509.KeyUsageCertSign}
+	issued := 0
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/enroll" || r.Header.Get("Authorization") != "Bearer good" {
+			http.Error(w, "invalid token", http.StatusUnauthorized)
+
+			return
+		}
+
+		data, _ := io.ReadAll(r.Body)
+		block, _ := pem.Decode(data)
+
+		csr, err := x509.ParseCertificateRequest(block.Bytes)
+		if err != nil || csr.CheckSignature() != nil {
+			http.Error(w, "invalid request", http.StatusBadRequest)
+
+			return
+		}
+
+		issued++
+		now := time.Now()
+		der, _ := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+			SerialNumber: big.NewInt(int64(issued + 1)),
+			NotBefore:    now,
+			NotAfter:     now.Add(ttl),
+		}, ca, csr.PublicKey, caKey)
+		pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: der})
+	}))
+	t.Cleanup(server.Close)
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0o600)
+
+	return server, caFile, &issued
+}
+
+func TestEnrollCredentialProvider(t *testing.T) {
+	server, caFile, issued := newEnrollServer(t, time.Hour)
+
+	provider, err := CreateCredentialProvider("enroll", map[string]string{"url": server.URL, "token": "good", "ca": caFile})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	p := provider.(*enrollCredentialProvider)
+	now := time.Now()
+	p.now = func() time.Time { return now }
+
+	cert, err := p.GetClientCertificate(nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if _, ok := cert.PrivateKey.(*ecdsa.PrivateKey); !ok || cert.Leaf == nil {
+		t.Fatalf("unexpected certificate %+v", cert)
+	}
+
+	// The certificate is reused until half of its lifetime has passed.
+	if renewed, _ := p.GetClientCertificate(nil); renewed != cert || *issued != 1 {
+		t.Errorf("certificate is renewed too early")
+	}
+
+	now = now.Add(31 * time.Minute)
+	if renewed, _ := p.GetClientCertificate(nil); renewed == cert || *issued != 2 {
+		t.Errorf("certificate is not renewed")
+	}
+
+	// The current certificate is kept if the renewal fails before it expires.
+	cert, _ = p.GetClientCertificate(nil)
+	p.token = "expired"
+	now = now.Add(10 * time.Minute)
+
+	if renewed, err := p.GetClientCertificate(nil); err != nil || renewed != cert {
+		t.Errorf("got certificate %v and error %v, want the current certificate", renewed, err)
+	}
+
+	now = now.Add(time.Hour)
+	if _, err := p.GetClientCertificate(nil); err == nil {
+		t.Error("expected error after the certificate expires")
+	}
+}
+
+func TestEnrollCredentialProviderTokenFile(t *testing.T) {
+	server, caFile, _ := newEnrollServer(t, time.Hour)
+	tokenFile := filepath.Join(t.TempDir(), "token")
+
+	provider, err := CreateCredentialProvider("enroll", map[string]string{"url": server.URL + "/", "token_file": tokenFile, "ca": caFile})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// The token file is read on enrollment, so that it can be refreshed by the SSO tools.
+	os.WriteFile(tokenFile, []byte("bad\n"), 0o600)
+
+	if _, err := provider.GetClientCertificate(nil); err == nil {
+		t.Error("expected error with invalid token")
+	}
+
+	os.WriteFile(tokenFile, []byte("good\n"), 0o600)
+
+	if _, err := provider.GetClientCertificate(&tls.CertificateRequestInfo{}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if _, err := CreateCredentialProvider("enroll", map[string]string{"url": server.URL}); err == nil {
+		t.Error("expected error without token")
+	}
+}
@@ -0,0 +1,147 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package fips restricts the TLS settings and the certificates to the FIPS-approved algorithms, required by some
+// regulated deployments. The builds with the boringcrypto experiment (GOEXPERIMENT=boringcrypto) use the validated
+// module and are always in the FIPS mode, the other builds restrict the Go crypto at runtime once it's enabled.
+package fips
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"sync/atomic"
+)
+
+const (
+	// ModeBoringCrypto is the mode of the boringcrypto builds.
+	ModeBoringCrypto = "boringcrypto"
+	// ModeRestricted is the mode of the other builds with the FIPS mode enabled.
+	ModeRestricted = "restricted"
+)
+
+// minRSABits is the minimum size of the approved RSA keys.
+const minRSABits = 2048
+
+// CipherSuites are the approved cipher suites of TLS 1.2.
+var CipherSuites = []uint16{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+}
+
+// Curves are the approved curves of the key exchanges.
+var Curves = []tls.CurveID{tls.CurveP256, tls.CurveP384}
+
+// signatureAlgorithms are the approved signature algorithms of the certificates, i.e. with SHA-2 hashes.
+var signatureAlgorithms = map[x509.SignatureAlgorithm]bool{
+	x509.SHA256WithRSA:    true,
+	x509.SHA384WithRSA:    true,
+	x509.SHA512WithRSA:    true,
+	x509.SHA256WithRSAPSS: true,
+	x509.SHA384WithRSAPSS: true,
+	x509.SHA512WithRSAPSS: true,
+	x509.ECDSAWithSHA256:  true,
+	x509.ECDSAWithSHA384:  true,
+	x509.ECDSAWithSHA512:  true,
+}
+
+var enabled atomic.Bool
+
+// Enable turns the FIPS mode on for the process.
+func Enable() {
+	enabled.Store(true)
+}
+
+// Enabled returns whether the FIPS mode is on.
+func Enabled() bool {
+	return boringCrypto || enabled.Load()
+}
+
+// Mode returns ModeBoringCrypto or ModeRestricted if the FIPS mode is on, or "" otherwise.
+func Mode() string {
+	switch {
+	case boringCrypto:
+		return ModeBoringCrypto
+	case enabled.Load():
+		return ModeRestricted
+	default:
+		return ""
+	}
+}
+
+// Apply restricts the TLS config to the approved versions, cipher suites and curves if the FIPS mode is on.
+func Apply(c *tls.Config) {
+	if !Enabled() {
+		return
+	}
+
+	c.MinVersion = tls.VersionTLS12
+	c.CipherSuites = CipherSuites
+	c.CurvePreferences = Curves
+
+	// The cipher suites of TLS 1.3 can't be restricted without boringcrypto, ChaCha20-Poly1305 could be negotiated.
+	if !boringCrypto {
+		c.MaxVersion = tls.VersionTLS12
+	}
+}
+
+// CheckCertificate returns an error if the FIPS mode is on and the certificate chain isn't signed or keyed with
+// the approved algorithms, e.g. by SHA-1 or with Ed25519 or RSA keys shorter than 2048 bits.
+func CheckCertificate(cert *tls.Certificate) error {
+	if !Enabled() {
+		return nil
+	}
+
+	for _, der := range cert.Certificate {
+		c, err := x509.ParseCertificate(der)
+		if err != nil {
+			return err
+		}
+
+		if err = checkKey(c.PublicKey); err != nil {
+			return fmt.Errorf("certificate %q: %v", c.Subject.CommonName, err)
+		}
+
+		if !signatureAlgorithms[c.SignatureAlgorithm] {
+			return fmt.Errorf("certificate %q: signature algorithm %v isn't FIPS-approved", c.Subject.CommonName, c.SignatureAlgorithm)
+		}
+	}
+
+	return nil
+}
+
+// checkKey returns an error if the public key isn't an approved type or size.
+func checkKey(key any) error {
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if k.N.BitLen() < minRSABits {
+			return fmt.Errorf("RSA key of %d bits isn't FIPS-approved, %d bits at least", k.N.BitLen(), minRSABits)
+		}
+	case *ecdsa.PublicKey:
+		switch k.Curve {
+		case elliptic.P256(), elliptic.P384(), elliptic.P521():
+		default:
+			return fmt.Errorf("ECDSA curve %s isn't FIPS-approved", k.Curve.Params().Name)
+		}
+	default:
+		return fmt.Errorf("key type %T isn't FIPS-approved", key)
+	}
+
+	return nil
+}
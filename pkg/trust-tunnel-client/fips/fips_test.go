@@ -0,0 +1,86 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fips
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+)
+
+// selfSigned returns a self-signed certificate of the key.
+func selfSigned(t *testing.T, key crypto.Signer) *tls.Certificate {
+	t.Helper()
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "trust-tunnel-agent"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestFIPS(t *testing.T) {
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 1024)
+
+	approved, ed, short := selfSigned(t, ecKey), selfSigned(t, edKey), selfSigned(t, rsaKey)
+
+	if !boringCrypto {
+		if err := CheckCertificate(ed); err != nil || Mode() != "" {
+			t.Fatalf("the certificates are checked with the FIPS mode off: %v", err)
+		}
+	}
+
+	Enable()
+
+	if Mode() == "" {
+		t.Fatal("the FIPS mode isn't on")
+	}
+
+	if err := CheckCertificate(approved); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	for _, cert := range []*tls.Certificate{ed, short} {
+		if err := CheckCertificate(cert); err == nil {
+			t.Error("the certificate should be refused")
+		}
+	}
+
+	c := &tls.Config{}
+	Apply(c)
+
+	if c.MinVersion != tls.VersionTLS12 || len(c.CipherSuites) != len(CipherSuites) || len(c.CurvePreferences) != len(Curves) {
+		t.Errorf("unexpected TLS config %+v", c)
+	}
+}
@@ -0,0 +1,181 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package client
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"trust-tunnel/pkg/trust-tunnel-client/forward"
+)
+
+// Forward forwards the connections accepted by the listener to req.Port on the loopback of the target's network
+// namespace, or of req.Host reached from it, by the agent instead of running Command, like kubectl port-forward.
+// The connections share the session, which ends once the listener is closed and the connections forwarded are
+// closed, or once the agent ends it, which closes the listener. refused receives the errors of the connections
+// refused by the agent if it's not nil. It requires the agents serving the protocol version 5, or 7 with req.Host.
+// conn is used as in Start.
+func (c *Client) Forward(conn *net.Conn, req *ForwardRequest, listener net.Listener, refused func(err error)) error {
+	if req.Port < 1 || req.Port > 65535 {
+		return fmt.Errorf("invalid port %d to forward to", req.Port)
+	}
+
+	if req.Reverse {
+		return fmt.Errorf("reverse forwards are run by ReverseForward")
+	}
+
+	session, stderr, err := c.startForward(conn, req)
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	mux := forward.NewClient(session, session, refused)
+
+	serveErr := make(chan error, 1)
+
+	go func() {
+		serveErr <- mux.Serve()
+	}()
+
+	acceptErr := make(chan error, 1)
+
+	go func() {
+		for {
+			local, err := listener.Accept()
+			if err != nil {
+				acceptErr <- err
+
+				return
+			}
+
+			if err = mux.Open(local); err != nil {
+				acceptErr <- err
+
+				return
+			}
+		}
+	}()
+
+	select {
+	case err = <-serveErr:
+		listener.Close()
+	case <-acceptErr:
+		err = drainForward(session, mux, serveErr)
+	}
+
+	return endForward(session, stderr, err)
+}
+
+// ReverseForward forwards the connections to req.Port on the loopback of the target's network namespace, where the
+// agent listens, to the connections made by dial on the client, like ssh -R, e.g. for a process in the target to
+// reach a debugger on the client. The connections share the session, which ends once done is closed and the
+// connections forwarded are closed, or once the agent ends it. It requires the agents serving the protocol version 8
+// and allowing the reverse forwards. conn is used as in Start.
+func (c *Client) ReverseForward(conn *net.Conn, req *ForwardRequest, dial func() (net.Conn, error), done <-chan struct{}) error {
+	if req.Port < 1 || req.Port > 65535 {
+		return fmt.Errorf("invalid port %d to forward from", req.Port)
+	}
+
+	if req.Host != "" {
+		return fmt.Errorf("reverse forwards listen on the loopback of the target, not %s", req.Host)
+	}
+
+	reverse := *req
+	reverse.Reverse = true
+
+	session, stderr, err := c.startForward(conn, &reverse)
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	mux := forward.NewReverseClient(session, session, dial)
+
+	serveErr := make(chan error, 1)
+
+	go func() {
+		serveErr <- mux.Serve()
+	}()
+
+	select {
+	case err = <-serveErr:
+	case <-done:
+		err = drainForward(session, mux, serveErr)
+	}
+
+	return endForward(session, stderr, err)
+}
+
+// startForward starts the session of the forward, whose error output is gathered in the background.
+func (c *Client) startForward(conn *net.Conn, req *ForwardRequest) (Session, *forwardStderr, error) {
+	// The options of the command don't apply to the port forward, which is run with a copy of the client.
+	forwardClient := *c
+	forwardClient.forwardRequest = req
+	forwardClient.Command = nil
+	forwardClient.Shell = ""
+	forwardClient.Interactive = true
+	forwardClient.Tty = false
+
+	session, err := forwardClient.start(conn)
+
+	c.SessionID, c.AffinityToken = forwardClient.SessionID, forwardClient.AffinityToken
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	stderr := &forwardStderr{done: make(chan struct{})}
+
+	go func() {
+		io.Copy(&stderr.buf, stderrReader{session})
+		close(stderr.done)
+	}()
+
+	return session, stderr, nil
+}
+
+// forwardStderr is the error output of the agent gathered to be returned.
+type forwardStderr struct {
+	buf  bytes.Buffer
+	done chan struct{}
+}
+
+// drainForward waits for the connections forwarded to be closed, then ends the session and waits for the mux.
+// The agent ends the session once the input is closed.
+func drainForward(session Session, mux *forward.Mux, serveErr <-chan error) error {
+	go func() {
+		mux.Drain()
+		CloseStdin(session)
+	}()
+
+	return <-serveErr
+}
+
+// endForward returns the error of the forward, the one of the mux or the one told by the agent.
+func endForward(session Session, stderr *forwardStderr, err error) error {
+	<-stderr.done
+
+	if err != nil {
+		return err
+	}
+
+	if exitCode := session.ExitCode(); exitCode != 0 {
+		return fmt.Errorf("port forward failed with exit code %d: %s", exitCode, strings.TrimSpace(stderr.buf.String()))
+	}
+
+	return nil
+}
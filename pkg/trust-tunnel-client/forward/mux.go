@@ -0,0 +1,445 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// Package forward multiplexes the TCP connections forwarded over a session as the streams of the forward frames,
+// see protocol.ForwardPath. The client opens a stream for each connection it accepts, and the agent dials the port
+// of the target for each stream opened. The roles are swapped for the reverse forwards: the agent opens a stream for
+// each connection accepted in the target, and the client dials its local port.
+package forward
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"trust-tunnel/pkg/trust-tunnel-client/protocol"
+)
+
+// ErrTooManyStreams is returned by Open if the streams open reach the limit, the connection is refused then.
+var ErrTooManyStreams = errors.New("too many streams")
+
+// Stats is the streams forwarded by a mux.
+type Stats struct {
+	// Streams is the number of the streams opened, and Refused is the number of them refused or failed to connect.
+	Streams int `json:"streams"`
+	Refused int `json:"refused"`
+
+	// BytesIn is the data sent by the client, and BytesOut is the data sent by the agent.
+	BytesIn  int64 `json:"bytes_in"`
+	BytesOut int64 `json:"bytes_out"`
+}
+
+// stream is a connection forwarded.
+type stream struct {
+	id   uint32
+	conn net.Conn
+
+	// sent and received are whether the close frame is sent and received, the stream is removed once both are.
+	sent, received bool
+
+	// removed is whether the stream is removed, the errors of its connection are expected then.
+	removed bool
+}
+
+// Mux forwards the connections as the streams of the forward frames read from r and written to w.
+// The writes are serialized, while the data of the streams is written to their connections in the order read,
+// so a connection not reading its data blocks the others, as the window of a single TCP connection does.
+type Mux struct {
+	r io.Reader
+	w io.Writer
+
+	// agent is whether the mux is the one of the agent.
+	agent bool
+
+	// dial connects to the port for the streams opened by the peer, it's nil for the side opening the streams.
+	dial       func() (net.Conn, error)
+	maxStreams int
+
+	// reset receives the errors of the streams reset by the peer.
+	reset func(err error)
+
+	wlock sync.Mutex
+	werr  error
+
+	lock    sync.Mutex
+	streams map[uint32]*stream
+	nextID  uint32
+	stats   Stats
+
+	// removed is signaled once a stream is removed or the mux is closed, for Drain.
+	removed *sync.Cond
+
+	// draining is whether the new streams are refused, and done is whether the mux is closed.
+	draining, done bool
+}
+
+// NewAgent returns the mux of the agent, dialing the port for each stream opened, up to maxStreams of them at
+// once if it's positive.
+func NewAgent(r io.Reader, w io.Writer, dial func() (net.Conn, error), maxStreams int) *Mux {
+	return newMux(r, w, true, dial, maxStreams, nil)
+}
+
+// NewClient returns the mux of the client, reset receives the errors of the streams reset by the agent.
+func NewClient(r io.Reader, w io.Writer, reset func(err error)) *Mux {
+	return newMux(r, w, false, nil, 0, reset)
+}
+
+// NewReverseAgent returns the mux of the agent for the reverse forwards, opening the streams of the connections
+// accepted in the target, up to maxStreams of them at once if it's positive.
+func NewReverseAgent(r io.Reader, w io.Writer, maxStreams int) *Mux {
+	return newMux(r, w, true, nil, maxStreams, nil)
+}
+
+// NewReverseClient returns the mux of the client for the reverse forwards, dialing the local port for each stream
+// opened by the agent.
+func NewReverseClient(r io.Reader, w io.Writer, dial func() (net.Conn, error)) *Mux {
+	return newMux(r, w, false, dial, 0, nil)
+}
+
+func newMux(r io.Reader, w io.Writer, agent bool, dial func() (net.Conn, error), maxStreams int, reset func(err error)) *Mux {
+	if reset == nil {
+		reset = func(error) {}
+	}
+
+	m := &Mux{r: r, w: w, agent: agent, dial: dial, maxStreams: maxStreams, reset: reset, streams: make(map[uint32]*stream)}
+	m.removed = sync.NewCond(&m.lock)
+
+	return m
+}
+
+// Open forwards the connection as a new stream, for the side opening the streams. The connection is closed once the
+// stream is, or if it's refused for ErrTooManyStreams.
+func (m *Mux) Open(conn net.Conn) error {
+	m.lock.Lock()
+
+	if m.draining || m.done {
+		m.lock.Unlock()
+		conn.Close()
+
+		return fmt.Errorf("the forward is closed")
+	}
+
+	if m.maxStreams > 0 && len(m.streams) >= m.maxStreams {
+		m.stats.Streams++
+		m.stats.Refused++
+		m.lock.Unlock()
+		conn.Close()
+
+		return fmt.Errorf("%w, the limit is %d", ErrTooManyStreams, m.maxStreams)
+	}
+
+	// The IDs are reused once they wrap around, skipping the ones in use.
+	m.nextID++
+	for m.streams[m.nextID] != nil {
+		m.nextID++
+	}
+
+	s := &stream{id: m.nextID, conn: conn}
+	m.streams[s.id] = s
+	m.stats.Streams++
+	m.lock.Unlock()
+
+	if err := m.send(protocol.ForwardOpen, s.id, nil); err != nil {
+		m.remove(s)
+
+		return err
+	}
+
+	go m.pump(s)
+
+	return nil
+}
+
+// Serve reads the forward frames until r ends, then closes all the streams. It returns nil if r ends with io.EOF.
+func (m *Mux) Serve() error {
+	defer m.Close()
+
+	for {
+		frame, err := protocol.ReadForwardFrame(m.r)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+
+			return err
+		}
+
+		switch frame.Type {
+		case protocol.ForwardOpen:
+			m.open(frame.Stream)
+		case protocol.ForwardData:
+			m.data(frame.Stream, frame.Payload)
+		case protocol.ForwardClose:
+			m.closed(frame.Stream)
+		case protocol.ForwardReset:
+			if s := m.lookup(frame.Stream); s != nil {
+				m.remove(s)
+				m.reset(fmt.Errorf("%s", frame.Payload))
+			}
+		}
+	}
+}
+
+// Drain refuses the new streams, and waits until the streams open are closed or the mux is closed.
+func (m *Mux) Drain() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.draining = true
+	for len(m.streams) > 0 && !m.done {
+		m.removed.Wait()
+	}
+}
+
+// Close closes all the streams, and refuses the new ones.
+func (m *Mux) Close() {
+	m.lock.Lock()
+	m.done = true
+	m.removed.Broadcast()
+
+	streams := m.streams
+	m.streams = make(map[uint32]*stream)
+
+	for _, s := range streams {
+		s.removed = true
+	}
+	m.lock.Unlock()
+
+	for _, s := range streams {
+		s.conn.Close()
+	}
+}
+
+// Stats returns the streams forwarded so far.
+func (m *Mux) Stats() Stats {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return m.stats
+}
+
+// open dials the port for the stream opened by the peer, it's refused by the side opening the streams. The dial
+// blocks the other streams, which is short on the loopback.
+func (m *Mux) open(id uint32) {
+	if m.dial == nil {
+		side := "client"
+		if m.agent {
+			side = "agent"
+		}
+
+		m.sendReset(id, fmt.Errorf("streams are opened by the %s", side))
+
+		return
+	}
+
+	m.lock.Lock()
+	m.stats.Streams++
+
+	var err error
+
+	switch {
+	case m.draining:
+		err = fmt.Errorf("the forward is closed")
+	case m.streams[id] != nil:
+		err = fmt.Errorf("stream %d is already open", id)
+	case m.maxStreams > 0 && len(m.streams) >= m.maxStreams:
+		err = fmt.Errorf("too many streams, the limit is %d", m.maxStreams)
+	}
+	m.lock.Unlock()
+
+	var conn net.Conn
+	if err == nil {
+		conn, err = m.dial()
+	}
+
+	if err != nil {
+		m.lock.Lock()
+		m.stats.Refused++
+		m.lock.Unlock()
+
+		m.sendReset(id, err)
+
+		return
+	}
+
+	s := &stream{id: id, conn: conn}
+
+	m.lock.Lock()
+	if m.done {
+		m.lock.Unlock()
+		conn.Close()
+
+		return
+	}
+
+	m.streams[id] = s
+	m.lock.Unlock()
+
+	go m.pump(s)
+}
+
+// data writes the data to the connection of the stream, the stream is reset if it fails. The data of the streams
+// unknown, e.g. reset already, is dropped.
+func (m *Mux) data(id uint32, payload []byte) {
+	s := m.lookup(id)
+	if s == nil {
+		return
+	}
+
+	m.count(len(payload), m.agent)
+
+	if _, err := s.conn.Write(payload); err != nil {
+		if m.remove(s) {
+			m.sendReset(id, err)
+		}
+	}
+}
+
+// closed half-closes the connection of the stream once the peer sends no more data.
+func (m *Mux) closed(id uint32) {
+	s := m.lookup(id)
+	if s == nil {
+		return
+	}
+
+	m.lock.Lock()
+	s.received = true
+	done := s.sent
+	m.lock.Unlock()
+
+	if done {
+		m.remove(s)
+
+		return
+	}
+
+	if cw, ok := s.conn.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+	}
+}
+
+// pump sends the data read from the connection of the stream, then the close frame once it reads EOF, or the reset
+// frame if it fails.
+func (m *Mux) pump(s *stream) {
+	buf := make([]byte, protocol.MaxForwardPayload)
+
+	for {
+		n, err := s.conn.Read(buf)
+		if n > 0 {
+			m.count(n, !m.agent)
+
+			if sendErr := m.send(protocol.ForwardData, s.id, buf[:n]); sendErr != nil {
+				m.remove(s)
+
+				return
+			}
+		}
+
+		if err == nil {
+			continue
+		}
+
+		if !errors.Is(err, io.EOF) {
+			if m.remove(s) {
+				m.sendReset(s.id, err)
+			}
+
+			return
+		}
+
+		m.lock.Lock()
+		s.sent = true
+		removed, done := s.removed, s.received
+		m.lock.Unlock()
+
+		if removed {
+			return
+		}
+
+		m.send(protocol.ForwardClose, s.id, nil)
+
+		if done {
+			m.remove(s)
+		}
+
+		return
+	}
+}
+
+// lookup returns the stream of the ID, nil if it's unknown.
+func (m *Mux) lookup(id uint32) *stream {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return m.streams[id]
+}
+
+// remove removes the stream and closes its connection, it returns false if the stream is already removed.
+func (m *Mux) remove(s *stream) bool {
+	m.lock.Lock()
+	if s.removed {
+		m.lock.Unlock()
+
+		return false
+	}
+
+	s.removed = true
+	if m.streams[s.id] == s {
+		delete(m.streams, s.id)
+		m.removed.Broadcast()
+	}
+	m.lock.Unlock()
+
+	s.conn.Close()
+
+	return true
+}
+
+// count counts the data of the streams, sent by the client if in is true.
+func (m *Mux) count(n int, in bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if in {
+		m.stats.BytesIn += int64(n)
+	} else {
+		m.stats.BytesOut += int64(n)
+	}
+}
+
+// sendReset sends the reset frame of the stream with the error.
+func (m *Mux) sendReset(id uint32, err error) {
+	msg := err.Error()
+	if len(msg) > protocol.MaxForwardPayload {
+		msg = msg[:protocol.MaxForwardPayload]
+	}
+
+	m.send(protocol.ForwardReset, id, []byte(msg))
+}
+
+// send writes the forward frame, all the later ones fail once a write fails.
+func (m *Mux) send(typ byte, id uint32, payload []byte) error {
+	m.wlock.Lock()
+	defer m.wlock.Unlock()
+
+	if m.werr != nil {
+		return m.werr
+	}
+
+	if _, err := m.w.Write(protocol.EncodeForwardFrame(typ, id, payload)); err != nil {
+		m.werr = err
+	}
+
+	return m.werr
+}
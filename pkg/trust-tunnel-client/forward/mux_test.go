@@ -0,0 +1,316 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package forward
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// listen returns a listener on the loopback, closed once the test ends.
+func listen(t *testing.T) net.Listener {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { l.Close() })
+
+	return l
+}
+
+// pair connects a client mux and an agent mux dialing the address, and returns a listener whose connections are
+// forwarded by the client mux.
+func pair(t *testing.T, dial func() (net.Conn, error), maxStreams int, reset func(error)) (net.Listener, *Mux) {
+	t.Helper()
+
+	toAgent, fromClient := io.Pipe()
+	toClient, fromAgent := io.Pipe()
+
+	agent := NewAgent(toAgent, fromAgent, dial, maxStreams)
+	client := NewClient(toClient, fromClient, reset)
+
+	go func() {
+		agent.Serve()
+		fromAgent.Close()
+	}()
+
+	go func() {
+		client.Serve()
+		fromClient.Close()
+	}()
+
+	t.Cleanup(func() {
+		fromClient.Close()
+		fromAgent.Close()
+	})
+
+	l := listen(t)
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			client.Open(conn)
+		}
+	}()
+
+	return l, agent
+}
+
+func TestMuxForward(t *testing.T) {
+	target := listen(t)
+
+	// The target echoes the connections in upper case until they are half-closed.
+	go func() {
+		for {
+			conn, err := target.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				data, _ := io.ReadAll(conn)
+				conn.Write(bytes.ToUpper(data))
+				conn.Close()
+			}()
+		}
+	}()
+
+	l, agent := pair(t, func() (net.Conn, error) { return net.Dial("tcp", target.Addr().String()) }, 0, nil)
+
+	// The data exceeding the payload of a frame is split.
+	large := strings.Repeat("x", 100<<10)
+
+	done := make(chan error)
+
+	for i := 0; i < 3; i++ {
+		go func(msg string) {
+			conn, err := net.Dial("tcp", l.Addr().String())
+			if err != nil {
+				done <- err
+
+				return
+			}
+			defer conn.Close()
+
+			conn.Write([]byte(msg))
+			conn.(*net.TCPConn).CloseWrite()
+
+			got, err := io.ReadAll(conn)
+			if err == nil && string(got) != strings.ToUpper(msg) {
+				err = fmt.Errorf("got %d bytes %.20q", len(got), got)
+			}
+
+			done <- err
+		}(fmt.Sprintf("hello %d %s", i, large))
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stats := agent.Stats()
+	if stats.Streams != 3 || stats.Refused != 0 || stats.BytesIn != stats.BytesOut || stats.BytesIn < 3*100<<10 {
+		t.Errorf("got stats %+v", stats)
+	}
+
+	// The streams are removed once closed by both sides.
+	deadline := time.Now().Add(5 * time.Second)
+	for agent.lookup(1) != nil || agent.lookup(2) != nil || agent.lookup(3) != nil {
+		if time.Now().After(deadline) {
+			t.Fatal("the streams are never removed")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestMuxRefused(t *testing.T) {
+	resets := make(chan error, 2)
+
+	var dials int
+
+	// The first stream is held open, and the ones dialed later fail to connect.
+	dial := func() (net.Conn, error) {
+		dials++
+		if dials > 1 {
+			return nil, fmt.Errorf("connection refused")
+		}
+
+		conn, peer := net.Pipe()
+		t.Cleanup(func() { peer.Close() })
+
+		return conn, nil
+	}
+
+	l, agent := pair(t, dial, 1, func(err error) { resets <- err })
+
+	// connect forwards a connection, and checks that it's reset with the error and closed.
+	connect := func(want string) {
+		t.Helper()
+
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		select {
+		case err := <-resets:
+			if err.Error() != want {
+				t.Errorf("got reset %v, want %s", err, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no reset of %s", want)
+		}
+
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+		if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+			t.Errorf("got %v reading the connection reset, want EOF", err)
+		}
+	}
+
+	held, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer held.Close()
+
+	for deadline := time.Now().Add(5 * time.Second); agent.lookup(1) == nil; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("the first stream is never opened")
+		}
+	}
+
+	connect("too many streams, the limit is 1")
+
+	agent.remove(agent.lookup(1))
+	connect("connection refused")
+
+	if stats := agent.Stats(); stats.Streams != 3 || stats.Refused != 2 {
+		t.Errorf("got stats %+v", stats)
+	}
+}
+
+func TestMuxReverse(t *testing.T) {
+	local := listen(t)
+
+	// The local port of the client echoes the connections in upper case until they are half-closed.
+	go func() {
+		for {
+			conn, err := local.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				data, _ := io.ReadAll(conn)
+				conn.Write(bytes.ToUpper(data))
+				conn.Close()
+			}()
+		}
+	}()
+
+	toAgent, fromClient := io.Pipe()
+	toClient, fromAgent := io.Pipe()
+
+	agent := NewReverseAgent(toAgent, fromAgent, 1)
+	client := NewReverseClient(toClient, fromClient, func() (net.Conn, error) { return net.Dial("tcp", local.Addr().String()) })
+
+	go agent.Serve()
+	go client.Serve()
+
+	t.Cleanup(func() {
+		fromClient.Close()
+		fromAgent.Close()
+	})
+
+	// The connections accepted in the target are opened by the agent.
+	target := listen(t)
+	opened := make(chan error, 4)
+
+	go func() {
+		for {
+			conn, err := target.Accept()
+			if err != nil {
+				return
+			}
+
+			opened <- agent.Open(conn)
+		}
+	}()
+
+	conn, err := net.Dial("tcp", target.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	conn.Write([]byte("hello"))
+	conn.(*net.TCPConn).CloseWrite()
+
+	if data, err := io.ReadAll(conn); err != nil || string(data) != "HELLO" {
+		t.Fatalf("got %q, %v", data, err)
+	}
+
+	if err := <-opened; err != nil {
+		t.Fatal(err)
+	}
+
+	for deadline := time.Now().Add(5 * time.Second); agent.lookup(1) != nil; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("the first stream is never removed")
+		}
+	}
+
+	// The connections beyond the limit are closed.
+	held, err := net.Dial("tcp", target.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer held.Close()
+
+	if err := <-opened; err != nil {
+		t.Fatal(err)
+	}
+
+	refused, err := net.Dial("tcp", target.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer refused.Close()
+
+	if err := <-opened; !errors.Is(err, ErrTooManyStreams) {
+		t.Errorf("got %v opening beyond the limit", err)
+	}
+
+	if stats := agent.Stats(); stats.Streams != 3 || stats.Refused != 1 || stats.BytesIn != 5 || stats.BytesOut != 5 {
+		t.Errorf("got stats %+v", stats)
+	}
+}
@@ -0,0 +1,8 @@
+module trust-tunnel/pkg/trust-tunnel-client
+
+go 1.21
+
+require (
+	github.com/gorilla/websocket v1.4.3-0.20200912193213-c3dd95aea977
+	github.com/tongsuo-project/tongsuo-go-sdk v0.0.0-20240124064327-da3f793fd8bd
+)
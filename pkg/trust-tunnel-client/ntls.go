@@ -12,8 +12,7 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-//go:build ntls
-// +build ntls
+//go:build ntls && linux && cgo
 
 package client
 
@@ -29,20 +28,30 @@ import (
 	"github.com/tongsuo-project/tongsuo-go-sdk/crypto"
 )
 
-func (c *Client) dialAgent(nc *net.Conn, url *url.URL, header *http.Header, tlsConfig *tls.Config) (*websocket.Conn, error) {
-	d := websocket.Dialer{}
+// ntlsSupported is whether the client is built with NTLS, which replaces TLS then.
+const ntlsSupported = true
+
+// dialAgent dials the agent over NTLS and establishes a websocket connection.
+func (c *Client) dialAgent(nc *net.Conn, url *url.URL, header *http.Header, tlsConfig *tls.Config) (*websocket.Conn, *http.Response, error) {
+	d := websocket.Dialer{
+		ReadBufferSize:  c.ReadBufferSize,
+		WriteBufferSize: c.WriteBufferSize,
+	}
 	if nc != nil {
 		d.NetDial = func(net, addr string) (net.Conn, error) {
 			return *nc, nil
 		}
 	} else {
 		d.NetDial = func(net, addr string) (net.Conn, error) {
-			return c.DialSessionUsingNtls(addr)
+			return c.DialSessionUsingNTLS(addr)
 		}
 	}
 
-	conn, _, err := d.Dial(url.String(), *header)
-	return conn, err
+	if c.DialerCustomizer != nil {
+		c.DialerCustomizer(&d)
+	}
+
+	return d.Dial(url.String(), *header)
 }
 
 // DialSessionUsingNTLS establishes a connection to the server using the NTLS protocol.
@@ -0,0 +1,277 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ErrPKCS11Unsupported is returned by the pkcs11 credential provider of a client built without PKCS#11,
+// which requires the pkcs11 build tag and cgo.
+var ErrPKCS11Unsupported = errors.New("PKCS#11 isn't supported by this build of the client, build it with -tags pkcs11 and cgo")
+
+// The PKCS#11 mechanisms and the parameters of RSA-PSS used for signing.
+const (
+	ckmRSAPKCS    = 0x1
+	ckmRSAPKCSPSS = 0xd
+	ckmECDSA      = 0x1041
+
+	ckmSHA1   = 0x220
+	ckmSHA256 = 0x250
+	ckmSHA384 = 0x260
+	ckmSHA512 = 0x270
+
+	ckgMGF1SHA1   = 0x1
+	ckgMGF1SHA256 = 0x2
+	ckgMGF1SHA384 = 0x3
+	ckgMGF1SHA512 = 0x4
+)
+
+// pkcs11Hashes maps the hashes to the PKCS#11 hash mechanisms and the MGF1 functions of RSA-PSS.
+var pkcs11Hashes = map[crypto.Hash][2]uint{
+	crypto.SHA1:   {ckmSHA1, ckgMGF1SHA1},
+	crypto.SHA256: {ckmSHA256, ckgMGF1SHA256},
+	crypto.SHA384: {ckmSHA384, ckgMGF1SHA384},
+	crypto.SHA512: {ckmSHA512, ckgMGF1SHA512},
+}
+
+// pkcs1Prefixes are the DER encoded DigestInfo prefixes of the digests signed with CKM_RSA_PKCS,
+// which signs the given data as is. The MD5+SHA1 digests of TLS 1.0 and 1.1 are signed without a prefix.
+var pkcs1Prefixes = map[crypto.Hash][]byte{
+	crypto.MD5SHA1: {},
+	crypto.SHA1:    {0x30, 0x21, 0x30, 0x09, 0x06, 0x05, 0x2b, 0x0e, 0x03, 0x02, 0x1a, 0x05, 0x00, 0x04, 0x14},
+	crypto.SHA256:  {0x30, 0x31, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x01, 0x05, 0x00, 0x04, 0x20},
+	crypto.SHA384:  {0x30, 0x41, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x02, 0x05, 0x00, 0x04, 0x30},
+	crypto.SHA512:  {0x30, 0x51, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x03, 0x05, 0x00, 0x04, 0x40},
+}
+
+// pkcs11Mechanism is a signing mechanism of PKCS#11.
+type pkcs11Mechanism struct {
+	mechanism uint
+	// hash, mgf and saltLength are the parameters of CKM_RSA_PKCS_PSS.
+	hash, mgf, saltLength uint
+}
+
+// pkcs11Key signs data with a private key kept in a PKCS#11 token.
+type pkcs11Key interface {
+	sign(mech pkcs11Mechanism, data []byte) ([]byte, error)
+}
+
+// pkcs11Params are the params of the pkcs11 credential provider.
+type pkcs11Params struct {
+	// module is the path of the PKCS#11 module, e.g. /usr/lib/softhsm/libsofthsm2.so.
+	module string
+	// token is the label of the token, and slot is the ID of its slot. The first slot with a token is used
+	// if neither is given.
+	token string
+	slot  *uint
+	// pin logs into the token, it's read from pinFile if it's given. No login is done if neither is given.
+	pin     string
+	pinFile string
+	// label and id identify the private key and the certificate in the token.
+	label string
+	id    []byte
+	// cert is the PEM file of the certificate chain, which is read from the token if it's empty.
+	cert string
+}
+
+// parsePKCS11Params parses the params of the pkcs11 credential provider.
+func parsePKCS11Params(params map[string]string) (*pkcs11Params, error) {
+	p := &pkcs11Params{
+		module:  params["module"],
+		token:   params["token"],
+		pin:     params["pin"],
+		pinFile: params["pin_file"],
+		label:   params["label"],
+		cert:    params["cert"],
+	}
+
+	if p.module == "" {
+		return nil, fmt.Errorf("module of PKCS#11 is required")
+	}
+
+	if params["slot"] != "" {
+		slot, err := strconv.ParseUint(params["slot"], 10, 0)
+		if err != nil {
+			return nil, fmt.Errorf("invalid slot %q: %v", params["slot"], err)
+		}
+
+		s := uint(slot)
+		p.slot = &s
+	}
+
+	if params["id"] != "" {
+		id, err := hex.DecodeString(params["id"])
+		if err != nil {
+			return nil, fmt.Errorf("invalid id %q, hex is expected: %v", params["id"], err)
+		}
+
+		p.id = id
+	}
+
+	if p.label == "" && p.id == nil {
+		return nil, fmt.Errorf("label or id of the key is required")
+	}
+
+	if p.pinFile != "" {
+		data, err := os.ReadFile(p.pinFile)
+		if err != nil {
+			return nil, fmt.Errorf("read pin file error: %v", err)
+		}
+
+		p.pin = strings.TrimRight(string(data), "\r\n")
+	}
+
+	return p, nil
+}
+
+// pkcs11CredentialProvider provides the client certificate whose private key is kept in a PKCS#11 token,
+// e.g. a smart card, an HSM, a TPM through tpm2-pkcs11, or a keychain exposed by p11-kit.
+type pkcs11CredentialProvider struct {
+	cert tls.Certificate
+}
+
+// newPKCS11CredentialProvider creates a credential provider with the params: "module", the path of the PKCS#11
+// module, the "token" label or the "slot" ID, the "pin" or the "pin_file" of the user, the "label" or the
+// hex "id" of the key, and the "cert" PEM file if the certificate isn't stored in the token with the key.
+func newPKCS11CredentialProvider(params map[string]string) (CredentialProvider, error) {
+	p, err := parsePKCS11Params(params)
+	if err != nil {
+		return nil, err
+	}
+
+	key, certDER, err := openPKCS11Key(p)
+	if err != nil {
+		return nil, err
+	}
+
+	var cert tls.Certificate
+
+	if p.cert != "" {
+		data, err := os.ReadFile(p.cert)
+		if err != nil {
+			return nil, fmt.Errorf("read certificate error: %v", err)
+		}
+
+		for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+			if block.Type == "CERTIFICATE" {
+				cert.Certificate = append(cert.Certificate, block.Bytes)
+			}
+		}
+	} else if certDER != nil {
+		cert.Certificate = [][]byte{certDER}
+	}
+
+	if len(cert.Certificate) == 0 {
+		return nil, fmt.Errorf("no certificate found for the PKCS#11 key")
+	}
+
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("parse certificate error: %v", err)
+	}
+
+	switch cert.Leaf.PublicKey.(type) {
+	case *ecdsa.PublicKey, *rsa.PublicKey:
+	default:
+		return nil, fmt.Errorf("unsupported public key %T of the PKCS#11 key, RSA or ECDSA is expected", cert.Leaf.PublicKey)
+	}
+
+	cert.PrivateKey = &pkcs11Signer{public: cert.Leaf.PublicKey, key: key}
+
+	return &pkcs11CredentialProvider{cert: cert}, nil
+}
+
+func (p *pkcs11CredentialProvider) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return &p.cert, nil
+}
+
+// pkcs11Signer is a crypto.Signer whose private key is kept in a PKCS#11 token.
+// The signing is serialized, as a PKCS#11 session runs a single operation at a time.
+type pkcs11Signer struct {
+	public crypto.PublicKey
+
+	lock sync.Mutex
+	key  pkcs11Key
+}
+
+func (s *pkcs11Signer) Public() crypto.PublicKey {
+	return s.public
+}
+
+// Sign signs the digest with the mechanism of the key type and opts, the ECDSA signatures of PKCS#11 are
+// converted to the ASN.1 form expected by TLS.
+func (s *pkcs11Signer) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	hash := opts.HashFunc()
+
+	if _, ok := s.public.(*ecdsa.PublicKey); ok {
+		sig, err := s.key.sign(pkcs11Mechanism{mechanism: ckmECDSA}, digest)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(sig) == 0 || len(sig)%2 != 0 {
+			return nil, fmt.Errorf("invalid ECDSA signature of %d bytes from PKCS#11", len(sig))
+		}
+
+		r, ss := new(big.Int).SetBytes(sig[:len(sig)/2]), new(big.Int).SetBytes(sig[len(sig)/2:])
+
+		return asn1.Marshal(struct{ R, S *big.Int }{r, ss})
+	}
+
+	if pss, ok := opts.(*rsa.PSSOptions); ok {
+		params, ok := pkcs11Hashes[hash]
+		if !ok {
+			return nil, fmt.Errorf("unsupported hash %v of RSA-PSS", hash)
+		}
+
+		saltLength := pss.SaltLength
+		if saltLength == rsa.PSSSaltLengthEqualsHash || saltLength == rsa.PSSSaltLengthAuto {
+			saltLength = hash.Size()
+		}
+
+		return s.key.sign(pkcs11Mechanism{
+			mechanism:  ckmRSAPKCSPSS,
+			hash:       params[0],
+			mgf:        params[1],
+			saltLength: uint(saltLength),
+		}, digest)
+	}
+
+	prefix, ok := pkcs1Prefixes[hash]
+	if !ok {
+		return nil, fmt.Errorf("unsupported hash %v of RSA PKCS #1 v1.5", hash)
+	}
+
+	return s.key.sign(pkcs11Mechanism{mechanism: ckmRSAPKCS}, append(append([]byte{}, prefix...), digest...))
+}
@@ -0,0 +1,446 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build pkcs11 && cgo && !windows
+
+package client
+
+/*
+#cgo linux LDFLAGS: -ldl
+#include <dlfcn.h>
+#include <stdlib.h>
+
+typedef unsigned long ck_ulong;
+
+typedef struct {
+	ck_ulong type;
+	void *value;
+	ck_ulong len;
+} ck_attribute;
+
+typedef struct {
+	ck_ulong mechanism;
+	void *parameter;
+	ck_ulong len;
+} ck_mechanism;
+
+typedef struct {
+	ck_ulong hash;
+	ck_ulong mgf;
+	ck_ulong salt_len;
+} ck_rsa_pss_params;
+
+typedef struct {
+	unsigned char major;
+	unsigned char minor;
+} ck_version;
+
+typedef struct {
+	unsigned char label[32];
+	unsigned char manufacturer_id[32];
+	unsigned char model[16];
+	unsigned char serial_number[16];
+	ck_ulong flags;
+	ck_ulong max_session_count;
+	ck_ulong session_count;
+	ck_ulong max_rw_session_count;
+	ck_ulong rw_session_count;
+	ck_ulong max_pin_len;
+	ck_ulong min_pin_len;
+	ck_ulong total_public_memory;
+	ck_ulong free_public_memory;
+	ck_ulong total_private_memory;
+	ck_ulong free_private_memory;
+	ck_version hardware_version;
+	ck_version firmware_version;
+	unsigned char utc_time[16];
+} ck_token_info;
+
+// pkcs11_module holds the functions of a PKCS#11 module used by the client.
+typedef struct {
+	ck_ulong (*initialize)(void *);
+	ck_ulong (*get_slot_list)(unsigned char, ck_ulong *, ck_ulong *);
+	ck_ulong (*get_token_info)(ck_ulong, ck_token_info *);
+	ck_ulong (*open_session)(ck_ulong, ck_ulong, void *, void *, ck_ulong *);
+	ck_ulong (*login)(ck_ulong, ck_ulong, unsigned char *, ck_ulong);
+	ck_ulong (*find_objects_init)(ck_ulong, ck_attribute *, ck_ulong);
+	ck_ulong (*find_objects)(ck_ulong, ck_ulong *, ck_ulong, ck_ulong *);
+	ck_ulong (*find_objects_final)(ck_ulong);
+	ck_ulong (*get_attribute_value)(ck_ulong, ck_ulong, ck_attribute *, ck_ulong);
+	ck_ulong (*sign_init)(ck_ulong, ck_mechanism *, ck_ulong);
+	ck_ulong (*sign)(ck_ulong, unsigned char *, ck_ulong, unsigned char *, ck_ulong *);
+} pkcs11_module;
+
+// pkcs11_load loads the functions of the module at path, it returns the error message on failure.
+static const char *pkcs11_load(const char *path, pkcs11_module *m) {
+	void *handle = dlopen(path, RTLD_NOW | RTLD_LOCAL);
+	if (handle == NULL) {
+		return dlerror();
+	}
+
+#define PKCS11_LOAD(field, name)                                  \
+	if ((*(void **)(&m->field) = dlsym(handle, name)) == NULL) { \
+		return "symbol " name " isn't found";                     \
+	}
+
+	PKCS11_LOAD(initialize, "C_Initialize")
+	PKCS11_LOAD(get_slot_list, "C_GetSlotList")
+	PKCS11_LOAD(get_token_info, "C_GetTokenInfo")
+	PKCS11_LOAD(open_session, "C_OpenSession")
+	PKCS11_LOAD(login, "C_Login")
+	PKCS11_LOAD(find_objects_init, "C_FindObjectsInit")
+	PKCS11_LOAD(find_objects, "C_FindObjects")
+	PKCS11_LOAD(find_objects_final, "C_FindObjectsFinal")
+	PKCS11_LOAD(get_attribute_value, "C_GetAttributeValue")
+	PKCS11_LOAD(sign_init, "C_SignInit")
+	PKCS11_LOAD(sign, "C_Sign")
+
+	return NULL;
+}
+
+static ck_ulong pkcs11_initialize(pkcs11_module *m) {
+	return m->initialize(NULL);
+}
+
+static ck_ulong pkcs11_get_slot_list(pkcs11_module *m, ck_ulong *slots, ck_ulong *count) {
+	return m->get_slot_list(1, slots, count);
+}
+
+static ck_ulong pkcs11_get_token_info(pkcs11_module *m, ck_ulong slot, ck_token_info *info) {
+	return m->get_token_info(slot, info);
+}
+
+static ck_ulong pkcs11_open_session(pkcs11_module *m, ck_ulong slot, ck_ulong *session) {
+	// CKF_SERIAL_SESSION is required.
+	return m->open_session(slot, 0x4, NULL, NULL, session);
+}
+
+static ck_ulong pkcs11_login(pkcs11_module *m, ck_ulong session, unsigned char *pin, ck_ulong len) {
+	// CKU_USER.
+	return m->login(session, 1, pin, len);
+}
+
+static ck_ulong pkcs11_find_objects_init(pkcs11_module *m, ck_ulong session, ck_attribute *tmpl, ck_ulong count) {
+	return m->find_objects_init(session, tmpl, count);
+}
+
+static ck_ulong pkcs11_find_objects(pkcs11_module *m, ck_ulong session, ck_ulong *objects, ck_ulong max, ck_ulong *count) {
+	return m->find_objects(session, objects, max, count);
+}
+
+static ck_ulong pkcs11_find_objects_final(pkcs11_module *m, ck_ulong session) {
+	return m->find_objects_final(session);
+}
+
+static ck_ulong pkcs11_get_attribute_value(pkcs11_module *m, ck_ulong session, ck_ulong object, ck_attribute *tmpl, ck_ulong count) {
+	return m->get_attribute_value(session, object, tmpl, count);
+}
+
+static ck_ulong pkcs11_sign_init(pkcs11_module *m, ck_ulong session, ck_mechanism *mech, ck_ulong key) {
+	return m->sign_init(session, mech, key);
+}
+
+static ck_ulong pkcs11_sign(pkcs11_module *m, ck_ulong session, unsigned char *data, ck_ulong len, unsigned char *sig, ck_ulong *sig_len) {
+	return m->sign(session, data, len, sig, sig_len);
+}
+*/
+import "C"
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"unsafe"
+)
+
+// pkcs11Supported is whether the client is built with PKCS#11.
+const pkcs11Supported = true
+
+// The PKCS#11 return values, object classes and attributes used by the client.
+const (
+	ckrOK                         = 0x0
+	ckrUserAlreadyLoggedIn        = 0x100
+	ckrCryptokiAlreadyInitialized = 0x191
+
+	ckoCertificate = 0x1
+	ckoPrivateKey  = 0x3
+
+	ckaClass = 0x0
+	ckaLabel = 0x3
+	ckaValue = 0x11
+	ckaID    = 0x102
+)
+
+var (
+	// pkcs11Modules are the loaded modules by path, as a module is initialized once per process.
+	pkcs11Modules     = map[string]*C.pkcs11_module{}
+	pkcs11ModulesLock sync.Mutex
+)
+
+// loadPKCS11Module loads and initializes the PKCS#11 module at path.
+func loadPKCS11Module(path string) (*C.pkcs11_module, error) {
+	pkcs11ModulesLock.Lock()
+	defer pkcs11ModulesLock.Unlock()
+
+	if m, ok := pkcs11Modules[path]; ok {
+		return m, nil
+	}
+
+	cpath := C.CString(path)
+	defer C.free(unsafe.Pointer(cpath))
+
+	m := (*C.pkcs11_module)(C.calloc(1, C.sizeof_pkcs11_module))
+
+	if msg := C.pkcs11_load(cpath, m); msg != nil {
+		C.free(unsafe.Pointer(m))
+
+		return nil, fmt.Errorf("load PKCS#11 module %s error: %s", path, C.GoString(msg))
+	}
+
+	if rv := C.pkcs11_initialize(m); rv != ckrOK && rv != ckrCryptokiAlreadyInitialized {
+		C.free(unsafe.Pointer(m))
+
+		return nil, pkcs11Error("C_Initialize", rv)
+	}
+
+	pkcs11Modules[path] = m
+
+	return m, nil
+}
+
+// pkcs11Error returns the error of a PKCS#11 function.
+func pkcs11Error(function string, rv C.ck_ulong) error {
+	return fmt.Errorf("PKCS#11 %s error: CKR 0x%x", function, uint64(rv))
+}
+
+// moduleKey is a private key in a session of a PKCS#11 module.
+type moduleKey struct {
+	module  *C.pkcs11_module
+	session C.ck_ulong
+	key     C.ck_ulong
+}
+
+// openPKCS11Key logs into the token given by p, and finds the private key and its certificate in it.
+// The certificate is nil if it isn't stored in the token.
+func openPKCS11Key(p *pkcs11Params) (pkcs11Key, []byte, error) {
+	m, err := loadPKCS11Module(p.module)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	slot, err := findPKCS11Slot(m, p)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	k := &moduleKey{module: m}
+
+	if rv := C.pkcs11_open_session(m, slot, &k.session); rv != ckrOK {
+		return nil, nil, pkcs11Error("C_OpenSession", rv)
+	}
+
+	if p.pin != "" {
+		pin := C.CBytes([]byte(p.pin))
+		rv := C.pkcs11_login(m, k.session, (*C.uchar)(pin), C.ck_ulong(len(p.pin)))
+		C.free(pin)
+
+		if rv != ckrOK && rv != ckrUserAlreadyLoggedIn {
+			return nil, nil, pkcs11Error("C_Login", rv)
+		}
+	}
+
+	key, found, err := k.find(ckoPrivateKey, p)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if !found {
+		return nil, nil, fmt.Errorf("no private key found in the PKCS#11 token with label %q and id %x", p.label, p.id)
+	}
+
+	k.key = key
+
+	if p.cert != "" {
+		return k, nil, nil
+	}
+
+	cert, found, err := k.find(ckoCertificate, p)
+	if err != nil || !found {
+		return k, nil, err
+	}
+
+	value, err := k.value(cert, ckaValue)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return k, value, nil
+}
+
+// findPKCS11Slot returns the slot given by p, or the first slot with a token.
+func findPKCS11Slot(m *C.pkcs11_module, p *pkcs11Params) (C.ck_ulong, error) {
+	if p.slot != nil {
+		return C.ck_ulong(*p.slot), nil
+	}
+
+	var count C.ck_ulong
+
+	if rv := C.pkcs11_get_slot_list(m, nil, &count); rv != ckrOK {
+		return 0, pkcs11Error("C_GetSlotList", rv)
+	}
+
+	if count == 0 {
+		return 0, fmt.Errorf("no PKCS#11 token found")
+	}
+
+	slots := (*C.ck_ulong)(C.calloc(count, C.sizeof_ck_ulong))
+	defer C.free(unsafe.Pointer(slots))
+
+	if rv := C.pkcs11_get_slot_list(m, slots, &count); rv != ckrOK {
+		return 0, pkcs11Error("C_GetSlotList", rv)
+	}
+
+	list := unsafe.Slice(slots, count)
+	if p.token == "" {
+		return list[0], nil
+	}
+
+	info := (*C.ck_token_info)(C.calloc(1, C.sizeof_ck_token_info))
+	defer C.free(unsafe.Pointer(info))
+
+	for _, slot := range list {
+		if rv := C.pkcs11_get_token_info(m, slot, info); rv != ckrOK {
+			return 0, pkcs11Error("C_GetTokenInfo", rv)
+		}
+
+		// The label is padded with blanks.
+		label := C.GoBytes(unsafe.Pointer(&info.label[0]), C.int(len(info.label)))
+		if string(bytes.TrimRight(label, " ")) == p.token {
+			return slot, nil
+		}
+	}
+
+	return 0, fmt.Errorf("PKCS#11 token %q isn't found", p.token)
+}
+
+// find finds the first object of class with the label and the ID given by p.
+func (k *moduleKey) find(class uint, p *pkcs11Params) (C.ck_ulong, bool, error) {
+	attrs := map[uint][]byte{ckaClass: ulongBytes(class)}
+
+	if p.label != "" {
+		attrs[ckaLabel] = []byte(p.label)
+	}
+
+	if p.id != nil {
+		attrs[ckaID] = p.id
+	}
+
+	// The template and the values are passed in C memory.
+	tmpl := (*C.ck_attribute)(C.calloc(C.size_t(len(attrs)), C.sizeof_ck_attribute))
+	defer C.free(unsafe.Pointer(tmpl))
+
+	entries := unsafe.Slice(tmpl, len(attrs))
+	i := 0
+
+	for typ, value := range attrs {
+		entries[i] = C.ck_attribute{_type: C.ck_ulong(typ), value: C.CBytes(value), len: C.ck_ulong(len(value))}
+		defer C.free(entries[i].value)
+
+		i++
+	}
+
+	if rv := C.pkcs11_find_objects_init(k.module, k.session, tmpl, C.ck_ulong(len(attrs))); rv != ckrOK {
+		return 0, false, pkcs11Error("C_FindObjectsInit", rv)
+	}
+	defer C.pkcs11_find_objects_final(k.module, k.session)
+
+	var object, count C.ck_ulong
+
+	if rv := C.pkcs11_find_objects(k.module, k.session, &object, 1, &count); rv != ckrOK {
+		return 0, false, pkcs11Error("C_FindObjects", rv)
+	}
+
+	return object, count == 1, nil
+}
+
+// value returns the value of the attribute of object.
+func (k *moduleKey) value(object C.ck_ulong, typ uint) ([]byte, error) {
+	attr := (*C.ck_attribute)(C.calloc(1, C.sizeof_ck_attribute))
+	defer C.free(unsafe.Pointer(attr))
+
+	attr._type = C.ck_ulong(typ)
+
+	// The length is got first.
+	if rv := C.pkcs11_get_attribute_value(k.module, k.session, object, attr, 1); rv != ckrOK {
+		return nil, pkcs11Error("C_GetAttributeValue", rv)
+	}
+
+	attr.value = C.malloc(C.size_t(attr.len))
+	defer C.free(attr.value)
+
+	if rv := C.pkcs11_get_attribute_value(k.module, k.session, object, attr, 1); rv != ckrOK {
+		return nil, pkcs11Error("C_GetAttributeValue", rv)
+	}
+
+	return C.GoBytes(attr.value, C.int(attr.len)), nil
+}
+
+// sign signs data with the key by mech in a single part operation.
+func (k *moduleKey) sign(mech pkcs11Mechanism, data []byte) ([]byte, error) {
+	cmech := (*C.ck_mechanism)(C.calloc(1, C.sizeof_ck_mechanism))
+	defer C.free(unsafe.Pointer(cmech))
+
+	cmech.mechanism = C.ck_ulong(mech.mechanism)
+
+	if mech.mechanism == ckmRSAPKCSPSS {
+		params := (*C.ck_rsa_pss_params)(C.calloc(1, C.sizeof_ck_rsa_pss_params))
+		defer C.free(unsafe.Pointer(params))
+
+		params.hash = C.ck_ulong(mech.hash)
+		params.mgf = C.ck_ulong(mech.mgf)
+		params.salt_len = C.ck_ulong(mech.saltLength)
+		cmech.parameter = unsafe.Pointer(params)
+		cmech.len = C.sizeof_ck_rsa_pss_params
+	}
+
+	if rv := C.pkcs11_sign_init(k.module, k.session, cmech, k.key); rv != ckrOK {
+		return nil, pkcs11Error("C_SignInit", rv)
+	}
+
+	in := C.CBytes(data)
+	defer C.free(in)
+
+	// The length of the signature is got first, which doesn't end the operation.
+	var n C.ck_ulong
+
+	if rv := C.pkcs11_sign(k.module, k.session, (*C.uchar)(in), C.ck_ulong(len(data)), nil, &n); rv != ckrOK {
+		return nil, pkcs11Error("C_Sign", rv)
+	}
+
+	sig := C.malloc(C.size_t(n))
+	defer C.free(sig)
+
+	if rv := C.pkcs11_sign(k.module, k.session, (*C.uchar)(in), C.ck_ulong(len(data)), (*C.uchar)(sig), &n); rv != ckrOK {
+		return nil, pkcs11Error("C_Sign", rv)
+	}
+
+	return C.GoBytes(sig, C.int(n)), nil
+}
+
+// ulongBytes returns the bytes of v as a CK_ULONG in the native byte order.
+func ulongBytes(v uint) []byte {
+	n := C.ck_ulong(v)
+
+	return C.GoBytes(unsafe.Pointer(&n), C.sizeof_ck_ulong)
+}
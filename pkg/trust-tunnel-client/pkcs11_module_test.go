@@ -0,0 +1,187 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build pkcs11 && cgo && !windows
+
+package client
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+// fakeModule is a PKCS#11 module with a token "test" of the PIN "1234", holding a private key and
+// a certificate labeled "key". Its signature is the mechanism and the salt length followed by the data.
+const fakeModule = `
+#include <string.h>
+
+typedef unsigned long ck_ulong;
+typedef struct { ck_ulong type; void *value; ck_ulong len; } ck_attribute;
+typedef struct { ck_ulong mechanism; void *parameter; ck_ulong len; } ck_mechanism;
+typedef struct { ck_ulong hash; ck_ulong mgf; ck_ulong salt_len; } ck_rsa_pss_params;
+
+static int logged_in, found;
+static ck_ulong find_class, mechanism, salt_len;
+static const char cert[] = "fake-cert";
+
+ck_ulong C_Initialize(void *args) { return 0; }
+
+ck_ulong C_GetSlotList(unsigned char present, ck_ulong *slots, ck_ulong *count) {
+	if (slots != NULL) {
+		slots[0] = 7;
+		slots[1] = 9;
+	}
+	*count = 2;
+	return 0;
+}
+
+ck_ulong C_GetTokenInfo(ck_ulong slot, unsigned char *info) {
+	memset(info, ' ', 32);
+	memcpy(info, slot == 9 ? "test" : "other", slot == 9 ? 4 : 5);
+	return 0;
+}
+
+ck_ulong C_OpenSession(ck_ulong slot, ck_ulong flags, void *app, void *notify, ck_ulong *session) {
+	*session = slot;
+	return 0;
+}
+
+ck_ulong C_Login(ck_ulong session, ck_ulong user, unsigned char *pin, ck_ulong len) {
+	if (session != 9 || len != 4 || memcmp(pin, "1234", 4) != 0) {
+		return 0xa0;
+	}
+	logged_in = 1;
+	return 0;
+}
+
+ck_ulong C_FindObjectsInit(ck_ulong session, ck_attribute *tmpl, ck_ulong count) {
+	found = 0;
+	for (ck_ulong i = 0; i < count; i++) {
+		if (tmpl[i].type == 0) {
+			find_class = *(ck_ulong *)tmpl[i].value;
+		}
+		if (tmpl[i].type == 3 && (tmpl[i].len != 3 || memcmp(tmpl[i].value, "key", 3) != 0)) {
+			found = 1;
+		}
+	}
+	return 0;
+}
+
+ck_ulong C_FindObjects(ck_ulong session, ck_ulong *objects, ck_ulong max, ck_ulong *count) {
+	*count = 0;
+	if (!found && logged_in) {
+		objects[0] = find_class == 3 ? 100 : 200;
+		*count = 1;
+		found = 1;
+	}
+	return 0;
+}
+
+ck_ulong C_FindObjectsFinal(ck_ulong session) { return 0; }
+
+ck_ulong C_GetAttributeValue(ck_ulong session, ck_ulong object, ck_attribute *tmpl, ck_ulong count) {
+	if (object != 200 || tmpl[0].type != 0x11) {
+		return 0x12;
+	}
+	if (tmpl[0].value != NULL) {
+		memcpy(tmpl[0].value, cert, sizeof(cert) - 1);
+	}
+	tmpl[0].len = sizeof(cert) - 1;
+	return 0;
+}
+
+ck_ulong C_SignInit(ck_ulong session, ck_mechanism *mech, ck_ulong key) {
+	if (key != 100) {
+		return 0x60;
+	}
+	mechanism = mech->mechanism;
+	salt_len = mech->parameter != NULL ? ((ck_rsa_pss_params *)mech->parameter)->salt_len : 0;
+	return 0;
+}
+
+ck_ulong C_Sign(ck_ulong session, unsigned char *data, ck_ulong len, unsigned char *sig, ck_ulong *sig_len) {
+	if (sig != NULL) {
+		sig[0] = (unsigned char)mechanism;
+		sig[1] = (unsigned char)salt_len;
+		memcpy(sig + 2, data, len);
+	}
+	*sig_len = len + 2;
+	return 0;
+}
+`
+
+// buildFakeModule builds fakeModule into a shared library.
+func buildFakeModule(t *testing.T) string {
+	gcc, err := exec.LookPath("gcc")
+	if err != nil {
+		t.Skip("gcc isn't found")
+	}
+
+	dir := t.TempDir()
+	src, lib := filepath.Join(dir, "fake.c"), filepath.Join(dir, "fake.so")
+	os.WriteFile(src, []byte(fakeModule), 0o600)
+
+	if out, err := exec.Command(gcc, "-shared", "-fPIC", "-o", lib, src).CombinedOutput(); err != nil {
+		t.Fatalf("build fake module error: %v: %s", err, out)
+	}
+
+	return lib
+}
+
+func TestOpenPKCS11Key(t *testing.T) {
+	module := buildFakeModule(t)
+
+	key, cert, err := openPKCS11Key(&pkcs11Params{module: module, token: "test", pin: "1234", label: "key"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if string(cert) != "fake-cert" {
+		t.Errorf("got certificate %q", cert)
+	}
+
+	sig, err := key.sign(pkcs11Mechanism{mechanism: ckmRSAPKCSPSS, saltLength: 32}, []byte("digest"))
+	if err != nil || string(sig) != "\x0d\x20digest" {
+		t.Errorf("got signature %q and error %v", sig, err)
+	}
+
+	invalid := []*pkcs11Params{
+		{module: module, token: "test", pin: "0000", label: "key"},
+		{module: module, token: "test", pin: "1234", label: "other"},
+		{module: module, token: "missing", pin: "1234", label: "key"},
+		{module: filepath.Join(t.TempDir(), "missing.so"), label: "key"},
+	}
+
+	for _, p := range invalid {
+		if _, _, err := openPKCS11Key(p); err == nil {
+			t.Errorf("expected error of params %+v", p)
+		}
+	}
+
+	// The certificate is read from the file if it's given.
+	certFile, _ := writeKeyPair(t, t.TempDir())
+
+	provider, err := CreateCredentialProvider("pkcs11", map[string]string{
+		"module": module, "token": "test", "pin": "1234", "label": "key", "cert": certFile,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if c, err := provider.GetClientCertificate(nil); err != nil || c.Leaf == nil {
+		t.Errorf("got certificate %v and error %v", c, err)
+	}
+}
@@ -0,0 +1,25 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !pkcs11 || !cgo || windows
+
+package client
+
+// pkcs11Supported is whether the client is built with PKCS#11.
+const pkcs11Supported = false
+
+// openPKCS11Key is a stub in the builds without PKCS#11, it always returns ErrPKCS11Unsupported.
+func openPKCS11Key(*pkcs11Params) (pkcs11Key, []byte, error) {
+	return nil, nil, ErrPKCS11Unsupported
+}
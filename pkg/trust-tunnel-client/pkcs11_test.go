@@ -0,0 +1,119 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// fakePKCS11Key signs by the PKCS#11 mechanisms with a key in memory.
+type fakePKCS11Key struct {
+	key crypto.Signer
+}
+
+func (k fakePKCS11Key) sign(mech pkcs11Mechanism, data []byte) ([]byte, error) {
+	switch mech.mechanism {
+	case ckmECDSA:
+		r, s, err := ecdsa.Sign(rand.Reader, k.key.(*ecdsa.PrivateKey), data)
+		if err != nil {
+			return nil, err
+		}
+
+		return append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...), nil
+	case ckmRSAPKCS:
+		// The data is the DigestInfo, which is signed as is without a hash.
+		return rsa.SignPKCS1v15(rand.Reader, k.key.(*rsa.PrivateKey), 0, data)
+	case ckmRSAPKCSPSS:
+		if mech.hash != ckmSHA256 || mech.mgf != ckgMGF1SHA256 {
+			return nil, fmt.Errorf("unexpected hash 0x%x and mgf 0x%x", mech.hash, mech.mgf)
+		}
+
+		return rsa.SignPSS(rand.Reader, k.key.(*rsa.PrivateKey), crypto.SHA256, data, &rsa.PSSOptions{SaltLength: int(mech.saltLength)})
+	}
+
+	return nil, fmt.Errorf("unexpected mechanism 0x%x", mech.mechanism)
+}
+
+func TestPKCS11Signer(t *testing.T) {
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	digest := sha256.Sum256([]byte("handshake"))
+
+	signer := &pkcs11Signer{public: &ecKey.PublicKey, key: fakePKCS11Key{ecKey}}
+
+	sig, err := signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil || !ecdsa.VerifyASN1(&ecKey.PublicKey, digest[:], sig) {
+		t.Errorf("invalid ECDSA signature, error: %v", err)
+	}
+
+	signer = &pkcs11Signer{public: &rsaKey.PublicKey, key: fakePKCS11Key{rsaKey}}
+
+	sig, err = signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if err := rsa.VerifyPKCS1v15(&rsaKey.PublicKey, crypto.SHA256, digest[:], sig); err != nil {
+		t.Errorf("invalid RSA PKCS #1 v1.5 signature: %v", err)
+	}
+
+	pss := &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: crypto.SHA256}
+
+	sig, err = signer.Sign(rand.Reader, digest[:], pss)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if err := rsa.VerifyPSS(&rsaKey.PublicKey, crypto.SHA256, digest[:], sig, pss); err != nil {
+		t.Errorf("invalid RSA-PSS signature: %v", err)
+	}
+}
+
+func TestParsePKCS11Params(t *testing.T) {
+	p, err := parsePKCS11Params(map[string]string{"module": "/usr/lib/p11.so", "slot": "2", "id": "0a1b", "pin": "1234"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if *p.slot != 2 || string(p.id) != "\x0a\x1b" || p.pin != "1234" {
+		t.Errorf("got params %+v", p)
+	}
+
+	invalid := []map[string]string{
+		{"label": "key"},
+		{"module": "/usr/lib/p11.so"},
+		{"module": "/usr/lib/p11.so", "id": "xyz"},
+		{"module": "/usr/lib/p11.so", "label": "key", "slot": "first"},
+	}
+
+	for _, params := range invalid {
+		if _, err := parsePKCS11Params(params); err == nil {
+			t.Errorf("expected error of params %v", params)
+		}
+	}
+
+	_, err = CreateCredentialProvider("pkcs11", map[string]string{"module": "/nonexistent.so", "label": "key"})
+	if err == nil || (!pkcs11Supported && !errors.Is(err, ErrPKCS11Unsupported)) {
+		t.Errorf("got error %v", err)
+	}
+}
@@ -0,0 +1,574 @@
+/*
+ * Copyright The TrustTunnel Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package trusttunnel.protocol;
+
+import java.io.ByteArrayOutputStream;
+import java.nio.ByteBuffer;
+import java.nio.charset.StandardCharsets;
+import java.util.AbstractMap;
+import java.util.ArrayList;
+import java.util.Base64;
+import java.util.List;
+import java.util.Map;
+
+/**
+ * Reference codec of the trust-tunnel wire protocol, see ../spec.json.
+ *
+ * <p>It only encodes and decodes the headers and the frames, and has no dependencies, pair it with
+ * any WebSocket library, e.g. java.net.http.WebSocket of Java 11.
+ */
+public final class TrustTunnelProtocol {
+    public static final int VERSION = 8;
+    public static final String PATH = "/exec";
+    public static final String RESIZE_PREFIX = "resize: ";
+    public static final String CLOSE_STDIN = "close stdin";
+    public static final String CLOSE_SESSION = "close session";
+    public static final int MAX_CLOSE_PAYLOAD = 123;
+    public static final String COMMAND_PREFIX = "command: ";
+    public static final int COMMAND_FRAME_VERSION = 2;
+    public static final String CONFIRM_PREFIX = "confirm: ";
+    public static final int CONFIRM_VERSION = 3;
+    public static final int COPY_VERSION = 4;
+    public static final String FORWARD_PATH = "/forward";
+    public static final int FORWARD_VERSION = 5;
+    public static final int OBSERVE_VERSION = 6;
+    public static final int FORWARD_HOST_VERSION = 7;
+    public static final int REVERSE_FORWARD_VERSION = 8;
+
+    public static final byte FORWARD_OPEN = 1;
+    public static final byte FORWARD_DATA = 2;
+    public static final byte FORWARD_CLOSE = 3;
+    public static final byte FORWARD_RESET = 4;
+    public static final int FORWARD_HEADER_LEN = 9;
+    public static final int MAX_FORWARD_PAYLOAD = 32 << 10;
+
+    public static final int CLOSE_NORMAL = 1000;
+    public static final int CLOSE_UNSUPPORTED_DATA = 1003;
+
+    public static final String TARGET_PHYSICAL = "physical";
+    public static final String TARGET_CONTAINER = "container";
+
+    private static final int MAX_WINDOW_SIZE = 65535;
+
+    private TrustTunnelProtocol() {
+    }
+
+    /** Request describes the session to establish, the empty fields are not sent. */
+    public static final class Request {
+        public List<String> command = new ArrayList<>();
+        public String targetType = TARGET_PHYSICAL;
+        public String userName = "";
+        public String loginName = "";
+        public String loginGroup = "";
+        public String agentAddr = "";
+        public String sessionId = "";
+        public String affinityToken = "";
+        public String podName = "";
+        public String containerName = "";
+        public String containerId = "";
+        public String ipAddress = "";
+        public boolean interactive;
+        public boolean tty;
+        public String shell = "";
+        public boolean tools;
+        public double cpus;
+        public int memoryMB;
+        public boolean disableCleanMode;
+        public String appName = "";
+        public String jumpTarget = "";
+    }
+
+    /**
+     * Returns the headers of the request establishing a session in order, a header may be repeated.
+     * The command is always sent in Command-Base64-Encode, one header per argument.
+     */
+    public static List<Map.Entry<String, String>> requestHeaders(Request req) {
+        if (!TARGET_PHYSICAL.equals(req.targetType) && !TARGET_CONTAINER.equals(req.targetType)) {
+            throw new IllegalArgumentException("invalid target type " + req.targetType);
+        }
+        if (TARGET_CONTAINER.equals(req.targetType) && isEmpty(req.podName)) {
+            throw new IllegalArgumentException("pod name is required for container targets");
+        }
+        if (req.command == null || req.command.isEmpty()) {
+            throw new IllegalArgumentException("no command");
+        }
+
+        List<Map.Entry<String, String>> headers = new ArrayList<>();
+        add(headers, "Session-Id", req.sessionId);
+        add(headers, "Affinity-Token", req.affinityToken);
+        add(headers, "User-Name", req.userName);
+        add(headers, "Login-Name", req.loginName);
+        add(headers, "Login-Group", req.loginGroup);
+        add(headers, "Agent-Addr", req.agentAddr);
+        add(headers, "Ip-Address", req.ipAddress);
+        add(headers, "Target-Type", req.targetType);
+        add(headers, "Pod-Name", req.podName);
+        add(headers, "Container-Name", req.containerName);
+        add(headers, "Container-Id", req.containerId);
+        add(headers, "Interactive", Boolean.toString(req.interactive));
+        add(headers, "Tty", Boolean.toString(req.tty));
+        for (String arg : req.command) {
+            add(headers, "Command-Base64-Encode",
+                    Base64.getEncoder().encodeToString(arg.getBytes(StandardCharsets.UTF_8)));
+        }
+        add(headers, "Shell", req.shell);
+        add(headers, "Tools", req.tools ? "1" : "");
+        add(headers, "Cpus", req.cpus > 0 ? Double.toString(req.cpus) : "");
+        add(headers, "Memory", req.memoryMB > 0 ? Integer.toString(req.memoryMB) : "");
+        add(headers, "Disable-Clean-Mode", req.disableCleanMode ? "1" : "");
+        add(headers, "App-Name", req.appName);
+        add(headers, "Jump-Target", req.jumpTarget);
+
+        return headers;
+    }
+
+    /** Decodes the values of the Command-Base64-Encode header. */
+    public static List<String> decodeCommand(List<String> values) {
+        List<String> command = new ArrayList<>();
+        for (String value : values) {
+            command.add(new String(Base64.getDecoder().decode(value), StandardCharsets.UTF_8));
+        }
+
+        return command;
+    }
+
+    /**
+     * Returns the text frame carrying the command, sent first with the headers Protocol-Version of
+     * COMMAND_FRAME_VERSION and Command-Frame of its length in UTF-8 instead of Command-Base64-Encode.
+     */
+    public static String encodeCommandFrame(List<String> command) {
+        StringBuilder sb = new StringBuilder(COMMAND_PREFIX).append('[');
+        for (int i = 0; i < command.size(); i++) {
+            if (i > 0) {
+                sb.append(',');
+            }
+            // The base64 alphabet needs no escaping in JSON strings.
+            sb.append('"')
+                    .append(Base64.getEncoder().encodeToString(command.get(i).getBytes(StandardCharsets.UTF_8)))
+                    .append('"');
+        }
+
+        return sb.append(']').toString();
+    }
+
+    /** Decodes the reply of the agent to the command frame into session_id, affinity_token and mfa. */
+    public static Map<String, Object> decodeCommandReply(String msg) {
+        if (!msg.startsWith(COMMAND_PREFIX)) {
+            throw new IllegalArgumentException("not a command reply");
+        }
+
+        return new JsonParser(msg.substring(COMMAND_PREFIX.length())).parseObject();
+    }
+
+    /**
+     * Decodes the command resolved by the agent, sent if the header Confirm is "1", into cmd as the list of the
+     * arguments, user, dir, target and reattach. It's answered by encodeConfirmAnswer unless reattach is true.
+     */
+    public static Map<String, Object> decodeConfirmation(String msg) {
+        if (!msg.startsWith(CONFIRM_PREFIX)) {
+            throw new IllegalArgumentException("not a confirmation");
+        }
+
+        Map<String, Object> confirmation = new JsonParser(msg.substring(CONFIRM_PREFIX.length())).parseObject();
+        List<String> values = new ArrayList<>();
+        if (confirmation.get("cmd") instanceof List) {
+            for (Object value : (List<?>) confirmation.get("cmd")) {
+                values.add(String.valueOf(value));
+            }
+        }
+        confirmation.put("cmd", decodeCommand(values));
+
+        return confirmation;
+    }
+
+    /** Returns the text frame answering the confirmation, the command is run only if it's confirmed. */
+    public static String encodeConfirmAnswer(boolean confirmed) {
+        return CONFIRM_PREFIX + (confirmed ? "yes" : "no");
+    }
+
+    /** Returns the text frame resizing the terminal. */
+    public static String encodeResize(int height, int width) {
+        return RESIZE_PREFIX + height + "," + width;
+    }
+
+    /** Decodes the text frame resizing the terminal, returns {height, width} or null if it's invalid. */
+    public static int[] decodeResize(String msg) {
+        if (!msg.startsWith(RESIZE_PREFIX)) {
+            return null;
+        }
+
+        String[] vals = msg.substring(RESIZE_PREFIX.length()).split(",", -1);
+        if (vals.length != 2) {
+            return null;
+        }
+
+        int height;
+        int width;
+        try {
+            height = Integer.parseInt(vals[0]);
+            width = Integer.parseInt(vals[1]);
+        } catch (NumberFormatException e) {
+            return null;
+        }
+
+        if (height <= 0 || width <= 0 || height > MAX_WINDOW_SIZE || width > MAX_WINDOW_SIZE) {
+            return null;
+        }
+
+        return new int[] {height, width};
+    }
+
+    /** Returns the forward frame of the stream, sent as (a part of) a binary frame on the forward endpoint. */
+    public static byte[] encodeForwardFrame(byte type, int stream, byte[] payload) {
+        if (payload.length > MAX_FORWARD_PAYLOAD) {
+            throw new IllegalArgumentException("forward frame of " + payload.length + " bytes exceeds the limit");
+        }
+
+        return ByteBuffer.allocate(FORWARD_HEADER_LEN + payload.length)
+                .put(type).putInt(stream).putInt(payload.length).put(payload).array();
+    }
+
+    /** ForwardFrame is a frame of the streams forwarded over the binary frames of the forward endpoint. */
+    public static final class ForwardFrame {
+        public final byte type;
+        /** The stream ID, an unsigned 32-bit integer. */
+        public final int stream;
+        public final byte[] payload;
+
+        ForwardFrame(byte type, int stream, byte[] payload) {
+            this.type = type;
+            this.stream = stream;
+            this.payload = payload;
+        }
+    }
+
+    /** ForwardDecoder decodes the forward frames from the binary frames, which may split or join them. */
+    public static final class ForwardDecoder {
+        private final ByteArrayOutputStream buf = new ByteArrayOutputStream();
+
+        /** Feeds the data of a binary frame, returns the complete forward frames. */
+        public List<ForwardFrame> feed(byte[] data) {
+            buf.write(data, 0, data.length);
+
+            ByteBuffer b = ByteBuffer.wrap(buf.toByteArray());
+            List<ForwardFrame> frames = new ArrayList<>();
+            while (b.remaining() >= FORWARD_HEADER_LEN) {
+                b.mark();
+
+                byte type = b.get();
+                int stream = b.getInt();
+                int length = b.getInt();
+                if (type < FORWARD_OPEN || type > FORWARD_RESET) {
+                    throw new IllegalArgumentException("invalid forward frame type " + type);
+                }
+                if (length < 0 || length > MAX_FORWARD_PAYLOAD) {
+                    throw new IllegalArgumentException("forward frame exceeds the limit");
+                }
+                if (b.remaining() < length) {
+                    b.reset();
+                    break;
+                }
+
+                byte[] payload = new byte[length];
+                b.get(payload);
+                frames.add(new ForwardFrame(type, stream, payload));
+            }
+
+            buf.reset();
+            buf.write(b.array(), b.position(), b.remaining());
+
+            return frames;
+        }
+    }
+
+    /** Truncates the payload of a close frame to the maximum length in bytes. */
+    public static String truncateClosePayload(String payload) {
+        byte[] b = payload.getBytes(StandardCharsets.UTF_8);
+        if (b.length <= MAX_CLOSE_PAYLOAD) {
+            return payload;
+        }
+
+        // Cut at a character boundary, so the payload is still valid UTF-8.
+        int n = MAX_CLOSE_PAYLOAD;
+        while (n > 0 && (b[n] & 0xC0) == 0x80) {
+            n--;
+        }
+
+        return new String(b, 0, n, StandardCharsets.UTF_8);
+    }
+
+    /** CloseStatus is the result of a session carried by the close frame. */
+    public static final class CloseStatus {
+        /** The exit code of the command, -1 if it didn't exit. */
+        public final int exitCode;
+        /** The error message of the agent, or null. */
+        public final String error;
+        /** The termination reason, empty if the agent doesn't report it. */
+        public final String reason;
+
+        public CloseStatus(int exitCode, String error, String reason) {
+            this.exitCode = exitCode;
+            this.error = error;
+            this.reason = reason;
+        }
+
+        @Override
+        public String toString() {
+            return "CloseStatus{exitCode=" + exitCode + ", error=" + error + ", reason=" + reason + "}";
+        }
+    }
+
+    /** Decodes the close frame, code is null if the connection is closed without a close frame. */
+    public static CloseStatus decodeClose(Integer code, String payload) {
+        if (payload == null) {
+            payload = "";
+        }
+        if (code == null) {
+            return new CloseStatus(-1, "connection closed abnormally", "");
+        }
+        if (code != CLOSE_NORMAL) {
+            return new CloseStatus(-1, isEmpty(payload) ? "connection closed with code " + code : payload, "");
+        }
+
+        Map<String, Object> msg;
+        try {
+            msg = new JsonParser(payload).parseObject();
+        } catch (IllegalArgumentException e) {
+            // Older agents send a plain text error.
+            return new CloseStatus(-1, isEmpty(payload) ? null : payload, "");
+        }
+
+        Object exitCode = msg.get("Code");
+        if (!(exitCode instanceof Long)) {
+            return new CloseStatus(-1, payload, "");
+        }
+
+        Object err = msg.get("Err");
+        Object reason = msg.get("Reason");
+
+        return new CloseStatus(((Long) exitCode).intValue(), err instanceof String ? (String) err : null,
+                reason instanceof String ? (String) reason : "");
+    }
+
+    private static void add(List<Map.Entry<String, String>> headers, String name, String value) {
+        if (!isEmpty(value)) {
+            headers.add(new AbstractMap.SimpleImmutableEntry<>(name, value));
+        }
+    }
+
+    private static boolean isEmpty(String s) {
+        return s == null || s.isEmpty();
+    }
+
+    /** JsonParser parses the flat JSON objects of the frames, nested objects are skipped. */
+    private static final class JsonParser {
+        private final String s;
+        private int pos;
+
+        JsonParser(String s) {
+            this.s = s;
+        }
+
+        Map<String, Object> parseObject() {
+            Map<String, Object> obj = new java.util.HashMap<>();
+            skipSpaces();
+            expect('{');
+            skipSpaces();
+            if (peek() == '}') {
+                pos++;
+                return finish(obj);
+            }
+            while (true) {
+                skipSpaces();
+                String key = parseString();
+                skipSpaces();
+                expect(':');
+                obj.put(key, parseValue());
+                skipSpaces();
+                char c = next();
+                if (c == '}') {
+                    return finish(obj);
+                }
+                if (c != ',') {
+                    throw new IllegalArgumentException("expected , or } at " + (pos - 1));
+                }
+            }
+        }
+
+        private Map<String, Object> finish(Map<String, Object> obj) {
+            skipSpaces();
+            if (pos != s.length()) {
+                throw new IllegalArgumentException("trailing data at " + pos);
+            }
+
+            return obj;
+        }
+
+        private Object parseValue() {
+            skipSpaces();
+            char c = peek();
+            if (c == '"') {
+                return parseString();
+            }
+            if (c == '[') {
+                return parseArray();
+            }
+            if (c == '{') {
+                skipNested();
+                return null;
+            }
+            if (s.startsWith("null", pos)) {
+                pos += 4;
+                return null;
+            }
+            if (s.startsWith("true", pos)) {
+                pos += 4;
+                return Boolean.TRUE;
+            }
+            if (s.startsWith("false", pos)) {
+                pos += 5;
+                return Boolean.FALSE;
+            }
+
+            int start = pos;
+            while (pos < s.length() && "+-0123456789.eE".indexOf(s.charAt(pos)) >= 0) {
+                pos++;
+            }
+            String num = s.substring(start, pos);
+            try {
+                return Long.parseLong(num);
+            } catch (NumberFormatException e) {
+                try {
+                    return Double.parseDouble(num);
+                } catch (NumberFormatException e2) {
+                    throw new IllegalArgumentException("invalid value at " + start);
+                }
+            }
+        }
+
+        private List<Object> parseArray() {
+            List<Object> list = new ArrayList<>();
+            expect('[');
+            skipSpaces();
+            if (peek() == ']') {
+                pos++;
+                return list;
+            }
+            while (true) {
+                list.add(parseValue());
+                skipSpaces();
+                char c = next();
+                if (c == ']') {
+                    return list;
+                }
+                if (c != ',') {
+                    throw new IllegalArgumentException("expected , or ] at " + (pos - 1));
+                }
+            }
+        }
+
+        private String parseString() {
+            expect('"');
+            StringBuilder sb = new StringBuilder();
+            while (true) {
+                char c = next();
+                if (c == '"') {
+                    return sb.toString();
+                }
+                if (c != '\\') {
+                    sb.append(c);
+                    continue;
+                }
+                c = next();
+                switch (c) {
+                    case 'b':
+                        sb.append('\b');
+                        break;
+                    case 'f':
+                        sb.append('\f');
+                        break;
+                    case 'n':
+                        sb.append('\n');
+                        break;
+                    case 'r':
+                        sb.append('\r');
+                        break;
+                    case 't':
+                        sb.append('\t');
+                        break;
+                    case 'u':
+                        if (pos + 4 > s.length()) {
+                            throw new IllegalArgumentException("invalid escape at " + pos);
+                        }
+                        try {
+                            sb.append((char) Integer.parseInt(s.substring(pos, pos + 4), 16));
+                        } catch (NumberFormatException e) {
+                            throw new IllegalArgumentException("invalid escape at " + pos);
+                        }
+                        pos += 4;
+                        break;
+                    default:
+                        sb.append(c);
+                }
+            }
+        }
+
+        private void skipNested() {
+            int depth = 0;
+            do {
+                char c = peek();
+                if (c == '"') {
+                    parseString();
+                    continue;
+                }
+                pos++;
+                if (c == '{' || c == '[') {
+                    depth++;
+                } else if (c == '}' || c == ']') {
+                    depth--;
+                }
+            } while (depth > 0);
+        }
+
+        private void skipSpaces() {
+            while (pos < s.length() && Character.isWhitespace(s.charAt(pos))) {
+                pos++;
+            }
+        }
+
+        private void expect(char c) {
+            if (next() != c) {
+                throw new IllegalArgumentException("expected " + c + " at " + (pos - 1));
+            }
+        }
+
+        private char peek() {
+            if (pos >= s.length()) {
+                throw new IllegalArgumentException("unexpected end of JSON");
+            }
+
+            return s.charAt(pos);
+        }
+
+        private char next() {
+            char c = peek();
+            pos++;
+
+            return c;
+        }
+    }
+}
@@ -0,0 +1,522 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package protocol is the wire protocol between the clients and the agents. spec.json is its machine-readable
+// specification for the clients on other platforms, and this package is the reference codec in Go.
+// The reference codecs in other languages are under the directories named after them.
+package protocol
+
+import (
+	_ "embed"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// The constants of the protocol, see spec.json for the details.
+const (
+	// Version is the latest version of the protocol, the agents serve all the versions up to it.
+	Version = 8
+
+	// Path is the path of the WebSocket endpoint of sessions.
+	Path = "/exec"
+
+	// ResizePrefix is the prefix of the text frames resizing the terminal, followed by "height,width".
+	ResizePrefix = "resize: "
+
+	// CloseStdin is the text frame closing the input of the command.
+	CloseStdin = "close stdin"
+
+	// CloseSession is the text frame terminating the session.
+	CloseSession = "close session"
+
+	// MaxClosePayload is the maximum length of the payloads of close frames.
+	MaxClosePayload = 123
+
+	// HeaderMFA is the request header of the clients able to answer MFA challenges, and the response header
+	// telling the client that the challenge follows.
+	HeaderMFA = "Mfa"
+
+	// HeaderLogs is the request header attaching to the output of the main process of the container instead of
+	// running a command, "1" to attach. HeaderLogsFollow and HeaderLogsTail tell whether to follow the output and
+	// how many of the last lines to show.
+	HeaderLogs       = "Logs"
+	HeaderLogsFollow = "Logs-Follow"
+	HeaderLogsTail   = "Logs-Tail"
+
+	// HeaderFileVerb is the request header reading the file of HeaderFilePath in the target by the agent instead
+	// of running a command, "cat", "tail" or "stat". HeaderFileLines is the number of the last lines of "tail".
+	HeaderFileVerb  = "File-Verb"
+	HeaderFilePath  = "File-Path"
+	HeaderFileLines = "File-Lines"
+
+	// HeaderCopy is the request header copying the files to or from the target by the agent as a tar stream
+	// instead of running a command, "to" to extract the stream of the input into the directory of HeaderCopyPath,
+	// or "from" to output the stream of the file or the directory of HeaderCopyPath. It requires the version
+	// CopyVersion.
+	HeaderCopy     = "Copy"
+	HeaderCopyPath = "Copy-Path"
+	CopyTo         = "to"
+	CopyFrom       = "from"
+
+	// CopyVersion is the version of the protocol supporting HeaderCopy.
+	CopyVersion = 4
+
+	// ForwardPath is the path of the WebSocket endpoint forwarding the TCP connections to HeaderForwardPort on the
+	// loopback of the target's network namespace instead of running a command. The connections are multiplexed as
+	// the forward frames in the binary frames of both directions. It requires the version ForwardVersion.
+	ForwardPath       = "/forward"
+	HeaderForwardPort = "Forward-Port"
+
+	// ForwardVersion is the version of the protocol supporting ForwardPath.
+	ForwardVersion = 5
+
+	// HeaderForwardHost is the request header of the host the connections are forwarded to instead of the loopback,
+	// resolved by the agent with the hosts file and the name servers of the target. It requires the version
+	// ForwardHostVersion.
+	HeaderForwardHost = "Forward-Host"
+
+	// ForwardHostVersion is the version of the protocol supporting HeaderForwardHost.
+	ForwardHostVersion = 7
+
+	// HeaderForwardReverse is the request header reversing the forward, "1" to reverse: the agent listens on
+	// HeaderForwardPort of the loopback of the target's network namespace and opens a stream for each connection
+	// accepted, which the client forwards to its local port. It requires the version ReverseForwardVersion.
+	HeaderForwardReverse = "Forward-Reverse"
+
+	// ReverseForwardVersion is the version of the protocol supporting HeaderForwardReverse.
+	ReverseForwardVersion = 8
+
+	// The types of the forward frames. ForwardOpen opens the stream of the ID given by the client, ForwardData
+	// carries its data, ForwardClose tells that the sender sends no more data on it, and ForwardReset aborts it,
+	// with the error as the payload.
+	ForwardOpen  = 1
+	ForwardData  = 2
+	ForwardClose = 3
+	ForwardReset = 4
+
+	// ForwardHeaderLen is the length of the header of the forward frames: the type, the stream ID and the length of
+	// the payload, the latter two in big endian.
+	ForwardHeaderLen = 9
+
+	// MaxForwardPayload is the maximum length of the payloads of the forward frames.
+	MaxForwardPayload = 32 << 10
+
+	// HeaderObserve is the request header attaching to the live session of Session-Id as a read-only observer
+	// instead of running a command, "1" to observe. The observer receives the output of the session and its input is
+	// discarded. It requires the version ObserveVersion.
+	HeaderObserve = "Observe"
+
+	// ObserveVersion is the version of the protocol supporting HeaderObserve.
+	ObserveVersion = 6
+
+	// HeaderTop is the request header printing the snapshot of the target as JSON instead of running a command.
+	HeaderTop = "Top"
+
+	// HeaderVerb is the request header running the verb registered in the agent instead of a command, and
+	// HeaderVerbArgs are its arguments, encoded as Command-Base64-Encode.
+	HeaderVerb     = "Verb"
+	HeaderVerbArgs = "Verb-Args"
+
+	// HeaderTag is the request header tagging the session with "key=value", repeated for each tag.
+	HeaderTag = "Tag"
+
+	// HeaderEnv is the request header forwarding the environment variable of the client as "NAME=value", e.g. the
+	// terminal type and the locale, repeated for each variable.
+	HeaderEnv = "Env"
+
+	// HeaderFrameProfile is the request header selecting the tuning profile of the output frames, FrameProfileBulk
+	// for high-throughput transfers, e.g. large cats, or FrameProfileDefault. HeaderFrameSize is the request header
+	// of the size of the output frames in bytes, bounded by the agent, and the response header of the size chosen.
+	// The agents not answering HeaderFrameSize use their own sizes.
+	HeaderFrameProfile = "Frame-Profile"
+	HeaderFrameSize    = "Frame-Size"
+
+	// The tuning profiles of the output frames.
+	FrameProfileDefault = "default"
+	FrameProfileBulk    = "bulk"
+
+	// HeaderProtocolVersion is the request header of the version of the protocol required by the client, and the
+	// response header of the latest version served by the agent. It's 1 if absent.
+	HeaderProtocolVersion = "Protocol-Version"
+
+	// HeaderCommandFrame is the request header of the length of the command frame, which carries the command
+	// instead of the command headers, e.g. for the long scripts exceeding the header limits of proxies.
+	// It requires the version CommandFrameVersion.
+	HeaderCommandFrame = "Command-Frame"
+
+	// CommandFrameVersion is the version of the protocol supporting HeaderCommandFrame.
+	CommandFrameVersion = 2
+
+	// CommandPrefix is the prefix of the command frame of the client, followed by the JSON array of the arguments
+	// encoded as Command-Base64-Encode, and of its reply of the agent, followed by the JSON of CommandReply.
+	CommandPrefix = "command: "
+
+	// HeaderConfirm is the request header of the clients confirming the command resolved by the agent before it's
+	// run, "1" to confirm. It requires the command frame and the version ConfirmVersion of the agent, which is told
+	// before the command is sent, so that the agents unable to ask for the confirmation never receive the command.
+	HeaderConfirm = "Confirm"
+
+	// ConfirmVersion is the version of the protocol supporting HeaderConfirm.
+	ConfirmVersion = 3
+
+	// ConfirmPrefix is the prefix of the text frame of the agent echoing the resolved command, followed by the JSON
+	// of Confirmation, and of the answer of the client, followed by ConfirmYes or ConfirmNo.
+	ConfirmPrefix = "confirm: "
+	ConfirmYes    = "yes"
+	ConfirmNo     = "no"
+
+	// MFAPrefix is the prefix of the text frames carrying the MFA challenge of the agent and the assertion
+	// of the client.
+	MFAPrefix = "mfa: "
+
+	// HeaderRetryAfter is the response header of the sessions refused for the limits of the agent, telling
+	// the seconds to retry after.
+	HeaderRetryAfter = "Retry-After"
+
+	// HeaderSidecarOccupancy is the response header of the sessions refused for the limits of the agent,
+	// telling the sidecars of the node against the limit as "current/limit".
+	HeaderSidecarOccupancy = "Sidecar-Occupancy"
+
+	// HeaderContainerSidecarOccupancy is as HeaderSidecarOccupancy, but of the target container.
+	HeaderContainerSidecarOccupancy = "Container-Sidecar-Occupancy"
+)
+
+//go:embed spec.json
+var specJSON []byte
+
+// Spec is the machine-readable specification of the protocol, only the fields used by the codecs are decoded.
+type Spec struct {
+	Name           string   `json:"name"`
+	Version        int      `json:"version"`
+	Endpoint       Endpoint `json:"endpoint"`
+	RequestHeaders []Header `json:"requestHeaders"`
+	Rejection      struct {
+		Status  int      `json:"status"`
+		Headers []Header `json:"headers"`
+	} `json:"rejection"`
+	Frames struct {
+		Client []Frame `json:"client"`
+		Agent  []Frame `json:"agent"`
+	} `json:"frames"`
+	Close struct {
+		MaxPayload int `json:"maxPayload"`
+	} `json:"close"`
+	TerminationReasons []struct {
+		Reason string `json:"reason"`
+	} `json:"terminationReasons"`
+	Forward struct {
+		Path  string `json:"path"`
+		Frame struct {
+			HeaderLength int `json:"headerLength"`
+			MaxPayload   int `json:"maxPayload"`
+			Types        []struct {
+				Name string `json:"name"`
+				Type byte   `json:"type"`
+			} `json:"types"`
+		} `json:"frame"`
+	} `json:"forward"`
+}
+
+// Endpoint is the WebSocket endpoint of sessions.
+type Endpoint struct {
+	Method string `json:"method"`
+	Path   string `json:"path"`
+}
+
+// Header is a header of the requests or the responses establishing sessions.
+type Header struct {
+	Name     string   `json:"name"`
+	Type     string   `json:"type"`
+	Values   []string `json:"values,omitempty"`
+	Repeated bool     `json:"repeated,omitempty"`
+}
+
+// Frame is a WebSocket frame of sessions.
+type Frame struct {
+	Name   string `json:"name"`
+	Opcode string `json:"opcode"`
+	Format string `json:"format,omitempty"`
+}
+
+// SpecJSON returns the machine-readable specification of the protocol.
+func SpecJSON() []byte {
+	return specJSON
+}
+
+// LoadSpec decodes the machine-readable specification of the protocol.
+func LoadSpec() (*Spec, error) {
+	var spec Spec
+	if err := json.Unmarshal(specJSON, &spec); err != nil {
+		return nil, fmt.Errorf("decode protocol spec error: %v", err)
+	}
+
+	return &spec, nil
+}
+
+// FormatOccupancy returns the value of the occupancy headers.
+func FormatOccupancy(current, limit int) string {
+	return fmt.Sprintf("%d/%d", current, limit)
+}
+
+// ParseOccupancy parses the value of the occupancy headers, and returns whether it's valid.
+func ParseOccupancy(s string) (int, int, bool) {
+	currentStr, limitStr, ok := strings.Cut(s, "/")
+	if !ok {
+		return 0, 0, false
+	}
+
+	current, err1 := strconv.Atoi(currentStr)
+	limit, err2 := strconv.Atoi(limitStr)
+
+	return current, limit, err1 == nil && err2 == nil
+}
+
+// CommandReply is the reply of the agent to the command frame once the session is authorized. The response headers
+// of the session are repeated in it, for they are issued by the target agent after the handshake with a jump agent.
+type CommandReply struct {
+	SessionID     string `json:"session_id,omitempty"`
+	AffinityToken string `json:"affinity_token,omitempty"`
+	// MFA is the type of the MFA challenge following the reply, as the HeaderMFA response header.
+	MFA string `json:"mfa,omitempty"`
+}
+
+// EncodeCommandFrame returns the text frame carrying the command.
+func EncodeCommandFrame(cmd []string) []byte {
+	b, _ := json.Marshal(EncodeCommand(cmd))
+
+	return append([]byte(CommandPrefix), b...)
+}
+
+// DecodeCommandFrame decodes the text frame carrying the command.
+func DecodeCommandFrame(msg []byte) ([]string, error) {
+	if !strings.HasPrefix(string(msg), CommandPrefix) {
+		return nil, fmt.Errorf("not a command frame")
+	}
+
+	var values []string
+	if err := json.Unmarshal(msg[len(CommandPrefix):], &values); err != nil {
+		return nil, fmt.Errorf("invalid command frame: %v", err)
+	}
+
+	if len(values) == 0 {
+		return nil, fmt.Errorf("invalid command frame: no command")
+	}
+
+	return DecodeCommand(values)
+}
+
+// EncodeCommandReply returns the text frame replying the command frame.
+func EncodeCommandReply(reply *CommandReply) []byte {
+	b, _ := json.Marshal(reply)
+
+	return append([]byte(CommandPrefix), b...)
+}
+
+// DecodeCommandReply decodes the text frame replying the command frame.
+func DecodeCommandReply(msg []byte) (*CommandReply, error) {
+	if !strings.HasPrefix(string(msg), CommandPrefix) {
+		return nil, fmt.Errorf("not a command reply")
+	}
+
+	var reply CommandReply
+	if err := json.Unmarshal(msg[len(CommandPrefix):], &reply); err != nil {
+		return nil, fmt.Errorf("invalid command reply: %v", err)
+	}
+
+	return &reply, nil
+}
+
+// Confirmation is the command resolved by the agent, echoed to the client for the confirmation before it's run.
+type Confirmation struct {
+	// Cmd is the command as it's run in the target, e.g. with the shell resolved and the login directory entered.
+	Cmd []string `json:"-"`
+
+	// User is the login user running the command, and Dir is its working directory.
+	User string `json:"user,omitempty"`
+	Dir  string `json:"dir,omitempty"`
+
+	// Target is the ID of the target container, empty for the host.
+	Target string `json:"target,omitempty"`
+
+	// Reattach tells that the session is reattached instead of running the command, no answer is expected then.
+	Reattach bool `json:"reattach,omitempty"`
+}
+
+// confirmationJSON is the JSON of Confirmation, the arguments of the command are encoded as Command-Base64-Encode,
+// so that the bytes echoed are exactly the ones run.
+type confirmationJSON struct {
+	Confirmation
+	Cmd []string `json:"cmd"`
+}
+
+// EncodeConfirmation returns the text frame echoing the resolved command.
+func EncodeConfirmation(confirmation *Confirmation) []byte {
+	b, _ := json.Marshal(&confirmationJSON{Confirmation: *confirmation, Cmd: EncodeCommand(confirmation.Cmd)})
+
+	return append([]byte(ConfirmPrefix), b...)
+}
+
+// DecodeConfirmation decodes the text frame echoing the resolved command.
+func DecodeConfirmation(msg []byte) (*Confirmation, error) {
+	if !strings.HasPrefix(string(msg), ConfirmPrefix) {
+		return nil, fmt.Errorf("not a confirmation")
+	}
+
+	var decoded confirmationJSON
+	if err := json.Unmarshal(msg[len(ConfirmPrefix):], &decoded); err != nil {
+		return nil, fmt.Errorf("invalid confirmation: %v", err)
+	}
+
+	cmd, err := DecodeCommand(decoded.Cmd)
+	if err != nil {
+		return nil, fmt.Errorf("invalid confirmation: %v", err)
+	}
+
+	decoded.Confirmation.Cmd = cmd
+
+	return &decoded.Confirmation, nil
+}
+
+// EncodeConfirmAnswer returns the text frame answering the confirmation.
+func EncodeConfirmAnswer(confirmed bool) []byte {
+	if confirmed {
+		return []byte(ConfirmPrefix + ConfirmYes)
+	}
+
+	return []byte(ConfirmPrefix + ConfirmNo)
+}
+
+// DecodeConfirmAnswer decodes the text frame answering the confirmation, and returns whether it's confirmed.
+func DecodeConfirmAnswer(msg []byte) (bool, error) {
+	switch string(msg) {
+	case ConfirmPrefix + ConfirmYes:
+		return true, nil
+	case ConfirmPrefix + ConfirmNo:
+		return false, nil
+	}
+
+	return false, fmt.Errorf("invalid confirmation answer")
+}
+
+// EncodeResize returns the text frame resizing the terminal.
+func EncodeResize(height, width int) []byte {
+	return []byte(fmt.Sprintf("%s%d,%d", ResizePrefix, height, width))
+}
+
+// DecodeResize decodes the text frame resizing the terminal, and returns whether it's valid.
+// The size must fit in the window size of terminals.
+func DecodeResize(msg []byte) (int, int, bool) {
+	if !strings.HasPrefix(string(msg), ResizePrefix) {
+		return 0, 0, false
+	}
+
+	vals := strings.Split(strings.TrimPrefix(string(msg), ResizePrefix), ",")
+	if len(vals) != 2 {
+		return 0, 0, false
+	}
+
+	h, _ := strconv.Atoi(vals[0])
+	w, _ := strconv.Atoi(vals[1])
+
+	if h <= 0 || w <= 0 || h > math.MaxUint16 || w > math.MaxUint16 {
+		return 0, 0, false
+	}
+
+	return h, w, true
+}
+
+// EncodeCommand returns the values of the Command-Base64-Encode header of the command.
+func EncodeCommand(cmd []string) []string {
+	encoded := make([]string, 0, len(cmd))
+	for _, arg := range cmd {
+		encoded = append(encoded, base64.StdEncoding.EncodeToString([]byte(arg)))
+	}
+
+	return encoded
+}
+
+// DecodeCommand decodes the values of the Command-Base64-Encode header.
+func DecodeCommand(values []string) ([]string, error) {
+	cmd := make([]string, 0, len(values))
+
+	for _, value := range values {
+		arg, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return nil, err
+		}
+
+		cmd = append(cmd, string(arg))
+	}
+
+	return cmd, nil
+}
+
+// ForwardFrame is a frame of the streams forwarded over the binary frames of ForwardPath.
+type ForwardFrame struct {
+	Type    byte
+	Stream  uint32
+	Payload []byte
+}
+
+// EncodeForwardFrame returns the forward frame. The payload must not exceed MaxForwardPayload.
+func EncodeForwardFrame(typ byte, stream uint32, payload []byte) []byte {
+	b := make([]byte, ForwardHeaderLen+len(payload))
+	b[0] = typ
+	binary.BigEndian.PutUint32(b[1:5], stream)
+	binary.BigEndian.PutUint32(b[5:9], uint32(len(payload)))
+	copy(b[ForwardHeaderLen:], payload)
+
+	return b
+}
+
+// ReadForwardFrame reads the next forward frame. The binary frames of WebSocket may split or join the forward
+// frames, so they are read from the stream of their data.
+func ReadForwardFrame(r io.Reader) (*ForwardFrame, error) {
+	var header [ForwardHeaderLen]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+
+	frame := &ForwardFrame{Type: header[0], Stream: binary.BigEndian.Uint32(header[1:5])}
+	if frame.Type < ForwardOpen || frame.Type > ForwardReset {
+		return nil, fmt.Errorf("invalid forward frame type %d", frame.Type)
+	}
+
+	n := binary.BigEndian.Uint32(header[5:9])
+	if n > MaxForwardPayload {
+		return nil, fmt.Errorf("forward frame of %d bytes exceeds the limit", n)
+	}
+
+	frame.Payload = make([]byte, n)
+	if _, err := io.ReadFull(r, frame.Payload); err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	return frame, nil
+}
+
+// TruncateClosePayload truncates the payload to fit in close frames.
+func TruncateClosePayload(payload string) string {
+	if len(payload) > MaxClosePayload {
+		return payload[:MaxClosePayload]
+	}
+
+	return payload
+}
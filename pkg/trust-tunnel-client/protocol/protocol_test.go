@@ -0,0 +1,208 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package protocol
+
+import (
+	"bytes"
+	"io"
+	"math"
+	"net/http"
+	"reflect"
+	"testing"
+	"testing/iotest"
+)
+
+func FuzzDecodeResize(f *testing.F) {
+	f.Add([]byte("resize: 24,80"))
+	f.Add([]byte("resize: 0,80"))
+	f.Add([]byte("resize: 99999999999999999999,1"))
+	f.Add([]byte("resize: -1,,"))
+
+	f.Fuzz(func(t *testing.T, msg []byte) {
+		h, w, ok := DecodeResize(msg)
+		if !ok {
+			return
+		}
+
+		if h <= 0 || w <= 0 || h > math.MaxUint16 || w > math.MaxUint16 {
+			t.Errorf("invalid size %d*%d is accepted from %q", h, w, msg)
+		}
+
+		if h2, w2, ok := DecodeResize(EncodeResize(h, w)); !ok || h2 != h || w2 != w {
+			t.Errorf("expected size %d*%d, got %d*%d", h, w, h2, w2)
+		}
+	})
+}
+
+func TestCommand(t *testing.T) {
+	cmd := []string{"sh", "-c", "echo 'multi\nline' | grep \u4e2d"}
+
+	decoded, err := DecodeCommand(EncodeCommand(cmd))
+	if err != nil || !reflect.DeepEqual(decoded, cmd) {
+		t.Errorf("expected %q, got %q %v", cmd, decoded, err)
+	}
+
+	if _, err = DecodeCommand([]string{"not base64"}); err == nil {
+		t.Error("expected error for invalid base64")
+	}
+}
+
+func TestCommandFrame(t *testing.T) {
+	cmd := []string{"sh", "-c", "echo 'multi\nline' | grep \u4e2d"}
+
+	decoded, err := DecodeCommandFrame(EncodeCommandFrame(cmd))
+	if err != nil || !reflect.DeepEqual(decoded, cmd) {
+		t.Errorf("expected %q, got %q %v", cmd, decoded, err)
+	}
+
+	for _, msg := range []string{"resize: 24,80", "command: ", "command: []", "command: [\"not base64\"]"} {
+		if _, err = DecodeCommandFrame([]byte(msg)); err == nil {
+			t.Errorf("expected error for %q", msg)
+		}
+	}
+
+	reply := &CommandReply{SessionID: "20240101000000", MFA: "totp"}
+
+	decodedReply, err := DecodeCommandReply(EncodeCommandReply(reply))
+	if err != nil || !reflect.DeepEqual(decodedReply, reply) {
+		t.Errorf("expected %+v, got %+v %v", reply, decodedReply, err)
+	}
+}
+
+func TestConfirmation(t *testing.T) {
+	confirmation := &Confirmation{Cmd: []string{"/bin/bash", "-c", "cd /root;rm -rf ./tmp\x00"}, User: "root", Dir: "/root", Target: "abc"}
+
+	decoded, err := DecodeConfirmation(EncodeConfirmation(confirmation))
+	if err != nil || !reflect.DeepEqual(decoded, confirmation) {
+		t.Errorf("expected %+v, got %+v %v", confirmation, decoded, err)
+	}
+
+	for _, msg := range []string{"command: {}", "confirm: ", "confirm: {\"cmd\":[\"not base64\"]}"} {
+		if _, err = DecodeConfirmation([]byte(msg)); err == nil {
+			t.Errorf("expected error for %q", msg)
+		}
+	}
+
+	for _, confirmed := range []bool{true, false} {
+		if decoded, err := DecodeConfirmAnswer(EncodeConfirmAnswer(confirmed)); err != nil || decoded != confirmed {
+			t.Errorf("expected %v, got %v %v", confirmed, decoded, err)
+		}
+	}
+
+	if _, err = DecodeConfirmAnswer([]byte("confirm: y")); err == nil {
+		t.Errorf("expected error for the invalid answer")
+	}
+}
+
+func TestOccupancy(t *testing.T) {
+	current, limit, ok := ParseOccupancy(FormatOccupancy(3, 10))
+	if !ok || current != 3 || limit != 10 {
+		t.Errorf("expected 3/10, got %d/%d %v", current, limit, ok)
+	}
+
+	for _, s := range []string{"", "3", "3/", "a/10"} {
+		if _, _, ok = ParseOccupancy(s); ok {
+			t.Errorf("expected %q to be invalid", s)
+		}
+	}
+}
+
+func TestForwardFrame(t *testing.T) {
+	var stream bytes.Buffer
+	stream.Write(EncodeForwardFrame(ForwardOpen, 1, nil))
+	stream.Write(EncodeForwardFrame(ForwardData, 1, []byte("hello")))
+
+	for _, expected := range []ForwardFrame{{Type: ForwardOpen, Stream: 1, Payload: []byte{}}, {Type: ForwardData, Stream: 1, Payload: []byte("hello")}} {
+		frame, err := ReadForwardFrame(iotest.OneByteReader(&stream))
+		if err != nil || !reflect.DeepEqual(*frame, expected) {
+			t.Errorf("expected frame %+v, got %+v %v", expected, frame, err)
+		}
+	}
+
+	if _, err := ReadForwardFrame(&stream); err != io.EOF {
+		t.Errorf("expected EOF, got %v", err)
+	}
+
+	for _, invalid := range [][]byte{
+		EncodeForwardFrame(7, 1, nil),
+		EncodeForwardFrame(ForwardData, 1, []byte("hello"))[:ForwardHeaderLen+2],
+		append(EncodeForwardFrame(ForwardData, 1, nil)[:5], 0xff, 0xff, 0xff, 0xff),
+	} {
+		if _, err := ReadForwardFrame(bytes.NewReader(invalid)); err == nil || err == io.EOF {
+			t.Errorf("expected error for the invalid frame %q, got %v", invalid, err)
+		}
+	}
+}
+
+func TestSpec(t *testing.T) {
+	spec, err := LoadSpec()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if spec.Version != Version || spec.Endpoint.Path != Path || spec.Close.MaxPayload != MaxClosePayload {
+		t.Errorf("spec doesn't match the constants: %+v", spec)
+	}
+
+	rejectionHeaders := make(map[string]bool)
+	for _, header := range spec.Rejection.Headers {
+		rejectionHeaders[header.Name] = true
+	}
+
+	if spec.Rejection.Status != http.StatusServiceUnavailable || !rejectionHeaders[HeaderRetryAfter] ||
+		!rejectionHeaders[HeaderSidecarOccupancy] || !rejectionHeaders[HeaderContainerSidecarOccupancy] {
+		t.Errorf("spec doesn't match the rejection: %+v", spec.Rejection)
+	}
+
+	requestHeaders := make(map[string]Header)
+	for _, header := range spec.RequestHeaders {
+		requestHeaders[header.Name] = header
+	}
+
+	if copyHeader := requestHeaders[HeaderCopy]; !reflect.DeepEqual(copyHeader.Values, []string{CopyTo, CopyFrom}) ||
+		requestHeaders[HeaderCopyPath].Name == "" {
+		t.Errorf("spec doesn't match the copy headers: %+v", copyHeader)
+	}
+
+	forwardTypes := make(map[string]byte)
+	for _, typ := range spec.Forward.Frame.Types {
+		forwardTypes[typ.Name] = typ.Type
+	}
+
+	if spec.Forward.Path != ForwardPath || requestHeaders[HeaderForwardPort].Name == "" || requestHeaders[HeaderForwardHost].Name == "" || requestHeaders[HeaderForwardReverse].Type != "flag" ||
+		spec.Forward.Frame.HeaderLength != ForwardHeaderLen || spec.Forward.Frame.MaxPayload != MaxForwardPayload ||
+		!reflect.DeepEqual(forwardTypes, map[string]byte{"open": ForwardOpen, "data": ForwardData, "close": ForwardClose, "reset": ForwardReset}) {
+		t.Errorf("spec doesn't match the forward endpoint: %+v", spec.Forward)
+	}
+
+	if profile := requestHeaders[HeaderFrameProfile]; !reflect.DeepEqual(profile.Values, []string{FrameProfileDefault, FrameProfileBulk}) ||
+		requestHeaders[HeaderFrameSize].Name == "" {
+		t.Errorf("spec doesn't match the frame headers: %+v", profile)
+	}
+
+	if observe := requestHeaders[HeaderObserve]; observe.Type != "flag" {
+		t.Errorf("spec doesn't match the observe header: %+v", observe)
+	}
+
+	formats := make(map[string]string)
+	for _, frame := range spec.Frames.Client {
+		formats[frame.Name] = frame.Format
+	}
+
+	if formats["resize"] != ResizePrefix+"{height},{width}" || formats["close-stdin"] != CloseStdin ||
+		formats["close-session"] != CloseSession {
+		t.Errorf("spec doesn't match the control frames: %v", formats)
+	}
+}
@@ -0,0 +1,273 @@
+# Copyright The TrustTunnel Authors.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+# http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+"""Reference codec of the trust-tunnel wire protocol, see ../spec.json.
+
+It only encodes and decodes the headers and the frames, pair it with any
+WebSocket library, e.g. websocket-client:
+
+    conn = websocket.create_connection(url, header=request_headers(...))
+    conn.send(encode_resize(24, 80))
+    opcode, data = conn.recv_data()
+    stream, payload = decode_frame(opcode, data)
+"""
+
+import base64
+import json
+import struct
+
+VERSION = 8
+PATH = "/exec"
+RESIZE_PREFIX = "resize: "
+CLOSE_STDIN = "close stdin"
+CLOSE_SESSION = "close session"
+MAX_CLOSE_PAYLOAD = 123
+COMMAND_PREFIX = "command: "
+COMMAND_FRAME_VERSION = 2
+CONFIRM_PREFIX = "confirm: "
+CONFIRM_VERSION = 3
+COPY_VERSION = 4
+FORWARD_PATH = "/forward"
+FORWARD_VERSION = 5
+OBSERVE_VERSION = 6
+FORWARD_HOST_VERSION = 7
+REVERSE_FORWARD_VERSION = 8
+
+FORWARD_OPEN = 1
+FORWARD_DATA = 2
+FORWARD_CLOSE = 3
+FORWARD_RESET = 4
+FORWARD_HEADER_LEN = 9
+MAX_FORWARD_PAYLOAD = 32 << 10
+
+OPCODE_TEXT = 0x1
+OPCODE_BINARY = 0x2
+
+CLOSE_NORMAL = 1000
+CLOSE_UNSUPPORTED_DATA = 1003
+
+TARGET_PHYSICAL = "physical"
+TARGET_CONTAINER = "container"
+
+_MAX_WINDOW_SIZE = 65535
+
+
+def request_headers(command, target_type=TARGET_PHYSICAL, user_name="", login_name="", login_group="",
+                    agent_addr="", session_id="", affinity_token="", pod_name="", container_name="",
+                    container_id="", ip_address="", interactive=False, tty=False, shell="", tools=False,
+                    cpus=0, memory_mb=0, disable_clean_mode=False, app_name="", jump_target=""):
+    """Returns the headers of the request establishing a session as a list of (name, value).
+
+    The command is always sent in Command-Base64-Encode, one header per argument.
+    """
+    if target_type not in (TARGET_PHYSICAL, TARGET_CONTAINER):
+        raise ValueError("invalid target type %r" % target_type)
+
+    if target_type == TARGET_CONTAINER and not pod_name:
+        raise ValueError("pod name is required for container targets")
+
+    if not command:
+        raise ValueError("no command")
+
+    headers = []
+
+    def add(name, value):
+        if value:
+            headers.append((name, value))
+
+    add("Session-Id", session_id)
+    add("Affinity-Token", affinity_token)
+    add("User-Name", user_name)
+    add("Login-Name", login_name)
+    add("Login-Group", login_group)
+    add("Agent-Addr", agent_addr)
+    add("Ip-Address", ip_address)
+    add("Target-Type", target_type)
+    add("Pod-Name", pod_name)
+    add("Container-Name", container_name)
+    add("Container-Id", container_id)
+    headers.append(("Interactive", "true" if interactive else "false"))
+    headers.append(("Tty", "true" if tty else "false"))
+
+    for arg in command:
+        headers.append(("Command-Base64-Encode", base64.b64encode(arg.encode("utf-8")).decode("ascii")))
+
+    add("Shell", shell)
+    add("Tools", "1" if tools else "")
+    add("Cpus", repr(float(cpus)) if cpus else "")
+    add("Memory", str(int(memory_mb)) if memory_mb else "")
+    add("Disable-Clean-Mode", "1" if disable_clean_mode else "")
+    add("App-Name", app_name)
+    add("Jump-Target", jump_target)
+
+    return headers
+
+
+def decode_command(values):
+    """Decodes the values of the Command-Base64-Encode header."""
+    return [base64.b64decode(value, validate=True).decode("utf-8") for value in values]
+
+
+def encode_command_frame(command):
+    """Returns the text frame carrying the command, to be declared by the headers of command_frame_headers."""
+    values = [base64.b64encode(arg.encode("utf-8")).decode("ascii") for arg in command]
+    return COMMAND_PREFIX + json.dumps(values, separators=(",", ":"))
+
+
+def command_frame_headers(frame):
+    """Returns the headers sent instead of Command-Base64-Encode with the command frame as a list of (name, value)."""
+    return [("Protocol-Version", str(COMMAND_FRAME_VERSION)), ("Command-Frame", str(len(frame.encode("utf-8"))))]
+
+
+def decode_command_reply(msg):
+    """Decodes the reply of the agent to the command frame, a dict of session_id, affinity_token and mfa."""
+    if not msg.startswith(COMMAND_PREFIX):
+        raise ValueError("not a command reply")
+
+    reply = json.loads(msg[len(COMMAND_PREFIX):])
+    if not isinstance(reply, dict):
+        raise ValueError("invalid command reply")
+
+    return reply
+
+
+def decode_confirmation(msg):
+    """Decodes the command resolved by the agent, sent if the header Confirm is "1", a dict of cmd as the list of the
+    arguments, user, dir, target and reattach. It's answered by encode_confirm_answer unless reattach is true."""
+    if not msg.startswith(CONFIRM_PREFIX):
+        raise ValueError("not a confirmation")
+
+    confirmation = json.loads(msg[len(CONFIRM_PREFIX):])
+    if not isinstance(confirmation, dict) or not isinstance(confirmation.get("cmd"), list):
+        raise ValueError("invalid confirmation")
+
+    confirmation["cmd"] = decode_command(confirmation["cmd"])
+    return confirmation
+
+
+def encode_confirm_answer(confirmed):
+    """Returns the text frame answering the confirmation, the command is run only if it's confirmed."""
+    return CONFIRM_PREFIX + ("yes" if confirmed else "no")
+
+
+def encode_resize(height, width):
+    """Returns the text frame resizing the terminal."""
+    return "%s%d,%d" % (RESIZE_PREFIX, height, width)
+
+
+def decode_resize(msg):
+    """Decodes the text frame resizing the terminal, returns (height, width) or None if it's invalid."""
+    if not msg.startswith(RESIZE_PREFIX):
+        return None
+
+    vals = msg[len(RESIZE_PREFIX):].split(",")
+    if len(vals) != 2:
+        return None
+
+    try:
+        height, width = int(vals[0]), int(vals[1])
+    except ValueError:
+        return None
+
+    if not (0 < height <= _MAX_WINDOW_SIZE and 0 < width <= _MAX_WINDOW_SIZE):
+        return None
+
+    return height, width
+
+
+def decode_frame(opcode, data):
+    """Returns the stream of a frame sent by the agent, ("stdout", bytes) or ("stderr", str)."""
+    if opcode == OPCODE_BINARY:
+        return "stdout", bytes(data)
+
+    if opcode == OPCODE_TEXT:
+        return "stderr", data.decode("utf-8") if isinstance(data, (bytes, bytearray)) else data
+
+    raise ValueError("unexpected opcode %d" % opcode)
+
+
+def encode_forward_frame(frame_type, stream, payload=b""):
+    """Returns the forward frame of the stream, sent as (a part of) a binary frame on the forward endpoint."""
+    if len(payload) > MAX_FORWARD_PAYLOAD:
+        raise ValueError("forward frame of %d bytes exceeds the limit" % len(payload))
+
+    return struct.pack(">BII", frame_type, stream, len(payload)) + bytes(payload)
+
+
+class ForwardDecoder(object):
+    """Decodes the forward frames from the binary frames of the forward endpoint, which may split or join them."""
+
+    def __init__(self):
+        self._buf = bytearray()
+
+    def feed(self, data):
+        """Feeds the data of a binary frame, returns the complete forward frames as (type, stream, payload)."""
+        self._buf.extend(data)
+        frames = []
+
+        while len(self._buf) >= FORWARD_HEADER_LEN:
+            frame_type, stream, length = struct.unpack(">BII", bytes(self._buf[:FORWARD_HEADER_LEN]))
+            if not FORWARD_OPEN <= frame_type <= FORWARD_RESET:
+                raise ValueError("invalid forward frame type %d" % frame_type)
+
+            if length > MAX_FORWARD_PAYLOAD:
+                raise ValueError("forward frame of %d bytes exceeds the limit" % length)
+
+            if len(self._buf) < FORWARD_HEADER_LEN + length:
+                break
+
+            frames.append((frame_type, stream, bytes(self._buf[FORWARD_HEADER_LEN:FORWARD_HEADER_LEN + length])))
+            del self._buf[:FORWARD_HEADER_LEN + length]
+
+        return frames
+
+
+class CloseStatus(object):
+    """The result of a session carried by the close frame."""
+
+    def __init__(self, exit_code, error=None, reason=""):
+        self.exit_code = exit_code
+        self.error = error
+        self.reason = reason
+
+    def __repr__(self):
+        return "CloseStatus(exit_code=%d, error=%r, reason=%r)" % (self.exit_code, self.error, self.reason)
+
+
+def decode_close(code, payload):
+    """Decodes the close frame, code is None if the connection is closed without a close frame."""
+    if isinstance(payload, (bytes, bytearray)):
+        payload = payload.decode("utf-8", "replace")
+
+    if code is None:
+        return CloseStatus(-1, "connection closed abnormally")
+
+    if code != CLOSE_NORMAL:
+        return CloseStatus(-1, payload or "connection closed with code %d" % code)
+
+    try:
+        msg = json.loads(payload)
+    except ValueError:
+        # Older agents send a plain text error.
+        return CloseStatus(-1, payload or None)
+
+    if not isinstance(msg, dict) or not isinstance(msg.get("Code"), int):
+        return CloseStatus(-1, payload or None)
+
+    return CloseStatus(msg["Code"], msg.get("Err"), msg.get("Reason", ""))
+
+
+def truncate_close_payload(payload):
+    """Truncates the payload of a close frame to the maximum length."""
+    return payload[:MAX_CLOSE_PAYLOAD]
@@ -0,0 +1,159 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// ErrTargetNotFound is returned by the resolvers when the name of the target is unknown to the inventory.
+var ErrTargetNotFound = errors.New("target not found")
+
+// Target is the parameters of a session's target resolved from its friendly name, the zero ones are left to the
+// client.
+type Target struct {
+	// AgentAddr and AgentPort are the address and the port of the agent serving the target.
+	AgentAddr string `json:"agent_addr"`
+	AgentPort int    `json:"agent_port,omitempty"`
+
+	// JumpAddr is the address of the jump agent proxying the sessions to the agent.
+	JumpAddr string `json:"jump_addr,omitempty"`
+
+	// Type is "physical" for the hosts, or "container" for the containers.
+	Type string `json:"type,omitempty"`
+
+	// PodName, ContainerName, ContainerID and IPAddress identify the container, ignored for the hosts.
+	PodName       string `json:"pod_name,omitempty"`
+	ContainerName string `json:"container_name,omitempty"`
+	ContainerID   string `json:"container_id,omitempty"`
+	IPAddress     string `json:"ip_address,omitempty"`
+}
+
+// TargetType returns the type of the target.
+func (t *Target) TargetType() (TargetType, error) {
+	switch t.Type {
+	case "", "physical":
+		return TargetPhys, nil
+	case "container":
+		return TargetContainer, nil
+	default:
+		return 0, fmt.Errorf("invalid target type %q", t.Type)
+	}
+}
+
+// Apply sets the parameters of the target to the client.
+func (t *Target) Apply(c *Client) error {
+	targetType, err := t.TargetType()
+	if err != nil {
+		return err
+	}
+
+	c.AgentAddr = t.AgentAddr
+	c.Type = targetType
+	c.PodName = t.PodName
+	c.ContainerName = t.ContainerName
+	c.ContainerID = t.ContainerID
+	c.IPAddress = t.IPAddress
+
+	if t.AgentPort > 0 {
+		c.AgentPort = t.AgentPort
+	}
+
+	if t.JumpAddr != "" {
+		c.JumpAddr = t.JumpAddr
+	}
+
+	return nil
+}
+
+// Resolver resolves the friendly names of the targets, e.g. "payments-prod-3", to their parameters, e.g. by querying
+// a CMDB or Kubernetes, so that the users needn't copy the addresses and the container IDs from other tools.
+type Resolver interface {
+	// Resolve returns the target of the name, or an error wrapping ErrTargetNotFound if it's unknown.
+	Resolve(name string) (*Target, error)
+}
+
+// resolverFactories stores the resolver factory functions by their names.
+var resolverFactories = map[string]func(params map[string]string) (Resolver, error){
+	"file": newFileResolver,
+}
+
+// RegisterResolver registers a factory function for a resolver.
+// If the resolver name is already registered, it panics.
+func RegisterResolver(name string, factoryFunc func(params map[string]string) (Resolver, error)) {
+	if _, exists := resolverFactories[name]; exists {
+		panic("resolver already registered")
+	}
+
+	resolverFactories[name] = factoryFunc
+}
+
+// CreateResolver creates a resolver by its name with the parameters.
+func CreateResolver(name string, params map[string]string) (Resolver, error) {
+	factoryFunc, exists := resolverFactories[name]
+	if !exists {
+		return nil, fmt.Errorf("resolver not found: %s", name)
+	}
+
+	return factoryFunc(params)
+}
+
+// fileResolver resolves the targets bookmarked in a JSON file, an object of the targets by their names.
+type fileResolver struct {
+	targets map[string]*Target
+}
+
+// newFileResolver creates a resolver of the targets bookmarked in the file given by the "path" param.
+func newFileResolver(params map[string]string) (Resolver, error) {
+	path := params["path"]
+	if path == "" {
+		return nil, fmt.Errorf("no path of the targets file")
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read targets file error: %v", err)
+	}
+
+	var targets map[string]*Target
+	if err = json.Unmarshal(data, &targets); err != nil {
+		return nil, fmt.Errorf("parse targets file %s error: %v", path, err)
+	}
+
+	for name, target := range targets {
+		if target == nil || target.AgentAddr == "" {
+			return nil, fmt.Errorf("target %s in %s has no agent address", name, path)
+		}
+
+		if _, err = target.TargetType(); err != nil {
+			return nil, fmt.Errorf("target %s in %s: %v", name, path, err)
+		}
+	}
+
+	return &fileResolver{targets: targets}, nil
+}
+
+func (r *fileResolver) Resolve(name string) (*Target, error) {
+	target, ok := r.targets[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrTargetNotFound, name)
+	}
+
+	copied := *target
+
+	return &copied, nil
+}
@@ -0,0 +1,68 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package client
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileResolver(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "targets.json")
+	os.WriteFile(path, []byte(`{
+		"payments-prod-3": {"agent_addr": "10.0.0.3", "type": "container", "pod_name": "payments-3", "container_name": "main"},
+		"bastion": {"agent_addr": "10.0.0.1", "agent_port": 7006, "jump_addr": "10.1.0.1:5006"}
+	}`), 0o600)
+
+	resolver, err := CreateResolver("file", map[string]string{"path": path})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	target, err := resolver.Resolve("payments-prod-3")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	c := &Client{AgentPort: 5006}
+	if err = target.Apply(c); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if c.AgentAddr != "10.0.0.3" || c.AgentPort != 5006 || c.Type != TargetContainer || c.PodName != "payments-3" ||
+		c.ContainerName != "main" {
+		t.Errorf("unexpected client %+v", c)
+	}
+
+	if target, err = resolver.Resolve("bastion"); err != nil || target.Apply(c) != nil || c.AgentPort != 7006 ||
+		c.JumpAddr != "10.1.0.1:5006" || c.Type != TargetPhys || c.PodName != "" {
+		t.Errorf("unexpected client %+v, error %v", c, err)
+	}
+
+	if _, err = resolver.Resolve("unknown"); !errors.Is(err, ErrTargetNotFound) {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	os.WriteFile(path, []byte(`{"broken": {"agent_addr": "10.0.0.3", "type": "vm"}}`), 0o600)
+
+	if _, err = CreateResolver("file", map[string]string{"path": path}); err == nil {
+		t.Error("expected error of invalid target type")
+	}
+
+	if _, err = CreateResolver("unknown", nil); err == nil {
+		t.Error("expected error of unknown resolver")
+	}
+}
@@ -0,0 +1,84 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+// Snapshot is the triage snapshot of a target gathered by the agent, printed as JSON by the sessions of Client.Top.
+type Snapshot struct {
+	// Time is when the snapshot is taken, in RFC 3339.
+	Time string `json:"time"`
+
+	// UptimeSeconds is how long the host has been up.
+	UptimeSeconds float64 `json:"uptime_seconds"`
+
+	// Load is the load average of the host over 1, 5 and 15 minutes.
+	Load [3]float64 `json:"load"`
+
+	// Memory is the memory of the host.
+	Memory SnapshotMemory `json:"memory"`
+
+	// Disks are the file systems mounted in the target.
+	Disks []SnapshotDisk `json:"disks"`
+
+	// Processes are the processes of the target using the most CPU, then memory.
+	Processes []SnapshotProcess `json:"processes"`
+
+	// Container is the resource usage of the container, it's set for container targets.
+	Container *SnapshotContainer `json:"container,omitempty"`
+
+	// Errors are the collectors failed, the rest of the snapshot is still gathered.
+	Errors []string `json:"errors,omitempty"`
+}
+
+// SnapshotMemory is the memory of a host.
+type SnapshotMemory struct {
+	TotalBytes     uint64 `json:"total_bytes"`
+	AvailableBytes uint64 `json:"available_bytes"`
+	SwapTotalBytes uint64 `json:"swap_total_bytes"`
+	SwapFreeBytes  uint64 `json:"swap_free_bytes"`
+}
+
+// SnapshotDisk is the usage of a file system.
+type SnapshotDisk struct {
+	Mount          string  `json:"mount"`
+	FSType         string  `json:"fstype"`
+	TotalBytes     uint64  `json:"total_bytes"`
+	AvailableBytes uint64  `json:"available_bytes"`
+	UsedPercent    float64 `json:"used_percent"`
+}
+
+// SnapshotProcess is a process of the target. The PIDs are in the PID namespace of the host.
+type SnapshotProcess struct {
+	PID        int     `json:"pid"`
+	PPID       int     `json:"ppid"`
+	UID        int     `json:"uid"`
+	State      string  `json:"state"`
+	Comm       string  `json:"comm"`
+	Cmd        string  `json:"cmd"`
+	Threads    int     `json:"threads"`
+	CPUPercent float64 `json:"cpu_percent"`
+	RSSBytes   uint64  `json:"rss_bytes"`
+}
+
+// SnapshotContainer is the resource usage of a container read from its cgroup.
+type SnapshotContainer struct {
+	ID            string  `json:"id"`
+	UptimeSeconds float64 `json:"uptime_seconds"`
+	CPUPercent    float64 `json:"cpu_percent"`
+
+	// MemoryLimitBytes is 0 if the memory isn't limited.
+	MemoryBytes      uint64 `json:"memory_bytes"`
+	MemoryLimitBytes uint64 `json:"memory_limit_bytes"`
+	Pids             uint64 `json:"pids"`
+}
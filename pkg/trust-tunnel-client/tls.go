@@ -12,7 +12,7 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-//go:build !ntls
+//go:build !ntls || !linux || !cgo
 
 package client
 
@@ -25,11 +25,22 @@ import (
 	"github.com/gorilla/websocket"
 )
 
+// ntlsSupported is whether the client is built with NTLS, which replaces TLS then.
+const ntlsSupported = false
+
+// DialSessionUsingNTLS is a stub in the builds without NTLS, it always returns ErrNTLSUnsupported.
+func (c *Client) DialSessionUsingNTLS(string) (net.Conn, error) {
+	return nil, ErrNTLSUnsupported
+}
+
 // dialAgent dials the agent and establishes a websocket connection.
-func (c *Client) dialAgent(networkConnection *net.Conn, url *url.URL, header *http.Header, tlsConfig *tls.Config) (*websocket.Conn, error) {
+// The handshake response is returned as well, even if the handshake fails.
+func (c *Client) dialAgent(networkConnection *net.Conn, url *url.URL, header *http.Header, tlsConfig *tls.Config) (*websocket.Conn, *http.Response, error) {
 	// Initialize a websocket dialer with the TLS configuration.
 	dialer := websocket.Dialer{
 		TLSClientConfig: tlsConfig,
+		ReadBufferSize:  c.ReadBufferSize,
+		WriteBufferSize: c.WriteBufferSize,
 	}
 
 	// If a network connection is provided, use it for dialing.
@@ -37,10 +48,14 @@ func (c *Client) dialAgent(networkConnection *net.Conn, url *url.URL, header *ht
 		dialer.NetDial = func(_, address string) (net.Conn, error) {
 			return *networkConnection, nil
 		}
+	} else {
+		dialer.NetDialContext = (&net.Dialer{KeepAlive: c.TCPKeepAlive}).DialContext
 	}
 
-	// Dial the agent and return the websocket connection.
-	conn, _, err := dialer.Dial(url.String(), *header) //nolint:bodyclose
+	if c.DialerCustomizer != nil {
+		c.DialerCustomizer(&dialer)
+	}
 
-	return conn, err
+	// Dial the agent and return the websocket connection.
+	return dialer.Dial(url.String(), *header)
 }
@@ -0,0 +1,254 @@
+// Copyright The TrustTunnel Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build js && wasm
+
+package client
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"syscall/js"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// The ready states of the WebSocket API.
+const (
+	browserWebSocketOpen = 1
+)
+
+// browserMessage is a data message received by the browser.
+type browserMessage struct {
+	messageType int
+	data        []byte
+}
+
+// browserWebSocket is the Transport over the WebSocket API of browsers.
+type browserWebSocket struct {
+	ws    js.Value
+	funcs []js.Func
+
+	lock     sync.Mutex
+	messages []browserMessage
+	// closeErr is set once the connection is closed, by the agent or broken.
+	closeErr     *websocket.CloseError
+	closeHandler func(code int, text string) error
+	// notify is signaled when a message is queued or the connection is closed.
+	notify chan struct{}
+}
+
+// DialBrowserWebSocket dials the agent with the WebSocket API of browsers, for Client.DialTransport in WebAssembly.
+// Browsers can't set the headers of WebSocket handshakes, so the headers are passed in the query string instead,
+// and the handshake response is unavailable, i.e. the sessions can't be reattached or redirected.
+// The TLS of wss URLs is up to the browser.
+func DialBrowserWebSocket(rawURL string, header http.Header) (Transport, *http.Response, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	query := u.Query()
+
+	for key, values := range header {
+		for _, value := range values {
+			query.Add(key, value)
+		}
+	}
+
+	u.RawQuery = query.Encode()
+
+	bws := &browserWebSocket{notify: make(chan struct{}, 1)}
+	opened := make(chan error, 1)
+
+	bws.ws = js.Global().Get("WebSocket").New(u.String())
+	bws.ws.Set("binaryType", "arraybuffer")
+
+	bws.on("open", func(js.Value) {
+		select {
+		case opened <- nil:
+		default:
+		}
+	})
+	bws.on("message", func(event js.Value) {
+		data := event.Get("data")
+		if data.Type() == js.TypeString {
+			bws.queue(browserMessage{messageType: websocket.TextMessage, data: []byte(data.String())})
+
+			return
+		}
+
+		array := js.Global().Get("Uint8Array").New(data)
+		message := make([]byte, array.Get("length").Int())
+		js.CopyBytesToGo(message, array)
+		bws.queue(browserMessage{messageType: websocket.BinaryMessage, data: message})
+	})
+	bws.on("close", func(event js.Value) {
+		code := event.Get("code").Int()
+		bws.closed(&websocket.CloseError{Code: code, Text: event.Get("reason").String()})
+
+		select {
+		case opened <- fmt.Errorf("websocket closed with code %d", code):
+		default:
+		}
+	})
+	// The error event carries no details, and it's the only event of failed handshakes in some runtimes.
+	// Browsers close the connection with CloseAbnormalClosure after it.
+	bws.on("error", func(js.Value) {
+		bws.closed(&websocket.CloseError{Code: websocket.CloseAbnormalClosure})
+
+		select {
+		case opened <- errors.New("websocket error"):
+		default:
+		}
+	})
+
+	if err = <-opened; err != nil {
+		bws.release()
+
+		return nil, nil, err
+	}
+
+	return bws, nil, nil
+}
+
+// on sets the handler of an event of the WebSocket.
+// The handlers run in the event loop of the browser, so they mustn't block.
+func (bws *browserWebSocket) on(event string, handler func(event js.Value)) {
+	f := js.FuncOf(func(_ js.Value, args []js.Value) any {
+		handler(args[0])
+
+		return nil
+	})
+
+	bws.funcs = append(bws.funcs, f)
+	bws.ws.Set("on"+event, f)
+}
+
+// queue queues a received message without blocking the event loop.
+func (bws *browserWebSocket) queue(message browserMessage) {
+	bws.lock.Lock()
+	bws.messages = append(bws.messages, message)
+	bws.lock.Unlock()
+
+	bws.signal()
+}
+
+// closed records the close of the connection.
+func (bws *browserWebSocket) closed(err *websocket.CloseError) {
+	bws.lock.Lock()
+	if bws.closeErr == nil {
+		bws.closeErr = err
+	}
+	bws.lock.Unlock()
+
+	bws.signal()
+}
+
+func (bws *browserWebSocket) signal() {
+	select {
+	case bws.notify <- struct{}{}:
+	default:
+	}
+}
+
+// release releases the event handlers once the connection is closed.
+func (bws *browserWebSocket) release() {
+	for _, event := range []string{"open", "message", "close", "error"} {
+		bws.ws.Set("on"+event, js.Null())
+	}
+
+	for _, f := range bws.funcs {
+		f.Release()
+	}
+
+	bws.funcs = nil
+}
+
+// ReadMessage reads the next data message, and calls the close handler once the connection is closed.
+func (bws *browserWebSocket) ReadMessage() (int, []byte, error) {
+	for {
+		bws.lock.Lock()
+		if len(bws.messages) > 0 {
+			message := bws.messages[0]
+			bws.messages = bws.messages[1:]
+			bws.lock.Unlock()
+
+			return message.messageType, message.data, nil
+		}
+
+		closeErr, handler := bws.closeErr, bws.closeHandler
+		bws.lock.Unlock()
+
+		if closeErr != nil {
+			if closeErr.Code != websocket.CloseAbnormalClosure && handler != nil {
+				handler(closeErr.Code, closeErr.Text)
+			}
+
+			bws.release()
+
+			return 0, nil, closeErr
+		}
+
+		<-bws.notify
+	}
+}
+
+// WriteMessage sends a data message.
+func (bws *browserWebSocket) WriteMessage(messageType int, data []byte) error {
+	if bws.ws.Get("readyState").Int() != browserWebSocketOpen {
+		return websocket.ErrCloseSent
+	}
+
+	switch messageType {
+	case websocket.TextMessage:
+		bws.ws.Call("send", string(data))
+	case websocket.BinaryMessage:
+		array := js.Global().Get("Uint8Array").New(len(data))
+		js.CopyBytesToJS(array, data)
+		bws.ws.Call("send", array)
+	default:
+		return fmt.Errorf("unsupported message type %d", messageType)
+	}
+
+	return nil
+}
+
+// WriteControl is a no-op for pings, which can't be sent by browsers. The browser answers the pings of the agent.
+func (bws *browserWebSocket) WriteControl(messageType int, _ []byte, _ time.Time) error {
+	if messageType == websocket.PingMessage {
+		return nil
+	}
+
+	return errors.New("control messages are not supported by browsers")
+}
+
+// SetCloseHandler sets the handler of the close frame from the agent.
+func (bws *browserWebSocket) SetCloseHandler(h func(code int, text string) error) {
+	bws.lock.Lock()
+	defer bws.lock.Unlock()
+
+	bws.closeHandler = h
+}
+
+// Close closes the connection, the browser sends a close frame if it's open.
+func (bws *browserWebSocket) Close() error {
+	bws.ws.Call("close")
+
+	return nil
+}
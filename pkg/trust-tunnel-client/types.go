@@ -15,7 +15,17 @@
 package client
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
+	"net/http"
+	"strconv"
+	"time"
+	"trust-tunnel/pkg/trust-tunnel-client/protocol"
+
+	"github.com/gorilla/websocket"
 )
 
 // TargetType represents the type of target host to log in,
@@ -27,23 +37,288 @@ const (
 	TargetContainer
 )
 
+// ShellAuto lets the agent resolve the shell in the target.
+const ShellAuto = "auto"
+
+// DefaultCommandFrameThreshold is the default of Client.CommandFrameThreshold, which keeps the headers within
+// the common limits of proxies (8 KiB) along with the other headers.
+const DefaultCommandFrameThreshold = 4096
+
+// LogsOptions specifies how to stream the output of the main process of a container.
+type LogsOptions struct {
+	// Follow specifies whether to follow the output until the session is closed or the container exits.
+	Follow bool `json:"follow,omitempty"`
+
+	// Tail specifies the number of the last lines to show, all lines are shown if it's negative.
+	Tail int `json:"tail"`
+}
+
+// The verbs of FileRequest.
+const (
+	FileVerbCat  = "cat"
+	FileVerbTail = "tail"
+	FileVerbStat = "stat"
+)
+
+// FileRequest specifies the file in the target read by the agent without spawning a shell.
+type FileRequest struct {
+	// Verb is FileVerbCat to show the content, FileVerbTail to show the last lines, or FileVerbStat to show
+	// the metadata and the hash of the file.
+	Verb string `json:"verb"`
+
+	// Path is the absolute path of the file in the target.
+	Path string `json:"path"`
+
+	// Lines is the number of the last lines shown by FileVerbTail, defaults to 10.
+	Lines int `json:"lines,omitempty"`
+}
+
+// The directions of CopyRequest.
+const (
+	CopyToTarget   = protocol.CopyTo
+	CopyFromTarget = protocol.CopyFrom
+)
+
+// CopyRequest specifies the files copied to or from the target by the agent as a tar stream, like kubectl cp.
+type CopyRequest struct {
+	// Direction is CopyToTarget to extract the tar stream into the directory of Path, or CopyFromTarget to get
+	// the tar stream of the file or the directory of Path, whose entries are named after its base name.
+	Direction string `json:"direction"`
+
+	// Path is the absolute path in the target.
+	Path string `json:"path"`
+}
+
+// ForwardRequest specifies the port of the target the connections are forwarded to, like kubectl port-forward.
+type ForwardRequest struct {
+	// Host is the host reached from the target's network namespace, e.g. "db" of the cluster DNS, resolved by the
+	// agent as the target does. The loopback is used if it's empty.
+	Host string `json:"host,omitempty"`
+
+	// Port is the port of Host, or of the loopback of the target's network namespace.
+	Port int `json:"port"`
+
+	// Reverse is whether the agent listens on Port of the loopback of the target's network namespace instead, and
+	// the connections accepted are forwarded to the client, see ReverseForward.
+	Reverse bool `json:"reverse,omitempty"`
+}
+
+// VerbRequest specifies the verb run natively by the agent, see the verbs registered in the agent.
+type VerbRequest struct {
+	// Name is the name of the verb, e.g. "ps".
+	Name string `json:"name"`
+
+	// Args are the arguments of the verb.
+	Args []string `json:"args,omitempty"`
+}
+
+// ErrCommandTimeout is returned by the reads of a session whose command is killed on Client.Timeout.
+var ErrCommandTimeout = errors.New("command timed out")
+
+// ErrCommandDeclined is returned when the command resolved by the agent isn't confirmed by Client.ConfirmCommand.
+var ErrCommandDeclined = errors.New("command declined")
+
+// ErrNTLSUnsupported is returned when the NTLS options are given to a client built without NTLS, which requires
+// the ntls build tag, cgo and Tongsuo on Linux.
+var ErrNTLSUnsupported = errors.New("NTLS isn't supported by this build of the client, build it with -tags ntls and cgo on Linux")
+
+// ErrCloseStdinUnsupported is returned by CloseStdin when the session doesn't implement StdinCloser.
+var ErrCloseStdinUnsupported = errors.New("closing the stdin alone isn't supported by the session")
+
+// ConnectionClosedError is returned by the reads of a session once the output is drained,
+// if the connection isn't closed normally after the command exits.
+type ConnectionClosedError struct {
+	// Code is the websocket close code, it's 1006 if the connection is broken without a close frame.
+	Code int
+
+	// ExitCode is the exit code of the command reported by the agent, -1 if it's unknown.
+	ExitCode int
+
+	// Err is the cause of the close, e.g. the error reported by the agent.
+	Err error
+}
+
+func (e *ConnectionClosedError) Error() string {
+	return fmt.Sprintf("connection closed with code %d: %v", e.Code, e.Err)
+}
+
+func (e *ConnectionClosedError) Unwrap() error {
+	return e.Err
+}
+
+// LimitError is returned on starting a session if the agent refuses it for its limits, e.g. no sidecar is
+// available. The occupancy is -1 if it's not reported by the agent.
+type LimitError struct {
+	// Message is the error reported by the agent.
+	Message string
+
+	// RetryAfter is the hint of the agent of when to retry, it's 0 if not given.
+	RetryAfter time.Duration
+
+	// Sidecars and SidecarLimit are the sidecars of the node against the limit.
+	Sidecars     int
+	SidecarLimit int
+
+	// ContainerSidecars and ContainerSidecarLimit are the sidecars of the target container against the limit.
+	ContainerSidecars     int
+	ContainerSidecarLimit int
+}
+
+func (e *LimitError) Error() string {
+	if e.RetryAfter > 0 {
+		return fmt.Sprintf("%s (retry after %v)", e.Message, e.RetryAfter)
+	}
+
+	return e.Message
+}
+
+// newLimitError parses the limit error from the response of the refused handshake.
+func newLimitError(resp *http.Response, err error) *LimitError {
+	limitErr := &LimitError{
+		Message:               err.Error(),
+		Sidecars:              -1,
+		SidecarLimit:          -1,
+		ContainerSidecars:     -1,
+		ContainerSidecarLimit: -1,
+	}
+
+	if resp.Body != nil {
+		if body, readErr := io.ReadAll(io.LimitReader(resp.Body, 1024)); readErr == nil && len(bytes.TrimSpace(body)) > 0 {
+			limitErr.Message = string(bytes.TrimSpace(body))
+		}
+	}
+
+	if seconds, convErr := strconv.Atoi(resp.Header.Get(protocol.HeaderRetryAfter)); convErr == nil && seconds > 0 {
+		limitErr.RetryAfter = time.Duration(seconds) * time.Second
+	}
+
+	if current, limit, ok := protocol.ParseOccupancy(resp.Header.Get(protocol.HeaderSidecarOccupancy)); ok {
+		limitErr.Sidecars, limitErr.SidecarLimit = current, limit
+	}
+
+	if current, limit, ok := protocol.ParseOccupancy(resp.Header.Get(protocol.HeaderContainerSidecarOccupancy)); ok {
+		limitErr.ContainerSidecars, limitErr.ContainerSidecarLimit = current, limit
+	}
+
+	return limitErr
+}
+
+// TerminationReason represents why a session is terminated.
+type TerminationReason string
+
+const (
+	// TerminationExited means the command exited by itself.
+	TerminationExited TerminationReason = "exited"
+
+	// TerminationClientClose means the client closed the session.
+	TerminationClientClose TerminationReason = "client-close"
+
+	// TerminationDisconnected means the client disconnected abnormally, and didn't reattach the session in time.
+	TerminationDisconnected TerminationReason = "disconnected"
+
+	// TerminationIdleTimeout means there was neither input nor output for the idle timeout of the agent.
+	TerminationIdleTimeout TerminationReason = "idle-timeout"
+
+	// TerminationMaxDuration means the session lasted for the maximum duration allowed by the agent.
+	TerminationMaxDuration TerminationReason = "max-duration"
+
+	// TerminationAgentShutdown means the agent was shutting down.
+	TerminationAgentShutdown TerminationReason = "agent-shutdown"
+
+	// TerminationRuntimeFailure means the output of the command couldn't be read from the runtime.
+	TerminationRuntimeFailure TerminationReason = "runtime-failure"
+
+	// TerminationOOM means the command was killed by the OOM killer.
+	TerminationOOM TerminationReason = "oom"
+)
+
+// Confirmation is the command resolved by the agent, given to Client.ConfirmCommand.
+type Confirmation = protocol.Confirmation
+
+// MFAChallenge is the challenge of the second factor, relayed by the agent before the session is established.
+type MFAChallenge struct {
+	// Type is the type of the assertion, e.g. "totp" or "webauthn".
+	Type string `json:"type"`
+
+	// Prompt is shown to the user, e.g. "TOTP code for alice: ".
+	Prompt string `json:"prompt,omitempty"`
+
+	// Data is the data of the challenge specific to the type, e.g. the WebAuthn request options.
+	Data json.RawMessage `json:"data,omitempty"`
+}
+
 // NormalCloseMessage represents a message for a normal close with a code and error.
+// Reason is given by agents supporting termination reasons.
 type NormalCloseMessage struct {
-	Code int
-	Err  error
+	Code   int
+	Err    error
+	Reason TerminationReason `json:",omitempty"`
+}
+
+// closeMessageJSON is the JSON form of NormalCloseMessage, in which the error is carried by its message.
+type closeMessageJSON struct {
+	Code   int
+	Err    json.RawMessage
+	Reason TerminationReason `json:",omitempty"`
+}
+
+// errUnknownRemote is the error reported by old agents, which marshal the errors as empty objects.
+var errUnknownRemote = errors.New("unknown error of agent")
+
+func (m NormalCloseMessage) MarshalJSON() ([]byte, error) {
+	msg := closeMessageJSON{Code: m.Code, Err: json.RawMessage("null"), Reason: m.Reason}
+
+	if m.Err != nil {
+		data, err := json.Marshal(m.Err.Error())
+		if err != nil {
+			return nil, err
+		}
+
+		msg.Err = data
+	}
+
+	return json.Marshal(msg)
+}
+
+func (m *NormalCloseMessage) UnmarshalJSON(data []byte) error {
+	var msg closeMessageJSON
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return err
+	}
+
+	m.Code, m.Reason, m.Err = msg.Code, msg.Reason, nil
+
+	if len(msg.Err) > 0 && string(msg.Err) != "null" {
+		var text string
+		if err := json.Unmarshal(msg.Err, &text); err != nil {
+			m.Err = errUnknownRemote
+		} else {
+			m.Err = errors.New(text)
+		}
+	}
+
+	return nil
 }
 
 // Client represents the configuration and data for a client connecting to a server.
 type Client struct {
-	// Session ID.
+	// Session ID, it's set to the ID issued by the agent after the session is started.
 	SessionID string
 
+	// AffinityToken identifies the agent instance holding the session, it's issued by the agent after the session
+	// is started, and should be given along with the session ID to reattach the session behind a load balancer.
+	AffinityToken string
+
 	// IP address of agent.
 	AgentAddr string
 
 	// Port of agent.
 	AgentPort int
 
+	// JumpAddr is the address ("host" or "host:port") of the jump agent, which proxies the session to the agent.
+	// The agent is dialed directly if it's empty.
+	JumpAddr string
+
 	// Type of target host to log in (physical machine or container).
 	Type TargetType
 
@@ -71,15 +346,30 @@ type Client struct {
 	// Enable tls verification if set to true.
 	TLSVerify bool
 
-	// Path of CA certificate file of TLS.
+	// Path of CA certificate file of TLS, the system trust store is used if it's empty.
 	TLSCaCert string
 
-	// Path of certificate file of TLS.
+	// Path of certificate file of TLS, the client isn't authenticated by certificate if it's empty.
 	TLSCert string
 
-	// Path of key file of TLS.
+	// Path of key file of TLS, it must be given along with TLSCert.
 	TLSKey string
 
+	// Credentials provides the client certificate instead of TLSCert and TLSKey if it's set.
+	Credentials CredentialProvider
+
+	// TLSInsecureSkipVerify disables the verification of the agent's certificate if TLSVerify is set.
+	// It's vulnerable to man-in-the-middle attacks, and should be used in labs only.
+	TLSInsecureSkipVerify bool
+
+	// TLSServerName is the server name to verify the certificate of the agent against,
+	// defaults to the host being dialed, i.e. the agent, the jump agent or the redirect target.
+	TLSServerName string
+
+	// FIPS restricts the cipher suites, the key types and the hash algorithms of TLS to the FIPS-approved sets for
+	// the process, and requires TLSVerify. It's always on in the boringcrypto builds.
+	FIPS bool
+
 	// Enable ntls verification if set to true.
 	NtlsVerify bool
 
@@ -110,23 +400,145 @@ type Client struct {
 	// Commands to be executed on target.
 	Command []string
 
+	// Shell is ShellAuto to let the agent run Command with the shell found in the target (bash, sh or ash),
+	// e.g. for distroless targets without bash. Command is run as it is if it's empty.
+	Shell string
+
+	// Tools runs Command with the tools of the sidecar in the namespaces of the container,
+	// to debug distroless images. The root of the container is at $TARGET_ROOT. Ignored if type is TargetPhys.
+	Tools bool
+
+	// Logs streams the output of the main process of the container instead of running Command if it's set,
+	// like docker logs. The session is neither interactive nor a TTY. Ignored if type is TargetPhys.
+	Logs *LogsOptions
+
+	// File reads the file in the target by the agent instead of running Command if it's set, which is allowed
+	// by the agents where a shell isn't. The session is neither interactive nor a TTY.
+	File *FileRequest
+
+	// Top prints the Snapshot of the target as JSON instead of running Command if it's set, gathered by the agent
+	// for triage without spawning a shell. The session is neither interactive nor a TTY.
+	Top bool
+
+	// Verb runs the verb natively by the agent instead of running Command if it's set, which is authorized with the
+	// scope of the verb. The session is neither interactive nor a TTY.
+	Verb *VerbRequest
+
+	// Observe attaches to the live session of SessionID as a read-only observer instead of running Command if it's
+	// set, e.g. to shadow the session of a colleague while troubleshooting together. The output of the session is
+	// read from the attachment on, and the writes to the session are discarded by the agent. It requires the agents
+	// serving the protocol version 6.
+	Observe bool
+
+	// Tags are the key/value pairs tagging the session, e.g. incident=INC-1234, carried into the audit logs and
+	// the metrics of the agent to cross-reference the sessions. The agent may refuse them by its policy.
+	Tags map[string]string
+
+	// Env are the environment variables forwarded to the command, e.g. TERM and LANG, so that the colors, the line
+	// drawing and the non-ASCII input work with the local terminal, or the custom ones of the command. The agent
+	// drops the ones not allowed by its policy.
+	Env map[string]string
+
 	// CPU resource for limiting the commands, e.g. 0.5, 2.0.
 	Cpus float64
 
 	// Memory resource in MB for limiting the commands, e.g. 500, 2048.
 	MemoryMB int
 
+	// TCPKeepAlive specifies the keep-alive period of the TCP connection to agent.
+	// Defaults to 15 seconds if zero, and keep-alive is disabled if negative.
+	TCPKeepAlive time.Duration
+
+	// PingPeriod specifies the period of sending websocket pings to agent, pings are disabled if not positive.
+	PingPeriod time.Duration
+
+	// ReadBufferSize and WriteBufferSize specify the websocket I/O buffer sizes in bytes,
+	// defaults to 4096 bytes if zero.
+	ReadBufferSize  int
+	WriteBufferSize int
+
+	// FrameProfile asks the agent for the size of the output frames, protocol.FrameProfileBulk for the larger frames of
+	// the agent's bulk_frame_size, which suit large outputs, e.g. cat of large files. Copies are bulk unless set.
+	FrameProfile string
+
+	// FrameSize asks the agent for the size in bytes of the output frames instead of the profile, clamped by the agent's
+	// limits. The agent's default if not positive.
+	FrameSize int
+
+	// Timeout specifies the maximum duration of the command, the session is closed and the command is killed
+	// once it's exceeded, and then the reads of the session return ErrCommandTimeout. No limit if not positive.
+	Timeout time.Duration
+
 	// DisableCleanMode is set to false as default.
 	// Disable clean mode means remote cmd will be executed via "docker exec" for container,
 	// and "ssh" for physical host.
 	DisableCleanMode bool
+
+	// ExtraHeaders are added to the handshake request, e.g. trace IDs or auth tokens of the embedding platform.
+	// The headers of the trust-tunnel protocol take precedence over them.
+	ExtraHeaders http.Header
+
+	// DialerCustomizer is called with the websocket dialer before dialing the agent, e.g. to customize the TLS
+	// settings or the proxy. It's called for every dial, including the ones following redirects.
+	DialerCustomizer func(*websocket.Dialer)
+
+	// DialTransport dials the agent with another websocket implementation instead of the dialer of gorilla,
+	// e.g. DialBrowserWebSocket in WebAssembly. The handshake response may be nil if it's unavailable, and
+	// the connection, TLS and dialer settings don't apply to it.
+	DialTransport func(url string, header http.Header) (Transport, *http.Response, error)
+
+	// CommandFrameThreshold is the length in bytes of the command in the headers, over which the command is sent in
+	// the command frame instead. It requires the agents serving the protocol version 2. Defaults to
+	// DefaultCommandFrameThreshold if zero, and the command is sent in the headers if negative, unless
+	// ConfirmCommand is set.
+	CommandFrameThreshold int
+
+	// MFAPrompt answers the MFA challenge of the agent with the assertion, e.g. the TOTP code typed by the user.
+	// The sessions requiring MFA fail if it's nil.
+	MFAPrompt func(challenge *MFAChallenge) (string, error)
+
+	// ConfirmCommand confirms the command as it's resolved by the agent before it's run, e.g. with the shell
+	// resolved and the login directory entered, by returning true. The command is always sent in the command frame
+	// then, and only to the agents serving the protocol version 3, so that the other agents never run it.
+	// The transports without the response headers can't confirm commands.
+	ConfirmCommand func(confirmation *Confirmation) (bool, error)
+
+	// copyRequest is set by Copy to copy the files instead of running Command.
+	copyRequest *CopyRequest
+
+	// forwardRequest is set by Forward to forward the connections instead of running Command.
+	forwardRequest *ForwardRequest
+}
+
+// Transport is the websocket connection of a session, implemented by *websocket.Conn of gorilla.
+// It can be swapped by Client.DialTransport, e.g. for the WebSocket API of browsers, so that the framing,
+// close and exit code handling of sessions are shared. The message types and the close errors of gorilla are used.
+type Transport interface {
+	// ReadMessage reads the next data message, the close handler is called once the close frame is received,
+	// and *websocket.CloseError is returned then.
+	ReadMessage() (messageType int, p []byte, err error)
+
+	// WriteMessage writes a data message.
+	WriteMessage(messageType int, data []byte) error
+
+	// WriteControl writes a control message, it may be a no-op for pings if the implementation can't send them.
+	WriteControl(messageType int, data []byte, deadline time.Time) error
+
+	// SetCloseHandler sets the handler of the close frame from the agent.
+	SetCloseHandler(h func(code int, text string) error)
+
+	// Close closes the connection.
+	Close() error
 }
 
 // Session represents a bidirectional RPC session for interacting with the target host.
 type Session interface {
+	// Read reads the output of the remote command. Once the output is drained, it returns io.EOF
+	// if the command exited, ErrCommandTimeout if it's killed on timeout, or *ConnectionClosedError
+	// if the connection is closed abnormally.
 	io.ReadWriteCloser
 
-	// ReadStderr reads error output from the remote command.
+	// ReadStderr reads error output from the remote command, it returns the same errors as Read.
 	ReadStderr(p []byte) (n int, err error)
 
 	// Resize adjusts the size of the remote terminal.
@@ -138,3 +550,39 @@ type Session interface {
 	// ExitCode returns the exit code of the remote command.
 	ExitCode() int
 }
+
+// StdinCloser is implemented by the sessions whose standard input can be closed alone, e.g. the ones
+// started by Client. It's kept out of Session so that the existing implementations of Session still satisfy it.
+type StdinCloser interface {
+	// CloseStdin sends an explicit close message to the agent, which closes the standard input of the remote
+	// command after the written input is consumed, so that the command reads EOF, while the output can still be read.
+	CloseStdin() error
+}
+
+// CloseStdin closes the standard input of the remote command of session if it implements StdinCloser,
+// otherwise it returns ErrCloseStdinUnsupported.
+func CloseStdin(session Session) error {
+	if closer, ok := session.(StdinCloser); ok {
+		return closer.CloseStdin()
+	}
+
+	return ErrCloseStdinUnsupported
+}
+
+// TerminationReporter is implemented by the sessions which report why they're terminated, e.g. the ones
+// started by Client. It's kept out of Session for the same reason as StdinCloser.
+type TerminationReporter interface {
+	// TerminationReason returns why the session is terminated after it's closed,
+	// it's empty if the agent doesn't report the reason.
+	TerminationReason() TerminationReason
+}
+
+// SessionTerminationReason returns why session is terminated if it implements TerminationReporter,
+// otherwise it's empty.
+func SessionTerminationReason(session Session) TerminationReason {
+	if reporter, ok := session.(TerminationReporter); ok {
+		return reporter.TerminationReason()
+	}
+
+	return ""
+}